@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crawler"
+	"crawler/crawler_policies"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"monitoring/logging"
+	"net/http"
+	"os"
+	"os/signal"
+	"pkg/domain_costs"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// logger reports what the crawler fetches and why it stops
+var logger = logging.Component("crawler/cmd/crawler")
+
+// maxPageBytes bounds the body read from a single page
+const maxPageBytes = 4 << 20
+
+var (
+	titlePattern  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	scriptPattern = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	tagPattern    = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// crawler fetches the URLs listed in -seeds with -workers workers, held to
+// -rate requests a second, and writes every page to the docserver at
+// -docserver. Fetches are charged to the crawl budget of their domain in a
+// cost ledger, which -budget pages a period. Every -period the ledger is
+// closed, and domains whose pages used at least -trim-bytes of crawl and
+// index without being returned by a search have their budget cut by
+// -trim-factor. Searches are only counted once searchd reports hits with
+// -cost-ledger, so until then no domain is cut. The ledger is served on
+// -admin at /admin/domain-costs to callers presenting -admin-token: GET
+// reports it, and POST takes the costs docserver and searchd report.
+// Logs are written to standard error from the -log-level of each component.
+func main() {
+	seedsPath := flag.String("seeds", "", "file of URLs to crawl, one a line")
+	workers := flag.Int("workers", 4, "pages fetched at once")
+	rate := flag.Int("rate", 5, "requests a second across all workers")
+	queueSize := flag.Int("queue", 100000, "most URLs waiting to be crawled")
+	docserverURL := flag.String("docserver", "http://localhost:8080", "URL of the docserver pages are written to")
+	docserverToken := flag.String("docserver-token", os.Getenv("DOCSERVER_WRITE_TOKEN"), "write token of the docserver")
+	budget := flag.Int("budget", 1000, "pages each domain may crawl a period; 0 leaves domains unlimited")
+	period := flag.Duration("period", 24*time.Hour, "length of an accounting period of the cost ledger")
+	trimBytes := flag.Int64("trim-bytes", 10<<20, "bytes of crawl and index a domain must use in a period without search hits to have its budget cut")
+	trimFactor := flag.Float64("trim-factor", 0.5, "factor the budget of a domain without search hits is multiplied by")
+	minBudget := flag.Int("min-budget", 10, "smallest budget a domain is cut to")
+	adminAddr := flag.String("admin", ":8090", "address to serve the cost ledger on at /admin/domain-costs")
+	adminToken := flag.String("admin-token", os.Getenv("COST_LEDGER_TOKEN"), "bearer token the admin API takes")
+	logLevel := flag.String("log-level", "info", "least severe level logged (debug, info, warn, error), optionally followed by levels for components, such as warn,crawler=debug")
+	logFormat := flag.String("log-format", logging.FormatText, "format logs are written to standard error in: text or json")
+	flag.Parse()
+
+	level, levels, err := logging.ParseLevels(*logLevel)
+	if err != nil {
+		fatal("Invalid log level", "error", err)
+	}
+	if err := logging.Setup(os.Stderr, logging.Options{Level: level, Levels: levels, Format: *logFormat}); err != nil {
+		fatal("Failed to set up logging", "error", err)
+	}
+	if *seedsPath == "" {
+		fatal("No -seeds given")
+	}
+	if *adminToken == "" {
+		fatal("No -admin-token given; the cost ledger takes costs only from callers presenting it")
+	}
+
+	queue := crawler.NewURLQueue(*queueSize)
+	seeds, err := readSeeds(*seedsPath)
+	if err != nil {
+		fatal("Failed to read seeds", "path", *seedsPath, "error", err)
+	}
+	for _, seed := range seeds {
+		if err := queue.AddURL(seed); err != nil {
+			fatal("Failed to queue seed", "url", seed, "error", err)
+		}
+	}
+
+	ledger := domain_costs.NewLedger(*budget)
+	rateLimiter := crawler_policies.NewRateLimiter(*rate, time.Second, time.Second)
+	fetcher := crawler_policies.NewCrawler(rateLimiter)
+	fetcher.SetLedger(ledger)
+	writer := &pageWriter{
+		url:    strings.TrimSuffix(*docserverURL, "/") + "/documents",
+		token:  *docserverToken,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	stopPeriods := make(chan struct{})
+	policy := domain_costs.TrimPolicy{MinBytes: *trimBytes, Factor: *trimFactor, MinBudget: *minBudget}
+	go ledger.RunPeriods(*period, policy, stopPeriods)
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/domain-costs", requireToken(*adminToken, ledger.Handler()))
+	server := &http.Server{
+		Addr:              *adminAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		logger.Info("Serving the cost ledger", "addr", *adminAddr)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			errs <- err
+		}
+	}()
+
+	queue.ProcessWorkerPool(*workers, func(url string) {
+		crawlPage(fetcher, rateLimiter, writer, url)
+	})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		logger.Info("Shutting down", "signal", sig.String())
+	case err := <-errs:
+		logger.Error("Server failed", "error", err)
+	}
+	close(stopPeriods)
+	fetcher.GracefulShutdown()
+	server.Close()
+}
+
+// crawlPage fetches url, waiting out the rate limit, and writes the page
+func crawlPage(fetcher *crawler_policies.Crawler, rateLimiter *crawler_policies.RateLimiter, writer *pageWriter, url string) {
+	for {
+		resp, err := fetcher.FetchURL(url)
+		if err != nil && err.Error() == "rate limit exceeded" {
+			rateLimiter.CooldownPeriod()
+			continue
+		}
+		if err != nil {
+			logger.Warn("Failed to fetch page", "url", url, "error", err)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxPageBytes))
+		resp.Body.Close()
+		if err != nil {
+			logger.Warn("Failed to read page", "url", url, "error", err)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			logger.Debug("Skipping page", "url", url, "status", resp.StatusCode)
+			return
+		}
+		if err := writer.write(url, body); err != nil {
+			logger.Warn("Failed to write page", "url", url, "error", err)
+		}
+		return
+	}
+}
+
+// pageWriter writes crawled pages to docserver, which charges parsing and
+// indexing them to their domain when it reports to the ledger
+type pageWriter struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// write stores the text of a page as a document with the page's URL
+func (w *pageWriter) write(url string, page []byte) error {
+	doc := map[string]any{
+		"id":       url,
+		"title":    pageTitle(page),
+		"content":  pageText(page),
+		"metadata": map[string]string{"url": url},
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("docserver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// pageTitle returns the text of the page's title element
+func pageTitle(page []byte) string {
+	match := titlePattern.FindSubmatch(page)
+	if match == nil {
+		return ""
+	}
+	return strings.TrimSpace(html.UnescapeString(string(match[1])))
+}
+
+// pageText returns the page's text without markup, scripts or styles
+func pageText(page []byte) string {
+	text := scriptPattern.ReplaceAll(page, nil)
+	text = tagPattern.ReplaceAll(text, []byte(" "))
+	return strings.Join(strings.Fields(html.UnescapeString(string(text))), " ")
+}
+
+// readSeeds reads the URLs of a seeds file, skipping blank lines and
+// comments starting with #
+func readSeeds(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var seeds []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			seeds = append(seeds, line)
+		}
+	}
+	return seeds, scanner.Err()
+}
+
+// requireToken serves next only to requests presenting token as bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -3,7 +3,9 @@ package crawler_policies
 import (
 	"context"
 	"errors"
+	"io"
 	"net/http"
+	"pkg/domain_costs"
 	"sync"
 	"time"
 )
@@ -110,6 +112,7 @@ func (rl *RateLimiter) CooldownPeriod() {
 // Crawler defines a structure to manage crawling processes
 type Crawler struct {
 	rateLimiter *RateLimiter
+	ledger      *domain_costs.Ledger // Nil unless fetches are charged to their domains
 }
 
 // NewCrawler initializes a new crawler with a rate limiting policy
@@ -119,21 +122,55 @@ func NewCrawler(rateLimiter *RateLimiter) *Crawler {
 	}
 }
 
-// FetchURL fetches the content of a URL with rate limiting applied
+// SetLedger charges every fetch to the crawl budget of its domain in
+// ledger, and the bytes of its body once it is closed
+func (c *Crawler) SetLedger(ledger *domain_costs.Ledger) {
+	c.ledger = ledger
+}
+
+// FetchURL fetches the content of a URL with rate limiting applied. With a
+// ledger set, URLs whose domain has used up its budget are not fetched.
 func (c *Crawler) FetchURL(url string) (*http.Response, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	if c.ledger != nil && !c.ledger.AllowCrawl(url) {
+		return nil, errors.New("crawl budget exhausted")
+	}
 
 	resp, err := c.rateLimiter.EnforceRateLimit(req)
 	if err != nil {
 		return nil, err
 	}
+	if c.ledger != nil {
+		resp.Body = &chargedBody{ReadCloser: resp.Body, ledger: c.ledger, url: url}
+	}
 
 	return resp, nil
 }
 
+// chargedBody counts the bytes read from a response body and records them
+// against the URL's domain when the body is closed
+type chargedBody struct {
+	io.ReadCloser
+	ledger *domain_costs.Ledger
+	url    string
+	bytes  int64
+	once   sync.Once
+}
+
+func (b *chargedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+func (b *chargedBody) Close() error {
+	b.once.Do(func() { b.ledger.RecordCrawl(b.url, b.bytes) })
+	return b.ReadCloser.Close()
+}
+
 // GracefulShutdown allows the crawler to shutdown while respecting rate limits
 func (c *Crawler) GracefulShutdown() {
 	c.rateLimiter.StopRateLimiter()
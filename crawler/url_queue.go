@@ -2,11 +2,14 @@ package crawler
 
 import (
 	"errors"
-	"fmt"
+	"monitoring/logging"
 	"sync"
 	"time"
 )
 
+// logger reports the URLs crawled, one record a URL, so it is sampled
+var logger = logging.Sampled(logging.Component("crawler"), logging.DefaultSampling)
+
 // URLQueue represents a thread-safe queue for managing URLs to be crawled
 type URLQueue struct {
 	queue    []string
@@ -87,7 +90,7 @@ func (q *URLQueue) ProcessURLs(workerID int, processFunc func(string)) {
 	for {
 		url, err := q.PopURL()
 		if err != nil {
-			fmt.Printf("Worker %d: Error popping URL: %v\n", workerID, err)
+			logger.Error("Failed to pop URL", "worker", workerID, "error", err)
 			return
 		}
 
@@ -105,7 +108,7 @@ func (q *URLQueue) ProcessWorkerPool(workerCount int, processFunc func(string))
 
 // Crawl simulates crawling a URL
 func Crawl(url string) {
-	fmt.Printf("Crawling URL: %s\n", url)
+	logger.Info("Crawling URL", "url", url)
 	time.Sleep(1 * time.Second) // Simulate time delay for crawling
 }
 
@@ -126,7 +129,7 @@ func main() {
 	for _, url := range urls {
 		err := queue.AddURL(url)
 		if err != nil {
-			fmt.Printf("Error adding URL: %v\n", err)
+			logger.Error("Failed to add URL", "error", err)
 		}
 	}
 
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"distributed/fault_tolerance"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"monitoring/logging"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// logger reports why clusterctl fails
+var logger = logging.Component("distributed/cmd/clusterctl")
+
+// clusterctl prints the state of a cluster as served by its /cluster/status
+// endpoint: node liveness, replication lag, shard placement and recent
+// failovers
+func main() {
+	addr := flag.String("addr", "localhost:8082", "host:port serving /cluster/status")
+	asJSON := flag.Bool("json", false, "print the raw status as JSON")
+	timeout := flag.Duration("timeout", 5*time.Second, "request timeout")
+	flag.Parse()
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get(fmt.Sprintf("http://%s/cluster/status", *addr))
+	if err != nil {
+		fatal("Failed to fetch cluster status", "error", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fatal("Cluster status request failed", "status", resp.StatusCode)
+	}
+	var status fault_tolerance.ClusterStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		fatal("Malformed cluster status", "error", err)
+	}
+
+	if *asJSON {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		out.Encode(status)
+		return
+	}
+	printStatus(status)
+}
+
+func printStatus(status fault_tolerance.ClusterStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Cluster status at %s\n\n", status.Time.Format(time.RFC3339))
+	fmt.Fprintln(w, "NODE\tADDRESS\tALIVE\tROLE\tTERM\tKEYS")
+	for _, node := range status.Nodes {
+		role := node.Role
+		if node.Witness {
+			role += " (witness)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%d\t%d\n", node.ID, node.Address, node.Alive, role, node.Term, node.Keys)
+	}
+
+	if replication := status.Replication; replication != nil {
+		fmt.Fprintf(w, "\nLeader %s, term %d, last index %d, commit index %d\n",
+			replication.Leader, replication.Term, replication.LastIndex, replication.CommitIndex)
+		fmt.Fprintln(w, "REPLICA\tMATCH\tLAG\tLAST CONTACT")
+		for _, replica := range replication.Replicas {
+			contact := "never"
+			if !replica.LastContact.IsZero() {
+				contact = time.Since(replica.LastContact).Round(time.Millisecond).String() + " ago"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", replica.ID, replica.MatchIndex, replica.Lag, contact)
+		}
+	}
+
+	if len(status.Shards) > 0 {
+		indexes := make([]string, 0, len(status.Shards))
+		for index := range status.Shards {
+			indexes = append(indexes, index)
+		}
+		sort.Strings(indexes)
+		fmt.Fprintln(w, "\nINDEX\tSHARD\tRANGE\tREPLICAS")
+		for _, index := range indexes {
+			for _, shard := range status.Shards[index] {
+				fmt.Fprintf(w, "%s\t%s\t[%d, %d)\t%s\n", index, shard.ID, shard.Start, shard.End, strings.Join(shard.Replicas, ", "))
+			}
+		}
+	}
+
+	if len(status.Failovers) > 0 {
+		fmt.Fprintln(w, "\nFAILOVER\tINDEX\tSHARD\tFROM\tTO")
+		for _, event := range status.Failovers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", event.Time.Format(time.RFC3339), event.Index, event.ShardID, event.Failed, event.Promoted)
+		}
+	}
+
+	for _, message := range status.Errors {
+		fmt.Fprintf(w, "\nwarning: %s\n", message)
+	}
+}
+
+// fatal logs why clusterctl failed and exits
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -3,10 +3,25 @@ package distributed_crawling
 import (
 	"context"
 	"fmt"
-	"log"
+	"monitoring/logging"
+	"monitoring/tracing"
 	"net/http"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer traces the pages fetched, a fetch span each
+var tracer = tracing.Tracer("distributed/distributed_crawling")
+
+// logger reports crawls starting, stopping and failing, and the sync of
+// crawled data between nodes. URLs are logged with urlLogger at debug
+// level, sampled as there is one a page.
+var (
+	logger    = logging.Component("distributed/distributed_crawling")
+	urlLogger = logging.Sampled(logger, logging.DefaultSampling)
 )
 
 // CrawlerCoordinator is responsible for coordinating multiple crawler instances
@@ -47,7 +62,7 @@ func NewCrawlerCoordinator(urlQueue []string, maxCrawlers int) *CrawlerCoordinat
 
 // Start initializes the crawling process with the available crawlers
 func (cc *CrawlerCoordinator) Start() {
-	log.Println("Starting CrawlerCoordinator")
+	logger.Info("Starting crawler coordinator", "crawlers", cc.maxCrawlers, "urls", len(cc.urlQueue))
 
 	for i := 0; i < cc.maxCrawlers; i++ {
 		crawler := &Crawler{id: i, active: false}
@@ -58,9 +73,9 @@ func (cc *CrawlerCoordinator) Start() {
 
 	select {
 	case <-cc.taskComplete:
-		log.Println("All tasks completed.")
+		logger.Info("All tasks completed")
 	case err := <-cc.errorChan:
-		log.Printf("Error occurred during crawling: %v\n", err)
+		logger.Error("Crawling failed", "error", err)
 		cc.cancelFunc()
 	}
 
@@ -83,10 +98,10 @@ func (cc *CrawlerCoordinator) assignTasks() {
 	for _, url := range cc.urlQueue {
 		select {
 		case <-cc.ctx.Done():
-			log.Println("Crawling process stopped")
+			logger.Info("Crawling process stopped")
 			return
 		case taskCh <- url:
-			log.Printf("Assigned URL to crawler: %s", url)
+			urlLogger.Debug("Assigned URL to crawler", "url", url)
 		}
 	}
 
@@ -101,11 +116,11 @@ func (cc *CrawlerCoordinator) runCrawler(crawler *Crawler, taskCh <-chan string)
 	for {
 		select {
 		case <-cc.ctx.Done():
-			log.Printf("Crawler %d stopped", crawler.id)
+			logger.Debug("Crawler stopped", "crawler", crawler.id)
 			return
 		case url, ok := <-taskCh:
 			if !ok {
-				log.Printf("Crawler %d no more tasks.", crawler.id)
+				logger.Debug("Crawler has no more tasks", "crawler", crawler.id)
 				return
 			}
 			crawler.active = true
@@ -115,21 +130,33 @@ func (cc *CrawlerCoordinator) runCrawler(crawler *Crawler, taskCh <-chan string)
 	}
 }
 
-// crawl fetches the URL and stores the result
+// crawl fetches the URL and stores the result, in a fetch span. Trace
+// context isn't sent to the sites crawled, which aren't ours.
 func (cc *CrawlerCoordinator) crawl(url string, crawlerID int) {
-	log.Printf("Crawler %d fetching URL: %s", crawlerID, url)
-	resp, err := http.Get(url)
+	urlLogger.Debug("Fetching URL", "crawler", crawlerID, "url", url)
+	ctx, span := tracer.Start(cc.ctx, "fetch", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("url.full", url), attribute.Int("crawler.id", crawlerID)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		tracing.End(span, err)
+		cc.errorChan <- fmt.Errorf("crawler %d failed to fetch %s: %v", crawlerID, url, err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
+		tracing.End(span, err)
 		cc.errorChan <- fmt.Errorf("crawler %d failed to fetch %s: %v", crawlerID, url, err)
 		return
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	span.End()
 
 	cc.resultMutex.Lock()
 	cc.results[url] = resp.Status
 	cc.resultMutex.Unlock()
 
-	log.Printf("Crawler %d successfully fetched: %s", crawlerID, url)
+	urlLogger.Debug("Fetched URL", "crawler", crawlerID, "url", url, "status", resp.StatusCode)
 }
 
 // Stop gracefully stops the crawling process
@@ -185,7 +212,7 @@ func main() {
 
 	results := coordinator.GetResults()
 	for url, status := range results {
-		fmt.Printf("URL: %s, Status: %s\n", url, status)
+		logger.Info("Crawled URL", "url", url, "status", status)
 	}
 
 	coordinator.Stop()
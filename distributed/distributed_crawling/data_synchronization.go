@@ -1,13 +1,35 @@
 package distributed_crawling
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"net/rpc"
 	"sync"
 	"time"
 )
 
+// SyncConfig bounds the sync RPCs sent to peers, so one slow peer doesn't
+// hold up replication to the others
+type SyncConfig struct {
+	DialTimeout time.Duration // Deadline for connecting to a peer
+	CallTimeout time.Duration // Deadline for a peer to answer a sync
+	Attempts    int           // Tries per peer before giving up
+	Backoff     time.Duration // Wait before the first retry, doubling after each
+	MaxBackoff  time.Duration
+}
+
+// DefaultSyncConfig tries each peer three times within about ten seconds
+var DefaultSyncConfig = SyncConfig{
+	DialTimeout: 2 * time.Second,
+	CallTimeout: 2 * time.Second,
+	Attempts:    3,
+	Backoff:     250 * time.Millisecond,
+	MaxBackoff:  2 * time.Second,
+}
+
 // SyncData represents the data to be synchronized
 type SyncData struct {
 	URL         string
@@ -23,6 +45,9 @@ type SynchronizationService struct {
 	peers       map[string]string
 	dataStore   map[string]SyncData
 	syncChannel chan SyncData
+	fence       *Fence
+	token       uint64
+	config      SyncConfig
 }
 
 // NewSynchronizationService creates a new service
@@ -32,12 +57,22 @@ func NewSynchronizationService(nodeID string, peers map[string]string) *Synchron
 		peers:       peers,
 		dataStore:   make(map[string]SyncData),
 		syncChannel: make(chan SyncData, 100),
+		config:      DefaultSyncConfig,
 	}
 }
 
+// SetConfig sets the timeouts and retries of sync RPCs sent to peers
+func (s *SynchronizationService) SetConfig(config SyncConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+}
+
 // SyncRequest represents a sync request between nodes
 type SyncRequest struct {
 	Data SyncData
+	// Token is the sender's fencing token, checked when the service has a fence
+	Token uint64
 }
 
 // SyncResponse represents the result of a sync operation
@@ -45,6 +80,22 @@ type SyncResponse struct {
 	Success bool
 }
 
+// SetFence makes the service reject synced writes carrying fencing tokens
+// older than the newest it has seen
+func (s *SynchronizationService) SetFence(fence *Fence) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fence = fence
+}
+
+// SetToken sets the fencing token sent along with the node's writes, taken
+// from the lock it holds
+func (s *SynchronizationService) SetToken(token uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
 // AddData adds new data to the local node and initiates sync with peers
 func (s *SynchronizationService) AddData(data SyncData) {
 	s.mu.Lock()
@@ -52,51 +103,151 @@ func (s *SynchronizationService) AddData(data SyncData) {
 
 	// Add data to the local store
 	s.dataStore[data.URL] = data
-	log.Printf("Node %s: Added data for URL: %s", s.nodeID, data.URL)
+	urlLogger.Debug("Added data for URL", "node", s.nodeID, "url", data.URL)
 
 	// Sync with peers asynchronously
-	go s.syncWithPeers(data)
+	go s.syncWithPeers(data, s.token)
 }
 
-// syncWithPeers sends data to all connected peers
-func (s *SynchronizationService) syncWithPeers(data SyncData) {
+// syncWithPeers sends data to all connected peers at once
+func (s *SynchronizationService) syncWithPeers(data SyncData, token uint64) {
+	s.mu.Lock()
+	config := s.config
+	s.mu.Unlock()
+
+	req := &SyncRequest{Data: data, Token: token}
+	var wg sync.WaitGroup
 	for peerID, address := range s.peers {
-		log.Printf("Node %s: Syncing with peer %s at %s", s.nodeID, peerID, address)
+		wg.Add(1)
+		go func(peerID, address string) {
+			defer wg.Done()
+			urlLogger.Debug("Syncing with peer", "node", s.nodeID, "peer", peerID, "address", address)
+			if err := s.syncPeer(address, req, config); err != nil {
+				logger.Warn("Sync with peer failed", "node", s.nodeID, "peer", peerID, "error", err)
+			} else {
+				urlLogger.Debug("Sync with peer succeeded", "node", s.nodeID, "peer", peerID)
+			}
+		}(peerID, address)
+	}
+	wg.Wait()
+}
 
-		client, err := rpc.Dial("tcp", address)
-		if err != nil {
-			log.Printf("Node %s: Failed to connect to peer %s: %v", s.nodeID, peerID, err)
-			continue
+// syncPeer sends one sync request, retrying transient failures with backoff
+func (s *SynchronizationService) syncPeer(address string, req *SyncRequest, config SyncConfig) error {
+	attempts := config.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := config.Backoff
+	for attempt := 1; ; attempt++ {
+		err := callPeer(address, req, config)
+		if err == nil || !isTransientSyncError(err) {
+			return err
 		}
-
-		req := &SyncRequest{Data: data}
-		var res SyncResponse
-		err = client.Call("SynchronizationService.SyncData", req, &res)
-		if err != nil || !res.Success {
-			log.Printf("Node %s: Sync failed with peer %s: %v", s.nodeID, peerID, err)
-		} else {
-			log.Printf("Node %s: Sync succeeded with peer %s", s.nodeID, peerID)
+		if attempt == attempts {
+			if attempts == 1 {
+				return err
+			}
+			return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+		}
+		if backoff > 0 {
+			time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
 		}
-		client.Close()
+		backoff *= 2
+		if config.MaxBackoff > 0 && backoff > config.MaxBackoff {
+			backoff = config.MaxBackoff
+		}
+	}
+}
+
+// errSyncTimeout is returned when a peer doesn't answer within CallTimeout
+var errSyncTimeout = errors.New("sync call timed out")
+
+// errSyncRejected is returned when a peer answered but didn't take the data
+var errSyncRejected = errors.New("sync rejected by peer")
+
+// callPeer makes a single sync RPC within the configured deadlines
+func callPeer(address string, req *SyncRequest, config SyncConfig) error {
+	conn, err := net.DialTimeout("tcp", address, config.DialTimeout)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	if config.CallTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.CallTimeout))
+	}
+
+	var res SyncResponse
+	call := client.Go("SynchronizationService.SyncData", req, &res, make(chan *rpc.Call, 1))
+	var timeout <-chan time.Time
+	if config.CallTimeout > 0 {
+		timer := time.NewTimer(config.CallTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-call.Done:
+	case <-timeout:
+		return errSyncTimeout
+	}
+	if call.Error != nil {
+		return call.Error
 	}
+	if !res.Success {
+		return errSyncRejected
+	}
+	return nil
+}
+
+// isTransientSyncError reports whether a failed sync is worth retrying.
+// Errors returned by the peer's handler, like a stale fencing token, and
+// explicit rejections would fail the same way again.
+func isTransientSyncError(err error) bool {
+	var serverErr rpc.ServerError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &serverErr), errors.Is(err, errSyncRejected):
+		return false
+	case errors.Is(err, errSyncTimeout), errors.Is(err, rpc.ErrShutdown), errors.As(err, &netErr),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	return false
 }
 
 // SyncData receives sync data from a peer
 func (s *SynchronizationService) SyncData(req *SyncRequest, res *SyncResponse) error {
+	s.mu.Lock()
+	fence := s.fence
+	s.mu.Unlock()
+	if fence == nil {
+		return s.syncData(req, res)
+	}
+	// The fence stays held while the write applies, so a newer holder can't
+	// be overtaken between the check and the write
+	err := fence.Guard(req.Token, func() error { return s.syncData(req, res) })
+	if err != nil {
+		logger.Warn("Rejected sync of URL", "node", s.nodeID, "url", req.Data.URL, "error", err)
+	}
+	return err
+}
+
+func (s *SynchronizationService) syncData(req *SyncRequest, res *SyncResponse) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// Check if data is already up-to-date
 	existingData, exists := s.dataStore[req.Data.URL]
 	if exists && existingData.ContentHash == req.Data.ContentHash {
-		log.Printf("Node %s: Data for URL %s already up-to-date", s.nodeID, req.Data.URL)
+		urlLogger.Debug("Data for URL already up to date", "node", s.nodeID, "url", req.Data.URL)
 		res.Success = true
 		return nil
 	}
 
 	// Update local data store
 	s.dataStore[req.Data.URL] = req.Data
-	log.Printf("Node %s: Synchronized data for URL %s", s.nodeID, req.Data.URL)
+	urlLogger.Debug("Synchronized data for URL", "node", s.nodeID, "url", req.Data.URL)
 	res.Success = true
 
 	return nil
@@ -109,72 +260,149 @@ func (s *SynchronizationService) Start(address string) error {
 	if err != nil {
 		return err
 	}
-	log.Printf("Node %s: Synchronization service started at %s", s.nodeID, address)
+	logger.Info("Synchronization service started", "node", s.nodeID, "address", address)
 
 	// Accept incoming connections
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Node %s: Connection error: %v", s.nodeID, err)
+			logger.Warn("Failed to accept connection", "node", s.nodeID, "error", err)
 			continue
 		}
 		go rpc.ServeConn(conn)
 	}
 }
 
-// DistributedLock for synchronization
+// DistributedLock for synchronization. The lock is leased: a holder that
+// stops renewing it, e.g. because it paused or was partitioned away, loses
+// it once the lease expires. Every acquisition hands out a fencing token
+// larger than all before it, which the holder sends along with its writes so
+// a Fence can turn away a former holder that doesn't know it lost the lock.
 type DistributedLock struct {
 	mu         sync.Mutex
 	lockedBy   string
-	lockChan   chan string
 	lockStatus bool
+	lease      time.Duration
+	expires    time.Time
+	token      uint64        // Fencing token of the latest acquisition
+	released   chan struct{} // Closed when the lock is released
 }
 
-// NewDistributedLock initializes a new distributed lock
+// DefaultLockLease is how long a lock is held without renewal
+const DefaultLockLease = 30 * time.Second
+
+// NewDistributedLock initializes a new distributed lock with the default lease
 func NewDistributedLock() *DistributedLock {
+	return NewLeasedLock(DefaultLockLease)
+}
+
+// NewLeasedLock initializes a lock whose holders must renew it within lease
+func NewLeasedLock(lease time.Duration) *DistributedLock {
 	return &DistributedLock{
-		lockChan:   make(chan string, 1),
-		lockStatus: false,
+		lease:    lease,
+		released: make(chan struct{}),
+	}
+}
+
+// expireLocked frees a lock whose lease ran out; callers hold mu
+func (dl *DistributedLock) expireLocked(now time.Time) {
+	if dl.lockStatus && !now.Before(dl.expires) {
+		logger.Warn("Lease on lock expired", "node", dl.lockedBy)
+		dl.releaseLocked()
 	}
 }
 
-// AcquireLock attempts to acquire the lock
-func (dl *DistributedLock) AcquireLock(nodeID string) bool {
+func (dl *DistributedLock) releaseLocked() {
+	dl.lockStatus = false
+	close(dl.released)
+	dl.released = make(chan struct{})
+}
+
+// AcquireLock attempts to acquire the lock, returning the fencing token the
+// holder must present with its writes
+func (dl *DistributedLock) AcquireLock(nodeID string) (uint64, bool) {
 	dl.mu.Lock()
 	defer dl.mu.Unlock()
 
+	now := time.Now()
+	dl.expireLocked(now)
 	if dl.lockStatus {
-		log.Printf("Node %s: Lock already acquired by %s", nodeID, dl.lockedBy)
-		return false
+		logger.Debug("Lock already acquired", "node", nodeID, "owner", dl.lockedBy)
+		return 0, false
 	}
 
 	// Acquire the lock
 	dl.lockedBy = nodeID
 	dl.lockStatus = true
-	dl.lockChan <- nodeID
-	log.Printf("Node %s: Lock acquired", nodeID)
+	dl.expires = now.Add(dl.lease)
+	dl.token++
+	logger.Info("Lock acquired", "node", nodeID, "token", dl.token)
+	return dl.token, true
+}
+
+// RenewLock extends the holder's lease. It fails once the lease has expired,
+// even if nobody else took the lock, since writes made with the token may
+// already have been fenced off.
+func (dl *DistributedLock) RenewLock(nodeID string, token uint64) bool {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	now := time.Now()
+	dl.expireLocked(now)
+	if !dl.heldLocked(nodeID, token) {
+		logger.Warn("Cannot renew lock", "node", nodeID, "token", token)
+		return false
+	}
+	dl.expires = now.Add(dl.lease)
 	return true
 }
 
 // ReleaseLock releases the lock
-func (dl *DistributedLock) ReleaseLock(nodeID string) bool {
+func (dl *DistributedLock) ReleaseLock(nodeID string, token uint64) bool {
 	dl.mu.Lock()
 	defer dl.mu.Unlock()
 
-	if dl.lockedBy != nodeID || !dl.lockStatus {
-		log.Printf("Node %s: Cannot release lock. Either not owner or lock not acquired", nodeID)
+	dl.expireLocked(time.Now())
+	if !dl.heldLocked(nodeID, token) {
+		logger.Warn("Cannot release lock, either not owner or lock not acquired", "node", nodeID)
 		return false
 	}
 
 	// Release the lock
-	dl.lockStatus = false
-	log.Printf("Node %s: Lock released", nodeID)
+	dl.releaseLocked()
+	logger.Info("Lock released", "node", nodeID)
 	return true
 }
 
-// WaitForLock waits until the lock is acquired by the current node
-func (dl *DistributedLock) WaitForLock(nodeID string) {
-	log.Printf("Node %s: Waiting for lock...", nodeID)
-	owner := <-dl.lockChan
-	log.Printf("Node %s: Lock acquired by %s", nodeID, owner)
+func (dl *DistributedLock) heldLocked(nodeID string, token uint64) bool {
+	return dl.lockStatus && dl.lockedBy == nodeID && dl.token == token
+}
+
+// Holder returns the node holding the lock and its fencing token
+func (dl *DistributedLock) Holder() (string, uint64, bool) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.expireLocked(time.Now())
+	return dl.lockedBy, dl.token, dl.lockStatus
+}
+
+// WaitForLock waits until the lock is acquired by the current node and
+// returns its fencing token
+func (dl *DistributedLock) WaitForLock(nodeID string) uint64 {
+	logger.Debug("Waiting for lock", "node", nodeID)
+	for {
+		if token, ok := dl.AcquireLock(nodeID); ok {
+			return token
+		}
+		dl.mu.Lock()
+		released, wait := dl.released, time.Until(dl.expires)
+		dl.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-released:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
 }
@@ -0,0 +1,60 @@
+package distributed_crawling
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrStaleToken is returned for writes made under a lock the writer no
+// longer holds
+var ErrStaleToken = errors.New("stale fencing token")
+
+// Fence guards a resource written by whoever holds a DistributedLock. It
+// remembers the newest fencing token it has seen and turns away older ones,
+// so a holder that paused past its lease can't overwrite the work of the
+// node that took the lock over.
+type Fence struct {
+	mu      sync.Mutex
+	highest uint64
+}
+
+// NewFence creates a fence that has seen no tokens
+func NewFence() *Fence {
+	return &Fence{}
+}
+
+// Check accepts token if no newer one has been seen and records it.
+// Token 0 is never handed out by a lock, so writes without one are rejected.
+func (f *Fence) Check(token uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checkLocked(token)
+}
+
+func (f *Fence) checkLocked(token uint64) error {
+	if token == 0 || token < f.highest {
+		return fmt.Errorf("%w: %d, newest is %d", ErrStaleToken, token, f.highest)
+	}
+	f.highest = token
+	return nil
+}
+
+// Guard runs write if token is accepted. The fence is held until write
+// returns, so a newer holder's writes can't be overtaken by an older one
+// that passed the check first.
+func (f *Fence) Guard(token uint64, write func() error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkLocked(token); err != nil {
+		return err
+	}
+	return write()
+}
+
+// Highest returns the newest token the fence has accepted
+func (f *Fence) Highest() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.highest
+}
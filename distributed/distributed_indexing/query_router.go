@@ -0,0 +1,278 @@
+package distributed_indexing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"monitoring/tracing"
+	"net/http"
+	"pkg/degradation"
+	"pkg/httpjson"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer traces the queries routed, a route span each with a shard-query
+// span per shard and a merge span
+var tracer = tracing.Tracer("distributed/distributed_indexing")
+
+// ErrNoShardsAnswered is returned when a query fails on every shard, or on
+// any shard while partial results aren't allowed
+var ErrNoShardsAnswered = errors.New("not enough shards answered")
+
+// Hit is one matching document
+type Hit struct {
+	DocID string  `json:"doc_id"`
+	Score float64 `json:"score"`
+	Shard string  `json:"shard"` // Set by the router
+	Node  string  `json:"node"`  // Set by the router
+}
+
+// ShardHits is a shard's answer to a query: its best hits, best first, and
+// how many documents of the shard matched in all
+type ShardHits struct {
+	Hits  []Hit `json:"hits"`
+	Total int   `json:"total"`
+}
+
+// ShardSearcher runs a query against one replica of a shard, returning at
+// most k hits. Scores must be comparable across shards, e.g. computed with
+// cluster-wide term statistics, since the router merges hits by score alone.
+type ShardSearcher interface {
+	SearchShard(ctx context.Context, node string, shard Shard, query string, k int) (ShardHits, error)
+}
+
+// SearcherFunc lets a plain function serve as a ShardSearcher
+type SearcherFunc func(ctx context.Context, node string, shard Shard, query string, k int) (ShardHits, error)
+
+// SearchShard calls f
+func (f SearcherFunc) SearchShard(ctx context.Context, node string, shard Shard, query string, k int) (ShardHits, error) {
+	return f(ctx, node, shard, query, k)
+}
+
+// QueryRouterConfig tunes how queries are fanned out
+type QueryRouterConfig struct {
+	// ShardTimeout bounds the time spent on each shard, across all the
+	// replicas tried
+	ShardTimeout time.Duration
+	// AllowPartial answers with the hits of the shards that did answer,
+	// flagged as degraded, when others fail. Without it a single failed
+	// shard fails the query.
+	AllowPartial bool
+}
+
+// DefaultQueryRouterConfig gives each shard two seconds and serves partial
+// results
+var DefaultQueryRouterConfig = QueryRouterConfig{ShardTimeout: 2 * time.Second, AllowPartial: true}
+
+// ShardFailure tells why a shard contributed nothing to a query
+type ShardFailure struct {
+	Shard string `json:"shard"`
+	Error string `json:"error"`
+}
+
+// SearchResponse is the merged answer of every shard of an index
+type SearchResponse struct {
+	Hits  []Hit `json:"hits"`
+	Total int   `json:"total"` // Matches across the shards that answered
+	// Degraded is set when some shards failed, so Hits may miss documents
+	// and Total undercounts
+	Degraded  bool           `json:"degraded"`
+	Shards    int            `json:"shards"`
+	Succeeded int            `json:"succeeded"`
+	Failures  []ShardFailure `json:"failures,omitempty"`
+	Epoch     uint64         `json:"epoch"` // Of the shard map the query was routed with
+	Took      time.Duration  `json:"took"`
+}
+
+// QueryRouter answers queries on an index by sending them to every shard
+// at once and merging what comes back
+type QueryRouter struct {
+	shardMap *ShardMap
+	searcher ShardSearcher
+	config   QueryRouterConfig
+	metrics  Metrics
+}
+
+// NewQueryRouter creates a router querying the shards of shardMap with
+// searcher. A zero ShardTimeout takes the default.
+func NewQueryRouter(shardMap *ShardMap, searcher ShardSearcher, config QueryRouterConfig) *QueryRouter {
+	if config.ShardTimeout <= 0 {
+		config.ShardTimeout = DefaultQueryRouterConfig.ShardTimeout
+	}
+	return &QueryRouter{shardMap: shardMap, searcher: searcher, config: config, metrics: noopMetrics{}}
+}
+
+// Search returns the k best hits for query across every shard of index.
+// Each shard is asked for its own k best, which is what it takes for the
+// merged top k to be exact however the hits are spread. A shard's replicas
+// are tried in order, primary first, until one answers or the shard's
+// deadline passes.
+func (r *QueryRouter) Search(ctx context.Context, index, query string, k int) (response SearchResponse, err error) {
+	if k <= 0 {
+		return SearchResponse{}, errors.New("k must be positive")
+	}
+	ctx, span := tracer.Start(ctx, "route", trace.WithAttributes(
+		attribute.String("search.index", index), attribute.Int("search.k", k)))
+	defer func() {
+		span.SetAttributes(attribute.Int("search.shards", response.Shards),
+			attribute.Int("search.shards_failed", len(response.Failures)),
+			attribute.Bool("search.degraded", response.Degraded))
+		tracing.End(span, err)
+	}()
+	start := time.Now()
+	shards, epoch, err := r.shardMap.shardsAtEpoch(index)
+	if err != nil {
+		return SearchResponse{}, err
+	}
+	span.SetAttributes(attribute.Int64("search.epoch", int64(epoch)))
+
+	answers := make([]ShardHits, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard Shard) {
+			defer wg.Done()
+			started := time.Now()
+			answers[i], errs[i] = r.searchShard(ctx, shard, query, k)
+			r.metrics.ObserveShardQuery(shard.ID, shardOutcome(errs[i]), time.Since(started))
+		}(i, shard)
+	}
+	wg.Wait()
+
+	response = SearchResponse{Shards: len(shards), Epoch: epoch}
+	var hits []Hit
+	for i, shard := range shards {
+		if errs[i] != nil {
+			response.Failures = append(response.Failures, ShardFailure{Shard: shard.ID, Error: errs[i].Error()})
+			continue
+		}
+		response.Succeeded++
+		response.Total += answers[i].Total
+		hits = append(hits, answers[i].Hits...)
+	}
+	if response.Succeeded == 0 || len(response.Failures) > 0 && !r.config.AllowPartial {
+		r.metrics.ObserveFanOut(OutcomeFailed, time.Since(start))
+		return response, fmt.Errorf("%w: %d of %d shards of %s failed, first %s: %s",
+			ErrNoShardsAnswered, len(response.Failures), len(shards), index,
+			response.Failures[0].Shard, response.Failures[0].Error)
+	}
+	response.Degraded = len(response.Failures) > 0
+	_, merge := tracer.Start(ctx, "merge", trace.WithAttributes(attribute.Int("search.hits", len(hits))))
+	response.Hits = mergeHits(hits, k)
+	merge.End()
+	response.Took = time.Since(start)
+	outcome := OutcomeOK
+	if response.Degraded {
+		outcome = OutcomeDegraded
+	}
+	r.metrics.ObserveFanOut(outcome, response.Took)
+	return response, nil
+}
+
+// searchShard queries the shard's replicas in order until one answers
+func (r *QueryRouter) searchShard(ctx context.Context, shard Shard, query string, k int) (answer ShardHits, err error) {
+	ctx, span := tracer.Start(ctx, "shard-query", trace.WithAttributes(attribute.String("search.shard", shard.ID)))
+	defer func() { tracing.End(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, r.config.ShardTimeout)
+	defer cancel()
+
+	if len(shard.Replicas) == 0 {
+		return ShardHits{}, errors.New("shard has no replicas")
+	}
+	for _, node := range shard.Replicas {
+		span.AddEvent("replica", trace.WithAttributes(attribute.String("search.node", node)))
+		answer, err = r.searcher.SearchShard(ctx, node, shard, query, k)
+		if err == nil {
+			for i := range answer.Hits {
+				answer.Hits[i].Shard = shard.ID
+				answer.Hits[i].Node = node
+			}
+			span.SetAttributes(attribute.String("search.node", node), attribute.Int("search.total", answer.Total))
+			return answer, nil
+		}
+		if ctx.Err() != nil {
+			return ShardHits{}, fmt.Errorf("replica on %s: %w", node, ctx.Err())
+		}
+	}
+	return ShardHits{}, fmt.Errorf("replica on %s: %w", shard.Replicas[len(shard.Replicas)-1], err)
+}
+
+// mergeHits keeps the k best hits, best first, ties broken by document ID
+// so the order is stable. A document answered by two shards, as can happen
+// while a shard is split or moved, is kept once with its best score.
+func mergeHits(hits []Hit, k int) []Hit {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].DocID < hits[j].DocID
+	})
+	merged := make([]Hit, 0, k)
+	seen := make(map[string]bool, len(hits))
+	for _, hit := range hits {
+		if len(merged) == k {
+			break
+		}
+		if seen[hit.DocID] {
+			continue
+		}
+		seen[hit.DocID] = true
+		merged = append(merged, hit)
+	}
+	return merged
+}
+
+// Handler serves queries over HTTP. Wrap it with tracing.Handler for the
+// spans of a query to join the trace of the request.
+//
+//	GET /search?index={index}&q={query}&k={k}  k defaults to 10
+//
+// Degraded responses say so in the X-Search-Degraded header too, as
+// partial-results; the body lists the shards that failed.
+func (r *QueryRouter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params := req.URL.Query()
+		index, query := params.Get("index"), params.Get("q")
+		if index == "" || query == "" {
+			http.Error(w, "missing index or q parameter", http.StatusBadRequest)
+			return
+		}
+		k := 10
+		if value := params.Get("k"); value != "" {
+			var err error
+			if k, err = strconv.Atoi(value); err != nil || k <= 0 {
+				http.Error(w, "k must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+
+		response, err := r.Search(req.Context(), index, query, k)
+		switch {
+		case errors.Is(err, ErrIndexNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if response.Degraded {
+			w.Header().Set(degradation.Header, "partial-results")
+		}
+		_, span := tracer.Start(req.Context(), "respond", trace.WithAttributes(attribute.Int("search.hits", len(response.Hits))))
+		httpjson.Write(w, http.StatusOK, response)
+		span.End()
+	})
+	return mux
+}
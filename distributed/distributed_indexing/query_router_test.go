@@ -0,0 +1,62 @@
+package distributed_indexing_test
+
+import (
+	"context"
+	"distributed/distributed_indexing"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Test that queries fan out to every shard and come back as one global top k,
+// flagged as degraded when a shard has no replica left to answer
+func TestScatterGatherQuery(t *testing.T) {
+	shardMap := distributed_indexing.NewShardMap()
+	if err := shardMap.CreateIndex("pages", 4, 2, []string{"Node1", "Node2", "Node3"}); err != nil {
+		t.Fatalf("Failed to partition index: %v", err)
+	}
+	shards, _ := shardMap.Shards("pages")
+	down := map[string]bool{"Node1": true} // Answered for by the next replica
+	broken := shards[3].ID
+
+	searcher := distributed_indexing.SearcherFunc(func(ctx context.Context, node string, shard distributed_indexing.Shard, query string, k int) (distributed_indexing.ShardHits, error) {
+		if down[node] || shard.ID == broken {
+			return distributed_indexing.ShardHits{}, fmt.Errorf("%s is unreachable", node)
+		}
+		var answer distributed_indexing.ShardHits
+		for i := 0; i < 5; i++ {
+			answer.Hits = append(answer.Hits, distributed_indexing.Hit{
+				DocID: fmt.Sprintf("%s-doc-%d", shard.ID, i),
+				Score: float64(shard.Start>>28) - float64(i),
+			})
+		}
+		answer.Total = len(answer.Hits)
+		if len(answer.Hits) > k {
+			answer.Hits = answer.Hits[:k]
+		}
+		return answer, nil
+	})
+
+	router := distributed_indexing.NewQueryRouter(shardMap, searcher, distributed_indexing.DefaultQueryRouterConfig)
+	response, err := router.Search(context.Background(), "pages", "search engine", 3)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if !response.Degraded || response.Succeeded != 3 || len(response.Failures) != 1 {
+		t.Fatalf("Expected a degraded answer from 3 of 4 shards, got %+v", response)
+	}
+	if len(response.Hits) != 3 || response.Total != 15 {
+		t.Fatalf("Expected 3 of 15 hits, got %d of %d", len(response.Hits), response.Total)
+	}
+	// Shard 2 scores highest of those answering, so it holds the whole top 3
+	for i, hit := range response.Hits {
+		if hit.Shard != shards[2].ID || hit.DocID != fmt.Sprintf("%s-doc-%d", shards[2].ID, i) {
+			t.Fatalf("Hit %d is %+v, expected document %d of %s", i, hit, i, shards[2].ID)
+		}
+	}
+
+	strict := distributed_indexing.NewQueryRouter(shardMap, searcher, distributed_indexing.QueryRouterConfig{})
+	if _, err := strict.Search(context.Background(), "pages", "search engine", 3); !errors.Is(err, distributed_indexing.ErrNoShardsAnswered) {
+		t.Fatalf("Expected the query to fail without partial results, got %v", err)
+	}
+}
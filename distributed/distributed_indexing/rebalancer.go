@@ -0,0 +1,467 @@
+package distributed_indexing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrMigrationNotFound = errors.New("migration not found")
+
+// ShardCopier copies a shard's data from one node to another. It reports
+// progress in bytes as it goes; the call blocks while the rebalancer
+// throttles the copy, so copiers should report often.
+type ShardCopier interface {
+	CopyShard(ctx context.Context, shard Shard, from, to string, progress func(copied, total int64)) error
+}
+
+// CopierFunc lets a plain function serve as a ShardCopier
+type CopierFunc func(ctx context.Context, shard Shard, from, to string, progress func(copied, total int64)) error
+
+// CopyShard calls f
+func (f CopierFunc) CopyShard(ctx context.Context, shard Shard, from, to string, progress func(copied, total int64)) error {
+	return f(ctx, shard, from, to, progress)
+}
+
+// RebalancerConfig tunes when and how fast shards are moved
+type RebalancerConfig struct {
+	Interval          time.Duration // How often placement is checked
+	MaxConcurrent     int           // Migrations running at once
+	BytesPerSecond    int64         // Throttles each migration; 0 is unlimited
+	MaxSkew           int           // Shard count difference between nodes tolerated
+	DiskHighWatermark float64       // Disk usage fraction above which shards are moved off a node
+}
+
+// DefaultRebalancerConfig checks every 30s and runs two 50MB/s migrations at a time
+var DefaultRebalancerConfig = RebalancerConfig{
+	Interval:          30 * time.Second,
+	MaxConcurrent:     2,
+	BytesPerSecond:    50 << 20,
+	MaxSkew:           1,
+	DiskHighWatermark: 0.85,
+}
+
+// MigrationState is where a migration is in its lifecycle
+type MigrationState string
+
+const (
+	MigrationCopying   MigrationState = "copying"
+	MigrationDone      MigrationState = "done"
+	MigrationFailed    MigrationState = "failed"
+	MigrationCancelled MigrationState = "cancelled"
+)
+
+// Migration moves one replica of a shard. The data is copied to the target
+// first and the shard map only switches over once the copy is complete, so
+// queries never reach a replica that is still filling.
+type Migration struct {
+	ID       string         `json:"id"`
+	Index    string         `json:"index"`
+	ShardID  string         `json:"shard"`
+	From     string         `json:"from"`
+	To       string         `json:"to"`
+	Reason   string         `json:"reason"`
+	State    MigrationState `json:"state"`
+	Copied   int64          `json:"copied"`
+	Total    int64          `json:"total"`
+	Error    string         `json:"error,omitempty"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+
+	cancel context.CancelFunc
+}
+
+// nodeState is what the rebalancer knows about a data node
+type nodeState struct {
+	diskUsage float64
+	draining  bool // Leaving the cluster once its shards are moved off
+}
+
+// Rebalancer keeps shards spread evenly over the data nodes. It moves shards
+// onto nodes that join, off nodes that leave or run low on disk, and from
+// the busiest to the idlest node while the skew exceeds MaxSkew.
+type Rebalancer struct {
+	shardMap *ShardMap
+	copier   ShardCopier
+	config   RebalancerConfig
+
+	mutex      sync.Mutex
+	nodes      map[string]*nodeState
+	migrations map[string]*Migration
+	nextID     int
+	token      uint64 // Fencing token cutovers are made with
+}
+
+// NewRebalancer creates a rebalancer moving shards of shardMap with copier
+func NewRebalancer(shardMap *ShardMap, copier ShardCopier, config RebalancerConfig) *Rebalancer {
+	if config.MaxConcurrent <= 0 {
+		config.MaxConcurrent = 1
+	}
+	return &Rebalancer{
+		shardMap:   shardMap,
+		copier:     copier,
+		config:     config,
+		nodes:      make(map[string]*nodeState),
+		migrations: make(map[string]*Migration),
+	}
+}
+
+// AddNode registers a data node that can take shards
+func (r *Rebalancer) AddNode(nodeID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if node, ok := r.nodes[nodeID]; ok {
+		node.draining = false
+		return
+	}
+	r.nodes[nodeID] = &nodeState{}
+	logger.Info("Node joined, shards will be rebalanced onto it", "node", nodeID)
+}
+
+// RemoveNode drains a node: its shards are moved to the remaining nodes and
+// it is forgotten once it holds none
+func (r *Rebalancer) RemoveNode(nodeID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if node, ok := r.nodes[nodeID]; ok {
+		node.draining = true
+		logger.Info("Draining shards off node", "node", nodeID)
+	}
+}
+
+// SetDiskUsage records the fraction of a node's disk in use
+func (r *Rebalancer) SetDiskUsage(nodeID string, usage float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if node, ok := r.nodes[nodeID]; ok {
+		node.diskUsage = usage
+	}
+}
+
+// SetFencingToken sets the token of the placement lock the rebalancer holds,
+// which the shard map checks on every cutover
+func (r *Rebalancer) SetFencingToken(token uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.token = token
+}
+
+func (r *Rebalancer) fencingToken() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.token
+}
+
+// Run checks placement every Interval until ctx is done
+func (r *Rebalancer) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.CancelAll()
+			return
+		case <-ticker.C:
+			r.Rebalance()
+		}
+	}
+}
+
+// Rebalance plans migrations for any skew in the current placement and
+// starts as many as the concurrency limit allows. It returns the migrations
+// started.
+func (r *Rebalancer) Rebalance() []Migration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var started []Migration
+	for r.runningLocked() < r.config.MaxConcurrent {
+		shard, from, to, reason := r.planLocked()
+		if shard == nil {
+			break
+		}
+		started = append(started, *r.startLocked(*shard, from, to, reason))
+	}
+	r.forgetDrainedLocked()
+	return started
+}
+
+func (r *Rebalancer) runningLocked() int {
+	running := 0
+	for _, migration := range r.migrations {
+		if migration.State == MigrationCopying {
+			running++
+		}
+	}
+	return running
+}
+
+// planLocked picks the next shard to move; callers hold the mutex. Running
+// migrations count as already done so they aren't planned twice. It returns
+// a nil shard when placement is balanced.
+func (r *Rebalancer) planLocked() (*Shard, string, string, string) {
+	placed := make(map[string][]Shard)
+	count := make(map[string]int)
+	for nodeID := range r.nodes {
+		placed[nodeID] = nil
+	}
+	for _, index := range r.shardMap.Indexes() {
+		shards, err := r.shardMap.Shards(index)
+		if err != nil {
+			continue
+		}
+		for _, shard := range shards {
+			for _, replica := range shard.Replicas {
+				placed[replica] = append(placed[replica], shard)
+				count[replica]++
+			}
+		}
+	}
+	moving := make(map[string]bool)
+	leaving := make(map[string]bool)
+	for _, migration := range r.migrations {
+		if migration.State == MigrationCopying {
+			moving[migration.Index+"/"+migration.ShardID] = true
+			leaving[migration.From] = true
+			count[migration.From]--
+			count[migration.To]++
+		}
+	}
+
+	// Nodes in ascending order of load, the candidates to receive shards
+	var targets []string
+	for nodeID, node := range r.nodes {
+		if !node.draining && !r.overloadedLocked(nodeID) {
+			targets = append(targets, nodeID)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if count[targets[i]] != count[targets[j]] {
+			return count[targets[i]] < count[targets[j]]
+		}
+		return targets[i] < targets[j]
+	})
+
+	// Sources in order of urgency: leaving nodes, full disks, then the most loaded
+	var sources []string
+	for nodeID := range placed {
+		sources = append(sources, nodeID)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		a, b := r.urgencyLocked(sources[i]), r.urgencyLocked(sources[j])
+		if a != b {
+			return a > b
+		}
+		if count[sources[i]] != count[sources[j]] {
+			return count[sources[i]] > count[sources[j]]
+		}
+		return sources[i] < sources[j]
+	})
+
+	for _, from := range sources {
+		var reason string
+		switch r.urgencyLocked(from) {
+		case 2:
+			reason = "node leaving"
+		case 1:
+			// Disk usage is only re-reported after a move, so shed one shard at a time
+			if leaving[from] {
+				continue
+			}
+			reason = "disk pressure"
+		}
+		for _, shard := range placed[from] {
+			if moving[shard.Index+"/"+shard.ID] {
+				continue
+			}
+			for _, to := range targets {
+				if to == from || hasReplica(shard, to) {
+					continue
+				}
+				if reason == "" {
+					if count[from]-count[to] <= r.config.MaxSkew {
+						// Targets are sorted by load, so none is further behind
+						break
+					}
+					reason = "skew"
+				}
+				shard := shard
+				return &shard, from, to, reason
+			}
+		}
+	}
+	return nil, "", "", ""
+}
+
+// urgencyLocked ranks why shards must leave a node: 2 when it is leaving or
+// unknown, 1 under disk pressure, 0 otherwise
+func (r *Rebalancer) urgencyLocked(nodeID string) int {
+	node, ok := r.nodes[nodeID]
+	switch {
+	case !ok || node.draining:
+		return 2
+	case r.overloadedLocked(nodeID):
+		return 1
+	}
+	return 0
+}
+
+func (r *Rebalancer) overloadedLocked(nodeID string) bool {
+	node, ok := r.nodes[nodeID]
+	return ok && r.config.DiskHighWatermark > 0 && node.diskUsage >= r.config.DiskHighWatermark
+}
+
+func hasReplica(shard Shard, nodeID string) bool {
+	for _, replica := range shard.Replicas {
+		if replica == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetDrainedLocked drops draining nodes that hold no shards any more
+func (r *Rebalancer) forgetDrainedLocked() {
+	for nodeID, node := range r.nodes {
+		if node.draining && len(r.shardMap.NodeShards(nodeID)) == 0 {
+			delete(r.nodes, nodeID)
+			logger.Info("Node drained and removed", "node", nodeID)
+		}
+	}
+}
+
+// startLocked launches a migration; callers hold the mutex
+func (r *Rebalancer) startLocked(shard Shard, from, to, reason string) *Migration {
+	r.nextID++
+	ctx, cancel := context.WithCancel(context.Background())
+	migration := &Migration{
+		ID:      fmt.Sprintf("migration-%d", r.nextID),
+		Index:   shard.Index,
+		ShardID: shard.ID,
+		From:    from,
+		To:      to,
+		Reason:  reason,
+		State:   MigrationCopying,
+		Started: time.Now(),
+		cancel:  cancel,
+	}
+	r.migrations[migration.ID] = migration
+	logger.Info("Moving shard", "index", shard.Index, "shard", shard.ID, "from", from, "to", to, "reason", reason)
+	go r.migrate(ctx, migration, shard)
+	return migration
+}
+
+// migrate copies the shard and then cuts the shard map over to the new
+// replica. A node that is leaving or gone may not be able to serve the copy,
+// so another replica is used as the source when there is one.
+func (r *Rebalancer) migrate(ctx context.Context, migration *Migration, shard Shard) {
+	source := r.copySource(shard, migration.From)
+	progress := func(copied, total int64) {
+		r.mutex.Lock()
+		migration.Copied, migration.Total = copied, total
+		r.mutex.Unlock()
+
+		if r.config.BytesPerSecond > 0 {
+			due := migration.Started.Add(time.Duration(float64(copied) / float64(r.config.BytesPerSecond) * float64(time.Second)))
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(due)):
+			}
+		}
+	}
+
+	err := r.copier.CopyShard(ctx, shard, source, migration.To, progress)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		// The shard map rejects the cutover if the shard was split or its
+		// replicas changed while copying
+		err = r.shardMap.Fenced(r.fencingToken(), func() error {
+			return r.shardMap.MoveShard(shard.Index, shard.ID, migration.From, migration.To)
+		})
+	}
+	r.finish(migration, err)
+}
+
+// copySource picks the replica to copy a shard from, preferring from unless it is leaving
+func (r *Rebalancer) copySource(shard Shard, from string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.urgencyLocked(from) < 2 {
+		return from
+	}
+	for _, replica := range shard.Replicas {
+		if replica != from && r.urgencyLocked(replica) < 2 {
+			return replica
+		}
+	}
+	return from
+}
+
+func (r *Rebalancer) finish(migration *Migration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	migration.Finished = time.Now()
+	migration.cancel()
+	switch {
+	case err == nil:
+		migration.State = MigrationDone
+		logger.Info("Moved shard", "index", migration.Index, "shard", migration.ShardID, "to", migration.To, "duration", migration.Finished.Sub(migration.Started))
+	case errors.Is(err, context.Canceled):
+		migration.State = MigrationCancelled
+		logger.Info("Cancelled shard move", "index", migration.Index, "shard", migration.ShardID, "to", migration.To)
+	default:
+		migration.State = MigrationFailed
+		migration.Error = err.Error()
+		logger.Error("Failed to move shard", "index", migration.Index, "shard", migration.ShardID, "to", migration.To, "error", err)
+	}
+}
+
+// Migrations returns all migrations, oldest first
+func (r *Rebalancer) Migrations() []Migration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	result := make([]Migration, 0, len(r.migrations))
+	for _, migration := range r.migrations {
+		result = append(result, *migration)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Started.Before(result[j].Started) })
+	return result
+}
+
+// Migration returns the migration with the given ID
+func (r *Rebalancer) Migration(id string) (Migration, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	migration, ok := r.migrations[id]
+	if !ok {
+		return Migration{}, fmt.Errorf("%w: %s", ErrMigrationNotFound, id)
+	}
+	return *migration, nil
+}
+
+// Cancel stops a running migration. The shard map is untouched, so the
+// shard stays where it was.
+func (r *Rebalancer) Cancel(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	migration, ok := r.migrations[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMigrationNotFound, id)
+	}
+	migration.cancel()
+	return nil
+}
+
+// CancelAll stops every running migration
+func (r *Rebalancer) CancelAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, migration := range r.migrations {
+		migration.cancel()
+	}
+}
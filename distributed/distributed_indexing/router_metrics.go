@@ -0,0 +1,102 @@
+package distributed_indexing
+
+import (
+	"context"
+	"errors"
+	"monitoring/metrics"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of shard queries and of the queries fanned out to them, as
+// Metrics are told them
+const (
+	OutcomeOK       = "ok"
+	OutcomeFailed   = "error"
+	OutcomeTimeout  = "timeout"  // Of a shard query
+	OutcomeDegraded = "degraded" // Of a query answered without some shards
+)
+
+// Metrics receives the router's instrumentation events. Inject an
+// implementation with SetMetrics; routers default to discarding them.
+type Metrics interface {
+	// ObserveShardQuery records a query of one shard, across the replicas
+	// tried, and how it ended
+	ObserveShardQuery(shard, outcome string, latency time.Duration)
+	// ObserveFanOut records a query of every shard of an index, merging
+	// included, and how it ended
+	ObserveFanOut(outcome string, latency time.Duration)
+}
+
+// noopMetrics discards all events
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveShardQuery(string, string, time.Duration) {}
+func (noopMetrics) ObserveFanOut(string, time.Duration)             {}
+
+// shardOutcome tells how a shard query that returned err ended
+func shardOutcome(err error) string {
+	switch {
+	case err == nil:
+		return OutcomeOK
+	case errors.Is(err, context.DeadlineExceeded):
+		return OutcomeTimeout
+	}
+	return OutcomeFailed
+}
+
+// PrometheusMetrics exports router events as Prometheus metrics
+type PrometheusMetrics struct {
+	shardQueries *prometheus.CounterVec
+	shardLatency *prometheus.HistogramVec
+	queries      *prometheus.CounterVec
+	fanOut       prometheus.Histogram
+}
+
+// NewPrometheusMetrics creates the router metrics and registers them with
+// reg. A nil reg uses metrics.Default, the registry metrics.Serve serves.
+func NewPrometheusMetrics(reg prometheus.Registerer) *PrometheusMetrics {
+	if reg == nil {
+		reg = metrics.Default
+	}
+	buckets := []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	m := &PrometheusMetrics{
+		shardQueries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "search_shard_queries_total",
+			Help: "Queries of each shard, by outcome: ok, error or timeout",
+		}, []string{"shard", "outcome"}),
+		shardLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "search_shard_query_seconds",
+			Help:    "Time taken by each shard to answer a query, across the replicas tried",
+			Buckets: buckets,
+		}, []string{"shard"}),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "search_fanout_queries_total",
+			Help: "Queries fanned out to every shard of an index, by outcome: ok, degraded or error",
+		}, []string{"outcome"}),
+		fanOut: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "search_fanout_seconds",
+			Help:    "Time taken to query every shard of an index and merge their hits",
+			Buckets: buckets,
+		}),
+	}
+	reg.MustRegister(m.shardQueries, m.shardLatency, m.queries, m.fanOut)
+	return m
+}
+
+func (m *PrometheusMetrics) ObserveShardQuery(shard, outcome string, latency time.Duration) {
+	m.shardQueries.WithLabelValues(shard, outcome).Inc()
+	m.shardLatency.WithLabelValues(shard).Observe(latency.Seconds())
+}
+
+func (m *PrometheusMetrics) ObserveFanOut(outcome string, latency time.Duration) {
+	m.queries.WithLabelValues(outcome).Inc()
+	m.fanOut.Observe(latency.Seconds())
+}
+
+// SetMetrics injects the metrics sink of the router; call it before
+// serving
+func (r *QueryRouter) SetMetrics(m Metrics) {
+	r.metrics = m
+}
@@ -0,0 +1,185 @@
+package distributed_indexing
+
+import (
+	"distributed/distributed_crawling"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"pkg/httpjson"
+	"strconv"
+	"strings"
+)
+
+// fencingTokenHeader carries the caller's fencing token on requests that
+// change shard placement
+const fencingTokenHeader = "X-Fencing-Token"
+
+// createIndexRequest is the body of PUT /shards/{index}
+type createIndexRequest struct {
+	Shards   int      `json:"shards"`
+	Replicas int      `json:"replicas"`
+	Nodes    []string `json:"nodes"`
+}
+
+// moveShardRequest is the body of POST /shards/{index}/{shard}/move
+type moveShardRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// shardsResponse is a list of shards along with the map epoch it was read at
+type shardsResponse struct {
+	Epoch  uint64  `json:"epoch"`
+	Shards []Shard `json:"shards"`
+}
+
+// Handler serves the shard map to the query router and operators
+//
+//	GET    /shards                          index names
+//	GET    /shards/{index}                  shards of an index
+//	PUT    /shards/{index}                  create an index
+//	DELETE /shards/{index}                  drop an index
+//	GET    /shards/{index}/lookup?doc={id}  shard holding a document
+//	POST   /shards/{index}/{shard}/split    split a shard in two
+//	POST   /shards/{index}/{shard}/move     move a replica between nodes
+//
+// Once the map has a fence, requests that change placement must carry the
+// caller's fencing token in the X-Fencing-Token header.
+func (m *ShardMap) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shards", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, m.Indexes())
+	})
+	mux.HandleFunc("/shards/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/shards/"), "/")
+		index := parts[0]
+		if index == "" || len(parts) > 3 {
+			http.NotFound(w, r)
+			return
+		}
+
+		token, _ := strconv.ParseUint(r.Header.Get(fencingTokenHeader), 10, 64)
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			shards, epoch, err := m.shardsAtEpoch(index)
+			if err != nil {
+				writeShardError(w, err)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, shardsResponse{Epoch: epoch, Shards: shards})
+		case len(parts) == 1 && r.Method == http.MethodPut:
+			var req createIndexRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err := m.Fenced(token, func() error { return m.CreateIndex(index, req.Shards, req.Replicas, req.Nodes) })
+			if err != nil {
+				writeShardError(w, err)
+				return
+			}
+			shards, epoch, _ := m.shardsAtEpoch(index)
+			httpjson.Write(w, http.StatusCreated, shardsResponse{Epoch: epoch, Shards: shards})
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			writeShardResult(w, m.Fenced(token, func() error { return m.DropIndex(index) }))
+		case len(parts) == 2 && parts[1] == "lookup" && r.Method == http.MethodGet:
+			docID := r.URL.Query().Get("doc")
+			if docID == "" {
+				http.Error(w, "missing doc parameter", http.StatusBadRequest)
+				return
+			}
+			shard, err := m.Lookup(index, docID)
+			if err != nil {
+				writeShardError(w, err)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, shard)
+		case len(parts) == 3 && parts[2] == "split" && r.Method == http.MethodPost:
+			var low, high Shard
+			err := m.Fenced(token, func() (err error) {
+				low, high, err = m.SplitShard(index, parts[1])
+				return err
+			})
+			if err != nil {
+				writeShardError(w, err)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, []Shard{low, high})
+		case len(parts) == 3 && parts[2] == "move" && r.Method == http.MethodPost:
+			var req moveShardRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeShardResult(w, m.Fenced(token, func() error { return m.MoveShard(index, parts[1], req.From, req.To) }))
+		case len(parts) == 1 || (len(parts) == 2 && parts[1] == "lookup") ||
+			(len(parts) == 3 && (parts[2] == "split" || parts[2] == "move")):
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return mux
+}
+
+// Handler serves rebalancing progress and cancellation
+//
+//	GET    /migrations       all migrations
+//	GET    /migrations/{id}  one migration
+//	DELETE /migrations/{id}  cancel a migration
+func (r *Rebalancer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/migrations", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, r.Migrations())
+	})
+	mux.HandleFunc("/migrations/", func(w http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, "/migrations/")
+		switch req.Method {
+		case http.MethodGet:
+			migration, err := r.Migration(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, migration)
+		case http.MethodDelete:
+			if err := r.Cancel(id); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// writeShardResult answers a shard map change with 204, or the error that stopped it
+func writeShardResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeShardError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeShardError maps shard map errors to HTTP statuses
+func writeShardError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrIndexNotFound), errors.Is(err, ErrShardNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrIndexExists), errors.Is(err, distributed_crawling.ErrStaleToken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,402 @@
+package distributed_indexing
+
+import (
+	"distributed/distributed_crawling"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"monitoring/logging"
+	"sort"
+	"sync"
+)
+
+// logger reports changes to the shard map and shard moves
+var logger = logging.Component("distributed/distributed_indexing")
+
+// hashSpace is the size of the document hash ring the shards divide
+const hashSpace = uint64(1) << 32
+
+var (
+	ErrIndexNotFound = errors.New("index not found")
+	ErrIndexExists   = errors.New("index already exists")
+	ErrShardNotFound = errors.New("shard not found")
+)
+
+// Shard is a partition of an index covering the document hashes in
+// [Start, End), held by its replica nodes
+type Shard struct {
+	ID       string   `json:"id"`
+	Index    string   `json:"index"`
+	Start    uint64   `json:"start"`
+	End      uint64   `json:"end"`
+	Replicas []string `json:"replicas"` // Node IDs, primary first
+}
+
+// Primary returns the node holding the shard's primary copy
+func (s Shard) Primary() string {
+	if len(s.Replicas) == 0 {
+		return ""
+	}
+	return s.Replicas[0]
+}
+
+func (s Shard) contains(hash uint64) bool {
+	return hash >= s.Start && hash < s.End
+}
+
+func (s *Shard) clone() Shard {
+	c := *s
+	c.Replicas = append([]string(nil), s.Replicas...)
+	return c
+}
+
+// ShardMap tracks which partitions of each index live on which nodes. It is
+// the source of truth the query router and indexers look shards up in.
+type ShardMap struct {
+	mutex   sync.Mutex
+	indexes map[string][]*Shard // Sorted by Start
+	nextID  int
+	epoch   uint64 // Bumped on every change so clients can tell their copy is stale
+	fence   *distributed_crawling.Fence
+}
+
+// NewShardMap creates an empty shard map
+func NewShardMap() *ShardMap {
+	return &ShardMap{indexes: make(map[string][]*Shard)}
+}
+
+// DocumentHash places a document ID on the hash ring
+func DocumentHash(docID string) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(docID))
+	return uint64(h.Sum32())
+}
+
+// SetFence makes ownership changes made through Fenced and the HTTP API
+// require the fencing token of the current holder of the placement lock
+func (m *ShardMap) SetFence(fence *distributed_crawling.Fence) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.fence = fence
+}
+
+// Fenced makes the ownership changes in change if token is current, so a
+// rebalancer or failover manager that lost its lock while paused can't undo
+// the placement decisions of the one that replaced it. Without a fence the
+// change is made unchecked.
+func (m *ShardMap) Fenced(token uint64, change func() error) error {
+	m.mutex.Lock()
+	fence := m.fence
+	m.mutex.Unlock()
+	if fence == nil {
+		return change()
+	}
+	return fence.Guard(token, change)
+}
+
+// CreateIndex splits a new index into shards of equal hash ranges and
+// places replicas of each on distinct nodes, spreading primaries round robin
+func (m *ShardMap) CreateIndex(index string, shards, replicas int, nodes []string) error {
+	if shards <= 0 {
+		return errors.New("an index needs at least one shard")
+	}
+	if replicas <= 0 || replicas > len(nodes) {
+		return fmt.Errorf("cannot place %d replicas on %d nodes", replicas, len(nodes))
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.indexes[index]; ok {
+		return fmt.Errorf("%w: %s", ErrIndexExists, index)
+	}
+
+	width := hashSpace / uint64(shards)
+	placed := make([]*Shard, shards)
+	for i := range placed {
+		shard := &Shard{ID: m.newShardIDLocked(), Index: index, Start: uint64(i) * width, End: uint64(i+1) * width}
+		if i == shards-1 {
+			shard.End = hashSpace
+		}
+		for r := 0; r < replicas; r++ {
+			shard.Replicas = append(shard.Replicas, nodes[(i+r)%len(nodes)])
+		}
+		placed[i] = shard
+	}
+	m.indexes[index] = placed
+	m.epoch++
+	logger.Info("Created index", "index", index, "shards", shards, "replicas", replicas)
+	return nil
+}
+
+// SetShards replaces the shards of an index, creating it if needed, e.g.
+// to follow a shard map kept elsewhere. The shards must cover the hash space
+// without gaps or overlaps.
+func (m *ShardMap) SetShards(index string, shards []Shard) error {
+	placed := make([]*Shard, len(shards))
+	for i := range shards {
+		shard := shards[i].clone()
+		shard.Index = index
+		placed[i] = &shard
+	}
+	sort.Slice(placed, func(i, j int) bool { return placed[i].Start < placed[j].Start })
+	var next uint64
+	for _, shard := range placed {
+		if shard.Start != next || shard.End <= shard.Start || len(shard.Replicas) == 0 {
+			return fmt.Errorf("shards of %s don't cover the hash space at %d", index, next)
+		}
+		next = shard.End
+	}
+	if next != hashSpace {
+		return fmt.Errorf("shards of %s don't cover the hash space at %d", index, next)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, shard := range placed {
+		// Keep generated IDs from colliding with the ones adopted
+		var id int
+		if _, err := fmt.Sscanf(shard.ID, "shard-%d", &id); err == nil && id > m.nextID {
+			m.nextID = id
+		}
+	}
+	m.indexes[index] = placed
+	m.epoch++
+	return nil
+}
+
+// DropIndex removes an index and all its shards
+func (m *ShardMap) DropIndex(index string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.indexes[index]; !ok {
+		return fmt.Errorf("%w: %s", ErrIndexNotFound, index)
+	}
+	delete(m.indexes, index)
+	m.epoch++
+	return nil
+}
+
+func (m *ShardMap) newShardIDLocked() string {
+	m.nextID++
+	return fmt.Sprintf("shard-%d", m.nextID)
+}
+
+// Lookup returns the shard of index holding the document
+func (m *ShardMap) Lookup(index, docID string) (Shard, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	shards, ok := m.indexes[index]
+	if !ok {
+		return Shard{}, fmt.Errorf("%w: %s", ErrIndexNotFound, index)
+	}
+	hash := DocumentHash(docID)
+	i := sort.Search(len(shards), func(i int) bool { return shards[i].End > hash })
+	if i == len(shards) || !shards[i].contains(hash) {
+		return Shard{}, fmt.Errorf("%w: no shard of %s covers %s", ErrShardNotFound, index, docID)
+	}
+	return shards[i].clone(), nil
+}
+
+// Shards returns every shard of index in hash order, e.g. for scatter-gather queries
+func (m *ShardMap) Shards(index string) ([]Shard, error) {
+	shards, _, err := m.shardsAtEpoch(index)
+	return shards, err
+}
+
+// shardsAtEpoch returns the shards of index with the epoch they were read at
+func (m *ShardMap) shardsAtEpoch(index string) ([]Shard, uint64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	shards, ok := m.indexes[index]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", ErrIndexNotFound, index)
+	}
+	result := make([]Shard, len(shards))
+	for i, shard := range shards {
+		result[i] = shard.clone()
+	}
+	return result, m.epoch, nil
+}
+
+// Indexes returns the names of all indexes
+func (m *ShardMap) Indexes() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := make([]string, 0, len(m.indexes))
+	for name := range m.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NodeShards returns every shard with a replica on the node
+func (m *ShardMap) NodeShards(nodeID string) []Shard {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var result []Shard
+	for _, shards := range m.indexes {
+		for _, shard := range shards {
+			for _, replica := range shard.Replicas {
+				if replica == nodeID {
+					result = append(result, shard.clone())
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Epoch returns the version of the map, which changes on every update
+func (m *ShardMap) Epoch() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.epoch
+}
+
+// findShardLocked returns the position of a shard; callers hold the mutex
+func (m *ShardMap) findShardLocked(index, shardID string) (int, error) {
+	shards, ok := m.indexes[index]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrIndexNotFound, index)
+	}
+	for i, shard := range shards {
+		if shard.ID == shardID {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s in %s", ErrShardNotFound, shardID, index)
+}
+
+// SplitShard divides a shard's hash range in two. Both halves stay on the
+// shard's replicas, so no data moves until one of them is moved.
+func (m *ShardMap) SplitShard(index, shardID string) (Shard, Shard, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i, err := m.findShardLocked(index, shardID)
+	if err != nil {
+		return Shard{}, Shard{}, err
+	}
+	shard := m.indexes[index][i]
+	if shard.End-shard.Start < 2 {
+		return Shard{}, Shard{}, fmt.Errorf("shard %s is too small to split", shardID)
+	}
+
+	mid := shard.Start + (shard.End-shard.Start)/2
+	low := &Shard{ID: m.newShardIDLocked(), Index: index, Start: shard.Start, End: mid, Replicas: append([]string(nil), shard.Replicas...)}
+	high := &Shard{ID: m.newShardIDLocked(), Index: index, Start: mid, End: shard.End, Replicas: append([]string(nil), shard.Replicas...)}
+
+	shards := m.indexes[index]
+	updated := append([]*Shard{}, shards[:i]...)
+	updated = append(updated, low, high)
+	m.indexes[index] = append(updated, shards[i+1:]...)
+	m.epoch++
+	logger.Info("Split shard", "index", index, "shard", shardID, "low", low.ID, "high", high.ID)
+	return low.clone(), high.clone(), nil
+}
+
+// AddReplica places another copy of a shard on the node
+func (m *ShardMap) AddReplica(index, shardID, nodeID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i, err := m.findShardLocked(index, shardID)
+	if err != nil {
+		return err
+	}
+	shard := m.indexes[index][i]
+	for _, replica := range shard.Replicas {
+		if replica == nodeID {
+			return fmt.Errorf("shard %s already has a replica on %s", shardID, nodeID)
+		}
+	}
+	shard.Replicas = append(shard.Replicas, nodeID)
+	m.epoch++
+	return nil
+}
+
+// RemoveReplica drops the copy of a shard on the node. The last replica of a
+// shard can't be removed.
+func (m *ShardMap) RemoveReplica(index, shardID, nodeID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i, err := m.findShardLocked(index, shardID)
+	if err != nil {
+		return err
+	}
+	shard := m.indexes[index][i]
+	for r, replica := range shard.Replicas {
+		if replica != nodeID {
+			continue
+		}
+		if len(shard.Replicas) == 1 {
+			return fmt.Errorf("cannot remove the last replica of shard %s", shardID)
+		}
+		shard.Replicas = append(shard.Replicas[:r], shard.Replicas[r+1:]...)
+		m.epoch++
+		return nil
+	}
+	return fmt.Errorf("shard %s has no replica on %s", shardID, nodeID)
+}
+
+// PromoteReplica makes the node's replica the shard's primary, e.g. when the
+// primary fails
+func (m *ShardMap) PromoteReplica(index, shardID, nodeID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i, err := m.findShardLocked(index, shardID)
+	if err != nil {
+		return err
+	}
+	shard := m.indexes[index][i]
+	for r, replica := range shard.Replicas {
+		if replica != nodeID {
+			continue
+		}
+		if r == 0 {
+			return nil
+		}
+		copy(shard.Replicas[1:r+1], shard.Replicas[:r])
+		shard.Replicas[0] = nodeID
+		m.epoch++
+		logger.Info("Promoted replica to primary", "index", index, "shard", shardID, "node", nodeID)
+		return nil
+	}
+	return fmt.Errorf("shard %s has no replica on %s", shardID, nodeID)
+}
+
+// MoveShard reassigns a shard's replica from one node to another, keeping
+// its position so a moved primary stays primary
+func (m *ShardMap) MoveShard(index, shardID, from, to string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i, err := m.findShardLocked(index, shardID)
+	if err != nil {
+		return err
+	}
+	shard := m.indexes[index][i]
+	position := -1
+	for r, replica := range shard.Replicas {
+		if replica == to {
+			return fmt.Errorf("shard %s already has a replica on %s", shardID, to)
+		}
+		if replica == from {
+			position = r
+		}
+	}
+	if position < 0 {
+		return fmt.Errorf("shard %s has no replica on %s", shardID, from)
+	}
+	shard.Replicas[position] = to
+	m.epoch++
+	logger.Info("Moved shard", "index", index, "shard", shardID, "from", from, "to", to)
+	return nil
+}
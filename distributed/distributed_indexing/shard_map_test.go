@@ -0,0 +1,78 @@
+package distributed_indexing_test
+
+import (
+	"distributed/distributed_indexing"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Test index partitioning through the shard map service
+func TestDistributedIndexPartitioning(t *testing.T) {
+	shardMap := distributed_indexing.NewShardMap()
+	if err := shardMap.CreateIndex("pages", 4, 2, []string{"Node1", "Node2", "Node3"}); err != nil {
+		t.Fatalf("Failed to partition index: %v", err)
+	}
+
+	server := httptest.NewServer(shardMap.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/shards/pages/lookup?doc=doc-42")
+	if err != nil {
+		t.Fatalf("Shard lookup failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Shard lookup returned status %d", resp.StatusCode)
+	}
+
+	var shard distributed_indexing.Shard
+	if err := json.NewDecoder(resp.Body).Decode(&shard); err != nil {
+		t.Fatalf("Failed to decode shard: %v", err)
+	}
+	expected, _ := shardMap.Lookup("pages", "doc-42")
+	if shard.ID != expected.ID || len(shard.Replicas) != 2 {
+		t.Fatalf("Lookup returned %+v, expected %+v", shard, expected)
+	}
+	t.Logf("doc-42 lives on shard %s with primary %s", shard.ID, shard.Primary())
+}
+
+// Test that lookups keep resolving while shards are split underneath them
+func TestDataSynchronizationDuringPartitioning(t *testing.T) {
+	shardMap := distributed_indexing.NewShardMap()
+	if err := shardMap.CreateIndex("pages", 2, 1, []string{"Node1", "Node2"}); err != nil {
+		t.Fatalf("Failed to partition index: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := shardMap.Lookup("pages", fmt.Sprintf("doc-%d", i)); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+
+	shards, _ := shardMap.Shards("pages")
+	for _, shard := range shards {
+		if _, _, err := shardMap.SplitShard("pages", shard.ID); err != nil {
+			t.Fatalf("Failed to split shard %s: %v", shard.ID, err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Lookup failed during split: %v", err)
+	}
+
+	shards, _ = shardMap.Shards("pages")
+	if len(shards) != 4 {
+		t.Fatalf("Expected 4 shards after splitting, got %d", len(shards))
+	}
+}
@@ -0,0 +1,330 @@
+package fault_tolerance
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	blobstore "pkg/blob_store"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupPrefix = "backups/"
+	manifestName = "manifest.json"
+	// Raft groups a cluster backup covers
+	dataGroup     = "data"
+	metadataGroup = "metadata"
+)
+
+// ErrBackupNotFound is returned when a store holds no backup with an ID
+var ErrBackupNotFound = errors.New("backup not found")
+
+// BackupOptions tunes a cluster backup
+type BackupOptions struct {
+	// Incremental stores only what changed since Parent, or since the latest
+	// backup when Parent is empty
+	Incremental bool
+	Parent      string
+}
+
+// BackupManifest describes a backup. It is written last, so a backup
+// without a manifest is incomplete and ignored.
+type BackupManifest struct {
+	ID      string        `json:"id"`
+	Created time.Time     `json:"created"`
+	Parent  string        `json:"parent,omitempty"` // Set on incremental backups
+	Groups  []GroupBackup `json:"groups"`
+}
+
+// GroupBackup describes the backup of one raft group's state
+type GroupBackup struct {
+	Name    string `json:"name"`
+	Index   uint64 `json:"index"` // Raft index the state is as of
+	Term    uint64 `json:"term"`
+	Object  string `json:"object"`
+	Keys    int    `json:"keys"`
+	Deleted int    `json:"deleted,omitempty"`
+	SHA256  string `json:"sha256"`
+}
+
+// groupState is the stored form of a group backup. Incremental backups
+// hold changed keys and the keys deleted since their parent.
+type groupState struct {
+	Entries map[string]string `json:"entries"`
+	Deleted []string          `json:"deleted,omitempty"`
+}
+
+// backupGroups returns the leaders of the raft groups holding the cluster's state
+func (c *Cluster) backupGroups() (map[string]*RaftNode, error) {
+	leader, err := c.Leader()
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string]*RaftNode{dataGroup: leader.Raft}
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	for _, node := range c.Nodes {
+		if node.Metadata == nil || !node.IsAlive() {
+			continue
+		}
+		if _, role, _ := node.Metadata.Raft().State(); role == Leader {
+			groups[metadataGroup] = node.Metadata.Raft()
+		}
+	}
+	return groups, nil
+}
+
+// consistentSnapshot captures every group at once. No group can commit
+// while all their leaders are locked, so the snapshots form a single point
+// in time across groups.
+func consistentSnapshot(groups map[string]*RaftNode) (map[string]Snapshot, error) {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		groups[name].mutex.Lock()
+		defer groups[names[i]].mutex.Unlock()
+	}
+	snapshots := make(map[string]Snapshot, len(groups))
+	for _, name := range names {
+		n := groups[name]
+		if n.role != Leader {
+			return nil, fmt.Errorf("%s group: %w", name, ErrNotLeader)
+		}
+		snapshots[name] = n.appliedSnapshotLocked()
+	}
+	return snapshots, nil
+}
+
+// Backup writes a point-in-time copy of the cluster's data and metadata to
+// store, such as a local directory or an S3 or GCS bucket, and returns its
+// manifest
+func (c *Cluster) Backup(ctx context.Context, store blobstore.BlobStore, options BackupOptions) (BackupManifest, error) {
+	groups, err := c.backupGroups()
+	if err != nil {
+		return BackupManifest{}, fmt.Errorf("failed to back up cluster: %w", err)
+	}
+	snapshots, err := consistentSnapshot(groups)
+	if err != nil {
+		return BackupManifest{}, fmt.Errorf("failed to back up cluster: %w", err)
+	}
+
+	created := time.Now().UTC()
+	manifest := BackupManifest{ID: created.Format("20060102T150405.000000000Z"), Created: created}
+	var parentState map[string]map[string]string
+	if options.Incremental {
+		parent := options.Parent
+		if parent == "" {
+			backups, err := ListBackups(ctx, store)
+			if err != nil {
+				return BackupManifest{}, err
+			}
+			if len(backups) == 0 {
+				return BackupManifest{}, fmt.Errorf("%w: no backup to increment", ErrBackupNotFound)
+			}
+			parent = backups[len(backups)-1].ID
+		}
+		if parentState, _, err = loadBackup(ctx, store, parent); err != nil {
+			return BackupManifest{}, err
+		}
+		manifest.Parent = parent
+	}
+
+	for name, snapshot := range snapshots {
+		state := groupState{Entries: snapshot.Data}
+		if previous, ok := parentState[name]; ok {
+			state = diffState(previous, snapshot.Data)
+		}
+		encoded, err := json.Marshal(state)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		object := backupPrefix + manifest.ID + "/" + name + ".json"
+		if err := putObject(ctx, store, object, encoded); err != nil {
+			return BackupManifest{}, fmt.Errorf("failed to upload %s: %w", object, err)
+		}
+		manifest.Groups = append(manifest.Groups, GroupBackup{
+			Name:    name,
+			Index:   snapshot.LastIndex,
+			Term:    snapshot.LastTerm,
+			Object:  object,
+			Keys:    len(state.Entries),
+			Deleted: len(state.Deleted),
+			SHA256:  sha256Hex(encoded),
+		})
+	}
+	sort.Slice(manifest.Groups, func(i, j int) bool { return manifest.Groups[i].Name < manifest.Groups[j].Name })
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	if err := putObject(ctx, store, backupPrefix+manifest.ID+"/"+manifestName, encoded); err != nil {
+		return BackupManifest{}, fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	logger.Info("Backed up cluster", "backup", manifest.ID, "parent", manifest.Parent)
+	return manifest, nil
+}
+
+// diffState returns what changed from previous to current
+func diffState(previous, current map[string]string) groupState {
+	state := groupState{Entries: make(map[string]string)}
+	for key, value := range current {
+		if old, ok := previous[key]; !ok || old != value {
+			state.Entries[key] = value
+		}
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			state.Deleted = append(state.Deleted, key)
+		}
+	}
+	sort.Strings(state.Deleted)
+	return state
+}
+
+// ListBackups returns the complete backups in store, oldest first
+func ListBackups(ctx context.Context, store blobstore.BlobStore) ([]BackupManifest, error) {
+	objects, err := store.List(ctx, backupPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	var manifests []BackupManifest
+	for _, object := range objects {
+		key := object.Key
+		if !strings.HasSuffix(key, "/"+manifestName) {
+			continue
+		}
+		manifest, err := readManifest(ctx, store, strings.TrimSuffix(strings.TrimPrefix(key, backupPrefix), "/"+manifestName))
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Created.Before(manifests[j].Created) })
+	return manifests, nil
+}
+
+func readManifest(ctx context.Context, store blobstore.BlobStore, id string) (BackupManifest, error) {
+	var manifest BackupManifest
+	encoded, err := getObject(ctx, store, backupPrefix+id+"/"+manifestName)
+	if errors.Is(err, blobstore.ErrNotExist) {
+		return manifest, fmt.Errorf("%w: %s", ErrBackupNotFound, id)
+	}
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(encoded, &manifest); err != nil {
+		return manifest, fmt.Errorf("malformed manifest of backup %s: %w", id, err)
+	}
+	return manifest, nil
+}
+
+// loadBackup rebuilds the state of every group as of backup id, replaying
+// its chain of incremental backups from the last full one
+func loadBackup(ctx context.Context, store blobstore.BlobStore, id string) (map[string]map[string]string, BackupManifest, error) {
+	var chain []BackupManifest
+	for next := id; next != ""; {
+		manifest, err := readManifest(ctx, store, next)
+		if err != nil {
+			return nil, BackupManifest{}, err
+		}
+		chain = append(chain, manifest)
+		next = manifest.Parent
+	}
+
+	states := make(map[string]map[string]string)
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, group := range chain[i].Groups {
+			encoded, err := getObject(ctx, store, group.Object)
+			if err != nil {
+				return nil, BackupManifest{}, fmt.Errorf("failed to download %s: %w", group.Object, err)
+			}
+			if sha256Hex(encoded) != group.SHA256 {
+				return nil, BackupManifest{}, fmt.Errorf("backup object %s is corrupt", group.Object)
+			}
+			var state groupState
+			if err := json.Unmarshal(encoded, &state); err != nil {
+				return nil, BackupManifest{}, fmt.Errorf("malformed backup object %s: %w", group.Object, err)
+			}
+
+			current, ok := states[group.Name]
+			if !ok || chain[i].Parent == "" {
+				current = make(map[string]string)
+				states[group.Name] = current
+			}
+			for key, value := range state.Entries {
+				current[key] = value
+			}
+			for _, key := range state.Deleted {
+				delete(current, key)
+			}
+		}
+	}
+	return states, chain[0], nil
+}
+
+// RestoreBackup rebuilds the cluster from backup id and starts raft, and the
+// metadata group if the backup holds one, from the restored state. The
+// cluster's nodes must not be running raft yet.
+func (c *Cluster) RestoreBackup(ctx context.Context, store blobstore.BlobStore, id string, config RaftConfig) error {
+	c.Mutex.Lock()
+	for _, node := range c.Nodes {
+		if node.Raft != nil || node.Metadata != nil {
+			c.Mutex.Unlock()
+			return errors.New("cannot restore a backup into a running cluster")
+		}
+	}
+	c.Mutex.Unlock()
+
+	states, manifest, err := loadBackup(ctx, store, id)
+	if err != nil {
+		return fmt.Errorf("failed to restore backup %s: %w", id, err)
+	}
+	snapshots := make(map[string]*Snapshot)
+	for _, group := range manifest.Groups {
+		snapshots[group.Name] = &Snapshot{LastIndex: group.Index, LastTerm: group.Term, Data: states[group.Name]}
+	}
+
+	data, ok := snapshots[dataGroup]
+	if !ok {
+		return fmt.Errorf("backup %s holds no cluster data", id)
+	}
+	c.startRaft(config, data)
+	if metadata, ok := snapshots[metadataGroup]; ok {
+		c.startMetadata(config, metadata)
+	}
+	logger.Info("Restored cluster from backup", "backup", id, "index", data.LastIndex)
+	return nil
+}
+
+// putObject stores a JSON object of a backup
+func putObject(ctx context.Context, store blobstore.BlobStore, key string, data []byte) error {
+	return store.Put(ctx, key, bytes.NewReader(data), blobstore.PutOptions{ContentType: "application/json"})
+}
+
+// getObject reads a whole object of a backup
+func getObject(ctx context.Context, store blobstore.BlobStore, key string) ([]byte, error) {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
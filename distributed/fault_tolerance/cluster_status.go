@@ -0,0 +1,161 @@
+package fault_tolerance
+
+import (
+	"distributed/distributed_indexing"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// recentFailovers is how many failovers the status endpoint reports
+const recentFailovers = 20
+
+// NodeStatus is a node's liveness and raft role
+type NodeStatus struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Alive   bool   `json:"alive"` // The failure detector's verdict
+	Witness bool   `json:"witness,omitempty"`
+	Role    string `json:"role,omitempty"` // Empty until the node runs raft
+	Term    uint64 `json:"term,omitempty"`
+	Keys    int    `json:"keys"`
+}
+
+// ReplicaProgress is how far a replica has copied the leader's log
+type ReplicaProgress struct {
+	ID          string    `json:"id"`
+	MatchIndex  uint64    `json:"match_index"`
+	Lag         uint64    `json:"lag"` // Entries behind the leader
+	LastContact time.Time `json:"last_contact"`
+	Witness     bool      `json:"witness,omitempty"`
+}
+
+// ReplicationStatus is the leader's view of its replicas
+type ReplicationStatus struct {
+	Leader      string            `json:"leader"`
+	Term        uint64            `json:"term"`
+	LastIndex   uint64            `json:"last_index"`
+	CommitIndex uint64            `json:"commit_index"`
+	Replicas    []ReplicaProgress `json:"replicas"`
+}
+
+// ClusterStatus is everything the status endpoint reports
+type ClusterStatus struct {
+	Time        time.Time                               `json:"time"`
+	Nodes       []NodeStatus                            `json:"nodes"`
+	Replication *ReplicationStatus                      `json:"replication,omitempty"` // Nil without a leader
+	Shards      map[string][]distributed_indexing.Shard `json:"shards,omitempty"`
+	Failovers   []FailoverEvent                         `json:"failovers,omitempty"`
+	Errors      []string                                `json:"errors,omitempty"`
+}
+
+// Progress returns the leader's log position and that of each replica. ok
+// is false on nodes that aren't leading.
+func (n *RaftNode) Progress() (status ReplicationStatus, ok bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.role != Leader {
+		return ReplicationStatus{}, false
+	}
+	status = ReplicationStatus{
+		Leader:      n.id,
+		Term:        n.currentTerm,
+		LastIndex:   n.lastIndex(),
+		CommitIndex: n.commitIndex,
+	}
+	for _, peer := range n.peers {
+		replica := ReplicaProgress{
+			ID:          peer,
+			MatchIndex:  n.matchIndex[peer],
+			LastContact: n.lastContact[peer],
+			Witness:     n.witnesses[peer],
+		}
+		if replica.MatchIndex < status.LastIndex {
+			replica.Lag = status.LastIndex - replica.MatchIndex
+		}
+		status.Replicas = append(status.Replicas, replica)
+	}
+	sort.Slice(status.Replicas, func(i, j int) bool { return status.Replicas[i].ID < status.Replicas[j].ID })
+	return status, true
+}
+
+// Status returns the liveness and raft role of every node, ordered by ID
+func (c *Cluster) Status() []NodeStatus {
+	c.Mutex.Lock()
+	nodes := append([]*Node(nil), c.Nodes...)
+	c.Mutex.Unlock()
+
+	statuses := make([]NodeStatus, 0, len(nodes))
+	for _, node := range nodes {
+		node.Mutex.Lock()
+		status := NodeStatus{
+			ID:      node.ID,
+			Address: node.IP,
+			Alive:   node.Alive,
+			Witness: node.Witness,
+			Keys:    len(node.Data),
+		}
+		raft := node.Raft
+		node.Mutex.Unlock()
+		if raft != nil {
+			term, role, _ := raft.State()
+			status.Role, status.Term = role.String(), term
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// ReplicationStatus returns the current leader's view of how far behind each
+// replica is
+func (rm *ReplicationManager) ReplicationStatus() (ReplicationStatus, error) {
+	leader, err := rm.Cluster.Leader()
+	if err != nil {
+		return ReplicationStatus{}, err
+	}
+	status, ok := leader.Raft.Progress()
+	if !ok {
+		return ReplicationStatus{}, ErrNotLeader
+	}
+	return status, nil
+}
+
+// StatusHandler serves GET /cluster/status for operators and the clusterctl
+// tool. shardMap and failover may be nil, leaving their sections out.
+func StatusHandler(rm *ReplicationManager, shardMap *distributed_indexing.ShardMap, failover *FailoverManager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := ClusterStatus{Time: time.Now(), Nodes: rm.Cluster.Status()}
+		if replication, err := rm.ReplicationStatus(); err != nil {
+			status.Errors = append(status.Errors, "replication: "+err.Error())
+		} else {
+			status.Replication = &replication
+		}
+		if shardMap != nil {
+			status.Shards = make(map[string][]distributed_indexing.Shard)
+			for _, index := range shardMap.Indexes() {
+				// Indexes dropped since they were listed are left out
+				if shards, err := shardMap.Shards(index); err == nil {
+					status.Shards[index] = shards
+				}
+			}
+		}
+		if failover != nil {
+			history := failover.History()
+			if len(history) > recentFailovers {
+				history = history[len(history)-recentFailovers:]
+			}
+			status.Failovers = history
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	return mux
+}
@@ -0,0 +1,173 @@
+package fault_tolerance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrQuorumUnavailable is returned when too few replicas are reachable to
+// meet the requested consistency level
+var ErrQuorumUnavailable = errors.New("not enough replicas for consistency level")
+
+// ErrWitness is returned when a witness, which holds no data, is asked to read
+var ErrWitness = errors.New("witness node holds no data")
+
+// ConsistencyLevel is how many replicas must acknowledge a read or write
+type ConsistencyLevel int
+
+const (
+	// One is acknowledged by a single replica. Writes return once the leader
+	// has logged them and may be lost if it fails; reads may be stale.
+	One ConsistencyLevel = iota
+	// Quorum is acknowledged by a majority, making reads and writes linearizable
+	Quorum
+	// All is acknowledged by every replica
+	All
+)
+
+// String returns the name of the level
+func (c ConsistencyLevel) String() string {
+	switch c {
+	case One:
+		return "ONE"
+	case Quorum:
+		return "QUORUM"
+	case All:
+		return "ALL"
+	}
+	return fmt.Sprintf("level-%d", int(c))
+}
+
+// replicas returns how many of clusterSize nodes must acknowledge at this level
+func (c ConsistencyLevel) replicas(clusterSize int) int {
+	switch c {
+	case One:
+		return 1
+	case All:
+		return clusterSize
+	}
+	return clusterSize/2 + 1
+}
+
+// reachablePeers counts the peers that answered within an election timeout,
+// leaving out witnesses when dataOnly is set; callers hold the mutex
+func (n *RaftNode) reachablePeers(dataOnly bool) int {
+	reachable := 0
+	for _, peer := range n.peers {
+		if dataOnly && n.witnesses[peer] {
+			continue
+		}
+		if time.Since(n.lastContact[peer]) < n.config.ElectionTimeout {
+			reachable++
+		}
+	}
+	return reachable
+}
+
+// Read returns the value of key at the given level. One reads this node's
+// state as is. Quorum and All must be served by the leader, which confirms
+// with that many replicas that it still leads before answering, so the read
+// reflects every write committed before it started.
+func (n *RaftNode) Read(ctx context.Context, key string, level ConsistencyLevel) (string, error) {
+	if n.witness {
+		return "", ErrWitness
+	}
+	if level == One {
+		value, ok := n.machine.Get(key)
+		if !ok {
+			return "", fmt.Errorf("key %s not found", key)
+		}
+		return value, nil
+	}
+
+	n.mutex.Lock()
+	if n.role != Leader {
+		n.mutex.Unlock()
+		return "", ErrNotLeader
+	}
+	// Until the leader commits an entry of its own term it can't tell which
+	// earlier entries are committed
+	if n.commitIndex == 0 || n.termAt(n.commitIndex) != n.currentTerm {
+		n.mutex.Unlock()
+		return "", fmt.Errorf("leader has not committed in its term yet: %w", ErrNotLeader)
+	}
+	readIndex := n.commitIndex
+	term := n.currentTerm
+	n.mutex.Unlock()
+
+	if err := n.confirmLeadership(ctx, term, level.replicas(len(n.peers)+1)); err != nil {
+		return "", err
+	}
+
+	// The leader applies entries as it commits them, so readIndex is applied
+	n.mutex.Lock()
+	applied := n.lastApplied >= readIndex
+	n.mutex.Unlock()
+	if !applied {
+		return "", ErrLeadershipLost
+	}
+
+	value, ok := n.machine.Get(key)
+	if !ok {
+		return "", fmt.Errorf("key %s not found", key)
+	}
+	return value, nil
+}
+
+// confirmLeadership sends a heartbeat round and waits until required nodes,
+// this one included, acknowledge it as leader of term
+func (n *RaftNode) confirmLeadership(ctx context.Context, term uint64, required int) error {
+	acks := make(chan bool, len(n.peers))
+
+	n.mutex.Lock()
+	for _, peer := range n.peers {
+		prev := n.nextIndex[peer] - 1
+		if prev < n.baseIndex() {
+			prev = n.baseIndex()
+		}
+		if prev > n.lastIndex() {
+			prev = n.lastIndex()
+		}
+		args := AppendEntriesArgs{
+			Term:         term,
+			LeaderID:     n.id,
+			PrevLogIndex: prev,
+			PrevLogTerm:  n.termAt(prev),
+			LeaderCommit: n.commitIndex,
+		}
+		go func(peer string) {
+			reply, err := n.transport.AppendEntries(peer, args)
+			if err != nil {
+				acks <- false
+				return
+			}
+			n.mutex.Lock()
+			ok := n.handleReplyTerm(reply.Term, term)
+			if ok {
+				n.lastContact[peer] = time.Now()
+			}
+			n.mutex.Unlock()
+			acks <- ok
+		}(peer)
+	}
+	n.mutex.Unlock()
+
+	confirmed, answered := 1, 0
+	for confirmed < required {
+		if answered == len(n.peers) {
+			return fmt.Errorf("%w: %d of %d replicas confirmed the leader", ErrQuorumUnavailable, confirmed, required)
+		}
+		select {
+		case ok := <-acks:
+			answered++
+			if ok {
+				confirmed++
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package fault_tolerance
+
+import (
+	"distributed/distributed_indexing"
+	"sync"
+	"time"
+)
+
+// ReplicaPosition reports how far a node's copy of a shard has caught up,
+// e.g. the last log index it applied. Higher is more up to date.
+type ReplicaPosition func(shard distributed_indexing.Shard, nodeID string) (uint64, error)
+
+// PromotionPolicy decides which replica of a failed primary takes over
+type PromotionPolicy int
+
+const (
+	// PromoteMostUpToDate asks every live replica for its position and
+	// promotes the furthest along, so the fewest writes are lost
+	PromoteMostUpToDate PromotionPolicy = iota
+	// PromoteInOrder promotes the next live replica in the shard map without
+	// asking replicas anything, for when positions aren't tracked
+	PromoteInOrder
+)
+
+// FailoverPolicy tunes when and how failover happens
+type FailoverPolicy struct {
+	TriggerOn         Suspicion     // Suspicion level that fails a node over; Suspect acts sooner at the risk of needless promotions
+	GracePeriod       time.Duration // Time a failed node has to come back before its shards fail over
+	Promotion         PromotionPolicy
+	DropFailedReplica bool // Remove the failed node's replicas from the shard map, leaving the rebalancer to replace them
+}
+
+// DefaultFailoverPolicy fails over nodes 5s after they are marked down,
+// promoting the most up-to-date replica
+var DefaultFailoverPolicy = FailoverPolicy{
+	TriggerOn:   Down,
+	GracePeriod: 5 * time.Second,
+	Promotion:   PromoteMostUpToDate,
+}
+
+// LoadBalancerNotifier is the part of a load balancer failover drives, so it
+// stops routing to failed nodes and resumes once they recover
+type LoadBalancerNotifier interface {
+	DrainNode(nodeID string) error
+	UndrainNode(nodeID string) error
+}
+
+// FailoverEvent records a replica promoted in place of a failed primary
+type FailoverEvent struct {
+	Index    string    `json:"index"`
+	ShardID  string    `json:"shard"`
+	Failed   string    `json:"failed"`
+	Promoted string    `json:"promoted"`
+	Position uint64    `json:"position"`
+	Time     time.Time `json:"time"`
+}
+
+// FailoverManager promotes replicas when the nodes holding shard primaries
+// fail, updates the shard map and tells load balancers to route around the
+// failed nodes
+type FailoverManager struct {
+	shardMap *distributed_indexing.ShardMap
+	position ReplicaPosition
+	policy   FailoverPolicy
+
+	mutex     sync.Mutex
+	failed    map[string]bool
+	pending   map[string]*time.Timer // Failovers waiting out the grace period
+	balancers []LoadBalancerNotifier
+	callbacks []func(FailoverEvent)
+	history   []FailoverEvent
+	token     uint64 // Fencing token shard map changes are made with
+}
+
+// NewFailoverManager creates a failover manager for the shards in shardMap.
+// position may be nil under PromoteInOrder.
+func NewFailoverManager(shardMap *distributed_indexing.ShardMap, position ReplicaPosition, policy FailoverPolicy) *FailoverManager {
+	if position == nil {
+		policy.Promotion = PromoteInOrder
+	}
+	return &FailoverManager{
+		shardMap: shardMap,
+		position: position,
+		policy:   policy,
+		failed:   make(map[string]bool),
+		pending:  make(map[string]*time.Timer),
+	}
+}
+
+// Watch fails nodes over as the failure detector reports them
+func (fm *FailoverManager) Watch(detector *FailureDetector) {
+	detector.OnStatusChange(func(node *Node, from, to Suspicion) {
+		switch {
+		case to >= fm.policy.TriggerOn && from < fm.policy.TriggerOn:
+			fm.NodeFailed(node.ID)
+		case to < fm.policy.TriggerOn && from >= fm.policy.TriggerOn:
+			fm.NodeRecovered(node.ID)
+		}
+	})
+}
+
+// AddLoadBalancer registers a load balancer to notify of failed and recovered nodes
+func (fm *FailoverManager) AddLoadBalancer(lb LoadBalancerNotifier) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	fm.balancers = append(fm.balancers, lb)
+}
+
+// OnFailover registers a callback for every promotion
+func (fm *FailoverManager) OnFailover(callback func(FailoverEvent)) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	fm.callbacks = append(fm.callbacks, callback)
+}
+
+// SetFencingToken sets the token of the placement lock the manager holds,
+// which the shard map checks on every promotion
+func (fm *FailoverManager) SetFencingToken(token uint64) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	fm.token = token
+}
+
+func (fm *FailoverManager) fencingToken() uint64 {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	return fm.token
+}
+
+// NodeFailed drains the node from the load balancers and, unless it
+// recovers within the grace period, fails its primaries over
+func (fm *FailoverManager) NodeFailed(nodeID string) {
+	fm.mutex.Lock()
+	if fm.failed[nodeID] {
+		fm.mutex.Unlock()
+		return
+	}
+	fm.failed[nodeID] = true
+	balancers := append([]LoadBalancerNotifier(nil), fm.balancers...)
+	if fm.policy.GracePeriod > 0 {
+		fm.pending[nodeID] = time.AfterFunc(fm.policy.GracePeriod, func() { fm.failover(nodeID) })
+	}
+	fm.mutex.Unlock()
+
+	logger.Warn("Node failed, draining it from load balancers", "node", nodeID, "balancers", len(balancers))
+	for _, lb := range balancers {
+		if err := lb.DrainNode(nodeID); err != nil {
+			logger.Error("Failed to drain node", "node", nodeID, "error", err)
+		}
+	}
+	if fm.policy.GracePeriod <= 0 {
+		fm.failover(nodeID)
+	}
+}
+
+// NodeRecovered cancels a pending failover and returns the node to the load
+// balancers. Shards that already failed over keep their new primary; the
+// node serves as a replica.
+func (fm *FailoverManager) NodeRecovered(nodeID string) {
+	fm.mutex.Lock()
+	if !fm.failed[nodeID] {
+		fm.mutex.Unlock()
+		return
+	}
+	delete(fm.failed, nodeID)
+	if timer, ok := fm.pending[nodeID]; ok {
+		timer.Stop()
+		delete(fm.pending, nodeID)
+		logger.Info("Node recovered within the grace period, failover cancelled", "node", nodeID)
+	}
+	balancers := append([]LoadBalancerNotifier(nil), fm.balancers...)
+	fm.mutex.Unlock()
+
+	for _, lb := range balancers {
+		if err := lb.UndrainNode(nodeID); err != nil {
+			logger.Error("Failed to undrain node", "node", nodeID, "error", err)
+		}
+	}
+}
+
+// failover promotes a replica for every shard the failed node was primary of
+func (fm *FailoverManager) failover(nodeID string) {
+	fm.mutex.Lock()
+	delete(fm.pending, nodeID)
+	if !fm.failed[nodeID] {
+		fm.mutex.Unlock()
+		return
+	}
+	fm.mutex.Unlock()
+
+	for _, shard := range fm.shardMap.NodeShards(nodeID) {
+		if shard.Primary() == nodeID {
+			fm.promote(shard, nodeID)
+		}
+		if fm.policy.DropFailedReplica {
+			err := fm.shardMap.Fenced(fm.fencingToken(), func() error {
+				return fm.shardMap.RemoveReplica(shard.Index, shard.ID, nodeID)
+			})
+			if err != nil {
+				logger.Error("Failed to drop replica", "shard", shard.ID, "node", nodeID, "error", err)
+			}
+		}
+	}
+}
+
+// promote picks a live replica by policy and makes it the shard's primary
+func (fm *FailoverManager) promote(shard distributed_indexing.Shard, failed string) {
+	best, bestPosition, found := "", uint64(0), false
+	for _, replica := range shard.Replicas[1:] {
+		if fm.isFailed(replica) {
+			continue
+		}
+		if fm.policy.Promotion == PromoteInOrder {
+			best, found = replica, true
+			break
+		}
+		position, err := fm.position(shard, replica)
+		if err != nil {
+			logger.Warn("Skipping replica", "shard", shard.ID, "node", replica, "error", err)
+			continue
+		}
+		if !found || position > bestPosition {
+			best, bestPosition, found = replica, position, true
+		}
+	}
+	if !found {
+		logger.Error("No live replica to promote, shard unavailable", "index", shard.Index, "shard", shard.ID)
+		return
+	}
+
+	err := fm.shardMap.Fenced(fm.fencingToken(), func() error {
+		return fm.shardMap.PromoteReplica(shard.Index, shard.ID, best)
+	})
+	if err != nil {
+		logger.Error("Failed to promote replica", "index", shard.Index, "shard", shard.ID, "node", best, "error", err)
+		return
+	}
+	event := FailoverEvent{
+		Index:    shard.Index,
+		ShardID:  shard.ID,
+		Failed:   failed,
+		Promoted: best,
+		Position: bestPosition,
+		Time:     time.Now(),
+	}
+
+	fm.mutex.Lock()
+	fm.history = append(fm.history, event)
+	callbacks := append([]func(FailoverEvent){}, fm.callbacks...)
+	fm.mutex.Unlock()
+
+	logger.Info("Failed shard over", "index", shard.Index, "shard", shard.ID, "from", failed, "to", best)
+	for _, callback := range callbacks {
+		callback(event)
+	}
+}
+
+func (fm *FailoverManager) isFailed(nodeID string) bool {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	return fm.failed[nodeID]
+}
+
+// History returns the promotions made so far, oldest first
+func (fm *FailoverManager) History() []FailoverEvent {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	return append([]FailoverEvent(nil), fm.history...)
+}
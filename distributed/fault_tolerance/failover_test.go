@@ -0,0 +1,34 @@
+package fault_tolerance_test
+
+import (
+	"distributed/distributed_indexing"
+	"distributed/fault_tolerance"
+	"testing"
+)
+
+// Test that a failed primary's most up-to-date replica is promoted
+func TestFailover(t *testing.T) {
+	shardMap := distributed_indexing.NewShardMap()
+	if err := shardMap.CreateIndex("pages", 1, 3, []string{"Node1", "Node2", "Node3"}); err != nil {
+		t.Fatalf("Failed to partition index: %v", err)
+	}
+
+	positions := map[string]uint64{"Node2": 10, "Node3": 12}
+	position := func(shard distributed_indexing.Shard, nodeID string) (uint64, error) {
+		return positions[nodeID], nil
+	}
+	policy := fault_tolerance.DefaultFailoverPolicy
+	policy.GracePeriod = 0
+	manager := fault_tolerance.NewFailoverManager(shardMap, position, policy)
+
+	manager.NodeFailed("Node1")
+
+	shard, _ := shardMap.Lookup("pages", "doc-1")
+	if shard.Primary() != "Node3" {
+		t.Fatalf("Expected Node3 to be promoted, primary is %s", shard.Primary())
+	}
+	if history := manager.History(); len(history) != 1 || history[0].Failed != "Node1" {
+		t.Fatalf("Unexpected failover history: %+v", history)
+	}
+	t.Logf("Failover successfully promoted %s for Node1", shard.Primary())
+}
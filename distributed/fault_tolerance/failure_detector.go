@@ -0,0 +1,233 @@
+package fault_tolerance
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Suspicion is how strongly the failure detector believes a node has failed
+type Suspicion int
+
+const (
+	Healthy Suspicion = iota
+	Suspect
+	Down
+)
+
+// String returns the name of the suspicion level
+func (s Suspicion) String() string {
+	switch s {
+	case Healthy:
+		return "healthy"
+	case Suspect:
+		return "suspect"
+	case Down:
+		return "down"
+	}
+	return "unknown"
+}
+
+// FailureDetectorConfig tunes the phi accrual failure detector. Phi is the
+// confidence, on a log10 scale, that a node has failed given how late its
+// heartbeat is compared to the intervals seen so far.
+type FailureDetectorConfig struct {
+	HeartbeatInterval time.Duration
+	PingTimeout       time.Duration
+	SuspectPhi        float64 // Phi above which a node is suspected
+	DownPhi           float64 // Phi above which a node is marked down
+	WindowSize        int     // Heartbeat intervals kept per node
+	MinStdDev         time.Duration
+}
+
+// DefaultFailureDetectorConfig marks a node down after roughly five missed
+// heartbeats on a steady network
+var DefaultFailureDetectorConfig = FailureDetectorConfig{
+	HeartbeatInterval: time.Second,
+	PingTimeout:       500 * time.Millisecond,
+	SuspectPhi:        3,
+	DownPhi:           8,
+	WindowSize:        100,
+	MinStdDev:         100 * time.Millisecond,
+}
+
+// StatusChangeFunc is called when a node moves between suspicion levels
+type StatusChangeFunc func(node *Node, from, to Suspicion)
+
+// heartbeatHistory holds the recent heartbeat intervals of a node
+type heartbeatHistory struct {
+	intervals []float64 // Milliseconds
+	last      time.Time
+}
+
+// record adds a heartbeat received at now
+func (h *heartbeatHistory) record(now time.Time, windowSize int) {
+	h.intervals = append(h.intervals, float64(now.Sub(h.last))/float64(time.Millisecond))
+	if len(h.intervals) > windowSize {
+		h.intervals = h.intervals[len(h.intervals)-windowSize:]
+	}
+	h.last = now
+}
+
+// phi estimates how unlikely it is that the next heartbeat is merely late,
+// assuming normally distributed intervals
+func (h *heartbeatHistory) phi(now time.Time, minStdDev time.Duration) float64 {
+	var mean, variance float64
+	for _, interval := range h.intervals {
+		mean += interval
+	}
+	mean /= float64(len(h.intervals))
+	for _, interval := range h.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	stdDev := math.Max(math.Sqrt(variance/float64(len(h.intervals))), float64(minStdDev)/float64(time.Millisecond))
+
+	// Logistic approximation of the normal CDF
+	elapsed := float64(now.Sub(h.last)) / float64(time.Millisecond)
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// FailureDetector pings the nodes of a cluster over their listeners and
+// marks them alive or dead from how regularly they answer
+type FailureDetector struct {
+	config    FailureDetectorConfig
+	ping      func(node *Node) error
+	mutex     sync.Mutex
+	history   map[string]*heartbeatHistory
+	status    map[string]Suspicion
+	callbacks []StatusChangeFunc
+}
+
+// NewFailureDetector creates a detector pinging nodes with Node.HealthCheck
+func NewFailureDetector(config FailureDetectorConfig) *FailureDetector {
+	return &FailureDetector{
+		config: config,
+		ping: func(node *Node) error {
+			return node.HealthCheck(config.PingTimeout)
+		},
+		history: make(map[string]*heartbeatHistory),
+		status:  make(map[string]Suspicion),
+	}
+}
+
+// SetPing replaces how nodes are pinged, e.g. for in-process clusters
+func (fd *FailureDetector) SetPing(ping func(node *Node) error) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	fd.ping = ping
+}
+
+// OnStatusChange registers a callback for suspicion changes, e.g. to trigger failover
+func (fd *FailureDetector) OnStatusChange(callback StatusChangeFunc) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	fd.callbacks = append(fd.callbacks, callback)
+}
+
+// Heartbeat records that the node answered at now
+func (fd *FailureDetector) Heartbeat(nodeID string, now time.Time) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	fd.historyLocked(nodeID, now).record(now, fd.config.WindowSize)
+}
+
+// historyLocked returns the node's history, seeding a new one with a single
+// expected interval so nodes that never answer are still detected
+func (fd *FailureDetector) historyLocked(nodeID string, now time.Time) *heartbeatHistory {
+	h, ok := fd.history[nodeID]
+	if !ok {
+		interval := float64(fd.config.HeartbeatInterval) / float64(time.Millisecond)
+		h = &heartbeatHistory{intervals: []float64{interval}, last: now}
+		fd.history[nodeID] = h
+	}
+	return h
+}
+
+// Phi returns the current suspicion value of the node
+func (fd *FailureDetector) Phi(nodeID string) float64 {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	h, ok := fd.history[nodeID]
+	if !ok {
+		return 0
+	}
+	return h.phi(time.Now(), fd.config.MinStdDev)
+}
+
+// Status returns the suspicion level of the node
+func (fd *FailureDetector) Status(nodeID string) Suspicion {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	return fd.status[nodeID]
+}
+
+// Run pings every node of the cluster each heartbeat interval and updates
+// their suspicion levels and Alive state. It blocks, so start it with go.
+func (fd *FailureDetector) Run(c *Cluster) {
+	ticker := time.NewTicker(fd.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.Mutex.Lock()
+		nodes := append([]*Node(nil), c.Nodes...)
+		c.Mutex.Unlock()
+
+		fd.mutex.Lock()
+		ping := fd.ping
+		fd.mutex.Unlock()
+
+		var wg sync.WaitGroup
+		for _, node := range nodes {
+			wg.Add(1)
+			go func(node *Node) {
+				defer wg.Done()
+				if err := ping(node); err == nil {
+					fd.Heartbeat(node.ID, time.Now())
+				}
+			}(node)
+		}
+		wg.Wait()
+
+		for _, node := range nodes {
+			fd.evaluate(node, time.Now())
+		}
+	}
+}
+
+// evaluate moves the node to the suspicion level its phi calls for
+func (fd *FailureDetector) evaluate(node *Node, now time.Time) {
+	fd.mutex.Lock()
+	phi := fd.historyLocked(node.ID, now).phi(now, fd.config.MinStdDev)
+	to := Healthy
+	switch {
+	case phi >= fd.config.DownPhi:
+		to = Down
+	case phi >= fd.config.SuspectPhi:
+		to = Suspect
+	}
+	from := fd.status[node.ID]
+	fd.status[node.ID] = to
+	callbacks := append([]StatusChangeFunc(nil), fd.callbacks...)
+	fd.mutex.Unlock()
+
+	if from == to {
+		return
+	}
+	logger.Info("Node changed state", "node", node.ID, "state", to, "phi", phi)
+
+	switch {
+	case to == Down:
+		node.setAlive(false)
+	case from == Down:
+		node.setAlive(true)
+		node.HandleFailure()
+	}
+	for _, callback := range callbacks {
+		callback(node, from, to)
+	}
+}
@@ -0,0 +1,328 @@
+package fault_tolerance
+
+import (
+	"context"
+	"distributed/distributed_indexing"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Key prefixes of the metadata the cluster keeps
+const (
+	MembersPrefix = "members/"
+	ShardsPrefix  = "shards/"
+	ConfigPrefix  = "config/"
+	// watchBuffer is how many events a watcher may fall behind by
+	watchBuffer = 256
+)
+
+// EventType is the kind of change a watch reports
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// WatchEvent is a change to a metadata key, at the raft index that made it
+type WatchEvent struct {
+	Type  EventType `json:"type"`
+	Key   string    `json:"key"`
+	Value string    `json:"value,omitempty"`
+	Index uint64    `json:"index"`
+}
+
+// Member is a node registered in the cluster
+type Member struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Witness bool   `json:"witness,omitempty"`
+}
+
+type watcher struct {
+	prefix string
+	events chan WatchEvent
+}
+
+// MetadataStore holds cluster membership, shard maps and configuration in
+// a raft group of its own, so every node sees the same metadata and can
+// watch it change. Writes go through the group's leader; reads are served
+// from the node's own copy, which may briefly lag the leader.
+type MetadataStore struct {
+	raft *RaftNode
+
+	mutex    sync.Mutex
+	data     map[string]string
+	index    uint64
+	watchers map[*watcher]bool
+	stopped  bool
+}
+
+// NewMetadataStore creates a member of the metadata group with the given peers
+func NewMetadataStore(id string, peers []string, transport Transport, config RaftConfig) *MetadataStore {
+	s := &MetadataStore{
+		data:     make(map[string]string),
+		watchers: make(map[*watcher]bool),
+	}
+	config.Witnesses = nil
+	s.raft = NewRaftNode(id, peers, transport, s, config)
+	return s
+}
+
+// Raft returns the store's raft node, e.g. to serve it with RaftHandler
+func (s *MetadataStore) Raft() *RaftNode {
+	return s.raft
+}
+
+// Run drives the store's raft group until Stop is called
+func (s *MetadataStore) Run() {
+	s.raft.Run()
+}
+
+// Stop halts the raft group and closes all watches
+func (s *MetadataStore) Stop() {
+	s.raft.Stop()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	for w := range s.watchers {
+		close(w.events)
+		delete(s.watchers, w)
+	}
+}
+
+// Put sets key once a majority of the group stores it. Only the leader
+// accepts writes.
+func (s *MetadataStore) Put(ctx context.Context, key, value string) error {
+	if value == "" {
+		return errors.New("empty metadata value, use Delete")
+	}
+	return s.raft.Propose(ctx, key, value, Quorum)
+}
+
+// Delete removes key once a majority of the group stores the deletion.
+// Deletes are entries with an empty value.
+func (s *MetadataStore) Delete(ctx context.Context, key string) error {
+	return s.raft.Propose(ctx, key, "", Quorum)
+}
+
+// Get returns the node's copy of key
+func (s *MetadataStore) Get(key string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.data[key]
+	return value, ok
+}
+
+// List returns the keys under prefix with their values
+func (s *MetadataStore) List(prefix string) map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make(map[string]string)
+	for key, value := range s.data {
+		if strings.HasPrefix(key, prefix) {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// Watch streams the changes to keys under prefix until ctx is done or the
+// store stops. A watcher that falls more than watchBuffer events behind has
+// its channel closed and must List and Watch again.
+func (s *MetadataStore) Watch(ctx context.Context, prefix string) <-chan WatchEvent {
+	w := &watcher{prefix: prefix, events: make(chan WatchEvent, watchBuffer)}
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		close(w.events)
+		return w.events
+	}
+	s.watchers[w] = true
+	s.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.watchers[w] {
+			close(w.events)
+			delete(s.watchers, w)
+		}
+	}()
+	return w.events
+}
+
+// notifyLocked sends an event to the watchers of its key; callers hold the mutex
+func (s *MetadataStore) notifyLocked(event WatchEvent) {
+	for w := range s.watchers {
+		if !strings.HasPrefix(event.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			logger.Warn("Metadata watcher fell behind, closing it", "prefix", w.prefix)
+			close(w.events)
+			delete(s.watchers, w)
+		}
+	}
+}
+
+// Apply stores a committed metadata write; MetadataStore is the raft state machine
+func (s *MetadataStore) Apply(key, value string, index uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.index = index
+	if value == "" {
+		if _, ok := s.data[key]; !ok {
+			return
+		}
+		delete(s.data, key)
+		s.notifyLocked(WatchEvent{Type: EventDelete, Key: key, Index: index})
+		return
+	}
+	s.data[key] = value
+	s.notifyLocked(WatchEvent{Type: EventPut, Key: key, Value: value, Index: index})
+}
+
+// Snapshot returns a copy of the metadata for raft log compaction
+func (s *MetadataStore) Snapshot() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data := make(map[string]string, len(s.data))
+	for key, value := range s.data {
+		data[key] = value
+	}
+	return data
+}
+
+// Restore replaces the metadata with a raft snapshot, telling watchers what changed
+func (s *MetadataStore) Restore(data map[string]string, index uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key := range s.data {
+		if _, ok := data[key]; !ok {
+			s.notifyLocked(WatchEvent{Type: EventDelete, Key: key, Index: index})
+		}
+	}
+	for key, value := range data {
+		if current, ok := s.data[key]; !ok || current != value {
+			s.notifyLocked(WatchEvent{Type: EventPut, Key: key, Value: value, Index: index})
+		}
+	}
+	s.data = make(map[string]string, len(data))
+	for key, value := range data {
+		s.data[key] = value
+	}
+	s.index = index
+}
+
+// Index returns the raft index of the last change applied to the node's copy
+func (s *MetadataStore) Index() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.index
+}
+
+// PutMember registers a node in the cluster
+func (s *MetadataStore) PutMember(ctx context.Context, member Member) error {
+	encoded, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, MembersPrefix+member.ID, string(encoded))
+}
+
+// RemoveMember unregisters a node
+func (s *MetadataStore) RemoveMember(ctx context.Context, id string) error {
+	return s.Delete(ctx, MembersPrefix+id)
+}
+
+// Members returns the registered nodes ordered by ID
+func (s *MetadataStore) Members() []Member {
+	var members []Member
+	for key, value := range s.List(MembersPrefix) {
+		var member Member
+		if err := json.Unmarshal([]byte(value), &member); err != nil {
+			logger.Warn("Skipping malformed member", "key", key, "error", err)
+			continue
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// PutShards records the shards of an index
+func (s *MetadataStore) PutShards(ctx context.Context, index string, shards []distributed_indexing.Shard) error {
+	encoded, err := json.Marshal(shards)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, ShardsPrefix+index, string(encoded))
+}
+
+// Shards returns the recorded shards of an index
+func (s *MetadataStore) Shards(index string) ([]distributed_indexing.Shard, error) {
+	value, ok := s.Get(ShardsPrefix + index)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", distributed_indexing.ErrIndexNotFound, index)
+	}
+	var shards []distributed_indexing.Shard
+	if err := json.Unmarshal([]byte(value), &shards); err != nil {
+		return nil, fmt.Errorf("malformed shards of %s: %w", index, err)
+	}
+	return shards, nil
+}
+
+// SetConfig sets a cluster-wide configuration value
+func (s *MetadataStore) SetConfig(ctx context.Context, key, value string) error {
+	return s.Put(ctx, ConfigPrefix+key, value)
+}
+
+// Config returns a cluster-wide configuration value
+func (s *MetadataStore) Config(key string) (string, bool) {
+	return s.Get(ConfigPrefix + key)
+}
+
+// SyncShardMap keeps m in line with the shard maps in the store until ctx
+// is done, so the query router follows placement changes made anywhere in
+// the cluster
+func (s *MetadataStore) SyncShardMap(ctx context.Context, m *distributed_indexing.ShardMap) {
+	for {
+		events := s.Watch(ctx, ShardsPrefix)
+		for key := range s.List(ShardsPrefix) {
+			s.syncIndex(m, strings.TrimPrefix(key, ShardsPrefix))
+		}
+		for event := range events {
+			s.syncIndex(m, strings.TrimPrefix(event.Key, ShardsPrefix))
+		}
+		// The watch closed: it either fell behind and must restart, or is over
+		s.mutex.Lock()
+		stopped := s.stopped
+		s.mutex.Unlock()
+		if stopped || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (s *MetadataStore) syncIndex(m *distributed_indexing.ShardMap, index string) {
+	shards, err := s.Shards(index)
+	if errors.Is(err, distributed_indexing.ErrIndexNotFound) {
+		m.DropIndex(index)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to sync shards", "index", index, "error", err)
+		return
+	}
+	if err := m.SetShards(index, shards); err != nil {
+		logger.Error("Failed to sync shards", "index", index, "error", err)
+	}
+}
@@ -0,0 +1,839 @@
+package fault_tolerance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotLeader is returned when a write is proposed to a node that isn't the leader
+	ErrNotLeader = errors.New("not the raft leader")
+	// ErrLeadershipLost is returned when a node loses leadership before a
+	// proposed write commits; the write may or may not commit under the new leader
+	ErrLeadershipLost = errors.New("raft leadership lost before commit")
+)
+
+// Role is the raft role of a node
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+// String returns the name of the role
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("role-%d", int(r))
+}
+
+// RaftConfig tunes the timing and log compaction of a raft node
+type RaftConfig struct {
+	ElectionTimeout   time.Duration // Minimum; each timeout is randomised up to twice this
+	HeartbeatInterval time.Duration
+	SnapshotThreshold int // Applied entries kept in the log before it is compacted
+	// Witnesses are the members that vote and store log positions but no
+	// data, letting two data nodes keep a majority through a partition
+	Witnesses []string
+}
+
+// DefaultRaftConfig suits nodes on a local network
+var DefaultRaftConfig = RaftConfig{
+	ElectionTimeout:   300 * time.Millisecond,
+	HeartbeatInterval: 50 * time.Millisecond,
+	SnapshotThreshold: 1024,
+}
+
+// LogEntry is a write in the replicated log. Entries with an empty key are
+// no-ops appended by new leaders.
+type LogEntry struct {
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Snapshot is the state machine as of LastIndex, replacing the log up to it
+type Snapshot struct {
+	LastIndex uint64            `json:"last_index"`
+	LastTerm  uint64            `json:"last_term"`
+	Data      map[string]string `json:"data"`
+}
+
+// StateMachine is the replicated state raft applies committed writes to
+type StateMachine interface {
+	Apply(key, value string, index uint64)
+	Snapshot() map[string]string
+	Restore(data map[string]string, index uint64)
+	Get(key string) (string, bool)
+}
+
+// RequestVoteArgs is sent by candidates to gather votes
+type RequestVoteArgs struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+// RequestVoteReply answers a RequestVote
+type RequestVoteReply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote_granted"`
+}
+
+// AppendEntriesArgs is sent by the leader to replicate entries and as heartbeat
+type AppendEntriesArgs struct {
+	Term         uint64     `json:"term"`
+	LeaderID     string     `json:"leader_id"`
+	PrevLogIndex uint64     `json:"prev_log_index"`
+	PrevLogTerm  uint64     `json:"prev_log_term"`
+	Entries      []LogEntry `json:"entries"`
+	LeaderCommit uint64     `json:"leader_commit"`
+}
+
+// AppendEntriesReply answers an AppendEntries. On failure ConflictIndex is
+// where the leader should retry from.
+type AppendEntriesReply struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflict_index"`
+}
+
+// InstallSnapshotArgs is sent by the leader to followers that fell behind its log
+type InstallSnapshotArgs struct {
+	Term     uint64   `json:"term"`
+	LeaderID string   `json:"leader_id"`
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+// InstallSnapshotReply answers an InstallSnapshot
+type InstallSnapshotReply struct {
+	Term uint64 `json:"term"`
+}
+
+// proposal is a write waiting for its entry to commit and reach enough replicas
+type proposal struct {
+	term     uint64
+	replicas int
+	dataOnly bool // Only data nodes count towards replicas
+	done     chan error
+}
+
+// RaftNode replicates writes to a StateMachine with the raft consensus
+// protocol. Writes are linearizable and survive the failure of a minority of
+// nodes. Membership is fixed at creation. Nodes created with
+// NewPersistentRaftNode store their term, vote and log before acting on
+// them, so they can restart; others keep them in memory only.
+type RaftNode struct {
+	id        string
+	peers     []string
+	transport Transport
+	machine   StateMachine
+	config    RaftConfig
+	storage   RaftStorage     // nil keeps the state in memory only
+	witness   bool            // This node votes but holds no data
+	witnesses map[string]bool // Peers that vote but hold no data
+
+	mutex            sync.Mutex
+	role             Role
+	currentTerm      uint64
+	votedFor         string
+	leaderID         string
+	log              []LogEntry // log[0] stands for the snapshot
+	snapshot         Snapshot
+	commitIndex      uint64
+	lastApplied      uint64
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	replicating      map[string]bool
+	proposals        map[uint64]proposal
+	lastContact      map[string]time.Time // Last reply from each peer
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+	stop             chan struct{}
+}
+
+// NewRaftNode creates a follower replicating to machine with the given peers.
+// A node listed in config.Witnesses never applies entries, so its machine
+// may be nil.
+func NewRaftNode(id string, peers []string, transport Transport, machine StateMachine, config RaftConfig) *RaftNode {
+	witnesses := make(map[string]bool)
+	for _, witness := range config.Witnesses {
+		witnesses[witness] = true
+	}
+	n := &RaftNode{
+		id:          id,
+		peers:       peers,
+		transport:   transport,
+		machine:     machine,
+		config:      config,
+		witness:     witnesses[id],
+		witnesses:   witnesses,
+		role:        Follower,
+		log:         []LogEntry{{}},
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		replicating: make(map[string]bool),
+		proposals:   make(map[uint64]proposal),
+		lastContact: make(map[string]time.Time),
+		stop:        make(chan struct{}),
+	}
+	n.resetElectionTimer()
+	return n
+}
+
+// NewPersistentRaftNode creates a follower like NewRaftNode whose term, vote
+// and log are kept in storage, resuming from what it held before a restart.
+// The storage is the caller's to close once the node has stopped.
+func NewPersistentRaftNode(id string, peers []string, transport Transport, machine StateMachine, config RaftConfig, storage RaftStorage) (*RaftNode, error) {
+	state, err := storage.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load raft state of node %s: %w", id, err)
+	}
+	n := NewRaftNode(id, peers, transport, machine, config)
+	n.storage = storage
+	n.currentTerm = state.CurrentTerm
+	n.votedFor = state.VotedFor
+	n.log = append([]LogEntry{{Index: state.Snapshot.LastIndex, Term: state.Snapshot.LastTerm}}, state.Entries...)
+	if state.Snapshot.LastIndex > 0 {
+		// Entries after the snapshot are applied again once the leader
+		// says they're committed
+		n.snapshot = state.Snapshot
+		n.commitIndex = state.Snapshot.LastIndex
+		n.lastApplied = state.Snapshot.LastIndex
+		if !n.witness {
+			n.machine.Restore(state.Snapshot.Data, state.Snapshot.LastIndex)
+		}
+	}
+	logger.Info("Raft node loaded its state", "node", id, "term", n.currentTerm, "index", n.lastIndex())
+	return n, nil
+}
+
+// Run drives elections and heartbeats until Stop is called
+func (n *RaftNode) Run() {
+	ticker := time.NewTicker(n.config.HeartbeatInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case now := <-ticker.C:
+			n.mutex.Lock()
+			switch {
+			case n.role == Leader && now.Sub(n.lastHeartbeat) >= n.config.HeartbeatInterval:
+				n.broadcastAppend()
+			case n.role != Leader && !n.witness && now.After(n.electionDeadline):
+				// Witnesses hold no data to serve, so they never campaign
+				n.startElection()
+			}
+			n.mutex.Unlock()
+		}
+	}
+}
+
+// Stop halts the node's timers; pending proposals fail with ErrLeadershipLost
+func (n *RaftNode) Stop() {
+	close(n.stop)
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.failProposals()
+}
+
+// State returns the node's current term, role and known leader
+func (n *RaftNode) State() (term uint64, role Role, leaderID string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.currentTerm, n.role, n.leaderID
+}
+
+// Propose replicates a write and blocks until as many replicas as level
+// requires store it, or ctx is done. Writes at Quorum and All are also
+// committed and applied on this node. Only the leader accepts writes.
+func (n *RaftNode) Propose(ctx context.Context, key, value string, level ConsistencyLevel) error {
+	if key == "" {
+		return errors.New("empty key")
+	}
+
+	n.mutex.Lock()
+	if n.role != Leader {
+		n.mutex.Unlock()
+		return ErrNotLeader
+	}
+	required, dataOnly := n.acksRequired(level)
+	if reachable := n.reachablePeers(dataOnly) + 1; reachable < required {
+		n.mutex.Unlock()
+		return fmt.Errorf("%w: %s write needs %d replicas, %d reachable", ErrQuorumUnavailable, level, required, reachable)
+	}
+	entry, err := n.appendLocked(key, value)
+	if err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+	n.broadcastAppend()
+	if level == One {
+		n.mutex.Unlock()
+		return nil
+	}
+	done := make(chan error, 1)
+	n.proposals[entry.Index] = proposal{term: entry.Term, replicas: required, dataOnly: dataOnly, done: done}
+	n.mutex.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		n.mutex.Lock()
+		delete(n.proposals, entry.Index)
+		n.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Log helpers; callers hold the mutex
+
+func (n *RaftNode) baseIndex() uint64 { return n.log[0].Index }
+func (n *RaftNode) lastIndex() uint64 { return n.log[len(n.log)-1].Index }
+func (n *RaftNode) lastTerm() uint64  { return n.log[len(n.log)-1].Term }
+
+// termAt returns the term of the entry at index, which must be in the log
+func (n *RaftNode) termAt(index uint64) uint64 {
+	return n.log[index-n.baseIndex()].Term
+}
+
+// appendLocked adds a new entry of the current term to the leader's log,
+// storing it first so the leader counts itself among its replicas safely
+func (n *RaftNode) appendLocked(key, value string) (LogEntry, error) {
+	entry := LogEntry{Term: n.currentTerm, Index: n.lastIndex() + 1, Key: key, Value: value}
+	if err := n.saveEntries([]LogEntry{entry}); err != nil {
+		return entry, err
+	}
+	n.log = append(n.log, entry)
+	return entry, nil
+}
+
+// saveVote stores the current term and vote before the node acts on them;
+// callers hold the mutex
+func (n *RaftNode) saveVote() error {
+	if n.storage == nil {
+		return nil
+	}
+	if err := n.storage.SaveVote(n.currentTerm, n.votedFor); err != nil {
+		logger.Error("Raft node failed to persist its vote", "node", n.id, "term", n.currentTerm, "error", err)
+		return err
+	}
+	return nil
+}
+
+// saveEntries stores entries before they join the log; callers hold the mutex
+func (n *RaftNode) saveEntries(entries []LogEntry) error {
+	if n.storage == nil {
+		return nil
+	}
+	if err := n.storage.Append(entries); err != nil {
+		logger.Error("Raft node failed to persist log entries", "node", n.id, "index", entries[0].Index, "error", err)
+		return err
+	}
+	return nil
+}
+
+// saveSnapshot stores a snapshot and the log following it before they
+// replace the node's log; callers hold the mutex
+func (n *RaftNode) saveSnapshot(snapshot Snapshot, entries []LogEntry) error {
+	if n.storage == nil {
+		return nil
+	}
+	if err := n.storage.SaveSnapshot(snapshot, entries); err != nil {
+		logger.Error("Raft node failed to persist snapshot", "node", n.id, "index", snapshot.LastIndex, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (n *RaftNode) resetElectionTimer() {
+	timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// quorum is the number of nodes, including this one, that make a majority
+func (n *RaftNode) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// acksRequired returns how many nodes, this one included, must store a write
+// at level. Witnesses count towards a majority, but an ALL write must reach
+// every copy of the data, so only data nodes count for it.
+func (n *RaftNode) acksRequired(level ConsistencyLevel) (int, bool) {
+	if level == All {
+		return len(n.peers) + 1 - len(n.witnesses), true
+	}
+	return level.replicas(len(n.peers) + 1), false
+}
+
+// withoutData strips the keys and values from entries sent to a witness,
+// which only needs their terms and indexes to vote safely
+func withoutData(entries []LogEntry) []LogEntry {
+	stripped := make([]LogEntry, len(entries))
+	for i, entry := range entries {
+		stripped[i] = LogEntry{Term: entry.Term, Index: entry.Index}
+	}
+	return stripped
+}
+
+// becomeFollower steps down into term, failing if a newer term couldn't be
+// stored; callers hold the mutex
+func (n *RaftNode) becomeFollower(term uint64) error {
+	if n.role == Leader {
+		logger.Info("Raft node stepping down", "node", n.id, "term", term)
+		n.failProposals()
+	}
+	n.role = Follower
+	if term > n.currentTerm {
+		n.currentTerm = term
+		n.votedFor = ""
+		return n.saveVote()
+	}
+	return nil
+}
+
+// failProposals gives up on every pending proposal
+func (n *RaftNode) failProposals() {
+	for index, p := range n.proposals {
+		p.done <- ErrLeadershipLost
+		delete(n.proposals, index)
+	}
+}
+
+// startElection campaigns for leadership of the next term
+func (n *RaftNode) startElection() {
+	n.role = Candidate
+	n.currentTerm++
+	n.votedFor = n.id
+	n.leaderID = ""
+	n.resetElectionTimer()
+	if err := n.saveVote(); err != nil {
+		// A vote that isn't stored could be cast twice after a restart
+		n.role = Follower
+		return
+	}
+
+	term := n.currentTerm
+	args := RequestVoteArgs{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	for _, peer := range n.peers {
+		go func(peer string) {
+			reply, err := n.transport.RequestVote(peer, args)
+			if err != nil {
+				return
+			}
+
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			n.lastContact[peer] = time.Now()
+			if reply.Term > n.currentTerm {
+				n.becomeFollower(reply.Term)
+				return
+			}
+			if n.role != Candidate || n.currentTerm != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader takes over the term and commits a no-op so entries of earlier
+// terms can commit too
+func (n *RaftNode) becomeLeader() {
+	n.role = Leader
+	n.leaderID = n.id
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	logger.Info("Raft node elected leader", "node", n.id, "term", n.currentTerm)
+
+	if _, err := n.appendLocked("", ""); err != nil {
+		// A leader that can't store its log can't commit anything
+		n.becomeFollower(n.currentTerm)
+		return
+	}
+	n.broadcastAppend()
+}
+
+// broadcastAppend replicates to every peer not already being replicated to
+func (n *RaftNode) broadcastAppend() {
+	n.lastHeartbeat = time.Now()
+	if len(n.peers) == 0 {
+		n.advanceCommit()
+		return
+	}
+	for _, peer := range n.peers {
+		if !n.replicating[peer] {
+			n.replicating[peer] = true
+			go n.replicateTo(peer)
+		}
+	}
+}
+
+// replicateTo brings one follower up to date with the leader's log, sending a
+// snapshot when the entries it needs were compacted away
+func (n *RaftNode) replicateTo(peer string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	defer func() { n.replicating[peer] = false }()
+
+	for n.role == Leader {
+		term := n.currentTerm
+		next := n.nextIndex[peer]
+
+		if next <= n.baseIndex() {
+			args := InstallSnapshotArgs{Term: term, LeaderID: n.id, Snapshot: n.snapshot}
+			if n.witnesses[peer] {
+				args.Snapshot.Data = nil
+			}
+			n.mutex.Unlock()
+			reply, err := n.transport.InstallSnapshot(peer, args)
+			n.mutex.Lock()
+			if err != nil || !n.handleReplyTerm(reply.Term, term) {
+				return
+			}
+			n.lastContact[peer] = time.Now()
+			n.matchIndex[peer] = args.Snapshot.LastIndex
+			n.nextIndex[peer] = args.Snapshot.LastIndex + 1
+			continue
+		}
+
+		prev := next - 1
+		args := AppendEntriesArgs{
+			Term:         term,
+			LeaderID:     n.id,
+			PrevLogIndex: prev,
+			PrevLogTerm:  n.termAt(prev),
+			Entries:      append([]LogEntry(nil), n.log[next-n.baseIndex():]...),
+			LeaderCommit: n.commitIndex,
+		}
+		if n.witnesses[peer] {
+			args.Entries = withoutData(args.Entries)
+		}
+		n.mutex.Unlock()
+		reply, err := n.transport.AppendEntries(peer, args)
+		n.mutex.Lock()
+		if err != nil || !n.handleReplyTerm(reply.Term, term) {
+			return
+		}
+		n.lastContact[peer] = time.Now()
+
+		if !reply.Success {
+			if reply.ConflictIndex >= next {
+				// The follower failed to store the entries; retry on the next heartbeat
+				return
+			}
+			n.nextIndex[peer] = reply.ConflictIndex
+			if n.nextIndex[peer] < 1 {
+				n.nextIndex[peer] = 1
+			}
+			continue
+		}
+		match := prev + uint64(len(args.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = match + 1
+		n.advanceCommit()
+		n.notifyProposals()
+		if n.nextIndex[peer] > n.lastIndex() {
+			return
+		}
+	}
+}
+
+// handleReplyTerm steps down on a newer term and reports whether the reply to
+// a request sent in term still counts
+func (n *RaftNode) handleReplyTerm(replyTerm, term uint64) bool {
+	if replyTerm > n.currentTerm {
+		n.becomeFollower(replyTerm)
+		return false
+	}
+	return n.role == Leader && n.currentTerm == term
+}
+
+// advanceCommit commits the newest entry of the current term stored on a majority
+func (n *RaftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && index > n.baseIndex(); index-- {
+		if n.termAt(index) != n.currentTerm {
+			break
+		}
+		if n.replicasWith(index, false) >= n.quorum() {
+			n.commitIndex = index
+			n.applyCommitted()
+			return
+		}
+	}
+}
+
+// applyCommitted applies newly committed entries in order
+func (n *RaftNode) applyCommitted() {
+	for n.lastApplied < n.commitIndex {
+		n.lastApplied++
+		entry := n.log[n.lastApplied-n.baseIndex()]
+		if entry.Key != "" && !n.witness {
+			n.machine.Apply(entry.Key, entry.Value, entry.Index)
+		}
+	}
+	n.notifyProposals()
+	n.maybeCompact()
+}
+
+// notifyProposals answers the applied proposals stored on enough replicas
+func (n *RaftNode) notifyProposals() {
+	for index, p := range n.proposals {
+		if index > n.lastApplied {
+			continue
+		}
+		// Entries at or below the snapshot were committed in their original term
+		if index > n.baseIndex() && n.termAt(index) != p.term {
+			p.done <- ErrLeadershipLost
+			delete(n.proposals, index)
+			continue
+		}
+		if n.replicasWith(index, p.dataOnly) >= p.replicas {
+			p.done <- nil
+			delete(n.proposals, index)
+		}
+	}
+}
+
+// replicasWith counts the nodes, this one included, known to store index,
+// leaving out witnesses when dataOnly is set
+func (n *RaftNode) replicasWith(index uint64, dataOnly bool) int {
+	replicas := 1
+	for _, peer := range n.peers {
+		if dataOnly && n.witnesses[peer] {
+			continue
+		}
+		if n.matchIndex[peer] >= index {
+			replicas++
+		}
+	}
+	return replicas
+}
+
+// maybeCompact replaces the applied part of the log with a snapshot once it
+// grows past the threshold
+func (n *RaftNode) maybeCompact() {
+	if n.config.SnapshotThreshold <= 0 || int(n.lastApplied-n.baseIndex()) < n.config.SnapshotThreshold {
+		return
+	}
+	snapshot := n.appliedSnapshotLocked()
+	log := append([]LogEntry{{Index: snapshot.LastIndex, Term: snapshot.LastTerm}}, n.log[n.lastApplied-n.baseIndex()+1:]...)
+	if err := n.saveSnapshot(snapshot, log[1:]); err != nil {
+		// The stored log still holds every entry, so compaction can wait
+		return
+	}
+	n.snapshot = snapshot
+	n.log = log
+	logger.Info("Raft node compacted its log", "node", n.id, "index", n.snapshot.LastIndex)
+}
+
+// appliedSnapshotLocked captures the state machine as of the last applied
+// entry; callers hold the mutex
+func (n *RaftNode) appliedSnapshotLocked() Snapshot {
+	snapshot := Snapshot{
+		LastIndex: n.lastApplied,
+		LastTerm:  n.termAt(n.lastApplied),
+	}
+	if !n.witness {
+		snapshot.Data = n.machine.Snapshot()
+	}
+	return snapshot
+}
+
+// seed starts a node that hasn't run yet from a snapshot, e.g. one restored
+// from a backup, as if it had applied the log up to it
+func (n *RaftNode) seed(snapshot Snapshot) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.log = []LogEntry{{Index: snapshot.LastIndex, Term: snapshot.LastTerm}}
+	n.currentTerm = snapshot.LastTerm
+	n.commitIndex = snapshot.LastIndex
+	n.lastApplied = snapshot.LastIndex
+	if n.witness {
+		snapshot.Data = nil
+	} else {
+		n.machine.Restore(snapshot.Data, snapshot.LastIndex)
+	}
+	n.snapshot = snapshot
+	if n.saveSnapshot(snapshot, nil) == nil {
+		n.saveVote()
+	}
+}
+
+// HandleRequestVote answers a candidate's vote request
+func (n *RaftNode) HandleRequestVote(args RequestVoteArgs) RequestVoteReply {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if args.Term < n.currentTerm {
+		return RequestVoteReply{Term: n.currentTerm}
+	}
+	if args.Term > n.currentTerm {
+		if err := n.becomeFollower(args.Term); err != nil {
+			return RequestVoteReply{Term: n.currentTerm}
+		}
+	}
+
+	upToDate := args.LastLogTerm > n.lastTerm() ||
+		(args.LastLogTerm == n.lastTerm() && args.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == args.CandidateID) && upToDate {
+		previous := n.votedFor
+		n.votedFor = args.CandidateID
+		if err := n.saveVote(); err != nil {
+			n.votedFor = previous
+			return RequestVoteReply{Term: n.currentTerm}
+		}
+		n.resetElectionTimer()
+		return RequestVoteReply{Term: n.currentTerm, VoteGranted: true}
+	}
+	return RequestVoteReply{Term: n.currentTerm}
+}
+
+// HandleAppendEntries stores the leader's entries if they continue this
+// node's log and commits what the leader has committed
+func (n *RaftNode) HandleAppendEntries(args AppendEntriesArgs) AppendEntriesReply {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if args.Term < n.currentTerm {
+		return AppendEntriesReply{Term: n.currentTerm}
+	}
+	if args.Term > n.currentTerm || n.role != Follower {
+		if err := n.becomeFollower(args.Term); err != nil {
+			return AppendEntriesReply{Term: n.currentTerm, ConflictIndex: args.PrevLogIndex + 1}
+		}
+	}
+	n.leaderID = args.LeaderID
+	n.resetElectionTimer()
+
+	// Entries already folded into the snapshot are known to match
+	if args.PrevLogIndex < n.baseIndex() {
+		skip := n.baseIndex() - args.PrevLogIndex
+		if uint64(len(args.Entries)) <= skip {
+			return AppendEntriesReply{Term: n.currentTerm, Success: true}
+		}
+		args.Entries = args.Entries[skip:]
+		args.PrevLogIndex = n.baseIndex()
+		args.PrevLogTerm = n.log[0].Term
+	}
+
+	if args.PrevLogIndex > n.lastIndex() {
+		return AppendEntriesReply{Term: n.currentTerm, ConflictIndex: n.lastIndex() + 1}
+	}
+	if conflictTerm := n.termAt(args.PrevLogIndex); conflictTerm != args.PrevLogTerm {
+		// Skip the whole conflicting term rather than one entry per round trip
+		index := args.PrevLogIndex
+		for index > n.baseIndex()+1 && n.termAt(index-1) == conflictTerm {
+			index--
+		}
+		return AppendEntriesReply{Term: n.currentTerm, ConflictIndex: index}
+	}
+
+	if n.witness {
+		args.Entries = withoutData(args.Entries)
+	}
+	for i, entry := range args.Entries {
+		if entry.Index <= n.lastIndex() && n.termAt(entry.Index) == entry.Term {
+			continue
+		}
+		// The leader counts this node as a replica once it replies, so the
+		// entries must be stored first
+		if err := n.saveEntries(args.Entries[i:]); err != nil {
+			return AppendEntriesReply{Term: n.currentTerm, ConflictIndex: entry.Index}
+		}
+		if entry.Index <= n.lastIndex() {
+			n.log = n.log[:entry.Index-n.baseIndex()]
+		}
+		n.log = append(n.log, args.Entries[i:]...)
+		break
+	}
+
+	if args.LeaderCommit > n.commitIndex {
+		lastNew := args.PrevLogIndex + uint64(len(args.Entries))
+		n.commitIndex = args.LeaderCommit
+		if lastNew < n.commitIndex {
+			n.commitIndex = lastNew
+		}
+		n.applyCommitted()
+	}
+	return AppendEntriesReply{Term: n.currentTerm, Success: true}
+}
+
+// HandleInstallSnapshot replaces this node's state with the leader's snapshot
+func (n *RaftNode) HandleInstallSnapshot(args InstallSnapshotArgs) InstallSnapshotReply {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if args.Term < n.currentTerm {
+		return InstallSnapshotReply{Term: n.currentTerm}
+	}
+	if args.Term > n.currentTerm || n.role != Follower {
+		if err := n.becomeFollower(args.Term); err != nil {
+			return InstallSnapshotReply{Term: n.currentTerm}
+		}
+	}
+	n.leaderID = args.LeaderID
+	n.resetElectionTimer()
+
+	snapshot := args.Snapshot
+	if snapshot.LastIndex <= n.commitIndex {
+		return InstallSnapshotReply{Term: n.currentTerm}
+	}
+
+	// Keep entries following the snapshot if this node already has them
+	log := []LogEntry{{Index: snapshot.LastIndex, Term: snapshot.LastTerm}}
+	if snapshot.LastIndex < n.lastIndex() && snapshot.LastIndex > n.baseIndex() &&
+		n.termAt(snapshot.LastIndex) == snapshot.LastTerm {
+		log = append(log, n.log[snapshot.LastIndex-n.baseIndex()+1:]...)
+	}
+	if n.witness {
+		snapshot.Data = nil
+	}
+	if err := n.saveSnapshot(snapshot, log[1:]); err != nil {
+		return InstallSnapshotReply{Term: n.currentTerm}
+	}
+	n.log = log
+	if !n.witness {
+		n.machine.Restore(snapshot.Data, snapshot.LastIndex)
+	}
+	n.snapshot = snapshot
+	n.commitIndex = snapshot.LastIndex
+	n.lastApplied = snapshot.LastIndex
+	logger.Info("Raft node installed snapshot", "node", n.id, "index", snapshot.LastIndex)
+	return InstallSnapshotReply{Term: n.currentTerm}
+}
@@ -0,0 +1,250 @@
+package fault_tolerance
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// raftCheckpointFile holds a raft node's state as of its last snapshot
+const raftCheckpointFile = "raft.json"
+
+// RaftState is what a raft node must remember across restarts to keep its
+// promises: the term, the vote cast in it and the log
+type RaftState struct {
+	CurrentTerm uint64     `json:"current_term"`
+	VotedFor    string     `json:"voted_for"`
+	Snapshot    Snapshot   `json:"snapshot"`
+	Entries     []LogEntry `json:"entries"` // The log following the snapshot
+}
+
+// RaftStorage persists the state of a raft node. Every change is durable
+// once its method returns, so the node may act on it.
+type RaftStorage interface {
+	// Load returns the state stored so far
+	Load() (RaftState, error)
+	// SaveVote stores the current term and the candidate voted for in it
+	SaveVote(term uint64, votedFor string) error
+	// Append stores entries, replacing any stored from the first one's index on
+	Append(entries []LogEntry) error
+	// SaveSnapshot replaces the snapshot and the log following it
+	SaveSnapshot(snapshot Snapshot, entries []LogEntry) error
+	Close() error
+}
+
+// raftRecord is one change in the raft log file: either entries or a new
+// term and vote
+type raftRecord struct {
+	Term     uint64     `json:"term,omitempty"`
+	VotedFor string     `json:"voted_for,omitempty"`
+	Entries  []LogEntry `json:"entries,omitempty"`
+}
+
+// raftCheckpoint is the state as of a snapshot and the generation of the log
+// file holding the changes made since
+type raftCheckpoint struct {
+	RaftState
+	Generation uint64 `json:"generation"`
+}
+
+// FileRaftStorage keeps a raft node's state in a directory as a checkpoint
+// plus a log file of the changes since, each synced before it is
+// acknowledged. Every snapshot becomes a new checkpoint with a fresh log
+// file, so the file holds no more than the log since the last compaction.
+type FileRaftStorage struct {
+	dir        string
+	mutex      sync.Mutex
+	state      RaftState
+	generation uint64
+	log        *os.File
+}
+
+// OpenFileRaftStorage opens or creates the raft storage in dir, replaying
+// its log file
+func OpenFileRaftStorage(dir string) (*FileRaftStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create raft storage directory: %w", err)
+	}
+	s := &FileRaftStorage{dir: dir}
+
+	encoded, err := os.ReadFile(filepath.Join(dir, raftCheckpointFile))
+	switch {
+	case err == nil:
+		var checkpoint raftCheckpoint
+		if err := json.Unmarshal(encoded, &checkpoint); err != nil {
+			return nil, fmt.Errorf("corrupt raft checkpoint in %s: %w", dir, err)
+		}
+		s.state, s.generation = checkpoint.RaftState, checkpoint.Generation
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to read raft checkpoint: %w", err)
+	}
+
+	s.log, err = os.OpenFile(s.logPath(s.generation), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+	if err := s.replay(); err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	s.removeStaleLogs()
+	return s, nil
+}
+
+// logPath returns the log file of a checkpoint generation
+func (s *FileRaftStorage) logPath(generation uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("raft-%d.log", generation))
+}
+
+// removeStaleLogs deletes the log files of other generations, left behind
+// by a crash while a checkpoint was written
+func (s *FileRaftStorage) removeStaleLogs() {
+	paths, _ := filepath.Glob(filepath.Join(s.dir, "raft-*.log"))
+	for _, path := range paths {
+		if path != s.logPath(s.generation) {
+			os.Remove(path)
+		}
+	}
+}
+
+// replay applies the log file on top of the checkpoint. A torn or corrupt
+// record at the tail was never acknowledged, so the file is cut there.
+func (s *FileRaftStorage) replay() error {
+	reader := bufio.NewReader(s.log)
+	var valid int64
+	for {
+		payload, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		var record raftRecord
+		if err == nil {
+			err = json.Unmarshal(payload, &record)
+		}
+		if err != nil {
+			logger.Warn("Truncating raft log", "dir", s.dir, "error", err)
+			break
+		}
+		if len(record.Entries) > 0 {
+			s.appendLocked(record.Entries)
+		} else {
+			s.state.CurrentTerm, s.state.VotedFor = record.Term, record.VotedFor
+		}
+		valid += size
+	}
+
+	if err := s.log.Truncate(valid); err != nil {
+		return fmt.Errorf("failed to truncate raft log: %w", err)
+	}
+	_, err := s.log.Seek(valid, io.SeekStart)
+	return err
+}
+
+// Load returns a copy of the stored state
+func (s *FileRaftStorage) Load() (RaftState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := s.state
+	state.Entries = append([]LogEntry(nil), s.state.Entries...)
+	return state, nil
+}
+
+// SaveVote appends the term and vote to the log file and syncs it
+func (s *FileRaftStorage) SaveVote(term uint64, votedFor string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.writeLocked(raftRecord{Term: term, VotedFor: votedFor}); err != nil {
+		return err
+	}
+	s.state.CurrentTerm, s.state.VotedFor = term, votedFor
+	return nil
+}
+
+// Append appends the entries to the log file and syncs it
+func (s *FileRaftStorage) Append(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.writeLocked(raftRecord{Entries: entries}); err != nil {
+		return err
+	}
+	s.appendLocked(entries)
+	return nil
+}
+
+// writeLocked appends one record to the log file; callers hold the mutex
+func (s *FileRaftStorage) writeLocked(record raftRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return appendRecord(s.log, payload)
+}
+
+// appendLocked adds entries to the log, dropping those the snapshot covers
+// and any the first of them replaces; callers hold the mutex
+func (s *FileRaftStorage) appendLocked(entries []LogEntry) {
+	base := s.state.Snapshot.LastIndex
+	for len(entries) > 0 && entries[0].Index <= base {
+		entries = entries[1:]
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if keep := entries[0].Index - base - 1; keep < uint64(len(s.state.Entries)) {
+		s.state.Entries = s.state.Entries[:keep]
+	}
+	s.state.Entries = append(s.state.Entries, entries...)
+}
+
+// SaveSnapshot writes the snapshot and the entries following it as a new
+// checkpoint with an empty log file of its own
+func (s *FileRaftStorage) SaveSnapshot(snapshot Snapshot, entries []LogEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	checkpoint := raftCheckpoint{
+		RaftState: RaftState{
+			CurrentTerm: s.state.CurrentTerm,
+			VotedFor:    s.state.VotedFor,
+			Snapshot:    snapshot,
+			Entries:     append([]LogEntry(nil), entries...),
+		},
+		Generation: s.generation + 1,
+	}
+	encoded, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	// The new log file exists before the checkpoint naming it does; a crash
+	// in between leaves the old generation in charge
+	log, err := os.OpenFile(s.logPath(checkpoint.Generation), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create raft log: %w", err)
+	}
+	if err := writeCheckpoint(filepath.Join(s.dir, raftCheckpointFile), encoded); err != nil {
+		log.Close()
+		os.Remove(log.Name())
+		return err
+	}
+
+	s.log.Close()
+	os.Remove(s.logPath(s.generation))
+	s.log, s.state, s.generation = log, checkpoint.RaftState, checkpoint.Generation
+	return nil
+}
+
+// Close closes the log file
+func (s *FileRaftStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.log.Close()
+}
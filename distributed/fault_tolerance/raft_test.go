@@ -0,0 +1,715 @@
+package fault_tolerance
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRaftConfig elects and replicates quickly, without compaction
+var testRaftConfig = RaftConfig{
+	ElectionTimeout:   50 * time.Millisecond,
+	HeartbeatInterval: 10 * time.Millisecond,
+}
+
+// testMachine is a map state machine
+type testMachine struct {
+	mutex sync.Mutex
+	data  map[string]string
+}
+
+func newTestMachine() *testMachine {
+	return &testMachine{data: make(map[string]string)}
+}
+
+func (m *testMachine) Apply(key, value string, index uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.data[key] = value
+}
+
+func (m *testMachine) Snapshot() map[string]string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data := make(map[string]string, len(m.data))
+	for key, value := range m.data {
+		data[key] = value
+	}
+	return data
+}
+
+func (m *testMachine) Restore(data map[string]string, index uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.data = make(map[string]string, len(data))
+	for key, value := range data {
+		m.data[key] = value
+	}
+}
+
+func (m *testMachine) Get(key string) (string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	value, ok := m.data[key]
+	return value, ok
+}
+
+// testNetwork delivers RPCs between raft nodes, except to and from nodes
+// marked down
+type testNetwork struct {
+	mutex sync.Mutex
+	nodes map[string]*RaftNode
+	down  map[string]bool
+}
+
+func newTestNetwork() *testNetwork {
+	return &testNetwork{nodes: make(map[string]*RaftNode), down: make(map[string]bool)}
+}
+
+func (net *testNetwork) add(node *RaftNode) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+	net.nodes[node.id] = node
+}
+
+func (net *testNetwork) setDown(id string, down bool) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+	net.down[id] = down
+}
+
+// transport returns the transport the node id sends through
+func (net *testNetwork) transport(id string) Transport {
+	return &testTransport{net: net, from: id}
+}
+
+type testTransport struct {
+	net  *testNetwork
+	from string
+}
+
+func (t *testTransport) route(peer string) (*RaftNode, error) {
+	t.net.mutex.Lock()
+	defer t.net.mutex.Unlock()
+	node := t.net.nodes[peer]
+	if node == nil || t.net.down[t.from] || t.net.down[peer] {
+		return nil, ErrPeerUnreachable
+	}
+	return node, nil
+}
+
+func (t *testTransport) RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	node, err := t.route(peer)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	return node.HandleRequestVote(args), nil
+}
+
+func (t *testTransport) AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	node, err := t.route(peer)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	return node.HandleAppendEntries(args), nil
+}
+
+func (t *testTransport) InstallSnapshot(peer string, args InstallSnapshotArgs) (InstallSnapshotReply, error) {
+	node, err := t.route(peer)
+	if err != nil {
+		return InstallSnapshotReply{}, err
+	}
+	return node.HandleInstallSnapshot(args), nil
+}
+
+// peersOf returns every ID but id
+func peersOf(id string, ids []string) []string {
+	var peers []string
+	for _, peer := range ids {
+		if peer != id {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// waitFor polls until ok holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForLeader waits until one of nodes leads and returns it
+func waitForLeader(t *testing.T, nodes []*RaftNode) *RaftNode {
+	t.Helper()
+	var leader *RaftNode
+	waitFor(t, "a leader", func() bool {
+		for _, node := range nodes {
+			if _, role, _ := node.State(); role == Leader {
+				leader = node
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func openRaftStorage(t *testing.T, dir string) *FileRaftStorage {
+	t.Helper()
+	storage, err := OpenFileRaftStorage(dir)
+	if err != nil {
+		t.Fatalf("Failed to open raft storage: %v", err)
+	}
+	return storage
+}
+
+func loadRaftState(t *testing.T, storage RaftStorage) RaftState {
+	t.Helper()
+	state, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Failed to load raft state: %v", err)
+	}
+	return state
+}
+
+// entryPositions returns the index and term of entries, for comparing logs
+func entryPositions(entries []LogEntry) [][2]uint64 {
+	positions := make([][2]uint64, len(entries))
+	for i, entry := range entries {
+		positions[i] = [2]uint64{entry.Index, entry.Term}
+	}
+	return positions
+}
+
+// Test that persistent nodes elect a leader and keep their term, vote and
+// log across a restart
+func TestRaftElectionPersistsTermAndVote(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	dirs := make(map[string]string)
+	for _, id := range ids {
+		dirs[id] = t.TempDir()
+	}
+
+	start := func(net *testNetwork) ([]*RaftNode, map[string]*FileRaftStorage, map[string]*testMachine) {
+		var nodes []*RaftNode
+		storages := make(map[string]*FileRaftStorage)
+		machines := make(map[string]*testMachine)
+		for _, id := range ids {
+			storages[id] = openRaftStorage(t, dirs[id])
+			machines[id] = newTestMachine()
+			node, err := NewPersistentRaftNode(id, peersOf(id, ids), net.transport(id), machines[id], testRaftConfig, storages[id])
+			if err != nil {
+				t.Fatalf("Failed to create node %s: %v", id, err)
+			}
+			net.add(node)
+			nodes = append(nodes, node)
+		}
+		return nodes, storages, machines
+	}
+
+	net := newTestNetwork()
+	nodes, storages, machines := start(net)
+	for _, node := range nodes {
+		go node.Run()
+	}
+	leader := waitForLeader(t, nodes)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.Propose(ctx, "page", "indexed", Quorum); err != nil {
+		t.Fatalf("Failed to propose: %v", err)
+	}
+	waitFor(t, "the write on every node", func() bool {
+		for _, machine := range machines {
+			if value, _ := machine.Get("page"); value != "indexed" {
+				return false
+			}
+		}
+		return true
+	})
+
+	terms := make(map[string]uint64)
+	votes := make(map[string]string)
+	for _, node := range nodes {
+		node.Stop()
+	}
+	for _, node := range nodes {
+		node.mutex.Lock()
+		terms[node.id], votes[node.id] = node.currentTerm, node.votedFor
+		node.mutex.Unlock()
+		storages[node.id].Close()
+	}
+	if votes[leader.id] != leader.id {
+		t.Fatalf("Leader %s voted for %q in its term", leader.id, votes[leader.id])
+	}
+
+	// Everything a node acted on was stored before it acted
+	for _, id := range ids {
+		storage := openRaftStorage(t, dirs[id])
+		state := loadRaftState(t, storage)
+		storage.Close()
+		if state.CurrentTerm != terms[id] || state.VotedFor != votes[id] {
+			t.Fatalf("Node %s stored term %d and vote %q, it had term %d and vote %q",
+				id, state.CurrentTerm, state.VotedFor, terms[id], votes[id])
+		}
+		found := false
+		for _, entry := range state.Entries {
+			found = found || entry.Key == "page" && entry.Value == "indexed"
+		}
+		if !found {
+			t.Fatalf("Node %s didn't store the committed write: %+v", id, state.Entries)
+		}
+	}
+
+	// A restarted node won't vote for another candidate in the term it
+	// already voted in
+	net = newTestNetwork()
+	nodes, storages, machines = start(net)
+	defer func() {
+		for _, storage := range storages {
+			storage.Close()
+		}
+	}()
+	restarted := nodes[0]
+	for _, node := range nodes {
+		if node.id == leader.id {
+			restarted = node
+		}
+	}
+	if term, role, _ := restarted.State(); term != terms[leader.id] || role != Follower {
+		t.Fatalf("Restarted leader is a %s in term %d, expected a follower in term %d", role, term, terms[leader.id])
+	}
+	other := peersOf(leader.id, ids)[0]
+	reply := restarted.HandleRequestVote(RequestVoteArgs{
+		Term:         terms[leader.id],
+		CandidateID:  other,
+		LastLogIndex: 100,
+		LastLogTerm:  terms[leader.id],
+	})
+	if reply.VoteGranted {
+		t.Fatalf("Restarted node voted twice in term %d", terms[leader.id])
+	}
+
+	// The restarted cluster elects a leader in a later term and applies the
+	// stored write again
+	for _, node := range nodes {
+		go node.Run()
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.Stop()
+		}
+	}()
+	newLeader := waitForLeader(t, nodes)
+	if term, _, _ := newLeader.State(); term <= terms[leader.id] {
+		t.Fatalf("New leader elected in term %d, not after term %d", term, terms[leader.id])
+	}
+	waitFor(t, "the stored write applied again", func() bool {
+		for _, machine := range machines {
+			if value, _ := machine.Get("page"); value != "indexed" {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Test that a follower replaces entries that conflict with the leader's,
+// in memory and in storage
+func TestRaftFollowerTruncatesConflictingEntries(t *testing.T) {
+	dir := t.TempDir()
+	storage := openRaftStorage(t, dir)
+	machine := newTestMachine()
+	follower, err := NewPersistentRaftNode("f", []string{"a", "b"}, nil, machine, testRaftConfig, storage)
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	reply := follower.HandleAppendEntries(AppendEntriesArgs{
+		Term:     1,
+		LeaderID: "a",
+		Entries: []LogEntry{
+			{Term: 1, Index: 1, Key: "x", Value: "1"},
+			{Term: 1, Index: 2, Key: "x", Value: "2"},
+			{Term: 1, Index: 3, Key: "x", Value: "3"},
+		},
+		LeaderCommit: 1,
+	})
+	if !reply.Success {
+		t.Fatalf("Follower rejected the first entries: %+v", reply)
+	}
+	if value, _ := machine.Get("x"); value != "1" {
+		t.Fatalf("Follower applied x=%q, expected only the committed x=1", value)
+	}
+
+	// A heartbeat resending entries the follower has keeps them
+	reply = follower.HandleAppendEntries(AppendEntriesArgs{
+		Term:         1,
+		LeaderID:     "a",
+		PrevLogIndex: 1,
+		PrevLogTerm:  1,
+		Entries:      []LogEntry{{Term: 1, Index: 2, Key: "x", Value: "2"}},
+	})
+	if !reply.Success || len(loadRaftState(t, storage).Entries) != 3 {
+		t.Fatalf("Follower lost entries to a repeated append: %+v", reply)
+	}
+
+	// A new leader's entry at index 2 replaces the uncommitted 2 and 3
+	reply = follower.HandleAppendEntries(AppendEntriesArgs{
+		Term:         2,
+		LeaderID:     "b",
+		PrevLogIndex: 1,
+		PrevLogTerm:  1,
+		Entries:      []LogEntry{{Term: 2, Index: 2, Key: "x", Value: "20"}},
+		LeaderCommit: 2,
+	})
+	if !reply.Success {
+		t.Fatalf("Follower rejected the new leader's entry: %+v", reply)
+	}
+	want := [][2]uint64{{1, 1}, {2, 2}}
+	if got := entryPositions(loadRaftState(t, storage).Entries); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Follower stored %v, expected %v", got, want)
+	}
+	if value, _ := machine.Get("x"); value != "20" {
+		t.Fatalf("Follower applied x=%q, expected x=20", value)
+	}
+
+	// An append that doesn't follow the log points back past the whole
+	// conflicting term
+	reply = follower.HandleAppendEntries(AppendEntriesArgs{
+		Term:         3,
+		LeaderID:     "a",
+		PrevLogIndex: 2,
+		PrevLogTerm:  1,
+		Entries:      []LogEntry{{Term: 3, Index: 3}},
+	})
+	if reply.Success || reply.ConflictIndex != 2 {
+		t.Fatalf("Follower answered %+v to a mismatched append, expected a conflict at 2", reply)
+	}
+
+	storage.Close()
+	storage = openRaftStorage(t, dir)
+	defer storage.Close()
+	if got := entryPositions(loadRaftState(t, storage).Entries); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Replayed log holds %v, expected %v", got, want)
+	}
+}
+
+// Test that the storage replaces entries from the first one appended and
+// drops those its snapshot covers
+func TestFileRaftStorageAppendReplacesConflicts(t *testing.T) {
+	dir := t.TempDir()
+	storage := openRaftStorage(t, dir)
+	entries := []LogEntry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}, {Term: 1, Index: 4}, {Term: 1, Index: 5}}
+	if err := storage.Append(entries); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := storage.Append([]LogEntry{{Term: 2, Index: 3}}); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	want := [][2]uint64{{1, 1}, {2, 1}, {3, 2}}
+	if got := entryPositions(loadRaftState(t, storage).Entries); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Storage holds %v, expected %v", got, want)
+	}
+
+	snapshot := Snapshot{LastIndex: 2, LastTerm: 1}
+	if err := storage.SaveSnapshot(snapshot, []LogEntry{{Term: 2, Index: 3}}); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	if err := storage.Append([]LogEntry{{Term: 1, Index: 2}, {Term: 2, Index: 3}, {Term: 2, Index: 4}}); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	want = [][2]uint64{{3, 2}, {4, 2}}
+	if got := entryPositions(loadRaftState(t, storage).Entries); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Storage holds %v, expected %v", got, want)
+	}
+
+	storage.Close()
+	storage = openRaftStorage(t, dir)
+	defer storage.Close()
+	if got := entryPositions(loadRaftState(t, storage).Entries); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Replayed log holds %v, expected %v", got, want)
+	}
+}
+
+// Test that a leader commits entries of earlier terms only by committing
+// one of its own term after them
+func TestRaftCommitsOnlyCurrentTermEntries(t *testing.T) {
+	machine := newTestMachine()
+	leader := NewRaftNode("a", []string{"b", "c"}, nil, machine, testRaftConfig)
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+
+	leader.role, leader.currentTerm, leader.leaderID = Leader, 3, "a"
+	leader.log = append(leader.log,
+		LogEntry{Term: 1, Index: 1, Key: "x", Value: "1"},
+		LogEntry{Term: 2, Index: 2, Key: "x", Value: "2"},
+	)
+	leader.matchIndex["b"], leader.matchIndex["c"] = 2, 2
+	leader.advanceCommit()
+	if leader.commitIndex != 0 {
+		t.Fatalf("Leader of term 3 committed index %d from earlier terms", leader.commitIndex)
+	}
+	if _, ok := machine.Get("x"); ok {
+		t.Fatalf("Leader applied an entry of an earlier term")
+	}
+
+	leader.log = append(leader.log, LogEntry{Term: 3, Index: 3, Key: "y", Value: "3"})
+	leader.advanceCommit()
+	if leader.commitIndex != 0 {
+		t.Fatalf("Leader committed index %d stored only on itself", leader.commitIndex)
+	}
+	leader.matchIndex["b"] = 3
+	leader.advanceCommit()
+	if leader.commitIndex != 3 {
+		t.Fatalf("Leader committed index %d, expected 3 once a majority stores it", leader.commitIndex)
+	}
+	x, _ := machine.Get("x")
+	y, _ := machine.Get("y")
+	if x != "2" || y != "3" {
+		t.Fatalf("Leader applied x=%q y=%q, expected x=2 y=3", x, y)
+	}
+}
+
+// Test that a witness votes a data node into leadership and stores log
+// positions without data, but never campaigns itself
+func TestRaftWitnessVotesButNeverCampaigns(t *testing.T) {
+	ids := []string{"a", "b", "w"}
+	config := testRaftConfig
+	config.Witnesses = []string{"w"}
+	net := newTestNetwork()
+	// a is down, so b can only win with the witness's vote
+	net.setDown("a", true)
+
+	machines := make(map[string]*testMachine)
+	var nodes []*RaftNode
+	for _, id := range []string{"a", "b"} {
+		machines[id] = newTestMachine()
+		node := NewRaftNode(id, peersOf(id, ids), net.transport(id), machines[id], config)
+		net.add(node)
+		nodes = append(nodes, node)
+	}
+	storage := openRaftStorage(t, t.TempDir())
+	defer storage.Close()
+	witness, err := NewPersistentRaftNode("w", peersOf("w", ids), net.transport("w"), nil, config, storage)
+	if err != nil {
+		t.Fatalf("Failed to create witness: %v", err)
+	}
+	net.add(witness)
+	nodes = append(nodes, witness)
+
+	go nodes[1].Run()
+	go witness.Run()
+	defer nodes[1].Stop()
+	defer witness.Stop()
+
+	leader := waitForLeader(t, nodes)
+	if leader.id != "b" {
+		t.Fatalf("%s was elected, expected b", leader.id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.Propose(ctx, "page", "indexed", Quorum); err != nil {
+		t.Fatalf("Failed to propose with the witness's ack: %v", err)
+	}
+	if value, _ := machines["b"].Get("page"); value != "indexed" {
+		t.Fatalf("Leader applied page=%q, expected indexed", value)
+	}
+	// Every copy of the data is needed for All, and a is down
+	if err := leader.Propose(ctx, "page", "all", All); !errors.Is(err, ErrQuorumUnavailable) {
+		t.Fatalf("All write with one data node answered %v, expected ErrQuorumUnavailable", err)
+	}
+
+	waitFor(t, "the write on the witness", func() bool {
+		return len(loadRaftState(t, storage).Entries) >= 2
+	})
+	for _, entry := range loadRaftState(t, storage).Entries {
+		if entry.Key != "" || entry.Value != "" {
+			t.Fatalf("Witness stored data: %+v", entry)
+		}
+	}
+
+	// Cut off from the leader, the witness waits rather than campaigning
+	term, _, _ := witness.State()
+	net.setDown("b", true)
+	time.Sleep(10 * config.ElectionTimeout)
+	if now, role, _ := witness.State(); now != term || role != Follower {
+		t.Fatalf("Witness became a %s in term %d, expected a follower in term %d", role, now, term)
+	}
+}
+
+// Test that replay cuts a torn or corrupt record off the end of the log
+// file, keeping everything before it
+func TestFileRaftStorageTruncatesTornTail(t *testing.T) {
+	setup := func(t *testing.T) (string, int64) {
+		dir := t.TempDir()
+		storage := openRaftStorage(t, dir)
+		if err := storage.SaveVote(1, "a"); err != nil {
+			t.Fatalf("Failed to save vote: %v", err)
+		}
+		for index := uint64(1); index <= 3; index++ {
+			if err := storage.Append([]LogEntry{{Term: 1, Index: index, Key: "x"}}); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+		storage.Close()
+		info, err := os.Stat(filepath.Join(dir, "raft-0.log"))
+		if err != nil {
+			t.Fatalf("Failed to stat log: %v", err)
+		}
+		return dir, info.Size()
+	}
+
+	t.Run("torn record", func(t *testing.T) {
+		dir, size := setup(t)
+		header := make([]byte, walHeaderSize)
+		binary.BigEndian.PutUint32(header, 100)
+		file, err := os.OpenFile(filepath.Join(dir, "raft-0.log"), os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			t.Fatalf("Failed to open log: %v", err)
+		}
+		file.Write(append(header, []byte(`{"entries":`)...))
+		file.Close()
+
+		storage := openRaftStorage(t, dir)
+		state := loadRaftState(t, storage)
+		if state.CurrentTerm != 1 || state.VotedFor != "a" || len(state.Entries) != 3 {
+			t.Fatalf("Replay kept %+v, expected term 1, vote a and 3 entries", state)
+		}
+		if info, _ := os.Stat(filepath.Join(dir, "raft-0.log")); info.Size() != size {
+			t.Fatalf("Log is %d bytes after replay, expected %d", info.Size(), size)
+		}
+		// Records appended after the cut replay too
+		if err := storage.Append([]LogEntry{{Term: 1, Index: 4}}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		storage.Close()
+		storage = openRaftStorage(t, dir)
+		defer storage.Close()
+		if entries := loadRaftState(t, storage).Entries; len(entries) != 4 {
+			t.Fatalf("Replay kept %d entries, expected 4", len(entries))
+		}
+	})
+
+	t.Run("corrupt record", func(t *testing.T) {
+		dir, size := setup(t)
+		path := filepath.Join(dir, "raft-0.log")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read log: %v", err)
+		}
+		data[size-2] ^= 0xff
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatalf("Failed to write log: %v", err)
+		}
+
+		storage := openRaftStorage(t, dir)
+		defer storage.Close()
+		want := [][2]uint64{{1, 1}, {2, 1}}
+		if got := entryPositions(loadRaftState(t, storage).Entries); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Replay kept %v, expected %v", got, want)
+		}
+	})
+}
+
+// Test that a snapshot moves the storage to a new generation of log file,
+// and that a crash part way through leaves a consistent state
+func TestFileRaftStorageSnapshotSwitchesGeneration(t *testing.T) {
+	dir := t.TempDir()
+	storage := openRaftStorage(t, dir)
+	if err := storage.SaveVote(2, "a"); err != nil {
+		t.Fatalf("Failed to save vote: %v", err)
+	}
+	var entries []LogEntry
+	for index := uint64(1); index <= 5; index++ {
+		entries = append(entries, LogEntry{Term: 2, Index: index, Key: "x"})
+	}
+	if err := storage.Append(entries); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	snapshot := Snapshot{LastIndex: 3, LastTerm: 2, Data: map[string]string{"x": "3"}}
+	if err := storage.SaveSnapshot(snapshot, entries[3:]); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "raft-0.log")); !os.IsNotExist(err) {
+		t.Fatalf("The log of generation 0 is left after the snapshot")
+	}
+	if err := storage.Append([]LogEntry{{Term: 2, Index: 6}}); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := storage.SaveVote(3, "b"); err != nil {
+		t.Fatalf("Failed to save vote: %v", err)
+	}
+	storage.Close()
+
+	check := func(t *testing.T, storage *FileRaftStorage) {
+		t.Helper()
+		state := loadRaftState(t, storage)
+		if state.CurrentTerm != 3 || state.VotedFor != "b" {
+			t.Fatalf("Storage holds term %d and vote %q, expected term 3 and vote b", state.CurrentTerm, state.VotedFor)
+		}
+		if state.Snapshot.LastIndex != 3 || state.Snapshot.Data["x"] != "3" {
+			t.Fatalf("Storage holds snapshot %+v, expected the one at index 3", state.Snapshot)
+		}
+		want := [][2]uint64{{4, 2}, {5, 2}, {6, 2}}
+		if got := entryPositions(state.Entries); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Storage holds %v, expected %v", got, want)
+		}
+	}
+
+	storage = openRaftStorage(t, dir)
+	check(t, storage)
+	storage.Close()
+
+	// A crash after the next generation's log was created, before the
+	// checkpoint naming it was written, leaves generation 1 in charge
+	next := filepath.Join(dir, "raft-2.log")
+	if err := os.WriteFile(next, []byte("partial"), 0o644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, raftCheckpointFile+".tmp"), []byte(`{"gen`), 0o644); err != nil {
+		t.Fatalf("Failed to write checkpoint: %v", err)
+	}
+	storage = openRaftStorage(t, dir)
+	check(t, storage)
+	if _, err := os.Stat(next); !os.IsNotExist(err) {
+		t.Fatalf("The log of the unfinished generation is left")
+	}
+
+	// The next snapshot still moves to generation 2 cleanly
+	if err := storage.SaveSnapshot(Snapshot{LastIndex: 5, LastTerm: 2}, []LogEntry{{Term: 2, Index: 6}}); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	storage.Close()
+
+	// A crash after the checkpoint was written, before the old log was
+	// removed, leaves generation 2 in charge
+	stale := filepath.Join(dir, "raft-1.log")
+	payload := []byte(`{"entries":[{"term":2,"index":7}]}`)
+	record := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	if err := os.WriteFile(stale, append(record, payload...), 0o644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+	storage = openRaftStorage(t, dir)
+	defer storage.Close()
+	state := loadRaftState(t, storage)
+	if state.Snapshot.LastIndex != 5 || !reflect.DeepEqual(entryPositions(state.Entries), [][2]uint64{{6, 2}}) {
+		t.Fatalf("Storage holds snapshot at %d and %v, expected the snapshot at 5 and entry 6", state.Snapshot.LastIndex, entryPositions(state.Entries))
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("The log of the replaced generation is left")
+	}
+}
@@ -0,0 +1,190 @@
+package fault_tolerance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ErrPeerUnreachable is returned by transports when a peer can't be contacted
+var ErrPeerUnreachable = errors.New("raft peer unreachable")
+
+// Transport carries raft RPCs to peers, identified by node ID
+type Transport interface {
+	RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error)
+	AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error)
+	InstallSnapshot(peer string, args InstallSnapshotArgs) (InstallSnapshotReply, error)
+}
+
+// LocalTransport delivers RPCs between nodes of an in-process cluster. Nodes
+// with a simulated failure neither send nor receive, as if they had crashed.
+type LocalTransport struct {
+	nodes map[string]*Node
+	group func(node *Node) *RaftNode // The raft group RPCs are delivered to
+	mutex sync.Mutex
+}
+
+// NewLocalTransport creates a transport between the raft nodes of the given nodes
+func NewLocalTransport(nodes []*Node) *LocalTransport {
+	return newLocalTransport(nodes, func(node *Node) *RaftNode { return node.Raft })
+}
+
+func newLocalTransport(nodes []*Node, group func(node *Node) *RaftNode) *LocalTransport {
+	t := &LocalTransport{nodes: make(map[string]*Node), group: group}
+	for _, node := range nodes {
+		t.nodes[node.ID] = node
+	}
+	return t
+}
+
+// route returns the raft node of peer if both it and the sender are reachable
+func (t *LocalTransport) route(from, peer string) (*RaftNode, error) {
+	t.mutex.Lock()
+	sender, target := t.nodes[from], t.nodes[peer]
+	t.mutex.Unlock()
+
+	if sender == nil || target == nil || !sender.reachable() || !target.reachable() {
+		return nil, ErrPeerUnreachable
+	}
+	raft := t.group(target)
+	if raft == nil {
+		return nil, ErrPeerUnreachable
+	}
+	return raft, nil
+}
+
+// RequestVote delivers a vote request to peer
+func (t *LocalTransport) RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	target, err := t.route(args.CandidateID, peer)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	return target.HandleRequestVote(args), nil
+}
+
+// AppendEntries delivers entries or a heartbeat to peer
+func (t *LocalTransport) AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	target, err := t.route(args.LeaderID, peer)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	return target.HandleAppendEntries(args), nil
+}
+
+// InstallSnapshot delivers a snapshot to peer
+func (t *LocalTransport) InstallSnapshot(peer string, args InstallSnapshotArgs) (InstallSnapshotReply, error) {
+	target, err := t.route(args.LeaderID, peer)
+	if err != nil {
+		return InstallSnapshotReply{}, err
+	}
+	return target.HandleInstallSnapshot(args), nil
+}
+
+// HTTPTransport sends RPCs as JSON over HTTP to peers served by RaftHandler
+type HTTPTransport struct {
+	addresses map[string]string // Node ID to host:port
+	config    RPCConfig
+	client    *http.Client
+}
+
+// NewHTTPTransport creates a transport to the peers at the given addresses,
+// bounding and retrying each RPC as config says
+func NewHTTPTransport(addresses map[string]string, config RPCConfig) *HTTPTransport {
+	return &HTTPTransport{
+		addresses: addresses,
+		config:    config,
+		client:    &http.Client{},
+	}
+}
+
+// call posts args to the peer's raft endpoint and decodes its reply
+func (t *HTTPTransport) call(peer, rpc string, policy RetryPolicy, args, reply interface{}) error {
+	address, ok := t.addresses[peer]
+	if !ok {
+		return fmt.Errorf("unknown raft peer %s", peer)
+	}
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	return policy.Do(context.Background(), func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/raft/%s", address, rpc), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrPeerUnreachable, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("raft %s: %w", rpc, statusError(peer, resp.StatusCode))
+		}
+		return json.NewDecoder(resp.Body).Decode(reply)
+	})
+}
+
+// RequestVote sends a vote request to peer
+func (t *HTTPTransport) RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	var reply RequestVoteReply
+	err := t.call(peer, "request-vote", t.config.RequestVote, args, &reply)
+	return reply, err
+}
+
+// AppendEntries sends entries or a heartbeat to peer
+func (t *HTTPTransport) AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	var reply AppendEntriesReply
+	err := t.call(peer, "append-entries", t.config.AppendEntries, args, &reply)
+	return reply, err
+}
+
+// InstallSnapshot sends a snapshot to peer
+func (t *HTTPTransport) InstallSnapshot(peer string, args InstallSnapshotArgs) (InstallSnapshotReply, error) {
+	var reply InstallSnapshotReply
+	err := t.call(peer, "install-snapshot", t.config.InstallSnapshot, args, &reply)
+	return reply, err
+}
+
+// RaftHandler serves the raft RPCs of n for peers using HTTPTransport
+func RaftHandler(n *RaftNode) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/request-vote", func(w http.ResponseWriter, r *http.Request) {
+		var args RequestVoteArgs
+		if decodeRaftArgs(w, r, &args) {
+			json.NewEncoder(w).Encode(n.HandleRequestVote(args))
+		}
+	})
+	mux.HandleFunc("/raft/append-entries", func(w http.ResponseWriter, r *http.Request) {
+		var args AppendEntriesArgs
+		if decodeRaftArgs(w, r, &args) {
+			json.NewEncoder(w).Encode(n.HandleAppendEntries(args))
+		}
+	})
+	mux.HandleFunc("/raft/install-snapshot", func(w http.ResponseWriter, r *http.Request) {
+		var args InstallSnapshotArgs
+		if decodeRaftArgs(w, r, &args) {
+			json.NewEncoder(w).Encode(n.HandleInstallSnapshot(args))
+		}
+	})
+	return mux
+}
+
+// decodeRaftArgs reads the RPC arguments, answering bad requests itself
+func decodeRaftArgs(w http.ResponseWriter, r *http.Request, args interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return true
+}
@@ -0,0 +1,134 @@
+package fault_tolerance
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// ErrKeyNotFound is returned when no queried replica holds the key
+var ErrKeyNotFound = errors.New("key not found")
+
+// Get reads key from as many replicas as level requires and returns the
+// freshest value, picking the latest write if replicas hold concurrent
+// values. Replicas found holding an older version, or missing the key, are
+// repaired in the background.
+func (rm *ReplicationManager) Get(key string, level ConsistencyLevel) (string, error) {
+	siblings, err := rm.GetSiblings(key, level)
+	if err != nil {
+		return "", err
+	}
+	winner := siblings[0]
+	for _, sibling := range siblings[1:] {
+		winner = lastWriteWins(winner, sibling)
+	}
+	return winner.Value, nil
+}
+
+// GetSiblings reads key like Get but returns every value no other replica
+// has superseded, so callers can resolve concurrent writes themselves by
+// writing the key again
+func (rm *ReplicationManager) GetSiblings(key string, level ConsistencyLevel) ([]VersionedValue, error) {
+	replicas, err := rm.selectReplicas(level)
+	if err != nil {
+		return nil, err
+	}
+
+	var frontier []VersionedValue
+	found := make([]bool, len(replicas))
+	versions := make([]Version, len(replicas))
+	for i, node := range replicas {
+		entry, ok := node.getVersioned(key)
+		found[i], versions[i] = ok, entry.Version
+		if !ok {
+			continue
+		}
+		candidates := node.Siblings(key)
+		if len(candidates) == 0 {
+			candidates = []VersionedValue{entry}
+		}
+		for _, candidate := range candidates {
+			frontier = addToFrontier(frontier, candidate)
+		}
+	}
+	if len(frontier) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	// A replica is current once its version descends from every sibling
+	latest := frontier[0].Version
+	for _, sibling := range frontier[1:] {
+		latest = latest.merge(sibling.Version)
+	}
+	for i, node := range replicas {
+		if !found[i] || versions[i].Compare(latest) != Equal {
+			go repairReplica(node, key, frontier)
+		}
+	}
+	return frontier, nil
+}
+
+// addToFrontier adds value to the set of mutually concurrent values, dropping
+// whatever it supersedes
+func addToFrontier(frontier []VersionedValue, value VersionedValue) []VersionedValue {
+	var kept []VersionedValue
+	for _, existing := range frontier {
+		switch value.Version.Compare(existing.Version) {
+		case Before, Equal:
+			return frontier
+		case Concurrent:
+			kept = append(kept, existing)
+		}
+	}
+	return append(kept, value)
+}
+
+// selectReplicas picks the live nodes to read from at level. The raft leader,
+// which applies writes first, is always asked when it is live; the rest are
+// picked at random to spread reads.
+func (rm *ReplicationManager) selectReplicas(level ConsistencyLevel) ([]*Node, error) {
+	rm.Cluster.Mutex.Lock()
+	var nodes []*Node
+	for _, node := range rm.Cluster.Nodes {
+		if !node.Witness {
+			nodes = append(nodes, node)
+		}
+	}
+	rm.Cluster.Mutex.Unlock()
+
+	required := level.replicas(len(nodes))
+	var live []*Node
+	for _, node := range nodes {
+		if node.IsAlive() {
+			live = append(live, node)
+		}
+	}
+	if len(live) < required || len(live) == 0 {
+		return nil, fmt.Errorf("%w: %s read needs %d replicas, %d live", ErrQuorumUnavailable, level, required, len(live))
+	}
+
+	rand.Shuffle(len(live), func(i, j int) { live[i], live[j] = live[j], live[i] })
+	if leader, err := rm.Cluster.Leader(); err == nil {
+		for i, node := range live {
+			if node == leader {
+				live[0], live[i] = live[i], live[0]
+				break
+			}
+		}
+	}
+	return live[:required], nil
+}
+
+// repairReplica merges the freshest values read into a stale replica
+func repairReplica(node *Node, key string, siblings []VersionedValue) {
+	for _, sibling := range siblings {
+		repaired, err := node.mergeVersion(key, sibling)
+		if err != nil {
+			logger.Warn("Read repair failed", "key", key, "node", node.ID, "error", err)
+			return
+		}
+		if repaired {
+			logger.Debug("Read repair updated key", "key", key, "node", node.ID)
+		}
+	}
+}
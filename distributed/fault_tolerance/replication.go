@@ -1,17 +1,26 @@
 package fault_tolerance
 
 import (
+	"context"
+	"distributed/distributed_crawling"
+	"errors"
 	"fmt"
-	"log"
+	"monitoring/logging"
 	"net"
-	"os"
 	"sync"
 	"time"
 )
 
+// logger reports nodes joining, failing, recovering and catching up
+var logger = logging.Component("distributed/fault_tolerance")
+
 const (
-	replicationFactor = 3
-	nodePort          = ":8080"
+	nodePort = ":8080"
+	// replicateTimeout bounds how long a write waits for a leader and a quorum
+	replicateTimeout = 5 * time.Second
+	// Heartbeat messages exchanged over the node listeners
+	heartbeatRequest = "PING"
+	heartbeatReply   = "PONG"
 )
 
 // Node represents a single node in the distributed system
@@ -22,6 +31,26 @@ type Node struct {
 	Mutex sync.Mutex
 	Peers []*Node
 	Data  map[string]string
+	// Versions orders each key's value against copies on other replicas
+	Versions map[string]Version
+	// Conflicts holds concurrent values of keys under KeepSiblings
+	Conflicts      map[string][]VersionedValue
+	ConflictPolicy ConflictPolicy
+	Raft           *RaftNode // Set once the cluster runs raft
+	// Witness nodes vote in raft elections but hold no data
+	Witness bool
+	// Metadata is the node's member of the cluster metadata group
+	Metadata *MetadataStore
+	// ShardOf assigns keys to replication logs; nil keeps one log
+	ShardOf    func(key string) string
+	logs       map[string]*ReplicationLog
+	logOffsets map[string]uint64 // Last offset applied from each peer's shard log
+	// Storage persists Data across restarts; nil keeps it in memory only
+	Storage StorageEngine
+	// Fence rejects StoreDataFenced writes from former lock holders
+	Fence *distributed_crawling.Fence
+	// crashed is set while a failure is simulated; the node answers nothing
+	crashed bool
 }
 
 // Cluster represents the entire distributed cluster
@@ -33,17 +62,60 @@ type Cluster struct {
 // ReplicationManager handles data replication across nodes
 type ReplicationManager struct {
 	Cluster *Cluster
+	// Fence rejects ReplicateFenced writes from former lock holders
+	Fence *distributed_crawling.Fence
 }
 
 // NewNode initializes a new Node
 func NewNode(id, ip string) *Node {
 	return &Node{
-		IP:    ip,
-		ID:    id,
-		Alive: true,
-		Data:  make(map[string]string),
-		Peers: []*Node{},
+		IP:         ip,
+		ID:         id,
+		Alive:      true,
+		Data:       make(map[string]string),
+		Versions:   make(map[string]Version),
+		Conflicts:  make(map[string][]VersionedValue),
+		Peers:      []*Node{},
+		logs:       make(map[string]*ReplicationLog),
+		logOffsets: make(map[string]uint64),
+	}
+}
+
+// NewWitnessNode initializes a witness: a lightweight node that only votes,
+// so a cluster of two data nodes keeps a majority when one is cut off
+func NewWitnessNode(id, ip string) *Node {
+	n := NewNode(id, ip)
+	n.Witness = true
+	return n
+}
+
+// NewPersistentNode initializes a Node whose data is kept in storage,
+// restoring what it held before a restart
+func NewPersistentNode(id, ip string, storage StorageEngine) (*Node, error) {
+	n := NewNode(id, ip)
+	n.Storage = storage
+	if err := n.loadStorage(); err != nil {
+		return nil, err
 	}
+	return n, nil
+}
+
+// loadStorage replaces the node's data with what its storage holds
+func (n *Node) loadStorage() error {
+	stored, err := n.Storage.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load data of node %s: %w", n.ID, err)
+	}
+	n.Mutex.Lock()
+	n.Data = make(map[string]string, len(stored))
+	n.Versions = make(map[string]Version, len(stored))
+	for key, entry := range stored {
+		n.Data[key] = entry.Value
+		n.Versions[key] = entry.Version
+	}
+	n.Mutex.Unlock()
+	logger.Info("Node loaded keys from storage", "node", n.ID, "keys", len(stored))
+	return nil
 }
 
 // AddPeer adds a peer node to the current node
@@ -53,47 +125,200 @@ func (n *Node) AddPeer(peer *Node) {
 	n.Peers = append(n.Peers, peer)
 }
 
-// StoreData stores key-value data on the node
-func (n *Node) StoreData(key, value string) {
+// StoreData writes key-value data through the node's raft group, blocking
+// until as many replicas as level requires acknowledge it. Without raft the
+// node holds the only copy, which meets only One.
+func (n *Node) StoreData(key, value string, level ConsistencyLevel) error {
+	if n.Raft == nil {
+		if level != One {
+			return fmt.Errorf("%w: node %s does not replicate", ErrQuorumUnavailable, n.ID)
+		}
+		return n.storeLocal(key, value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), replicateTimeout)
+	defer cancel()
+	return n.Raft.Propose(ctx, key, value, level)
+}
+
+// StoreDataFenced writes key-value data like StoreData on behalf of a lock
+// holder, unless the node's fence has seen a newer token than the holder's
+func (n *Node) StoreDataFenced(key, value string, level ConsistencyLevel, token uint64) error {
+	if n.Fence == nil {
+		return fmt.Errorf("node %s has no fence to check token %d against", n.ID, token)
+	}
+	return n.Fence.Guard(token, func() error { return n.StoreData(key, value, level) })
+}
+
+// ReadData reads key at the given level. One reads the node's own copy, which
+// may be stale; Quorum and All must be served by the raft leader.
+func (n *Node) ReadData(key string, level ConsistencyLevel) (string, error) {
+	if n.Raft == nil {
+		if level != One {
+			return "", fmt.Errorf("%w: node %s does not replicate", ErrQuorumUnavailable, n.ID)
+		}
+		value, ok := n.Get(key)
+		if !ok {
+			return "", fmt.Errorf("key %s not found", key)
+		}
+		return value, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), replicateTimeout)
+	defer cancel()
+	return n.Raft.Read(ctx, key, level)
+}
+
+// storeLocal stores a new write of key-value data made on this node outside
+// raft. It supersedes the current value and any siblings.
+func (n *Node) storeLocal(key, value string) error {
 	n.Mutex.Lock()
 	defer n.Mutex.Unlock()
-	n.Data[key] = value
-	log.Printf("Node %s stored data: %s -> %s", n.ID, key, value)
+	version := n.newLocalVersionLocked(key)
+	delete(n.Conflicts, key)
+	return n.storeLocked(key, VersionedValue{Value: value, Version: version})
 }
 
-// ReplicateData replicates data across multiple peers
-func (n *Node) ReplicateData(key, value string) {
-	n.StoreData(key, value)
-	for i := 0; i < replicationFactor-1 && i < len(n.Peers); i++ {
-		go func(peer *Node) {
-			peer.StoreData(key, value)
-			log.Printf("Replicated data to Node %s: %s -> %s", peer.ID, key, value)
-		}(n.Peers[i])
+// storeLocked persists and stores key; callers hold the mutex
+func (n *Node) storeLocked(key string, entry VersionedValue) error {
+	if n.Storage != nil {
+		if err := n.Storage.Put(key, entry); err != nil {
+			return fmt.Errorf("node %s failed to persist %s: %w", n.ID, key, err)
+		}
 	}
+	n.Data[key] = entry.Value
+	n.Versions[key] = entry.Version
+	n.logLocked(key).Append(key, entry)
+	logger.Debug("Node stored data", "node", n.ID, "key", key)
+	return nil
 }
 
-// HealthCheck periodically checks if the node is alive
-func (n *Node) HealthCheck() {
-	for {
-		time.Sleep(5 * time.Second)
-		if !n.Alive {
-			log.Printf("Node %s is down", n.ID)
-		} else {
-			log.Printf("Node %s is alive", n.ID)
+// Get returns the node's own copy of key
+func (n *Node) Get(key string) (string, bool) {
+	entry, ok := n.getVersioned(key)
+	return entry.Value, ok
+}
+
+// getVersioned returns the node's own copy of key with its version
+func (n *Node) getVersioned(key string) (VersionedValue, bool) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	value, ok := n.Data[key]
+	return VersionedValue{Value: value, Version: n.Versions[key]}, ok
+}
+
+// Apply stores a committed raft entry; Node is the raft state machine. Keys
+// read-repaired to a later version are left alone.
+func (n *Node) Apply(key, value string, index uint64) {
+	entry := VersionedValue{Value: value, Version: Version{Index: index, Timestamp: time.Now().UnixNano()}}
+	if _, err := n.mergeVersion(key, entry); err != nil {
+		logger.Error("Failed to apply committed entry", "error", err)
+	}
+}
+
+// Snapshot returns a copy of the node's data for raft log compaction
+func (n *Node) Snapshot() map[string]string {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	data := make(map[string]string, len(n.Data))
+	for key, value := range n.Data {
+		data[key] = value
+	}
+	return data
+}
+
+// Restore replaces the node's data with a raft snapshot taken at index. Keys
+// are versioned at the snapshot index, as their values are current as of it.
+func (n *Node) Restore(data map[string]string, index uint64) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	n.Data = make(map[string]string, len(data))
+	n.Versions = make(map[string]Version, len(data))
+	n.Conflicts = make(map[string][]VersionedValue)
+	stored := make(map[string]VersionedValue, len(data))
+	for key, value := range data {
+		n.Data[key] = value
+		n.Versions[key] = Version{Index: index}
+		stored[key] = VersionedValue{Value: value, Version: n.Versions[key]}
+	}
+	if n.Storage != nil {
+		if err := n.Storage.Replace(stored); err != nil {
+			logger.Error("Node failed to persist snapshot", "node", n.ID, "error", err)
 		}
 	}
+	logger.Info("Node restored keys from snapshot", "node", n.ID, "keys", len(data))
+}
+
+// IsAlive reports whether the node is believed to be up
+func (n *Node) IsAlive() bool {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	return n.Alive
+}
+
+// setAlive records the failure detector's verdict on the node
+func (n *Node) setAlive(alive bool) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	n.Alive = alive
+}
+
+// reachable reports whether the node is actually answering, as opposed to
+// what the failure detector believes
+func (n *Node) reachable() bool {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	return !n.crashed
+}
+
+// HealthCheck sends a heartbeat to the node's listener and waits for the reply
+func (n *Node) HealthCheck(timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", n.IP+nodePort, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprintln(conn, heartbeatRequest); err != nil {
+		return err
+	}
+	var reply string
+	if _, err := fmt.Fscan(conn, &reply); err != nil {
+		return err
+	}
+	if reply != heartbeatReply {
+		return fmt.Errorf("unexpected heartbeat reply %q from node %s", reply, n.ID)
+	}
+	return nil
 }
 
-// HandleFailure attempts to recover data from peers
+// HandleFailure recovers the node's data, first from its own storage and
+// then from peers for whatever it missed while down, replaying their
+// replication logs where they reach back far enough. Nodes running raft are
+// caught up by the leader instead of peers.
 func (n *Node) HandleFailure() {
+	if n.Storage != nil {
+		if err := n.loadStorage(); err != nil {
+			logger.Error("Failed to restore node from storage", "node", n.ID, "error", err)
+		}
+	}
+	if n.Raft != nil || n.Witness {
+		return
+	}
+	options := DefaultTransferOptions
 	for _, peer := range n.Peers {
-		if peer.Alive {
-			log.Printf("Recovering data from Node %s", peer.ID)
-			for key, value := range peer.Data {
-				n.StoreData(key, value)
-			}
-			break
+		if !peer.IsAlive() || peer.Witness {
+			continue
+		}
+		logger.Info("Recovering data", "node", n.ID, "peer", peer.ID)
+		progress, err := n.CatchUpFrom(context.Background(), peer, options)
+		if err == nil {
+			return
 		}
+		// Try the next peer, carrying on from where this one stopped
+		logger.Error("Recovery failed", "node", n.ID, "peer", peer.ID, "keys", progress.Keys, "error", err)
+		options.Cursor = progress.Cursor
 	}
 }
 
@@ -115,7 +340,144 @@ func (c *Cluster) AddNode(node *Node) {
 			existingNode.AddPeer(node)
 		}
 	}
-	log.Printf("Node %s added to the cluster", node.ID)
+	logger.Info("Node added to the cluster", "node", node.ID)
+}
+
+// StartRaft runs raft on every node of the cluster, replicating between them
+// in process. Membership is fixed from then on.
+func (c *Cluster) StartRaft(config RaftConfig) {
+	c.startRaft(config, nil)
+}
+
+// startRaft runs raft on every node, first seeding them with restored if set
+func (c *Cluster) startRaft(config RaftConfig, restored *Snapshot) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	transport := NewLocalTransport(c.Nodes)
+	config.Witnesses = nil
+	for _, node := range c.Nodes {
+		if node.Witness {
+			config.Witnesses = append(config.Witnesses, node.ID)
+		}
+	}
+	for _, node := range c.Nodes {
+		var peers []string
+		for _, other := range c.Nodes {
+			if other != node {
+				peers = append(peers, other.ID)
+			}
+		}
+		node.Raft = NewRaftNode(node.ID, peers, transport, node, config)
+		if restored != nil {
+			node.Raft.seed(*restored)
+		}
+	}
+	for _, node := range c.Nodes {
+		go node.Raft.Run()
+	}
+	logger.Info("Started raft", "nodes", len(c.Nodes))
+}
+
+// StartMetadata runs the cluster metadata group on every node, witnesses
+// included, and registers the nodes as its members
+func (c *Cluster) StartMetadata(config RaftConfig) {
+	c.startMetadata(config, nil)
+}
+
+// startMetadata runs the metadata group, first seeding it with restored if set
+func (c *Cluster) startMetadata(config RaftConfig, restored *Snapshot) {
+	c.Mutex.Lock()
+	transport := newLocalTransport(c.Nodes, func(node *Node) *RaftNode {
+		if node.Metadata == nil {
+			return nil
+		}
+		return node.Metadata.Raft()
+	})
+	for _, node := range c.Nodes {
+		var peers []string
+		for _, other := range c.Nodes {
+			if other != node {
+				peers = append(peers, other.ID)
+			}
+		}
+		node.Metadata = NewMetadataStore(node.ID, peers, transport, config)
+		if restored != nil {
+			node.Metadata.Raft().seed(*restored)
+		}
+	}
+	nodes := append([]*Node(nil), c.Nodes...)
+	c.Mutex.Unlock()
+
+	for _, node := range nodes {
+		go node.Metadata.Run()
+	}
+	for _, node := range nodes {
+		member := Member{ID: node.ID, Address: node.IP, Witness: node.Witness}
+		err := c.withMetadataLeader(func(ctx context.Context, store *MetadataStore) error {
+			return store.PutMember(ctx, member)
+		})
+		if err != nil {
+			logger.Error("Failed to register node", "node", node.ID, "error", err)
+		}
+	}
+	logger.Info("Started cluster metadata", "nodes", len(nodes))
+}
+
+// withMetadataLeader runs op against the metadata group's leader, retrying
+// while leadership changes hands until replicateTimeout passes
+func (c *Cluster) withMetadataLeader(op func(ctx context.Context, store *MetadataStore) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), replicateTimeout)
+	defer cancel()
+
+	for {
+		err := errors.New("no metadata leader elected")
+		c.Mutex.Lock()
+		var leader *MetadataStore
+		for _, node := range c.Nodes {
+			if node.Metadata == nil || !node.IsAlive() {
+				continue
+			}
+			if _, role, _ := node.Metadata.Raft().State(); role == Leader {
+				leader = node.Metadata
+			}
+		}
+		c.Mutex.Unlock()
+
+		if leader != nil {
+			err = op(ctx, leader)
+			if err == nil || (!errors.Is(err, ErrNotLeader) && !errors.Is(err, ErrLeadershipLost)) {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// Leader returns the live node currently leading the cluster
+func (c *Cluster) Leader() (*Node, error) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	var leader *Node
+	var leaderTerm uint64
+	for _, node := range c.Nodes {
+		if node.Raft == nil || !node.IsAlive() {
+			continue
+		}
+		// A partitioned old leader may not know it was replaced yet
+		if term, role, _ := node.Raft.State(); role == Leader && term >= leaderTerm {
+			leader, leaderTerm = node, term
+		}
+	}
+	if leader == nil {
+		return nil, errors.New("no raft leader elected")
+	}
+	return leader, nil
 }
 
 // NewReplicationManager initializes a new replication manager
@@ -125,10 +487,51 @@ func NewReplicationManager(cluster *Cluster) *ReplicationManager {
 	}
 }
 
-// Replicate replicates data across the cluster
-func (rm *ReplicationManager) Replicate(key, value string) {
-	for _, node := range rm.Cluster.Nodes {
-		node.ReplicateData(key, value)
+// Replicate writes data through the raft leader and returns once as many
+// replicas as level requires have stored it, waiting for an election if
+// there's no leader
+func (rm *ReplicationManager) Replicate(key, value string, level ConsistencyLevel) error {
+	err := rm.withLeader(func(ctx context.Context, leader *Node) error {
+		return leader.Raft.Propose(ctx, key, value, level)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replicate %s: %w", key, err)
+	}
+	return nil
+}
+
+// ReplicateFenced replicates data like Replicate on behalf of a lock holder,
+// unless the manager's fence has seen a newer token than the holder's
+func (rm *ReplicationManager) ReplicateFenced(key, value string, level ConsistencyLevel, token uint64) error {
+	if rm.Fence == nil {
+		return fmt.Errorf("failed to replicate %s: no fence to check token %d against", key, token)
+	}
+	return rm.Fence.Guard(token, func() error { return rm.Replicate(key, value, level) })
+}
+
+// withLeader runs op against the current leader, retrying while leadership
+// changes hands until replicateTimeout passes
+func (rm *ReplicationManager) withLeader(op func(ctx context.Context, leader *Node) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), replicateTimeout)
+	defer cancel()
+
+	for {
+		leader, err := rm.Cluster.Leader()
+		if err == nil {
+			err = op(ctx, leader)
+			if err == nil {
+				return nil
+			}
+		}
+		if leader != nil && !errors.Is(err, ErrNotLeader) && !errors.Is(err, ErrLeadershipLost) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(50 * time.Millisecond):
+		}
 	}
 }
 
@@ -136,16 +539,16 @@ func (rm *ReplicationManager) Replicate(key, value string) {
 func (n *Node) NodeListener() {
 	listener, err := net.Listen("tcp", n.IP+nodePort)
 	if err != nil {
-		log.Fatalf("Error starting listener on Node %s: %v", n.ID, err)
-		os.Exit(1)
+		logger.Error("Failed to start listener", "node", n.ID, "error", err)
+		return
 	}
 	defer listener.Close()
-	log.Printf("Node %s is listening on %s", n.ID, n.IP+nodePort)
+	logger.Info("Node listening", "node", n.ID, "address", n.IP+nodePort)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Error accepting connection on Node %s: %v", n.ID, err)
+			logger.Warn("Failed to accept connection", "node", n.ID, "error", err)
 			continue
 		}
 		go n.HandleConnection(conn)
@@ -156,34 +559,56 @@ func (n *Node) NodeListener() {
 func (n *Node) HandleConnection(conn net.Conn) {
 	defer conn.Close()
 	var key, value string
-	fmt.Fscan(conn, &key, &value)
-	n.StoreData(key, value)
+	fmt.Fscan(conn, &key)
+	if key == heartbeatRequest {
+		if n.reachable() {
+			fmt.Fprintln(conn, heartbeatReply)
+		}
+		return
+	}
+	fmt.Fscan(conn, &value)
+	if n.Raft == nil {
+		if err := n.storeLocal(key, value); err != nil {
+			fmt.Fprintf(conn, "error: %v\n", err)
+		}
+		return
+	}
+
+	// Writes must go through consensus; clients retry against the leader
+	if err := n.StoreData(key, value, Quorum); err != nil {
+		_, _, leaderID := n.Raft.State()
+		fmt.Fprintf(conn, "error: %v (leader %s)\n", err, leaderID)
+	}
 }
 
-// ClusterListener monitors cluster-wide node health
+// ClusterListener monitors cluster-wide node health with a heartbeat failure
+// detector, logging nodes as they are suspected or marked down
 func (c *Cluster) ClusterListener() {
-	for {
-		for _, node := range c.Nodes {
-			go node.HealthCheck()
+	detector := NewFailureDetector(DefaultFailureDetectorConfig)
+	detector.OnStatusChange(func(node *Node, from, to Suspicion) {
+		if to == Down {
+			logger.Warn("Node marked down, failover required", "node", node.ID)
 		}
-		time.Sleep(10 * time.Second)
-	}
+	})
+	detector.Run(c)
 }
 
-// SimulateNodeFailure simulates node failure by marking a node as down
+// SimulateNodeFailure simulates node failure; the node stops answering
 func (n *Node) SimulateNodeFailure() {
 	n.Mutex.Lock()
 	defer n.Mutex.Unlock()
 	n.Alive = false
-	log.Printf("Node %s has failed", n.ID)
+	n.crashed = true
+	logger.Warn("Node has failed", "node", n.ID)
 }
 
 // SimulateNodeRecovery simulates node recovery and data restoration
 func (n *Node) SimulateNodeRecovery() {
 	n.Mutex.Lock()
-	defer n.Mutex.Unlock()
 	n.Alive = true
-	log.Printf("Node %s has recovered", n.ID)
+	n.crashed = false
+	n.Mutex.Unlock()
+	logger.Info("Node has recovered", "node", n.ID)
 	n.HandleFailure()
 }
 
@@ -199,13 +624,23 @@ func TestCluster() {
 	cluster.AddNode(node2)
 	cluster.AddNode(node3)
 
+	cluster.StartRaft(DefaultRaftConfig)
+
 	replicationManager := NewReplicationManager(cluster)
-	replicationManager.Replicate("key1", "value1")
+	if err := replicationManager.Replicate("key1", "value1", All); err != nil {
+		logger.Error("Replication failed", "error", err)
+	}
 
-	// Simulate node failure
+	// Simulate node failure; the remaining majority keeps accepting writes
 	node2.SimulateNodeFailure()
+	if err := replicationManager.Replicate("key2", "value2", Quorum); err != nil {
+		logger.Error("Replication failed", "error", err)
+	}
+	if value, err := replicationManager.Get("key1", Quorum); err == nil {
+		logger.Info("Read key1 at QUORUM", "value", value)
+	}
 
-	// Simulate recovery
+	// Simulate recovery; the leader catches the node up
 	node2.SimulateNodeRecovery()
 
 	// Start cluster listener
@@ -215,6 +650,9 @@ func TestCluster() {
 	go node1.NodeListener()
 	go node2.NodeListener()
 	go node3.NodeListener()
+	go node1.StateListener()
+	go node2.StateListener()
+	go node3.StateListener()
 
 	// Keep the test running
 	select {}
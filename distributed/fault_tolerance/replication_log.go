@@ -0,0 +1,275 @@
+package fault_tolerance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	// defaultLogRetention is how many writes each shard's log keeps
+	defaultLogRetention = 100000
+	// defaultShard holds every key of nodes without a ShardOf function
+	defaultShard = "default"
+)
+
+// ErrLogTruncated is returned when the entries after an offset were
+// discarded, so the reader must fall back to a full state transfer
+var ErrLogTruncated = errors.New("replication log truncated past offset")
+
+// ReplicationEntry is a write in a shard's replication log
+type ReplicationEntry struct {
+	Offset uint64         `json:"offset"`
+	Key    string         `json:"key"`
+	Entry  VersionedValue `json:"entry"`
+}
+
+// LogChunk is a page of a replication log
+type LogChunk struct {
+	Entries   []ReplicationEntry `json:"entries"`
+	Head      uint64             `json:"head"` // Offset of the newest write
+	Truncated bool               `json:"truncated,omitempty"`
+}
+
+// ReplicationLog keeps the recent writes of a shard so replicas that fell
+// behind can replay them from the last offset they applied
+type ReplicationLog struct {
+	Retention int
+
+	mutex   sync.Mutex
+	entries []ReplicationEntry
+	first   uint64 // Offset of entries[0]
+	head    uint64
+}
+
+// NewReplicationLog creates an empty log keeping up to retention writes
+func NewReplicationLog(retention int) *ReplicationLog {
+	return &ReplicationLog{Retention: retention, first: 1}
+}
+
+// Append logs a write and returns its offset
+func (l *ReplicationLog) Append(key string, entry VersionedValue) uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.head++
+	l.entries = append(l.entries, ReplicationEntry{Offset: l.head, Key: key, Entry: entry})
+	if l.Retention > 0 && len(l.entries) > l.Retention {
+		drop := len(l.entries) - l.Retention
+		l.entries = append([]ReplicationEntry(nil), l.entries[drop:]...)
+		l.first += uint64(drop)
+	}
+	return l.head
+}
+
+// Read returns up to limit writes following offset after
+func (l *ReplicationLog) Read(after uint64, limit int) (LogChunk, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	chunk := LogChunk{Head: l.head}
+	// An offset past the head was handed out by a log since lost, e.g. when
+	// the peer restarted
+	if after+1 < l.first || after > l.head {
+		chunk.Truncated = true
+		return chunk, fmt.Errorf("%w %d, log holds %d to %d", ErrLogTruncated, after, l.first, l.head)
+	}
+	start := int(after + 1 - l.first)
+	if start > len(l.entries) {
+		return chunk, nil
+	}
+	end := len(l.entries)
+	if end-start > limit {
+		end = start + limit
+	}
+	chunk.Entries = append([]ReplicationEntry(nil), l.entries[start:end]...)
+	return chunk, nil
+}
+
+// Head returns the offset of the newest write
+func (l *ReplicationLog) Head() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.head
+}
+
+// logLocked returns the log of the shard holding key; callers hold the mutex
+func (n *Node) logLocked(key string) *ReplicationLog {
+	shard := defaultShard
+	if n.ShardOf != nil {
+		shard = n.ShardOf(key)
+	}
+	l, ok := n.logs[shard]
+	if !ok {
+		l = NewReplicationLog(defaultLogRetention)
+		n.logs[shard] = l
+	}
+	return l
+}
+
+// ReplicationLogs returns the head offset of each shard's log
+func (n *Node) ReplicationLogs() map[string]uint64 {
+	n.Mutex.Lock()
+	logs := make(map[string]*ReplicationLog, len(n.logs))
+	for shard, l := range n.logs {
+		logs[shard] = l
+	}
+	n.Mutex.Unlock()
+
+	heads := make(map[string]uint64, len(logs))
+	for shard, l := range logs {
+		heads[shard] = l.Head()
+	}
+	return heads
+}
+
+// ReplicationLogHandler serves the node's replication logs to lagging peers:
+// GET /replog lists the shards with their head offsets and
+// GET /replog?shard=<shard>&after=<offset>&limit=<writes> pages through one
+func (n *Node) ReplicationLogHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		if !query.Has("shard") {
+			json.NewEncoder(w).Encode(n.ReplicationLogs())
+			return
+		}
+
+		after, err := strconv.ParseUint(query.Get("after"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxChunkSize {
+			limit = maxChunkSize
+		}
+
+		n.Mutex.Lock()
+		l, ok := n.logs[query.Get("shard")]
+		n.Mutex.Unlock()
+		if !ok {
+			json.NewEncoder(w).Encode(LogChunk{})
+			return
+		}
+		// A truncated log still answers, flagging that a full transfer is needed
+		chunk, _ := l.Read(after, limit)
+		json.NewEncoder(w).Encode(chunk)
+	})
+}
+
+// CatchUpFrom replays the writes peer made since this node last caught up
+// with it. If the peer's log no longer reaches back that far the node falls
+// back to a full state transfer, whose progress is returned.
+func (n *Node) CatchUpFrom(ctx context.Context, peer *Node, options TransferOptions) (TransferProgress, error) {
+	address := peer.IP + statePort
+	var heads map[string]uint64
+	if err := getJSON(ctx, options.Client, options.LogRetry, fmt.Sprintf("http://%s/replog", address), &heads); err != nil {
+		return TransferProgress{}, fmt.Errorf("failed to list replication logs of %s: %w", peer.ID, err)
+	}
+	shards := make([]string, 0, len(heads))
+	for shard := range heads {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	replayed := 0
+	for _, shard := range shards {
+		count, err := n.replayLog(ctx, peer.ID, address, shard, options)
+		replayed += count
+		if errors.Is(err, ErrLogTruncated) {
+			return n.fullCatchUp(ctx, peer.ID, address, heads, options)
+		}
+		if err != nil {
+			return TransferProgress{}, err
+		}
+	}
+	logger.Info("Node caught up by replaying writes", "node", n.ID, "peer", peer.ID, "writes", replayed)
+	return TransferProgress{}, nil
+}
+
+// replayLog applies one shard's log entries after the last offset applied from peer
+func (n *Node) replayLog(ctx context.Context, peerID, address, shard string, options TransferOptions) (int, error) {
+	cursor := peerID + "/" + shard
+	n.Mutex.Lock()
+	offset := n.logOffsets[cursor]
+	n.Mutex.Unlock()
+
+	replayed := 0
+	for {
+		query := url.Values{
+			"shard": {shard},
+			"after": {strconv.FormatUint(offset, 10)},
+			"limit": {strconv.Itoa(options.ChunkSize)},
+		}
+		var chunk LogChunk
+		if err := getJSON(ctx, options.Client, options.LogRetry, fmt.Sprintf("http://%s/replog?%s", address, query.Encode()), &chunk); err != nil {
+			return replayed, fmt.Errorf("failed to read replication log of %s: %w", peerID, err)
+		}
+		if chunk.Truncated {
+			return replayed, ErrLogTruncated
+		}
+		for _, entry := range chunk.Entries {
+			if _, err := n.mergeVersion(entry.Key, entry.Entry); err != nil {
+				return replayed, err
+			}
+			offset = entry.Offset
+			replayed++
+		}
+		n.Mutex.Lock()
+		n.logOffsets[cursor] = offset
+		n.Mutex.Unlock()
+		if len(chunk.Entries) == 0 || offset >= chunk.Head {
+			return replayed, nil
+		}
+	}
+}
+
+// fullCatchUp copies all of peer's data and then marks every log as applied
+// up to the heads listed before the copy started. Writes made during the
+// copy are replayed again next time, which merging versions makes harmless.
+func (n *Node) fullCatchUp(ctx context.Context, peerID, address string, heads map[string]uint64, options TransferOptions) (TransferProgress, error) {
+	logger.Warn("Replication log is truncated, falling back to a full state transfer", "peer", peerID)
+	progress, err := n.StreamStateFrom(ctx, address, options)
+	if err != nil {
+		return progress, err
+	}
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	for shard, head := range heads {
+		n.logOffsets[peerID+"/"+shard] = head
+	}
+	return progress, nil
+}
+
+// getJSON fetches endpoint and decodes its JSON body into v, retrying
+// transient failures as policy allows
+func getJSON(ctx context.Context, client *http.Client, policy RetryPolicy, endpoint string, v interface{}) error {
+	return policy.Do(ctx, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return statusError(req.URL.Host, resp.StatusCode)
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	})
+}
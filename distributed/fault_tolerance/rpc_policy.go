@@ -0,0 +1,135 @@
+package fault_tolerance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy bounds one kind of replication RPC, so a slow or dead peer
+// costs a known amount of time instead of stalling its caller
+type RetryPolicy struct {
+	Timeout    time.Duration // Deadline of each attempt; 0 leaves attempts unbounded
+	Attempts   int           // Tries before giving up
+	Backoff    time.Duration // Wait before the first retry, doubling after each
+	MaxBackoff time.Duration
+}
+
+// RPCConfig sets the retry policy of each replication RPC
+type RPCConfig struct {
+	RequestVote     RetryPolicy
+	AppendEntries   RetryPolicy
+	InstallSnapshot RetryPolicy
+	StateTransfer   RetryPolicy // Each chunk of a state transfer
+	ReplicationLog  RetryPolicy // Each page of a replication log
+}
+
+// DefaultRPCConfig keeps raft RPCs well inside the election timeout and
+// gives bulk transfers room to ride out brief outages
+var DefaultRPCConfig = RPCConfig{
+	// A vote arriving after the election timed out is useless, so votes
+	// aren't retried
+	RequestVote: RetryPolicy{Timeout: 150 * time.Millisecond, Attempts: 1},
+	// The next heartbeat resends entries anyway, so one quick retry is enough
+	AppendEntries:   RetryPolicy{Timeout: 500 * time.Millisecond, Attempts: 2, Backoff: 20 * time.Millisecond, MaxBackoff: 20 * time.Millisecond},
+	InstallSnapshot: RetryPolicy{Timeout: 30 * time.Second, Attempts: 3, Backoff: 500 * time.Millisecond, MaxBackoff: 5 * time.Second},
+	StateTransfer:   RetryPolicy{Timeout: 30 * time.Second, Attempts: 4, Backoff: 500 * time.Millisecond, MaxBackoff: 5 * time.Second},
+	ReplicationLog:  RetryPolicy{Timeout: 10 * time.Second, Attempts: 4, Backoff: 200 * time.Millisecond, MaxBackoff: 2 * time.Second},
+}
+
+// transientError marks a failure worth retrying
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string { return e.err.Error() }
+func (e transientError) Unwrap() error { return e.err }
+
+// transient marks err as worth retrying
+func transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return transientError{err}
+}
+
+// IsTransient reports whether err may go away by itself, like a timeout, a
+// refused connection or an overloaded peer. Anything else, e.g. a malformed
+// request or an unknown peer, fails the same way every time.
+func IsTransient(err error) bool {
+	var marked transientError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &marked), errors.As(err, &netErr):
+		return true
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrPeerUnreachable):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// The peer hung up mid-response, e.g. while restarting
+		return true
+	}
+	return false
+}
+
+// statusError classifies an unexpected HTTP status from a peer
+func statusError(peer string, status int) error {
+	err := fmt.Errorf("peer %s answered with status %d", peer, status)
+	if status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout {
+		return transient(err)
+	}
+	return err
+}
+
+// Do runs op until it succeeds, fails permanently, runs out of attempts or
+// ctx is done. Each attempt gets its own deadline.
+func (p RetryPolicy) Do(ctx context.Context, op func(ctx context.Context) error) error {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := p.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = p.attempt(ctx, op)
+		if err == nil || !IsTransient(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt == attempts {
+			if attempts == 1 {
+				return err
+			}
+			return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+		}
+
+		// Jitter keeps peers that failed together from retrying in lockstep
+		wait := backoff
+		if wait > 0 {
+			wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+func (p RetryPolicy) attempt(ctx context.Context, op func(ctx context.Context) error) error {
+	if p.Timeout <= 0 {
+		return op(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	return op(ctx)
+}
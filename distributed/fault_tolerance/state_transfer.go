@@ -0,0 +1,186 @@
+package fault_tolerance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	statePort = ":8081"
+	// maxChunkSize caps the keys a peer sends in one state transfer chunk
+	maxChunkSize = 10000
+)
+
+// StateChunk is one page of a node's data, in key order
+type StateChunk struct {
+	Entries map[string]VersionedValue `json:"entries"`
+	Next    string                    `json:"next"` // Cursor to request the following chunk with
+	Done    bool                      `json:"done"`
+}
+
+// TransferOptions tunes a state transfer
+type TransferOptions struct {
+	ChunkSize      int
+	BytesPerSecond int64       // Throttles the transfer; 0 is unlimited
+	Cursor         string      // Resumes a transfer after this key
+	Retry          RetryPolicy // Bounds each chunk request
+	LogRetry       RetryPolicy // Bounds each replication log request of a catch-up
+	Client         *http.Client
+}
+
+// DefaultTransferOptions sends 1000 keys per chunk at up to 10MB/s
+var DefaultTransferOptions = TransferOptions{
+	ChunkSize:      1000,
+	BytesPerSecond: 10 << 20,
+	Retry:          DefaultRPCConfig.StateTransfer,
+	LogRetry:       DefaultRPCConfig.ReplicationLog,
+	Client:         &http.Client{},
+}
+
+// TransferProgress reports how far a state transfer got. Passing Cursor back
+// in TransferOptions resumes an interrupted transfer.
+type TransferProgress struct {
+	Cursor string
+	Keys   int
+	Bytes  int64
+}
+
+// StateTransferHandler serves the node's data in chunks to recovering or
+// joining nodes at GET /state?after=<cursor>&limit=<keys>
+func (n *Node) StateTransferHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxChunkSize {
+			limit = maxChunkSize
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.chunkAfter(r.URL.Query().Get("after"), limit))
+	})
+}
+
+// StateListener serves the node's data and replication logs to peers on the
+// state transfer port
+func (n *Node) StateListener() {
+	mux := http.NewServeMux()
+	mux.Handle("/state", n.StateTransferHandler())
+	mux.Handle("/replog", n.ReplicationLogHandler())
+	logger.Info("Serving state", "node", n.ID, "address", n.IP+statePort)
+	if err := http.ListenAndServe(n.IP+statePort, mux); err != nil {
+		logger.Error("State listener stopped", "node", n.ID, "error", err)
+	}
+}
+
+// chunkAfter returns up to limit keys following after in key order
+func (n *Node) chunkAfter(after string, limit int) StateChunk {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	var keys []string
+	for key := range n.Data {
+		if key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	chunk := StateChunk{Entries: make(map[string]VersionedValue), Next: after, Done: len(keys) <= limit}
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	for _, key := range keys {
+		chunk.Entries[key] = VersionedValue{Value: n.Data[key], Version: n.Versions[key]}
+		chunk.Next = key
+	}
+	return chunk
+}
+
+// StreamStateFrom copies the data of the peer serving StateTransferHandler at
+// address onto this node, chunk by chunk. Failed chunks are retried; if the
+// transfer still fails the returned progress can be used to resume it.
+func (n *Node) StreamStateFrom(ctx context.Context, address string, options TransferOptions) (TransferProgress, error) {
+	progress := TransferProgress{Cursor: options.Cursor}
+	start := time.Now()
+
+	for {
+		chunk, size, err := n.fetchChunk(ctx, address, progress.Cursor, options)
+		if err != nil {
+			return progress, fmt.Errorf("state transfer from %s stopped after %d keys: %w", address, progress.Keys, err)
+		}
+		// Versions keep a late chunk from overwriting newer local writes
+		for key, entry := range chunk.Entries {
+			if _, err := n.mergeVersion(key, entry); err != nil {
+				return progress, err
+			}
+		}
+		// Only advance once the whole chunk is stored, so a resumed transfer
+		// never skips keys
+		progress.Cursor = chunk.Next
+		progress.Keys += len(chunk.Entries)
+		progress.Bytes += size
+		if chunk.Done {
+			logger.Info("Received state", "node", n.ID, "from", address, "keys", progress.Keys, "bytes", progress.Bytes, "duration", time.Since(start))
+			return progress, nil
+		}
+
+		if options.BytesPerSecond > 0 {
+			due := start.Add(time.Duration(float64(progress.Bytes) / float64(options.BytesPerSecond) * float64(time.Second)))
+			select {
+			case <-ctx.Done():
+				return progress, ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		}
+	}
+}
+
+// fetchChunk requests the chunk after cursor, retrying transient failures
+// with backoff
+func (n *Node) fetchChunk(ctx context.Context, address, cursor string, options TransferOptions) (StateChunk, int64, error) {
+	query := url.Values{"after": {cursor}, "limit": {strconv.Itoa(options.ChunkSize)}}
+	endpoint := fmt.Sprintf("http://%s/state?%s", address, query.Encode())
+
+	var chunk StateChunk
+	var size int64
+	err := options.Retry.Do(ctx, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := options.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return statusError(address, resp.StatusCode)
+		}
+
+		chunk = StateChunk{}
+		if err := json.Unmarshal(body, &chunk); err != nil {
+			return err
+		}
+		size = int64(len(body))
+		return nil
+	})
+	return chunk, size, err
+}
@@ -0,0 +1,258 @@
+package fault_tolerance
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	checkpointFile = "data.json"
+	walFile        = "wal.log"
+	// walHeaderSize is the length and CRC32 preceding each WAL record
+	walHeaderSize = 8
+	// defaultCheckpointRecords is how many WAL records trigger a checkpoint
+	defaultCheckpointRecords = 10000
+)
+
+// StorageEngine persists a node's data so it survives restarts
+type StorageEngine interface {
+	// Load returns the data stored so far
+	Load() (map[string]VersionedValue, error)
+	// Put durably stores one key
+	Put(key string, entry VersionedValue) error
+	// Replace durably swaps all data for data, e.g. on a raft snapshot
+	Replace(data map[string]VersionedValue) error
+	Close() error
+}
+
+// walRecord is one write in the write-ahead log
+type walRecord struct {
+	Key     string  `json:"key"`
+	Value   string  `json:"value"`
+	Version Version `json:"version"`
+}
+
+// FileStorage keeps a node's data in a directory as a checkpoint plus a
+// write-ahead log of the writes since. Every write is synced to the log
+// before it is acknowledged; the log is folded into a new checkpoint once
+// it holds CheckpointRecords writes.
+type FileStorage struct {
+	CheckpointRecords int
+
+	dir     string
+	mutex   sync.Mutex
+	data    map[string]VersionedValue
+	wal     *os.File
+	records int
+}
+
+// OpenFileStorage opens or creates the storage in dir, replaying its log
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	s := &FileStorage{
+		CheckpointRecords: defaultCheckpointRecords,
+		dir:               dir,
+		data:              make(map[string]VersionedValue),
+	}
+
+	checkpoint, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(checkpoint, &s.data); err != nil {
+			return nil, fmt.Errorf("corrupt checkpoint in %s: %w", dir, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	s.wal, err = os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	if err := s.replay(); err != nil {
+		s.wal.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay applies the log on top of the checkpoint. A torn or corrupt record
+// at the tail is a write that was never acknowledged, so the log is cut there.
+func (s *FileStorage) replay() error {
+	reader := bufio.NewReader(s.wal)
+	var valid int64
+	for {
+		record, size, err := readWALRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Warn("Truncating write-ahead log", "dir", s.dir, "records", s.records, "error", err)
+			break
+		}
+		s.data[record.Key] = VersionedValue{Value: record.Value, Version: record.Version}
+		s.records++
+		valid += size
+	}
+
+	if err := s.wal.Truncate(valid); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	_, err := s.wal.Seek(valid, io.SeekStart)
+	return err
+}
+
+// readWALRecord reads one record and its size on disk
+func readWALRecord(r io.Reader) (walRecord, int64, error) {
+	var record walRecord
+	payload, size, err := readRecord(r)
+	if err != nil {
+		return record, 0, err
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, 0, err
+	}
+	return record, size, nil
+}
+
+// readRecord reads one length and CRC32 framed payload and its size on disk
+func readRecord(r io.Reader) ([]byte, int64, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.New("torn record header")
+		}
+		return nil, 0, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header[:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, errors.New("torn record")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errors.New("record checksum mismatch")
+	}
+	return payload, int64(walHeaderSize + len(payload)), nil
+}
+
+// appendRecord frames payload with its length and CRC32, appends it to file
+// and syncs it
+func appendRecord(file *os.File, payload []byte) error {
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:walHeaderSize], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+
+	if _, err := file.Write(record); err != nil {
+		return fmt.Errorf("failed to append to write-ahead log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// Load returns a copy of the stored data
+func (s *FileStorage) Load() (map[string]VersionedValue, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data := make(map[string]VersionedValue, len(s.data))
+	for key, value := range s.data {
+		data[key] = value
+	}
+	return data, nil
+}
+
+// Put appends the write to the log and syncs it
+func (s *FileStorage) Put(key string, entry VersionedValue) error {
+	payload, err := json.Marshal(walRecord{Key: key, Value: entry.Value, Version: entry.Version})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := appendRecord(s.wal, payload); err != nil {
+		return err
+	}
+	s.data[key] = entry
+	s.records++
+
+	if s.CheckpointRecords > 0 && s.records >= s.CheckpointRecords {
+		return s.checkpointLocked()
+	}
+	return nil
+}
+
+// Replace writes data as the new checkpoint and empties the log
+func (s *FileStorage) Replace(data map[string]VersionedValue) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data = make(map[string]VersionedValue, len(data))
+	for key, value := range data {
+		s.data[key] = value
+	}
+	return s.checkpointLocked()
+}
+
+// checkpointLocked atomically writes the data to a new checkpoint and then
+// truncates the log it covers; callers hold the mutex
+func (s *FileStorage) checkpointLocked() error {
+	encoded, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	if err := writeCheckpoint(filepath.Join(s.dir, checkpointFile), encoded); err != nil {
+		return err
+	}
+
+	// A crash before truncation only replays writes the checkpoint already has
+	if err := s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.records = 0
+	return nil
+}
+
+// writeCheckpoint atomically replaces the checkpoint at path with encoded,
+// syncing it before it is renamed into place
+func writeCheckpoint(path string, encoded []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint: %w", err)
+	}
+	if _, err := file.Write(encoded); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync checkpoint: %w", err)
+	}
+	file.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to install checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Close closes the write-ahead log
+func (s *FileStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.wal.Close()
+}
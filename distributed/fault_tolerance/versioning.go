@@ -0,0 +1,200 @@
+package fault_tolerance
+
+import (
+	"fmt"
+	"time"
+)
+
+// VectorClock counts the writes each node has made to a key
+type VectorClock map[string]uint64
+
+// Ordering is how two versions relate
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+// String returns the name of the ordering
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	case Concurrent:
+		return "concurrent"
+	}
+	return fmt.Sprintf("ordering-%d", int(o))
+}
+
+// Increment returns a copy of the clock with one more write by nodeID
+func (vc VectorClock) Increment(nodeID string) VectorClock {
+	clock := vc.Merge(nil)
+	clock[nodeID]++
+	return clock
+}
+
+// Merge returns a clock that has seen every write either clock has
+func (vc VectorClock) Merge(other VectorClock) VectorClock {
+	clock := make(VectorClock, len(vc))
+	for node, count := range vc {
+		clock[node] = count
+	}
+	for node, count := range other {
+		if count > clock[node] {
+			clock[node] = count
+		}
+	}
+	return clock
+}
+
+// Compare reports whether vc happened before, after or concurrently with other
+func (vc VectorClock) Compare(other VectorClock) Ordering {
+	behind, ahead := false, false
+	for node, count := range vc {
+		if count > other[node] {
+			ahead = true
+		}
+	}
+	for node, count := range other {
+		if count > vc[node] {
+			behind = true
+		}
+	}
+	switch {
+	case ahead && behind:
+		return Concurrent
+	case ahead:
+		return After
+	case behind:
+		return Before
+	}
+	return Equal
+}
+
+// Version orders the writes to a key. Writes through raft carry the log
+// index that totally orders them and supersede writes made outside raft;
+// the others carry a vector clock, so concurrent writes are detected rather
+// than silently overwritten. Timestamp breaks ties for last-write-wins.
+type Version struct {
+	Index     uint64      `json:"index,omitempty"`
+	Clock     VectorClock `json:"clock,omitempty"`
+	Timestamp int64       `json:"timestamp,omitempty"` // Unix nanoseconds of the write
+}
+
+// Compare reports how v relates to other
+func (v Version) Compare(other Version) Ordering {
+	if v.Index > 0 || other.Index > 0 {
+		switch {
+		case v.Index > other.Index:
+			return After
+		case v.Index < other.Index:
+			return Before
+		}
+	}
+	return v.Clock.Compare(other.Clock)
+}
+
+// merge returns a version that descends from both v and other
+func (v Version) merge(other Version) Version {
+	merged := Version{Index: v.Index, Clock: v.Clock.Merge(other.Clock), Timestamp: v.Timestamp}
+	if other.Index > merged.Index {
+		merged.Index = other.Index
+	}
+	if other.Timestamp > merged.Timestamp {
+		merged.Timestamp = other.Timestamp
+	}
+	return merged
+}
+
+// VersionedValue is a value together with the version that wrote it
+type VersionedValue struct {
+	Value   string  `json:"value"`
+	Version Version `json:"version"`
+}
+
+// ConflictPolicy decides what a node does with concurrent writes to a key
+type ConflictPolicy int
+
+const (
+	// LastWriteWins keeps the value with the latest timestamp
+	LastWriteWins ConflictPolicy = iota
+	// KeepSiblings keeps every concurrent value for the caller to resolve;
+	// the latest is served until then
+	KeepSiblings
+)
+
+// lastWriteWins picks the later of two concurrent values, breaking timestamp
+// ties by value so every replica picks the same one
+func lastWriteWins(a, b VersionedValue) VersionedValue {
+	if b.Version.Timestamp > a.Version.Timestamp ||
+		(b.Version.Timestamp == a.Version.Timestamp && b.Value > a.Value) {
+		return b
+	}
+	return a
+}
+
+// newLocalVersionLocked versions a write made on this node, descending from
+// the current value and all its siblings; callers hold the mutex
+func (n *Node) newLocalVersionLocked(key string) Version {
+	clock := n.Versions[key].Clock
+	for _, sibling := range n.Conflicts[key] {
+		clock = clock.Merge(sibling.Version.Clock)
+	}
+	return Version{Clock: clock.Increment(n.ID), Timestamp: time.Now().UnixNano()}
+}
+
+// mergeVersion stores a value written elsewhere if it is newer than the
+// node's copy, resolving concurrent writes by the node's ConflictPolicy. It
+// reports whether the node's copy changed.
+func (n *Node) mergeVersion(key string, incoming VersionedValue) (bool, error) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	value, ok := n.Data[key]
+	if !ok {
+		return true, n.storeLocked(key, incoming)
+	}
+	current := VersionedValue{Value: value, Version: n.Versions[key]}
+
+	switch incoming.Version.Compare(current.Version) {
+	case After:
+		// The current version descends from every sibling, so this supersedes them
+		delete(n.Conflicts, key)
+		return true, n.storeLocked(key, incoming)
+	case Before, Equal:
+		return false, nil
+	}
+
+	// Concurrent: the stored version descends from both so neither write
+	// is lost or replayed
+	winner := lastWriteWins(current, incoming)
+	resolved := VersionedValue{Value: winner.Value, Version: current.Version.merge(incoming.Version)}
+	if n.ConflictPolicy == KeepSiblings {
+		siblings := n.Conflicts[key]
+		if len(siblings) == 0 {
+			siblings = []VersionedValue{current}
+		}
+		n.Conflicts[key] = append(siblings, incoming)
+		logger.Warn("Node holds conflicting values", "node", n.ID, "key", key, "values", len(n.Conflicts[key]))
+	}
+	if err := n.storeLocked(key, resolved); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Siblings returns the concurrent values the node holds for key under
+// KeepSiblings, or nil if there is no conflict. Writing the key again
+// resolves the conflict.
+func (n *Node) Siblings(key string) []VersionedValue {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	return append([]VersionedValue(nil), n.Conflicts[key]...)
+}
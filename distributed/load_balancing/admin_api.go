@@ -0,0 +1,139 @@
+package load_balancing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"pkg/httpjson"
+	"strings"
+)
+
+// nodeAdmin is the runtime management surface shared by both balancers
+type nodeAdmin interface {
+	Snapshot() []NodeSnapshot
+	RemoveNode(nodeID string) error
+	DrainNode(nodeID string) error
+	UndrainNode(nodeID string) error
+	IsDrained(nodeID string) (bool, error)
+	SetNodeWeight(nodeID string, weight float64) error
+}
+
+// addNodeRequest is the body of POST /admin/nodes
+type addNodeRequest struct {
+	Address       string  `json:"address"`
+	MaxLoad       int     `json:"max_load"`
+	BandwidthMbps float64 `json:"bandwidth_mbps"`
+	CPUCores      float64 `json:"cpu_cores"`
+}
+
+// AdminHandler exposes runtime management of the query nodes, see adminHandler
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	return adminHandler(lb, func(req addNodeRequest) {
+		lb.AddNode(req.Address)
+	})
+}
+
+// AdminHandler exposes runtime management of the crawler nodes, see adminHandler.
+// Nodes added with a bandwidth or CPU count are weighted by that capacity.
+func (lb *CrawlerLoadBalancer) AdminHandler() http.Handler {
+	return adminHandler(lb, func(req addNodeRequest) {
+		if req.BandwidthMbps > 0 || req.CPUCores > 0 {
+			lb.AddWeightedNode(req.Address, NodeCapacity{BandwidthMbps: req.BandwidthMbps, CPUCores: req.CPUCores})
+			return
+		}
+		maxLoad := req.MaxLoad
+		if maxLoad <= 0 {
+			lb.mutex.Lock()
+			maxLoad = lb.baseMaxLoad
+			lb.mutex.Unlock()
+		}
+		lb.AddNode(req.Address, maxLoad)
+	})
+}
+
+// adminHandler serves
+//
+//	GET    /admin/nodes               node snapshots
+//	POST   /admin/nodes               add a node
+//	DELETE /admin/nodes/{id}          remove a node
+//	GET    /admin/nodes/{id}/drain    drain progress
+//	POST   /admin/nodes/{id}/drain    start draining
+//	DELETE /admin/nodes/{id}/drain    return to rotation
+//	PUT    /admin/nodes/{id}/weight   set the node's weight
+func adminHandler(a nodeAdmin, add func(addNodeRequest)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/nodes", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpjson.Write(w, http.StatusOK, a.Snapshot())
+		case http.MethodPost:
+			var req addNodeRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Address == "" {
+				http.Error(w, "missing node address", http.StatusBadRequest)
+				return
+			}
+			add(req)
+			httpjson.Write(w, http.StatusCreated, a.Snapshot())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/admin/nodes/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/nodes/"), "/")
+		nodeID := parts[0]
+		if nodeID == "" || len(parts) > 2 {
+			http.NotFound(w, r)
+			return
+		}
+
+		var action string
+		if len(parts) == 2 {
+			action = parts[1]
+		}
+		switch {
+		case action == "" && r.Method == http.MethodDelete:
+			writeAdminResult(w, a.RemoveNode(nodeID))
+		case action == "drain" && r.Method == http.MethodGet:
+			drained, err := a.IsDrained(nodeID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, map[string]bool{"drained": drained})
+		case action == "drain" && r.Method == http.MethodPost:
+			writeAdminResult(w, a.DrainNode(nodeID))
+		case action == "drain" && r.Method == http.MethodDelete:
+			writeAdminResult(w, a.UndrainNode(nodeID))
+		case action == "weight" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+			var req struct {
+				Weight float64 `json:"weight"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeAdminResult(w, a.SetNodeWeight(nodeID, req.Weight))
+		case action == "" || action == "drain" || action == "weight":
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return mux
+}
+
+// writeAdminResult answers an admin action with 204, or the error that stopped it
+func writeAdminResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrNodeNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
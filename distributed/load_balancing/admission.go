@@ -0,0 +1,293 @@
+package load_balancing
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRateLimited is returned when a client or the cluster exceeds its query rate
+	ErrRateLimited = errors.New("query rate limit exceeded")
+	// ErrOverloaded is returned when every backend node is above the load threshold
+	ErrOverloaded = errors.New("all nodes overloaded")
+)
+
+// tokenBucket is a token bucket refilled continuously at rate tokens per second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill tops up the bucket for the time elapsed since the last call
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait returns how long until a token becomes available
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// AdmissionController enforces a global and a per-client query rate
+type AdmissionController struct {
+	global      *tokenBucket
+	clients     map[string]*tokenBucket
+	clientRate  float64
+	clientBurst int
+	mutex       sync.Mutex
+}
+
+// NewAdmissionController creates an admission controller. Rates are in
+// queries per second; a rate of zero disables that limit.
+func NewAdmissionController(globalRate float64, globalBurst int, clientRate float64, clientBurst int) *AdmissionController {
+	ac := &AdmissionController{
+		clients:     make(map[string]*tokenBucket),
+		clientRate:  clientRate,
+		clientBurst: clientBurst,
+	}
+	if globalRate > 0 {
+		ac.global = newTokenBucket(globalRate, globalBurst)
+	}
+	return ac
+}
+
+// Admit takes a token for the client from both the client and global buckets.
+// When the query is rejected it returns how long the client should back off.
+func (ac *AdmissionController) Admit(clientID string) (bool, time.Duration) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	now := time.Now()
+	var client *tokenBucket
+	if ac.clientRate > 0 {
+		client = ac.clients[clientID]
+		if client == nil {
+			client = newTokenBucket(ac.clientRate, ac.clientBurst)
+			ac.clients[clientID] = client
+		}
+		client.refill(now)
+		if client.tokens < 1 {
+			return false, client.wait()
+		}
+	}
+	if ac.global != nil {
+		ac.global.refill(now)
+		if ac.global.tokens < 1 {
+			return false, ac.global.wait()
+		}
+		ac.global.tokens--
+	}
+	if client != nil {
+		client.tokens--
+	}
+	return true, 0
+}
+
+// PruneIdleClients drops buckets of clients that have been idle long enough to be full again
+func (ac *AdmissionController) PruneIdleClients() {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	now := time.Now()
+	for id, bucket := range ac.clients {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(ac.clients, id)
+		}
+	}
+}
+
+// SetAdmissionController enables rate limiting of incoming queries
+func (lb *LoadBalancer) SetAdmissionController(ac *AdmissionController) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.admission = ac
+}
+
+// SetShedRetryAfter sets the back-off advertised to clients when load is shed
+func (lb *LoadBalancer) SetShedRetryAfter(d time.Duration) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.shedRetryAfter = d
+}
+
+// PriorityAuthorizer reports whether the caller of a request may choose
+// the priority class of its queries
+type PriorityAuthorizer func(r *http.Request) bool
+
+// SetTrustedCallers lets callers any of authorizers accept choose their
+// priority class with the X-Query-Priority header. Queries of other callers
+// are batch, whatever they ask for.
+func (lb *LoadBalancer) SetTrustedCallers(authorizers ...PriorityAuthorizer) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.trusted = authorizers
+}
+
+// InternalNetworks trusts callers whose address is in one of the CIDR
+// ranges, such as the cluster's own network
+func InternalNetworks(cidrs ...string) (PriorityAuthorizer, error) {
+	prefixes := make([]netip.Prefix, len(cidrs))
+	for i, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", cidr, err)
+		}
+		prefixes[i] = prefix
+	}
+	return func(r *http.Request) bool {
+		addr, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil {
+			return false
+		}
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr.Addr().Unmap()) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// BearerTokens trusts callers presenting one of the tokens in their
+// Authorization header
+func BearerTokens(tokens ...string) PriorityAuthorizer {
+	return func(r *http.Request) bool {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return false
+		}
+		for _, token := range tokens {
+			if token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// priority returns the priority class of a request's query: the one its
+// X-Query-Priority header asks for if the caller is trusted, otherwise
+// batch, the lowest
+func (lb *LoadBalancer) priority(r *http.Request) (Priority, error) {
+	priority, err := ParsePriority(r.Header.Get("X-Query-Priority"))
+	if err != nil {
+		return priority, err
+	}
+	lb.mutex.Lock()
+	trusted := lb.trusted
+	lb.mutex.Unlock()
+	for _, authorized := range trusted {
+		if authorized(r) {
+			return priority, nil
+		}
+	}
+	return PriorityBatch, nil
+}
+
+// Overloaded reports whether every active node has more queries in flight
+// than the load threshold
+func (lb *LoadBalancer) Overloaded() bool {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	active := 0
+	for _, node := range lb.nodes {
+		if !node.available() {
+			continue
+		}
+		active++
+		if node.Load() <= lb.threshold {
+			return false
+		}
+	}
+	return active > 0
+}
+
+// Admit applies rate limiting and load shedding to a query from clientID.
+// It returns ErrRateLimited or ErrOverloaded along with a suggested back-off.
+func (lb *LoadBalancer) Admit(clientID string) (time.Duration, error) {
+	lb.mutex.Lock()
+	ac := lb.admission
+	retryAfter := lb.shedRetryAfter
+	lb.mutex.Unlock()
+
+	if ac != nil {
+		if ok, wait := ac.Admit(clientID); !ok {
+			return wait, ErrRateLimited
+		}
+	}
+	if lb.Overloaded() {
+		return retryAfter, ErrOverloaded
+	}
+	return 0, nil
+}
+
+// ServeHTTP accepts queries from clients on ?query= and forwards them to a node,
+// answering 429 with Retry-After when the query is rate limited or load is shed.
+// Only trusted callers choose their priority; see SetTrustedCallers.
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("query")
+	if query == "" {
+		http.Error(w, "missing query", http.StatusBadRequest)
+		return
+	}
+
+	priority, err := lb.priority(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if wait, err := lb.Admit(clientID(r)); err != nil {
+		seconds := int(math.Ceil(wait.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	if err := lb.BalanceLoadWithPriority(r.Context(), query, priority); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// clientID identifies the caller by its X-Client-ID header or remote IP
+func clientID(r *http.Request) string {
+	if id := r.Header.Get("X-Client-ID"); id != "" {
+		return id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,91 @@
+package load_balancing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// NodeCapacity describes the resources of a crawler node
+type NodeCapacity struct {
+	BandwidthMbps float64
+	CPUCores      float64
+}
+
+// ReferenceCapacity is the capacity that corresponds to a weight of 1
+var ReferenceCapacity = NodeCapacity{BandwidthMbps: 100, CPUCores: 2}
+
+// Weight returns the node's capacity relative to ReferenceCapacity. The
+// scarcer resource decides, since a crawl is bound by whichever runs out first.
+// Unset resources are ignored; a capacity with none set has weight 1.
+func (c NodeCapacity) Weight() float64 {
+	weight := math.Inf(1)
+	if c.BandwidthMbps > 0 {
+		weight = math.Min(weight, c.BandwidthMbps/ReferenceCapacity.BandwidthMbps)
+	}
+	if c.CPUCores > 0 {
+		weight = math.Min(weight, c.CPUCores/ReferenceCapacity.CPUCores)
+	}
+	if math.IsInf(weight, 1) {
+		return 1
+	}
+	return weight
+}
+
+// scaledMaxLoad returns the MaxLoad of a node with the given weight
+func (lb *CrawlerLoadBalancer) scaledMaxLoad(weight float64) int {
+	maxLoad := int(math.Round(float64(lb.baseMaxLoad) * weight))
+	if maxLoad < 1 {
+		maxLoad = 1
+	}
+	return maxLoad
+}
+
+// AddWeightedNode adds a crawler node whose share of tasks and MaxLoad scale
+// with its capacity
+func (lb *CrawlerLoadBalancer) AddWeightedNode(address string, capacity NodeCapacity) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	weight := capacity.Weight()
+	lb.nextID++
+	node := newCrawlerNode(fmt.Sprintf("crawler-node-%d", lb.nextID), address, lb.scaledMaxLoad(weight), weight)
+	node.AddedAt = time.Now()
+	lb.nodes = append(lb.nodes, node)
+	lb.metrics.SetActiveNodes(lb.activeNodes())
+	logger.Info("Added crawler node", "node", node.ID, "weight", weight)
+}
+
+// SetNodeCapacity updates the capacity of an existing crawler node
+func (lb *CrawlerLoadBalancer) SetNodeCapacity(nodeID string, capacity NodeCapacity) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	for _, node := range lb.nodes {
+		if node.ID == nodeID {
+			node.Weight = capacity.Weight()
+			node.MaxLoad = lb.scaledMaxLoad(node.Weight)
+			return nil
+		}
+	}
+	return ErrNodeNotFound
+}
+
+// SetNodeWeight sets the relative capacity of a crawler node directly,
+// scaling its MaxLoad to match
+func (lb *CrawlerLoadBalancer) SetNodeWeight(nodeID string, weight float64) error {
+	if weight <= 0 {
+		return errors.New("weight must be positive")
+	}
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	node := lb.findNode(nodeID)
+	if node == nil {
+		return ErrNodeNotFound
+	}
+	node.Weight = weight
+	node.MaxLoad = lb.scaledMaxLoad(weight)
+	return nil
+}
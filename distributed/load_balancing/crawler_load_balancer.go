@@ -1,27 +1,59 @@
 package load_balancing
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
+	"pkg/balancer"
 	"sync"
 	"time"
 )
 
-// CrawlerNode represents a single crawler node
+// CrawlerNode represents a single crawler node. Its health and count of
+// assigned tasks are atomic; the other mutable fields are guarded by the
+// mutex of the balancer owning the node.
 type CrawlerNode struct {
+	nodeState
 	ID       string
 	Address  string
-	IsActive bool
-	Load     int
 	MaxLoad  int
+	Weight   float64 // Relative capacity, 1 for a reference node
+	Draining bool
+	Zone     string
+	AddedAt  time.Time // Start of the node's slow-start ramp, zero for initial nodes
+	Info     NodeInfo
+	latency  LatencyStats
+}
+
+// newCrawlerNode creates an active crawler node
+func newCrawlerNode(id, address string, maxLoad int, weight float64) *CrawlerNode {
+	node := &CrawlerNode{
+		ID:      id,
+		Address: address,
+		MaxLoad: maxLoad,
+		Weight:  weight,
+	}
+	node.setActive(true)
+	return node
 }
 
 // CrawlerLoadBalancer manages load distribution among crawler nodes
 type CrawlerLoadBalancer struct {
-	nodes []*CrawlerNode
-	mutex sync.Mutex
+	nodes       []*CrawlerNode
+	mutex       sync.Mutex
+	nextID      int
+	baseMaxLoad int    // MaxLoad of a node with weight 1
+	zone        string // Zone of the balancer, empty disables zone preference
+	slowStart   time.Duration
+	protocol    Protocol
+	grpcPool    *grpcPool
+	metrics     Metrics
+	maxRetries  int
+	pending     *taskQueue
+	maintenance maintenanceSchedule
 }
 
 // NewCrawlerLoadBalancer initializes a CrawlerLoadBalancer with the given nodes
@@ -31,94 +63,140 @@ func NewCrawlerLoadBalancer(nodeAddresses []string, maxLoad int) (*CrawlerLoadBa
 	}
 	nodes := make([]*CrawlerNode, len(nodeAddresses))
 	for i, addr := range nodeAddresses {
-		nodes[i] = &CrawlerNode{
-			ID:       fmt.Sprintf("crawler-node-%d", i+1),
-			Address:  addr,
-			IsActive: true,
-			Load:     0,
-			MaxLoad:  maxLoad,
-		}
+		nodes[i] = newCrawlerNode(fmt.Sprintf("crawler-node-%d", i+1), addr, maxLoad, 1)
 	}
 	return &CrawlerLoadBalancer{
-		nodes: nodes,
+		nodes:       nodes,
+		nextID:      len(nodes),
+		baseMaxLoad: maxLoad,
+		protocol:    ProtocolHTTP,
+		metrics:     noopMetrics{},
+		pending:     newTaskQueue(DefaultPendingTasks, nil),
 	}, nil
 }
 
 // SelectNode selects the least loaded active node to handle the next crawl task
 func (lb *CrawlerLoadBalancer) SelectNode() (*CrawlerNode, error) {
+	return lb.SelectNodeFor("")
+}
+
+// SelectNodeFor selects the active node supporting the feature with the lowest
+// load relative to its capacity weight, so tasks spread in proportion to capacity.
+// Nodes in the balancer's own zone are preferred, and nodes still in their
+// slow-start window count as more loaded than they are.
+func (lb *CrawlerLoadBalancer) SelectNodeFor(feature string) (*CrawlerNode, error) {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
 
-	var selectedNode *CrawlerNode
-	minLoad := int(^uint(0) >> 1) // Max int value
+	start := time.Now()
+	defer func() { lb.metrics.ObserveSelection(time.Since(start)) }()
 
-	for _, node := range lb.nodes {
-		if node.IsActive && node.Load < minLoad {
-			selectedNode = node
-			minLoad = node.Load
+	selector := balancer.Selector{Zone: lb.zone}
+	for i, node := range lb.nodes {
+		if !node.IsActive() || node.Draining || !node.Info.Supports(feature) {
+			continue
 		}
+		ramp := balancer.SlowStartFactor(node.AddedAt, start, lb.slowStart)
+		selector.Offer(i, node.Zone, balancer.Score(node.Load(), node.Weight, ramp))
 	}
 
-	if selectedNode == nil {
+	i, ok := selector.Best()
+	if !ok {
 		return nil, errors.New("no active nodes available")
 	}
 
-	return selectedNode, nil
+	return lb.nodes[i], nil
 }
 
-// AssignCrawlTask assigns a crawl task to the least loaded node
-func (lb *CrawlerLoadBalancer) AssignCrawlTask(url string) error {
-	node, err := lb.SelectNode()
-	if err != nil {
-		return err
+// AssignCrawlTask assigns a crawl task to the least loaded node. The task is
+// abandoned when ctx is cancelled or its deadline passes.
+func (lb *CrawlerLoadBalancer) AssignCrawlTask(ctx context.Context, url string) error {
+	return lb.AssignCrawlTaskFor(ctx, url, "")
+}
+
+// AssignCrawlTaskFor assigns a crawl task that requires the given protocol
+// feature, skipping nodes whose reported metadata doesn't advertise it. A failed
+// node is marked inactive and the task retried on another one up to maxRetries times.
+// When every node is at MaxLoad the task waits in the pending queue instead.
+func (lb *CrawlerLoadBalancer) AssignCrawlTaskFor(ctx context.Context, url, feature string) error {
+	lb.mutex.Lock()
+	metrics, maxRetries := lb.metrics, lb.maxRetries
+	lb.mutex.Unlock()
+
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			metrics.ObserveRetry()
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var node *CrawlerNode
+		node, err = lb.reserveNode(feature)
+		if err == ErrNodesSaturated {
+			return lb.enqueueTask(url, feature)
+		}
+		if err != nil {
+			return err
+		}
+
+		metrics.ObserveRequest(node.ID)
+		sent := time.Now()
+		err = lb.forwardCrawlTask(ctx, node, url)
+		if err == nil {
+			lb.observeLatency(node, time.Since(sent))
+			return nil
+		}
+
+		lb.releaseNode(node)
+		metrics.ObserveFailure(node.ID)
+		// A cancelled caller says nothing about the node's health
+		if ctx.Err() != nil {
+			return err
+		}
+		lb.MarkNodeInactive(node)
 	}
+	return err
+}
 
-	err = lb.forwardCrawlTaskToNode(node, url)
+// forwardCrawlTaskToNode forwards the crawl task to the selected node
+func (lb *CrawlerLoadBalancer) forwardCrawlTaskToNode(ctx context.Context, node *CrawlerNode, url string) error {
+	body, err := json.Marshal(map[string]string{"url": url})
 	if err != nil {
-		lb.MarkNodeInactive(node)
 		return err
 	}
 
-	node.Load++
-	if node.Load >= node.MaxLoad {
-		go lb.redistributeLoad(node)
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s/crawl", node.Address), bytes.NewReader(body))
+	if err != nil {
+		return errors.New("failed to create request")
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	return nil
-}
-
-// forwardCrawlTaskToNode forwards the crawl task to the selected node
-func (lb *CrawlerLoadBalancer) forwardCrawlTaskToNode(node *CrawlerNode, url string) error {
-	resp, err := http.Post(fmt.Sprintf("http://%s/crawl", node.Address), "application/json", nil)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.New("failed to forward crawl task to node")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
 		return errors.New("failed to forward crawl task to node")
 	}
-	fmt.Printf("Crawl task for %s sent to node %s\n", url, node.ID)
+	requestLogger.Debug("Crawl task sent to node", "url", url, "node", node.ID)
 	return nil
 }
 
 // MarkNodeInactive marks a node as inactive due to errors
 func (lb *CrawlerLoadBalancer) MarkNodeInactive(node *CrawlerNode) {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-	node.IsActive = false
-	fmt.Printf("Crawler node %s marked inactive\n", node.ID)
-}
-
-// redistributeLoad redistributes the load from an overloaded or failed node
-func (lb *CrawlerLoadBalancer) redistributeLoad(overloadedNode *CrawlerNode) {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-
-	fmt.Printf("Redistributing load from crawler node %s\n", overloadedNode.ID)
-	overloadedNode.Load = 0 // Reset load of the overloaded node
-
-	for _, node := range lb.nodes {
-		if node.IsActive && node != overloadedNode && node.Load < node.MaxLoad {
-			node.Load++
-			fmt.Printf("Redistributed task to node %s\n", node.ID)
-		}
+	if !node.setActive(false) {
+		return
 	}
+	lb.mutex.Lock()
+	lb.metrics.SetActiveNodes(lb.activeNodes())
+	lb.mutex.Unlock()
+	logger.Warn("Crawler node marked inactive", "node", node.ID)
 }
 
 // MonitorNodes periodically checks the health of the crawler nodes
@@ -126,8 +204,12 @@ func (lb *CrawlerLoadBalancer) MonitorNodes(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		for _, node := range lb.nodes {
+	for now := range ticker.C {
+		lb.applyMaintenance(now)
+		lb.mutex.Lock()
+		nodes := append([]*CrawlerNode(nil), lb.nodes...)
+		lb.mutex.Unlock()
+		for _, node := range nodes {
 			go lb.checkNodeHealth(node)
 		}
 	}
@@ -135,12 +217,29 @@ func (lb *CrawlerLoadBalancer) MonitorNodes(interval time.Duration) {
 
 // checkNodeHealth checks the health of a single crawler node
 func (lb *CrawlerLoadBalancer) checkNodeHealth(node *CrawlerNode) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/health", node.Address))
-	if err != nil || resp.StatusCode != http.StatusOK {
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s/health", node.Address))
+	if err != nil {
 		lb.MarkNodeInactive(node)
-	} else {
-		node.IsActive = true
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		lb.MarkNodeInactive(node)
+		return
+	}
+
+	info, err := fetchNodeInfo(node.Address)
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	node.setActive(true)
+	if err == nil {
+		node.Info = info
+		if info.Zone != "" {
+			node.Zone = info.Zone
+		}
 	}
+	lb.metrics.SetActiveNodes(lb.activeNodes())
+	go lb.dispatchPending()
 }
 
 // AddNode adds a new crawler node to the load balancer
@@ -148,15 +247,12 @@ func (lb *CrawlerLoadBalancer) AddNode(address string, maxLoad int) {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
 
-	newNode := &CrawlerNode{
-		ID:       fmt.Sprintf("crawler-node-%d", len(lb.nodes)+1),
-		Address:  address,
-		IsActive: true,
-		Load:     0,
-		MaxLoad:  maxLoad,
-	}
-	lb.nodes = append(lb.nodes, newNode)
-	fmt.Printf("Added new crawler node: %s\n", newNode.ID)
+	lb.nextID++
+	node := newCrawlerNode(fmt.Sprintf("crawler-node-%d", lb.nextID), address, maxLoad, 1)
+	node.AddedAt = time.Now()
+	lb.nodes = append(lb.nodes, node)
+	lb.metrics.SetActiveNodes(lb.activeNodes())
+	logger.Info("Added crawler node", "node", node.ID)
 }
 
 // RemoveNode removes a crawler node from the load balancer
@@ -167,43 +263,31 @@ func (lb *CrawlerLoadBalancer) RemoveNode(nodeID string) error {
 	for i, node := range lb.nodes {
 		if node.ID == nodeID {
 			lb.nodes = append(lb.nodes[:i], lb.nodes[i+1:]...)
-			fmt.Printf("Removed crawler node: %s\n", nodeID)
+			lb.metrics.SetActiveNodes(lb.activeNodes())
+			if lb.grpcPool != nil {
+				lb.grpcPool.remove(node.Address)
+			}
+			logger.Info("Removed crawler node", "node", nodeID)
 			return nil
 		}
 	}
-	return errors.New("node not found")
-}
-
-// RandomizeLoad simulates random load assignment to nodes
-func (lb *CrawlerLoadBalancer) RandomizeLoad() {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-
-	for _, node := range lb.nodes {
-		node.Load = rand.Intn(node.MaxLoad)
-	}
+	return ErrNodeNotFound
 }
 
-// NodeCount returns the number of active nodes
+// NodeCount returns the number of active nodes that aren't draining
 func (lb *CrawlerLoadBalancer) NodeCount() int {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
+	return lb.activeNodes()
+}
 
+// activeNodes counts the active nodes; callers hold the mutex
+func (lb *CrawlerLoadBalancer) activeNodes() int {
 	count := 0
 	for _, node := range lb.nodes {
-		if node.IsActive {
+		if node.IsActive() && !node.Draining {
 			count++
 		}
 	}
 	return count
 }
-
-// ResetLoad resets the load of all crawler nodes
-func (lb *CrawlerLoadBalancer) ResetLoad() {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-
-	for _, node := range lb.nodes {
-		node.Load = 0
-	}
-}
@@ -0,0 +1,303 @@
+package load_balancing
+
+import (
+	"errors"
+	"time"
+)
+
+// MaintenanceWindow is a period during which a node is drained automatically
+type MaintenanceWindow struct {
+	NodeID string    `json:"node_id"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// maintenanceSchedule holds upcoming windows and the nodes in one now, with
+// whether the window drained the node. Nodes drained already, or drained or
+// undrained by hand during the window, are left as they are when it ends.
+type maintenanceSchedule struct {
+	windows []MaintenanceWindow
+	drained map[string]bool
+}
+
+// add schedules a window; callers hold the balancer mutex
+func (s *maintenanceSchedule) add(window MaintenanceWindow) error {
+	if !window.End.After(window.Start) {
+		return errors.New("maintenance window must end after it starts")
+	}
+	s.windows = append(s.windows, window)
+	return nil
+}
+
+// due drops expired windows and returns the nodes to drain as their window
+// starts at now, those draining reports as drained already aside, and the
+// nodes to undrain as the window that drained them ends; callers hold the
+// balancer mutex
+func (s *maintenanceSchedule) due(now time.Time, draining func(nodeID string) bool) (enter, leave []string) {
+	inWindow := make(map[string]bool)
+	remaining := s.windows[:0]
+	for _, window := range s.windows {
+		if !now.Before(window.End) {
+			continue
+		}
+		remaining = append(remaining, window)
+		if !now.Before(window.Start) {
+			inWindow[window.NodeID] = true
+		}
+	}
+	s.windows = remaining
+
+	if s.drained == nil {
+		s.drained = make(map[string]bool)
+	}
+	for nodeID := range inWindow {
+		if _, ok := s.drained[nodeID]; !ok {
+			s.drained[nodeID] = !draining(nodeID)
+			if s.drained[nodeID] {
+				enter = append(enter, nodeID)
+			}
+		}
+	}
+	for nodeID, applied := range s.drained {
+		if !inWindow[nodeID] {
+			delete(s.drained, nodeID)
+			if applied {
+				leave = append(leave, nodeID)
+			}
+		}
+	}
+	return enter, leave
+}
+
+// disown leaves a node drained or undrained by hand as it is when its
+// window ends; callers hold the balancer mutex
+func (s *maintenanceSchedule) disown(nodeID string) {
+	if _, ok := s.drained[nodeID]; ok {
+		s.drained[nodeID] = false
+	}
+}
+
+// list returns a copy of the scheduled windows
+func (s *maintenanceSchedule) list() []MaintenanceWindow {
+	return append([]MaintenanceWindow(nil), s.windows...)
+}
+
+// findNode returns the query node with the given ID; callers hold the mutex
+func (lb *LoadBalancer) findNode(nodeID string) *Node {
+	for _, node := range lb.nodes {
+		if node.ID == nodeID {
+			return node
+		}
+	}
+	return nil
+}
+
+// setDraining flips the drain flag of a query node. Unless scheduled, the
+// change is by hand and outlasts any maintenance window.
+func (lb *LoadBalancer) setDraining(nodeID string, draining, scheduled bool) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	node := lb.findNode(nodeID)
+	if node == nil {
+		return ErrNodeNotFound
+	}
+	node.Draining = draining
+	if !scheduled {
+		lb.maintenance.disown(nodeID)
+	}
+	lb.metrics.SetActiveNodes(lb.activeNodes())
+	return nil
+}
+
+// isDraining reports whether a query node is draining; callers hold the mutex
+func (lb *LoadBalancer) isDraining(nodeID string) bool {
+	node := lb.findNode(nodeID)
+	return node != nil && node.Draining
+}
+
+// DrainNode stops sending new queries to a node while the ones already
+// forwarded to it complete
+func (lb *LoadBalancer) DrainNode(nodeID string) error {
+	if err := lb.setDraining(nodeID, true, false); err != nil {
+		return err
+	}
+	logger.Info("Draining node", "node", nodeID)
+	return nil
+}
+
+// UndrainNode returns a drained node to rotation
+func (lb *LoadBalancer) UndrainNode(nodeID string) error {
+	if err := lb.setDraining(nodeID, false, false); err != nil {
+		return err
+	}
+	logger.Info("Node back in rotation", "node", nodeID)
+	return nil
+}
+
+// IsDrained reports whether a draining node has no queries in flight and can
+// safely be taken down
+func (lb *LoadBalancer) IsDrained(nodeID string) (bool, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	node := lb.findNode(nodeID)
+	if node == nil {
+		return false, ErrNodeNotFound
+	}
+	return node.Draining && node.Load() == 0, nil
+}
+
+// ScheduleMaintenance drains a node between start and end. The window is
+// applied by MonitorNodes on each health check tick.
+func (lb *LoadBalancer) ScheduleMaintenance(nodeID string, start, end time.Time) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if lb.findNode(nodeID) == nil {
+		return ErrNodeNotFound
+	}
+	return lb.maintenance.add(MaintenanceWindow{NodeID: nodeID, Start: start, End: end})
+}
+
+// MaintenanceWindows returns the scheduled maintenance windows of the query nodes
+func (lb *LoadBalancer) MaintenanceWindows() []MaintenanceWindow {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.maintenance.list()
+}
+
+// applyMaintenance drains nodes whose window has started and undrains those
+// the window drained once it has ended
+func (lb *LoadBalancer) applyMaintenance(now time.Time) {
+	lb.mutex.Lock()
+	enter, leave := lb.maintenance.due(now, lb.isDraining)
+	lb.mutex.Unlock()
+
+	for _, nodeID := range enter {
+		if err := lb.setDraining(nodeID, true, true); err != nil {
+			logger.Error("Failed to start maintenance of node", "node", nodeID, "error", err)
+			continue
+		}
+		logger.Info("Draining node for maintenance", "node", nodeID)
+	}
+	for _, nodeID := range leave {
+		if err := lb.setDraining(nodeID, false, true); err != nil {
+			logger.Error("Failed to end maintenance of node", "node", nodeID, "error", err)
+			continue
+		}
+		logger.Info("Node back in rotation after maintenance", "node", nodeID)
+	}
+}
+
+// findNode returns the crawler node with the given ID; callers hold the mutex
+func (lb *CrawlerLoadBalancer) findNode(nodeID string) *CrawlerNode {
+	for _, node := range lb.nodes {
+		if node.ID == nodeID {
+			return node
+		}
+	}
+	return nil
+}
+
+// setDraining flips the drain flag of a crawler node. Unless scheduled, the
+// change is by hand and outlasts any maintenance window.
+func (lb *CrawlerLoadBalancer) setDraining(nodeID string, draining, scheduled bool) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	node := lb.findNode(nodeID)
+	if node == nil {
+		return ErrNodeNotFound
+	}
+	node.Draining = draining
+	if !scheduled {
+		lb.maintenance.disown(nodeID)
+	}
+	lb.metrics.SetActiveNodes(lb.activeNodes())
+	return nil
+}
+
+// isDraining reports whether a crawler node is draining; callers hold the
+// mutex
+func (lb *CrawlerLoadBalancer) isDraining(nodeID string) bool {
+	node := lb.findNode(nodeID)
+	return node != nil && node.Draining
+}
+
+// DrainNode stops assigning new crawl tasks to a node while the ones it
+// already holds complete
+func (lb *CrawlerLoadBalancer) DrainNode(nodeID string) error {
+	if err := lb.setDraining(nodeID, true, false); err != nil {
+		return err
+	}
+	logger.Info("Draining crawler node", "node", nodeID)
+	return nil
+}
+
+// UndrainNode returns a drained crawler node to rotation and hands it any
+// tasks that queued up meanwhile
+func (lb *CrawlerLoadBalancer) UndrainNode(nodeID string) error {
+	if err := lb.setDraining(nodeID, false, false); err != nil {
+		return err
+	}
+	logger.Info("Crawler node back in rotation", "node", nodeID)
+	go lb.dispatchPending()
+	return nil
+}
+
+// IsDrained reports whether a draining crawler node has completed all its
+// tasks and can safely be taken down
+func (lb *CrawlerLoadBalancer) IsDrained(nodeID string) (bool, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	node := lb.findNode(nodeID)
+	if node == nil {
+		return false, ErrNodeNotFound
+	}
+	return node.Draining && node.Load() == 0, nil
+}
+
+// ScheduleMaintenance drains a crawler node between start and end. The window
+// is applied by MonitorNodes on each health check tick.
+func (lb *CrawlerLoadBalancer) ScheduleMaintenance(nodeID string, start, end time.Time) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if lb.findNode(nodeID) == nil {
+		return ErrNodeNotFound
+	}
+	return lb.maintenance.add(MaintenanceWindow{NodeID: nodeID, Start: start, End: end})
+}
+
+// MaintenanceWindows returns the scheduled maintenance windows of the crawler nodes
+func (lb *CrawlerLoadBalancer) MaintenanceWindows() []MaintenanceWindow {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.maintenance.list()
+}
+
+// applyMaintenance drains crawler nodes whose window has started and
+// undrains those the window drained once it has ended
+func (lb *CrawlerLoadBalancer) applyMaintenance(now time.Time) {
+	lb.mutex.Lock()
+	enter, leave := lb.maintenance.due(now, lb.isDraining)
+	lb.mutex.Unlock()
+
+	for _, nodeID := range enter {
+		if err := lb.setDraining(nodeID, true, true); err != nil {
+			logger.Error("Failed to start maintenance of crawler node", "node", nodeID, "error", err)
+			continue
+		}
+		logger.Info("Draining crawler node for maintenance", "node", nodeID)
+	}
+	for _, nodeID := range leave {
+		if err := lb.setDraining(nodeID, false, true); err != nil {
+			logger.Error("Failed to end maintenance of crawler node", "node", nodeID, "error", err)
+			continue
+		}
+		logger.Info("Crawler node back in rotation after maintenance", "node", nodeID)
+		go lb.dispatchPending()
+	}
+}
@@ -0,0 +1,295 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: forwarding.proto
+
+// Messages and services the load balancers use when forwarding over gRPC.
+// The Go code in forwardingpb is generated from this file by go generate;
+// rerun it after changing the file.
+
+package forwardingpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type QueryRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Query         string                 `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *QueryRequest) Reset() {
+	*x = QueryRequest{}
+	mi := &file_forwarding_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QueryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryRequest) ProtoMessage() {}
+
+func (x *QueryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_forwarding_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryRequest.ProtoReflect.Descriptor instead.
+func (*QueryRequest) Descriptor() ([]byte, []int) {
+	return file_forwarding_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *QueryRequest) GetQuery() string {
+	if x != nil {
+		return x.Query
+	}
+	return ""
+}
+
+type QueryResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Accepted      bool                   `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *QueryResponse) Reset() {
+	*x = QueryResponse{}
+	mi := &file_forwarding_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QueryResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryResponse) ProtoMessage() {}
+
+func (x *QueryResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_forwarding_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryResponse.ProtoReflect.Descriptor instead.
+func (*QueryResponse) Descriptor() ([]byte, []int) {
+	return file_forwarding_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *QueryResponse) GetAccepted() bool {
+	if x != nil {
+		return x.Accepted
+	}
+	return false
+}
+
+func (x *QueryResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+type CrawlTaskRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Url           string                 `protobuf:"bytes,1,opt,name=url,proto3" json:"url,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CrawlTaskRequest) Reset() {
+	*x = CrawlTaskRequest{}
+	mi := &file_forwarding_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CrawlTaskRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CrawlTaskRequest) ProtoMessage() {}
+
+func (x *CrawlTaskRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_forwarding_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CrawlTaskRequest.ProtoReflect.Descriptor instead.
+func (*CrawlTaskRequest) Descriptor() ([]byte, []int) {
+	return file_forwarding_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *CrawlTaskRequest) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+type CrawlTaskResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Accepted      bool                   `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CrawlTaskResponse) Reset() {
+	*x = CrawlTaskResponse{}
+	mi := &file_forwarding_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CrawlTaskResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CrawlTaskResponse) ProtoMessage() {}
+
+func (x *CrawlTaskResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_forwarding_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CrawlTaskResponse.ProtoReflect.Descriptor instead.
+func (*CrawlTaskResponse) Descriptor() ([]byte, []int) {
+	return file_forwarding_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CrawlTaskResponse) GetAccepted() bool {
+	if x != nil {
+		return x.Accepted
+	}
+	return false
+}
+
+func (x *CrawlTaskResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+var File_forwarding_proto protoreflect.FileDescriptor
+
+const file_forwarding_proto_rawDesc = "" +
+	"\n" +
+	"\x10forwarding.proto\x12\x15searchengine.balancer\"$\n" +
+	"\fQueryRequest\x12\x14\n" +
+	"\x05query\x18\x01 \x01(\tR\x05query\"E\n" +
+	"\rQueryResponse\x12\x1a\n" +
+	"\baccepted\x18\x01 \x01(\bR\baccepted\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\"$\n" +
+	"\x10CrawlTaskRequest\x12\x10\n" +
+	"\x03url\x18\x01 \x01(\tR\x03url\"I\n" +
+	"\x11CrawlTaskResponse\x12\x1a\n" +
+	"\baccepted\x18\x01 \x01(\bR\baccepted\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage2b\n" +
+	"\fQueryService\x12R\n" +
+	"\x05Query\x12#.searchengine.balancer.QueryRequest\x1a$.searchengine.balancer.QueryResponse2o\n" +
+	"\fCrawlService\x12_\n" +
+	"\n" +
+	"AssignTask\x12'.searchengine.balancer.CrawlTaskRequest\x1a(.searchengine.balancer.CrawlTaskResponseBF\n" +
+	"\x19com.searchengine.balancerP\x01Z'distributed/load_balancing/forwardingpbb\x06proto3"
+
+var (
+	file_forwarding_proto_rawDescOnce sync.Once
+	file_forwarding_proto_rawDescData []byte
+)
+
+func file_forwarding_proto_rawDescGZIP() []byte {
+	file_forwarding_proto_rawDescOnce.Do(func() {
+		file_forwarding_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_forwarding_proto_rawDesc), len(file_forwarding_proto_rawDesc)))
+	})
+	return file_forwarding_proto_rawDescData
+}
+
+var file_forwarding_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_forwarding_proto_goTypes = []any{
+	(*QueryRequest)(nil),      // 0: searchengine.balancer.QueryRequest
+	(*QueryResponse)(nil),     // 1: searchengine.balancer.QueryResponse
+	(*CrawlTaskRequest)(nil),  // 2: searchengine.balancer.CrawlTaskRequest
+	(*CrawlTaskResponse)(nil), // 3: searchengine.balancer.CrawlTaskResponse
+}
+var file_forwarding_proto_depIdxs = []int32{
+	0, // 0: searchengine.balancer.QueryService.Query:input_type -> searchengine.balancer.QueryRequest
+	2, // 1: searchengine.balancer.CrawlService.AssignTask:input_type -> searchengine.balancer.CrawlTaskRequest
+	1, // 2: searchengine.balancer.QueryService.Query:output_type -> searchengine.balancer.QueryResponse
+	3, // 3: searchengine.balancer.CrawlService.AssignTask:output_type -> searchengine.balancer.CrawlTaskResponse
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_forwarding_proto_init() }
+func file_forwarding_proto_init() {
+	if File_forwarding_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_forwarding_proto_rawDesc), len(file_forwarding_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   2,
+		},
+		GoTypes:           file_forwarding_proto_goTypes,
+		DependencyIndexes: file_forwarding_proto_depIdxs,
+		MessageInfos:      file_forwarding_proto_msgTypes,
+	}.Build()
+	File_forwarding_proto = out.File
+	file_forwarding_proto_goTypes = nil
+	file_forwarding_proto_depIdxs = nil
+}
@@ -0,0 +1,214 @@
+package load_balancing
+
+//go:generate protoc --go_out=. --go_opt=module=distributed/load_balancing --go-grpc_out=. --go-grpc_opt=module=distributed/load_balancing forwarding.proto
+
+import (
+	"context"
+	"distributed/load_balancing/forwardingpb"
+	"errors"
+	"fmt"
+	"monitoring/tracing"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Protocol is the transport used to forward work to backend nodes
+type Protocol string
+
+const (
+	ProtocolHTTP Protocol = "http"
+	ProtocolGRPC Protocol = "grpc"
+)
+
+// defaultCallTimeout bounds a forwarded call when the caller set no deadline
+const defaultCallTimeout = 5 * time.Second
+
+// grpcPool keeps a fixed number of client connections per node address and
+// hands them out round-robin. Connections are created without waiting for
+// the node: each connects in the background, and again after it fails, so
+// a connection handed out may not be ready yet.
+type grpcPool struct {
+	size  int
+	conns map[string][]*grpc.ClientConn
+	next  map[string]int
+	mutex sync.Mutex
+}
+
+func newGRPCPool(size int) *grpcPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &grpcPool{
+		size:  size,
+		conns: make(map[string][]*grpc.ClientConn),
+		next:  make(map[string]int),
+	}
+}
+
+// get returns a pooled connection to address, creating the pool on first
+// use. Connections that failed to connect are passed over while another is
+// usable; calls on one still connecting wait for it. When every connection
+// has failed, the next is returned anyway and the call fails fast.
+func (p *grpcPool) get(address string) (*grpc.ClientConn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	conns, ok := p.conns[address]
+	if !ok {
+		for i := 0; i < p.size; i++ {
+			conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()), tracing.DialOption())
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return nil, err
+			}
+			// Clients stay idle until their first call; start connecting now
+			// so the pool is open by the time calls arrive
+			conn.Connect()
+			conns = append(conns, conn)
+		}
+		p.conns[address] = conns
+	}
+
+	start := p.next[address]
+	for n := 0; n < len(conns); n++ {
+		i := (start + n) % len(conns)
+		if conns[i].GetState() != connectivity.TransientFailure {
+			p.next[address] = (i + 1) % len(conns)
+			return conns[i], nil
+		}
+	}
+	p.next[address] = (start + 1) % len(conns)
+	return conns[start], nil
+}
+
+// remove closes and forgets the connections to address
+func (p *grpcPool) remove(address string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, conn := range p.conns[address] {
+		conn.Close()
+	}
+	delete(p.conns, address)
+	delete(p.next, address)
+}
+
+// Close closes every pooled connection
+func (p *grpcPool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for address, conns := range p.conns {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(p.conns, address)
+	}
+	p.next = make(map[string]int)
+}
+
+// invoke runs a unary call on a pooled connection to address, bounding it
+// by defaultCallTimeout when the caller's context carries no deadline of
+// its own
+func (p *grpcPool) invoke(ctx context.Context, address string, call func(ctx context.Context, conn *grpc.ClientConn) error) error {
+	conn, err := p.get(address)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultCallTimeout)
+		defer cancel()
+	}
+	return call(ctx, conn)
+}
+
+// SetForwardingProtocol selects HTTP or gRPC for forwarding queries. For gRPC,
+// poolSize connections are kept open to each node, opened in the background
+// on the first query forwarded to it.
+func (lb *LoadBalancer) SetForwardingProtocol(protocol Protocol, poolSize int) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if lb.grpcPool != nil {
+		lb.grpcPool.Close()
+		lb.grpcPool = nil
+	}
+	lb.protocol = protocol
+	if protocol == ProtocolGRPC {
+		lb.grpcPool = newGRPCPool(poolSize)
+	}
+}
+
+// forwardQuery sends the query to the node over the configured protocol
+func (lb *LoadBalancer) forwardQuery(ctx context.Context, node *Node, query string) error {
+	lb.mutex.Lock()
+	pool := lb.grpcPool
+	lb.mutex.Unlock()
+
+	if pool == nil {
+		return lb.forwardQueryToNode(ctx, node, query)
+	}
+
+	var resp *forwardingpb.QueryResponse
+	err := pool.invoke(ctx, node.Address, func(ctx context.Context, conn *grpc.ClientConn) (err error) {
+		resp, err = forwardingpb.NewQueryServiceClient(conn).Query(ctx, &forwardingpb.QueryRequest{Query: query})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to forward query to node: %w", err)
+	}
+	if !resp.GetAccepted() {
+		return errors.New("query rejected by node: " + resp.GetMessage())
+	}
+	requestLogger.Debug("Query sent to node over gRPC", "query", query, "node", node.ID)
+	return nil
+}
+
+// SetForwardingProtocol selects HTTP or gRPC for forwarding crawl tasks. For
+// gRPC, poolSize connections are kept open to each node, opened in the
+// background on the first task forwarded to it.
+func (lb *CrawlerLoadBalancer) SetForwardingProtocol(protocol Protocol, poolSize int) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if lb.grpcPool != nil {
+		lb.grpcPool.Close()
+		lb.grpcPool = nil
+	}
+	lb.protocol = protocol
+	if protocol == ProtocolGRPC {
+		lb.grpcPool = newGRPCPool(poolSize)
+	}
+}
+
+// forwardCrawlTask sends the crawl task to the node over the configured protocol
+func (lb *CrawlerLoadBalancer) forwardCrawlTask(ctx context.Context, node *CrawlerNode, url string) error {
+	lb.mutex.Lock()
+	pool := lb.grpcPool
+	lb.mutex.Unlock()
+
+	if pool == nil {
+		return lb.forwardCrawlTaskToNode(ctx, node, url)
+	}
+
+	var resp *forwardingpb.CrawlTaskResponse
+	err := pool.invoke(ctx, node.Address, func(ctx context.Context, conn *grpc.ClientConn) (err error) {
+		resp, err = forwardingpb.NewCrawlServiceClient(conn).AssignTask(ctx, &forwardingpb.CrawlTaskRequest{Url: url})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to forward crawl task to node: %w", err)
+	}
+	if !resp.GetAccepted() {
+		return errors.New("crawl task rejected by node: " + resp.GetMessage())
+	}
+	requestLogger.Debug("Crawl task sent to node over gRPC", "url", url, "node", node.ID)
+	return nil
+}
@@ -0,0 +1,195 @@
+package load_balancing_test
+
+import (
+	"context"
+	"distributed/load_balancing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// These tests exercise the balancers from many goroutines at once and are
+// meant to be run with the race detector enabled (go test -race).
+
+// newBackend starts a fake node answering queries, crawl tasks, health checks
+// and metadata requests. Requests block until release is closed, if given.
+func newBackend(release <-chan struct{}) (*httptest.Server, string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if release != nil && (r.URL.Path == "/query" || r.URL.Path == "/crawl") {
+			<-release
+		}
+		if r.URL.Path == "/info" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"version":"test","features":["query","crawl"]}`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return server, strings.TrimPrefix(server.URL, "http://")
+}
+
+// totalLoad sums the in-flight requests of every node in a snapshot
+func totalLoad(snapshot []load_balancing.NodeSnapshot) int {
+	total := 0
+	for _, node := range snapshot {
+		total += node.Load
+	}
+	return total
+}
+
+// Test that concurrent queries, health checks and membership changes don't race
+// and that every query's load is released once it completes
+func TestQueryLoadBalancerConcurrentAccess(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		server, address := newBackend(nil)
+		defer server.Close()
+		addresses = append(addresses, address)
+	}
+
+	lb, err := load_balancing.NewLoadBalancer(addresses, 10)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	go lb.MonitorNodes(20 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := lb.BalanceLoad(context.Background(), "race query"); err != nil {
+					t.Errorf("BalanceLoad failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			lb.DrainNode("node-1")
+			lb.Snapshot()
+			lb.UndrainNode("node-1")
+			lb.SetNodeWeight("node-2", float64(i%3+1))
+			lb.Overloaded()
+			lb.NodeCount()
+		}
+	}()
+	wg.Wait()
+
+	if load := totalLoad(lb.Snapshot()); load != 0 {
+		t.Errorf("Expected no queries in flight after completion, got %d", load)
+	}
+}
+
+// Test that a node's load counts the queries it is handling and drops as they finish
+func TestQueryLoadBalancerInFlightCount(t *testing.T) {
+	release := make(chan struct{})
+	server, address := newBackend(release)
+	defer server.Close()
+
+	lb, err := load_balancing.NewLoadBalancer([]string{address}, 10)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	const queries = 5
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lb.BalanceLoad(context.Background(), "slow query")
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for totalLoad(lb.Snapshot()) != queries {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d queries in flight, got %d", queries, totalLoad(lb.Snapshot()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if drained, _ := lb.IsDrained("node-1"); drained {
+		t.Errorf("Node with queries in flight reported as drained")
+	}
+
+	lb.DrainNode("node-1")
+	close(release)
+	wg.Wait()
+
+	if load := totalLoad(lb.Snapshot()); load != 0 {
+		t.Errorf("Expected no queries in flight after completion, got %d", load)
+	}
+	if drained, _ := lb.IsDrained("node-1"); !drained {
+		t.Errorf("Expected idle draining node to be drained")
+	}
+}
+
+// Test that concurrent task assignment and completion keep the crawler nodes'
+// load consistent with the tasks they still hold
+func TestCrawlerLoadBalancerConcurrentAccess(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		server, address := newBackend(nil)
+		defer server.Close()
+		addresses = append(addresses, address)
+	}
+
+	lb, err := load_balancing.NewCrawlerLoadBalancer(addresses, 1000)
+	if err != nil {
+		t.Fatalf("Failed to create crawler load balancer: %v", err)
+	}
+	go lb.MonitorNodes(20 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := lb.AssignCrawlTask(context.Background(), "https://example.com"); err != nil {
+					t.Errorf("AssignCrawlTask failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			lb.DrainNode("crawler-node-3")
+			lb.Snapshot()
+			lb.UndrainNode("crawler-node-3")
+			lb.SetNodeWeight("crawler-node-2", float64(i%3+1))
+			lb.NodeCount()
+		}
+		lb.AddNode(addresses[0], 1000)
+	}()
+	wg.Wait()
+
+	assigned := totalLoad(lb.Snapshot())
+	if assigned != 30*20 {
+		t.Errorf("Expected %d tasks held by crawler nodes, got %d", 30*20, assigned)
+	}
+
+	for _, node := range lb.Snapshot() {
+		for i := 0; i < node.Load; i++ {
+			if err := lb.CompleteCrawlTask(node.ID); err != nil {
+				t.Fatalf("CompleteCrawlTask failed: %v", err)
+			}
+		}
+	}
+	if load := totalLoad(lb.Snapshot()); load != 0 {
+		t.Errorf("Expected no tasks held after completion, got %d", load)
+	}
+}
@@ -0,0 +1,186 @@
+package load_balancing
+
+import (
+	"monitoring/metrics"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics receives the balancers' instrumentation events. Inject an
+// implementation with SetMetrics; balancers default to discarding them.
+type Metrics interface {
+	ObserveRequest(node string)
+	ObserveFailure(node string)
+	ObserveRetry()
+	SetActiveNodes(count int)
+	ObserveSelection(latency time.Duration)
+	ObserveLoad(node string, load int)
+	ObserveCrossZone(fromZone, toZone string)
+	ObserveEjection(node string)
+	ObserveMirror(primaryLatency, shadowLatency time.Duration, diverged bool)
+}
+
+// noopMetrics discards all events
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveRequest(string)                            {}
+func (noopMetrics) ObserveFailure(string)                            {}
+func (noopMetrics) ObserveRetry()                                    {}
+func (noopMetrics) SetActiveNodes(int)                               {}
+func (noopMetrics) ObserveSelection(time.Duration)                   {}
+func (noopMetrics) ObserveLoad(string, int)                          {}
+func (noopMetrics) ObserveCrossZone(string, string)                  {}
+func (noopMetrics) ObserveEjection(string)                           {}
+func (noopMetrics) ObserveMirror(time.Duration, time.Duration, bool) {}
+
+// PrometheusMetrics exports balancer events as Prometheus metrics, labelled
+// with the balancer name so both balancers can share a registry
+type PrometheusMetrics struct {
+	requests    *prometheus.CounterVec
+	failures    *prometheus.CounterVec
+	retries     prometheus.Counter
+	activeNodes prometheus.Gauge
+	selection   prometheus.Histogram
+	load        *prometheus.HistogramVec
+	crossZone   *prometheus.CounterVec
+	ejections   *prometheus.CounterVec
+	mirrored    *prometheus.HistogramVec
+	divergences prometheus.Counter
+}
+
+// NewPrometheusMetrics creates the balancer metrics and registers them with
+// reg. A nil reg uses metrics.Default, the registry metrics.Serve serves.
+func NewPrometheusMetrics(reg prometheus.Registerer, balancer string) *PrometheusMetrics {
+	if reg == nil {
+		reg = metrics.Default
+	}
+	labels := prometheus.Labels{"balancer": balancer}
+
+	m := &PrometheusMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "load_balancer_requests_total",
+			Help:        "Requests forwarded to each backend node",
+			ConstLabels: labels,
+		}, []string{"node"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "load_balancer_failures_total",
+			Help:        "Failed forwards to each backend node",
+			ConstLabels: labels,
+		}, []string{"node"}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "load_balancer_retries_total",
+			Help:        "Requests retried on another node after a failure",
+			ConstLabels: labels,
+		}),
+		activeNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "load_balancer_active_nodes",
+			Help:        "Number of backend nodes currently eligible for work",
+			ConstLabels: labels,
+		}),
+		selection: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "load_balancer_selection_seconds",
+			Help:        "Time spent selecting a backend node",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.00001, 4, 8),
+		}),
+		load: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "load_balancer_node_load",
+			Help:        "Load of a backend node when it is assigned work",
+			ConstLabels: labels,
+			Buckets:     prometheus.LinearBuckets(0, 5, 20),
+		}, []string{"node"}),
+		crossZone: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "load_balancer_cross_zone_requests_total",
+			Help:        "Requests forwarded to a node outside the balancer's zone",
+			ConstLabels: labels,
+		}, []string{"from_zone", "to_zone"}),
+		ejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "load_balancer_outlier_ejections_total",
+			Help:        "Times a backend node was ejected as an outlier",
+			ConstLabels: labels,
+		}, []string{"node"}),
+		mirrored: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "load_balancer_mirrored_query_seconds",
+			Help:        "Latency of mirrored queries in the primary and shadow pools",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"pool"}),
+		divergences: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "load_balancer_mirror_divergences_total",
+			Help:        "Mirrored queries answered by only one of the primary and shadow pools",
+			ConstLabels: labels,
+		}),
+	}
+	reg.MustRegister(m.requests, m.failures, m.retries, m.activeNodes, m.selection, m.load, m.crossZone, m.ejections,
+		m.mirrored, m.divergences)
+	return m
+}
+
+func (m *PrometheusMetrics) ObserveRequest(node string) {
+	m.requests.WithLabelValues(node).Inc()
+}
+
+func (m *PrometheusMetrics) ObserveFailure(node string) {
+	m.failures.WithLabelValues(node).Inc()
+}
+
+func (m *PrometheusMetrics) ObserveRetry() {
+	m.retries.Inc()
+}
+
+func (m *PrometheusMetrics) SetActiveNodes(count int) {
+	m.activeNodes.Set(float64(count))
+}
+
+func (m *PrometheusMetrics) ObserveSelection(latency time.Duration) {
+	m.selection.Observe(latency.Seconds())
+}
+
+func (m *PrometheusMetrics) ObserveLoad(node string, load int) {
+	m.load.WithLabelValues(node).Observe(float64(load))
+}
+
+func (m *PrometheusMetrics) ObserveCrossZone(fromZone, toZone string) {
+	m.crossZone.WithLabelValues(fromZone, toZone).Inc()
+}
+
+func (m *PrometheusMetrics) ObserveEjection(node string) {
+	m.ejections.WithLabelValues(node).Inc()
+}
+
+func (m *PrometheusMetrics) ObserveMirror(primaryLatency, shadowLatency time.Duration, diverged bool) {
+	m.mirrored.WithLabelValues("primary").Observe(primaryLatency.Seconds())
+	m.mirrored.WithLabelValues("shadow").Observe(shadowLatency.Seconds())
+	if diverged {
+		m.divergences.Inc()
+	}
+}
+
+// SetMetrics injects the metrics sink of the query load balancer
+func (lb *LoadBalancer) SetMetrics(m Metrics) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.metrics = m
+}
+
+// SetMetrics injects the metrics sink of the crawler load balancer
+func (lb *CrawlerLoadBalancer) SetMetrics(m Metrics) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.metrics = m
+}
+
+// SetMaxRetries sets how many other nodes a failed query is retried on
+func (lb *LoadBalancer) SetMaxRetries(retries int) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.maxRetries = retries
+}
+
+// SetMaxRetries sets how many other nodes a failed crawl task is retried on
+func (lb *CrawlerLoadBalancer) SetMaxRetries(retries int) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.maxRetries = retries
+}
@@ -0,0 +1,137 @@
+package load_balancing
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ShadowConfig controls query mirroring to a shadow pool
+type ShadowConfig struct {
+	Percent     float64       // Share of queries mirrored, 0-100
+	Timeout     time.Duration // Deadline of a mirrored query
+	MaxInFlight int           // Mirrored queries beyond this are dropped
+}
+
+// ShadowReport compares the primary pool with the shadow pool over the
+// mirrored queries
+type ShadowReport struct {
+	Mirrored       int64         `json:"mirrored"`
+	Dropped        int64         `json:"dropped"`
+	PrimaryErrors  int64         `json:"primary_errors"`
+	ShadowErrors   int64         `json:"shadow_errors"`
+	Divergences    int64         `json:"divergences"` // Queries only one pool answered
+	PrimaryLatency time.Duration `json:"primary_latency_ns"`
+	ShadowLatency  time.Duration `json:"shadow_latency_ns"`
+}
+
+// shadowMirror sends sampled queries to a shadow balancer and compares results.
+// Shadow responses are discarded and never affect the caller.
+type shadowMirror struct {
+	primary      *LoadBalancer
+	shadow       *LoadBalancer
+	config       ShadowConfig
+	slots        chan struct{}
+	report       ShadowReport
+	primaryTotal time.Duration // Total latencies, for the means
+	shadowTotal  time.Duration
+	mutex        sync.Mutex
+}
+
+// SetShadowPool mirrors config.Percent of queries to the nodes of shadow, so
+// a new ranking or index build can be validated under real traffic. A nil
+// shadow stops mirroring.
+func (lb *LoadBalancer) SetShadowPool(shadow *LoadBalancer, config ShadowConfig) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if shadow == nil {
+		lb.mirror = nil
+		return
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultCallTimeout
+	}
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 64
+	}
+	lb.mirror = &shadowMirror{
+		primary: lb,
+		shadow:  shadow,
+		config:  config,
+		slots:   make(chan struct{}, config.MaxInFlight),
+	}
+}
+
+// ShadowReport returns the comparison of the primary and shadow pools since
+// mirroring was enabled
+func (lb *LoadBalancer) ShadowReport() (ShadowReport, error) {
+	lb.mutex.Lock()
+	mirror := lb.mirror
+	lb.mutex.Unlock()
+
+	if mirror == nil {
+		return ShadowReport{}, errors.New("no shadow pool configured")
+	}
+	mirror.mutex.Lock()
+	defer mirror.mutex.Unlock()
+	return mirror.report, nil
+}
+
+// sample decides whether a query is mirrored
+func (m *shadowMirror) sample() bool {
+	return rand.Float64()*100 < m.config.Percent
+}
+
+// send mirrors a query that the primary pool answered with primaryErr after
+// primaryLatency. It never blocks: when too many mirrored queries are in
+// flight the query is dropped.
+func (m *shadowMirror) send(query, feature string, primaryErr error, primaryLatency time.Duration) {
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.mutex.Lock()
+		m.report.Dropped++
+		m.mutex.Unlock()
+		return
+	}
+
+	go func() {
+		defer func() { <-m.slots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.config.Timeout)
+		defer cancel()
+		start := time.Now()
+		shadowErr := m.shadow.balanceLoadFor(ctx, query, feature)
+		m.record(primaryErr, primaryLatency, shadowErr, time.Since(start))
+	}()
+}
+
+// record adds one mirrored query to the comparison
+func (m *shadowMirror) record(primaryErr error, primaryLatency time.Duration, shadowErr error, shadowLatency time.Duration) {
+	diverged := (primaryErr == nil) != (shadowErr == nil)
+
+	m.mutex.Lock()
+	m.report.Mirrored++
+	if primaryErr != nil {
+		m.report.PrimaryErrors++
+	}
+	if shadowErr != nil {
+		m.report.ShadowErrors++
+	}
+	if diverged {
+		m.report.Divergences++
+	}
+	m.primaryTotal += primaryLatency
+	m.shadowTotal += shadowLatency
+	m.report.PrimaryLatency = m.primaryTotal / time.Duration(m.report.Mirrored)
+	m.report.ShadowLatency = m.shadowTotal / time.Duration(m.report.Mirrored)
+	m.mutex.Unlock()
+
+	m.primary.mutex.Lock()
+	metrics := m.primary.metrics
+	m.primary.mutex.Unlock()
+	metrics.ObserveMirror(primaryLatency, shadowLatency, diverged)
+}
@@ -0,0 +1,82 @@
+package load_balancing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// BuildVersion is the version of this binary, set at build time with
+// -ldflags "-X distributed/load_balancing.BuildVersion=v1.2.3"
+var BuildVersion = "dev"
+
+// Protocol features a node can advertise in its membership metadata
+const (
+	FeatureQuery      = "query"
+	FeatureCrawl      = "crawl"
+	FeatureBatchQuery = "batch-query"
+)
+
+// NodeInfo is the metadata a backend node self-reports to the balancers
+type NodeInfo struct {
+	Version  string   `json:"version"`
+	Features []string `json:"features"`
+	Plugins  []string `json:"plugins"`
+	Zone     string   `json:"zone,omitempty"`
+}
+
+// LocalNodeInfo builds the NodeInfo for the running binary
+func LocalNodeInfo(features, plugins []string) NodeInfo {
+	return NodeInfo{
+		Version:  BuildVersion,
+		Features: features,
+		Plugins:  plugins,
+	}
+}
+
+// Supports reports whether the node advertised the given feature.
+// An empty feature is supported by every node.
+func (info NodeInfo) Supports(feature string) bool {
+	if feature == "" {
+		return true
+	}
+	for _, f := range info.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// NodeInfoHandler serves the node's metadata on /info for the balancers to poll
+func NodeInfoHandler(info NodeInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	})
+}
+
+// probeClient is used for health and metadata checks, so a hung node can't
+// pile up checks from successive monitoring ticks
+var probeClient = &http.Client{Timeout: 5 * time.Second}
+
+// fetchNodeInfo retrieves the self-reported metadata of the node at address
+func fetchNodeInfo(address string) (NodeInfo, error) {
+	var info NodeInfo
+
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s/info", address))
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return info, errors.New("node info not available")
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return info, err
+	}
+	return info, nil
+}
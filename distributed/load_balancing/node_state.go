@@ -0,0 +1,42 @@
+package load_balancing
+
+import "sync/atomic"
+
+// nodeState is the part of a node's state that changes on every request and
+// health check. It is read and written without the balancer mutex, so all of
+// it is atomic; the rest of a node's fields are guarded by the balancer mutex.
+type nodeState struct {
+	active   atomic.Bool
+	inFlight atomic.Int64
+}
+
+// IsActive reports whether the node passed its last health check
+func (s *nodeState) IsActive() bool {
+	return s.active.Load()
+}
+
+// setActive records the node's health and reports whether it changed
+func (s *nodeState) setActive(active bool) bool {
+	return s.active.Swap(active) != active
+}
+
+// Load returns the number of requests the node is currently handling
+func (s *nodeState) Load() int {
+	return int(s.inFlight.Load())
+}
+
+// acquire counts a request sent to the node and returns the new load
+func (s *nodeState) acquire() int {
+	return int(s.inFlight.Add(1))
+}
+
+// release counts a request to the node as finished. The count never drops
+// below zero, so a stray release can't make a node look idler than it is.
+func (s *nodeState) release() {
+	for {
+		current := s.inFlight.Load()
+		if current <= 0 || s.inFlight.CompareAndSwap(current, current-1) {
+			return
+		}
+	}
+}
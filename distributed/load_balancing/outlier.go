@@ -0,0 +1,223 @@
+package load_balancing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// OutlierPolicy configures passive outlier detection on the query balancer.
+// Every Interval each node's error rate and mean latency over the interval is
+// compared with the fleet median; nodes deviating too far are ejected.
+type OutlierPolicy struct {
+	Interval           time.Duration
+	MinRequests        int           // Requests a node needs in an interval to be judged
+	ErrorRateThreshold float64       // Error rate above the median that ejects a node, e.g. 0.2
+	LatencyFactor      float64       // Multiple of the median latency that ejects a node, 0 disables
+	BaseEjection       time.Duration // First ejection time, doubled on each repeat ejection
+	MaxEjection        time.Duration
+	MaxEjectedPercent  int // Share of the fleet that may be ejected at once, at least one node unless 0
+}
+
+// DefaultOutlierPolicy ejects nodes failing 20% more queries than their peers
+// or answering three times slower, never more than a third of the fleet
+var DefaultOutlierPolicy = OutlierPolicy{
+	Interval:           10 * time.Second,
+	MinRequests:        20,
+	ErrorRateThreshold: 0.2,
+	LatencyFactor:      3,
+	BaseEjection:       30 * time.Second,
+	MaxEjection:        5 * time.Minute,
+	MaxEjectedPercent:  33,
+}
+
+// outlierStats is what a node did during the current detection interval
+type outlierStats struct {
+	requests int
+	failures int
+	latency  time.Duration // Total latency of successful queries
+}
+
+func (s outlierStats) errorRate() float64 {
+	return float64(s.failures) / float64(s.requests)
+}
+
+func (s outlierStats) meanLatency() time.Duration {
+	if succeeded := s.requests - s.failures; succeeded > 0 {
+		return s.latency / time.Duration(succeeded)
+	}
+	return 0
+}
+
+// outlierState tracks a node's ejection; guarded by the balancer mutex
+type outlierState struct {
+	stats        outlierStats
+	ejected      bool
+	ejectedUntil time.Time
+	ejections    int
+}
+
+// recordOutcome counts a finished query towards the node's interval stats.
+// Queries abandoned by the caller say nothing about the node and are skipped.
+func (s *outlierState) recordOutcome(err error, latency time.Duration) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	s.stats.requests++
+	if err != nil {
+		s.stats.failures++
+		return
+	}
+	s.stats.latency += latency
+}
+
+// median returns the middle of values, which must not be empty
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// DetectOutliers evaluates the nodes against policy every policy.Interval,
+// ejecting outliers and re-probing ejected nodes once their ejection expires
+func (lb *LoadBalancer) DetectOutliers(policy OutlierPolicy) {
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		lb.evaluateOutliers(policy, now)
+		lb.probeEjected(policy, now)
+	}
+}
+
+// evaluateOutliers ejects the nodes whose last interval deviates from the
+// fleet median and starts a new interval
+func (lb *LoadBalancer) evaluateOutliers(policy OutlierPolicy, now time.Time) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	var candidates []*Node
+	var errorRates, latencies []float64
+	ejected := 0
+	for _, node := range lb.nodes {
+		if node.outlier.ejected {
+			ejected++
+			continue
+		}
+		stats := node.outlier.stats
+		node.outlier.stats = outlierStats{}
+		if !node.IsActive() || stats.requests < policy.MinRequests {
+			continue
+		}
+		candidates = append(candidates, node)
+		errorRates = append(errorRates, stats.errorRate())
+		latencies = append(latencies, float64(stats.meanLatency()))
+	}
+	// Outliers only exist relative to a fleet
+	if len(candidates) < 3 {
+		return
+	}
+
+	medianErrors, medianLatency := median(errorRates), median(latencies)
+	maxEjected := len(lb.nodes) * policy.MaxEjectedPercent / 100
+	// A small fleet may still eject one node, or detection would never act
+	if maxEjected == 0 && policy.MaxEjectedPercent > 0 {
+		maxEjected = 1
+	}
+	for i, node := range candidates {
+		if ejected >= maxEjected {
+			logger.Warn("Outlier ejection limit reached, keeping remaining nodes in rotation")
+			return
+		}
+
+		var reason string
+		switch {
+		case errorRates[i]-medianErrors >= policy.ErrorRateThreshold:
+			reason = fmt.Sprintf("error rate %.2f vs median %.2f", errorRates[i], medianErrors)
+		case policy.LatencyFactor > 0 && medianLatency > 0 && latencies[i] > policy.LatencyFactor*medianLatency:
+			reason = fmt.Sprintf("latency %v vs median %v", time.Duration(latencies[i]), time.Duration(medianLatency))
+		default:
+			// A clean interval works off one past ejection
+			if node.outlier.ejections > 0 {
+				node.outlier.ejections--
+			}
+			continue
+		}
+		lb.ejectLocked(node, policy, now, reason)
+		ejected++
+	}
+}
+
+// ejectLocked takes a node out of rotation for an exponentially growing time;
+// callers hold the mutex
+func (lb *LoadBalancer) ejectLocked(node *Node, policy OutlierPolicy, now time.Time, reason string) {
+	duration := policy.BaseEjection << node.outlier.ejections
+	if duration > policy.MaxEjection || duration <= 0 {
+		duration = policy.MaxEjection
+	}
+	node.outlier.ejected = true
+	node.outlier.ejectedUntil = now.Add(duration)
+	node.outlier.ejections++
+	lb.metrics.ObserveEjection(node.ID)
+	lb.metrics.SetActiveNodes(lb.activeNodes())
+	logger.Warn("Ejected outlier node", "node", node.ID, "duration", duration, "reason", reason)
+}
+
+// probeEjected health checks the nodes whose ejection has expired, returning
+// healthy ones to rotation and ejecting the others again
+func (lb *LoadBalancer) probeEjected(policy OutlierPolicy, now time.Time) {
+	lb.mutex.Lock()
+	var expired []*Node
+	for _, node := range lb.nodes {
+		if node.outlier.ejected && !now.Before(node.outlier.ejectedUntil) {
+			expired = append(expired, node)
+		}
+	}
+	lb.mutex.Unlock()
+
+	for _, node := range expired {
+		healthy := probeNode(node.Address)
+
+		lb.mutex.Lock()
+		if healthy {
+			node.outlier.ejected = false
+			node.outlier.stats = outlierStats{}
+			lb.metrics.SetActiveNodes(lb.activeNodes())
+			logger.Info("Outlier node passed its probe, back in rotation", "node", node.ID)
+		} else {
+			lb.ejectLocked(node, policy, now, "failed probe")
+		}
+		lb.mutex.Unlock()
+	}
+}
+
+// probeNode reports whether the node at address answers its health check
+func probeNode(address string) bool {
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s/health", address))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// EjectedNodes returns the IDs of the nodes currently ejected as outliers
+func (lb *LoadBalancer) EjectedNodes() []string {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	var ejected []string
+	for _, node := range lb.nodes {
+		if node.outlier.ejected {
+			ejected = append(ejected, node.ID)
+		}
+	}
+	return ejected
+}
@@ -0,0 +1,203 @@
+package load_balancing
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Priority is the QoS class of a query
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota
+	PriorityInternal
+	PriorityBatch
+)
+
+// String returns the name of the priority class
+func (p Priority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityInternal:
+		return "internal"
+	case PriorityBatch:
+		return "batch"
+	}
+	return fmt.Sprintf("priority-%d", int(p))
+}
+
+// ParsePriority parses a priority class name, defaulting to interactive
+func ParsePriority(name string) (Priority, error) {
+	switch name {
+	case "", "interactive":
+		return PriorityInteractive, nil
+	case "internal":
+		return PriorityInternal, nil
+	case "batch":
+		return PriorityBatch, nil
+	}
+	return PriorityInteractive, fmt.Errorf("unknown priority class %q", name)
+}
+
+// DefaultPriorityWeights gives interactive queries most of the capacity while
+// guaranteeing batch work still makes progress
+var DefaultPriorityWeights = map[Priority]int{
+	PriorityInteractive: 8,
+	PriorityInternal:    4,
+	PriorityBatch:       1,
+}
+
+// waiter is a query queued for a dispatch slot
+type waiter struct {
+	finish float64
+	seq    uint64
+	index  int
+	ready  chan struct{}
+}
+
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].finish == h[j].finish {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].finish < h[j].finish
+}
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	w.index = -1
+	*h = old[:len(old)-1]
+	return w
+}
+
+// FairScheduler limits in-flight queries and hands out free slots using
+// weighted fair queuing across priority classes
+type FairScheduler struct {
+	weights     map[Priority]int
+	maxInFlight int
+	inFlight    int
+	virtualTime float64
+	lastFinish  map[Priority]float64
+	queue       waiterHeap
+	seq         uint64
+	mutex       sync.Mutex
+}
+
+// NewFairScheduler creates a scheduler allowing maxInFlight concurrent queries
+func NewFairScheduler(maxInFlight int, weights map[Priority]int) *FairScheduler {
+	if weights == nil {
+		weights = DefaultPriorityWeights
+	}
+	return &FairScheduler{
+		weights:     weights,
+		maxInFlight: maxInFlight,
+		lastFinish:  make(map[Priority]float64),
+	}
+}
+
+// Acquire blocks until a slot is granted to a query of the given class and
+// returns the function that releases it. It gives up when ctx is done.
+func (s *FairScheduler) Acquire(ctx context.Context, priority Priority) (func(), error) {
+	s.mutex.Lock()
+	if s.inFlight < s.maxInFlight && len(s.queue) == 0 {
+		s.inFlight++
+		s.mutex.Unlock()
+		return s.release, nil
+	}
+
+	weight := s.weights[priority]
+	if weight <= 0 {
+		weight = 1
+	}
+	start := s.virtualTime
+	if s.lastFinish[priority] > start {
+		start = s.lastFinish[priority]
+	}
+	w := &waiter{
+		finish: start + 1/float64(weight),
+		seq:    s.seq,
+		ready:  make(chan struct{}),
+	}
+	s.seq++
+	s.lastFinish[priority] = w.finish
+	heap.Push(&s.queue, w)
+	s.mutex.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.release, nil
+	case <-ctx.Done():
+		s.mutex.Lock()
+		granted := w.index < 0
+		if !granted {
+			heap.Remove(&s.queue, w.index)
+		}
+		s.mutex.Unlock()
+
+		// The slot may have been handed over while we were giving up; pass it on
+		if granted {
+			s.release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// release frees a slot and dispatches the queued query with the earliest finish tag
+func (s *FairScheduler) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.queue) == 0 {
+		s.inFlight--
+		return
+	}
+	w := heap.Pop(&s.queue).(*waiter)
+	s.virtualTime = w.finish
+	close(w.ready)
+}
+
+// Queued returns the number of queries waiting for a slot
+func (s *FairScheduler) Queued() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.queue)
+}
+
+// SetScheduler enables QoS scheduling of queries across priority classes
+func (lb *LoadBalancer) SetScheduler(s *FairScheduler) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.scheduler = s
+}
+
+// BalanceLoadWithPriority waits for the scheduler to admit the query in its
+// priority class and then forwards it
+func (lb *LoadBalancer) BalanceLoadWithPriority(ctx context.Context, query string, priority Priority) error {
+	lb.mutex.Lock()
+	s := lb.scheduler
+	lb.mutex.Unlock()
+
+	if s != nil {
+		release, err := s.Acquire(ctx, priority)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	return lb.BalanceLoad(ctx, query)
+}
@@ -1,27 +1,73 @@
 package load_balancing
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math/rand"
+	"monitoring/logging"
+	"monitoring/tracing"
 	"net/http"
+	"pkg/balancer"
 	"sync"
 	"time"
 )
 
-// Node represents a single query processing node
+// logger reports nodes joining, leaving and changing state. Requests are
+// logged with requestLogger at debug level, sampled as there is one a
+// request.
+var (
+	logger        = logging.Component("distributed/load_balancing")
+	requestLogger = logging.Sampled(logger, logging.DefaultSampling)
+)
+
+// ErrNodeNotFound is returned when a node ID doesn't belong to the balancer
+var ErrNodeNotFound = errors.New("node not found")
+
+// Node represents a single query processing node. Its health and in-flight
+// query count are atomic; the other mutable fields are guarded by the mutex
+// of the balancer owning the node.
 type Node struct {
+	nodeState
 	ID       string
 	Address  string
-	IsActive bool
-	Load     int
+	Weight   float64 // Relative capacity, 1 for a reference node
+	Draining bool
+	Zone     string
+	AddedAt  time.Time // Start of the node's slow-start ramp, zero for initial nodes
+	Info     NodeInfo
+	latency  LatencyStats
+	outlier  outlierState
+}
+
+// newNode creates an active query node of weight 1
+func newNode(id, address string) *Node {
+	node := &Node{
+		ID:      id,
+		Address: address,
+		Weight:  1,
+	}
+	node.setActive(true)
+	return node
 }
 
 // LoadBalancer distributes queries across multiple processing nodes
 type LoadBalancer struct {
-	nodes     []*Node
-	mutex     sync.Mutex
-	threshold int // Threshold to redistribute load
+	nodes          []*Node
+	mutex          sync.Mutex
+	nextID         int
+	threshold      int    // In-flight queries above which a node is overloaded
+	zone           string // Zone of the balancer, empty disables zone preference
+	slowStart      time.Duration
+	maintenance    maintenanceSchedule
+	admission      *AdmissionController
+	shedRetryAfter time.Duration
+	trusted        []PriorityAuthorizer // Callers allowed to raise their priority
+	scheduler      *FairScheduler
+	protocol       Protocol
+	grpcPool       *grpcPool
+	metrics        Metrics
+	maxRetries     int
+	mirror         *shadowMirror
 }
 
 // NewLoadBalancer initializes a LoadBalancer with given nodes
@@ -31,66 +77,153 @@ func NewLoadBalancer(nodeAddresses []string, threshold int) (*LoadBalancer, erro
 	}
 	nodes := make([]*Node, len(nodeAddresses))
 	for i, addr := range nodeAddresses {
-		nodes[i] = &Node{
-			ID:       fmt.Sprintf("node-%d", i+1),
-			Address:  addr,
-			IsActive: true,
-			Load:     0,
-		}
+		nodes[i] = newNode(fmt.Sprintf("node-%d", i+1), addr)
 	}
 	return &LoadBalancer{
-		nodes:     nodes,
-		threshold: threshold,
+		nodes:          nodes,
+		nextID:         len(nodes),
+		threshold:      threshold,
+		shedRetryAfter: time.Second,
+		protocol:       ProtocolHTTP,
+		metrics:        noopMetrics{},
 	}, nil
 }
 
 // SelectNode selects the least loaded active node to handle a query
 func (lb *LoadBalancer) SelectNode() (*Node, error) {
+	return lb.SelectNodeFor("")
+}
+
+// SelectNodeFor selects the least loaded active node that supports the feature,
+// preferring nodes in the balancer's own zone. Nodes still in their slow-start
+// window count as more loaded than they are.
+func (lb *LoadBalancer) SelectNodeFor(feature string) (*Node, error) {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
+	return lb.selectNodeLocked(feature)
+}
 
-	var selectedNode *Node
-	minLoad := int(^uint(0) >> 1) // Max int value
+// selectNodeLocked is SelectNodeFor for callers holding the mutex
+func (lb *LoadBalancer) selectNodeLocked(feature string) (*Node, error) {
+	start := time.Now()
+	defer func() { lb.metrics.ObserveSelection(time.Since(start)) }()
 
-	for _, node := range lb.nodes {
-		if node.IsActive && node.Load < minLoad {
-			selectedNode = node
-			minLoad = node.Load
+	selector := balancer.Selector{Zone: lb.zone}
+	for i, node := range lb.nodes {
+		if !node.available() || !node.Info.Supports(feature) {
+			continue
 		}
+		ramp := balancer.SlowStartFactor(node.AddedAt, start, lb.slowStart)
+		selector.Offer(i, node.Zone, balancer.Score(node.Load(), node.Weight, ramp))
 	}
 
-	if selectedNode == nil {
+	i, ok := selector.Best()
+	if !ok {
 		return nil, errors.New("no active nodes available")
 	}
 
-	return selectedNode, nil
+	return lb.nodes[i], nil
 }
 
-// BalanceLoad distributes the incoming query load across nodes
-func (lb *LoadBalancer) BalanceLoad(query string) error {
-	node, err := lb.SelectNode()
+// acquireNode selects the node for a query and counts the query against it
+// until releaseNode, so concurrent selections see each other's load
+func (lb *LoadBalancer) acquireNode(feature string) (*Node, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	node, err := lb.selectNodeLocked(feature)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	lb.metrics.ObserveLoad(node.ID, node.acquire())
+	observeCrossZone(lb.metrics, lb.zone, node.Zone)
+	return node, nil
+}
 
-	err = lb.forwardQueryToNode(node, query)
-	if err != nil {
-		lb.MarkNodeInactive(node)
-		return err
+// releaseNode counts a query to a node as finished, recording its outcome for
+// outlier detection and its latency if the node accepted it
+func (lb *LoadBalancer) releaseNode(node *Node, err error, latency time.Duration) {
+	node.release()
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	node.outlier.recordOutcome(err, latency)
+	if err == nil {
+		node.latency.observe(latency)
 	}
+}
+
+// BalanceLoad distributes the incoming query load across nodes. The query is
+// abandoned when ctx is cancelled or its deadline passes.
+func (lb *LoadBalancer) BalanceLoad(ctx context.Context, query string) error {
+	return lb.BalanceLoadFor(ctx, query, "")
+}
+
+// BalanceLoadFor distributes a query that requires the given protocol feature,
+// skipping nodes whose reported metadata doesn't advertise it. A failed node is
+// marked inactive and the query retried on another one up to maxRetries times,
+// falling back to other zones once no same-zone node is left. A sample of
+// queries is mirrored to the shadow pool, if one is set.
+func (lb *LoadBalancer) BalanceLoadFor(ctx context.Context, query, feature string) error {
+	lb.mutex.Lock()
+	mirror := lb.mirror
+	lb.mutex.Unlock()
 
-	node.Load++
-	if node.Load > lb.threshold {
-		go lb.redistributeLoad(node)
+	if mirror == nil || !mirror.sample() {
+		return lb.balanceLoadFor(ctx, query, feature)
 	}
+	start := time.Now()
+	err := lb.balanceLoadFor(ctx, query, feature)
+	mirror.send(query, feature, err, time.Since(start))
+	return err
+}
 
-	return nil
+// balanceLoadFor is BalanceLoadFor without mirroring
+func (lb *LoadBalancer) balanceLoadFor(ctx context.Context, query, feature string) error {
+	lb.mutex.Lock()
+	metrics, maxRetries := lb.metrics, lb.maxRetries
+	lb.mutex.Unlock()
+
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			metrics.ObserveRetry()
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var node *Node
+		node, err = lb.acquireNode(feature)
+		if err != nil {
+			return err
+		}
+
+		metrics.ObserveRequest(node.ID)
+		sent := time.Now()
+		err = lb.forwardQuery(ctx, node, query)
+		lb.releaseNode(node, err, time.Since(sent))
+		if err == nil {
+			return nil
+		}
+
+		metrics.ObserveFailure(node.ID)
+		// A cancelled caller says nothing about the node's health
+		if ctx.Err() != nil {
+			return err
+		}
+		lb.MarkNodeInactive(node)
+	}
+	return err
 }
 
+// forwardClient forwards queries, passing their trace on to the node
+var forwardClient = &http.Client{Transport: tracing.Transport(nil)}
+
 // forwardQueryToNode forwards the query to the selected node
-func (lb *LoadBalancer) forwardQueryToNode(node *Node, query string) error {
+func (lb *LoadBalancer) forwardQueryToNode(ctx context.Context, node *Node, query string) error {
 	url := fmt.Sprintf("http://%s/query", node.Address)
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
 	if err != nil {
 		return errors.New("failed to create request")
 	}
@@ -99,37 +232,37 @@ func (lb *LoadBalancer) forwardQueryToNode(node *Node, query string) error {
 	q.Add("query", query)
 	req.URL.RawQuery = q.Encode()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.New("failed to forward query to node")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
 		return errors.New("failed to forward query to node")
 	}
 
-	fmt.Printf("Query '%s' sent to node %s\n", query, node.ID)
+	requestLogger.Debug("Query sent to node", "query", query, "node", node.ID)
 	return nil
 }
 
-// MarkNodeInactive marks a node as inactive
-func (lb *LoadBalancer) MarkNodeInactive(node *Node) {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-	node.IsActive = false
-	fmt.Printf("Node %s marked inactive\n", node.ID)
+// available reports whether the node may receive new queries; callers hold
+// the balancer mutex
+func (node *Node) available() bool {
+	return node.IsActive() && !node.Draining && !node.outlier.ejected
 }
 
-// redistributeLoad redistributes the load of an overloaded node
-func (lb *LoadBalancer) redistributeLoad(overloadedNode *Node) {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-
-	overloadedNode.Load = 0 // Reset load of the overloaded node
-	fmt.Printf("Redistributing load from node %s\n", overloadedNode.ID)
-
-	for i := 0; i < len(lb.nodes); i++ {
-		if lb.nodes[i].IsActive && lb.nodes[i] != overloadedNode {
-			lb.nodes[i].Load--
-		}
+// MarkNodeInactive marks a node as inactive
+func (lb *LoadBalancer) MarkNodeInactive(node *Node) {
+	if !node.setActive(false) {
+		return
 	}
+	lb.mutex.Lock()
+	lb.metrics.SetActiveNodes(lb.activeNodes())
+	lb.mutex.Unlock()
+	logger.Warn("Node marked inactive", "node", node.ID)
 }
 
 // MonitorNodes checks the health of nodes periodically
@@ -137,8 +270,12 @@ func (lb *LoadBalancer) MonitorNodes(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		for _, node := range lb.nodes {
+	for now := range ticker.C {
+		lb.applyMaintenance(now)
+		lb.mutex.Lock()
+		nodes := append([]*Node(nil), lb.nodes...)
+		lb.mutex.Unlock()
+		for _, node := range nodes {
 			go lb.checkNodeHealth(node)
 		}
 	}
@@ -146,12 +283,28 @@ func (lb *LoadBalancer) MonitorNodes(interval time.Duration) {
 
 // checkNodeHealth pings the node to check its health status
 func (lb *LoadBalancer) checkNodeHealth(node *Node) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/health", node.Address))
-	if err != nil || resp.StatusCode != http.StatusOK {
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s/health", node.Address))
+	if err != nil {
+		lb.MarkNodeInactive(node)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
 		lb.MarkNodeInactive(node)
-	} else {
-		node.IsActive = true
+		return
+	}
+
+	info, err := fetchNodeInfo(node.Address)
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	node.setActive(true)
+	if err == nil {
+		node.Info = info
+		if info.Zone != "" {
+			node.Zone = info.Zone
+		}
 	}
+	lb.metrics.SetActiveNodes(lb.activeNodes())
 }
 
 // AddNode adds a new node to the load balancer
@@ -159,14 +312,29 @@ func (lb *LoadBalancer) AddNode(address string) {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
 
-	newNode := &Node{
-		ID:       fmt.Sprintf("node-%d", len(lb.nodes)+1),
-		Address:  address,
-		IsActive: true,
-		Load:     0,
+	lb.nextID++
+	node := newNode(fmt.Sprintf("node-%d", lb.nextID), address)
+	node.AddedAt = time.Now()
+	lb.nodes = append(lb.nodes, node)
+	lb.metrics.SetActiveNodes(lb.activeNodes())
+	logger.Info("Added node", "node", node.ID)
+}
+
+// SetNodeWeight sets the relative capacity of a node, giving it a share of
+// queries in proportion to its weight
+func (lb *LoadBalancer) SetNodeWeight(nodeID string, weight float64) error {
+	if weight <= 0 {
+		return errors.New("weight must be positive")
+	}
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	node := lb.findNode(nodeID)
+	if node == nil {
+		return ErrNodeNotFound
 	}
-	lb.nodes = append(lb.nodes, newNode)
-	fmt.Printf("Added new node: %s\n", newNode.ID)
+	node.Weight = weight
+	return nil
 }
 
 // RemoveNode removes a node from the load balancer
@@ -177,53 +345,41 @@ func (lb *LoadBalancer) RemoveNode(nodeID string) error {
 	for i, node := range lb.nodes {
 		if node.ID == nodeID {
 			lb.nodes = append(lb.nodes[:i], lb.nodes[i+1:]...)
-			fmt.Printf("Removed node: %s\n", nodeID)
+			lb.metrics.SetActiveNodes(lb.activeNodes())
+			if lb.grpcPool != nil {
+				lb.grpcPool.remove(node.Address)
+			}
+			logger.Info("Removed node", "node", nodeID)
 			return nil
 		}
 	}
-	return errors.New("node not found")
+	return ErrNodeNotFound
 }
 
-// RandomizeLoad simulates random load assignment to nodes
-func (lb *LoadBalancer) RandomizeLoad() {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-
-	for _, node := range lb.nodes {
-		node.Load = rand.Intn(lb.threshold)
-	}
-}
-
-// NodeCount returns the number of active nodes
+// NodeCount returns the number of active nodes that aren't draining or ejected
 func (lb *LoadBalancer) NodeCount() int {
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
+	return lb.activeNodes()
+}
 
+// activeNodes counts the active nodes; callers hold the mutex
+func (lb *LoadBalancer) activeNodes() int {
 	count := 0
 	for _, node := range lb.nodes {
-		if node.IsActive {
+		if node.available() {
 			count++
 		}
 	}
 	return count
 }
 
-// ResetLoad resets the load of all nodes
-func (lb *LoadBalancer) ResetLoad() {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-
-	for _, node := range lb.nodes {
-		node.Load = 0
-	}
-}
-
 func main() {
 	// Node addresses
 	nodeAddresses := []string{"127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003"}
 	lb, err := NewLoadBalancer(nodeAddresses, 10)
 	if err != nil {
-		fmt.Println("Error initializing load balancer:", err)
+		logger.Error("Failed to initialize load balancer", "error", err)
 		return
 	}
 
@@ -231,9 +387,9 @@ func main() {
 
 	queries := []string{"query1", "query2", "query3", "query4", "query5"}
 	for _, query := range queries {
-		err := lb.BalanceLoad(query)
+		err := lb.BalanceLoad(context.Background(), query)
 		if err != nil {
-			fmt.Println("Error balancing load:", err)
+			logger.Error("Failed to balance load", "error", err)
 		}
 		time.Sleep(1 * time.Second)
 	}
@@ -242,5 +398,4 @@ func main() {
 	time.Sleep(10 * time.Second)
 	lb.AddNode("127.0.0.1:8004")
 	lb.RemoveNode("node-2")
-	lb.RandomizeLoad()
 }
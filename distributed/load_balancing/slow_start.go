@@ -0,0 +1,19 @@
+package load_balancing
+
+import "time"
+
+// SetSlowStart makes query nodes added with AddNode ramp up to their full share
+// of queries over window while their caches warm. Zero disables the ramp.
+func (lb *LoadBalancer) SetSlowStart(window time.Duration) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.slowStart = window
+}
+
+// SetSlowStart makes newly added crawler nodes ramp up to their full share of
+// tasks over window. Zero disables the ramp.
+func (lb *CrawlerLoadBalancer) SetSlowStart(window time.Duration) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.slowStart = window
+}
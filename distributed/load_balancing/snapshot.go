@@ -0,0 +1,107 @@
+package load_balancing
+
+import "time"
+
+// latencyDecay is the weight of the newest sample in the moving average
+const latencyDecay = 0.2
+
+// LatencyStats summarises how long a node took to accept forwarded work
+type LatencyStats struct {
+	Count int64         `json:"count"`
+	Mean  time.Duration `json:"mean_ns"`
+	EWMA  time.Duration `json:"ewma_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+// observe adds a sample; callers hold the balancer mutex
+func (s *LatencyStats) observe(latency time.Duration) {
+	s.Count++
+	s.Mean += (latency - s.Mean) / time.Duration(s.Count)
+	if s.Count == 1 {
+		s.EWMA = latency
+	} else {
+		s.EWMA += time.Duration(latencyDecay * float64(latency-s.EWMA))
+	}
+	if latency > s.Max {
+		s.Max = latency
+	}
+}
+
+// NodeSnapshot is a point-in-time copy of a node's state. It shares nothing
+// with the balancer, so it stays valid while the node keeps changing.
+type NodeSnapshot struct {
+	ID       string       `json:"id"`
+	Address  string       `json:"address"`
+	Zone     string       `json:"zone,omitempty"`
+	IsActive bool         `json:"is_active"`
+	Draining bool         `json:"draining"`
+	Ejected  bool         `json:"ejected"`
+	Load     int          `json:"load"` // Requests in flight
+	MaxLoad  int          `json:"max_load,omitempty"`
+	Weight   float64      `json:"weight"`
+	AddedAt  time.Time    `json:"added_at"`
+	Latency  LatencyStats `json:"latency"`
+	Info     NodeInfo     `json:"info"`
+}
+
+// clone copies the metadata so the snapshot doesn't alias the node's slices
+func (info NodeInfo) clone() NodeInfo {
+	info.Features = append([]string(nil), info.Features...)
+	info.Plugins = append([]string(nil), info.Plugins...)
+	return info
+}
+
+// Snapshot returns a copy of the state of every query node
+func (lb *LoadBalancer) Snapshot() []NodeSnapshot {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	snapshot := make([]NodeSnapshot, 0, len(lb.nodes))
+	for _, node := range lb.nodes {
+		snapshot = append(snapshot, NodeSnapshot{
+			ID:       node.ID,
+			Address:  node.Address,
+			Zone:     node.Zone,
+			IsActive: node.IsActive(),
+			Draining: node.Draining,
+			Ejected:  node.outlier.ejected,
+			Load:     node.Load(),
+			Weight:   node.Weight,
+			AddedAt:  node.AddedAt,
+			Latency:  node.latency,
+			Info:     node.Info.clone(),
+		})
+	}
+	return snapshot
+}
+
+// Snapshot returns a copy of the state of every crawler node
+func (lb *CrawlerLoadBalancer) Snapshot() []NodeSnapshot {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	snapshot := make([]NodeSnapshot, 0, len(lb.nodes))
+	for _, node := range lb.nodes {
+		snapshot = append(snapshot, NodeSnapshot{
+			ID:       node.ID,
+			Address:  node.Address,
+			Zone:     node.Zone,
+			IsActive: node.IsActive(),
+			Draining: node.Draining,
+			Load:     node.Load(),
+			MaxLoad:  node.MaxLoad,
+			Weight:   node.Weight,
+			AddedAt:  node.AddedAt,
+			Latency:  node.latency,
+			Info:     node.Info.clone(),
+		})
+	}
+	return snapshot
+}
+
+// observeLatency records how long a crawler node took to accept a task
+func (lb *CrawlerLoadBalancer) observeLatency(node *CrawlerNode, latency time.Duration) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	node.latency.observe(latency)
+}
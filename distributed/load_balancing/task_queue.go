@@ -0,0 +1,173 @@
+package load_balancing
+
+import (
+	"context"
+	"errors"
+	"pkg/balancer"
+	"time"
+)
+
+// DefaultPendingTasks is the default bound of the crawler balancer's pending queue
+const DefaultPendingTasks = 1024
+
+var (
+	// ErrNodesSaturated is returned when every eligible crawler node is at MaxLoad
+	ErrNodesSaturated = errors.New("all crawler nodes at capacity")
+	// ErrTaskQueueFull is returned when a task can neither be assigned nor queued
+	ErrTaskQueueFull = errors.New("crawl task queue full")
+)
+
+// pendingTask is a crawl task waiting for capacity
+type pendingTask struct {
+	url     string
+	feature string
+}
+
+// taskQueue is a bounded FIFO of crawl tasks held while all nodes are saturated
+type taskQueue struct {
+	tasks      []pendingTask
+	limit      int
+	onOverflow func(url string)
+}
+
+func newTaskQueue(limit int, onOverflow func(url string)) *taskQueue {
+	return &taskQueue{
+		limit:      limit,
+		onOverflow: onOverflow,
+	}
+}
+
+// SetPendingQueue bounds the number of crawl tasks held while all nodes are
+// saturated. onOverflow, if set, receives tasks rejected because the queue is full.
+func (lb *CrawlerLoadBalancer) SetPendingQueue(limit int, onOverflow func(url string)) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.pending.limit = limit
+	lb.pending.onOverflow = onOverflow
+}
+
+// PendingTasks returns the number of crawl tasks waiting for capacity
+func (lb *CrawlerLoadBalancer) PendingTasks() int {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return len(lb.pending.tasks)
+}
+
+// reserveNode picks the node for a task like SelectNodeFor but only among
+// nodes below MaxLoad, and counts the task against it
+func (lb *CrawlerLoadBalancer) reserveNode(feature string) (*CrawlerNode, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.reserveNodeLocked(feature)
+}
+
+// reserveNodeLocked is reserveNode for callers holding the mutex
+func (lb *CrawlerLoadBalancer) reserveNodeLocked(feature string) (*CrawlerNode, error) {
+	selector := balancer.Selector{Zone: lb.zone}
+	eligible := false
+	now := time.Now()
+
+	for i, node := range lb.nodes {
+		if !node.IsActive() || node.Draining || !node.Info.Supports(feature) {
+			continue
+		}
+		eligible = true
+		if node.Load() >= node.MaxLoad {
+			continue
+		}
+		ramp := balancer.SlowStartFactor(node.AddedAt, now, lb.slowStart)
+		selector.Offer(i, node.Zone, balancer.Score(node.Load(), node.Weight, ramp))
+	}
+
+	i, ok := selector.Best()
+	if !ok {
+		if eligible {
+			return nil, ErrNodesSaturated
+		}
+		return nil, errors.New("no active nodes available")
+	}
+	selectedNode := lb.nodes[i]
+
+	lb.metrics.ObserveLoad(selectedNode.ID, selectedNode.acquire())
+	observeCrossZone(lb.metrics, lb.zone, selectedNode.Zone)
+	return selectedNode, nil
+}
+
+// releaseNode gives back capacity reserved on a node
+func (lb *CrawlerLoadBalancer) releaseNode(node *CrawlerNode) {
+	node.release()
+}
+
+// enqueueTask holds a task until capacity frees up
+func (lb *CrawlerLoadBalancer) enqueueTask(url, feature string) error {
+	lb.mutex.Lock()
+	if len(lb.pending.tasks) >= lb.pending.limit {
+		onOverflow := lb.pending.onOverflow
+		lb.mutex.Unlock()
+		if onOverflow != nil {
+			onOverflow(url)
+		}
+		return ErrTaskQueueFull
+	}
+	lb.pending.tasks = append(lb.pending.tasks, pendingTask{url: url, feature: feature})
+	lb.mutex.Unlock()
+
+	requestLogger.Debug("All crawler nodes saturated, queued crawl task", "url", url)
+	return nil
+}
+
+// CompleteCrawlTask records that a node finished a task, freeing capacity for
+// the next pending one
+func (lb *CrawlerLoadBalancer) CompleteCrawlTask(nodeID string) error {
+	lb.mutex.Lock()
+	var found *CrawlerNode
+	for _, node := range lb.nodes {
+		if node.ID == nodeID {
+			found = node
+			break
+		}
+	}
+	lb.mutex.Unlock()
+
+	if found == nil {
+		return ErrNodeNotFound
+	}
+	lb.releaseNode(found)
+	lb.dispatchPending()
+	return nil
+}
+
+// dispatchPending forwards queued tasks in order for as long as nodes have capacity
+func (lb *CrawlerLoadBalancer) dispatchPending() {
+	for {
+		lb.mutex.Lock()
+		if len(lb.pending.tasks) == 0 {
+			lb.mutex.Unlock()
+			return
+		}
+		task := lb.pending.tasks[0]
+		node, err := lb.reserveNodeLocked(task.feature)
+		if err != nil {
+			lb.mutex.Unlock()
+			return
+		}
+		lb.pending.tasks = lb.pending.tasks[1:]
+		metrics := lb.metrics
+		lb.mutex.Unlock()
+
+		metrics.ObserveRequest(node.ID)
+		sent := time.Now()
+		if err := lb.forwardCrawlTask(context.Background(), node, task.url); err == nil {
+			lb.observeLatency(node, time.Since(sent))
+			continue
+		}
+
+		lb.releaseNode(node)
+		metrics.ObserveFailure(node.ID)
+		lb.MarkNodeInactive(node)
+
+		lb.mutex.Lock()
+		lb.pending.tasks = append([]pendingTask{task}, lb.pending.tasks...)
+		lb.mutex.Unlock()
+	}
+}
@@ -0,0 +1,56 @@
+package load_balancing
+
+// observeCrossZone records a request leaving the balancer's zone. Nodes
+// without a zone label aren't counted.
+func observeCrossZone(m Metrics, balancerZone, nodeZone string) {
+	if balancerZone == "" || nodeZone == "" || nodeZone == balancerZone {
+		return
+	}
+	m.ObserveCrossZone(balancerZone, nodeZone)
+}
+
+// SetZone sets the zone the query balancer runs in. Queries then go to
+// same-zone nodes and only cross zones when none of them is available.
+func (lb *LoadBalancer) SetZone(zone string) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.zone = zone
+}
+
+// SetNodeZone labels a query node with its zone. Nodes reporting a zone in
+// their /info metadata are relabelled on the next health check.
+func (lb *LoadBalancer) SetNodeZone(nodeID, zone string) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	node := lb.findNode(nodeID)
+	if node == nil {
+		return ErrNodeNotFound
+	}
+	node.Zone = zone
+	logger.Info("Node placed in zone", "node", nodeID, "zone", zone)
+	return nil
+}
+
+// SetZone sets the zone the crawler balancer runs in. Tasks then go to
+// same-zone nodes and only cross zones when none of them has capacity.
+func (lb *CrawlerLoadBalancer) SetZone(zone string) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.zone = zone
+}
+
+// SetNodeZone labels a crawler node with its zone. Nodes reporting a zone in
+// their /info metadata are relabelled on the next health check.
+func (lb *CrawlerLoadBalancer) SetNodeZone(nodeID, zone string) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	node := lb.findNode(nodeID)
+	if node == nil {
+		return ErrNodeNotFound
+	}
+	node.Zone = zone
+	logger.Info("Crawler node placed in zone", "node", nodeID, "zone", zone)
+	return nil
+}
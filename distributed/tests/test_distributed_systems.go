@@ -13,7 +13,6 @@ import (
 
 // API endpoints for interacting with the Java services
 const (
-	indexPartitionAPI   = "http://localhost:8080/api/index_partition"
 	indexReplicationAPI = "http://localhost:8080/api/index_replication"
 	failoverAPI         = "http://localhost:8080/api/failover"
 )
@@ -117,29 +116,6 @@ func TestQueryLoadBalancing(t *testing.T) {
 	}
 }
 
-// Test index partitioning by calling the Java API
-func TestDistributedIndexPartitioning(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-
-	payload := map[string]string{
-		"node":      "Node1",
-		"partition": "IndexPartition1",
-	}
-
-	// Call Java service to partition the index
-	err := callJavaAPI(indexPartitionAPI, payload)
-	if err != nil {
-		t.Fatalf("Failed to partition index: %v", err)
-	}
-
-	t.Logf("Index partitioning successfully initiated for Node1")
-	select {
-	case <-ctx.Done():
-		t.Fatal("Index partitioning timed out")
-	}
-}
-
 // Test index replication between nodes using Java API
 func TestIndexReplication(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Second)
@@ -163,52 +139,6 @@ func TestIndexReplication(t *testing.T) {
 	}
 }
 
-// Test fault tolerance by simulating node failure using Java API
-func TestFailover(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	payload := map[string]string{
-		"failedNode": "Node1",
-		"backupNode": "Node2",
-	}
-
-	// Call Java service to simulate failover
-	err := callJavaAPI(failoverAPI, payload)
-	if err != nil {
-		t.Fatalf("Failover simulation failed: %v", err)
-	}
-
-	t.Logf("Failover successfully simulated for Node1")
-	select {
-	case <-ctx.Done():
-		t.Fatal("Failover simulation timed out")
-	}
-}
-
-// Test data synchronization during index partitioning using Java API
-func TestDataSynchronizationDuringPartitioning(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 40*time.Second)
-	defer cancel()
-
-	payload := map[string]string{
-		"partition": "IndexPartition1",
-		"node":      "Node1",
-	}
-
-	// Call Java service to initiate data synchronization
-	err := callJavaAPI(indexPartitionAPI, payload)
-	if err != nil {
-		t.Fatalf("Failed to synchronize data during partitioning: %v", err)
-	}
-
-	t.Logf("Data synchronization during partitioning initiated for Node1")
-	select {
-	case <-ctx.Done():
-		t.Fatal("Data synchronization timed out")
-	}
-}
-
 // Test replication consistency across nodes using Java API
 func TestReplicationConsistency(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Second)
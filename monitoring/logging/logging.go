@@ -0,0 +1,271 @@
+// Package logging is the structured logging of the Go components. Each
+// component logs through its own slog.Logger, taken with Component and
+// tagged with its name, instead of printing to standard output; the process
+// decides with Setup where the records go, in which format, and from which
+// level for each component. High-volume paths log through Sampled loggers,
+// so a burst of requests can't flood the logs.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Formats records can be written in
+const (
+	FormatText = "text" // key=value pairs, for people
+	FormatJSON = "json" // A JSON object a line, for log shippers
+)
+
+// Options configures the logging of a process
+type Options struct {
+	// Level is the least severe level logged
+	Level slog.Level
+	// Levels overrides Level for components, by name, such as
+	// "distributed/load_balancing"
+	Levels map[string]slog.Level
+	Format string
+	// AddSource adds the file and line of the call to each record
+	AddSource bool
+	// Handler, if set, takes the records in place of a handler writing
+	// them in Format, as for a process embedding the components in its
+	// own logging. It is given records of every level that is logged.
+	Handler slog.Handler
+}
+
+// config is where component loggers send their records
+type config struct {
+	handler slog.Handler // Nil until Setup, for slog's default logger
+	level   slog.Level
+	levels  map[string]slog.Level
+}
+
+// current is swapped by Setup while components log
+var current atomic.Pointer[config]
+
+func init() {
+	current.Store(&config{level: slog.LevelInfo})
+}
+
+// Setup sends the records of every component, and of slog's and the log
+// package's default loggers, to w in options' format, or to options'
+// Handler
+func Setup(w io.Writer, options Options) error {
+	// The handler takes the records of every level any component logs;
+	// each component filters its own
+	least := options.Level
+	for _, level := range options.Levels {
+		if level < least {
+			least = level
+		}
+	}
+	handlerOptions := &slog.HandlerOptions{Level: least, AddSource: options.AddSource}
+	handler := options.Handler
+	switch {
+	case handler != nil:
+		// The embedding process formats the records
+	case options.Format == FormatText, options.Format == "":
+		handler = slog.NewTextHandler(w, handlerOptions)
+	case options.Format == FormatJSON:
+		handler = slog.NewJSONHandler(w, handlerOptions)
+	default:
+		return fmt.Errorf("unknown log format %q, want %s or %s", options.Format, FormatText, FormatJSON)
+	}
+	current.Store(&config{handler: handler, level: options.Level, levels: options.Levels})
+	slog.SetDefault(slog.New(levelHandler{handler, options.Level}))
+	return nil
+}
+
+// ParseLevels reads a level, optionally followed by overrides for
+// components, such as "info" or "warn,distributed/load_balancing=debug"
+func ParseLevels(spec string) (slog.Level, map[string]slog.Level, error) {
+	level := slog.LevelInfo
+	levels := make(map[string]slog.Level)
+	for i, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		component, name, override := strings.Cut(part, "=")
+		if !override {
+			name = part
+		}
+		var parsed slog.Level
+		if err := parsed.UnmarshalText([]byte(name)); err != nil {
+			return level, nil, fmt.Errorf("bad log level %q: %v", part, err)
+		}
+		switch {
+		case override:
+			levels[component] = parsed
+		case i == 0:
+			level = parsed
+		default:
+			return level, nil, fmt.Errorf("bad log level %q: only the first level may be given without a component", part)
+		}
+	}
+	return level, levels, nil
+}
+
+// Component returns the logger of a component, tagging its records with
+// component=name. Components take it once, usually into a package
+// variable; it logs as Setup last said, even if Setup is called later.
+func Component(name string) *slog.Logger {
+	return slog.New(&componentHandler{component: name})
+}
+
+// componentHandler passes a component's records on to the handler Setup set,
+// with the attributes and groups added to it since
+type componentHandler struct {
+	component string
+	with      []func(slog.Handler) slog.Handler
+	// cached is the handler built for a config, rebuilt when Setup swaps it
+	cached atomic.Pointer[builtHandler]
+}
+
+type builtHandler struct {
+	config  *config
+	handler slog.Handler
+}
+
+// target returns the handler the component's records go to, and the least
+// severe level it logs
+func (h *componentHandler) target() (slog.Handler, slog.Level) {
+	config := current.Load()
+	level, ok := config.levels[h.component]
+	if !ok {
+		level = config.level
+	}
+	if built := h.cached.Load(); built != nil && built.config == config {
+		return built.handler, level
+	}
+	// Until Setup, records go to slog's default logger, which may change
+	handler := config.handler
+	if handler == nil {
+		handler = slog.Default().Handler()
+	}
+	handler = handler.WithAttrs([]slog.Attr{slog.String("component", h.component)})
+	for _, with := range h.with {
+		handler = with(handler)
+	}
+	if config.handler != nil {
+		h.cached.Store(&builtHandler{config: config, handler: handler})
+	}
+	return handler, level
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	handler, least := h.target()
+	return level >= least && handler.Enabled(ctx, level)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	handler, _ := h.target()
+	return handler.Handle(ctx, record)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.derive(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.derive(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h *componentHandler) derive(with func(slog.Handler) slog.Handler) slog.Handler {
+	withs := append(append([]func(slog.Handler) slog.Handler(nil), h.with...), with)
+	return &componentHandler{component: h.component, with: withs}
+}
+
+// levelHandler drops the records of next below level
+type levelHandler struct {
+	next  slog.Handler
+	level slog.Level
+}
+
+func (h levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.next.Enabled(ctx, level)
+}
+
+func (h levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.next.Handle(ctx, record)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.next.WithAttrs(attrs), h.level}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.next.WithGroup(name), h.level}
+}
+
+// Sampling bounds how often a message is logged
+type Sampling struct {
+	// Tick is the period the counts of each message start over in
+	Tick time.Duration
+	// First records of a message are logged each tick, then every
+	// Thereafter-th; zero Thereafter drops the rest
+	First      int
+	Thereafter int
+}
+
+// DefaultSampling logs ten records of a message a second, then one in a
+// hundred
+var DefaultSampling = Sampling{Tick: time.Second, First: 10, Thereafter: 100}
+
+// Sampled returns logger logging records of the same message, whatever
+// their level, as sampling says
+func Sampled(logger *slog.Logger, sampling Sampling) *slog.Logger {
+	return slog.New(&samplingHandler{next: logger.Handler(), counts: &sampleCounts{sampling: sampling}})
+}
+
+// samplingHandler passes on the records sampled to next
+type samplingHandler struct {
+	next   slog.Handler
+	counts *sampleCounts // Shared with the handlers derived from this one
+}
+
+// sampleCounts counts the records of each message this tick
+type sampleCounts struct {
+	sampling Sampling
+	mutex    sync.Mutex
+	tick     time.Time
+	seen     map[string]int
+}
+
+// sample counts a record of message, reporting whether it is logged
+func (c *sampleCounts) sample(message string, at time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.seen == nil || at.Sub(c.tick) >= c.sampling.Tick {
+		c.tick = at
+		c.seen = make(map[string]int)
+	}
+	c.seen[message]++
+	n := c.seen[message]
+	if n <= c.sampling.First {
+		return true
+	}
+	return c.sampling.Thereafter > 0 && (n-c.sampling.First)%c.sampling.Thereafter == 0
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if !h.counts.sample(record.Message, record.Time) {
+		return nil
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{next: h.next.WithAttrs(attrs), counts: h.counts}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{next: h.next.WithGroup(name), counts: h.counts}
+}
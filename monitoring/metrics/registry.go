@@ -0,0 +1,67 @@
+// Package metrics is where the components of a process register their
+// Prometheus collectors, and how the process serves them. The crawler, the
+// load balancers, the document store and the indexes each register with a
+// Registry, usually Default, and the process serves it once with Serve.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds the collectors of a process. It is a prometheus.Registry,
+// so anything taking a prometheus.Registerer or prometheus.Gatherer takes
+// it, and it always reports the process's own system metrics.
+type Registry struct {
+	*prometheus.Registry
+	system *SystemMetricsCollector
+}
+
+// NewRegistry returns a registry holding only the system metrics
+func NewRegistry() *Registry {
+	r := &Registry{
+		Registry: prometheus.NewRegistry(),
+		system:   NewSystemMetricsCollector(),
+	}
+	r.MustRegister(r.system)
+	return r
+}
+
+// Default is the registry components register with unless they are given
+// another, and the one Serve serves
+var Default = NewRegistry()
+
+// AddDataDirs reports the disk usage of each of dirs with the system
+// metrics
+func (r *Registry) AddDataDirs(dirs ...string) {
+	r.system.AddDataDirs(dirs...)
+}
+
+// Handler serves the registry's metrics in the Prometheus text format, or
+// as OpenMetrics, with the exemplars of histograms, to scrapers asking for
+// it
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+// Serve serves the registry's metrics at /metrics on addr, returning only
+// when the server fails
+func (r *Registry) Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r.Handler())
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return server.ListenAndServe()
+}
+
+// Serve serves Default's metrics at /metrics on addr, returning only when
+// the server fails
+func Serve(addr string) error {
+	return Default.Serve(addr)
+}
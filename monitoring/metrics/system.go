@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"monitoring/logging"
+)
+
+// logger reports data directories that can't be measured, on every scrape,
+// so it is sampled
+var logger = logging.Sampled(logging.Component("monitoring/metrics"), logging.DefaultSampling)
+
+// clockTicks is the unit of the CPU times in /proc/self/stat, USER_HZ,
+// which is 100 on every Linux platform Go supports
+const clockTicks = 100
+
+// SystemMetricsCollector reports on the process it runs in: CPU, memory, file
+// descriptors, goroutines, garbage collection and the disk usage of its data
+// directories. Every Registry has one. Process figures are read from /proc
+// and are left out where it doesn't exist.
+type SystemMetricsCollector struct {
+	cpuUsage    *prometheus.Desc
+	cpuSeconds  *prometheus.Desc
+	memoryUsage *prometheus.Desc
+	heapAlloc   *prometheus.Desc
+	openFDs     *prometheus.Desc
+	goRoutines  *prometheus.Desc
+	gcRuns      *prometheus.Desc
+	gcPause     *prometheus.Desc
+	gcLastPause *prometheus.Desc
+	dataDirSize *prometheus.Desc
+
+	mutex    sync.Mutex
+	dataDirs []string
+	// The process CPU time and wall time at the last collection, to work out
+	// the CPU usage since
+	lastCPU  float64
+	lastTime time.Time
+}
+
+// NewSystemMetricsCollector initializes the system metrics, reporting the disk
+// usage of each of dataDirs
+func NewSystemMetricsCollector(dataDirs ...string) *SystemMetricsCollector {
+	collector := &SystemMetricsCollector{
+		cpuUsage:    prometheus.NewDesc("system_cpu_usage_percentage", "CPU used by the process since the last scrape, in percent of all CPUs", nil, nil),
+		cpuSeconds:  prometheus.NewDesc("system_cpu_seconds_total", "User and system CPU time used by the process in seconds", nil, nil),
+		memoryUsage: prometheus.NewDesc("system_memory_usage_bytes", "Resident memory of the process in bytes", nil, nil),
+		heapAlloc:   prometheus.NewDesc("system_heap_alloc_bytes", "Bytes of allocated heap objects", nil, nil),
+		openFDs:     prometheus.NewDesc("system_open_fds", "Number of open file descriptors", nil, nil),
+		goRoutines:  prometheus.NewDesc("system_goroutines_count", "Number of active Go routines", nil, nil),
+		gcRuns:      prometheus.NewDesc("system_gc_runs_total", "Number of completed garbage collection cycles", nil, nil),
+		gcPause:     prometheus.NewDesc("system_gc_pause_seconds_total", "Time the program was paused for garbage collection in seconds", nil, nil),
+		gcLastPause: prometheus.NewDesc("system_gc_last_pause_seconds", "Length of the last garbage collection pause in seconds", nil, nil),
+		dataDirSize: prometheus.NewDesc("system_data_dir_bytes", "Size of the files under a data directory in bytes", []string{"dir"}, nil),
+		dataDirs:    dataDirs,
+		lastTime:    time.Now(),
+	}
+	collector.lastCPU, _ = processCPUSeconds()
+	return collector
+}
+
+// Describe sends the descriptors of the metrics to Prometheus
+func (collector *SystemMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.cpuUsage
+	ch <- collector.cpuSeconds
+	ch <- collector.memoryUsage
+	ch <- collector.heapAlloc
+	ch <- collector.openFDs
+	ch <- collector.goRoutines
+	ch <- collector.gcRuns
+	ch <- collector.gcPause
+	ch <- collector.gcLastPause
+	ch <- collector.dataDirSize
+}
+
+// Collect fetches the system metrics and sends them to Prometheus
+func (collector *SystemMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	if cpu, err := processCPUSeconds(); err == nil {
+		ch <- prometheus.MustNewConstMetric(collector.cpuSeconds, prometheus.CounterValue, cpu)
+		ch <- prometheus.MustNewConstMetric(collector.cpuUsage, prometheus.GaugeValue, collector.cpuUsageSince(cpu))
+	}
+	if rss, err := residentMemory(); err == nil {
+		ch <- prometheus.MustNewConstMetric(collector.memoryUsage, prometheus.GaugeValue, rss)
+	}
+	if fds, err := openFileDescriptors(); err == nil {
+		ch <- prometheus.MustNewConstMetric(collector.openFDs, prometheus.GaugeValue, fds)
+	}
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	ch <- prometheus.MustNewConstMetric(collector.heapAlloc, prometheus.GaugeValue, float64(memStats.HeapAlloc))
+	ch <- prometheus.MustNewConstMetric(collector.goRoutines, prometheus.GaugeValue, float64(runtime.NumGoroutine()))
+	ch <- prometheus.MustNewConstMetric(collector.gcRuns, prometheus.CounterValue, float64(memStats.NumGC))
+	ch <- prometheus.MustNewConstMetric(collector.gcPause, prometheus.CounterValue, time.Duration(memStats.PauseTotalNs).Seconds())
+	var lastPause float64
+	if memStats.NumGC > 0 {
+		lastPause = time.Duration(memStats.PauseNs[(memStats.NumGC+255)%256]).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(collector.gcLastPause, prometheus.GaugeValue, lastPause)
+
+	collector.mutex.Lock()
+	dataDirs := collector.dataDirs
+	collector.mutex.Unlock()
+	for _, dir := range dataDirs {
+		size, err := dirSize(dir)
+		if err != nil {
+			logger.Warn("Failed to measure data directory", "dir", dir, "error", err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(collector.dataDirSize, prometheus.GaugeValue, size, dir)
+	}
+}
+
+// AddDataDirs reports the disk usage of dirs too
+func (collector *SystemMetricsCollector) AddDataDirs(dirs ...string) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.dataDirs = append(collector.dataDirs, dirs...)
+}
+
+// cpuUsageSince returns the percentage of all CPUs the process used between
+// the last collection and now, when it had used cpu seconds
+func (collector *SystemMetricsCollector) cpuUsageSince(cpu float64) float64 {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(collector.lastTime).Seconds()
+	used := cpu - collector.lastCPU
+	collector.lastCPU, collector.lastTime = cpu, now
+	if elapsed <= 0 {
+		return 0
+	}
+	return used / elapsed / float64(runtime.NumCPU()) * 100
+}
+
+// processCPUSeconds returns the user and system CPU time the process has
+// used, from /proc/self/stat
+func processCPUSeconds() (float64, error) {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return 0, err
+	}
+	// The command name in parentheses may hold spaces, so fields are
+	// counted from the parenthesis closing it; utime and stime are the
+	// 14th and 15th fields, the 12th and 13th after it
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("malformed /proc/self/stat")
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("malformed /proc/self/stat")
+	}
+	utime, err := strconv.ParseFloat(fields[11], 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseFloat(fields[12], 64)
+	if err != nil {
+		return 0, err
+	}
+	return (utime + stime) / clockTicks, nil
+}
+
+// residentMemory returns the resident set size of the process in bytes,
+// from /proc/self/statm
+func residentMemory() (float64, error) {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed /proc/self/statm")
+	}
+	pages, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * float64(os.Getpagesize()), nil
+}
+
+// openFileDescriptors counts the entries of /proc/self/fd
+func openFileDescriptors() (float64, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	return float64(len(entries)), nil
+}
+
+// dirSize adds up the sizes of the regular files under dir
+func dirSize(dir string) (float64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may be removed while walking
+			if os.IsNotExist(err) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return float64(size), err
+}
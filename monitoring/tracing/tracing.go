@@ -0,0 +1,173 @@
+// Package tracing sets up OpenTelemetry tracing for a process, and wraps its
+// HTTP and gRPC servers and clients so trace context crosses the nodes a
+// request passes through. A crawled page is traced through fetch, parse,
+// store and index, and a search through route, shard-query, merge and
+// respond, each node adding its spans to the same trace, so the latency of
+// a request across nodes can be broken down by where it was spent.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// Exporters spans can be sent with
+const (
+	ExporterNone     = ""          // Spans are dropped, but trace context is still passed on
+	ExporterOTLPGRPC = "otlp-grpc" // OTLP over gRPC, to a collector on port 4317 by default
+	ExporterOTLPHTTP = "otlp-http" // OTLP over HTTP, to a collector on port 4318 by default
+	ExporterStdout   = "stdout"    // Pretty-printed JSON on standard output, for debugging
+)
+
+// Config says where a process sends its spans
+type Config struct {
+	// ServiceName names the process in traces, such as "searchd"
+	ServiceName string
+	Exporter    string
+	// Endpoint is the collector's host:port. Empty takes the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable, or the exporter's
+	// default on localhost.
+	Endpoint string
+	// Insecure sends OTLP without TLS, as to a collector on the same host
+	Insecure bool
+	// SampleRatio is the share of traces started here that are recorded,
+	// from 0 to 1. Requests arriving with trace context follow the sampling
+	// decision of their caller, so a trace is recorded on every node or on
+	// none.
+	SampleRatio float64
+}
+
+// DefaultConfig records every trace and drops the spans, for flags to
+// start from
+var DefaultConfig = Config{SampleRatio: 1}
+
+// Setup makes config the process's tracing: it sets the global tracer
+// provider that Tracer's tracers use, and the W3C trace context and baggage
+// propagators that Handler, Transport, ServerOption and DialOption pass
+// trace context with. Call the returned function on exit to flush the spans
+// still buffered.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config.Exporter == ExporterNone {
+		return func(context.Context) error { return nil }, nil
+	}
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return nil, fmt.Errorf("sample ratio %v is not between 0 and 1", config.SampleRatio)
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case ExporterOTLPGRPC:
+		var options []otlptracegrpc.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, options...)
+	case ExporterOTLPHTTP:
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, want %s, %s or %s",
+			config.Exporter, ExporterOTLPGRPC, ExporterOTLPHTTP, ExporterStdout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the trace exporter: %w", err)
+	}
+
+	// The environment, such as OTEL_SERVICE_NAME and
+	// OTEL_RESOURCE_ATTRIBUTES, overrides the service name given
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", config.ServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv())
+	if err != nil && !errors.Is(err, resource.ErrPartialResource) {
+		return nil, fmt.Errorf("failed to describe the process: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer a component starts its spans with, named after
+// its package. It follows the provider Setup sets, even if taken before.
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// End ends span, marking it failed with err if err isn't nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the recorded trace ctx is part of, or "" if it
+// isn't part of one, as for exemplars and logs to point to the trace
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsSampled() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// Handler serves requests with next, each in a server span named after
+// operation, continuing the trace the caller passed on if any
+func Handler(next http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(next, operation)
+}
+
+// Transport sends requests with base, or http.DefaultTransport if nil, each
+// in a client span passing the trace on to the server
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base)
+}
+
+// ServerOption serves each gRPC call in a server span, continuing the trace
+// the caller passed on if any
+func ServerOption() grpc.ServerOption {
+	return grpc.StatsHandler(otelgrpc.NewServerHandler())
+}
+
+// DialOption makes each gRPC call in a client span passing the trace on to
+// the server
+func DialOption() grpc.DialOption {
+	return grpc.WithStatsHandler(otelgrpc.NewClientHandler())
+}
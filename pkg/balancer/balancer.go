@@ -0,0 +1,161 @@
+package balancer
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoEndpoints is returned by Pick when no endpoint can take a request
+var ErrNoEndpoints = errors.New("no endpoints available")
+
+// Endpoint is a backend a Balancer can pick
+type Endpoint struct {
+	ID      string  `json:"id"`
+	Address string  `json:"address"`
+	Zone    string  `json:"zone,omitempty"`
+	Weight  float64 `json:"weight"` // Relative capacity, 0 means 1
+}
+
+// EndpointState is a copy of what a Balancer knows about an endpoint
+type EndpointState struct {
+	Endpoint
+	InFlight     int
+	Failures     int // Consecutive failed requests
+	EjectedUntil time.Time
+}
+
+// Options configures a Balancer
+type Options struct {
+	Zone             string        // Zone of the client, empty disables zone preference
+	SlowStart        time.Duration // Ramp-up window of endpoints joining after the first update
+	FailureThreshold int           // Consecutive failures that eject an endpoint, 0 disables ejection
+	EjectionTime     time.Duration
+}
+
+// endpoint is the mutable state kept per endpoint
+type endpoint struct {
+	EndpointState
+	addedAt time.Time
+}
+
+// Balancer spreads requests over a changing set of endpoints by weighted least
+// load, preferring the local zone, ramping new endpoints up slowly and
+// ejecting endpoints that keep failing. It is safe for concurrent use.
+type Balancer struct {
+	options   Options
+	endpoints []*endpoint
+	populated bool
+	mutex     sync.Mutex
+}
+
+// New creates a Balancer without endpoints; add them with Update or Subscribe
+func New(options Options) *Balancer {
+	return &Balancer{options: options}
+}
+
+// Pick selects the endpoint for the next request and counts the request
+// against it. Every successful Pick must be followed by a Report.
+func (b *Balancer) Pick() (Endpoint, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	selector := Selector{Zone: b.options.Zone}
+	for i, ep := range b.endpoints {
+		if now.Before(ep.EjectedUntil) {
+			continue
+		}
+		ramp := SlowStartFactor(ep.addedAt, now, b.options.SlowStart)
+		selector.Offer(i, ep.Zone, Score(ep.InFlight, ep.Weight, ramp))
+	}
+
+	i, ok := selector.Best()
+	if !ok {
+		return Endpoint{}, ErrNoEndpoints
+	}
+	ep := b.endpoints[i]
+	ep.InFlight++
+	return ep.Endpoint, nil
+}
+
+// Report records the outcome of a request sent to a picked endpoint
+func (b *Balancer) Report(picked Endpoint, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ep := b.find(picked.ID)
+	if ep == nil {
+		// Removed while the request was in flight
+		return
+	}
+	if ep.InFlight > 0 {
+		ep.InFlight--
+	}
+	if err == nil {
+		ep.Failures = 0
+		return
+	}
+	ep.Failures++
+	if b.options.FailureThreshold > 0 && ep.Failures >= b.options.FailureThreshold {
+		ep.EjectedUntil = time.Now().Add(b.options.EjectionTime)
+		ep.Failures = 0
+	}
+}
+
+// Update replaces the endpoint set. Endpoints already known keep their load
+// and failure state; new ones start their slow-start ramp.
+func (b *Balancer) Update(endpoints []Endpoint) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	updated := make([]*endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if e.Weight <= 0 {
+			e.Weight = 1
+		}
+		ep := b.find(e.ID)
+		if ep == nil {
+			ep = &endpoint{}
+			// The initial set is the fleet, not newcomers
+			if b.populated {
+				ep.addedAt = now
+			}
+		}
+		ep.Endpoint = e
+		updated = append(updated, ep)
+	}
+	b.endpoints = updated
+	b.populated = true
+}
+
+// Subscribe applies each membership update received on updates until the
+// channel is closed. Run it in its own goroutine.
+func (b *Balancer) Subscribe(updates <-chan []Endpoint) {
+	for endpoints := range updates {
+		b.Update(endpoints)
+	}
+}
+
+// Endpoints returns the current state of every endpoint
+func (b *Balancer) Endpoints() []EndpointState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	states := make([]EndpointState, 0, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		states = append(states, ep.EndpointState)
+	}
+	return states
+}
+
+// find returns the endpoint with the given ID; callers hold the mutex
+func (b *Balancer) find(id string) *endpoint {
+	for _, ep := range b.endpoints {
+		if ep.ID == id {
+			return ep
+		}
+	}
+	return nil
+}
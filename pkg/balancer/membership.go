@@ -0,0 +1,85 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"monitoring/logging"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// logger reports membership that can't be fetched
+var logger = logging.Component("pkg/balancer")
+
+// adminNode is the subset of a load balancer's /admin/nodes entries used for membership
+type adminNode struct {
+	Endpoint
+	IsActive bool `json:"is_active"`
+	Draining bool `json:"draining"`
+	Ejected  bool `json:"ejected"`
+}
+
+// PollMembership polls the /admin/nodes endpoint of a query or crawler load
+// balancer every interval and sends the nodes currently in rotation whenever
+// they change. The channel is closed when ctx is done, so it can be passed
+// straight to Subscribe.
+func PollMembership(ctx context.Context, adminURL string, interval time.Duration) <-chan []Endpoint {
+	updates := make(chan []Endpoint)
+	go func() {
+		defer close(updates)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last []Endpoint
+		for {
+			endpoints, err := fetchMembership(ctx, adminURL)
+			if err != nil {
+				logger.Warn("Failed to fetch membership", "url", adminURL, "error", err)
+			} else if last == nil || !reflect.DeepEqual(endpoints, last) {
+				select {
+				case updates <- endpoints:
+					last = endpoints
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates
+}
+
+// fetchMembership reads the endpoints in rotation from a balancer's admin API
+func fetchMembership(ctx context.Context, adminURL string) ([]Endpoint, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, adminURL+"/admin/nodes", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var nodes []adminNode
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return nil, err
+	}
+	endpoints := make([]Endpoint, 0, len(nodes))
+	for _, node := range nodes {
+		if node.IsActive && !node.Draining && !node.Ejected {
+			endpoints = append(endpoints, node.Endpoint)
+		}
+	}
+	return endpoints, nil
+}
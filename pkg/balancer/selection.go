@@ -0,0 +1,63 @@
+package balancer
+
+import "time"
+
+// MinSlowStartFactor is the share of its normal traffic an endpoint receives
+// right after it's added
+const MinSlowStartFactor = 0.1
+
+// SlowStartFactor is how far an endpoint added at addedAt has ramped up towards
+// its full share of traffic, rising linearly from MinSlowStartFactor to 1 over
+// window. Endpoints with a zero addedAt aren't ramped.
+func SlowStartFactor(addedAt, now time.Time, window time.Duration) float64 {
+	if window <= 0 || addedAt.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(addedAt)
+	if elapsed >= window {
+		return 1
+	}
+	factor := float64(elapsed) / float64(window)
+	if factor < MinSlowStartFactor {
+		return MinSlowStartFactor
+	}
+	return factor
+}
+
+// Score rates an endpoint for least-load selection, lower is better. Counting
+// the request being placed keeps idle endpoints comparable, so a heavier weight
+// or a further ramped endpoint wins among them.
+func Score(load int, weight, rampFactor float64) float64 {
+	return float64(load+1) / (weight * rampFactor)
+}
+
+// SameZone reports whether an endpoint in zone counts as local to a balancer
+// in localZone. Every endpoint is local to a balancer without a zone.
+func SameZone(localZone, zone string) bool {
+	return localZone == "" || zone == localZone
+}
+
+// Selector picks the best of a sequence of candidates: any endpoint in the
+// local zone beats every endpoint outside it, and the lowest score wins among
+// equals
+type Selector struct {
+	Zone      string
+	best      int
+	bestScore float64
+	bestLocal bool
+	found     bool
+}
+
+// Offer considers the candidate at index, located in zone and scored score
+func (s *Selector) Offer(index int, zone string, score float64) {
+	local := SameZone(s.Zone, zone)
+	if s.found && ((s.bestLocal && !local) || (s.bestLocal == local && score >= s.bestScore)) {
+		return
+	}
+	s.best, s.bestScore, s.bestLocal, s.found = index, score, local, true
+}
+
+// Best returns the index of the winning candidate, and false if none was offered
+func (s *Selector) Best() (int, bool) {
+	return s.best, s.found
+}
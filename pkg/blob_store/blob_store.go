@@ -0,0 +1,82 @@
+package blobstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotExist is returned for keys that hold no object
+var ErrNotExist = errors.New("object does not exist")
+
+// BlobStore keeps objects by key, such as backups and exports, on a local
+// disk or in a cloud bucket. Keys are slash-separated paths.
+type BlobStore interface {
+	// Put stores everything read from r under key, replacing any object
+	// there. Readers of key see the old object or the new one, never a
+	// partial one.
+	Put(ctx context.Context, key string, r io.Reader, options PutOptions) error
+	// Get opens the object under key; callers close it
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// List describes the objects whose keys start with prefix, ordered by key
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// PutOptions describes an object being stored
+type PutOptions struct {
+	ContentType string // Defaults to application/octet-stream
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// DefaultPartSize is how much of an object S3Store and GCSStore send per
+// request; larger objects are uploaded in parts of this size
+const DefaultPartSize = 16 << 20
+
+func contentType(options PutOptions) string {
+	if options.ContentType == "" {
+		return "application/octet-stream"
+	}
+	return options.ContentType
+}
+
+// validKey rejects keys that are empty or would escape a store's root
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return errors.New("object keys must be non-empty relative paths")
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return errors.New("object keys must not have empty, . or .. segments")
+		}
+	}
+	return nil
+}
+
+// nextPart fills buf from r and reports whether it holds the last of r,
+// so the final part of an upload can be sent as such
+func nextPart(r *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, true, nil
+	default:
+		return n, false, err
+	}
+	if _, err := r.Peek(1); err == io.EOF {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
+	}
+	return n, false, nil
+}
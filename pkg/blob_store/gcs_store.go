@@ -0,0 +1,339 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCSConfig says where a GCSStore keeps its objects and how
+type GCSConfig struct {
+	Bucket   string
+	Endpoint string // Defaults to https://storage.googleapis.com
+	// TokenSource returns OAuth 2 access tokens for requests. By default
+	// the GOOGLE_OAUTH_ACCESS_TOKEN environment variable is used if set,
+	// and otherwise tokens come from the metadata server of the Compute
+	// Engine or GKE instance the process runs on.
+	TokenSource func(ctx context.Context) (string, error)
+	// ChunkSize is the size of each chunk of a resumable upload, a multiple
+	// of 256KB; objects up to this size are sent whole. Zero means
+	// DefaultPartSize.
+	ChunkSize int
+	// KMSKeyName, if set, names the Cloud KMS key objects are encrypted with
+	KMSKeyName string
+	// CustomerKey, if set, is a 32-byte AES key objects are encrypted with
+	// but which Google doesn't keep; it is needed again to read them
+	CustomerKey []byte
+	Client      *http.Client // Defaults to http.DefaultClient
+}
+
+// GCSStore keeps objects in a Google Cloud Storage bucket, through the
+// JSON API
+type GCSStore struct {
+	config GCSConfig
+}
+
+const gcsChunkMultiple = 256 << 10
+
+// NewGCSStore returns a store for the bucket config names
+func NewGCSStore(config GCSConfig) (*GCSStore, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("GCS needs a bucket")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://storage.googleapis.com"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	if config.ChunkSize == 0 {
+		config.ChunkSize = DefaultPartSize
+	}
+	if config.ChunkSize < 0 || config.ChunkSize%gcsChunkMultiple != 0 {
+		return nil, fmt.Errorf("GCS chunks must be a positive multiple of %d bytes", gcsChunkMultiple)
+	}
+	if config.CustomerKey != nil && len(config.CustomerKey) != 32 {
+		return nil, errors.New("GCS customer keys must be 32 bytes")
+	}
+	if config.KMSKeyName != "" && config.CustomerKey != nil {
+		return nil, errors.New("GCS objects can't use both a KMS key and a customer key")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.TokenSource == nil {
+		if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+			config.TokenSource = func(context.Context) (string, error) { return token, nil }
+		} else {
+			config.TokenSource = (&metadataTokenSource{client: config.Client}).Token
+		}
+	}
+	return &GCSStore{config: config}, nil
+}
+
+// Put uploads the object in one request if it fits in a chunk, and through
+// a resumable upload otherwise, which is cancelled if any chunk fails
+func (s *GCSStore) Put(ctx context.Context, key string, r io.Reader, options PutOptions) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	buf := make([]byte, s.config.ChunkSize)
+	n, last, err := nextPart(br, buf)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"name": {key}}
+	if s.config.KMSKeyName != "" {
+		query.Set("kmsKeyName", s.config.KMSKeyName)
+	}
+	headers := s.encryptionHeaders()
+	if last {
+		query.Set("uploadType", "media")
+		headers.Set("Content-Type", contentType(options))
+		resp, err := s.request(ctx, http.MethodPost, s.uploadURL(query), headers, buf[:n], key)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	query.Set("uploadType", "resumable")
+	headers.Set("X-Upload-Content-Type", contentType(options))
+	resp, err := s.request(ctx, http.MethodPost, s.uploadURL(query), headers, nil, key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("GCS didn't start a resumable upload of %s", key)
+	}
+	if err := s.uploadChunks(ctx, key, session, br, buf, n, last); err != nil {
+		if resp, cancelErr := s.send(context.Background(), http.MethodDelete, session, nil, nil); cancelErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *GCSStore) uploadChunks(ctx context.Context, key, session string, r *bufio.Reader, buf []byte, n int, last bool) error {
+	var offset int64
+	for {
+		headers := s.encryptionHeaders()
+		total := "*"
+		if last {
+			total = strconv.FormatInt(offset+int64(n), 10)
+		}
+		headers.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(n)-1, total))
+		resp, err := s.send(ctx, http.MethodPut, session, headers, buf[:n])
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case last && resp.StatusCode/100 == 2:
+			return nil
+		case !last && resp.StatusCode == http.StatusPermanentRedirect:
+		default:
+			return gcsError(http.MethodPut, key, resp.StatusCode, body)
+		}
+		offset += int64(n)
+		if n, last, err = nextPart(r, buf); err != nil {
+			return err
+		}
+	}
+}
+
+// Get downloads the object
+func (s *GCSStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.request(ctx, http.MethodGet, s.objectURL(key)+"?alt=media", s.encryptionHeaders(), nil, key)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object
+func (s *GCSStore) Delete(ctx context.Context, key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	resp, err := s.request(ctx, http.MethodDelete, s.objectURL(key), nil, nil, key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List pages through the bucket's objects
+func (s *GCSStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	token := ""
+	for {
+		query := url.Values{"prefix": {prefix}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		listURL := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", s.config.Endpoint, url.PathEscape(s.config.Bucket), query.Encode())
+		resp, err := s.request(ctx, http.MethodGet, listURL, nil, nil, prefix)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    string    `json:"size"` // A decimal string, as the API sends 64-bit integers
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("malformed GCS listing: %w", err)
+		}
+		for _, item := range page.Items {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			objects = append(objects, ObjectInfo{Key: item.Name, Size: size, Modified: item.Updated})
+		}
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		token = page.NextPageToken
+	}
+}
+
+func (s *GCSStore) uploadURL(query url.Values) string {
+	return fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", s.config.Endpoint, url.PathEscape(s.config.Bucket), query.Encode())
+}
+
+func (s *GCSStore) objectURL(key string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", s.config.Endpoint, url.PathEscape(s.config.Bucket), url.PathEscape(key))
+}
+
+// encryptionHeaders returns the headers a customer-supplied key travels in
+func (s *GCSStore) encryptionHeaders() http.Header {
+	headers := http.Header{}
+	if s.config.CustomerKey != nil {
+		sum := sha256.Sum256(s.config.CustomerKey)
+		headers.Set("X-Goog-Encryption-Algorithm", "AES256")
+		headers.Set("X-Goog-Encryption-Key", base64.StdEncoding.EncodeToString(s.config.CustomerKey))
+		headers.Set("X-Goog-Encryption-Key-Sha256", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return headers
+}
+
+// request sends a request and fails unless the response is a success; the
+// caller closes the body
+func (s *GCSStore) request(ctx context.Context, method, target string, headers http.Header, body []byte, key string) (*http.Response, error) {
+	resp, err := s.send(ctx, method, target, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return nil, gcsError(method, key, resp.StatusCode, data)
+	}
+	return resp, nil
+}
+
+// send sends an authorized request
+func (s *GCSStore) send(ctx context.Context, method, target string, headers http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	token, err := s.config.TokenSource(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a GCS access token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return s.config.Client.Do(req)
+}
+
+// gcsError turns a GCS error response into an error, ErrNotExist for
+// missing objects
+func gcsError(method, key string, status int, body []byte) error {
+	if status == http.StatusNotFound {
+		return ErrNotExist
+	}
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &e)
+	message := e.Error.Message
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return fmt.Errorf("GCS %s %s failed with status %d: %s", method, key, status, message)
+}
+
+// metadataTokenSource gets access tokens for the instance's service
+// account from the metadata server, reusing each until shortly before it
+// expires
+type metadataTokenSource struct {
+	client  *http.Client
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+const metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+func (m *metadataTokenSource) Token(ctx context.Context) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.token != "" && time.Now().Before(m.expires) {
+		return m.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned status %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("malformed token from the metadata server: %w", err)
+	}
+	m.token = token.AccessToken
+	m.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return m.token, nil
+}
@@ -0,0 +1,417 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config says where an S3Store keeps its objects and how
+type S3Config struct {
+	Bucket string
+	Region string
+	// Endpoint is an S3-compatible service's URL, such as a MinIO server's;
+	// objects are then addressed by path. Empty means AWS, addressed by
+	// virtual host.
+	Endpoint string
+	// Credentials default to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	// and AWS_SESSION_TOKEN environment variables
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PartSize is the size of each part of a multipart upload, at least
+	// 5MB; objects up to this size are sent whole. Zero means
+	// DefaultPartSize.
+	PartSize int
+	// ServerSideEncryption is "AES256" or "aws:kms" to have S3 encrypt
+	// objects at rest, with KMSKeyID choosing the KMS key
+	ServerSideEncryption string
+	KMSKeyID             string
+	// CustomerKey, if set, is a 32-byte AES key S3 encrypts objects with
+	// but doesn't keep (SSE-C); it is needed again to read them
+	CustomerKey []byte
+	Client      *http.Client // Defaults to http.DefaultClient
+}
+
+// S3Store keeps objects in an S3 bucket, through the S3 REST API
+type S3Store struct {
+	config S3Config
+	base   *url.URL
+}
+
+const minS3PartSize = 5 << 20
+
+// NewS3Store returns a store for the bucket config names
+func NewS3Store(config S3Config) (*S3Store, error) {
+	if config.Bucket == "" || config.Region == "" {
+		return nil, errors.New("S3 needs a bucket and a region")
+	}
+	if config.AccessKeyID == "" {
+		config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		config.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("S3 needs an access key ID and secret")
+	}
+	if config.PartSize == 0 {
+		config.PartSize = DefaultPartSize
+	}
+	if config.PartSize < minS3PartSize {
+		return nil, fmt.Errorf("S3 parts must be at least %d bytes", minS3PartSize)
+	}
+	switch config.ServerSideEncryption {
+	case "", "AES256", "aws:kms":
+	default:
+		return nil, fmt.Errorf("unknown S3 server-side encryption %q", config.ServerSideEncryption)
+	}
+	if config.CustomerKey != nil && len(config.CustomerKey) != 32 {
+		return nil, errors.New("S3 customer keys must be 32 bytes")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	var base *url.URL
+	var err error
+	if config.Endpoint != "" {
+		base, err = url.Parse(strings.TrimSuffix(config.Endpoint, "/") + "/" + config.Bucket)
+	} else {
+		base, err = url.Parse(fmt.Sprintf("https://%s.s3.%s.amazonaws.com", config.Bucket, config.Region))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	return &S3Store{config: config, base: base}, nil
+}
+
+// Put uploads the object in one request if it fits in a part, and as a
+// multipart upload otherwise, which is aborted if any part fails
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, options PutOptions) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	buf := make([]byte, s.config.PartSize)
+	n, last, err := nextPart(br, buf)
+	if err != nil {
+		return err
+	}
+	headers := s.encryptionHeaders(true)
+	headers.Set("Content-Type", contentType(options))
+	if last {
+		_, err := s.do(ctx, http.MethodPut, key, nil, headers, buf[:n])
+		return err
+	}
+
+	body, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, headers, nil)
+	if err != nil {
+		return err
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &created); err != nil || created.UploadID == "" {
+		return fmt.Errorf("S3 didn't start a multipart upload of %s", key)
+	}
+	if err := s.uploadParts(ctx, key, created.UploadID, br, buf, n, last); err != nil {
+		query := url.Values{"uploadId": {created.UploadID}}
+		if _, abortErr := s.do(context.Background(), http.MethodDelete, key, query, nil, nil); abortErr != nil {
+			return fmt.Errorf("%w; aborting the upload also failed: %v", err, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// completedPart is a part of a multipart upload, as CompleteMultipartUpload
+// lists it
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3Store) uploadParts(ctx context.Context, key, uploadID string, r *bufio.Reader, buf []byte, n int, last bool) error {
+	var parts []completedPart
+	headers := s.encryptionHeaders(false)
+	for number := 1; ; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.request(ctx, http.MethodPut, key, query, headers, buf[:n])
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d of %s: %w", number, key, err)
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		if last {
+			break
+		}
+		if n, last, err = nextPart(r, buf); err != nil {
+			return err
+		}
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	body, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, complete)
+	if err != nil {
+		return err
+	}
+	// S3 can fail a completion after starting a 200 response
+	if bytes.Contains(body, []byte("<Error>")) {
+		return s3Error(http.MethodPost, key, http.StatusOK, body)
+	}
+	return nil
+}
+
+// Get downloads the object
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.send(ctx, http.MethodGet, key, nil, s.encryptionHeaders(false), nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, s3Error(http.MethodGet, key, resp.StatusCode, body)
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object. S3 doesn't say whether it existed, so this
+// never returns ErrNotExist.
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	_, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	return err
+}
+
+// List pages through ListObjectsV2
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("malformed S3 listing: %w", err)
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{Key: object.Key, Size: object.Size, Modified: object.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// encryptionHeaders returns the headers encrypting an object; the managed
+// encryption ones go only on requests creating objects
+func (s *S3Store) encryptionHeaders(creating bool) http.Header {
+	headers := http.Header{}
+	if creating && s.config.ServerSideEncryption != "" {
+		headers.Set("X-Amz-Server-Side-Encryption", s.config.ServerSideEncryption)
+		if s.config.KMSKeyID != "" {
+			headers.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.config.KMSKeyID)
+		}
+	}
+	if s.config.CustomerKey != nil {
+		sum := md5.Sum(s.config.CustomerKey)
+		headers.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+		headers.Set("X-Amz-Server-Side-Encryption-Customer-Key", base64.StdEncoding.EncodeToString(s.config.CustomerKey))
+		headers.Set("X-Amz-Server-Side-Encryption-Customer-Key-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return headers
+}
+
+// do sends a request and returns the body of a successful response
+func (s *S3Store) do(ctx context.Context, method, key string, query url.Values, headers http.Header, body []byte) ([]byte, error) {
+	resp, err := s.request(ctx, method, key, query, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// request sends a request and fails unless the response is a success; the
+// caller closes the body
+func (s *S3Store) request(ctx context.Context, method, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	resp, err := s.send(ctx, method, key, query, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return nil, s3Error(method, key, resp.StatusCode, data)
+	}
+	return resp, nil
+}
+
+// send signs and sends a request
+func (s *S3Store) send(ctx context.Context, method, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	u := *s.base
+	if key != "" || u.Path == "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	// Send the path escaped exactly as it is signed
+	u.RawPath = awsEscape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.config.Client.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	// Sign the host and every x-amz- header
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := now.Format("20060102") + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), now.Format("20060102"))
+	for _, part := range []string{s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes a query string the way Signature Version 4 wants
+// it: sorted, with every reserved character escaped
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, awsEscape(name, true)+"="+awsEscape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and
+// slashes unless escapeSlash
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Error turns an S3 error response into an error, ErrNotExist for
+// missing objects
+func s3Error(method, key string, status int, body []byte) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	xml.Unmarshal(body, &e)
+	if status == http.StatusNotFound && (e.Code == "" || e.Code == "NoSuchKey") {
+		return ErrNotExist
+	}
+	if e.Code == "" {
+		e.Code = http.StatusText(status)
+	}
+	return fmt.Errorf("S3 %s %s failed with status %d: %s %s", method, key, status, e.Code, e.Message)
+}
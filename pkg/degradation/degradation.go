@@ -0,0 +1,220 @@
+package degradation
+
+import (
+	"io/ioutil"
+	"monitoring/logging"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// logger reports the governor entering and leaving degraded mode
+var logger = logging.Component("pkg/degradation")
+
+// Header carries the degradation reasons on responses served in degraded mode
+const Header = "X-Search-Degraded"
+
+// Usage is the resource pressure of the process, each value in percent
+type Usage struct {
+	Memory float64
+	Disk   float64
+	CPU    float64
+}
+
+// Thresholds are the usage levels at which the engine starts degrading.
+// Crossing Critical on any resource additionally switches to cache-only serving.
+type Thresholds struct {
+	Memory   float64
+	Disk     float64
+	CPU      float64
+	Critical float64
+}
+
+// DefaultThresholds degrade at 85% usage and go cache-only at 95%
+var DefaultThresholds = Thresholds{Memory: 85, Disk: 85, CPU: 85, Critical: 95}
+
+// Policy tells the serving path which expensive behaviors to skip
+type Policy struct {
+	Degraded            bool     `json:"degraded"`
+	Reasons             []string `json:"reasons,omitempty"`
+	DisableAggregations bool     `json:"disable_aggregations"`
+	RerankWindow        int      `json:"rerank_window"`
+	CacheOnly           bool     `json:"cache_only"`
+}
+
+// RerankLimit caps a requested rerank window by the policy
+func (p Policy) RerankLimit(k int) int {
+	if p.RerankWindow > 0 && k > p.RerankWindow {
+		return p.RerankWindow
+	}
+	return k
+}
+
+// Sampler measures current resource usage
+type Sampler func() (Usage, error)
+
+// Governor samples resource usage and derives the current degradation policy
+type Governor struct {
+	thresholds     Thresholds
+	sampler        Sampler
+	degradedWindow int
+	policy         Policy
+	mutex          sync.RWMutex
+}
+
+// NewGovernor creates a governor. degradedWindow is the rerank window used
+// while degraded; a nil sampler uses SystemSampler on the working directory.
+func NewGovernor(thresholds Thresholds, sampler Sampler, degradedWindow int) *Governor {
+	if sampler == nil {
+		sampler = SystemSampler(".", 0)
+	}
+	return &Governor{
+		thresholds:     thresholds,
+		sampler:        sampler,
+		degradedWindow: degradedWindow,
+	}
+}
+
+// Check samples usage once and updates the policy
+func (g *Governor) Check() Policy {
+	usage, err := g.sampler()
+	if err != nil {
+		logger.Error("Resource sampling failed", "error", err)
+		return g.Policy()
+	}
+
+	policy := Evaluate(usage, g.thresholds, g.degradedWindow)
+
+	g.mutex.Lock()
+	if policy.Degraded != g.policy.Degraded || policy.CacheOnly != g.policy.CacheOnly {
+		logger.Warn("Degradation mode changed", "degraded", policy.Degraded, "cache_only", policy.CacheOnly, "reasons", policy.Reasons)
+	}
+	g.policy = policy
+	g.mutex.Unlock()
+	return policy
+}
+
+// Policy returns the most recently computed policy
+func (g *Governor) Policy() Policy {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.policy
+}
+
+// Run re-evaluates the policy every interval until stop is closed
+func (g *Governor) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	g.Check()
+	for {
+		select {
+		case <-ticker.C:
+			g.Check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Evaluate derives the policy for a usage sample
+func Evaluate(usage Usage, t Thresholds, degradedWindow int) Policy {
+	var policy Policy
+	critical := false
+
+	check := func(name string, value, threshold float64) {
+		if threshold <= 0 || value < threshold {
+			return
+		}
+		policy.Reasons = append(policy.Reasons, name)
+		if t.Critical > 0 && value >= t.Critical {
+			critical = true
+		}
+	}
+	check("memory", usage.Memory, t.Memory)
+	check("disk", usage.Disk, t.Disk)
+	check("cpu", usage.CPU, t.CPU)
+
+	if len(policy.Reasons) == 0 {
+		return policy
+	}
+	policy.Degraded = true
+	policy.DisableAggregations = true
+	policy.RerankWindow = degradedWindow
+	policy.CacheOnly = critical
+	return policy
+}
+
+// SystemSampler measures process memory against memoryLimit bytes (total system
+// memory when zero), disk usage of dataDir and the one-minute load average
+func SystemSampler(dataDir string, memoryLimit uint64) Sampler {
+	return func() (Usage, error) {
+		var usage Usage
+
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+		limit := memoryLimit
+		if limit == 0 {
+			limit = totalMemory()
+		}
+		if limit > 0 {
+			usage.Memory = float64(memStats.Sys) / float64(limit) * 100
+		}
+
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(dataDir, &fs); err != nil {
+			return usage, err
+		}
+		if fs.Blocks > 0 {
+			usage.Disk = float64(fs.Blocks-fs.Bavail) / float64(fs.Blocks) * 100
+		}
+
+		usage.CPU = loadAverage() / float64(runtime.NumCPU()) * 100
+		return usage, nil
+	}
+}
+
+// totalMemory reads MemTotal from /proc/meminfo
+func totalMemory() uint64 {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// loadAverage reads the one-minute load average from /proc/loadavg
+func loadAverage() float64 {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, _ := strconv.ParseFloat(fields[0], 64)
+	return load
+}
+
+// Middleware flags responses served while degraded so clients can tell a
+// reduced answer from a complete one
+func Middleware(g *Governor, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if policy := g.Policy(); policy.Degraded {
+			w.Header().Set(Header, strings.Join(policy.Reasons, ","))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,256 @@
+package domain_costs
+
+import (
+	"encoding/json"
+	"monitoring/logging"
+	"net/http"
+	"net/url"
+	"pkg/httpjson"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger reports the crawl budgets trimmed and the costs that couldn't be
+// reported
+var logger = logging.Component("pkg/domain_costs")
+
+// DomainCost is the resource usage attributed to a single source domain
+type DomainCost struct {
+	Domain     string        `json:"domain"`
+	Pages      int64         `json:"pages"`
+	CrawlBytes int64         `json:"crawl_bytes"`
+	ParseCPU   time.Duration `json:"parse_cpu_ns"`
+	IndexBytes int64         `json:"index_bytes"`
+	QueryHits  int64         `json:"query_hits"`
+	Budget     int           `json:"budget"`
+	Used       int           `json:"used"`
+}
+
+// StorageBytes is the bandwidth plus index footprint of the domain
+func (c DomainCost) StorageBytes() int64 {
+	return c.CrawlBytes + c.IndexBytes
+}
+
+// BytesPerHit is how many crawled and indexed bytes each query hit costs
+func (c DomainCost) BytesPerHit() float64 {
+	if c.QueryHits == 0 {
+		return float64(c.StorageBytes())
+	}
+	return float64(c.StorageBytes()) / float64(c.QueryHits)
+}
+
+// TrimPolicy decides which domains get their crawl budget reduced. A domain
+// that used at least MinBytes without a single query hit during the period
+// has its budget multiplied by Factor, never going below MinBudget.
+type TrimPolicy struct {
+	MinBytes  int64
+	Factor    float64
+	MinBudget int
+}
+
+// Ledger accumulates per-domain costs and enforces per-period crawl budgets.
+// The crawler keeps it and charges fetches to it; the indexer and the search
+// server record theirs through a Reporter.
+type Ledger struct {
+	domains       map[string]*DomainCost
+	defaultBudget int
+	// attributed is set once query hits are recorded, since until then
+	// every domain looks unused and none is trimmed
+	attributed bool
+	mutex      sync.Mutex
+}
+
+// NewLedger creates a ledger where every domain may crawl defaultBudget pages
+// per period. A budget of zero leaves the domain unlimited.
+func NewLedger(defaultBudget int) *Ledger {
+	return &Ledger{
+		domains:       make(map[string]*DomainCost),
+		defaultBudget: defaultBudget,
+	}
+}
+
+// Domain extracts the accounting key of a URL, or of a bare host name such
+// as www.example.com
+func Domain(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		u, err = url.Parse("//" + rawURL)
+	}
+	if err != nil || u.Hostname() == "" {
+		return rawURL
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// entry returns the cost record for the URL's domain; callers hold the mutex
+func (l *Ledger) entry(rawURL string) *DomainCost {
+	domain := Domain(rawURL)
+	cost, exists := l.domains[domain]
+	if !exists {
+		cost = &DomainCost{Domain: domain, Budget: l.defaultBudget}
+		l.domains[domain] = cost
+	}
+	return cost
+}
+
+// AllowCrawl reports whether the URL's domain has budget left this period and consumes one page of it
+func (l *Ledger) AllowCrawl(rawURL string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	cost := l.entry(rawURL)
+	if cost.Budget > 0 && cost.Used >= cost.Budget {
+		return false
+	}
+	cost.Used++
+	return true
+}
+
+// RecordCrawl records bandwidth spent fetching a page
+func (l *Ledger) RecordCrawl(rawURL string, bytes int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	cost := l.entry(rawURL)
+	cost.Pages++
+	cost.CrawlBytes += bytes
+}
+
+// RecordParse records CPU time spent parsing a page
+func (l *Ledger) RecordParse(rawURL string, cpu time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entry(rawURL).ParseCPU += cpu
+}
+
+// RecordIndex records bytes added to the index for a page
+func (l *Ledger) RecordIndex(rawURL string, bytes int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entry(rawURL).IndexBytes += bytes
+}
+
+// RecordQueryHit records that a page from the domain was returned by a query
+func (l *Ledger) RecordQueryHit(rawURL string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entry(rawURL).QueryHits++
+	l.attributed = true
+}
+
+// Add adds the costs another service recorded, as a Reporter sends them, to
+// those of their domains. Budgets and the pages used of them are the
+// ledger's own and are left alone.
+func (l *Ledger) Add(usage []DomainCost) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, u := range usage {
+		cost := l.entry(u.Domain)
+		cost.Pages += u.Pages
+		cost.CrawlBytes += u.CrawlBytes
+		cost.ParseCPU += u.ParseCPU
+		cost.IndexBytes += u.IndexBytes
+		cost.QueryHits += u.QueryHits
+		if u.QueryHits > 0 {
+			l.attributed = true
+		}
+	}
+}
+
+// Report returns all domains ordered from most to least expensive per hit
+func (l *Ledger) Report() []DomainCost {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	report := make([]DomainCost, 0, len(l.domains))
+	for _, cost := range l.domains {
+		report = append(report, *cost)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].BytesPerHit() > report[j].BytesPerHit()
+	})
+	return report
+}
+
+// EndPeriod trims the budgets of domains the policy flags as wasteful and
+// starts a new accounting period. A domain without a budget is held to
+// Factor of the pages it crawled in the period. Nothing is trimmed until
+// query hits have been recorded, so a ledger no search server reports to
+// never mistakes every domain for unused. It returns the trimmed domains.
+func (l *Ledger) EndPeriod(policy TrimPolicy) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var trimmed []string
+	for domain, cost := range l.domains {
+		if l.attributed && cost.QueryHits == 0 && cost.StorageBytes() >= policy.MinBytes && (cost.Budget == 0 || cost.Budget > policy.MinBudget) {
+			limit := cost.Budget
+			if limit == 0 {
+				limit = cost.Used
+			}
+			budget := int(float64(limit) * policy.Factor)
+			if budget < policy.MinBudget {
+				budget = policy.MinBudget
+			}
+			// A budget of zero would lift the limit instead
+			if budget < 1 {
+				budget = 1
+			}
+			logger.Info("Trimming crawl budget", "domain", domain, "from", cost.Budget, "to", budget)
+			cost.Budget = budget
+			trimmed = append(trimmed, domain)
+		}
+		cost.Pages, cost.CrawlBytes, cost.ParseCPU, cost.IndexBytes, cost.QueryHits = 0, 0, 0, 0, 0
+		cost.Used = 0
+	}
+	return trimmed
+}
+
+// SetBudget overrides the crawl budget of a domain, given as a host name or
+// any URL on it
+func (l *Ledger) SetBudget(domain string, budget int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entry(domain).Budget = budget
+}
+
+// RunPeriods ends an accounting period every interval until stop is closed
+func (l *Ledger) RunPeriods(interval time.Duration, policy TrimPolicy, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.EndPeriod(policy)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Handler serves the cost report on GET /admin/domain-costs and takes the
+// costs of other services, as a Reporter sends them, on POST
+func (l *Ledger) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/domain-costs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpjson.Write(w, http.StatusOK, l.Report())
+		case http.MethodPost:
+			var usage []DomainCost
+			if err := json.NewDecoder(r.Body).Decode(&usage); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			l.Add(usage)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
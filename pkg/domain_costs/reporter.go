@@ -0,0 +1,142 @@
+package domain_costs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultReportInterval is how often services report the costs they
+// recorded to the crawler's ledger
+const DefaultReportInterval = 10 * time.Second
+
+// Reporter records costs in a service other than the crawler, such as the
+// indexer or the search server, and sends them to the crawler's Ledger on
+// POST /admin/domain-costs
+type Reporter struct {
+	url    string
+	token  string
+	client *http.Client
+	mutex  sync.Mutex
+	usage  map[string]*DomainCost
+}
+
+// NewReporter creates a reporter sending to the ledger served at ledgerURL,
+// such as http://crawler:8090, with token as bearer token if it is set
+func NewReporter(ledgerURL, token string) *Reporter {
+	return &Reporter{
+		url:    strings.TrimSuffix(ledgerURL, "/") + "/admin/domain-costs",
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+		usage:  make(map[string]*DomainCost),
+	}
+}
+
+// entry returns the usage of the URL's domain; callers hold the mutex
+func (r *Reporter) entry(rawURL string) *DomainCost {
+	domain := Domain(rawURL)
+	cost, exists := r.usage[domain]
+	if !exists {
+		cost = &DomainCost{Domain: domain}
+		r.usage[domain] = cost
+	}
+	return cost
+}
+
+// RecordParse records CPU time spent parsing a page
+func (r *Reporter) RecordParse(rawURL string, cpu time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entry(rawURL).ParseCPU += cpu
+}
+
+// RecordIndex records bytes added to the index for a page
+func (r *Reporter) RecordIndex(rawURL string, bytes int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entry(rawURL).IndexBytes += bytes
+}
+
+// RecordQueryHit records that a page from the domain was returned by a query
+func (r *Reporter) RecordQueryHit(rawURL string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entry(rawURL).QueryHits++
+}
+
+// Flush sends the costs recorded since the last flush. Costs the ledger
+// didn't take are kept for the next one.
+func (r *Reporter) Flush() error {
+	r.mutex.Lock()
+	usage := make([]DomainCost, 0, len(r.usage))
+	for _, cost := range r.usage {
+		usage = append(usage, *cost)
+	}
+	r.usage = make(map[string]*DomainCost)
+	r.mutex.Unlock()
+	if len(usage) == 0 {
+		return nil
+	}
+
+	err := r.send(usage)
+	if err != nil {
+		r.mutex.Lock()
+		for _, u := range usage {
+			cost := r.entry(u.Domain)
+			cost.ParseCPU += u.ParseCPU
+			cost.IndexBytes += u.IndexBytes
+			cost.QueryHits += u.QueryHits
+		}
+		r.mutex.Unlock()
+	}
+	return err
+}
+
+// send posts usage to the ledger
+func (r *Reporter) send(usage []DomainCost) error {
+	body, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("domain cost ledger answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Run flushes every interval until stop is closed, then once more
+func (r *Reporter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Flush(); err != nil {
+				logger.Warn("Failed to report domain costs", "ledger", r.url, "error", err)
+			}
+		case <-stop:
+			if err := r.Flush(); err != nil {
+				logger.Warn("Failed to report domain costs", "ledger", r.url, "error", err)
+			}
+			return
+		}
+	}
+}
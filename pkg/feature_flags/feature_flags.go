@@ -0,0 +1,186 @@
+package feature_flags
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"monitoring/logging"
+	"net/http"
+	"pkg/httpjson"
+	"strings"
+	"sync"
+)
+
+// logger reports flags overridden at runtime
+var logger = logging.Component("pkg/feature_flags")
+
+// Flags gating risky engine behaviors
+const (
+	FlagNewRanker     = "new_ranker"
+	FlagNewCodec      = "new_codec"
+	FlagWANDExecution = "wand_execution"
+)
+
+// Flag describes how a feature is rolled out. RolloutPercent (0-100) is the
+// share of traffic that sees the feature when no override matches.
+type Flag struct {
+	Name           string          `json:"name"`
+	Enabled        bool            `json:"enabled"`
+	RolloutPercent float64         `json:"rollout_percent"`
+	Tenants        map[string]bool `json:"tenants,omitempty"`
+	Collections    map[string]bool `json:"collections,omitempty"`
+}
+
+// Target is what a flag is evaluated for. Key is hashed to place the request
+// in a stable rollout bucket, usually a user or session identifier.
+type Target struct {
+	Tenant     string
+	Collection string
+	Key        string
+}
+
+// Registry holds configured flags and runtime overrides set through the admin API
+type Registry struct {
+	flags     map[string]*Flag
+	overrides map[string]*Flag
+	mutex     sync.RWMutex
+}
+
+// NewRegistry creates a registry from configured flags
+func NewRegistry(flags []Flag) *Registry {
+	r := &Registry{
+		flags:     make(map[string]*Flag),
+		overrides: make(map[string]*Flag),
+	}
+	for i := range flags {
+		flag := flags[i]
+		r.flags[flag.Name] = &flag
+	}
+	return r
+}
+
+// LoadRegistry reads a JSON list of flags from a config file
+func LoadRegistry(filePath string) (*Registry, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var flags []Flag
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return nil, err
+	}
+	return NewRegistry(flags), nil
+}
+
+// Enabled evaluates a flag for the target. Tenant overrides win over
+// collection overrides, which win over the percentage rollout.
+func (r *Registry) Enabled(name string, target Target) bool {
+	r.mutex.RLock()
+	flag := r.overrides[name]
+	if flag == nil {
+		flag = r.flags[name]
+	}
+	r.mutex.RUnlock()
+
+	if flag == nil || !flag.Enabled {
+		return false
+	}
+	if enabled, ok := flag.Tenants[target.Tenant]; ok {
+		return enabled
+	}
+	if enabled, ok := flag.Collections[target.Collection]; ok {
+		return enabled
+	}
+	return bucket(name, target) < flag.RolloutPercent
+}
+
+// bucket maps the target to a stable value in [0, 100)
+func bucket(name string, target Target) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(name + "/" + target.Tenant + "/" + target.Collection + "/" + target.Key))
+	return float64(h.Sum32()%10000) / 100
+}
+
+// Override replaces a flag's configuration at runtime
+func (r *Registry) Override(flag Flag) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.overrides[flag.Name] = &flag
+	logger.Info("Feature flag overridden", "flag", flag.Name, "enabled", flag.Enabled, "rollout", flag.RolloutPercent)
+}
+
+// ClearOverride reverts a flag to its configured state
+func (r *Registry) ClearOverride(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.overrides, name)
+	logger.Info("Feature flag override cleared", "flag", name)
+}
+
+// Flags returns the effective configuration of every flag
+func (r *Registry) Flags() []Flag {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	flags := make([]Flag, 0, len(r.flags)+len(r.overrides))
+	for name, flag := range r.flags {
+		if override, ok := r.overrides[name]; ok {
+			flags = append(flags, *override)
+		} else {
+			flags = append(flags, *flag)
+		}
+	}
+	for name, override := range r.overrides {
+		if _, ok := r.flags[name]; !ok {
+			flags = append(flags, *override)
+		}
+	}
+	return flags
+}
+
+// Handler exposes the flags on /admin/flags. PUT /admin/flags/{name} sets an
+// override and DELETE /admin/flags/{name} rolls it back.
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/flags", func(w http.ResponseWriter, req *http.Request) {
+		httpjson.Write(w, http.StatusOK, r.Flags())
+	})
+	mux.HandleFunc("/admin/flags/", func(w http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(req.URL.Path, "/admin/flags/")
+		if name == "" {
+			http.Error(w, "missing flag name", http.StatusBadRequest)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodPut, http.MethodPost:
+			flag, err := decodeFlag(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			flag.Name = name
+			r.Override(flag)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			r.ClearOverride(name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// decodeFlag parses and validates a flag from a request body
+func decodeFlag(req *http.Request) (Flag, error) {
+	var flag Flag
+	if err := json.NewDecoder(req.Body).Decode(&flag); err != nil {
+		return flag, err
+	}
+	if flag.RolloutPercent < 0 || flag.RolloutPercent > 100 {
+		return flag, errors.New("rollout_percent must be between 0 and 100")
+	}
+	return flag, nil
+}
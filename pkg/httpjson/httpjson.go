@@ -0,0 +1,15 @@
+// Package httpjson writes the JSON responses of the HTTP APIs, so every
+// service answers with the same headers and encoding
+package httpjson
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Write writes v as a JSON response with the given status code
+func Write(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,220 @@
+package apikeys
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Authenticator checks the API key of every request against a KeyStore,
+// the scope the request needs and the key's rate limit
+type Authenticator struct {
+	keys *KeyStore
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket // By key ID
+}
+
+// NewAuthenticator returns an authenticator for the keys in keys
+func NewAuthenticator(keys *KeyStore) *Authenticator {
+	return &Authenticator{keys: keys, buckets: make(map[string]*bucket)}
+}
+
+// bucket is a token bucket, refilled at the key's rate up to its burst
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimitError turns a request away until the key's bucket refills
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v, retry after %s", ErrRateLimited, e.RetryAfter.Round(time.Millisecond))
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// Authenticate returns the key a token belongs to if it allows scope and
+// is within its rate limit. Failures wrap ErrUnauthenticated,
+// ErrForbidden or ErrRateLimited; the last is a *RateLimitError.
+func (a *Authenticator) Authenticate(token string, scope Scope) (Key, error) {
+	key, err := a.keys.lookup(token)
+	if err != nil {
+		return Key{}, err
+	}
+	if !key.Allows(scope) {
+		return Key{}, fmt.Errorf("%w: %s needs %s", ErrForbidden, key.ID, scope)
+	}
+	if wait := a.take(key, time.Now()); wait > 0 {
+		return Key{}, &RateLimitError{RetryAfter: wait}
+	}
+	return key, nil
+}
+
+// take spends a token from the key's bucket, or returns how long until
+// one is available
+func (a *Authenticator) take(key Key, now time.Time) time.Duration {
+	if key.RateLimit <= 0 {
+		return 0
+	}
+	burst := float64(key.Burst)
+	if burst <= 0 {
+		burst = math.Ceil(key.RateLimit)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	b, exists := a.buckets[key.ID]
+	if !exists {
+		b = &bucket{tokens: burst, updated: now}
+		a.buckets[key.ID] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*key.RateLimit)
+	b.updated = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / key.RateLimit * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// keyContext carries the key a request was authenticated with
+type keyContext struct{}
+
+// KeyFromContext returns the key a request was authenticated with by
+// Middleware or the interceptors
+func KeyFromContext(ctx context.Context) (Key, bool) {
+	key, ok := ctx.Value(keyContext{}).(Key)
+	return key, ok
+}
+
+// Token reads the API key from an authorization value: a bearer token, or
+// an Elasticsearch style "ApiKey base64(id:secret)"
+func Token(authorization string) string {
+	scheme, credentials, ok := strings.Cut(authorization, " ")
+	if !ok {
+		return ""
+	}
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		return strings.TrimSpace(credentials)
+	case strings.EqualFold(scheme, "ApiKey"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+		if err != nil {
+			return ""
+		}
+		id, secret, _ := strings.Cut(string(decoded), ":")
+		return id + "." + secret
+	}
+	return ""
+}
+
+// Middleware authenticates every request to next for the scope scopeFor
+// returns, answering 401, 403 or 429 if it may not proceed
+func (a *Authenticator) Middleware(next http.Handler, scopeFor func(r *http.Request) Scope) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := a.Authenticate(Token(r.Header.Get("Authorization")), scopeFor(r))
+		if err != nil {
+			var limited *RateLimitError
+			switch {
+			case errors.As(err, &limited):
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds()))))
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+			case errors.Is(err, ErrForbidden):
+				http.Error(w, err.Error(), http.StatusForbidden)
+			default:
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyContext{}, key)))
+	})
+}
+
+// UnaryInterceptor authenticates unary gRPC calls by the "authorization"
+// metadata, for the scope scopeFor returns for the full method name
+func (a *Authenticator) UnaryInterceptor(scopeFor func(method string) Scope) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authenticateGRPC(ctx, scopeFor(info.FullMethod))
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor authenticates streaming gRPC calls like
+// UnaryInterceptor
+func (a *Authenticator) StreamInterceptor(scopeFor func(method string) Scope) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticateGRPC(stream.Context(), scopeFor(info.FullMethod))
+		if err != nil {
+			return err
+		}
+		return handler(srv, &keyStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+func (a *Authenticator) authenticateGRPC(ctx context.Context, scope Scope) (context.Context, error) {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			token = Token(values[0])
+		}
+	}
+	key, err := a.Authenticate(token, scope)
+	switch {
+	case err == nil:
+		return context.WithValue(ctx, keyContext{}, key), nil
+	case errors.Is(err, ErrRateLimited):
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrForbidden):
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+}
+
+// keyStream is a server stream whose context carries its key
+type keyStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *keyStream) Context() context.Context {
+	return s.ctx
+}
+
+// ScopeByMethod returns the scope HTTP requests need by method: read for
+// GET and HEAD, write otherwise, and admin for paths starting with one of
+// adminPaths
+func ScopeByMethod(adminPaths ...string) func(r *http.Request) Scope {
+	return func(r *http.Request) Scope {
+		for _, prefix := range adminPaths {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				return ScopeAdmin
+			}
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return ScopeRead
+		}
+		return ScopeWrite
+	}
+}
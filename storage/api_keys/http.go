@@ -0,0 +1,79 @@
+package apikeys
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"pkg/httpjson"
+)
+
+// createResponse is the answer to POST /keys, the only time the token is
+// shown
+type createResponse struct {
+	Key
+	Token string `json:"token"`
+}
+
+// Handler manages keys over HTTP. It checks no credentials itself, so it
+// belongs behind Middleware requiring ScopeAdmin.
+//
+//	GET    /keys        every key, without secrets
+//	POST   /keys        create a key from {"name", "scopes", "rate_limit", "burst"}
+//	DELETE /keys/{id}   revoke a key
+func (s *KeyStore) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			keys, err := s.List()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, keys)
+		case http.MethodPost:
+			var spec struct {
+				Name      string  `json:"name"`
+				Scopes    []Scope `json:"scopes"`
+				RateLimit float64 `json:"rate_limit"`
+				Burst     int     `json:"burst"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&spec); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			token, key, err := s.Create(Key{Name: spec.Name, Scopes: spec.Scopes, RateLimit: spec.RateLimit, Burst: spec.Burst})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			httpjson.Write(w, http.StatusCreated, createResponse{Key: key, Token: token})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/keys/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/keys/"))
+		if err != nil || id == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.Revoke(id); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrKeyNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
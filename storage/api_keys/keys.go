@@ -0,0 +1,345 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"monitoring/logging"
+)
+
+// logger reports keys that can't be reloaded, which happens on every
+// request until the file is fixed, so it is sampled
+var logger = logging.Sampled(logging.Component("storage/api_keys"), logging.DefaultSampling)
+
+// Scope is what a key may do
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"  // Search and read documents
+	ScopeWrite Scope = "write" // Also add, change and delete documents
+	ScopeAdmin Scope = "admin" // Everything, including managing keys and indexes
+)
+
+// Errors returned, possibly wrapped, when a request is turned away
+var (
+	ErrUnauthenticated = errors.New("missing or invalid API key")
+	ErrForbidden       = errors.New("API key lacks the scope for this request")
+	ErrRateLimited     = errors.New("API key rate limit exceeded")
+	ErrKeyNotFound     = errors.New("API key not found")
+)
+
+// Key is an API key as stored. Only a hash of its secret is kept; the
+// token handed out when it is created is the only copy of the secret.
+type Key struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	Scopes []Scope `json:"scopes"`
+	// RateLimit is how many requests a second the key may make on average,
+	// and Burst how many at once; 0 means no limit. Burst defaults to the
+	// rate, rounded up.
+	RateLimit float64   `json:"rate_limit,omitempty"`
+	Burst     int       `json:"burst,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Hash is the hex SHA-256 of the secret. Secrets are random, so a fast
+	// hash is enough to keep a stolen key file from being usable.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Allows reports whether the key's scopes cover scope: admin covers
+// everything and write covers read
+func (k *Key) Allows(scope Scope) bool {
+	for _, granted := range k.Scopes {
+		switch {
+		case granted == scope, granted == ScopeAdmin:
+			return true
+		case granted == ScopeWrite && scope == ScopeRead:
+			return true
+		}
+	}
+	return false
+}
+
+// checkScopes rejects keys without scopes or with unknown ones
+func checkScopes(scopes []Scope) error {
+	if len(scopes) == 0 {
+		return errors.New("keys need at least one scope")
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeRead, ScopeWrite, ScopeAdmin:
+		default:
+			return fmt.Errorf("unknown scope %q, want read, write or admin", scope)
+		}
+	}
+	return nil
+}
+
+// ParseScopes reads a comma-separated list of scopes
+func ParseScopes(text string) ([]Scope, error) {
+	var scopes []Scope
+	for _, name := range strings.Split(text, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			scopes = append(scopes, Scope(name))
+		}
+	}
+	return scopes, checkScopes(scopes)
+}
+
+// reloadInterval is how often a KeyStore checks its file for keys other
+// processes created or revoked
+const reloadInterval = time.Second
+
+// KeyStore keeps API keys in a JSON file, so several servers can share
+// them. Keys created or revoked by another process take effect within
+// about a second.
+type KeyStore struct {
+	path string
+
+	mutex   sync.Mutex
+	keys    map[string]*Key
+	modTime time.Time // Of the file when it was last read
+	checked time.Time // When the file was last looked at
+}
+
+// OpenKeyStore loads the keys in the file at path, which need not exist
+// yet. An empty path keeps keys in memory only.
+func OpenKeyStore(path string) (*KeyStore, error) {
+	s := &KeyStore{path: path, keys: make(map[string]*Key)}
+	if path == "" {
+		return s, nil
+	}
+	if err := s.loadLocked(); err != nil {
+		return nil, err
+	}
+	s.checked = time.Now()
+	return s, nil
+}
+
+// loadLocked reads the key file, leaving the keys empty if it is missing
+func (s *KeyStore) loadLocked() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.keys = make(map[string]*Key)
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var keys []*Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("parse API keys %s: %w", s.path, err)
+	}
+	s.keys = make(map[string]*Key, len(keys))
+	for _, key := range keys {
+		s.keys[key.ID] = key
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// refreshLocked reloads the key file if it changed since it was read,
+// looking at most once every reloadInterval
+func (s *KeyStore) refreshLocked() error {
+	if s.path == "" || time.Since(s.checked) < reloadInterval {
+		return nil
+	}
+	s.checked = time.Now()
+	info, err := os.Stat(s.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if s.modTime.IsZero() {
+			return nil
+		}
+	case err != nil:
+		return err
+	case info.ModTime().Equal(s.modTime):
+		return nil
+	}
+	return s.loadLocked()
+}
+
+// saveLocked writes the keys to a temporary file and renames it over the
+// key file, so readers never see a partial one
+func (s *KeyStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.listLocked(true), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// Create adds a key with the name, scopes and rate limit of spec and
+// returns it with the token clients present, which is shown only now
+func (s *KeyStore) Create(spec Key) (string, Key, error) {
+	if err := checkScopes(spec.Scopes); err != nil {
+		return "", Key{}, err
+	}
+	if spec.RateLimit < 0 || spec.Burst < 0 {
+		return "", Key{}, errors.New("rate limits must not be negative")
+	}
+	id, err := randomString(8)
+	if err != nil {
+		return "", Key{}, err
+	}
+	secret, err := randomString(24)
+	if err != nil {
+		return "", Key{}, err
+	}
+	key := &Key{
+		ID:        id,
+		Name:      spec.Name,
+		Scopes:    append([]Scope(nil), spec.Scopes...),
+		RateLimit: spec.RateLimit,
+		Burst:     spec.Burst,
+		CreatedAt: time.Now().UTC(),
+		Hash:      hashSecret(secret),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Start from the file as it is now, so keys other processes created
+	// aren't lost
+	s.checked = time.Time{}
+	if err := s.refreshLocked(); err != nil {
+		return "", Key{}, err
+	}
+	s.keys[id] = key
+	if err := s.saveLocked(); err != nil {
+		delete(s.keys, id)
+		return "", Key{}, err
+	}
+	return id + "." + secret, withoutHash(key), nil
+}
+
+// Revoke deletes a key; requests presenting it fail from then on
+func (s *KeyStore) Revoke(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checked = time.Time{}
+	if err := s.refreshLocked(); err != nil {
+		return err
+	}
+	key, exists := s.keys[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	delete(s.keys, id)
+	if err := s.saveLocked(); err != nil {
+		s.keys[id] = key
+		return err
+	}
+	return nil
+}
+
+// List returns every key, without hashes, oldest first
+func (s *KeyStore) List() ([]Key, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.refreshLocked(); err != nil {
+		return nil, err
+	}
+	return s.listLocked(false), nil
+}
+
+func (s *KeyStore) listLocked(hashes bool) []Key {
+	keys := make([]Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		if hashes {
+			keys = append(keys, *key)
+		} else {
+			keys = append(keys, withoutHash(key))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// lookup returns the key a token belongs to
+func (s *KeyStore) lookup(token string) (Key, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return Key{}, ErrUnauthenticated
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.refreshLocked(); err != nil {
+		// Keep serving the keys already loaded
+		logger.Error("Failed to reload API keys", "error", err)
+	}
+	key, exists := s.keys[id]
+	if !exists || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashSecret(secret))) != 1 {
+		return Key{}, ErrUnauthenticated
+	}
+	return withoutHash(key), nil
+}
+
+func withoutHash(key *Key) Key {
+	k := *key
+	k.Hash = ""
+	k.Scopes = append([]Scope(nil), key.Scopes...)
+	return k
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes, base64url encoded so tokens need
+// no escaping in headers
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"monitoring/logging"
+	apikeys "storage/api_keys"
+)
+
+// logger reports why apikeys fails
+var logger = logging.Component("storage/cmd/apikeys")
+
+// apikeys manages the API keys docserver and searchd authenticate requests
+// with, for instance to create the first admin key. Servers pick up
+// changes to the key file within a second.
+//
+//	apikeys -keys keys.json create -name ingest -scopes write -rate 50
+//	apikeys -keys keys.json list
+//	apikeys -keys keys.json revoke <id>
+func main() {
+	keysPath := flag.String("keys", "keys.json", "JSON file of API keys")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-keys file] create|list|revoke ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	keys, err := apikeys.OpenKeyStore(*keysPath)
+	if err != nil {
+		fatal("Failed to open API keys", "error", err)
+	}
+
+	switch command, args := flag.Arg(0), flag.Args()[1:]; command {
+	case "create":
+		create := flag.NewFlagSet("create", flag.ExitOnError)
+		name := create.String("name", "", "what the key is for")
+		scopes := create.String("scopes", string(apikeys.ScopeRead), "comma-separated scopes: read, write or admin")
+		rate := create.Float64("rate", 0, "requests a second the key may make on average; 0 is unlimited")
+		burst := create.Int("burst", 0, "requests the key may make at once; 0 means the rate, rounded up")
+		create.Parse(args)
+		parsed, err := apikeys.ParseScopes(*scopes)
+		if err != nil {
+			fatal("Invalid scopes", "error", err)
+		}
+		token, key, err := keys.Create(apikeys.Key{Name: *name, Scopes: parsed, RateLimit: *rate, Burst: *burst})
+		if err != nil {
+			fatal("Failed to create a key", "error", err)
+		}
+		fmt.Fprintf(os.Stderr, "Created key %s; its token is shown only once:\n", key.ID)
+		fmt.Println(token)
+	case "list":
+		list, err := keys.List()
+		if err != nil {
+			fatal("Failed to list keys", "error", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tRATE\tBURST\tCREATED")
+		for _, key := range list {
+			scopes := make([]string, len(key.Scopes))
+			for i, scope := range key.Scopes {
+				scopes[i] = string(scope)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%g\t%d\t%s\n", key.ID, key.Name, strings.Join(scopes, ","),
+				key.RateLimit, key.Burst, key.CreatedAt.Format("2006-01-02 15:04"))
+		}
+		w.Flush()
+	case "revoke":
+		if len(args) != 1 {
+			fatal("Revoke takes the ID of one key", "usage", "apikeys revoke <id>")
+		}
+		if err := keys.Revoke(args[0]); err != nil {
+			fatal("Failed to revoke a key", "id", args[0], "error", err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// fatal logs why apikeys failed and exits
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"monitoring/logging"
+	documentstore "storage/document_store"
+)
+
+// logger reports why docbench fails
+var logger = logging.Component("storage/cmd/docbench")
+
+// docbench measures DocumentDB write throughput under concurrent load for
+// different shard counts, adding then updating documents from several
+// writers at once against an in-memory engine. With -bench topk it instead
+// compares the latency of top-k searches with and without pruning.
+func main() {
+	bench := flag.String("bench", "writes", "what to measure: writes or topk")
+	writers := flag.Int("writers", 8, "number of concurrent writers")
+	docs := flag.Int("docs", 20000, "documents each writer adds and then updates, or the corpus size for topk")
+	shardList := flag.String("shards", fmt.Sprintf("1,%d", documentstore.DefaultShards), "comma-separated shard counts to compare")
+	k := flag.Int("k", 10, "results per top-k search")
+	flag.Parse()
+
+	if *bench == "topk" {
+		if err := runTopK(*docs, *k); err != nil {
+			fatal("Top-k benchmark failed", "error", err)
+		}
+		return
+	}
+	if *bench != "writes" {
+		fatal("Unknown benchmark", "bench", *bench)
+	}
+
+	var counts []int
+	for _, field := range strings.Split(*shardList, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 {
+			fatal("Invalid shard count", "shards", field)
+		}
+		counts = append(counts, n)
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "SHARDS\tWRITES\tELAPSED\tWRITES/SEC")
+	for _, n := range counts {
+		writes, elapsed, err := run(n, *writers, *docs)
+		if err != nil {
+			fatal("Benchmark failed", "shards", n, "error", err)
+		}
+		fmt.Fprintf(out, "%d\t%d\t%s\t%.0f\n", n, writes, elapsed.Round(time.Millisecond), float64(writes)/elapsed.Seconds())
+	}
+	out.Flush()
+}
+
+// run times writers adding and updating docs documents each in a fresh
+// database with the given number of shards
+func run(shards, writers, docs int) (int, time.Duration, error) {
+	db, err := documentstore.OpenShardedDocumentDB(documentstore.NewMemoryEngine(), shards)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < docs; i++ {
+				doc := &documentstore.Document{
+					ID:      fmt.Sprintf("w%d-doc%d", w, i),
+					Title:   fmt.Sprintf("Document %d", i),
+					Content: "the quick brown fox jumps over the lazy dog",
+				}
+				if err := db.AddDocument(doc); err != nil {
+					errs <- err
+					return
+				}
+			}
+			for i := 0; i < docs; i++ {
+				id := fmt.Sprintf("w%d-doc%d", w, i)
+				if err := db.UpdateDocument(id, "the lazy dog sleeps through the quick brown fox"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return 0, 0, err
+	}
+	return 2 * writers * docs, elapsed, nil
+}
+
+// vocabulary is how many distinct words the top-k corpus draws from
+const vocabulary = 5000
+
+// runTopK fills a database with docs documents of words drawn from a Zipf
+// distribution, as in natural text, then times queries of increasing
+// length ranked in full and cut to k against TopK
+func runTopK(docs, k int) error {
+	db := documentstore.NewDocumentDB()
+	defer db.Close()
+	rng := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(rng, 1.1, 1, vocabulary-1)
+	word := func() string { return fmt.Sprintf("w%d", zipf.Uint64()) }
+
+	batch := make([]*documentstore.Document, 0, documentstore.DefaultBulkBatchSize)
+	for i := 0; i < docs; i++ {
+		words := make([]string, 50+rng.Intn(250))
+		for j := range words {
+			words[j] = word()
+		}
+		batch = append(batch, &documentstore.Document{
+			ID:      fmt.Sprintf("doc%07d", i),
+			Title:   word() + " " + word(),
+			Content: strings.Join(words, " "),
+		})
+		if len(batch) == cap(batch) || i == docs-1 {
+			if err := db.Bulk(batch, documentstore.BulkOptions{}).Err(); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	db.ForceMerge()
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "WORDS\tMATCHES\tFULL RANKING\tTOP-K\tSPEEDUP")
+	for _, words := range []int{1, 2, 4, 8} {
+		var queries []string
+		for q := 0; q < 20; q++ {
+			terms := make([]string, words)
+			for i := range terms {
+				// Common words make the long posting lists pruning is for
+				terms[i] = fmt.Sprintf("w%d", rng.Intn(50))
+			}
+			queries = append(queries, strings.Join(terms, " "))
+		}
+
+		matches := 0
+		start := time.Now()
+		for _, query := range queries {
+			results := db.RankedSearch(query)
+			matches += len(results)
+			if len(results) > k {
+				results = results[:k]
+			}
+		}
+		full := time.Since(start) / time.Duration(len(queries))
+		start = time.Now()
+		for _, query := range queries {
+			db.TopK(query, k)
+		}
+		top := time.Since(start) / time.Duration(len(queries))
+		fmt.Fprintf(out, "%d\t%d\t%s\t%s\t%.1fx\n", words, matches/len(queries),
+			full.Round(time.Microsecond), top.Round(time.Microsecond), float64(full)/float64(top))
+	}
+	return out.Flush()
+}
+
+// fatal logs why docbench failed and exits
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
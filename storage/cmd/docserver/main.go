@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"monitoring/logging"
+	"monitoring/metrics"
+	"monitoring/tracing"
+	"pkg/domain_costs"
+	"pkg/feature_flags"
+	apikeys "storage/api_keys"
+	documentserver "storage/document_server"
+	documentstore "storage/document_store"
+	indexcatalog "storage/index_catalog"
+	savedsearches "storage/saved_searches"
+)
+
+// logger reports what docserver serves and why it stops
+var logger = logging.Component("storage/cmd/docserver")
+
+// docserver serves a document database over HTTP and gRPC. Clients
+// authenticate with bearer tokens: the write token allows everything, the
+// read token only reads and watches. With neither set, requests are not
+// authenticated at all. With -keys, clients present API keys instead,
+// managed with the apikeys command or, by admin keys, at /keys. With
+// -saved-searches, searches saved at /saved-searches are alerted on as
+// matching documents are added. With -indices, named indices are created,
+// aliased, reindexed and deleted at /indices, and served under
+// /indices/{name}/. With -admission, edits of single documents go ahead of
+// bulk writes, and each kind of write is held to its own rate. With
+// -trace-exporter, the parsing and storing of documents written is traced
+// to an OpenTelemetry collector, joining the traces of the callers. With
+// -flags, compression of stored content and WAND pruning are rolled out by
+// feature flag, and with -keys rollouts are changed by admin keys at
+// /admin/flags. With -cost-ledger, the CPU time spent analyzing the pages
+// written and the bytes they add to the index are reported to the crawler's
+// domain cost ledger. Logs are written to standard error from the -log-level of
+// each component.
+func main() {
+	dbPath := flag.String("db", "documents.db", "Bolt database file; empty keeps documents in memory only")
+	httpAddr := flag.String("http", ":8080", "address to serve HTTP on; empty disables it")
+	grpcAddr := flag.String("grpc", ":9090", "address to serve gRPC on; empty disables it")
+	metricsAddr := flag.String("metrics", "", "address to serve Prometheus metrics on at /metrics, unauthenticated; empty disables it")
+	writeToken := flag.String("write-token", os.Getenv("DOCSERVER_WRITE_TOKEN"), "token allowing reads and writes")
+	readToken := flag.String("read-token", os.Getenv("DOCSERVER_READ_TOKEN"), "token allowing reads and watches")
+	keysPath := flag.String("keys", "", "JSON file of API keys to authenticate requests with, in place of the tokens")
+	signalsPath := flag.String("signals", "", "JSON file of ranking signals to combine, as documentstore.Signal; empty ranks by text relevance")
+	queryCacheTTL := flag.Duration("query-cache-ttl", 0, "how long query results are cached, so writes may take as long to show in repeated searches; 0 disables the cache")
+	bulkConcurrency := flag.Int("bulk-concurrency", documentserver.DefaultBulkConcurrency, "workers applying the actions of an NDJSON bulk request")
+	languages := flag.String("languages", "", "comma-separated languages (en, de, fr, es) to analyze documents in by their language metadata; empty only splits words")
+	savedSearchesPath := flag.String("saved-searches", "", "JSON file of saved searches to alert on new matching documents for; empty disables saved searches")
+	indicesDir := flag.String("indices", "", "directory of a catalog of named indices to manage and serve under /indices, with aliases; empty disables it")
+	admission := flag.Bool("admission", false, "admit edits of single documents ahead of bulk writes, throttling writes past the rates below")
+	interactiveRate := flag.Float64("interactive-rate", 0, "documents per second edits of single documents are capped at, with -admission; 0 leaves them uncapped")
+	bulkRate := flag.Float64("bulk-rate", 0, "documents per second bulk writes are capped at, with -admission; 0 leaves them uncapped")
+	bulkMaxWait := flag.Duration("bulk-max-wait", 0, "longest a bulk batch waits to be admitted before the rest of the request is throttled, with -admission; 0 waits as long as the client does")
+	alertDelay := flag.Duration("alert-delay", savedsearches.DefaultBatchDelay, "longest a new document waits to be matched against saved searches with others")
+	traceExporter := flag.String("trace-exporter", tracing.ExporterNone, "where to send trace spans: otlp-grpc, otlp-http or stdout; empty sends none but still passes trace context on")
+	traceEndpoint := flag.String("trace-endpoint", "", "host:port of the OTLP collector; empty takes OTEL_EXPORTER_OTLP_ENDPOINT or the exporter's default on localhost")
+	traceInsecure := flag.Bool("trace-insecure", false, "send spans to the OTLP collector without TLS")
+	traceSample := flag.Float64("trace-sample", tracing.DefaultConfig.SampleRatio, "share of the traces started here that are recorded, from 0 to 1; requests keep their caller's decision")
+	logLevel := flag.String("log-level", "info", "least severe level logged (debug, info, warn, error), optionally followed by levels for components, such as warn,storage/document_store=debug")
+	logFormat := flag.String("log-format", logging.FormatText, "format logs are written to standard error in: text or json")
+	flagsPath := flag.String("flags", "", "JSON file of feature flags rolling out new_codec and wand_execution by host; empty stores content uncompressed and prunes with WAND")
+	costLedger := flag.String("cost-ledger", "", "URL of the crawler serving the domain cost ledger, such as http://crawler:8090, to report parse and index costs to; empty reports none")
+	costLedgerToken := flag.String("cost-ledger-token", os.Getenv("COST_LEDGER_TOKEN"), "bearer token the crawler's admin API takes, for -cost-ledger")
+	flag.Parse()
+
+	level, levels, err := logging.ParseLevels(*logLevel)
+	if err != nil {
+		fatal("Invalid log level", "error", err)
+	}
+	if err := logging.Setup(os.Stderr, logging.Options{Level: level, Levels: levels, Format: *logFormat}); err != nil {
+		fatal("Failed to set up logging", "error", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		ServiceName: "docserver",
+		Exporter:    *traceExporter,
+		Endpoint:    *traceEndpoint,
+		Insecure:    *traceInsecure,
+		SampleRatio: *traceSample,
+	})
+	if err != nil {
+		fatal("Failed to set up tracing", "error", err)
+	}
+
+	var engine documentstore.StorageEngine = documentstore.NewMemoryEngine()
+	if *dbPath != "" {
+		bolt, err := documentstore.OpenBoltEngine(*dbPath)
+		if err != nil {
+			fatal("Failed to open the database file", "path", *dbPath, "error", err)
+		}
+		engine = bolt
+	}
+
+	// Content compressed while new_codec was enabled stays readable once it
+	// is rolled back, so the engine always decompresses
+	compress := func() bool { return false }
+	var flags *feature_flags.Registry
+	var prune func() bool // Nil to always prune with WAND
+	if *flagsPath != "" {
+		flags, err = feature_flags.LoadRegistry(*flagsPath)
+		if err != nil {
+			fatal("Failed to load feature flags", "error", err)
+		}
+		host, _ := os.Hostname()
+		compress = func() bool {
+			return flags.Enabled(feature_flags.FlagNewCodec, feature_flags.Target{Key: host})
+		}
+		prune = func() bool {
+			return flags.Enabled(feature_flags.FlagWANDExecution, feature_flags.Target{Key: host})
+		}
+	}
+	compression := documentstore.DefaultCompressionOptions
+	compression.Enabled = compress
+	engine, err = documentstore.NewCompressingEngine(engine, compression)
+	if err != nil {
+		fatal("Failed to set up compression", "error", err)
+	}
+
+	// The settings apply to the database and to every index of the catalog
+	var settings []func(*documentstore.DocumentDB)
+	stopReporting := make(chan struct{})
+	reported := make(chan struct{})
+	if *costLedger != "" {
+		reporter := domain_costs.NewReporter(*costLedger, *costLedgerToken)
+		settings = append(settings, func(db *documentstore.DocumentDB) { db.SetCostRecorder(reporter) })
+		go func() {
+			defer close(reported)
+			reporter.Run(domain_costs.DefaultReportInterval, stopReporting)
+		}()
+	} else {
+		close(reported)
+	}
+	if prune != nil {
+		settings = append(settings, func(db *documentstore.DocumentDB) { db.SetTopKPruning(prune) })
+	}
+	if *signalsPath != "" {
+		data, err := os.ReadFile(*signalsPath)
+		if err != nil {
+			fatal("Failed to read ranking signals", "error", err)
+		}
+		var signals []documentstore.Signal
+		if err := json.Unmarshal(data, &signals); err != nil {
+			fatal("Failed to parse ranking signals", "path", *signalsPath, "error", err)
+		}
+		scorer, err := documentstore.NewSignalScorer(signals)
+		if err != nil {
+			fatal("Invalid ranking signals", "path", *signalsPath, "error", err)
+		}
+		scoring := documentstore.DefaultScoringConfig
+		scoring.Scorer = scorer
+		settings = append(settings, func(db *documentstore.DocumentDB) { db.SetScoring(scoring) })
+	}
+
+	if *languages != "" {
+		analysis := documentstore.Analysis{Languages: make(map[string]*documentstore.Analyzer)}
+		for _, language := range strings.Split(*languages, ",") {
+			analyzer, ok := documentstore.LanguageAnalyzer(strings.TrimSpace(language))
+			if !ok {
+				fatal("No analyzer for language", "language", language)
+			}
+			analysis.Languages[strings.TrimSpace(language)] = analyzer
+		}
+		settings = append(settings, func(db *documentstore.DocumentDB) { db.SetAnalysis(analysis) })
+	}
+
+	if *queryCacheTTL > 0 {
+		options := documentstore.DefaultQueryCacheOptions
+		options.TTL = *queryCacheTTL
+		settings = append(settings, func(db *documentstore.DocumentDB) { db.SetQueryCache(options) })
+	}
+	configure := func(_ string, db *documentstore.DocumentDB) {
+		for _, set := range settings {
+			set(db)
+		}
+	}
+	db, err := documentstore.OpenDocumentDB(engine, settings...)
+	if err != nil {
+		fatal("Failed to open the document database", "error", err)
+	}
+
+	var authorize documentserver.Authorizer
+	var authenticator *apikeys.Authenticator
+	var keys *apikeys.KeyStore
+	switch {
+	case *keysPath != "":
+		if *writeToken != "" || *readToken != "" {
+			fatal("Use either -keys or tokens, not both")
+		}
+		keys, err = apikeys.OpenKeyStore(*keysPath)
+		if err != nil {
+			fatal("Failed to open API keys", "error", err)
+		}
+		authenticator = apikeys.NewAuthenticator(keys)
+	case *writeToken != "" || *readToken != "":
+		tokens := make(map[string][]documentserver.Operation)
+		if *readToken != "" {
+			tokens[*readToken] = []documentserver.Operation{documentserver.OpRead, documentserver.OpWatch}
+		}
+		if *writeToken != "" {
+			tokens[*writeToken] = []documentserver.Operation{documentserver.OpRead, documentserver.OpWatch, documentserver.OpWrite}
+		}
+		authorize = documentserver.TokenAuthorizer(tokens)
+	default:
+		logger.Warn("No tokens or keys set; requests are not authenticated")
+	}
+	server := documentserver.NewServer(db, authorize)
+	server.SetBulkConcurrency(*bulkConcurrency)
+	if *admission {
+		options := documentstore.DefaultAdmissionOptions
+		options.Interactive.Rate = *interactiveRate
+		options.Bulk.Rate = *bulkRate
+		options.Bulk.MaxWait = *bulkMaxWait
+		server.SetAdmission(documentstore.NewAdmission(options))
+	}
+
+	var catalog *indexcatalog.Catalog
+	if *indicesDir != "" {
+		catalog, err = indexcatalog.OpenCatalog(*indicesDir, configure)
+		if err != nil {
+			fatal("Failed to open the index catalog", "error", err)
+		}
+		server.SetIndices(catalog)
+	}
+
+	watchCtx, stopWatches := context.WithCancel(context.Background())
+	percolating := make(chan struct{})
+	if *savedSearchesPath != "" {
+		store, err := savedsearches.OpenStore(*savedSearchesPath)
+		if err != nil {
+			fatal("Failed to open saved searches", "error", err)
+		}
+		server.SetSavedSearches(store)
+		percolator := savedsearches.NewPercolator(db, store, savedsearches.Options{BatchDelay: *alertDelay})
+		go func() {
+			defer close(percolating)
+			percolator.Run(watchCtx)
+		}()
+	} else {
+		close(percolating)
+	}
+	errs := make(chan error, 3)
+	handler := server.Handler()
+	var grpcOptions []grpc.ServerOption
+	if authenticator != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/", handler)
+		mux.Handle("/keys", keys.Handler())
+		mux.Handle("/keys/", keys.Handler())
+		if flags != nil {
+			mux.Handle("/admin/flags", flags.Handler())
+			mux.Handle("/admin/flags/", flags.Handler())
+		}
+		handler = authenticator.Middleware(mux, httpScope)
+		grpcOptions = append(grpcOptions,
+			grpc.UnaryInterceptor(authenticator.UnaryInterceptor(grpcScope)),
+			grpc.StreamInterceptor(authenticator.StreamInterceptor(grpcScope)))
+	}
+	handler = tracing.Handler(handler, "docserver")
+	grpcOptions = append(grpcOptions, tracing.ServerOption())
+	var httpServer *http.Server
+	if *httpAddr != "" {
+		httpServer = &http.Server{
+			Addr:              *httpAddr,
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+			BaseContext:       func(net.Listener) context.Context { return watchCtx },
+		}
+		go func() {
+			logger.Info("Serving HTTP", "address", *httpAddr)
+			if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}()
+	}
+	grpcServer := server.GRPCServer(grpcOptions...)
+	if *grpcAddr != "" {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			fatal("Failed to listen", "address", *grpcAddr, "error", err)
+		}
+		go func() {
+			logger.Info("Serving gRPC", "address", *grpcAddr)
+			errs <- grpcServer.Serve(listener)
+		}()
+	}
+	if *metricsAddr != "" {
+		if *dbPath != "" {
+			metrics.Default.AddDataDirs(filepath.Dir(*dbPath))
+		}
+		if *indicesDir != "" {
+			metrics.Default.AddDataDirs(*indicesDir)
+		}
+		go func() {
+			logger.Info("Serving metrics", "address", *metricsAddr)
+			errs <- metrics.Serve(*metricsAddr)
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		logger.Info("Shutting down", "signal", sig.String())
+	case err := <-errs:
+		logger.Error("Server failed", "error", err)
+	}
+
+	// Watches run until their client leaves, so they are cut off rather
+	// than waited for
+	stopWatches()
+	<-percolating
+	if httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		httpServer.Shutdown(ctx)
+		cancel()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		grpcServer.Stop()
+	}
+	close(stopReporting)
+	<-reported
+	if err := db.Close(); err != nil {
+		logger.Error("Failed to close the document database", "error", err)
+	}
+	if catalog != nil {
+		if err := catalog.Close(); err != nil {
+			logger.Error("Failed to close the index catalog", "error", err)
+		}
+	}
+	// Spans still buffered are sent before exiting
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("Failed to send the last trace spans", "error", err)
+	}
+	cancel()
+}
+
+// fatal logs why docserver can't start and exits
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// scopeByMethod is the scope an API key needs for a request on the
+// database: admin to manage keys, feature flags, the full-text index and the catalog of
+// indices, otherwise by method
+var scopeByMethod = apikeys.ScopeByMethod("/admin/", "/keys", "/index/rebuild", "/index/snapshot", "/indices", "/aliases", "/reindex")
+
+// httpScope is scopeByMethod, with requests for an index of the catalog,
+// at /indices/{name}/..., needing what the same request on the database
+// would
+func httpScope(r *http.Request) apikeys.Scope {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/indices/"); ok {
+		if _, path, nested := strings.Cut(rest, "/"); nested {
+			u := *r.URL
+			u.Path = "/" + path
+			nestedRequest := *r
+			nestedRequest.URL = &u
+			return scopeByMethod(&nestedRequest)
+		}
+	}
+	return scopeByMethod(r)
+}
+
+// grpcScope is the scope an API key needs for a method of the
+// DocumentStore service: read for reads and watches, write otherwise
+func grpcScope(method string) apikeys.Scope {
+	switch method[strings.LastIndex(method, "/")+1:] {
+	case "Get", "Trash", "Search", "Watch":
+		return apikeys.ScopeRead
+	}
+	return apikeys.ScopeWrite
+}
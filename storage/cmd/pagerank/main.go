@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"monitoring/logging"
+	documentstore "storage/document_store"
+)
+
+// logger reports why pagerank fails
+var logger = logging.Component("storage/cmd/pagerank")
+
+// pagerank is the batch job scoring documents by their links. It computes
+// PageRank over the link graph of a Bolt document database and stores each
+// document's score in its metadata, for searches to weigh in through
+// ScoringConfig.MetadataBoosts. Run it while no server holds the file, for
+// instance from cron between crawls.
+func main() {
+	dbPath := flag.String("db", "documents.db", "Bolt database file")
+	damping := flag.Float64("damping", documentstore.DefaultPageRankOptions.Damping, "chance of following a link rather than jumping")
+	iterations := flag.Int("iterations", documentstore.DefaultPageRankOptions.MaxIterations, "most iterations to run")
+	tolerance := flag.Float64("tolerance", documentstore.DefaultPageRankOptions.Tolerance, "total change in scores below which to stop")
+	key := flag.String("key", documentstore.PageRankKey, "metadata key to store scores under")
+	seeds := flag.String("seeds", "", "JSON file of teleport weights by document ID, for a seeded ranking")
+	dryRun := flag.Bool("dry-run", false, "print the best scored documents instead of storing scores")
+	top := flag.Int("top", 20, "documents to print with -dry-run")
+	flag.Parse()
+
+	options := documentstore.PageRankOptions{
+		Damping:       *damping,
+		MaxIterations: *iterations,
+		Tolerance:     *tolerance,
+		MetadataKey:   *key,
+	}
+	if *seeds != "" {
+		data, err := os.ReadFile(*seeds)
+		if err != nil {
+			fatal("Failed to read seeds", "error", err)
+		}
+		if err := json.Unmarshal(data, &options.Teleport); err != nil {
+			fatal("Failed to parse seeds", "path", *seeds, "error", err)
+		}
+	}
+
+	engine, err := documentstore.OpenBoltEngine(*dbPath)
+	if err != nil {
+		fatal("Failed to open the database file", "path", *dbPath, "error", err)
+	}
+	db, err := documentstore.OpenDocumentDB(engine)
+	if err != nil {
+		fatal("Failed to open the document database", "error", err)
+	}
+	defer db.Close()
+
+	if !*dryRun {
+		result, err := db.RunPageRank(options)
+		if err != nil {
+			fatal("PageRank failed", "error", err)
+		}
+		fmt.Printf("Updated the scores of %d documents in %s\n", result.Updated, result.Took)
+		return
+	}
+
+	result, err := db.ComputePageRank(options)
+	if err != nil {
+		fatal("PageRank failed", "error", err)
+	}
+	ids := make([]string, 0, len(result.Scores))
+	for id := range result.Scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if result.Scores[ids[i]] != result.Scores[ids[j]] {
+			return result.Scores[ids[i]] > result.Scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > *top {
+		ids = ids[:*top]
+	}
+	fmt.Printf("%d documents, %d links, %d iterations, converged: %v\n",
+		result.Documents, result.Links, result.Iterations, result.Converged)
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "SCORE\tINLINKS\tID")
+	for _, id := range ids {
+		fmt.Fprintf(out, "%.4f\t%d\t%s\n", result.Scores[id], db.InlinkCount(id), id)
+	}
+	out.Flush()
+}
+
+// fatal logs why pagerank failed and exits
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"monitoring/logging"
+	"monitoring/metrics"
+	"monitoring/tracing"
+	"pkg/degradation"
+	"pkg/domain_costs"
+	"pkg/feature_flags"
+	apikeys "storage/api_keys"
+	documentserver "storage/document_server"
+	documentstore "storage/document_store"
+	queryanalytics "storage/query_analytics"
+	searchserver "storage/search_server"
+)
+
+// logger reports what searchd serves and why it stops
+var logger = logging.Component("storage/cmd/searchd")
+
+// followRetry is how long searchd waits to follow -docserver again after
+// failing to
+const followRetry = 5 * time.Second
+
+// searchd serves searches over a document database to end users as JSON
+// over HTTP, and to other services over gRPC. It only reads; documents are
+// written through docserver. With -docserver, searchd copies the documents
+// of a running docserver and follows its change feed, so searches see its
+// writes within moments. Otherwise it loads the Bolt database file -db once
+// at startup, which docserver must not have open, since Bolt locks the file
+// for the process writing it. With -keys, clients
+// present API keys, managed with the apikeys command. Searches and the
+// clicks reported on /feedback are aggregated into reports on /analytics,
+// and with -judgments kept as training data for a -rank-model re-ranking
+// the best matches. With -metrics, request rates, latencies, result counts,
+// timeouts and query cache hits are served to Prometheus. With
+// -trace-exporter, searches are traced to an OpenTelemetry collector,
+// joining the traces of the callers, and latency exemplars carry trace IDs.
+// With -degrade-at, searches skip facets and most re-ranking while memory,
+// disk or CPU use is high, and are answered from the query cache alone past
+// -cache-only-at, flagged degraded rather than failing. With -flags, the
+// re-ranking model and WAND pruning are rolled out by feature flag, and
+// rollouts are changed on /admin/flags. With -cost-ledger, the crawled
+// pages searches return are counted as hits of their domains in the
+// crawler's domain cost ledger.
+// Logs are written to standard error from the -log-level of each component.
+func main() {
+	dbPath := flag.String("db", "", "Bolt database file to search, loaded at startup, which no docserver may have open; empty searches the documents of -docserver, or none")
+	docserverURL := flag.String("docserver", "", "URL of the docserver to copy documents from and follow the changes of, such as http://docserver:8080")
+	docserverToken := flag.String("docserver-token", os.Getenv("DOCSERVER_READ_TOKEN"), "token allowing reads and watches of -docserver")
+	httpAddr := flag.String("http", ":8081", "address to serve HTTP on")
+	grpcAddr := flag.String("grpc", ":9091", "address to serve gRPC on; empty disables it")
+	metricsAddr := flag.String("metrics", "", "address to serve Prometheus metrics on at /metrics, unauthenticated; empty disables it")
+	languages := flag.String("languages", "", "comma-separated languages (en, de, fr, es) to analyze documents in by their language metadata; empty only splits words")
+	queryCacheTTL := flag.Duration("query-cache-ttl", 0, "how long query results are cached; 0 disables the cache")
+	maxLimit := flag.Int("max-limit", searchserver.DefaultOptions.MaxLimit, "most hits a page may ask for")
+	snippetLength := flag.Int("snippet-length", searchserver.DefaultOptions.SnippetLength, "characters of content shown under each hit")
+	searchTimeout := flag.Duration("search-timeout", searchserver.DefaultOptions.SearchTimeout, "longest a search runs before answering with the hits found so far")
+	queryLog := flag.String("query-log", "", "file to append a JSON line to for every search and click; empty logs none")
+	judgmentsPath := flag.String("judgments", "", "file to append clicks and skips joined to their searches to, as JSON lines for training ranking models; empty keeps none")
+	rankModel := flag.String("rank-model", "", "JSON file of linear model coefficients re-ranking the best matches by feature; empty doesn't re-rank")
+	rerankTop := flag.Int("rerank-top", documentstore.DefaultRerankTopN, "how many of the best matches -rank-model re-ranks")
+	rerankMetadata := flag.String("rerank-metadata", "", "comma-separated numeric metadata keys offered to -rank-model as metadata.<key> features")
+	degradeAt := flag.Float64("degrade-at", 0, "percent of memory, disk or CPU in use from which searches skip facets and re-rank at most -degraded-rerank matches; 0 never degrades")
+	cacheOnlyAt := flag.Float64("cache-only-at", degradation.DefaultThresholds.Critical, "percent of memory, disk or CPU in use from which searches are answered from the query cache alone, with -degrade-at set")
+	degradedRerank := flag.Int("degraded-rerank", 10, "how many of the best matches -rank-model re-ranks while degraded")
+	degradeInterval := flag.Duration("degrade-interval", 5*time.Second, "how often resource usage is sampled for -degrade-at")
+	flagsPath := flag.String("flags", "", "JSON file of feature flags rolling out new_ranker by search and wand_execution by host; empty enables both")
+	costLedger := flag.String("cost-ledger", "", "URL of the crawler serving the domain cost ledger, such as http://crawler:8090, to report search hits to; empty reports none")
+	costLedgerToken := flag.String("cost-ledger-token", os.Getenv("COST_LEDGER_TOKEN"), "bearer token the crawler's admin API takes, for -cost-ledger")
+	analyticsInterval := flag.Duration("analytics-interval", queryanalytics.DefaultInterval, "how often searches are aggregated into a report on /analytics")
+	keysPath := flag.String("keys", "", "JSON file of API keys to authenticate requests with, any scope allowing searches and admin /analytics and /admin/flags; empty serves everyone")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long in-flight searches may finish on shutdown")
+	traceExporter := flag.String("trace-exporter", tracing.ExporterNone, "where to send trace spans: otlp-grpc, otlp-http or stdout; empty sends none but still passes trace context on")
+	traceEndpoint := flag.String("trace-endpoint", "", "host:port of the OTLP collector; empty takes OTEL_EXPORTER_OTLP_ENDPOINT or the exporter's default on localhost")
+	traceInsecure := flag.Bool("trace-insecure", false, "send spans to the OTLP collector without TLS")
+	traceSample := flag.Float64("trace-sample", tracing.DefaultConfig.SampleRatio, "share of the traces started here that are recorded, from 0 to 1; requests keep their caller's decision")
+	logLevel := flag.String("log-level", "info", "least severe level logged (debug, info, warn, error), optionally followed by levels for components, such as warn,storage/document_store=debug")
+	logFormat := flag.String("log-format", logging.FormatText, "format logs are written to standard error in: text or json")
+	flag.Parse()
+
+	level, levels, err := logging.ParseLevels(*logLevel)
+	if err != nil {
+		fatal("Invalid log level", "error", err)
+	}
+	if err := logging.Setup(os.Stderr, logging.Options{Level: level, Levels: levels, Format: *logFormat}); err != nil {
+		fatal("Failed to set up logging", "error", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		ServiceName: "searchd",
+		Exporter:    *traceExporter,
+		Endpoint:    *traceEndpoint,
+		Insecure:    *traceInsecure,
+		SampleRatio: *traceSample,
+	})
+	if err != nil {
+		fatal("Failed to set up tracing", "error", err)
+	}
+
+	var engine documentstore.StorageEngine = documentstore.NewMemoryEngine()
+	if *dbPath != "" && *docserverURL != "" {
+		fatal("Use either -db or -docserver, not both")
+	}
+	if *dbPath != "" {
+		bolt, err := documentstore.OpenBoltEngine(*dbPath)
+		if err != nil {
+			fatal("Failed to open the database file", "path", *dbPath, "error", err)
+		}
+		engine = bolt
+	}
+	// docserver may have compressed content under the new_codec flag;
+	// searchd only reads, so never compresses
+	compression := documentstore.DefaultCompressionOptions
+	compression.Enabled = func() bool { return false }
+	engine, err = documentstore.NewCompressingEngine(engine, compression)
+	if err != nil {
+		fatal("Failed to set up decompression", "error", err)
+	}
+
+	// Documents are analyzed as they are loaded
+	var settings []func(*documentstore.DocumentDB)
+	if *languages != "" {
+		analysis := documentstore.Analysis{Languages: make(map[string]*documentstore.Analyzer)}
+		for _, language := range strings.Split(*languages, ",") {
+			analyzer, ok := documentstore.LanguageAnalyzer(strings.TrimSpace(language))
+			if !ok {
+				fatal("No analyzer for language", "language", language)
+			}
+			analysis.Languages[strings.TrimSpace(language)] = analyzer
+		}
+		settings = append(settings, func(db *documentstore.DocumentDB) { db.SetAnalysis(analysis) })
+	}
+	db, err := documentstore.OpenDocumentDB(engine, settings...)
+	if err != nil {
+		fatal("Failed to open the document database", "error", err)
+	}
+
+	followCtx, stopFollowing := context.WithCancel(context.Background())
+	followed := make(chan struct{})
+	if *docserverURL != "" {
+		follower := documentserver.NewFollower(*docserverURL, *docserverToken, db)
+		go func() {
+			defer close(followed)
+			follower.Run(followCtx, followRetry, func(err error) {
+				logger.Warn("Failed to follow docserver", "docserver", *docserverURL, "error", err)
+			})
+		}()
+		go func() {
+			select {
+			case <-follower.Synced():
+				logger.Info("Copied the documents of docserver", "docserver", *docserverURL, "documents", db.GetDocumentCount())
+			case <-followCtx.Done():
+			}
+		}()
+	} else {
+		close(followed)
+	}
+
+	if *queryCacheTTL > 0 {
+		options := documentstore.DefaultQueryCacheOptions
+		options.TTL = *queryCacheTTL
+		db.SetQueryCache(options)
+	}
+
+	if *rankModel != "" {
+		file, err := os.Open(*rankModel)
+		if err != nil {
+			fatal("Failed to open the rank model", "error", err)
+		}
+		model, err := documentstore.LoadLinearModel(file)
+		file.Close()
+		if err != nil {
+			fatal("Failed to load the rank model", "path", *rankModel, "error", err)
+		}
+		config := &documentstore.RerankConfig{Model: model, TopN: *rerankTop}
+		if *rerankMetadata != "" {
+			for _, key := range strings.Split(*rerankMetadata, ",") {
+				config.Metadata = append(config.Metadata, strings.TrimSpace(key))
+			}
+		}
+		if err := db.SetReranker(config); err != nil {
+			fatal("Failed to re-rank with the model", "error", err)
+		}
+	}
+
+	options := searchserver.DefaultOptions
+	options.MaxLimit = *maxLimit
+	options.SnippetLength = *snippetLength
+	options.SearchTimeout = *searchTimeout
+	search := searchserver.NewServer(db, options)
+	if *metricsAddr != "" {
+		search.SetMetrics(searchserver.NewPrometheusMetrics(nil, db))
+	}
+	stopReporting := make(chan struct{})
+	reported := make(chan struct{})
+	if *costLedger != "" {
+		reporter := domain_costs.NewReporter(*costLedger, *costLedgerToken)
+		search.SetHitRecorder(reporter)
+		go func() {
+			defer close(reported)
+			reporter.Run(domain_costs.DefaultReportInterval, stopReporting)
+		}()
+	} else {
+		close(reported)
+	}
+
+	analyticsOptions := queryanalytics.Options{Interval: *analyticsInterval}
+	if *queryLog != "" {
+		file, err := os.OpenFile(*queryLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			fatal("Failed to open the query log", "error", err)
+		}
+		defer file.Close()
+		analyticsOptions.Log = file
+	}
+	if *judgmentsPath != "" {
+		file, err := os.OpenFile(*judgmentsPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			fatal("Failed to open the judgments file", "error", err)
+		}
+		defer file.Close()
+		analyticsOptions.Judgments = queryanalytics.NewJudgmentLog(file)
+	}
+	analytics := queryanalytics.New(analyticsOptions)
+	analytics.Start()
+	search.SetAnalytics(analytics)
+
+	mux := http.NewServeMux()
+	mux.Handle("/analytics", analytics.Handler())
+	mux.Handle("/", search.Handler())
+	if *flagsPath != "" {
+		flags, err := feature_flags.LoadRegistry(*flagsPath)
+		if err != nil {
+			fatal("Failed to load feature flags", "error", err)
+		}
+		host, _ := os.Hostname()
+		db.SetTopKPruning(func() bool {
+			return flags.Enabled(feature_flags.FlagWANDExecution, feature_flags.Target{Key: host})
+		})
+		search.SetFeatureFlags(flags)
+		mux.Handle("/admin/flags", flags.Handler())
+		mux.Handle("/admin/flags/", flags.Handler())
+	}
+	var handler http.Handler = mux
+
+	stopGovernor := make(chan struct{})
+	if *degradeAt > 0 {
+		dataDir := "."
+		if *dbPath != "" {
+			dataDir = filepath.Dir(*dbPath)
+		}
+		thresholds := degradation.Thresholds{Memory: *degradeAt, Disk: *degradeAt, CPU: *degradeAt, Critical: *cacheOnlyAt}
+		governor := degradation.NewGovernor(thresholds, degradation.SystemSampler(dataDir, 0), *degradedRerank)
+		go governor.Run(*degradeInterval, stopGovernor)
+		search.SetDegradation(governor)
+		handler = degradation.Middleware(governor, handler)
+	}
+	var grpcOptions []grpc.ServerOption
+	if *keysPath != "" {
+		keys, err := apikeys.OpenKeyStore(*keysPath)
+		if err != nil {
+			fatal("Failed to open API keys", "error", err)
+		}
+		authenticator := apikeys.NewAuthenticator(keys)
+		read := func(string) apikeys.Scope { return apikeys.ScopeRead }
+		handler = authenticator.Middleware(handler, func(r *http.Request) apikeys.Scope {
+			// The queries of every user and the rollouts are only for admins
+			if p := path.Clean(r.URL.Path); p == "/analytics" || strings.HasPrefix(p, "/admin/") {
+				return apikeys.ScopeAdmin
+			}
+			return apikeys.ScopeRead
+		})
+		grpcOptions = append(grpcOptions,
+			grpc.UnaryInterceptor(authenticator.UnaryInterceptor(read)),
+			grpc.StreamInterceptor(authenticator.StreamInterceptor(read)))
+	}
+	handler = tracing.Handler(handler, "searchd")
+	grpcOptions = append(grpcOptions, tracing.ServerOption())
+	server := &http.Server{
+		Addr:              *httpAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+	errs := make(chan error, 3)
+	go func() {
+		logger.Info("Serving searches", "address", *httpAddr)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			errs <- err
+		}
+	}()
+	grpcServer := search.GRPCServer(grpcOptions...)
+	if *grpcAddr != "" {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			fatal("Failed to listen", "address", *grpcAddr, "error", err)
+		}
+		go func() {
+			logger.Info("Serving gRPC", "address", *grpcAddr)
+			errs <- grpcServer.Serve(listener)
+		}()
+	}
+	if *metricsAddr != "" {
+		if *dbPath != "" {
+			metrics.Default.AddDataDirs(filepath.Dir(*dbPath))
+		}
+		go func() {
+			logger.Info("Serving metrics", "address", *metricsAddr)
+			errs <- metrics.Serve(*metricsAddr)
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		logger.Info("Shutting down", "signal", sig.String())
+	case err := <-errs:
+		logger.Error("Server failed", "error", err)
+	}
+
+	// Searches in flight are let finish; new connections are refused
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("Searches still running were cut off", "timeout", *shutdownTimeout, "error", err)
+	}
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(*shutdownTimeout):
+		// Streams left running are cut off
+		grpcServer.Stop()
+	}
+	close(stopGovernor)
+	close(stopReporting)
+	<-reported
+	stopFollowing()
+	<-followed
+	analytics.Close()
+	if err := db.Close(); err != nil {
+		logger.Error("Failed to close the document database", "error", err)
+	}
+	// Spans still buffered are sent before exiting
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("Failed to send the last trace spans", "error", err)
+	}
+	cancel()
+}
+
+// fatal logs why searchd can't start and exits
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
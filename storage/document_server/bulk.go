@@ -0,0 +1,363 @@
+package documentserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sync"
+
+	"pkg/httpjson"
+	documentstore "storage/document_store"
+)
+
+// DefaultBulkConcurrency is how many workers apply the actions of an NDJSON
+// bulk request unless SetBulkConcurrency says otherwise
+const DefaultBulkConcurrency = 4
+
+// bulkChunkSize is how many actions of an NDJSON bulk request are read
+// before they are applied, bounding the memory a request holds
+const bulkChunkSize = 1000
+
+// Actions of an NDJSON bulk request
+const (
+	bulkIndex  = "index"  // Add or replace a document
+	bulkCreate = "create" // Add a document, failing if it exists
+	bulkUpdate = "update" // Apply a JSON merge patch
+	bulkDelete = "delete" // Move a document to the trash
+)
+
+// bulkDeleted is the status of a deleted document, alongside
+// documentstore.BulkCreated, BulkUpdated and BulkFailed
+const bulkDeleted = "deleted"
+
+// bulkItem reports what became of one action of an NDJSON bulk request
+type bulkItem struct {
+	Index  int    `json:"index"` // Position among the request's actions
+	Action string `json:"action"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Set when the document was stored as a link to a duplicate's content
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+// bulkResponse is the answer to an NDJSON bulk request, listing every
+// action read, in request order
+type bulkResponse struct {
+	Created int        `json:"created"`
+	Updated int        `json:"updated"`
+	Deleted int        `json:"deleted"`
+	Failed  int        `json:"failed"`
+	Items   []bulkItem `json:"items"`
+	// Error is why reading the request stopped early. The actions before
+	// it were applied.
+	Error string `json:"error,omitempty"`
+}
+
+// bulkAction is one parsed action, with its document or patch
+type bulkAction struct {
+	index  int
+	action string
+	id     string
+	doc    *documentstore.Document // For index and create
+	patch  []byte                  // For update
+	err    string                  // Why the action fails without being tried
+}
+
+// SetBulkConcurrency sets how many workers apply the actions of an NDJSON
+// bulk request; 0 means DefaultBulkConcurrency. Actions on the same
+// document are always applied in request order.
+func (s *Server) SetBulkConcurrency(n int) {
+	if n <= 0 {
+		n = DefaultBulkConcurrency
+	}
+	s.mutex.Lock()
+	s.bulkConcurrency = n
+	s.mutex.Unlock()
+}
+
+// isNDJSON reports whether a bulk request body holds actions rather than a
+// JSON array of documents, peeking at it without consuming it
+func isNDJSON(r *http.Request, body *bufio.Reader) bool {
+	if r.Header.Get("Content-Type") == "application/x-ndjson" {
+		return true
+	}
+	for i := 1; ; i++ {
+		peeked, err := body.Peek(i)
+		if err != nil || len(peeked) < i {
+			return false
+		}
+		switch c := peeked[i-1]; c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return c == '{'
+		}
+	}
+}
+
+// serveNDJSONBulk applies a bulk request of NDJSON action lines, each
+// followed by a document for index and create and by {"doc": patch} for
+// update:
+//
+//	{"index": {"_id": "a"}}
+//	{"title": "A", "content": "..."}
+//	{"update": {"_id": "b"}}
+//	{"doc": {"metadata": {"lang": "en"}}}
+//	{"delete": {"_id": "c"}}
+//
+// Actions are read and applied a chunk at a time, so a request's documents
+// aren't all held in memory at once. A failed action doesn't stop the
+// rest; a malformed action line does, since the lines after it can't be
+// told apart.
+func (s *Server) serveNDJSONBulk(ctx context.Context, w http.ResponseWriter, body io.Reader) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64<<10), maxBodyBytes)
+	line := 0
+	next := func() ([]byte, bool) {
+		for scanner.Scan() {
+			line++
+			if text := bytes.TrimSpace(scanner.Bytes()); len(text) > 0 {
+				return text, true
+			}
+		}
+		return nil, false
+	}
+
+	resp := bulkResponse{Items: []bulkItem{}}
+	var chunk []bulkAction
+	// Each chunk is read in a parse span of its own, before it is stored
+	_, parsing := tracer.Start(ctx, "parse")
+	for {
+		text, ok := next()
+		if !ok {
+			break
+		}
+		action, err := parseBulkAction(text, len(resp.Items)+len(chunk))
+		if err != nil {
+			resp.Error = fmt.Sprintf("line %d: %v", line, err)
+			break
+		}
+		if action.action != bulkDelete {
+			source, ok := next()
+			if !ok {
+				resp.Error = fmt.Sprintf("line %d: %s action without its document", line, action.action)
+				break
+			}
+			action.parseSource(source)
+		}
+		chunk = append(chunk, action)
+		if len(chunk) == bulkChunkSize {
+			parsing.End()
+			s.applyBulk(ctx, chunk, &resp)
+			chunk = chunk[:0]
+			_, parsing = tracer.Start(ctx, "parse")
+		}
+	}
+	if err := scanner.Err(); err != nil && resp.Error == "" {
+		resp.Error = fmt.Sprintf("line %d: %v", line+1, err)
+	}
+	parsing.End()
+	s.applyBulk(ctx, chunk, &resp)
+
+	status := http.StatusOK
+	if resp.Error != "" {
+		status = http.StatusBadRequest
+	}
+	httpjson.Write(w, status, resp)
+}
+
+// parseBulkAction reads an action line such as {"index": {"_id": "a"}}
+func parseBulkAction(text []byte, index int) (bulkAction, error) {
+	var line map[string]struct {
+		ID  string `json:"_id"`
+		Alt string `json:"id"`
+	}
+	if err := json.Unmarshal(text, &line); err != nil {
+		return bulkAction{}, fmt.Errorf("malformed action: %v", err)
+	}
+	if len(line) != 1 {
+		return bulkAction{}, errors.New("an action line must hold one action")
+	}
+	action := bulkAction{index: index}
+	for name, target := range line {
+		action.action, action.id = name, target.ID
+		if action.id == "" {
+			action.id = target.Alt
+		}
+	}
+	switch action.action {
+	case bulkIndex, bulkCreate:
+	case bulkUpdate, bulkDelete:
+		if action.id == "" {
+			return bulkAction{}, fmt.Errorf("%s action without an _id", action.action)
+		}
+	default:
+		return bulkAction{}, fmt.Errorf("unknown action %q, want index, create, update or delete", action.action)
+	}
+	return action, nil
+}
+
+// parseSource reads the line following an index, create or update action,
+// failing the action if it is malformed
+func (a *bulkAction) parseSource(text []byte) {
+	if a.action == bulkUpdate {
+		var update struct {
+			Doc json.RawMessage `json:"doc"`
+		}
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&update); err != nil || len(update.Doc) == 0 {
+			a.err = `an update must be {"doc": patch}`
+			return
+		}
+		a.patch = update.Doc
+		return
+	}
+	var doc documentstore.Document
+	if err := json.Unmarshal(text, &doc); err != nil {
+		a.err = fmt.Sprintf("malformed document: %v", err)
+		return
+	}
+	switch {
+	case doc.ID == "":
+		doc.ID = a.id
+	case a.id == "":
+		a.id = doc.ID
+	case doc.ID != a.id:
+		a.err = fmt.Sprintf("document ID %q doesn't match the action's %q", doc.ID, a.id)
+		return
+	}
+	if doc.ID == "" {
+		a.err = errMissingID.Error()
+		return
+	}
+	a.doc = &doc
+}
+
+// applyBulk applies a chunk of actions and adds their items to resp.
+// Actions are spread over workers by document ID, so each worker applies
+// the actions on its documents in order.
+func (s *Server) applyBulk(ctx context.Context, actions []bulkAction, resp *bulkResponse) {
+	if len(actions) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	workers := s.bulkConcurrency
+	s.mutex.Unlock()
+	partitions := make([][]int, workers)
+	for i, action := range actions {
+		h := fnv.New32a()
+		h.Write([]byte(action.id))
+		worker := int(h.Sum32() % uint32(workers))
+		partitions[worker] = append(partitions[worker], i)
+	}
+	items := make([]bulkItem, len(actions))
+	var wg sync.WaitGroup
+	for _, positions := range partitions {
+		if len(positions) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(positions []int) {
+			defer wg.Done()
+			s.applyBulkPartition(ctx, actions, positions, items)
+		}(positions)
+	}
+	wg.Wait()
+
+	for _, item := range items {
+		switch item.Status {
+		case documentstore.BulkCreated:
+			resp.Created++
+		case documentstore.BulkUpdated:
+			resp.Updated++
+		case bulkDeleted:
+			resp.Deleted++
+		default:
+			resp.Failed++
+		}
+	}
+	resp.Items = append(resp.Items, items...)
+}
+
+// applyBulkPartition applies the actions at positions in turn, filling in
+// their items. Runs of adds are written together through Bulk; a run ends
+// when an action touches a document already in it.
+func (s *Server) applyBulkPartition(ctx context.Context, actions []bulkAction, positions []int, items []bulkItem) {
+	var run []int
+	var upsert bool
+	pending := make(map[string]bool)
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		docs := make([]*documentstore.Document, len(run))
+		for j, i := range run {
+			docs[j] = actions[i].doc
+		}
+		report := s.storeBulk(ctx, docs, upsert)
+		for j, i := range run {
+			items[i].Status = report.Items[j].Status
+			items[i].Error = report.Items[j].Error
+			items[i].DuplicateOf = report.Items[j].DuplicateOf
+		}
+		run = run[:0]
+		pending = make(map[string]bool)
+	}
+
+	for _, i := range positions {
+		action := &actions[i]
+		item := &items[i]
+		*item = bulkItem{Index: action.index, Action: action.action, ID: action.id, Status: documentstore.BulkFailed}
+		if action.err != "" {
+			item.Error = action.err
+			continue
+		}
+		if pending[action.id] {
+			flush()
+		}
+		switch action.action {
+		case bulkIndex, bulkCreate:
+			if len(run) > 0 && upsert != (action.action == bulkIndex) {
+				flush()
+			}
+			upsert = action.action == bulkIndex
+			run = append(run, i)
+			pending[action.id] = true
+		case bulkUpdate, bulkDelete:
+			release, err := s.admit(ctx, documentstore.LaneBulk, 1)
+			if err != nil {
+				item.Error = err.Error()
+				continue
+			}
+			s.applyBulkEdit(ctx, action, item)
+			release()
+		}
+	}
+	flush()
+}
+
+// applyBulkEdit applies an update or delete action, filling in its item
+func (s *Server) applyBulkEdit(ctx context.Context, action *bulkAction, item *bulkItem) {
+	switch action.action {
+	case bulkUpdate:
+		if _, err := s.patchDocument(ctx, action.id, action.patch); err != nil {
+			item.Error = err.Error()
+			return
+		}
+		item.Status = documentstore.BulkUpdated
+	case bulkDelete:
+		if err := store(ctx, "delete", action.id, func() error { return s.db.DeleteDocument(action.id) }); err != nil {
+			item.Error = err.Error()
+			return
+		}
+		item.Status = bulkDeleted
+	}
+}
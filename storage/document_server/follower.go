@@ -0,0 +1,217 @@
+package documentserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	documentstore "storage/document_store"
+)
+
+// Headers of GET /watch, see Server.watch
+const (
+	headerChangeFeed = "X-Change-Feed"
+	headerChangeSeq  = "X-Change-Seq"
+)
+
+// followPageSize is how many documents a Follower copies a request
+const followPageSize = 500
+
+// errResync ends a follow whose changes are no longer kept, or whose feed
+// started over, so the documents are copied again
+var errResync = errors.New("the change feed can't be resumed; copying the documents again")
+
+// Follower keeps a database a copy of the documents a docserver serves, so
+// a process that only reads, such as searchd, sees the writes docserver
+// takes without opening the database file docserver holds. It copies every
+// document, then applies the server's change feed, copying again whenever
+// the feed can't be resumed.
+type Follower struct {
+	url    string
+	token  string
+	client *http.Client
+	db     *documentstore.DocumentDB
+	feed   string // Empty until the documents are copied
+	seq    uint64 // Last change of feed applied
+	synced chan struct{}
+	once   sync.Once
+}
+
+// NewFollower creates a follower copying the documents of the docserver at
+// serverURL, such as http://docserver:8080, into db, with token as bearer
+// token if it is set. The token needs the read and watch operations.
+func NewFollower(serverURL, token string, db *documentstore.DocumentDB) *Follower {
+	return &Follower{
+		url:    strings.TrimSuffix(serverURL, "/"),
+		token:  token,
+		client: &http.Client{},
+		db:     db,
+		synced: make(chan struct{}),
+	}
+}
+
+// Synced is closed once the documents have been copied the first time
+func (f *Follower) Synced() <-chan struct{} {
+	return f.synced
+}
+
+// Run follows the server until ctx is done. Errors, after which it tries
+// again every retry, are passed to onError.
+func (f *Follower) Run(ctx context.Context, retry time.Duration, onError func(error)) {
+	for ctx.Err() == nil {
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			// The server ended the feed, as it does with a watcher that
+			// falls behind; resume at once
+			continue
+		}
+		onError(err)
+		if errors.Is(err, errResync) {
+			continue
+		}
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// follow applies the change feed until it ends, copying the documents first
+// when the feed is new
+func (f *Follower) follow(ctx context.Context) error {
+	params := url.Values{}
+	if f.feed != "" {
+		params.Set("since", strconv.FormatUint(f.seq, 10))
+	}
+	resp, err := f.get(ctx, "/watch", params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	feed := resp.Header.Get(headerChangeFeed)
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		f.feed = ""
+		return errResync
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("watching %s: %s", f.url, resp.Status)
+	case f.feed != "" && feed != f.feed:
+		f.feed = ""
+		return errResync
+	}
+
+	if f.feed == "" {
+		// The changes made while copying are replayed from the stream
+		// opened before; replaying a change the copy has is harmless
+		seq, err := strconv.ParseUint(resp.Header.Get(headerChangeSeq), 10, 64)
+		if err != nil {
+			return fmt.Errorf("watching %s: bad %s header: %w", f.url, headerChangeSeq, err)
+		}
+		if err := f.copy(ctx); err != nil {
+			return err
+		}
+		f.once.Do(func() { close(f.synced) })
+		f.feed, f.seq = feed, seq
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), maxBodyBytes)
+	for scanner.Scan() {
+		var event documentstore.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("watching %s: %w", f.url, err)
+		}
+		if err := f.apply(event); err != nil {
+			return err
+		}
+		f.seq = event.Seq
+	}
+	return scanner.Err()
+}
+
+// copy replaces the documents of the database with the server's
+func (f *Follower) copy(ctx context.Context) error {
+	copied := make(map[string]bool)
+	cursor := ""
+	for {
+		params := url.Values{"limit": {strconv.Itoa(followPageSize)}}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		resp, err := f.get(ctx, "/documents", params)
+		if err != nil {
+			return err
+		}
+		var page documentstore.Page
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		} else {
+			err = errors.New(resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("copying the documents of %s: %w", f.url, err)
+		}
+
+		docs := make([]*documentstore.Document, 0, len(page.Results))
+		for _, result := range page.Results {
+			docs = append(docs, result.Document)
+			copied[result.Document.ID] = true
+		}
+		if err := f.db.Replicate(docs); err != nil {
+			return err
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	for _, doc := range f.db.ListDocuments() {
+		if !copied[doc.ID] {
+			if err := f.db.PurgeDocument(doc.ID); err != nil && !errors.Is(err, documentstore.ErrNotFound) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// apply makes one change of the feed to the database
+func (f *Follower) apply(event documentstore.Event) error {
+	if event.Type == documentstore.EventDelete {
+		err := f.db.PurgeDocument(event.ID)
+		if err != nil && !errors.Is(err, documentstore.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	return f.db.Replicate([]*documentstore.Document{event.Document})
+}
+
+// get sends an authenticated GET request to the server
+func (f *Follower) get(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	target := f.url + path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	return f.client.Do(req)
+}
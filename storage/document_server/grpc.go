@@ -0,0 +1,375 @@
+package documentserver
+
+//go:generate protoc --go_out=. --go_opt=module=storage/document_server --go-grpc_out=. --go-grpc_opt=module=storage/document_server document_store.proto
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"storage/document_server/documentpb"
+	documentstore "storage/document_store"
+)
+
+// GRPCServer returns a gRPC server with the DocumentStore service of
+// document_store.proto registered, ready to Serve. Interceptors, TLS and
+// other options are passed through to grpc.NewServer.
+func (s *Server) GRPCServer(options ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(options...)
+	documentpb.RegisterDocumentStoreServer(server, &grpcServer{s: s})
+	return server
+}
+
+// grpcServer serves the DocumentStore service of document_store.proto with
+// a Server
+type grpcServer struct {
+	documentpb.UnimplementedDocumentStoreServer
+	s *Server
+}
+
+func (g *grpcServer) Get(ctx context.Context, req *documentpb.GetRequest) (*documentpb.Document, error) {
+	var doc *documentstore.Document
+	err := g.call(ctx, OpRead, req.GetId(), func(context.Context) (err error) {
+		doc, err = g.s.getDocument(req.GetId(), req.GetFields())
+		return err
+	})
+	return documentToProto(doc), err
+}
+
+func (g *grpcServer) Add(ctx context.Context, req *documentpb.Document) (*documentpb.Document, error) {
+	var doc *documentstore.Document
+	parse(ctx, func() error {
+		doc = documentFromProto(req)
+		return nil
+	})
+	err := g.call(ctx, OpWrite, "", func(ctx context.Context) (err error) {
+		doc, err = g.s.addDocument(ctx, doc)
+		return err
+	})
+	return documentToProto(doc), err
+}
+
+func (g *grpcServer) Update(ctx context.Context, req *documentpb.UpdateRequest) (*documentpb.Document, error) {
+	var doc *documentstore.Document
+	err := g.call(ctx, OpWrite, req.GetId(), func(ctx context.Context) (err error) {
+		doc, err = g.s.updateDocument(ctx, req.GetId(), req.GetContent(), req.GetExpectedVersion())
+		return err
+	})
+	return documentToProto(doc), err
+}
+
+func (g *grpcServer) Patch(ctx context.Context, req *documentpb.PatchRequest) (*documentpb.Document, error) {
+	var doc *documentstore.Document
+	err := g.call(ctx, OpWrite, req.GetId(), func(ctx context.Context) (err error) {
+		doc, err = g.s.patchDocument(ctx, req.GetId(), req.GetPatch())
+		return err
+	})
+	return documentToProto(doc), err
+}
+
+func (g *grpcServer) Delete(ctx context.Context, req *documentpb.DeleteRequest) (*documentpb.DeleteResponse, error) {
+	id := req.GetId()
+	err := g.call(ctx, OpWrite, id, func(ctx context.Context) error {
+		return store(ctx, "delete", id, func() error { return g.s.db.DeleteDocument(id) })
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &documentpb.DeleteResponse{}, nil
+}
+
+func (g *grpcServer) Recover(ctx context.Context, req *documentpb.RecoverRequest) (*documentpb.Document, error) {
+	id := req.GetId()
+	var doc *documentstore.Document
+	err := g.call(ctx, OpWrite, id, func(ctx context.Context) error {
+		return store(ctx, "recover", id, func() (err error) {
+			doc, err = g.s.db.RecoverDocument(id)
+			return err
+		})
+	})
+	return documentToProto(doc), err
+}
+
+func (g *grpcServer) Purge(ctx context.Context, req *documentpb.PurgeRequest) (*documentpb.DeleteResponse, error) {
+	id := req.GetId()
+	err := g.call(ctx, OpWrite, id, func(ctx context.Context) error {
+		return store(ctx, "purge", id, func() error { return g.s.db.PurgeDocument(id) })
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &documentpb.DeleteResponse{}, nil
+}
+
+func (g *grpcServer) Trash(ctx context.Context, req *documentpb.TrashRequest) (*documentpb.TrashResponse, error) {
+	var docs []*documentstore.Document
+	err := g.call(ctx, OpRead, "", func(context.Context) error {
+		docs = g.s.db.Trash()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &documentpb.TrashResponse{Documents: documentsToProto(docs)}, nil
+}
+
+// Bulk writes the documents of a request, admitting its own batches
+func (g *grpcServer) Bulk(ctx context.Context, req *documentpb.BulkRequest) (*documentpb.BulkReport, error) {
+	var docs []*documentstore.Document
+	parse(ctx, func() error {
+		for _, doc := range req.GetDocuments() {
+			docs = append(docs, documentFromProto(doc))
+		}
+		return nil
+	})
+	if err := g.s.allowGRPC(ctx, OpWrite, ""); err != nil {
+		return nil, err
+	}
+	return bulkReportToProto(g.s.storeBulk(ctx, docs, req.GetUpsert())), nil
+}
+
+func (g *grpcServer) Search(ctx context.Context, req *documentpb.SearchRequest) (*documentpb.SearchResponse, error) {
+	var page documentstore.Page
+	err := g.call(ctx, OpRead, "", func(context.Context) error {
+		options := documentstore.SearchOptions{
+			Limit:    int(req.GetLimit()),
+			Offset:   int(req.GetOffset()),
+			Cursor:   req.GetCursor(),
+			SortBy:   documentstore.SortField(req.GetSort()),
+			Reverse:  req.GetReverse(),
+			Fields:   req.GetFields(),
+			GeoField: req.GetGeoField(),
+		}
+		facets, err := parseFacets(req.GetFacets())
+		if err != nil {
+			return err
+		}
+		options.Facets = facets
+		if options.Origin, err = parseOrigin(req.GetOrigin()); err != nil {
+			return err
+		}
+		page, err = g.s.page(req.GetQuery(), options)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return searchResponseToProto(page), nil
+}
+
+// Watch streams change events until the client cancels or the feed ends,
+// which it does when the client falls behind or the store closes; the
+// client should then watch again from the last sequence number it received
+func (g *grpcServer) Watch(req *documentpb.WatchRequest, stream documentpb.DocumentStore_WatchServer) error {
+	ctx := stream.Context()
+	if err := g.s.allowGRPC(ctx, OpWatch, ""); err != nil {
+		return err
+	}
+	since := g.s.db.ChangeSeq()
+	if req.Since != nil {
+		since = req.GetSince()
+	}
+	events, err := g.s.db.Watch(ctx, since)
+	if err != nil {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	for event := range events {
+		if err := stream.Send(eventToProto(event)); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Unavailable, "change feed ended; watch again from the last sequence number received")
+}
+
+// call runs a unary call authorized for operation, and for document id if
+// the call names one. Writes are admitted in the interactive lane; Bulk
+// admits its own batches, so it doesn't go through call.
+func (g *grpcServer) call(ctx context.Context, operation Operation, id string, call func(ctx context.Context) error) error {
+	if err := g.s.allowGRPC(ctx, operation, id); err != nil {
+		return err
+	}
+	if operation == OpWrite {
+		release, err := g.s.admit(ctx, documentstore.LaneInteractive, 1)
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		} else if err != nil {
+			return grpcError(err)
+		}
+		defer release()
+	}
+	if err := call(ctx); err != nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+// allowGRPC authorizes a call with the bearer token in its "authorization"
+// metadata
+func (s *Server) allowGRPC(ctx context.Context, operation Operation, id string) error {
+	var credentials string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			credentials = bearerToken(values[0])
+		}
+	}
+	err := s.authorize(ctx, AuthRequest{
+		Credentials: credentials,
+		Operation:   operation,
+		DocumentID:  id,
+		Transport:   "grpc",
+	})
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	default:
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+}
+
+// grpcError turns a store error into a status with the code that fits it
+func grpcError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, documentstore.ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, documentstore.ErrAlreadyExists), errors.Is(err, documentstore.ErrDuplicateContent):
+		code = codes.AlreadyExists
+	case errors.Is(err, documentstore.ErrVersionConflict):
+		code = codes.Aborted
+	case errors.Is(err, documentstore.ErrInvalidDocument), errors.Is(err, errBadRequest):
+		code = codes.InvalidArgument
+	case errors.Is(err, documentstore.ErrThrottled):
+		code = codes.ResourceExhausted
+	}
+	return status.Error(code, err.Error())
+}
+
+// documentToProto encodes a document, or returns nil for nil
+func documentToProto(doc *documentstore.Document) *documentpb.Document {
+	if doc == nil {
+		return nil
+	}
+	return &documentpb.Document{
+		Id:          doc.ID,
+		Title:       doc.Title,
+		Content:     doc.Content,
+		Metadata:    doc.Metadata,
+		CreatedAt:   unixNano(doc.CreatedAt),
+		UpdatedAt:   unixNano(doc.UpdatedAt),
+		Version:     doc.Version,
+		ExpiresAt:   unixNano(doc.ExpiresAt),
+		ContentHash: doc.ContentHash,
+		DuplicateOf: doc.DuplicateOf,
+		DeletedAt:   unixNano(doc.DeletedAt),
+		Links:       doc.Links,
+		Vector:      doc.Vector,
+	}
+}
+
+func documentFromProto(doc *documentpb.Document) *documentstore.Document {
+	return &documentstore.Document{
+		ID:          doc.GetId(),
+		Title:       doc.GetTitle(),
+		Content:     doc.GetContent(),
+		Metadata:    doc.GetMetadata(),
+		CreatedAt:   fromUnixNano(doc.GetCreatedAt()),
+		UpdatedAt:   fromUnixNano(doc.GetUpdatedAt()),
+		Version:     doc.GetVersion(),
+		ExpiresAt:   fromUnixNano(doc.GetExpiresAt()),
+		ContentHash: doc.GetContentHash(),
+		DuplicateOf: doc.GetDuplicateOf(),
+		DeletedAt:   fromUnixNano(doc.GetDeletedAt()),
+		Links:       doc.GetLinks(),
+		Vector:      doc.GetVector(),
+	}
+}
+
+func documentsToProto(docs []*documentstore.Document) []*documentpb.Document {
+	encoded := make([]*documentpb.Document, len(docs))
+	for i, doc := range docs {
+		encoded[i] = documentToProto(doc)
+	}
+	return encoded
+}
+
+func bulkReportToProto(report documentstore.BulkReport) *documentpb.BulkReport {
+	m := &documentpb.BulkReport{
+		Created:  int32(report.Created),
+		Updated:  int32(report.Updated),
+		Failed:   int32(report.Failed),
+		Replaced: report.Replaced,
+	}
+	for _, item := range report.Items {
+		m.Items = append(m.Items, &documentpb.BulkItem{
+			Index:       int32(item.Index),
+			Id:          item.ID,
+			Status:      item.Status,
+			Error:       item.Error,
+			DuplicateOf: item.DuplicateOf,
+		})
+	}
+	return m
+}
+
+func searchResponseToProto(page documentstore.Page) *documentpb.SearchResponse {
+	m := &documentpb.SearchResponse{
+		Total:      int32(page.Total),
+		NextCursor: page.NextCursor,
+		Suggestion: page.Suggestion,
+	}
+	for _, result := range page.Results {
+		m.Results = append(m.Results, &documentpb.SearchResult{Document: documentToProto(result.Document), Score: result.Score})
+	}
+	// Facets are sent by name, so responses encode the same every time
+	names := make([]string, 0, len(page.Facets))
+	for name := range page.Facets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		facet := page.Facets[name]
+		encoded := &documentpb.Facet{Name: name, Other: int32(facet.Other), Missing: int32(facet.Missing)}
+		for _, bucket := range facet.Buckets {
+			encoded.Buckets = append(encoded.Buckets, &documentpb.FacetBucket{Key: bucket.Key, Count: int32(bucket.Count)})
+		}
+		m.Facets = append(m.Facets, encoded)
+	}
+	return m
+}
+
+func eventToProto(event documentstore.Event) *documentpb.Event {
+	return &documentpb.Event{
+		Seq:      event.Seq,
+		Type:     event.Type,
+		Id:       event.ID,
+		Document: documentToProto(event.Document),
+		Time:     unixNano(event.Time),
+	}
+}
+
+// unixNano encodes a time as Unix nanoseconds, the zero time as 0
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano decodes Unix nanoseconds, 0 being the zero time
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,686 @@
+package documentserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"pkg/httpjson"
+	documentstore "storage/document_store"
+)
+
+// Limits on the size of request bodies
+const (
+	maxBodyBytes     = 16 << 20
+	maxBulkBodyBytes = 256 << 20
+	maxSnapshotBytes = 4 << 30
+)
+
+// updateRequest is the body of PUT /documents/{id}
+type updateRequest struct {
+	Content string `json:"content"`
+	// Version, if set, makes the update fail unless the document is still
+	// at that version
+	Version uint64 `json:"version,omitempty"`
+}
+
+// linksResponse is the answer to GET /links
+type linksResponse struct {
+	ID          string   `json:"id"`
+	Outlinks    []string `json:"outlinks"`
+	Inlinks     []string `json:"inlinks"`
+	InlinkCount int      `json:"inlink_count"`
+	Neighbors   []string `json:"neighbors,omitempty"`
+}
+
+// indexResponse is the answer to GET /index
+type indexResponse struct {
+	Generation uint64                        `json:"generation"`
+	Segments   documentstore.SegmentStats    `json:"segments"`
+	QueryCache documentstore.QueryCacheStats `json:"query_cache"`
+	// Admission reports on each ingestion lane when writes are admitted
+	Admission map[documentstore.Lane]documentstore.LaneStats `json:"admission,omitempty"`
+}
+
+// statsResponse is the answer to GET /index/stats
+type statsResponse struct {
+	documentstore.IndexStats
+	// TermStats answers the request's term parameters
+	TermStats []documentstore.TermStats `json:"term_stats,omitempty"`
+}
+
+// linkDirections are the values of the direction parameter of GET /links
+var linkDirections = map[string]documentstore.LinkDirection{
+	"":     documentstore.LinksOut,
+	"out":  documentstore.LinksOut,
+	"in":   documentstore.LinksIn,
+	"both": documentstore.LinksBoth,
+}
+
+// Handler serves the store as JSON over HTTP
+//
+//	GET    /documents                 a page of all documents
+//	POST   /documents                 add a document
+//	GET    /documents/{id}            a document
+//	PUT    /documents/{id}            replace a document's content
+//	PATCH  /documents/{id}            apply a JSON merge patch
+//	DELETE /documents/{id}            move a document to the trash
+//	GET    /trash                     the deleted documents that can be recovered
+//	POST   /trash/{id}/recover        recover a deleted document
+//	DELETE /trash/{id}                remove a document for good
+//	POST   /bulk?upsert=true          add or replace a JSON array of documents
+//	POST   /bulk                      apply NDJSON index, create, update and
+//	                                  delete actions, see serveNDJSONBulk
+//	GET    /links?id={id}             a document's links, and with depth={n}
+//	                                  and direction=out|in|both its neighbors
+//	POST   /links                     add a JSON array of {"from", "to"} links
+//	GET    /search?q={query}          a page of matches for a query
+//	GET    /explain?q={query}&id={id} how a document scores for a query
+//	GET    /watch?since={seq}         the change feed, as JSON lines
+//	GET    /index                     the full-text index's generation and
+//	                                  segments, and the ingestion lanes
+//	GET    /index/stats               document, field, metadata and term
+//	                                  statistics, with top_terms={n} the
+//	                                  commonest terms and with term={term}
+//	                                  that term's frequencies
+//	POST   /index/rebuild             reindex every document into a new generation
+//	GET    /index/snapshot            a snapshot of the full-text index
+//	PUT    /index/snapshot            swap in a generation loaded from a snapshot
+//	GET    /saved-searches            the searches alerted on, with
+//	POST   /saved-searches            SetSavedSearches, see savedsearches.Store
+//	GET    /saved-searches/{id}
+//	DELETE /saved-searches/{id}
+//	GET    /indices                   the indices of a catalog and their
+//	PUT    /indices/{name}            aliases, with SetIndices, see
+//	DELETE /indices/{name}            indexcatalog.Catalog.Handler; each
+//	*      /indices/{name}/...        index is served as above under
+//	PUT    /aliases/{alias}           /indices/{name}/, by name or alias
+//	POST   /reindex
+//
+// Pages take limit, offset, cursor, sort and reverse parameters, and for
+// sort=distance origin and geo_field, as SearchOptions, and facet parameters in the short form ParseFacet reads,
+// such as facet=terms:metadata.language&facet=histogram:created_at:month. Pages and single documents take a fields parameter listing
+// the fields to return, such as fields=title,metadata.date, to leave out
+// large content. IDs containing slashes must be escaped as %2F.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/documents", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if !s.allowHTTP(w, r, OpRead, "") {
+				return
+			}
+			s.writePage(w, r, "")
+		case http.MethodPost:
+			var doc documentstore.Document
+			if !s.allowHTTP(w, r, OpWrite, "") || !decodeBody(w, r, maxBodyBytes, &doc) {
+				return
+			}
+			release, ok := s.admitHTTP(w, r)
+			if !ok {
+				return
+			}
+			defer release()
+			stored, err := s.addDocument(r.Context(), &doc)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			httpjson.Write(w, http.StatusCreated, stored)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/documents/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/documents/"))
+		if err != nil || id == "" {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveDocument(w, r, id)
+	})
+	mux.HandleFunc("/trash", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.allowHTTP(w, r, OpRead, "") {
+			return
+		}
+		httpjson.Write(w, http.StatusOK, s.db.Trash())
+	})
+	mux.HandleFunc("/trash/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.EscapedPath(), "/trash/")
+		escaped, recovering := strings.CutSuffix(path, "/recover")
+		id, err := url.PathUnescape(escaped)
+		if err != nil || id == "" {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveTrash(w, r, id, recovering)
+	})
+	mux.HandleFunc("/bulk", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.allowHTTP(w, r, OpWrite, "") {
+			return
+		}
+		body := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxBulkBodyBytes))
+		if isNDJSON(r, body) {
+			s.serveNDJSONBulk(r.Context(), w, body)
+			return
+		}
+		var docs []*documentstore.Document
+		if err := parse(r.Context(), func() error { return json.NewDecoder(body).Decode(&docs) }); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		upsert, _ := strconv.ParseBool(r.URL.Query().Get("upsert"))
+		httpjson.Write(w, http.StatusOK, s.storeBulk(r.Context(), docs, upsert))
+	})
+	mux.HandleFunc("/links", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.writeLinks(w, r)
+		case http.MethodPost:
+			var links []documentstore.Link
+			if !s.allowHTTP(w, r, OpWrite, "") || !decodeBody(w, r, maxBulkBodyBytes, &links) {
+				return
+			}
+			report, err := s.db.AddLinks(links)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, report)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query().Get("q")
+		if query == "" {
+			http.Error(w, "missing query", http.StatusBadRequest)
+			return
+		}
+		if !s.allowHTTP(w, r, OpRead, "") {
+			return
+		}
+		s.writePage(w, r, query)
+	})
+	mux.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params := r.URL.Query()
+		if params.Get("q") == "" || params.Get("id") == "" {
+			http.Error(w, "missing query or id", http.StatusBadRequest)
+			return
+		}
+		if !s.allowHTTP(w, r, OpRead, params.Get("id")) {
+			return
+		}
+		explanation, err := s.db.Explain(params.Get("q"), params.Get("id"))
+		if err != nil {
+			if !errors.Is(err, documentstore.ErrNotFound) {
+				err = fmt.Errorf("%w: %v", errBadRequest, err)
+			}
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, explanation)
+	})
+	mux.HandleFunc("/index", s.serveIndex)
+	mux.HandleFunc("/index/", s.serveIndex)
+	mux.HandleFunc("/watch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.allowHTTP(w, r, OpWatch, "") {
+			return
+		}
+		s.watch(w, r)
+	})
+	mux.HandleFunc("/saved-searches", s.serveSavedSearches)
+	mux.HandleFunc("/saved-searches/", s.serveSavedSearches)
+	for _, path := range []string{"/indices", "/indices/", "/aliases", "/aliases/", "/reindex"} {
+		mux.HandleFunc(path, s.serveIndices)
+	}
+	return mux
+}
+
+// serveIndices passes requests on the catalog of indices to it. Requests
+// managing the catalog are authorized here, reads to read and the rest to
+// write; requests for an index are authorized by the server for it.
+func (s *Server) serveIndices(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	indices := s.indices
+	s.mutex.Unlock()
+	if indices == nil {
+		http.NotFound(w, r)
+		return
+	}
+	rest, forIndex := strings.CutPrefix(r.URL.Path, "/indices/")
+	if _, _, nested := strings.Cut(rest, "/"); !forIndex || !nested {
+		operation := OpWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			operation = OpRead
+		}
+		if !s.allowHTTP(w, r, operation, "") {
+			return
+		}
+	}
+	indices.ServeHTTP(w, r)
+}
+
+// serveSavedSearches passes requests on saved searches to their store,
+// once authorized: reads to read, the rest to write
+func (s *Server) serveSavedSearches(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	searches := s.savedSearches
+	s.mutex.Unlock()
+	if searches == nil {
+		http.NotFound(w, r)
+		return
+	}
+	operation := OpWrite
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		operation = OpRead
+	}
+	if !s.allowHTTP(w, r, operation, "") {
+		return
+	}
+	searches.ServeHTTP(w, r)
+}
+
+// serveIndex serves the requests on the full-text index. Rebuilds and loads
+// swap the new generation in without interrupting searches.
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request) {
+	methods := map[string]string{
+		"/index":          http.MethodGet,
+		"/index/stats":    http.MethodGet,
+		"/index/rebuild":  http.MethodPost,
+		"/index/snapshot": http.MethodGet + " " + http.MethodPut,
+	}
+	allowed, ok := methods[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.Contains(allowed, r.Method) {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	operation := OpRead
+	if r.Method != http.MethodGet {
+		operation = OpWrite
+	}
+	if !s.allowHTTP(w, r, operation, "") {
+		return
+	}
+
+	switch r.URL.Path {
+	case "/index":
+		httpjson.Write(w, http.StatusOK, s.indexResponse(s.db.IndexGeneration()))
+	case "/index/stats":
+		params := r.URL.Query()
+		top, err := intParam(params, "top_terms")
+		if err != nil || top < 0 {
+			http.Error(w, "top_terms must be a count", http.StatusBadRequest)
+			return
+		}
+		resp := statsResponse{IndexStats: s.db.IndexStats(top)}
+		for _, term := range params["term"] {
+			resp.TermStats = append(resp.TermStats, s.db.TermStats(term))
+		}
+		httpjson.Write(w, http.StatusOK, resp)
+	case "/index/rebuild":
+		httpjson.Write(w, http.StatusOK, s.indexResponse(s.db.RebuildIndex()))
+	case "/index/snapshot":
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/gzip")
+			// Headers are sent by now, so a failure can only cut the stream short
+			s.db.WriteIndexSnapshot(w)
+			return
+		}
+		report, err := s.db.ReadIndexSnapshot(http.MaxBytesReader(w, r.Body, maxSnapshotBytes))
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		httpjson.Write(w, http.StatusOK, report)
+	}
+}
+
+// indexResponse describes the full-text index at generation
+func (s *Server) indexResponse(generation uint64) indexResponse {
+	resp := indexResponse{Generation: generation, Segments: s.db.SegmentStats(), QueryCache: s.db.QueryCacheStats()}
+	s.mutex.Lock()
+	admission := s.admission
+	s.mutex.Unlock()
+	if admission != nil {
+		resp.Admission = admission.Stats()
+	}
+	return resp
+}
+
+// serveDocument serves the requests on a single document
+func (s *Server) serveDocument(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		doc *documentstore.Document
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		if !s.allowHTTP(w, r, OpRead, id) {
+			return
+		}
+		doc, err = s.getDocument(id, fieldsParam(r.URL.Query()))
+	case http.MethodPut:
+		var req updateRequest
+		if !s.allowHTTP(w, r, OpWrite, id) || !decodeBody(w, r, maxBodyBytes, &req) {
+			return
+		}
+		release, ok := s.admitHTTP(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+		doc, err = s.updateDocument(r.Context(), id, req.Content, req.Version)
+	case http.MethodPatch:
+		if !s.allowHTTP(w, r, OpWrite, id) {
+			return
+		}
+		patch, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		if readErr != nil {
+			http.Error(w, readErr.Error(), http.StatusBadRequest)
+			return
+		}
+		release, ok := s.admitHTTP(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+		doc, err = s.patchDocument(r.Context(), id, patch)
+	case http.MethodDelete:
+		if !s.allowHTTP(w, r, OpWrite, id) {
+			return
+		}
+		release, ok := s.admitHTTP(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+		if err := store(r.Context(), "delete", id, func() error { return s.db.DeleteDocument(id) }); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, doc)
+}
+
+// serveTrash serves the requests on a deleted document: recovering it, or
+// removing it for good
+func (s *Server) serveTrash(w http.ResponseWriter, r *http.Request, id string, recovering bool) {
+	switch {
+	case recovering && r.Method == http.MethodPost:
+		if !s.allowHTTP(w, r, OpWrite, id) {
+			return
+		}
+		release, ok := s.admitHTTP(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+		var doc *documentstore.Document
+		err := store(r.Context(), "recover", id, func() (err error) {
+			doc, err = s.db.RecoverDocument(id)
+			return err
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, doc)
+	case !recovering && r.Method == http.MethodDelete:
+		if !s.allowHTTP(w, r, OpWrite, id) {
+			return
+		}
+		release, ok := s.admitHTTP(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+		if err := store(r.Context(), "purge", id, func() error { return s.db.PurgeDocument(id) }); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writePage answers with the page of documents the request's parameters
+// select
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, query string) {
+	params := r.URL.Query()
+	options := documentstore.SearchOptions{
+		Cursor:   params.Get("cursor"),
+		SortBy:   documentstore.SortField(params.Get("sort")),
+		GeoField: params.Get("geo_field"),
+		Fields:   fieldsParam(params),
+	}
+	var err error
+	if options.Origin, err = parseOrigin(params.Get("origin")); err != nil {
+		writeError(w, err)
+		return
+	}
+	if options.Limit, err = intParam(params, "limit"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if options.Offset, err = intParam(params, "offset"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options.Reverse, _ = strconv.ParseBool(params.Get("reverse"))
+	if options.Facets, err = parseFacets(params["facet"]); err != nil {
+		writeError(w, err)
+		return
+	}
+	page, err := s.page(query, options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, page)
+}
+
+// writeLinks answers with a document's place in the link graph
+func (s *Server) writeLinks(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	id := params.Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	depth, err := intParam(params, "depth")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	direction, ok := linkDirections[params.Get("direction")]
+	if !ok {
+		http.Error(w, "direction must be out, in or both", http.StatusBadRequest)
+		return
+	}
+	if !s.allowHTTP(w, r, OpRead, id) {
+		return
+	}
+	// Documents that aren't stored have no outgoing links but can still be
+	// linked to
+	outlinks, _ := s.db.Outlinks(id)
+	resp := linksResponse{
+		ID:          id,
+		Outlinks:    append([]string{}, outlinks...),
+		Inlinks:     s.db.Inlinks(id),
+		InlinkCount: s.db.InlinkCount(id),
+	}
+	if depth > 0 {
+		resp.Neighbors = s.db.Neighbors(id, depth, direction)
+	}
+	httpjson.Write(w, http.StatusOK, resp)
+}
+
+// watch streams change events as JSON lines until the client goes away or
+// the feed ends. A client that falls behind is disconnected and should
+// reconnect from the last sequence number it received. The response names
+// the feed in X-Change-Feed, which changes when the server restarts and
+// its sequence numbers start over, and gives in X-Change-Seq the sequence
+// number the stream starts after.
+func (s *Server) watch(w http.ResponseWriter, r *http.Request) {
+	since := s.db.ChangeSeq()
+	if param := r.URL.Query().Get("since"); param != "" {
+		var err error
+		if since, err = strconv.ParseUint(param, 10, 64); err != nil {
+			http.Error(w, "since must be a sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+	events, err := s.db.Watch(r.Context(), since)
+	if err != nil {
+		// The feed no longer holds the changes asked for
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(headerChangeFeed, s.feed)
+	w.Header().Set(headerChangeSeq, strconv.FormatUint(since, 10))
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// allowHTTP authorizes a request, answering it with 401 or 403 if it may
+// not proceed
+func (s *Server) allowHTTP(w http.ResponseWriter, r *http.Request, operation Operation, id string) bool {
+	err := s.authorize(r.Context(), AuthRequest{
+		Credentials: bearerToken(r.Header.Get("Authorization")),
+		Operation:   operation,
+		DocumentID:  id,
+		Transport:   "http",
+	})
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrUnauthenticated):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+	return false
+}
+
+// admitHTTP admits an edit of a single document in the interactive lane,
+// answering with the error if it is turned away. Call the returned
+// function once the edit is done.
+func (s *Server) admitHTTP(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	release, err := s.admit(r.Context(), documentstore.LaneInteractive, 1)
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	return release, true
+}
+
+// decodeBody decodes a JSON body into v, in a parse span, answering with
+// 400 if it can't
+func decodeBody(w http.ResponseWriter, r *http.Request, limit int64, v interface{}) bool {
+	err := parse(r.Context(), func() error { return json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(v) })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// fieldsParam splits the comma-separated fields parameter
+func fieldsParam(params url.Values) []string {
+	var fields []string
+	for _, field := range strings.Split(params.Get("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func intParam(params url.Values, name string) (int, error) {
+	value := params.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New(name + " must be an integer")
+	}
+	return n, nil
+}
+
+// writeError answers with the status that fits a store error
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, documentstore.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, documentstore.ErrAlreadyExists),
+		errors.Is(err, documentstore.ErrVersionConflict),
+		errors.Is(err, documentstore.ErrDuplicateContent):
+		status = http.StatusConflict
+	case errors.Is(err, documentstore.ErrInvalidDocument):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, errBadRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, documentstore.ErrThrottled):
+		status = http.StatusTooManyRequests
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,297 @@
+package documentserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"monitoring/tracing"
+	documentstore "storage/document_store"
+	indexcatalog "storage/index_catalog"
+	savedsearches "storage/saved_searches"
+)
+
+// Operation is the kind of access a request needs
+type Operation string
+
+const (
+	OpRead  Operation = "read"  // Get, list and search
+	OpWrite Operation = "write" // Add, update, patch, delete and bulk
+	OpWatch Operation = "watch" // Stream the change feed
+)
+
+// Errors an Authorizer returns, possibly wrapped, to turn a request away.
+// Any other error is treated like ErrForbidden.
+var (
+	ErrUnauthenticated = errors.New("missing or invalid credentials")
+	ErrForbidden       = errors.New("operation not allowed")
+)
+
+// AuthRequest describes a request to be authorized
+type AuthRequest struct {
+	// Credentials are the bearer token from the HTTP Authorization header or
+	// the gRPC "authorization" metadata, without the "Bearer " prefix
+	Credentials string
+	Operation   Operation
+	DocumentID  string // Empty for adds and requests that span documents
+	Transport   string // "http" or "grpc"
+}
+
+// Authorizer decides whether a request may proceed
+type Authorizer func(ctx context.Context, req AuthRequest) error
+
+// TokenAuthorizer allows requests carrying one of tokens, each limited to
+// the operations listed for it
+func TokenAuthorizer(tokens map[string][]Operation) Authorizer {
+	return func(ctx context.Context, req AuthRequest) error {
+		for token, operations := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(req.Credentials)) != 1 {
+				continue
+			}
+			for _, operation := range operations {
+				if operation == req.Operation {
+					return nil
+				}
+			}
+			return ErrForbidden
+		}
+		return ErrUnauthenticated
+	}
+}
+
+// Server serves a DocumentDB over HTTP and gRPC, so components written in
+// other languages can use the store without embedding it
+type Server struct {
+	db        *documentstore.DocumentDB
+	authorize Authorizer
+	// feed names the change feed of this process, whose sequence numbers
+	// start over when the database is opened again
+	feed string
+
+	mutex           sync.Mutex // Guards the settings below
+	bulkConcurrency int
+	savedSearches   http.Handler             // Nil unless searches can be saved
+	indices         http.Handler             // Nil unless a catalog of indices is served
+	admission       *documentstore.Admission // Nil unless writes are admitted
+}
+
+// NewServer returns a server for db. Every request is passed to authorize
+// first; a nil authorize allows everything.
+func NewServer(db *documentstore.DocumentDB, authorize Authorizer) *Server {
+	if authorize == nil {
+		authorize = func(context.Context, AuthRequest) error { return nil }
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &Server{db: db, authorize: authorize, feed: hex.EncodeToString(b), bulkConcurrency: DefaultBulkConcurrency}
+}
+
+// SetSavedSearches serves the saved searches in store on /saved-searches,
+// for a savedsearches.Percolator to alert on
+func (s *Server) SetSavedSearches(store *savedsearches.Store) {
+	s.mutex.Lock()
+	s.savedSearches = store.Handler()
+	s.mutex.Unlock()
+}
+
+// SetIndices serves the catalog's indices and their management on
+// /indices, /aliases and /reindex. Each index is served under
+// /indices/{name}/ as the server serves its own database, authorized the
+// same way.
+func (s *Server) SetIndices(catalog *indexcatalog.Catalog) {
+	handler := catalog.Handler(func(_ string, db *documentstore.DocumentDB) http.Handler {
+		s.mutex.Lock()
+		concurrency, admission := s.bulkConcurrency, s.admission
+		s.mutex.Unlock()
+		index := NewServer(db, s.authorize)
+		index.SetBulkConcurrency(concurrency)
+		index.SetAdmission(admission)
+		return index.Handler()
+	})
+	s.mutex.Lock()
+	s.indices = handler
+	s.mutex.Unlock()
+}
+
+// SetAdmission admits writes through admission: edits of single documents
+// in the interactive lane and bulk requests in the bulk lane, a bulk batch
+// at a time. Writes it turns away are answered with 429 Too Many Requests,
+// or RESOURCE_EXHAUSTED over gRPC. Nil admits every write at once.
+func (s *Server) SetAdmission(admission *documentstore.Admission) {
+	s.mutex.Lock()
+	s.admission = admission
+	s.mutex.Unlock()
+}
+
+// admit admits a write of n documents in a lane, returning the function to
+// call once it is done
+func (s *Server) admit(ctx context.Context, lane documentstore.Lane, n int) (func(), error) {
+	s.mutex.Lock()
+	admission := s.admission
+	s.mutex.Unlock()
+	if admission == nil {
+		return func() {}, nil
+	}
+	return admission.Admit(ctx, lane, n)
+}
+
+// bulkOptions returns the options bulk writes are made with, admitting
+// their batches in the bulk lane until ctx is done
+func (s *Server) bulkOptions(ctx context.Context, upsert bool) documentstore.BulkOptions {
+	options := documentstore.BulkOptions{Upsert: upsert}
+	s.mutex.Lock()
+	admission := s.admission
+	s.mutex.Unlock()
+	if admission != nil {
+		options.BatchSize = admission.BulkBatchSize()
+		options.Admit = admission.Admitter(ctx, documentstore.LaneBulk)
+	}
+	return options
+}
+
+// tracer traces the requests served, a parse span for decoding each and a
+// store span for each write to the database, which indexes documents as it
+// stores them
+var tracer = tracing.Tracer("storage/document_server")
+
+// parse decodes a request with decode in a parse span
+func parse(ctx context.Context, decode func() error) error {
+	_, span := tracer.Start(ctx, "parse")
+	err := decode()
+	tracing.End(span, err)
+	return err
+}
+
+// store makes a write of a document to the database in a store span
+func store(ctx context.Context, operation, id string, write func() error) error {
+	_, span := tracer.Start(ctx, "store", trace.WithAttributes(
+		attribute.String("db.operation.name", operation), attribute.String("document.id", id)))
+	err := write()
+	tracing.End(span, err)
+	return err
+}
+
+// storeBulk writes docs to the database in a store span
+func (s *Server) storeBulk(ctx context.Context, docs []*documentstore.Document, upsert bool) documentstore.BulkReport {
+	_, span := tracer.Start(ctx, "store", trace.WithAttributes(
+		attribute.String("db.operation.name", "bulk"), attribute.Int("documents", len(docs))))
+	report := s.db.Bulk(docs, s.bulkOptions(ctx, upsert))
+	span.SetAttributes(attribute.Int("documents.created", report.Created),
+		attribute.Int("documents.updated", report.Updated), attribute.Int("documents.failed", report.Failed))
+	span.End()
+	return report
+}
+
+// bearerToken strips the "Bearer " scheme from an authorization value
+func bearerToken(value string) string {
+	if len(value) > len("Bearer ") && strings.EqualFold(value[:len("Bearer ")], "Bearer ") {
+		return value[len("Bearer "):]
+	}
+	return ""
+}
+
+// getDocument returns the given fields of a document, or all of them if
+// fields is empty
+func (s *Server) getDocument(id string, fields []string) (*documentstore.Document, error) {
+	doc, err := s.db.GetDocumentFields(id, fields)
+	if err != nil && !errors.Is(err, documentstore.ErrNotFound) {
+		// Only an unknown field fails otherwise
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return doc, err
+}
+
+// addDocument adds doc and returns it as stored
+func (s *Server) addDocument(ctx context.Context, doc *documentstore.Document) (*documentstore.Document, error) {
+	if doc.ID == "" {
+		return nil, errMissingID
+	}
+	if err := store(ctx, "add", doc.ID, func() error { return s.db.AddDocument(doc) }); err != nil {
+		return nil, err
+	}
+	return s.db.GetDocument(doc.ID)
+}
+
+// updateDocument replaces a document's content, only from expectedVersion
+// if it isn't zero, and returns the document as stored
+func (s *Server) updateDocument(ctx context.Context, id, content string, expectedVersion uint64) (*documentstore.Document, error) {
+	err := store(ctx, "update", id, func() error {
+		if expectedVersion != 0 {
+			return s.db.UpdateDocumentIf(id, expectedVersion, content)
+		}
+		return s.db.UpdateDocument(id, content)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.db.GetDocument(id)
+}
+
+// patchDocument applies a JSON merge patch and returns the document as stored
+func (s *Server) patchDocument(ctx context.Context, id string, patch []byte) (*documentstore.Document, error) {
+	if err := store(ctx, "patch", id, func() error { return s.db.PatchDocument(id, patch) }); err != nil {
+		if errors.Is(err, documentstore.ErrNotFound) || errors.Is(err, documentstore.ErrInvalidDocument) {
+			return nil, err
+		}
+		// Otherwise the patch itself is malformed
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return s.db.GetDocument(id)
+}
+
+// page lists documents for an empty query and searches otherwise
+func (s *Server) page(query string, options documentstore.SearchOptions) (documentstore.Page, error) {
+	var page documentstore.Page
+	var err error
+	if query == "" {
+		page, err = s.db.ListDocumentsPage(options)
+	} else {
+		page, err = s.db.SearchPage(query, options)
+	}
+	if err != nil {
+		// Only a bad query, cursor or sort order fails a page
+		return page, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return page, nil
+}
+
+// parseFacets reads facet requests in the short form ParseFacet takes
+func parseFacets(specs []string) ([]documentstore.FacetRequest, error) {
+	var facets []documentstore.FacetRequest
+	for _, spec := range specs {
+		facet, err := documentstore.ParseFacet(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		facets = append(facets, facet)
+	}
+	return facets, nil
+}
+
+// parseOrigin reads the point results are sorted by distance from, if
+// there is one
+func parseOrigin(value string) (documentstore.GeoPoint, error) {
+	if value == "" {
+		return documentstore.GeoPoint{}, nil
+	}
+	origin, err := documentstore.ParseGeoPoint(value)
+	if err != nil {
+		return origin, fmt.Errorf("%w: bad origin %q: %v", errBadRequest, value, err)
+	}
+	return origin, nil
+}
+
+var (
+	// errBadRequest marks failures caused by the request rather than the store
+	errBadRequest = errors.New("bad request")
+	errMissingID  = fmt.Errorf("%w: document needs an ID", errBadRequest)
+)
@@ -0,0 +1,287 @@
+package documentstore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Lane is a class of writes admission control tells apart
+type Lane string
+
+// Ingestion lanes
+const (
+	// LaneInteractive is for single edits someone is waiting on, such as
+	// those made through the API
+	LaneInteractive Lane = "interactive"
+	// LaneBulk is for crawler output, imports and reindexing, which can
+	// wait
+	LaneBulk Lane = "bulk"
+)
+
+// LaneOptions caps the writes a lane admits
+type LaneOptions struct {
+	// Rate caps the documents per second the lane admits; zero leaves it
+	// uncapped
+	Rate float64
+	// Burst is how many documents the lane admits at once ahead of its
+	// rate; zero means a second's worth
+	Burst int
+	// MaxQueue is how many writes may wait in the lane at once; more are
+	// turned away with ErrThrottled. Zero lets any number wait.
+	MaxQueue int
+	// MaxWait is the longest a write waits to be admitted before it is
+	// turned away with ErrThrottled; zero waits as long as its context
+	// allows
+	MaxWait time.Duration
+}
+
+// AdmissionOptions configures an Admission
+type AdmissionOptions struct {
+	Interactive LaneOptions
+	Bulk        LaneOptions
+	// BulkBatchSize is the most documents a bulk write should hold, and
+	// BulkConcurrency how many bulk writes are admitted at once. Bulk
+	// writes wait while interactive writes wait or run, so an interactive
+	// write is held up by no more than BulkConcurrency writes of
+	// BulkBatchSize documents already under way.
+	BulkBatchSize   int
+	BulkConcurrency int
+}
+
+// DefaultAdmissionOptions lets 1000 interactive writes wait up to a second
+// and 64 bulk writes of 100 documents wait as long as they need, one
+// running at a time
+var DefaultAdmissionOptions = AdmissionOptions{
+	Interactive:     LaneOptions{MaxQueue: 1000, MaxWait: time.Second},
+	Bulk:            LaneOptions{MaxQueue: 64},
+	BulkBatchSize:   100,
+	BulkConcurrency: 1,
+}
+
+// LaneStats describes the writes of one lane, for monitoring
+type LaneStats struct {
+	Waiting   int    `json:"waiting"`   // Writes waiting to be admitted
+	Running   int    `json:"running"`   // Admitted writes not yet done
+	Admitted  uint64 `json:"admitted"`  // Documents admitted
+	Throttled uint64 `json:"throttled"` // Writes turned away
+	// WaitTime is how long admitted writes waited in total; LastWait and
+	// MaxWait how long the last one and the longest one did
+	WaitTime time.Duration `json:"wait_time"`
+	LastWait time.Duration `json:"last_wait"`
+	MaxWait  time.Duration `json:"max_wait"`
+}
+
+// lane is the state of one lane: a token bucket for its rate and its
+// queue
+type lane struct {
+	options LaneOptions
+	tokens  float64 // Documents that may be admitted now
+	filled  time.Time
+	stats   LaneStats
+}
+
+// refill adds the tokens earned since the bucket was last filled
+func (l *lane) refill(now time.Time) {
+	if l.options.Rate <= 0 {
+		return
+	}
+	l.tokens = math.Min(l.tokens+now.Sub(l.filled).Seconds()*l.options.Rate, l.burst())
+	l.filled = now
+}
+
+func (l *lane) burst() float64 {
+	if l.options.Burst > 0 {
+		return float64(l.options.Burst)
+	}
+	return math.Max(l.options.Rate, 1)
+}
+
+// delay returns how long until the bucket holds what admitting n
+// documents takes: n tokens, or a full bucket for writes larger than it
+func (l *lane) delay(n int) time.Duration {
+	if l.options.Rate <= 0 {
+		return 0
+	}
+	need := math.Min(float64(n), l.burst())
+	if l.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - l.tokens) / l.options.Rate * float64(time.Second))
+}
+
+// Admission controls how fast documents are written, in two lanes: the
+// interactive lane for edits someone is waiting on, and the bulk lane for
+// crawler output and reindexing. Each lane has its own rate cap and queue
+// limit, and bulk writes give way whenever interactive writes are queued
+// or running, so bulk work never holds up an edit for longer than the
+// bulk writes already under way take. Writers call Admit before writing
+// and the release function it returns after.
+type Admission struct {
+	options AdmissionOptions
+
+	mutex       sync.Mutex
+	lanes       map[Lane]*lane
+	bulkRunning int
+	changed     chan struct{} // Closed and replaced when a write is released or stops waiting
+}
+
+// NewAdmission returns admission control with the given options; zero
+// BulkBatchSize and BulkConcurrency take their DefaultAdmissionOptions
+// values
+func NewAdmission(options AdmissionOptions) *Admission {
+	if options.BulkBatchSize <= 0 {
+		options.BulkBatchSize = DefaultAdmissionOptions.BulkBatchSize
+	}
+	if options.BulkConcurrency <= 0 {
+		options.BulkConcurrency = DefaultAdmissionOptions.BulkConcurrency
+	}
+	now := time.Now()
+	a := &Admission{options: options, changed: make(chan struct{})}
+	a.lanes = map[Lane]*lane{
+		LaneInteractive: {options: options.Interactive, filled: now},
+		LaneBulk:        {options: options.Bulk, filled: now},
+	}
+	for _, l := range a.lanes {
+		l.tokens = l.burst()
+	}
+	return a
+}
+
+// BulkBatchSize returns the most documents a bulk write should hold
+func (a *Admission) BulkBatchSize() int {
+	return a.options.BulkBatchSize
+}
+
+// Admit waits until a write of n documents may go ahead in the lane, then
+// returns a function to call once the write is done. It fails with
+// ErrThrottled if the lane's queue is full or the write would wait longer
+// than the lane's MaxWait, and with ctx's error when ctx is done first.
+func (a *Admission) Admit(ctx context.Context, name Lane, n int) (func(), error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	l, ok := a.lanes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown ingestion lane %q", name)
+	}
+	if l.options.MaxQueue > 0 && l.stats.Waiting >= l.options.MaxQueue {
+		l.stats.Throttled++
+		return nil, fmt.Errorf("%w: %d %s writes are waiting", ErrThrottled, l.stats.Waiting, name)
+	}
+
+	start := time.Now()
+	var deadline <-chan time.Time
+	if l.options.MaxWait > 0 {
+		timer := time.NewTimer(l.options.MaxWait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	l.stats.Waiting++
+	defer func() {
+		l.stats.Waiting--
+		a.broadcastLocked()
+	}()
+	for {
+		now := time.Now()
+		l.refill(now)
+		delay := l.delay(n)
+		if l.options.MaxWait > 0 && now.Sub(start)+delay > l.options.MaxWait {
+			l.stats.Throttled++
+			return nil, fmt.Errorf("%w: the %s lane is over its rate", ErrThrottled, name)
+		}
+		blocked := name == LaneBulk && a.yieldLocked()
+		if delay == 0 && !blocked {
+			break
+		}
+
+		var wake <-chan time.Time
+		var timer *time.Timer
+		if delay > 0 {
+			timer = time.NewTimer(delay)
+			wake = timer.C
+		}
+		changed := a.changed
+		a.mutex.Unlock()
+		select {
+		case <-wake:
+		case <-changed:
+		case <-deadline:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		a.mutex.Lock()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		select {
+		case <-deadline:
+			l.stats.Throttled++
+			return nil, fmt.Errorf("%w: the %s lane waited over %s", ErrThrottled, name, l.options.MaxWait)
+		default:
+		}
+	}
+
+	if l.options.Rate > 0 {
+		l.tokens -= float64(n)
+	}
+	waited := time.Since(start)
+	l.stats.Running++
+	l.stats.Admitted += uint64(n)
+	l.stats.WaitTime += waited
+	l.stats.LastWait = waited
+	if waited > l.stats.MaxWait {
+		l.stats.MaxWait = waited
+	}
+	if name == LaneBulk {
+		a.bulkRunning++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mutex.Lock()
+			defer a.mutex.Unlock()
+			l.stats.Running--
+			if name == LaneBulk {
+				a.bulkRunning--
+			}
+			a.broadcastLocked()
+		})
+	}, nil
+}
+
+// broadcastLocked wakes the writers waiting for a write to be released or
+// to stop waiting
+func (a *Admission) broadcastLocked() {
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+// yieldLocked reports whether a bulk write has to wait: for interactive
+// writes, or for a bulk write to finish
+func (a *Admission) yieldLocked() bool {
+	interactive := a.lanes[LaneInteractive].stats
+	return interactive.Waiting > 0 || interactive.Running > 0 || a.bulkRunning >= a.options.BulkConcurrency
+}
+
+// Admitter returns a function admitting bulk writes in the lane until ctx
+// is done, for BulkOptions.Admit
+func (a *Admission) Admitter(ctx context.Context, name Lane) func(n int) (func(), error) {
+	return func(n int) (func(), error) {
+		return a.Admit(ctx, name, n)
+	}
+}
+
+// Stats reports on each lane
+func (a *Admission) Stats() map[Lane]LaneStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	stats := make(map[Lane]LaneStats, len(a.lanes))
+	for name, l := range a.lanes {
+		stats[name] = l.stats
+	}
+	return stats
+}
@@ -0,0 +1,250 @@
+package documentstore
+
+import (
+	"sort"
+	"strings"
+)
+
+// TokenFilter is a step of an analyzer, rewriting, dropping or adding
+// tokens. Filters see every token of a field at once, in order.
+type TokenFilter interface {
+	Filter(tokens []string) []string
+}
+
+// TokenFilterFunc lets an ordinary function be used as a TokenFilter
+type TokenFilterFunc func(tokens []string) []string
+
+// Filter calls f(tokens)
+func (f TokenFilterFunc) Filter(tokens []string) []string {
+	return f(tokens)
+}
+
+// Analyzer turns text into the terms the full-text index holds. The same
+// analyzer must read a document's text and the queries meant to find it,
+// which DocumentDB sees to.
+type Analyzer struct {
+	// Tokenizer splits text into tokens; nil means StandardTokenizer
+	Tokenizer func(text string) []string
+	Filters   []TokenFilter
+}
+
+// StandardAnalyzer lowercases and splits text into runs of letters and
+// digits, and does nothing else
+var StandardAnalyzer = &Analyzer{}
+
+// StandardTokenizer lowercases text and splits it into runs of letters and
+// digits
+func StandardTokenizer(text string) []string {
+	return tokenize(text)
+}
+
+// Analyze returns the terms of text. Filters that drop tokens, such as stop
+// words, close up the gaps, so phrases match across them.
+func (a *Analyzer) Analyze(text string) []string {
+	if a == nil {
+		return tokenize(text)
+	}
+	var tokens []string
+	if a.Tokenizer != nil {
+		tokens = a.Tokenizer(text)
+	} else {
+		tokens = tokenize(text)
+	}
+	for _, filter := range a.Filters {
+		if len(tokens) == 0 {
+			break
+		}
+		tokens = filter.Filter(tokens)
+	}
+	return tokens
+}
+
+// LowercaseFilter lowercases tokens, for tokenizers that don't
+var LowercaseFilter TokenFilter = TokenFilterFunc(func(tokens []string) []string {
+	for i, token := range tokens {
+		tokens[i] = strings.ToLower(token)
+	}
+	return tokens
+})
+
+// StopWords returns a filter dropping the given words, which should be
+// lowercase
+func StopWords(words ...string) TokenFilter {
+	stop := make(map[string]bool, len(words))
+	for _, word := range words {
+		stop[word] = true
+	}
+	return TokenFilterFunc(func(tokens []string) []string {
+		kept := tokens[:0]
+		for _, token := range tokens {
+			if !stop[token] {
+				kept = append(kept, token)
+			}
+		}
+		return kept
+	})
+}
+
+// accents folds the accented Latin letters of European languages to plain
+// ones
+var accents = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "æ", "ae",
+	"ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "œ", "oe",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ý", "y", "ÿ", "y", "ß", "ss",
+)
+
+// FoldAccents folds accented letters to plain ones, so "café" finds
+// "cafe"; tokens must already be lowercase
+var FoldAccents TokenFilter = TokenFilterFunc(func(tokens []string) []string {
+	for i, token := range tokens {
+		tokens[i] = accents.Replace(token)
+	}
+	return tokens
+})
+
+// EnglishStemmer reduces English words to their Porter stems, so
+// "searching", "searched" and "searches" all find "search"
+var EnglishStemmer TokenFilter = TokenFilterFunc(func(tokens []string) []string {
+	for i, token := range tokens {
+		tokens[i] = porterStem(token)
+	}
+	return tokens
+})
+
+// Stop words of the languages LanguageAnalyzer knows
+var (
+	EnglishStopWords = []string{
+		"a", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if", "in", "into", "is", "it",
+		"no", "not", "of", "on", "or", "such", "that", "the", "their", "then", "there", "these",
+		"they", "this", "to", "was", "will", "with",
+	}
+	GermanStopWords = []string{
+		"aber", "als", "am", "an", "auch", "auf", "aus", "bei", "bin", "bis", "das", "dass", "dem",
+		"den", "der", "des", "die", "du", "ein", "eine", "einem", "einen", "einer", "eines", "er",
+		"es", "für", "hat", "ich", "im", "in", "ist", "mit", "nach", "nicht", "noch", "oder", "sie",
+		"sind", "so", "und", "uns", "von", "vor", "war", "was", "wie", "wir", "zu", "zum", "zur",
+	}
+	FrenchStopWords = []string{
+		"au", "aux", "avec", "ce", "ces", "dans", "de", "des", "du", "elle", "en", "est", "et", "il",
+		"ils", "je", "la", "le", "les", "leur", "lui", "ma", "mais", "me", "même", "mes", "mon",
+		"ne", "nous", "on", "ou", "par", "pas", "pour", "qu", "que", "qui", "sa", "se", "ses",
+		"son", "sur", "ta", "te", "tes", "ton", "tu", "un", "une", "vous",
+	}
+	SpanishStopWords = []string{
+		"a", "al", "como", "con", "de", "del", "el", "en", "es", "esta", "este", "la", "las", "le",
+		"les", "lo", "los", "mas", "más", "me", "mi", "no", "nos", "o", "para", "pero", "por",
+		"que", "se", "si", "sin", "sobre", "su", "sus", "te", "tu", "un", "una", "uno", "y", "ya",
+	}
+)
+
+// LanguageAnalyzer returns the analyzer for a language, by ISO 639-1 code:
+// English drops stop words and stems; German, French and Spanish drop stop
+// words and fold accents. It reports false for other languages.
+func LanguageAnalyzer(language string) (*Analyzer, bool) {
+	switch language {
+	case "en":
+		return &Analyzer{Filters: []TokenFilter{StopWords(EnglishStopWords...), EnglishStemmer}}, true
+	case "de":
+		return &Analyzer{Filters: []TokenFilter{StopWords(GermanStopWords...), FoldAccents}}, true
+	case "fr":
+		return &Analyzer{Filters: []TokenFilter{StopWords(FrenchStopWords...), FoldAccents}}, true
+	case "es":
+		return &Analyzer{Filters: []TokenFilter{StopWords(SpanishStopWords...), FoldAccents}}, true
+	}
+	return nil, false
+}
+
+// DefaultLanguageKey is the metadata key naming a document's language
+// unless Analysis says otherwise
+const DefaultLanguageKey = "language"
+
+// Analysis chooses the analyzer for each document by its language
+type Analysis struct {
+	// Default analyzes documents in other languages or none; nil means
+	// StandardAnalyzer
+	Default *Analyzer
+	// Languages maps the values of the language key to their analyzers
+	Languages map[string]*Analyzer
+	// LanguageKey is the metadata key naming a document's language; empty
+	// means DefaultLanguageKey
+	LanguageKey string
+}
+
+// analyzerFor returns the analyzer of a document
+func (a *Analysis) analyzerFor(doc *Document) *Analyzer {
+	if a == nil {
+		return StandardAnalyzer
+	}
+	key := a.LanguageKey
+	if key == "" {
+		key = DefaultLanguageKey
+	}
+	if analyzer, ok := a.Languages[doc.Metadata[key]]; ok && analyzer != nil {
+		return analyzer
+	}
+	return a.Default
+}
+
+// analyzers returns every analyzer documents may be indexed with, the
+// default first
+func (a *Analysis) analyzers() []*Analyzer {
+	if a == nil {
+		return []*Analyzer{StandardAnalyzer}
+	}
+	languages := make([]string, 0, len(a.Languages))
+	for language := range a.Languages {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	analyzers := []*Analyzer{a.Default}
+	seen := map[*Analyzer]bool{a.Default: true}
+	for _, language := range languages {
+		if analyzer := a.Languages[language]; analyzer != nil && !seen[analyzer] {
+			seen[analyzer] = true
+			analyzers = append(analyzers, analyzer)
+		}
+	}
+	return analyzers
+}
+
+// matchEach runs match once for each analyzer, which analyzes the query
+// with it, and keeps the matches indexed with that analyzer, so documents
+// are only ever compared with queries analyzed the same way. Callers hold
+// the shard's lock.
+func (a *Analysis) matchEach(s *shard, match func(analyzer *Analyzer) (ids, terms []string)) ([]string, []string) {
+	analyzers := a.analyzers()
+	if len(analyzers) == 1 {
+		return match(analyzers[0])
+	}
+	var ids, terms []string
+	for _, analyzer := range analyzers {
+		matched, matchedTerms := match(analyzer)
+		for _, id := range matched {
+			if a.analyzerFor(s.documents[id]) == analyzer {
+				ids = append(ids, id)
+			}
+		}
+		terms = append(terms, matchedTerms...)
+	}
+	return ids, terms
+}
+
+// SetAnalysis changes how text is analyzed and reindexes every document
+// with the new analyzers, into a new generation of the full-text index.
+// Documents are analyzed while searches and writes carry on against the old
+// generation; the new one is swapped in at once when it is ready. Documents
+// and queries are analyzed alike, so searches keep finding what they
+// should.
+func (db *DocumentDB) SetAnalysis(analysis Analysis) {
+	db.rebuildIndex(&analysis)
+}
+
+// currentAnalysis returns the analysis settings, nil for the standard
+// analyzer alone
+func (db *DocumentDB) currentAnalysis() *Analysis {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.analysis
+}
@@ -0,0 +1,180 @@
+package documentstore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Backups are gzip-compressed JSON lines: a backupHeader, then one document
+// per line in ID order
+const (
+	backupFormat  = "documentdb-backup"
+	backupVersion = 1
+)
+
+type backupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	// Since is zero for full backups. Incremental ones hold the documents
+	// updated after it and are restored over the existing documents.
+	Since     time.Time `json:"since"`
+	Documents int       `json:"documents"`
+}
+
+// WriteBackup streams a backup of the documents updated after since, or of
+// every document if since is zero, to w. Each shard is locked only while
+// its documents are listed, not while they are written. Incremental backups
+// can't record deletions, so restoring a full backup followed by its
+// incrementals brings back documents deleted in between.
+func (db *DocumentDB) WriteBackup(w io.Writer, since time.Time) (int, error) {
+	var docs []*Document
+	for _, doc := range db.snapshot() {
+		if since.IsZero() || doc.UpdatedAt.After(since) {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	header := backupHeader{
+		Format:    backupFormat,
+		Version:   backupVersion,
+		CreatedAt: time.Now(),
+		Since:     since,
+		Documents: len(docs),
+	}
+	if err := enc.Encode(header); err != nil {
+		return 0, err
+	}
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return 0, err
+		}
+	}
+	return len(docs), gz.Close()
+}
+
+// BackupDatabase writes a full backup of the document database to a file,
+// replacing it atomically
+func (db *DocumentDB) BackupDatabase(filePath string) error {
+	return db.backupToFile(filePath, time.Time{})
+}
+
+// BackupDatabaseSince writes an incremental backup of the documents updated
+// after since to a file, replacing it atomically
+func (db *DocumentDB) BackupDatabaseSince(filePath string, since time.Time) error {
+	if since.IsZero() {
+		return errors.New("incremental backup needs a start time")
+	}
+	return db.backupToFile(filePath, since)
+}
+
+func (db *DocumentDB) backupToFile(filePath string, since time.Time) error {
+	var count int
+	err := replaceFile(filePath, func(w io.Writer) error {
+		var err error
+		count, err = db.WriteBackup(w, since)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Database backed up", "path", filePath, "documents", count)
+	return nil
+}
+
+// readBackup decodes a backup, or a legacy backup holding one JSON object
+// of documents by ID
+func readBackup(r io.Reader) (backupHeader, map[string]*Document, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		var docs map[string]*Document
+		if err := json.NewDecoder(br).Decode(&docs); err != nil {
+			return backupHeader{}, nil, err
+		}
+		for id, doc := range docs {
+			if doc == nil || id == "" || doc.ID != id {
+				return backupHeader{}, nil, fmt.Errorf("document under key %q is missing or has a different ID", id)
+			}
+		}
+		return backupHeader{}, docs, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return backupHeader{}, nil, err
+	}
+	defer gz.Close()
+	dec := json.NewDecoder(gz)
+	var header backupHeader
+	if err := dec.Decode(&header); err != nil {
+		return header, nil, fmt.Errorf("malformed header: %w", err)
+	}
+	if header.Format != backupFormat {
+		return header, nil, errors.New("not a document database backup")
+	}
+	if header.Version < 1 || header.Version > backupVersion {
+		return header, nil, fmt.Errorf("unsupported backup version %d, expected at most %d", header.Version, backupVersion)
+	}
+
+	docs := make(map[string]*Document, header.Documents)
+	for {
+		var doc Document
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return header, nil, fmt.Errorf("malformed document %d: %w", len(docs)+1, err)
+		}
+		if doc.ID == "" {
+			return header, nil, fmt.Errorf("document %d has no ID", len(docs)+1)
+		}
+		if _, exists := docs[doc.ID]; exists {
+			return header, nil, fmt.Errorf("document %s appears twice", doc.ID)
+		}
+		docs[doc.ID] = &doc
+	}
+	if len(docs) != header.Documents {
+		return header, nil, fmt.Errorf("backup holds %d documents, header says %d", len(docs), header.Documents)
+	}
+	return header, docs, nil
+}
+
+// replaceFile writes path through write so readers see the old or the new
+// contents, never a mix: the data goes to a temporary file in the same
+// directory, which is synced and renamed over path
+func replaceFile(path string, write func(w io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	defer os.Remove(tmp) // Fails harmlessly once renamed
+
+	buffered := bufio.NewWriter(file)
+	if err := write(buffered); err != nil {
+		file.Close()
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
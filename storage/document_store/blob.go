@@ -0,0 +1,79 @@
+package documentstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	blobstore "pkg/blob_store"
+)
+
+// Content types of the objects written to blob stores
+var exportContentTypes = map[ExportFormat]string{
+	FormatJSONL: "application/x-ndjson",
+	FormatCSV:   "text/csv; charset=utf-8",
+	FormatWARC:  "application/warc",
+}
+
+// BackupToBlob streams a backup to key in store, as BackupDatabase and
+// BackupDatabaseSince write one to a file; a zero since makes it a full
+// backup. Large backups go up in parts, never held in memory whole.
+func (db *DocumentDB) BackupToBlob(ctx context.Context, store blobstore.BlobStore, key string, since time.Time) error {
+	count, err := putStream(ctx, store, key, "application/gzip", func(w io.Writer) (int, error) {
+		return db.WriteBackup(w, since)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to back up to %s: %w", key, err)
+	}
+	logger.Info("Database backed up", "key", key, "documents", count)
+	return nil
+}
+
+// RestoreFromBlob restores the backup under key in store, as
+// RestoreDatabaseWithOptions restores one from a file
+func (db *DocumentDB) RestoreFromBlob(ctx context.Context, store blobstore.BlobStore, key string, options RestoreOptions) (RestoreReport, error) {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return RestoreReport{}, fmt.Errorf("failed to open backup %s: %w", key, err)
+	}
+	defer r.Close()
+	return db.restore(r, key, options)
+}
+
+// ExportToBlob exports every document to key in store
+func (db *DocumentDB) ExportToBlob(ctx context.Context, store blobstore.BlobStore, key string, options ExportOptions) error {
+	count, err := putStream(ctx, store, key, exportContentTypes[options.Format], func(w io.Writer) (int, error) {
+		return db.Export(w, options)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export to %s: %w", key, err)
+	}
+	logger.Info("Documents exported", "key", key, "documents", count, "format", options.Format)
+	return nil
+}
+
+// putStream stores what write produces under key, piping it to the store
+// as it is written, and returns write's count
+func putStream(ctx context.Context, store blobstore.BlobStore, key, contentType string, write func(w io.Writer) (int, error)) (int, error) {
+	pr, pw := io.Pipe()
+	type result struct {
+		count int
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		count, err := write(pw)
+		pw.CloseWithError(err)
+		done <- result{count, err}
+	}()
+
+	err := store.Put(ctx, key, pr, blobstore.PutOptions{ContentType: contentType})
+	// Unblock the writer if the store gave up before reading everything
+	pr.CloseWithError(fmt.Errorf("upload ended early: %v", err))
+	written := <-done
+	if written.err != nil && err == nil {
+		err = written.err
+	}
+	return written.count, err
+}
@@ -0,0 +1,227 @@
+package documentstore
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultBulkBatchSize is how many documents a bulk request writes to the
+// storage engine at a time unless told otherwise
+const DefaultBulkBatchSize = 500
+
+// BulkOptions controls a bulk request
+type BulkOptions struct {
+	// BatchSize is how many documents are written to the engine at a time.
+	// The part of a batch in each shard succeeds or fails as a whole.
+	BatchSize int
+	// Upsert replaces existing documents, as new versions, instead of
+	// failing them
+	Upsert bool
+	// Admit, if set, is called before each batch with its size and returns
+	// a function to call once the batch is written, as Admission.Admitter's
+	// functions do. If it fails, the batch and the rest of the request fail
+	// with its error.
+	Admit func(n int) (func(), error)
+}
+
+// Outcomes of one document in a bulk request
+const (
+	BulkCreated = "created"
+	BulkUpdated = "updated"
+	BulkFailed  = "failed"
+)
+
+// BulkItem reports what became of one document of a bulk request
+type BulkItem struct {
+	Index  int    `json:"index"` // Position in the request
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Set when the document was stored as a link to a duplicate's content
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+// BulkReport lists the outcome of every document of a bulk request, in
+// request order
+type BulkReport struct {
+	Created int        `json:"created"`
+	Updated int        `json:"updated"`
+	Failed  int        `json:"failed"`
+	Items   []BulkItem `json:"items"`
+	// Replaced lists the documents deleted as older copies of a document in
+	// the request, under DedupKeepLatest
+	Replaced []string `json:"replaced,omitempty"`
+}
+
+// Err summarizes the failures of a report, or returns nil if there were none
+func (r BulkReport) Err() error {
+	if r.Failed == 0 {
+		return nil
+	}
+	for _, item := range r.Items {
+		if item.Status == BulkFailed {
+			return fmt.Errorf("%d of %d documents failed, first %q: %s", r.Failed, len(r.Items), item.ID, item.Error)
+		}
+	}
+	return nil
+}
+
+// Bulk adds many documents, batch by batch, validating each one. Invalid
+// documents and those whose batch the engine rejects fail on their own
+// without stopping the rest, and the report says which and why. Shards are
+// locked one at a time so readers aren't held up by large requests.
+// Duplicate content is treated as the dedup policy says, counting
+// duplicates of documents earlier in the request.
+func (db *DocumentDB) Bulk(docs []*Document, options BulkOptions) BulkReport {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBulkBatchSize
+	}
+	policy := db.dedupPolicy()
+	if policy != DedupOff {
+		db.ingest.Lock()
+		defer db.ingest.Unlock()
+	}
+	dedup := db.planBulkDedup(docs, policy)
+	report := BulkReport{Items: make([]BulkItem, len(docs))}
+	seen := make(map[string]int, len(docs)) // ID to first index
+	for start := 0; start < len(docs); start += options.BatchSize {
+		end := start + options.BatchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		var release func()
+		if options.Admit != nil {
+			var err error
+			if release, err = options.Admit(end - start); err != nil {
+				for i := start; i < len(docs); i++ {
+					report.Items[i] = BulkItem{Index: i, Status: BulkFailed, Error: err.Error()}
+					if docs[i] != nil {
+						report.Items[i].ID = docs[i].ID
+					}
+				}
+				break
+			}
+		}
+		// Each shard's part of the batch is written on its own, so only that
+		// shard is locked meanwhile
+		groups := make(map[*shard][]int)
+		for i := start; i < end; i++ {
+			var id string
+			if docs[i] != nil {
+				id = docs[i].ID
+			}
+			s := db.shardFor(id)
+			groups[s] = append(groups[s], i)
+		}
+		for _, s := range db.shards {
+			if positions, ok := groups[s]; ok {
+				db.bulkShard(s, docs, positions, options, seen, dedup, &report)
+			}
+		}
+		if release != nil {
+			release()
+		}
+	}
+	if policy == DedupKeepLatest {
+		replaced, err := db.dropBulkCopies(docs, dedup, &report)
+		if err != nil {
+			logger.Warn("Bulk request stored but older copies remain", "error", err)
+		}
+		report.Replaced = replaced
+	}
+	for _, item := range report.Items {
+		switch item.Status {
+		case BulkCreated:
+			report.Created++
+		case BulkUpdated:
+			report.Updated++
+		default:
+			report.Failed++
+		}
+	}
+	return report
+}
+
+// bulkShard validates and writes the documents at positions, which belong
+// to s, filling in their items
+func (db *DocumentDB) bulkShard(s *shard, docs []*Document, positions []int, options BulkOptions, seen map[string]int, dedup bulkDedup, report *BulkReport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var batch Batch
+	var replaced []*Document // Existing versions of the upserted documents
+	var indexes []int        // Request positions of batch.Puts
+	now := time.Now()
+	schema := db.currentSchema()
+	for _, i := range positions {
+		doc := docs[i]
+		item := &report.Items[i]
+		item.Index = i
+		item.Status = BulkFailed
+		if doc == nil {
+			item.Error = "document is null"
+			continue
+		}
+		item.ID = doc.ID
+		if doc.ID == "" {
+			item.Error = "document has no ID"
+			continue
+		}
+		if first, dup := seen[doc.ID]; dup {
+			item.Error = fmt.Sprintf("duplicate of document %d in this request", first)
+			continue
+		}
+		seen[doc.ID] = i
+		if err := schema.validate(doc); err != nil {
+			item.Error = err.Error()
+			continue
+		}
+		if err := db.vectors.check(doc); err != nil {
+			item.Error = err.Error()
+			continue
+		}
+		if err := dedup.rejected[i]; err != nil {
+			item.Error = err.Error()
+			continue
+		}
+
+		existing, exists := s.documents[doc.ID]
+		if exists && !options.Upsert {
+			item.Error = fmt.Sprintf("%v: %s", ErrAlreadyExists, doc.ID)
+			continue
+		}
+		dedup.plans[i].apply(doc)
+		item.DuplicateOf = doc.DuplicateOf
+		doc.Links = normalizeLinks(doc.Links)
+		doc.UpdatedAt = now
+		if exists {
+			doc.CreatedAt = existing.CreatedAt
+			doc.Version = existing.Version + 1
+			item.Status = BulkUpdated
+		} else {
+			doc.CreatedAt = now
+			doc.Version = s.firstVersionLocked(doc.ID)
+			item.Status = BulkCreated
+		}
+		batch.Puts = append(batch.Puts, doc)
+		replaced = append(replaced, existing)
+		indexes = append(indexes, i)
+	}
+	if len(batch.Puts) == 0 {
+		return
+	}
+
+	if err := db.engine.Write(batch); err != nil {
+		for _, i := range indexes {
+			report.Items[i].Status = BulkFailed
+			report.Items[i].Error = err.Error()
+		}
+		return
+	}
+	for i, doc := range batch.Puts {
+		if replaced[i] != nil {
+			db.keepVersionLocked(s, replaced[i])
+		}
+		db.putLocked(s, doc)
+	}
+}
@@ -0,0 +1,365 @@
+package documentstore
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CacheOptions configures a CachingEngine
+type CacheOptions struct {
+	// MaxBytes bounds the cache by the approximate in-memory size of the
+	// documents it holds; the least recently used are evicted first
+	MaxBytes int64
+	// WriteBehind makes Write return once a batch is queued instead of once
+	// it is stored. Queued writes are coalesced by ID and handed to the
+	// wrapped engine as one batch every FlushInterval, whenever MaxPending
+	// documents are queued, and on Load, Sync and Close. Queued writes are
+	// lost if the process dies, unless a WALEngine wraps the cache.
+	WriteBehind   bool
+	FlushInterval time.Duration
+	MaxPending    int
+}
+
+// DefaultCacheOptions cache up to 64MB of documents and write them through
+var DefaultCacheOptions = CacheOptions{
+	MaxBytes:      64 << 20,
+	FlushInterval: 100 * time.Millisecond,
+	MaxPending:    1000,
+}
+
+// CacheStats counts the work of a CachingEngine, for monitoring
+type CacheStats struct {
+	Hits        int64 // Reads served from the cache or the write queue
+	Misses      int64 // Reads passed to the wrapped engine
+	Evictions   int64
+	Entries     int
+	Bytes       int64
+	Pending     int   // Documents queued for writing behind
+	Flushes     int64 // Batches of queued writes stored
+	FlushErrors int64
+}
+
+// CachingEngine keeps recently read and written documents in an LRU cache
+// in front of the engine it wraps, so documents read one at a time with Get
+// are served from memory while they stay hot. A DocumentDB loads every
+// document at open and serves reads from memory anyway; the cache is for
+// readers that look documents up by ID in an engine, such as a serving
+// process sharing a Bolt file. It can also write behind, turning many
+// small writes into few large ones.
+type CachingEngine struct {
+	inner   StorageEngine
+	options CacheOptions
+
+	mutex      sync.Mutex
+	lru        *list.List // Of *cacheEntry, most recently used first
+	entries    map[string]*list.Element
+	generation uint64 // Bumped by every write, so stale reads aren't cached
+	stats      CacheStats
+	pending    map[string]*Document // Queued writes; nil marks a delete
+	flushing   map[string]*Document // Writes being flushed
+	flushErr   error
+
+	flushMutex sync.Mutex // Serializes flushes
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+type cacheEntry struct {
+	doc  *Document
+	size int64
+}
+
+// NewCachingEngine wraps inner with a cache. A zero MaxBytes, FlushInterval
+// or MaxPending takes its value from DefaultCacheOptions.
+func NewCachingEngine(inner StorageEngine, options CacheOptions) *CachingEngine {
+	if options.MaxBytes == 0 {
+		options.MaxBytes = DefaultCacheOptions.MaxBytes
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultCacheOptions.FlushInterval
+	}
+	if options.MaxPending <= 0 {
+		options.MaxPending = DefaultCacheOptions.MaxPending
+	}
+	e := &CachingEngine{
+		inner:   inner,
+		options: options,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		pending: make(map[string]*Document),
+	}
+	if options.WriteBehind {
+		e.stop = make(chan struct{})
+		e.done = make(chan struct{})
+		go e.flushLoop()
+	}
+	return e
+}
+
+// Load flushes queued writes and loads every document from the wrapped
+// engine, leaving the cache as it is
+func (e *CachingEngine) Load() (map[string]*Document, error) {
+	if err := e.flush(); err != nil {
+		return nil, err
+	}
+	return e.inner.Load()
+}
+
+// Get returns a copy of the document, reading it from the wrapped engine
+// and caching it on a miss
+func (e *CachingEngine) Get(id string) (*Document, error) {
+	doc, generation, err := e.lookup(id)
+	if doc != nil || err != nil {
+		return doc, err
+	}
+
+	doc, err = getDocument(e.inner, id)
+	if err != nil {
+		return nil, err
+	}
+	e.mutex.Lock()
+	// A write since the read may have replaced the document
+	if e.generation == generation {
+		e.storeLocked(copyDocument(doc))
+	}
+	e.mutex.Unlock()
+	return doc, nil
+}
+
+// GetFields returns the given fields of a document from the cache, or else
+// from the wrapped engine. Partial documents aren't cached.
+func (e *CachingEngine) GetFields(id string, fields []string) (*Document, error) {
+	p, err := compileProjection(fields)
+	if err != nil {
+		return nil, err
+	}
+	doc, _, err := e.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	if doc != nil {
+		return p.apply(doc), nil
+	}
+	return getDocumentFields(e.inner, id, fields)
+}
+
+// lookup returns a copy of a queued or cached document. On a miss it
+// returns the write generation, so that what is read from the wrapped
+// engine is only cached if nothing was written meanwhile.
+func (e *CachingEngine) lookup(id string) (*Document, uint64, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if doc, queued := e.queuedLocked(id); queued {
+		e.stats.Hits++
+		if doc == nil {
+			return nil, 0, fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		return copyDocument(doc), 0, nil
+	}
+	if element, ok := e.entries[id]; ok {
+		e.lru.MoveToFront(element)
+		e.stats.Hits++
+		return copyDocument(element.Value.(*cacheEntry).doc), 0, nil
+	}
+	e.stats.Misses++
+	return nil, e.generation, nil
+}
+
+// Write stores the batch in the wrapped engine and the cache, or with
+// WriteBehind queues it. Once a flush has failed, writes fail until one
+// succeeds, so callers learn that their earlier writes aren't stored.
+func (e *CachingEngine) Write(batch Batch) error {
+	if !e.options.WriteBehind {
+		if err := e.inner.Write(batch); err != nil {
+			return err
+		}
+		e.mutex.Lock()
+		e.cacheLocked(batch)
+		e.mutex.Unlock()
+		return nil
+	}
+
+	e.mutex.Lock()
+	if e.flushErr != nil {
+		e.mutex.Unlock()
+		if err := e.flush(); err != nil {
+			return err
+		}
+		e.mutex.Lock()
+	}
+	for _, id := range batch.Deletes {
+		e.pending[id] = nil
+	}
+	for _, doc := range batch.Puts {
+		e.pending[doc.ID] = copyDocument(doc)
+	}
+	e.cacheLocked(batch)
+	full := len(e.pending) >= e.options.MaxPending
+	e.mutex.Unlock()
+
+	if full {
+		// The batch is queued, so a failure here is reported by the next
+		// write rather than this one
+		e.flush()
+	}
+	return nil
+}
+
+// Sync flushes queued writes and then the wrapped engine, if it can sync
+func (e *CachingEngine) Sync() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	if inner, ok := e.inner.(syncer); ok {
+		return inner.Sync()
+	}
+	return nil
+}
+
+// canSync tells a WALEngine whether Sync makes writes durable
+func (e *CachingEngine) canSync() bool {
+	return canSync(e.inner)
+}
+
+// Close flushes queued writes and closes the wrapped engine
+func (e *CachingEngine) Close() error {
+	if e.stop != nil {
+		close(e.stop)
+		<-e.done
+	}
+	err := e.flush()
+	if closeErr := e.inner.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Stats returns the cache's counters
+func (e *CachingEngine) Stats() CacheStats {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	stats := e.stats
+	stats.Entries = e.lru.Len()
+	stats.Pending = len(e.pending) + len(e.flushing)
+	return stats
+}
+
+func (e *CachingEngine) flushLoop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.options.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			if err := e.flush(); err != nil {
+				logger.Error("Write-behind flush failed", "error", err)
+			}
+		}
+	}
+}
+
+// flush hands the queued writes to the wrapped engine as one batch. If that
+// fails they are queued again, behind any newer writes to the same IDs.
+func (e *CachingEngine) flush() error {
+	e.flushMutex.Lock()
+	defer e.flushMutex.Unlock()
+
+	e.mutex.Lock()
+	if len(e.pending) == 0 {
+		e.mutex.Unlock()
+		return nil
+	}
+	var batch Batch
+	for id, doc := range e.pending {
+		if doc == nil {
+			batch.Deletes = append(batch.Deletes, id)
+		} else {
+			batch.Puts = append(batch.Puts, doc)
+		}
+	}
+	e.flushing, e.pending = e.pending, make(map[string]*Document)
+	e.mutex.Unlock()
+
+	err := e.inner.Write(batch)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err != nil {
+		for id, doc := range e.flushing {
+			if _, newer := e.pending[id]; !newer {
+				e.pending[id] = doc
+			}
+		}
+		e.flushErr = fmt.Errorf("failed to write %d queued documents: %w", len(e.flushing), err)
+		e.stats.FlushErrors++
+	} else {
+		e.flushErr = nil
+		e.stats.Flushes++
+	}
+	e.flushing = nil
+	return e.flushErr
+}
+
+// queuedLocked returns the latest queued write to id, nil for a delete
+func (e *CachingEngine) queuedLocked(id string) (*Document, bool) {
+	if doc, ok := e.pending[id]; ok {
+		return doc, true
+	}
+	doc, ok := e.flushing[id]
+	return doc, ok
+}
+
+// cacheLocked brings the cache up to date with a batch being written
+func (e *CachingEngine) cacheLocked(batch Batch) {
+	e.generation++
+	for _, id := range batch.Deletes {
+		e.removeLocked(id)
+	}
+	for _, doc := range batch.Puts {
+		e.storeLocked(copyDocument(doc))
+	}
+}
+
+// storeLocked caches doc, which the cache then owns, evicting the least
+// recently used documents to make room
+func (e *CachingEngine) storeLocked(doc *Document) {
+	e.removeLocked(doc.ID)
+	size := documentSize(doc)
+	if size > e.options.MaxBytes {
+		return
+	}
+	e.entries[doc.ID] = e.lru.PushFront(&cacheEntry{doc: doc, size: size})
+	e.stats.Bytes += size
+	for e.stats.Bytes > e.options.MaxBytes {
+		oldest := e.lru.Back()
+		e.removeLocked(oldest.Value.(*cacheEntry).doc.ID)
+		e.stats.Evictions++
+	}
+}
+
+func (e *CachingEngine) removeLocked(id string) {
+	element, ok := e.entries[id]
+	if !ok {
+		return
+	}
+	e.lru.Remove(element)
+	delete(e.entries, id)
+	e.stats.Bytes -= element.Value.(*cacheEntry).size
+}
+
+// documentSize estimates the memory a cached document takes
+func documentSize(doc *Document) int64 {
+	size := 256 + len(doc.ID) + len(doc.Title) + len(doc.Content) + len(doc.ContentHash) +
+		len(doc.DuplicateOf) + len(doc.ContentEncoding) + len(doc.CompressedContent)
+	for key, value := range doc.Metadata {
+		size += len(key) + len(value) + 32
+	}
+	for _, link := range doc.Links {
+		size += len(link) + 16
+	}
+	return int64(size)
+}
@@ -0,0 +1,159 @@
+package documentstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// changeLogSize is how many recent changes, at least, are kept for watchers
+// to catch up from, and how far a watcher may fall behind before it is dropped
+const changeLogSize = 10000
+
+// Kinds of change events
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// Event is one change to the database. Sequence numbers start at 1 each
+// time the database is opened and grow by 1 with every change.
+type Event struct {
+	Seq      uint64    `json:"seq"`
+	Type     string    `json:"type"`
+	ID       string    `json:"id"`
+	Document *Document `json:"document,omitempty"` // The new version; for soft deletes the tombstone
+	Time     time.Time `json:"time"`
+}
+
+// watcher queues events for one Watch call and feeds them to its channel
+type watcher struct {
+	mutex    sync.Mutex
+	pending  []Event
+	overflow bool // Fell too far behind; the channel closes once drained
+	closed   bool
+	wake     chan struct{}
+}
+
+// ChangeSeq returns the sequence number of the latest change, to Watch from
+// when only changes from now on are wanted
+func (db *DocumentDB) ChangeSeq() uint64 {
+	db.feed.Lock()
+	defer db.feed.Unlock()
+	return db.seq
+}
+
+// Watch streams the changes after sinceSeq in order, replaying those that
+// happened already, then the rest as they happen. The channel closes when
+// ctx is done, when the database closes, or when the consumer falls more
+// than changeLogSize events behind; in the last case call Watch again from
+// the last sequence number received. Watch fails if the changes after
+// sinceSeq are no longer kept, in which case the consumer has to resync
+// from ListDocuments.
+func (db *DocumentDB) Watch(ctx context.Context, sinceSeq uint64) (<-chan Event, error) {
+	db.feed.Lock()
+	defer db.feed.Unlock()
+
+	if sinceSeq > db.seq {
+		return nil, fmt.Errorf("sequence %d is ahead of the change feed at %d", sinceSeq, db.seq)
+	}
+	if len(db.changes) > 0 && sinceSeq+1 < db.changes[0].Seq {
+		return nil, fmt.Errorf("changes after %d are no longer kept; the oldest is %d", sinceSeq, db.changes[0].Seq)
+	}
+
+	w := &watcher{wake: make(chan struct{}, 1)}
+	for _, event := range db.changes {
+		if event.Seq > sinceSeq {
+			w.pending = append(w.pending, event)
+		}
+	}
+	db.watchers[w] = true
+
+	out := make(chan Event)
+	go db.deliver(ctx, w, out)
+	return out, nil
+}
+
+// deliver passes a watcher's events to out until the watch ends
+func (db *DocumentDB) deliver(ctx context.Context, w *watcher, out chan<- Event) {
+	defer close(out)
+	defer func() {
+		db.feed.Lock()
+		delete(db.watchers, w)
+		db.feed.Unlock()
+	}()
+
+	for {
+		w.mutex.Lock()
+		events, done := w.pending, w.closed || w.overflow
+		w.pending = nil
+		w.mutex.Unlock()
+
+		for _, event := range events {
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(events) > 0 {
+			continue
+		}
+		if done {
+			return
+		}
+		select {
+		case <-w.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// publish records a change and queues it for the watchers. Callers hold
+// the lock of the document's shard, so changes to a document are published
+// in the order they are made.
+func (db *DocumentDB) publish(kind, id string, doc *Document) {
+	db.feed.Lock()
+	defer db.feed.Unlock()
+
+	db.seq++
+	event := Event{Seq: db.seq, Type: kind, ID: id, Document: doc, Time: time.Now()}
+	if len(db.changes) == 2*changeLogSize {
+		// Trim in bulk so each change costs O(1) on average
+		db.changes = append(db.changes[:0], db.changes[changeLogSize:]...)
+	}
+	db.changes = append(db.changes, event)
+
+	for w := range db.watchers {
+		w.mutex.Lock()
+		if len(w.pending) >= changeLogSize {
+			w.overflow = true
+		} else if !w.overflow {
+			w.pending = append(w.pending, event)
+		}
+		w.mutex.Unlock()
+		w.notify()
+	}
+}
+
+// closeWatchers ends every watch once its queued events are delivered
+func (db *DocumentDB) closeWatchers() {
+	db.feed.Lock()
+	defer db.feed.Unlock()
+	for w := range db.watchers {
+		w.mutex.Lock()
+		w.closed = true
+		w.mutex.Unlock()
+		w.notify()
+	}
+}
+
+func (w *watcher) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
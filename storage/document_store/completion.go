@@ -0,0 +1,66 @@
+package documentstore
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CompleteQuery suggests up to n ways to finish a query as it is typed:
+// the query with its last word completed to indexed words starting with
+// it, those in the most documents first. Like SuggestQuery's corrections,
+// completions are index terms, so under a stemming analyzer they are
+// stems. A query ending in a space, or in anything but a word searched in
+// text, has no completions.
+func (db *DocumentDB) CompleteQuery(query string, n int) []string {
+	if n <= 0 || query == "" || strings.TrimRightFunc(query, unicode.IsSpace) != query {
+		return nil
+	}
+	head, last := "", query
+	if i := strings.LastIndexFunc(query, unicode.IsSpace); i >= 0 {
+		_, size := utf8.DecodeRuneInString(query[i:])
+		head, last = query[:i+size], query[i+size:]
+	}
+	field, word, scoped := strings.Cut(last, ":")
+	if !scoped {
+		field, word = "", last
+	} else if field != FieldTitle && field != FieldContent {
+		return nil
+	}
+	prefix := strings.ToLower(word)
+	if terms := tokenize(word); len(terms) != 1 || terms[0] != prefix {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	db.rlockAll()
+	for _, s := range db.shards {
+		s.text.dictionary.prefixed(prefix, func(term string) {
+			counts[term] += s.text.df[term]
+		})
+	}
+	db.runlockAll()
+
+	terms := make([]string, 0, len(counts))
+	for term := range counts {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if counts[terms[i]] != counts[terms[j]] {
+			return counts[terms[i]] > counts[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+	if len(terms) > n {
+		terms = terms[:n]
+	}
+	completions := make([]string, len(terms))
+	for i, term := range terms {
+		if scoped {
+			term = field + ":" + term
+		}
+		completions[i] = head + term
+	}
+	return completions
+}
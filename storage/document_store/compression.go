@@ -0,0 +1,227 @@
+package documentstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses document content at rest
+type Codec interface {
+	// Name identifies the codec in stored documents, so it must not change
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[string]Codec{"gzip": GzipCodec{Level: gzip.DefaultCompression}}
+)
+
+// RegisterCodec makes a codec available to CompressingEngine, both for
+// compressing and for reading documents stored with it. gzip is built in;
+// faster codecs such as zstd can be added by wrapping a library for them.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+func lookupCodec(name string) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec %q", name)
+	}
+	return codec, nil
+}
+
+// GzipCodec compresses with gzip at the given level
+type GzipCodec struct {
+	Level int
+}
+
+// Name returns "gzip"
+func (c GzipCodec) Name() string {
+	return "gzip"
+}
+
+// Compress gzips data
+func (c GzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress gunzips data
+func (c GzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// CompressionOptions configures a CompressingEngine
+type CompressionOptions struct {
+	Codec string // Name of a registered codec
+	// Threshold is the content size in bytes below which content is stored
+	// as is, since small texts barely shrink
+	Threshold int
+	// Enabled, if set, is asked before each document is written whether to
+	// compress it, so the codec can be rolled out and back at runtime.
+	// Compressed documents load either way.
+	Enabled func() bool
+}
+
+// DefaultCompressionOptions gzips content of 1KB or more
+var DefaultCompressionOptions = CompressionOptions{Codec: "gzip", Threshold: 1024}
+
+// CompressingEngine compresses document content on its way into the engine
+// it wraps and decompresses it as documents are loaded, so large HTML
+// bodies take a fraction of the space on disk. Content that wouldn't shrink
+// is stored as is. Documents stored without compression load unchanged,
+// so compression can be switched on for an existing database.
+type CompressingEngine struct {
+	inner     StorageEngine
+	codec     Codec
+	threshold int
+	enabled   func() bool // Nil to always compress
+}
+
+// syncingCompressingEngine passes Sync through to a wrapped engine that
+// has it
+type syncingCompressingEngine struct {
+	*CompressingEngine
+}
+
+// Sync flushes the wrapped engine
+func (e syncingCompressingEngine) Sync() error {
+	return e.inner.(syncer).Sync()
+}
+
+// NewCompressingEngine wraps inner with compression. The engine it returns
+// can Sync if inner can, so it may sit under a WALEngine.
+func NewCompressingEngine(inner StorageEngine, options CompressionOptions) (StorageEngine, error) {
+	codec, err := lookupCodec(options.Codec)
+	if err != nil {
+		return nil, err
+	}
+	e := &CompressingEngine{inner: inner, codec: codec, threshold: options.Threshold, enabled: options.Enabled}
+	if canSync(inner) {
+		return syncingCompressingEngine{e}, nil
+	}
+	return e, nil
+}
+
+// Load returns the wrapped engine's documents with their content
+// decompressed
+func (e *CompressingEngine) Load() (map[string]*Document, error) {
+	docs, err := e.inner.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if err := decompress(doc); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// Get reads one document from the wrapped engine and decompresses its
+// content, if the wrapped engine can read single documents
+func (e *CompressingEngine) Get(id string) (*Document, error) {
+	doc, err := getDocument(e.inner, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := decompress(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Write compresses the content of the batch's documents and hands them on
+func (e *CompressingEngine) Write(batch Batch) error {
+	puts := make([]*Document, len(batch.Puts))
+	for i, doc := range batch.Puts {
+		compressed, err := e.compress(doc)
+		if err != nil {
+			return fmt.Errorf("failed to compress document %s: %w", doc.ID, err)
+		}
+		puts[i] = compressed
+	}
+	return e.inner.Write(Batch{Puts: puts, Deletes: batch.Deletes})
+}
+
+// Close closes the wrapped engine
+func (e *CompressingEngine) Close() error {
+	return e.inner.Close()
+}
+
+// compress returns a copy of doc with its content compressed, or doc itself
+// if its content is too small or doesn't shrink or compression is off
+func (e *CompressingEngine) compress(doc *Document) (*Document, error) {
+	if len(doc.Content) < e.threshold || len(doc.Content) == 0 || (e.enabled != nil && !e.enabled()) {
+		return doc, nil
+	}
+	data, err := e.codec.Compress([]byte(doc.Content))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= len(doc.Content) {
+		return doc, nil
+	}
+	c := *doc
+	c.Content = ""
+	c.ContentEncoding = e.codec.Name()
+	c.CompressedContent = data
+	return &c, nil
+}
+
+// GetFields reads the given fields of a document from the wrapped engine,
+// decompressing its content if that is among them
+func (e *CompressingEngine) GetFields(id string, fields []string) (*Document, error) {
+	doc, err := getDocumentFields(e.inner, id, fields)
+	if err != nil {
+		return nil, err
+	}
+	if err := decompress(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// decompress restores the content of a document loaded from the wrapped
+// engine, in place
+func decompress(doc *Document) error {
+	if doc.ContentEncoding == "" {
+		return nil
+	}
+	codec, err := lookupCodec(doc.ContentEncoding)
+	if err != nil {
+		return fmt.Errorf("document %s: %w", doc.ID, err)
+	}
+	content, err := codec.Decompress(doc.CompressedContent)
+	if err != nil {
+		return fmt.Errorf("failed to decompress document %s: %w", doc.ID, err)
+	}
+	doc.Content = string(content)
+	doc.ContentEncoding, doc.CompressedContent = "", nil
+	return nil
+}
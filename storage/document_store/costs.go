@@ -0,0 +1,33 @@
+package documentstore
+
+import "time"
+
+// CostRecorder is told what indexing crawled pages costs, such as a
+// domain_costs.Reporter charging it to their domains
+type CostRecorder interface {
+	RecordParse(rawURL string, cpu time.Duration)
+	RecordIndex(rawURL string, bytes int64)
+}
+
+// SetCostRecorder makes the database tell r, for every document stored with
+// a url metadata, the time its text took to analyze and its size in the
+// index. Nil stops recording.
+func (db *DocumentDB) SetCostRecorder(r CostRecorder) {
+	db.mutex.Lock()
+	db.costs = r
+	db.mutex.Unlock()
+}
+
+// recordCosts tells the cost recorder, if one is set, what indexing doc
+// took
+func (db *DocumentDB) recordCosts(doc *Document, took time.Duration) {
+	db.mutex.RLock()
+	r := db.costs
+	db.mutex.RUnlock()
+	url := doc.Metadata[metadataURL]
+	if r == nil || url == "" {
+		return
+	}
+	r.RecordParse(url, took)
+	r.RecordIndex(url, int64(len(doc.Title)+len(doc.Content)))
+}
@@ -0,0 +1,310 @@
+package documentstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DedupPolicy decides what happens when a document is added whose content
+// is already stored under another ID, as with pages fetched from mirrors
+type DedupPolicy int
+
+const (
+	// DedupOff stores duplicates like any other document
+	DedupOff DedupPolicy = iota
+	// DedupReject refuses duplicates with a *DuplicateError
+	DedupReject
+	// DedupLink stores a duplicate without its content, with DuplicateOf
+	// naming the document holding it; ResolveDocument follows the link
+	DedupLink
+	// DedupKeepLatest stores the duplicate and deletes the older copies
+	DedupKeepLatest
+)
+
+// DuplicateError reports a document refused for having the same content as
+// a stored one
+type DuplicateError struct {
+	ID          string
+	DuplicateOf string
+}
+
+// Is makes every DuplicateError match ErrDuplicateContent
+func (e *DuplicateError) Is(target error) bool {
+	return target == ErrDuplicateContent
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("document %s has the same content as document %s", e.ID, e.DuplicateOf)
+}
+
+// fingerprint hashes content with runs of whitespace collapsed, so copies
+// differing only in layout count as duplicates
+func fingerprint(content string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(content), " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+// documentFingerprint returns the fingerprint a document is indexed under.
+// Documents stored before fingerprinting have none recorded.
+func documentFingerprint(doc *Document) string {
+	if doc.ContentHash != "" {
+		return doc.ContentHash
+	}
+	return fingerprint(doc.Content)
+}
+
+// fingerprintIndex maps content fingerprints to the documents having them,
+// across shards. Its lock is taken after any shard's.
+type fingerprintIndex struct {
+	mutex sync.Mutex
+	ids   map[string][]string // Fingerprint to IDs, in the order stored
+}
+
+func newFingerprintIndex() *fingerprintIndex {
+	return &fingerprintIndex{ids: make(map[string][]string)}
+}
+
+func (f *fingerprintIndex) add(hash, id string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.ids[hash] = append(f.ids[hash], id)
+}
+
+func (f *fingerprintIndex) remove(hash, id string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ids := f.ids[hash]
+	for i, other := range ids {
+		if other == id {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(f.ids, hash)
+	} else {
+		f.ids[hash] = ids
+	}
+}
+
+// lookup returns the IDs of the documents with a fingerprint, oldest first,
+// leaving out those in exclude
+func (f *fingerprintIndex) lookup(hash string, exclude func(id string) bool) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var ids []string
+	for _, id := range f.ids[hash] {
+		if !exclude(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// SetDedupPolicy sets how AddDocument and Bulk treat duplicate content.
+// Updates aren't checked, so they can make documents duplicates.
+func (db *DocumentDB) SetDedupPolicy(policy DedupPolicy) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.dedup = policy
+}
+
+// dedupPolicy returns the current dedup policy
+func (db *DocumentDB) dedupPolicy() DedupPolicy {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.dedup
+}
+
+// Duplicates returns the IDs of the other documents with the same content
+// as a document, including links to it, oldest first
+func (db *DocumentDB) Duplicates(id string) ([]string, error) {
+	doc, err := db.GetDocument(id)
+	if err != nil {
+		return nil, err
+	}
+	return db.fingerprints.lookup(documentFingerprint(doc), func(other string) bool {
+		return other == id || !sameNamespace(other, id)
+	}), nil
+}
+
+// ResolveDocument is GetDocument, but a link to a duplicate's content is
+// followed to the document holding it
+func (db *DocumentDB) ResolveDocument(id string) (*Document, error) {
+	doc, err := db.GetDocument(id)
+	if err != nil || doc.DuplicateOf == "" {
+		return doc, err
+	}
+	original, err := db.GetDocument(doc.DuplicateOf)
+	if err != nil {
+		return nil, fmt.Errorf("document %s duplicates %s: %w", id, doc.DuplicateOf, err)
+	}
+	return original, nil
+}
+
+// dedupPlan is what adding a document takes under the dedup policy
+type dedupPlan struct {
+	hash        string
+	duplicateOf string   // Set to store the document as a link
+	stale       []string // Older copies to delete once it is stored
+}
+
+// planDedup works out how policy treats a document about to be added,
+// failing if it refuses it. Only documents in its namespace count as
+// copies. Callers hold db.ingest unless policy is DedupOff, and no shard
+// locks.
+func (db *DocumentDB) planDedup(doc *Document, policy DedupPolicy) (dedupPlan, error) {
+	plan := dedupPlan{hash: fingerprint(doc.Content)}
+	if policy == DedupOff {
+		return plan, nil
+	}
+	copies := db.fingerprints.lookup(plan.hash, func(id string) bool { return id == doc.ID || !sameNamespace(id, doc.ID) })
+	if len(copies) == 0 {
+		return plan, nil
+	}
+	switch policy {
+	case DedupReject:
+		return plan, &DuplicateError{ID: doc.ID, DuplicateOf: copies[0]}
+	case DedupLink:
+		plan.duplicateOf = db.canonical(copies[0])
+	case DedupKeepLatest:
+		plan.stale = copies
+	}
+	return plan, nil
+}
+
+// apply records the plan's outcome on the document being added
+func (p dedupPlan) apply(doc *Document) {
+	doc.ContentHash, doc.DuplicateOf = p.hash, p.duplicateOf
+	if p.duplicateOf != "" {
+		doc.Content = ""
+	}
+}
+
+// canonical follows id to the document holding its content
+func (db *DocumentDB) canonical(id string) string {
+	s := db.shardFor(id)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if doc, exists := s.documents[id]; exists && doc.DuplicateOf != "" {
+		return doc.DuplicateOf
+	}
+	return id
+}
+
+// bulkDedup is the dedup plan of every document of a bulk request
+type bulkDedup struct {
+	plans    []dedupPlan
+	rejected []error // Why each refused document is refused
+}
+
+// planBulkDedup is planDedup for every document of a bulk request, where a
+// document also duplicates those before it in the request. Under
+// DedupKeepLatest every copy is stored, and dropBulkCopies then deletes all
+// but the last one written.
+func (db *DocumentDB) planBulkDedup(docs []*Document, policy DedupPolicy) bulkDedup {
+	d := bulkDedup{plans: make([]dedupPlan, len(docs)), rejected: make([]error, len(docs))}
+	requested := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		if doc != nil {
+			requested[doc.ID] = true
+		}
+	}
+	first := make(map[string]int) // Dedup group to the first position in it
+	for i, doc := range docs {
+		if doc == nil {
+			continue
+		}
+		plan := dedupPlan{hash: fingerprint(doc.Content)}
+		group := dedupGroup(doc.ID, plan.hash)
+		earlier, seen := first[group]
+		if !seen {
+			first[group] = i
+		}
+		var copies []string
+		if policy != DedupOff {
+			// Stored documents the request replaces aren't copies to dedup against
+			copies = db.fingerprints.lookup(plan.hash, func(id string) bool { return requested[id] || !sameNamespace(id, doc.ID) })
+		}
+		switch {
+		case policy == DedupOff, len(copies) == 0 && !seen:
+		case policy == DedupReject && len(copies) > 0:
+			d.rejected[i] = &DuplicateError{ID: doc.ID, DuplicateOf: copies[0]}
+		case policy == DedupReject:
+			d.rejected[i] = &DuplicateError{ID: doc.ID, DuplicateOf: docs[earlier].ID}
+		case policy == DedupLink && len(copies) > 0:
+			plan.duplicateOf = db.canonical(copies[0])
+		case policy == DedupLink:
+			plan.duplicateOf = d.plans[earlier].duplicateOf
+			if plan.duplicateOf == "" {
+				plan.duplicateOf = docs[earlier].ID
+			}
+		case policy == DedupKeepLatest:
+			plan.stale = copies
+		}
+		d.plans[i] = plan
+	}
+	return d
+}
+
+// dropBulkCopies deletes, for each content a bulk request stored under
+// DedupKeepLatest, its older copies: those stored before and those earlier
+// in the request. It returns the IDs of the documents deleted.
+func (db *DocumentDB) dropBulkCopies(docs []*Document, d bulkDedup, report *BulkReport) ([]string, error) {
+	last := make(map[string]int) // Dedup group to the last position written
+	for i, item := range report.Items {
+		if item.Status != BulkFailed {
+			last[dedupGroup(docs[i].ID, d.plans[i].hash)] = i
+		}
+	}
+	var dropped []string
+	var errs []error
+	for group, winner := range last {
+		stale := d.plans[winner].stale
+		for i, item := range report.Items {
+			if i != winner && item.Status != BulkFailed && dedupGroup(docs[i].ID, d.plans[i].hash) == group {
+				stale = append(stale, docs[i].ID)
+			}
+		}
+		removed, err := db.removeCopies(stale, d.plans[winner].hash)
+		dropped = append(dropped, removed...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	sort.Strings(dropped)
+	return dropped, errors.Join(errs...)
+}
+
+// dedupGroup keys the documents of a request that are copies of each
+// other: those with the same fingerprint in the same namespace
+func dedupGroup(id, hash string) string {
+	return namespaceOf(id) + NamespaceSeparator + hash
+}
+
+// removeCopies deletes older copies of replaced content, skipping any that
+// changed since they were found, and returns the IDs it deleted
+func (db *DocumentDB) removeCopies(ids []string, hash string) ([]string, error) {
+	var removed []string
+	var errs []error
+	for _, id := range ids {
+		s := db.shardFor(id)
+		s.mutex.Lock()
+		if doc, exists := s.documents[id]; exists && documentFingerprint(doc) == hash {
+			if err := db.engine.Write(Batch{Deletes: []string{id}}); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete older copy %s: %w", id, err))
+			} else {
+				db.removeLocked(s, id)
+				delete(s.history, id)
+				removed = append(removed, id)
+			}
+		}
+		s.mutex.Unlock()
+	}
+	return removed, errors.Join(errs...)
+}
@@ -0,0 +1,156 @@
+package documentstore
+
+// termDictionary is a trie over the terms of an inverted index, so terms
+// can be found by prefix or by edit distance without scanning them all
+type termDictionary struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children map[rune]*trieNode
+	term     bool // Whether a term ends here
+	terms    int  // Terms ending here or below, so empty branches can be pruned
+}
+
+func newTermDictionary() *termDictionary {
+	return &termDictionary{}
+}
+
+// insert adds a term not yet in the dictionary
+func (d *termDictionary) insert(term string) {
+	node := &d.root
+	node.terms++
+	for _, r := range term {
+		child, ok := node.children[r]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[rune]*trieNode)
+			}
+			child = &trieNode{}
+			node.children[r] = child
+		}
+		child.terms++
+		node = child
+	}
+	node.term = true
+}
+
+// delete removes a term in the dictionary, pruning the branches it leaves
+// empty
+func (d *termDictionary) delete(term string) {
+	node := &d.root
+	node.terms--
+	for _, r := range term {
+		child := node.children[r]
+		child.terms--
+		if child.terms == 0 {
+			delete(node.children, r)
+			return
+		}
+		node = child
+	}
+	node.term = false
+}
+
+// prefixed calls visit with every term starting with prefix
+func (d *termDictionary) prefixed(prefix string, visit func(term string)) {
+	node := &d.root
+	for _, r := range prefix {
+		if node = node.children[r]; node == nil {
+			return
+		}
+	}
+	node.walk([]rune(prefix), visit)
+}
+
+func (n *trieNode) walk(path []rune, visit func(term string)) {
+	if n.term {
+		visit(string(path))
+	}
+	for r, child := range n.children {
+		child.walk(append(path, r), visit)
+	}
+}
+
+// fuzzy calls visit with every term within max edits of word and its
+// distance. It runs a Levenshtein automaton for word down the trie, leaving
+// each branch as soon as no term along it can be close enough, so it only
+// looks at a small part of a large dictionary.
+func (d *termDictionary) fuzzy(word string, max int, visit func(term string, distance int)) {
+	automaton := newLevenshteinAutomaton(word, max)
+	d.root.fuzzy(automaton, automaton.start(), nil, visit)
+}
+
+func (n *trieNode) fuzzy(a *levenshteinAutomaton, state []int, path []rune, visit func(term string, distance int)) {
+	if n.term && a.accepts(state) {
+		visit(string(path), state[len(state)-1])
+	}
+	for r, child := range n.children {
+		if next := a.step(state, r); a.alive(next) {
+			child.fuzzy(a, next, append(path, r), visit)
+		}
+	}
+}
+
+// levenshteinAutomaton accepts the strings within max edits of a word. A
+// state is the row of the edit distance table for the input read so far:
+// entry i is the distance between the input and the first i runes of word.
+type levenshteinAutomaton struct {
+	word []rune
+	max  int
+}
+
+func newLevenshteinAutomaton(word string, max int) *levenshteinAutomaton {
+	return &levenshteinAutomaton{word: []rune(word), max: max}
+}
+
+// start is the state before any input
+func (a *levenshteinAutomaton) start() []int {
+	state := make([]int, len(a.word)+1)
+	for i := range state {
+		state[i] = i
+	}
+	return state
+}
+
+// step returns the state after reading r in state
+func (a *levenshteinAutomaton) step(state []int, r rune) []int {
+	next := make([]int, len(state))
+	next[0] = state[0] + 1
+	for i := 1; i < len(state); i++ {
+		cost := 1
+		if a.word[i-1] == r {
+			cost = 0
+		}
+		next[i] = minInt(state[i]+1, next[i-1]+1, state[i-1]+cost)
+	}
+	return next
+}
+
+// accepts reports whether the input read into state is within max edits
+func (a *levenshteinAutomaton) accepts(state []int) bool {
+	return state[len(state)-1] <= a.max
+}
+
+// alive reports whether any continuation of the input read into state can
+// still be accepted
+func (a *levenshteinAutomaton) alive(state []int) bool {
+	for _, distance := range state {
+		if distance <= a.max {
+			return true
+		}
+	}
+	return false
+}
+
+// literalPrefix returns the part of a wildcard pattern before its first
+// special character, which every term it matches starts with
+func literalPrefix(pattern string) string {
+	for i, r := range pattern {
+		switch r {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
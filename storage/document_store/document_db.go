@@ -1,15 +1,19 @@
 package documentstore
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"sync"
 	"time"
+
+	"monitoring/logging"
 )
 
+// logger is where the database reports what it does in the background and
+// what goes wrong without failing a call
+var logger = logging.Component("storage/document_store")
+
 // Document represents the structure of a document to be stored
 type Document struct {
 	ID        string            `json:"id"`
@@ -18,251 +22,355 @@ type Document struct {
 	Metadata  map[string]string `json:"metadata"`
 	CreatedAt time.Time         `json:"created_at"`
 	UpdatedAt time.Time         `json:"updated_at"`
+	Version   uint64            `json:"version"`    // Starts at 1, or past a deleted version, and grows by 1 with every update
+	ExpiresAt time.Time         `json:"expires_at"` // Zero for documents that never expire
+	DeletedAt time.Time         `json:"deleted_at"` // Set on tombstones of soft-deleted documents
+	// IDs of the documents this one links to, as the crawler extracted them
+	Links []string `json:"links,omitempty"`
+	// Fingerprint of the content, for finding duplicates
+	ContentHash string `json:"content_hash,omitempty"`
+	// Set on a duplicate stored as a link to the document holding its content
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// An embedding of the document, such as a sentence encoder computes, for
+	// SimilarSearch. Every vector in a database has the same length.
+	Vector []float32 `json:"vector,omitempty"`
+	// Set only on documents a CompressingEngine has stored, in place of Content
+	ContentEncoding   string `json:"content_encoding,omitempty"`
+	CompressedContent []byte `json:"compressed_content,omitempty"`
 }
 
-// DocumentDB defines the structure of the in-memory database
+// DocumentDB defines the structure of the database. Documents are served
+// from memory and every change is written through to the storage engine.
+// They are spread over shards by ID so writes to different shards proceed in
+// parallel. Stored documents are never modified; updates replace them with
+// new copies, so documents can be read after their shard is unlocked.
 type DocumentDB struct {
-	documents map[string]*Document
-	mutex     sync.RWMutex
+	shards []*shard
+	engine StorageEngine
+	keep   int64  // Previous versions retained per document, accessed atomically
+	merged uint64 // Segment merges completed, accessed atomically
+
+	fingerprints *fingerprintIndex
+	links        *linkIndex
+	vectors      *vectorIndex
+	spelling     *spellIndex
+	results      *queryCache
+	ingest       sync.Mutex     // Serializes adds while a dedup policy is set
+	metering     sync.Mutex     // Serializes writes to namespaces with quotas
+	merges       sync.WaitGroup // Background segment merges
+	rebuilding   sync.Mutex     // Serializes index rebuilds and loads
+
+	mutex          sync.RWMutex // Guards the settings and sweeper below
+	scoring        ScoringConfig
+	fusion         FusionConfig
+	rerank         *RerankConfig   // Nil unless searches are re-ranked
+	schema         *compiledSchema // Nil unless documents are validated
+	dedup          DedupPolicy
+	expiry         ExpirationStats
+	retention      time.Duration // How long deleted documents stay in the trash
+	analysis       *Analysis     // Nil for the standard analyzer alone
+	pruning        func() bool   // Nil unless TopK pruning is switched at runtime
+	costs          CostRecorder  // Nil unless indexing costs are recorded
+	segmentOptions SegmentOptions
+	generation     uint64                    // Of the full-text index
+	quotas         map[string]NamespaceQuota // By namespace name
+	sweepStop      chan struct{}             // Nil unless the expiry sweeper runs
+	sweepDone      chan struct{}
+
+	feed     sync.Mutex // Guards the change feed below
+	seq      uint64     // Sequence number of the latest change
+	changes  []Event    // Recent changes, oldest first
+	watchers map[*watcher]bool
 }
 
-// NewDocumentDB initializes and returns a new instance of DocumentDB
+// NewDocumentDB initializes and returns a new instance of DocumentDB that
+// keeps its documents in memory only
 func NewDocumentDB() *DocumentDB {
-	return &DocumentDB{
-		documents: make(map[string]*Document),
+	return newDocumentDB(NewMemoryEngine(), DefaultShards)
+}
+
+// OpenDocumentDB returns a DocumentDB holding the documents stored in engine
+// and persisting its changes there. settings, such as SetAnalysis, are
+// applied before the documents are loaded, so they are indexed as
+// configured rather than indexed again once it changes.
+func OpenDocumentDB(engine StorageEngine, settings ...func(*DocumentDB)) (*DocumentDB, error) {
+	return OpenShardedDocumentDB(engine, DefaultShards, settings...)
+}
+
+// OpenShardedDocumentDB is OpenDocumentDB with the number of shards to
+// split the documents into. More shards let more writers run at once.
+func OpenShardedDocumentDB(engine StorageEngine, shards int, settings ...func(*DocumentDB)) (*DocumentDB, error) {
+	if shards < 1 {
+		return nil, errors.New("a document database needs at least one shard")
+	}
+	docs, err := engine.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load documents: %w", err)
+	}
+	db := newDocumentDB(engine, shards)
+	for _, set := range settings {
+		set(db)
+	}
+	analysis := db.currentAnalysis()
+	for id, doc := range docs {
+		s := db.shardFor(id)
+		if !doc.DeletedAt.IsZero() {
+			s.trash[id] = doc
+			continue
+		}
+		s.documents[id] = doc
+		s.accountLocked(doc, false)
+		s.text.add(doc, analysis.analyzerFor(doc))
+		db.fingerprints.add(documentFingerprint(doc), id)
+		db.links.add(doc)
+		db.vectors.put(doc)
 	}
+	for _, s := range db.shards {
+		db.mergeLocked(s)
+	}
+	return db, nil
 }
 
-// AddDocument adds a new document to the database
+func newDocumentDB(engine StorageEngine, shards int) *DocumentDB {
+	db := &DocumentDB{
+		shards:         make([]*shard, shards),
+		engine:         engine,
+		fingerprints:   newFingerprintIndex(),
+		links:          newLinkIndex(),
+		vectors:        newVectorIndex(),
+		spelling:       &spellIndex{},
+		results:        newQueryCache(),
+		scoring:        DefaultScoringConfig,
+		fusion:         DefaultFusionConfig,
+		retention:      DefaultTrashRetention,
+		segmentOptions: DefaultSegmentOptions,
+		quotas:         make(map[string]NamespaceQuota),
+		watchers:       make(map[*watcher]bool),
+	}
+	for i := range db.shards {
+		db.shards[i] = newShard(db.segmentOptions)
+	}
+	return db
+}
+
+// Close stops the expiry sweeper, ends every watch and closes the storage
+// engine
+func (db *DocumentDB) Close() error {
+	db.stopSweeper()
+	db.merges.Wait()
+	db.lockAll()
+	defer db.unlockAll()
+	for _, s := range db.shards {
+		// Gives up any index builds
+		s.building = make(map[string]*fieldIndex)
+	}
+	db.closeWatchers()
+	return db.engine.Close()
+}
+
+// AddDocument adds a new document to the database, treating duplicate
+// content as the dedup policy says. Its errors match ErrAlreadyExists if
+// the ID is taken, ErrInvalidDocument if the schema rejects the document
+// and ErrDuplicateContent if the dedup policy does.
 func (db *DocumentDB) AddDocument(doc *Document) error {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
+	policy := db.dedupPolicy()
+	if policy != DedupOff {
+		db.ingest.Lock()
+		defer db.ingest.Unlock()
+	}
+	plan, err := db.planDedup(doc, policy)
+	if err != nil {
+		return err
+	}
+	if err := db.addDocument(doc, plan); err != nil {
+		return err
+	}
+	if _, err := db.removeCopies(plan.stale, plan.hash); err != nil {
+		logger.Warn("Document added but older copies remain", "id", doc.ID, "error", err)
+	}
+	return nil
+}
+
+func (db *DocumentDB) addDocument(doc *Document, plan dedupPlan) error {
+	s := db.shardFor(doc.ID)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	if _, exists := db.documents[doc.ID]; exists {
-		return errors.New("document with the same ID already exists")
+	if _, exists := s.documents[doc.ID]; exists {
+		return fmt.Errorf("%w: %s", ErrAlreadyExists, doc.ID)
+	}
+	if err := db.currentSchema().validate(doc); err != nil {
+		return err
+	}
+	if err := db.vectors.check(doc); err != nil {
+		return err
 	}
 
+	plan.apply(doc)
+	doc.Links = normalizeLinks(doc.Links)
 	doc.CreatedAt = time.Now()
 	doc.UpdatedAt = doc.CreatedAt
-	db.documents[doc.ID] = doc
+	doc.Version = s.firstVersionLocked(doc.ID)
+	if err := db.engine.Write(Batch{Puts: []*Document{doc}}); err != nil {
+		return err
+	}
+	db.putLocked(s, doc)
 	return nil
 }
 
-// GetDocument retrieves a document by ID
+// GetDocument retrieves a document by ID, failing with ErrNotFound if
+// there is none
 func (db *DocumentDB) GetDocument(id string) (*Document, error) {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
+	s := db.shardFor(id)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
-	if doc, exists := db.documents[id]; exists {
+	if doc, exists := s.documents[id]; exists {
 		return doc, nil
 	}
-	return nil, errors.New("document not found")
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
 }
 
-// UpdateDocument updates the content of a document
+// UpdateDocument updates the content of a document; it fails with
+// ErrNotFound if there is none
 func (db *DocumentDB) UpdateDocument(id string, newContent string) error {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-
-	if doc, exists := db.documents[id]; exists {
-		doc.Content = newContent
-		doc.UpdatedAt = time.Now()
-		return nil
+	s := db.shardFor(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if doc, exists := s.documents[id]; exists {
+		updated := copyDocument(doc)
+		updated.Content = newContent
+		return db.commitUpdateLocked(s, doc, updated)
 	}
-	return errors.New("document not found")
+	return fmt.Errorf("%w: %s", ErrNotFound, id)
 }
 
-// DeleteDocument removes a document from the database by ID
+// DeleteDocument removes a document from the database by ID; it fails with
+// ErrNotFound if there is none. The document moves to the trash, where
+// RecoverDocument can bring it back until the trash retention runs out; with
+// retention off it is removed for good.
 func (db *DocumentDB) DeleteDocument(id string) error {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
+	s := db.shardFor(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	if _, exists := db.documents[id]; exists {
-		delete(db.documents, id)
-		return nil
+	doc, exists := s.documents[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if db.trashRetention() > 0 {
+		return db.trashLocked(s, doc)
+	}
+	if err := db.engine.Write(Batch{Deletes: []string{id}}); err != nil {
+		return err
 	}
-	return errors.New("document not found")
+	db.removeLocked(s, id)
+	delete(s.history, id)
+	return nil
 }
 
 // ListDocuments returns a list of all documents
 func (db *DocumentDB) ListDocuments() []*Document {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-
-	var docs []*Document
-	for _, doc := range db.documents {
-		docs = append(docs, doc)
-	}
-	return docs
+	return db.snapshot()
 }
 
-// FindDocumentsByMetadata searches for documents by matching metadata key-value pairs
+// FindDocumentsByMetadata searches for documents by matching metadata key-value
+// pairs, using the index on the key if there is one
 func (db *DocumentDB) FindDocumentsByMetadata(key, value string) []*Document {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-
 	var results []*Document
-	for _, doc := range db.documents {
-		if v, exists := doc.Metadata[key]; exists && v == value {
-			results = append(results, doc)
+	for _, s := range db.shards {
+		s.mutex.RLock()
+		if idx, exists := s.indexes[key]; exists {
+			for id := range idx.values[value] {
+				results = append(results, s.documents[id])
+			}
+		} else {
+			for _, doc := range s.documents {
+				if v, exists := doc.Metadata[key]; exists && v == value {
+					results = append(results, doc)
+				}
+			}
 		}
+		s.mutex.RUnlock()
 	}
 	return results
 }
 
-// BulkAddDocuments allows adding multiple documents at once
+// BulkAddDocuments adds multiple documents at once. Documents that fail
+// validation are skipped and reported in the error; the rest are added.
 func (db *DocumentDB) BulkAddDocuments(docs []*Document) error {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-
-	for _, doc := range docs {
-		if _, exists := db.documents[doc.ID]; exists {
-			return fmt.Errorf("document with ID %s already exists", doc.ID)
-		}
-
-		doc.CreatedAt = time.Now()
-		doc.UpdatedAt = doc.CreatedAt
-		db.documents[doc.ID] = doc
+	report := db.Bulk(docs, BulkOptions{})
+	if report.Failed > 0 {
+		return report.Err()
 	}
 	return nil
 }
 
-// SearchDocuments searches for documents by matching part of the title
+// SearchDocuments runs a query in the query language, best matches first.
+// A query that doesn't parse matches nothing; use Query to see why.
 func (db *DocumentDB) SearchDocuments(query string) []*Document {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-
-	var results []*Document
-	for _, doc := range db.documents {
-		if contains(doc.Title, query) {
-			results = append(results, doc)
-		}
-	}
-	return results
-}
-
-// Helper function to check if a string contains a substring
-func contains(str, substr string) bool {
-	return len(str) >= len(substr) && str[:len(substr)] == substr
-}
-
-// ConcurrentFindDocumentsByContent searches for documents concurrently by content matching
-func (db *DocumentDB) ConcurrentFindDocumentsByContent(content string) []*Document {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-
-	var wg sync.WaitGroup
-	results := make([]*Document, 0)
-	resultsCh := make(chan *Document, len(db.documents))
-
-	for _, doc := range db.documents {
-		wg.Add(1)
-		go func(d *Document) {
-			defer wg.Done()
-			if contains(d.Content, content) {
-				resultsCh <- d
-			}
-		}(doc)
-	}
-
-	go func() {
-		wg.Wait()
-		close(resultsCh)
-	}()
-
-	for doc := range resultsCh {
-		results = append(results, doc)
-	}
-	return results
-}
-
-// BackupDatabase creates a backup of the document database to a file
-func (db *DocumentDB) BackupDatabase(filePath string) error {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-
-	file, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	data, err := json.Marshal(db.documents)
-	if err != nil {
-		return err
-	}
-
-	_, err = file.Write(data)
+	results, err := db.Query(query)
 	if err != nil {
-		return err
+		return nil
 	}
-
-	fmt.Printf("Database backed up to %s\n", filePath)
-	return nil
+	return resultDocuments(results)
 }
 
-// RestoreDatabase restores the database from a backup file
-func (db *DocumentDB) RestoreDatabase(filePath string) error {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	data, err := ioutil.ReadAll(file)
-	if err != nil {
-		return err
-	}
-
-	var restoredDocs map[string]*Document
-	err = json.Unmarshal(data, &restoredDocs)
-	if err != nil {
-		return err
-	}
-
-	db.documents = restoredDocs
-	fmt.Printf("Database restored from %s\n", filePath)
-	return nil
+// ConcurrentFindDocumentsByContent returns the documents whose content
+// holds content anywhere, ignoring case
+func (db *DocumentDB) ConcurrentFindDocumentsByContent(content string) []*Document {
+	return db.FindDocumentsByContent(content, MatchOptions{Mode: MatchSubstring})
 }
 
 // PurgeOldDocuments removes documents older than a specific time
 func (db *DocumentDB) PurgeOldDocuments(olderThan time.Time) int {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-
-	removedCount := 0
-	for id, doc := range db.documents {
-		if doc.CreatedAt.Before(olderThan) {
-			delete(db.documents, id)
-			removedCount++
+	purged := 0
+	for _, s := range db.shards {
+		s.mutex.Lock()
+		var expired []string
+		for id, doc := range s.documents {
+			if doc.CreatedAt.Before(olderThan) {
+				expired = append(expired, id)
+			}
+		}
+		if len(expired) > 0 {
+			if err := db.engine.Write(Batch{Deletes: expired}); err != nil {
+				logger.Error("Failed to purge old documents", "error", err)
+			} else {
+				for _, id := range expired {
+					db.removeLocked(s, id)
+					delete(s.history, id)
+				}
+				purged += len(expired)
+			}
 		}
+		s.mutex.Unlock()
 	}
-	return removedCount
+	return purged
 }
 
 // GetDocumentCount returns the total number of documents in the database
 func (db *DocumentDB) GetDocumentCount() int {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-
-	return len(db.documents)
+	count := 0
+	for _, s := range db.shards {
+		s.mutex.RLock()
+		count += len(s.documents)
+		s.mutex.RUnlock()
+	}
+	return count
 }
 
-// ExportDocuments exports all documents to a specified file
+// ExportDocuments writes a line naming each document to a file, for
+// people to read; ExportFile writes formats other tools can load
 func (db *DocumentDB) ExportDocuments(filePath string) error {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-
 	file, err := os.Create(filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	for _, doc := range db.documents {
+	for _, doc := range db.snapshot() {
 		line := fmt.Sprintf("Document ID: %s, Title: %s\n", doc.ID, doc.Title)
 		_, err := file.WriteString(line)
 		if err != nil {
@@ -270,6 +378,6 @@ func (db *DocumentDB) ExportDocuments(filePath string) error {
 		}
 	}
 
-	fmt.Printf("Documents exported to %s\n", filePath)
+	logger.Info("Documents exported", "path", filePath)
 	return nil
 }
@@ -0,0 +1,104 @@
+package documentstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	documentstore "storage/document_store"
+)
+
+func openMemoryDB(t *testing.T) *documentstore.DocumentDB {
+	t.Helper()
+	db, err := documentstore.OpenDocumentDB(documentstore.NewMemoryEngine())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Test that a document added again after a delete continues past its
+// tombstone's version, so versions and the change feed never go back
+func TestReAddAfterDeleteKeepsVersionsGrowing(t *testing.T) {
+	db := openMemoryDB(t)
+	events, err := db.Watch(context.Background(), db.ChangeSeq())
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+
+	if err := db.AddDocument(&documentstore.Document{ID: "page", Content: "first"}); err != nil {
+		t.Fatalf("Failed to add document: %v", err)
+	}
+	if err := db.UpdateDocument("page", "second"); err != nil {
+		t.Fatalf("Failed to update document: %v", err)
+	}
+	if err := db.DeleteDocument("page"); err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	trash := db.Trash()
+	if len(trash) != 1 || trash[0].Version != 3 {
+		t.Fatalf("Trash holds %+v, expected the tombstone at version 3", trash)
+	}
+
+	if err := db.AddDocument(&documentstore.Document{ID: "page", Content: "third"}); err != nil {
+		t.Fatalf("Failed to add document again: %v", err)
+	}
+	doc, err := db.GetDocument("page")
+	if err != nil {
+		t.Fatalf("Failed to get document: %v", err)
+	}
+	if doc.Version != 4 {
+		t.Fatalf("Re-added document has version %d, expected 4", doc.Version)
+	}
+	if len(db.Trash()) != 0 {
+		t.Fatalf("Re-added document left its tombstone in the trash")
+	}
+
+	if err := db.DeleteDocument("page"); err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	report := db.Bulk([]*documentstore.Document{{ID: "page", Content: "fourth"}}, documentstore.BulkOptions{})
+	if report.Created != 1 {
+		t.Fatalf("Bulk report %+v, expected the document created", report)
+	}
+	if doc, _ = db.GetDocument("page"); doc.Version != 6 {
+		t.Fatalf("Document added in bulk has version %d, expected 6", doc.Version)
+	}
+
+	var last uint64
+	for i := 0; i < 6; i++ {
+		select {
+		case event := <-events:
+			if event.Document == nil {
+				t.Fatalf("Event %d has no document", event.Seq)
+			}
+			if event.Document.Version <= last {
+				t.Fatalf("Event %d has version %d after version %d", event.Seq, event.Document.Version, last)
+			}
+			last = event.Document.Version
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for event %d", i+1)
+		}
+	}
+}
+
+// Test that with the trash turned off a deleted document leaves nothing
+// behind, so the ID starts over at version 1
+func TestReAddWithoutTrashStartsOver(t *testing.T) {
+	db := openMemoryDB(t)
+	db.SetTrashRetention(0)
+
+	if err := db.AddDocument(&documentstore.Document{ID: "page", Content: "first"}); err != nil {
+		t.Fatalf("Failed to add document: %v", err)
+	}
+	if err := db.DeleteDocument("page"); err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	if err := db.AddDocument(&documentstore.Document{ID: "page", Content: "second"}); err != nil {
+		t.Fatalf("Failed to add document again: %v", err)
+	}
+	if doc, _ := db.GetDocument("page"); doc.Version != 1 {
+		t.Fatalf("Re-added document has version %d, expected 1", doc.Version)
+	}
+}
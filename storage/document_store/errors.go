@@ -0,0 +1,27 @@
+package documentstore
+
+import "errors"
+
+// Errors returned by DocumentDB, usually wrapped with the document ID or
+// other detail; tell them apart with errors.Is
+var (
+	ErrNotFound        = errors.New("document not found")
+	ErrAlreadyExists   = errors.New("document already exists")
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrInvalidDocument matches every *ValidationError
+	ErrInvalidDocument = errors.New("invalid document")
+	// ErrDuplicateContent matches every *DuplicateError
+	ErrDuplicateContent = errors.New("duplicate content")
+	ErrIndexNotFound    = errors.New("index not found")
+	ErrIndexExists      = errors.New("index already exists")
+	// ErrIncompatibleMapping matches every *MappingError
+	ErrIncompatibleMapping = errors.New("incompatible mapping change")
+	// ErrPipelineClosed is returned for changes submitted to a closed
+	// IndexPipeline
+	ErrPipelineClosed = errors.New("index pipeline closed")
+	// ErrQuotaExceeded is returned for writes a namespace has no room for
+	ErrQuotaExceeded = errors.New("namespace quota exceeded")
+	// ErrThrottled is returned for writes an Admission turns away, to be
+	// retried later
+	ErrThrottled = errors.New("ingestion throttled")
+)
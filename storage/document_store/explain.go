@@ -0,0 +1,203 @@
+package documentstore
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Explanation breaks down how a document scores for a query, for finding
+// out why it ranks where it does. Scores are as Execute computes them;
+// the freshness boosts and re-ranking of a page of search results come on
+// top.
+type Explanation struct {
+	ID      string  `json:"id"`
+	Query   string  `json:"query"`   // As parsed
+	Matched bool    `json:"matched"` // Whether the query matches the document at all
+	Rank    int     `json:"rank"`    // Among the query's matches, from 1; 0 if unmatched
+	Matches int     `json:"matches"` // How many documents the query matches
+	Score   float64 `json:"score"`   // The final score, or what it would be if matched
+	// Relevance is the text score, the sum of the terms' scores
+	Relevance float64            `json:"relevance"`
+	Model     string             `json:"model"` // "bm25" or "tfidf"
+	K1        float64            `json:"k1,omitempty"`
+	B         float64            `json:"b,omitempty"`
+	Documents int                `json:"documents"` // In the collection, for IDF
+	Terms     []TermExplanation  `json:"terms"`     // The query's terms the document holds
+	Boosts    []BoostExplanation `json:"metadata_boosts,omitempty"`
+	// Signals break down a SignalScorer's score; a custom Scorer's score is
+	// only given as a whole
+	Signals []SignalExplanation `json:"signals,omitempty"`
+}
+
+// TermExplanation is what one query term contributes to a score
+type TermExplanation struct {
+	Term string `json:"term"` // As indexed
+	// DocumentFrequency is how many documents hold the term, which IDF
+	// falls with
+	DocumentFrequency int                `json:"document_frequency"`
+	IDF               float64            `json:"idf"`
+	Score             float64            `json:"score"`
+	Fields            []FieldExplanation `json:"fields"`
+}
+
+// FieldExplanation is what a term contributes from one field: roughly
+// Boost × IDF × TF
+type FieldExplanation struct {
+	Field         string  `json:"field"`
+	Frequency     int     `json:"frequency"` // Occurrences of the term in the field
+	Length        int     `json:"length"`    // Tokens in the field
+	AverageLength float64 `json:"average_length"`
+	Boost         float64 `json:"boost"`
+	// TF is the term frequency as the model weighs it: saturated and
+	// normalized for length under BM25, log-scaled under TF-IDF
+	TF    float64 `json:"tf"`
+	Score float64 `json:"score"`
+}
+
+// BoostExplanation is the factor a metadata boost multiplies the score by
+type BoostExplanation struct {
+	Key    string  `json:"key"`
+	Weight float64 `json:"weight"`
+	Value  string  `json:"value"`
+	Factor float64 `json:"factor"` // 1 when the value is missing or not positive
+}
+
+// SignalExplanation is what one signal of a SignalScorer contributes
+type SignalExplanation struct {
+	Signal
+	Value        float64 `json:"value"`        // Before weighting
+	Contribution float64 `json:"contribution"` // Weight × value
+}
+
+// Explain breaks down how the document with the given ID scores for a
+// query in the query language. Documents the query doesn't match are
+// explained too, as far as they hold its terms.
+func (db *DocumentDB) Explain(query, id string) (*Explanation, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	e := &Explanation{ID: id, Query: q.String(), Terms: []TermExplanation{}}
+	results := db.Execute(q)
+	e.Matches = len(results)
+	for i, result := range results {
+		if result.Document.ID == id {
+			e.Matched, e.Rank = true, i+1
+			break
+		}
+	}
+
+	config := db.scoringConfig()
+	match := db.matcher(q, nil)
+	home := db.shardFor(id)
+	db.rlockAll()
+	defer db.runlockAll()
+	doc, exists := home.documents[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	// The terms scored on are gathered across shards as a search gathers
+	// them, so the scores come out the same
+	var terms []string
+	seen := make(map[string]bool)
+	for _, s := range db.shards {
+		_, shardTerms := match(s)
+		for _, term := range shardTerms {
+			if !seen[term] {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+	stats := db.corpusStatsLocked(terms)
+	e.Documents = int(stats.docs)
+	e.Model = "bm25"
+	if config.Model == TFIDF {
+		e.Model = "tfidf"
+	} else {
+		e.K1, e.B = config.K1, config.B
+	}
+
+	for _, term := range terms {
+		p := home.text.posting(term, id)
+		if p == nil {
+			continue
+		}
+		df := stats.df[term]
+		te := TermExplanation{Term: term, DocumentFrequency: int(df), IDF: termIDF(config, stats, df)}
+		for _, field := range textFields {
+			tf := p.frequency(field)
+			if tf == 0 {
+				continue
+			}
+			length := home.text.length(id, field)
+			score := fieldScore(config, stats, df, field, tf, length)
+			e.Relevance += score
+			te.Score += score
+			te.Fields = append(te.Fields, explainField(config, stats, field, tf, length, score))
+		}
+		e.Terms = append(e.Terms, te)
+	}
+
+	e.Score = e.Relevance
+	if config.Scorer != nil {
+		ctx := ScoreContext{Document: doc, Relevance: e.Relevance, Now: time.Now()}
+		e.Score = config.Scorer.Score(ctx)
+		if scorer, ok := config.Scorer.(*SignalScorer); ok {
+			for _, signal := range scorer.signals {
+				value := signal.value(ctx)
+				e.Signals = append(e.Signals, SignalExplanation{Signal: signal.Signal, Value: value, Contribution: signal.Weight * value})
+			}
+		}
+		return e, nil
+	}
+	keys := make([]string, 0, len(config.MetadataBoosts))
+	for key := range config.MetadataBoosts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		weight := config.MetadataBoosts[key]
+		boost := BoostExplanation{Key: key, Weight: weight, Value: doc.Metadata[key], Factor: 1}
+		if value, err := strconv.ParseFloat(boost.Value, 64); err == nil && value > 0 && !math.IsInf(value, 0) {
+			boost.Factor = 1 + weight*math.Log1p(value)
+		}
+		e.Boosts = append(e.Boosts, boost)
+	}
+	e.Score = e.Relevance * metadataBoost(doc, config.MetadataBoosts)
+	return e, nil
+}
+
+// termIDF is the inverse document frequency of a term df documents hold,
+// as the scoring model weighs it
+func termIDF(config ScoringConfig, stats corpusStats, df float64) float64 {
+	if config.Model == TFIDF {
+		return math.Log(1 + stats.docs/df)
+	}
+	return math.Log(1 + (stats.docs-df+0.5)/(df+0.5))
+}
+
+// explainField breaks down fieldScore's score for a term in a field
+func explainField(config ScoringConfig, stats corpusStats, field string, tf, length int, score float64) FieldExplanation {
+	fe := FieldExplanation{Field: field, Frequency: tf, Length: length, Boost: 1, Score: score}
+	if boost, ok := config.FieldBoosts[field]; ok {
+		fe.Boost = boost
+	}
+	if stats.docs > 0 {
+		fe.AverageLength = stats.totals[field] / stats.docs
+	}
+	frequency := float64(tf)
+	if config.Model == TFIDF {
+		fe.TF = 1 + math.Log(frequency)
+		return fe
+	}
+	norm := 1.0
+	if fe.AverageLength > 0 {
+		norm = 1 - config.B + config.B*float64(length)/fe.AverageLength
+	}
+	fe.TF = frequency * (config.K1 + 1) / (frequency + config.K1*norm)
+	return fe
+}
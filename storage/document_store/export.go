@@ -0,0 +1,263 @@
+package documentstore
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportFormat names a format documents can be exported to and imported
+// from
+type ExportFormat string
+
+// Export formats
+const (
+	// FormatJSONL writes one JSON document per line with every field
+	FormatJSONL ExportFormat = "jsonl"
+	// FormatCSV writes a header row, then a row per document with the
+	// columns asked for
+	FormatCSV ExportFormat = "csv"
+	// FormatWARC writes a WARC 1.0 file with a resource record per document,
+	// for web archive tooling
+	FormatWARC ExportFormat = "warc"
+)
+
+// CSV columns besides "metadata.<key>", which holds one metadata value
+const (
+	ColumnID          = "id"
+	ColumnTitle       = "title"
+	ColumnContent     = "content"
+	ColumnMetadata    = "metadata" // Every metadata value, as a JSON object
+	ColumnCreatedAt   = "created_at"
+	ColumnUpdatedAt   = "updated_at"
+	ColumnExpiresAt   = "expires_at"
+	ColumnVersion     = "version"
+	ColumnContentHash = "content_hash"
+	ColumnDuplicateOf = "duplicate_of"
+	ColumnLinks       = "links"  // Outgoing links, as a JSON array
+	ColumnVector      = "vector" // The embedding, as a JSON array
+)
+
+// DefaultCSVColumns are the columns exported to CSV unless told otherwise
+var DefaultCSVColumns = []string{ColumnID, ColumnTitle, ColumnContent, ColumnMetadata, ColumnCreatedAt, ColumnUpdatedAt, ColumnVersion}
+
+// metadataColumn is the prefix of columns holding one metadata value
+const metadataColumn = ColumnMetadata + "."
+
+// ExportOptions controls an export
+type ExportOptions struct {
+	Format  ExportFormat
+	Columns []string // CSV columns, in order; empty means DefaultCSVColumns
+}
+
+// FormatForPath guesses an export format from a file name's extension:
+// .jsonl or .ndjson, .csv, and .warc or .warc.gz
+func FormatForPath(path string) (ExportFormat, error) {
+	name := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.HasSuffix(name, ".jsonl"), strings.HasSuffix(name, ".ndjson"):
+		return FormatJSONL, nil
+	case strings.HasSuffix(name, ".csv"):
+		return FormatCSV, nil
+	case strings.HasSuffix(name, ".warc"), strings.HasSuffix(name, ".warc.gz"):
+		return FormatWARC, nil
+	}
+	return "", fmt.Errorf("can't tell the format of %s from its extension", path)
+}
+
+// Export writes every document to w in the given format, ordered by ID, and
+// returns how many it wrote. Like WriteBackup it doesn't hold the shard
+// locks while writing.
+func (db *DocumentDB) Export(w io.Writer, options ExportOptions) (int, error) {
+	docs := db.snapshot()
+	sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+
+	var err error
+	switch options.Format {
+	case FormatJSONL:
+		err = writeJSONL(w, docs)
+	case FormatCSV:
+		columns := options.Columns
+		if len(columns) == 0 {
+			columns = DefaultCSVColumns
+		}
+		err = writeCSV(w, docs, columns)
+	case FormatWARC:
+		err = writeWARC(w, docs)
+	default:
+		err = fmt.Errorf("unknown export format %q", options.Format)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+// ExportFile exports every document to a file, replacing it atomically
+func (db *DocumentDB) ExportFile(filePath string, options ExportOptions) error {
+	var count int
+	err := replaceFile(filePath, func(w io.Writer) error {
+		var err error
+		count, err = db.Export(w, options)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Documents exported", "path", filePath, "documents", count, "format", options.Format)
+	return nil
+}
+
+func writeJSONL(w io.Writer, docs []*Document) error {
+	enc := json.NewEncoder(w)
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCSV(w io.Writer, docs []*Document, columns []string) error {
+	for _, column := range columns {
+		if !validColumn(column) {
+			return fmt.Errorf("unknown CSV column %q", column)
+		}
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	row := make([]string, len(columns))
+	for _, doc := range docs {
+		for i, column := range columns {
+			value, err := columnValue(doc, column)
+			if err != nil {
+				return fmt.Errorf("document %s: %w", doc.ID, err)
+			}
+			row[i] = value
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func validColumn(column string) bool {
+	switch column {
+	case ColumnID, ColumnTitle, ColumnContent, ColumnMetadata, ColumnCreatedAt, ColumnUpdatedAt,
+		ColumnExpiresAt, ColumnVersion, ColumnContentHash, ColumnDuplicateOf, ColumnLinks, ColumnVector:
+		return true
+	}
+	return strings.HasPrefix(column, metadataColumn) && len(column) > len(metadataColumn)
+}
+
+// columnValue renders one CSV column of a document
+func columnValue(doc *Document, column string) (string, error) {
+	switch column {
+	case ColumnID:
+		return doc.ID, nil
+	case ColumnTitle:
+		return doc.Title, nil
+	case ColumnContent:
+		return doc.Content, nil
+	case ColumnMetadata:
+		if len(doc.Metadata) == 0 {
+			return "", nil
+		}
+		data, err := json.Marshal(doc.Metadata)
+		return string(data), err
+	case ColumnCreatedAt:
+		return formatTime(doc.CreatedAt), nil
+	case ColumnUpdatedAt:
+		return formatTime(doc.UpdatedAt), nil
+	case ColumnExpiresAt:
+		return formatTime(doc.ExpiresAt), nil
+	case ColumnVersion:
+		return strconv.FormatUint(doc.Version, 10), nil
+	case ColumnContentHash:
+		return doc.ContentHash, nil
+	case ColumnDuplicateOf:
+		return doc.DuplicateOf, nil
+	case ColumnLinks:
+		if len(doc.Links) == 0 {
+			return "", nil
+		}
+		data, err := json.Marshal(doc.Links)
+		return string(data), err
+	case ColumnVector:
+		if len(doc.Vector) == 0 {
+			return "", nil
+		}
+		data, err := json.Marshal(doc.Vector)
+		return string(data), err
+	}
+	return doc.Metadata[strings.TrimPrefix(column, metadataColumn)], nil
+}
+
+// setColumn reads one CSV column into a document
+func setColumn(doc *Document, column, value string) error {
+	var err error
+	switch column {
+	case ColumnID:
+		doc.ID = value
+	case ColumnTitle:
+		doc.Title = value
+	case ColumnContent:
+		doc.Content = value
+	case ColumnMetadata:
+		if value != "" {
+			var metadata map[string]string
+			if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+				return fmt.Errorf("malformed metadata: %w", err)
+			}
+			for key, v := range metadata {
+				setMetadata(doc, key, v)
+			}
+		}
+	case ColumnExpiresAt:
+		if value != "" {
+			doc.ExpiresAt, err = time.Parse(time.RFC3339Nano, value)
+		}
+	case ColumnLinks:
+		if value != "" {
+			err = json.Unmarshal([]byte(value), &doc.Links)
+		}
+	case ColumnVector:
+		if value != "" {
+			err = json.Unmarshal([]byte(value), &doc.Vector)
+		}
+	case ColumnCreatedAt, ColumnUpdatedAt, ColumnVersion, ColumnContentHash, ColumnDuplicateOf:
+		// Assigned afresh as the document is stored
+	default:
+		if value != "" {
+			setMetadata(doc, strings.TrimPrefix(column, metadataColumn), value)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("malformed %s: %w", column, err)
+	}
+	return nil
+}
+
+func setMetadata(doc *Document, key, value string) {
+	if doc.Metadata == nil {
+		doc.Metadata = make(map[string]string)
+	}
+	doc.Metadata[key] = value
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,322 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of facets
+const (
+	FacetTerms         = "terms"     // Counts by distinct value, most common first
+	FacetDateHistogram = "histogram" // Counts by calendar interval, oldest first
+	FacetRange         = "range"     // Counts by numeric range, in the order asked for
+)
+
+// Date histogram intervals, in UTC; weeks start on Monday
+const (
+	IntervalHour  = "hour"
+	IntervalDay   = "day"
+	IntervalWeek  = "week"
+	IntervalMonth = "month"
+	IntervalYear  = "year"
+)
+
+// DefaultFacetSize is how many values a terms facet returns unless told
+// otherwise
+const DefaultFacetSize = 10
+
+// FacetRequest asks for one aggregation over every match of a search, not
+// just the page returned
+type FacetRequest struct {
+	// Name keys the facet in Page.Facets; empty means Field
+	Name string `json:"name,omitempty"`
+	Kind string `json:"kind"`
+	// Field is "metadata.<key>" for every kind. Date histograms also take
+	// ColumnCreatedAt, ColumnUpdatedAt and ColumnExpiresAt; metadata dates
+	// are RFC 3339 times. Range facets need numeric values.
+	Field    string          `json:"field"`
+	Size     int             `json:"size,omitempty"`     // Terms to return; 0 means DefaultFacetSize
+	Interval string          `json:"interval,omitempty"` // For date histograms
+	Ranges   []NumericBucket `json:"ranges,omitempty"`   // For range facets
+}
+
+// NumericBucket is a range of a range facet, from From up to but not
+// including To; a nil bound is open
+type NumericBucket struct {
+	Key  string   `json:"key,omitempty"` // Empty means "from-to", with * for open bounds
+	From *float64 `json:"from,omitempty"`
+	To   *float64 `json:"to,omitempty"`
+}
+
+// Facet is the answer to one FacetRequest
+type Facet struct {
+	Buckets []FacetBucket `json:"buckets"`
+	// Other counts the matches whose terms didn't make the top Size
+	Other int `json:"other,omitempty"`
+	// Missing counts the matches without a usable value for the field
+	Missing int `json:"missing,omitempty"`
+}
+
+// FacetBucket is one value, interval or range of a facet and how many
+// matches fall in it. Date histogram keys are the RFC 3339 start of the
+// interval.
+type FacetBucket struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// ParseFacet reads the short form of a facet request used in URLs:
+//
+//	terms:metadata.language[:size]
+//	histogram:created_at:month
+//	range:metadata.size:10,100,1000
+//
+// Range bounds split the line into buckets, open at either end: the last
+// example counts below 10, 10 to 100, 100 to 1000 and 1000 or more.
+func ParseFacet(spec string) (FacetRequest, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 {
+		return FacetRequest{}, fmt.Errorf("facet %q must be kind:field", spec)
+	}
+	request := FacetRequest{Kind: parts[0], Field: parts[1]}
+	switch {
+	case request.Kind == FacetTerms && len(parts) <= 3:
+		if len(parts) == 3 {
+			size, err := strconv.Atoi(parts[2])
+			if err != nil {
+				return FacetRequest{}, fmt.Errorf("facet %q: size must be an integer", spec)
+			}
+			request.Size = size
+		}
+	case request.Kind == FacetDateHistogram && len(parts) == 3:
+		request.Interval = parts[2]
+	case request.Kind == FacetRange && len(parts) == 3:
+		var bounds []float64
+		for _, field := range strings.Split(parts[2], ",") {
+			bound, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return FacetRequest{}, fmt.Errorf("facet %q: bound %q is not a number", spec, field)
+			}
+			bounds = append(bounds, bound)
+		}
+		request.Ranges = rangesBetween(bounds)
+	default:
+		return FacetRequest{}, fmt.Errorf("malformed facet %q", spec)
+	}
+	return request, request.check()
+}
+
+// rangesBetween turns bounds into the buckets below, between and above them
+func rangesBetween(bounds []float64) []NumericBucket {
+	ranges := make([]NumericBucket, 0, len(bounds)+1)
+	var from *float64
+	for i := range bounds {
+		to := &bounds[i]
+		ranges = append(ranges, NumericBucket{From: from, To: to})
+		from = to
+	}
+	return append(ranges, NumericBucket{From: from})
+}
+
+// check reports whether a facet request can be computed
+func (r FacetRequest) check() error {
+	if r.Field == "" {
+		return errors.New("facets need a field")
+	}
+	metadata := strings.HasPrefix(r.Field, metadataColumn) && len(r.Field) > len(metadataColumn)
+	switch r.Kind {
+	case FacetTerms:
+		if !metadata {
+			return fmt.Errorf("terms facets count metadata values, not %q", r.Field)
+		}
+		if r.Size < 0 {
+			return errors.New("facet size must not be negative")
+		}
+	case FacetDateHistogram:
+		if !metadata && r.Field != ColumnCreatedAt && r.Field != ColumnUpdatedAt && r.Field != ColumnExpiresAt {
+			return fmt.Errorf("date histograms can't bucket %q", r.Field)
+		}
+		if _, ok := intervalStarts[r.Interval]; !ok {
+			return fmt.Errorf("unknown date histogram interval %q", r.Interval)
+		}
+	case FacetRange:
+		if !metadata {
+			return fmt.Errorf("range facets bucket numeric metadata, not %q", r.Field)
+		}
+		if len(r.Ranges) == 0 {
+			return errors.New("range facets need ranges")
+		}
+	default:
+		return fmt.Errorf("unknown facet kind %q", r.Kind)
+	}
+	return nil
+}
+
+// intervalStarts truncate times to the start of their interval, in UTC
+var intervalStarts = map[string]func(t time.Time) time.Time{
+	IntervalHour: func(t time.Time) time.Time { return t.Truncate(time.Hour) },
+	IntervalDay: func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	},
+	IntervalWeek: func(t time.Time) time.Time {
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	},
+	IntervalMonth: func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	},
+	IntervalYear: func(t time.Time) time.Time {
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	},
+}
+
+// computeFacets aggregates every result for each request
+func computeFacets(results []SearchResult, requests []FacetRequest) (map[string]Facet, error) {
+	if len(requests) == 0 {
+		return nil, nil
+	}
+	facets := make(map[string]Facet, len(requests))
+	for _, request := range requests {
+		if err := request.check(); err != nil {
+			return nil, err
+		}
+		name := request.Name
+		if name == "" {
+			name = request.Field
+		}
+		if _, taken := facets[name]; taken {
+			return nil, fmt.Errorf("two facets are named %q", name)
+		}
+		switch request.Kind {
+		case FacetTerms:
+			facets[name] = termsFacet(results, request)
+		case FacetDateHistogram:
+			facets[name] = dateHistogram(results, request)
+		case FacetRange:
+			facets[name] = rangeFacet(results, request)
+		}
+	}
+	return facets, nil
+}
+
+func termsFacet(results []SearchResult, request FacetRequest) Facet {
+	key := strings.TrimPrefix(request.Field, metadataColumn)
+	var facet Facet
+	counts := make(map[string]int)
+	for _, result := range results {
+		value, ok := result.Document.Metadata[key]
+		if !ok {
+			facet.Missing++
+			continue
+		}
+		counts[value]++
+	}
+	for value, count := range counts {
+		facet.Buckets = append(facet.Buckets, FacetBucket{Key: value, Count: count})
+	}
+	sort.Slice(facet.Buckets, func(i, j int) bool {
+		if facet.Buckets[i].Count != facet.Buckets[j].Count {
+			return facet.Buckets[i].Count > facet.Buckets[j].Count
+		}
+		return facet.Buckets[i].Key < facet.Buckets[j].Key
+	})
+	size := request.Size
+	if size == 0 {
+		size = DefaultFacetSize
+	}
+	if len(facet.Buckets) > size {
+		for _, bucket := range facet.Buckets[size:] {
+			facet.Other += bucket.Count
+		}
+		facet.Buckets = facet.Buckets[:size]
+	}
+	if facet.Buckets == nil {
+		facet.Buckets = []FacetBucket{}
+	}
+	return facet
+}
+
+func dateHistogram(results []SearchResult, request FacetRequest) Facet {
+	start := intervalStarts[request.Interval]
+	var facet Facet
+	counts := make(map[time.Time]int)
+	for _, result := range results {
+		date, ok := documentDate(result.Document, request.Field)
+		if !ok {
+			facet.Missing++
+			continue
+		}
+		counts[start(date.UTC())]++
+	}
+	starts := make([]time.Time, 0, len(counts))
+	for t := range counts {
+		starts = append(starts, t)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	facet.Buckets = make([]FacetBucket, len(starts))
+	for i, t := range starts {
+		facet.Buckets[i] = FacetBucket{Key: t.Format(time.RFC3339), Count: counts[t]}
+	}
+	return facet
+}
+
+// documentDate reads a date field of a document, if it has one
+func documentDate(doc *Document, field string) (time.Time, bool) {
+	var date time.Time
+	switch field {
+	case ColumnCreatedAt:
+		date = doc.CreatedAt
+	case ColumnUpdatedAt:
+		date = doc.UpdatedAt
+	case ColumnExpiresAt:
+		date = doc.ExpiresAt
+	default:
+		value, ok := doc.Metadata[strings.TrimPrefix(field, metadataColumn)]
+		if !ok {
+			return time.Time{}, false
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, false
+		}
+		date = parsed
+	}
+	return date, !date.IsZero()
+}
+
+func rangeFacet(results []SearchResult, request FacetRequest) Facet {
+	key := strings.TrimPrefix(request.Field, metadataColumn)
+	facet := Facet{Buckets: make([]FacetBucket, len(request.Ranges))}
+	for i, r := range request.Ranges {
+		facet.Buckets[i].Key = r.Key
+		if r.Key == "" {
+			facet.Buckets[i].Key = formatBound(r.From) + "-" + formatBound(r.To)
+		}
+	}
+	for _, result := range results {
+		value, err := strconv.ParseFloat(result.Document.Metadata[key], 64)
+		if err != nil || math.IsNaN(value) {
+			facet.Missing++
+			continue
+		}
+		// Ranges may overlap, so a value counts in every one holding it
+		for i, r := range request.Ranges {
+			if (r.From == nil || value >= *r.From) && (r.To == nil || value < *r.To) {
+				facet.Buckets[i].Count++
+			}
+		}
+	}
+	return facet
+}
+
+func formatBound(bound *float64) string {
+	if bound == nil {
+		return "*"
+	}
+	return strconv.FormatFloat(*bound, 'g', -1, 64)
+}
@@ -0,0 +1,137 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// CrawledAtKey is the metadata key holding when a crawler fetched a
+// document, as an RFC 3339 time. Importing WARC records sets it from their
+// WARC-Date.
+const CrawledAtKey = "crawled_at"
+
+// crawlTime is when a document was crawled: its CrawledAtKey time, or
+// when it was last stored if it has none
+func crawlTime(doc *Document) time.Time {
+	if value, ok := doc.Metadata[CrawledAtKey]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t
+		}
+	}
+	return doc.UpdatedAt
+}
+
+// Decay functions, how a freshness boost falls off with age. Each halves
+// at the half-life.
+const (
+	DecayExponential = "exp"    // Halves with every half-life, never reaching 0
+	DecayLinear      = "linear" // Falls steadily to 0 at twice the half-life
+	DecayGauss       = "gauss"  // Stays near 1 for recent ages, then falls off fast
+)
+
+// checkDecay reports whether decay names a decay function; empty means
+// DecayExponential
+func checkDecay(decay string) error {
+	switch decay {
+	case "", DecayExponential, DecayLinear, DecayGauss:
+		return nil
+	}
+	return fmt.Errorf("unknown decay %q, want %s, %s or %s", decay, DecayExponential, DecayLinear, DecayGauss)
+}
+
+// decayFactor is the boost of something age old, from 1 when new towards
+// 0 as it ages. Ages in the future count as new.
+func decayFactor(decay string, age, halfLife time.Duration) float64 {
+	if age < 0 {
+		age = 0
+	}
+	x := float64(age) / float64(halfLife)
+	switch decay {
+	case DecayLinear:
+		return math.Max(0, 1-x/2)
+	case DecayGauss:
+		return math.Exp(-math.Ln2 * x * x)
+	}
+	return math.Exp2(-x)
+}
+
+// FreshnessBoost lifts recently crawled documents in a search, for queries
+// whose answers go stale: a score is multiplied by 1 + Weight × the decay
+// of the document's crawl age. Documents without CrawledAtKey age from
+// when they were last stored.
+type FreshnessBoost struct {
+	Weight   float64       `json:"weight"`
+	HalfLife time.Duration `json:"half_life"`
+	Decay    string        `json:"decay,omitempty"` // Empty means DecayExponential
+}
+
+func (b *FreshnessBoost) check() error {
+	if b.HalfLife <= 0 {
+		return errors.New("freshness half-life must be positive")
+	}
+	if !(b.Weight >= 0) || math.IsInf(b.Weight, 0) {
+		return errors.New("freshness weight must not be negative")
+	}
+	return checkDecay(b.Decay)
+}
+
+// apply boosts the scores of results as of now
+func (b *FreshnessBoost) apply(results []SearchResult, now time.Time) {
+	for i := range results {
+		age := now.Sub(crawlTime(results[i].Document))
+		results[i].Score *= 1 + b.Weight*decayFactor(b.Decay, age, b.HalfLife)
+	}
+}
+
+// freshnessField is the query field filtering on crawl recency, as in
+// freshness:7d
+const freshnessField = "freshness"
+
+// parseAge reads an age written as a count of seconds, minutes, hours,
+// days or weeks, such as 7d
+func parseAge(text string) (time.Duration, bool) {
+	if len(text) < 2 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	unit, ok := units[text[len(text)-1]]
+	n, err := strconv.Atoi(text[:len(text)-1])
+	if !ok || err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// freshnessNode filters on documents crawled since a time, which a
+// freshness:<age> clause fixes when it is parsed
+type freshnessNode struct {
+	since time.Time
+}
+
+func (n *freshnessNode) execute(ex *execution) map[string]bool {
+	ids := make(map[string]bool)
+	for id, doc := range ex.shard.documents {
+		if ex.deadline.step() {
+			break
+		}
+		if !crawlTime(doc).Before(n.since) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func (n *freshnessNode) cost(s *shard) int {
+	return len(s.documents)
+}
+
+func (n *freshnessNode) bind(*Analyzer) planNode {
+	return n
+}
+
+func (n *freshnessNode) String() string {
+	return freshnessField + ":>=" + n.since.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,308 @@
+package documentstore
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Fields of a document the full-text index covers
+const (
+	FieldTitle   = "title"
+	FieldContent = "content"
+)
+
+var textFields = []string{FieldTitle, FieldContent}
+
+// posting records where a term occurs in one document, by field
+type posting struct {
+	positions map[string][]int // Field to token positions
+}
+
+// frequency returns how often the term occurs in field
+func (p *posting) frequency(field string) int {
+	return len(p.positions[field])
+}
+
+// invertedIndex maps terms to the documents and positions they occur at. New
+// documents go into an in-memory buffer, which is flushed into an immutable
+// segment once it holds enough of them; segments are merged in the
+// background. A document lives in exactly one segment or the buffer, which
+// live records; removing a document from a segment only leaves a tombstone
+// there until a merge drops it. Callers hold the shard's lock.
+type invertedIndex struct {
+	options    SegmentOptions
+	buffer     *segment            // Takes new documents until flushed
+	segments   []*segment          // Flushed segments, immutable but for tombstones
+	live       map[string]*segment // Document ID to the segment or buffer holding it
+	df         map[string]int      // Term to documents containing it
+	totals     map[string]int      // Field to token count across documents
+	dictionary *termDictionary     // The terms in df, for prefix and fuzzy lookups
+	merging    bool                // Whether a background merge is running
+}
+
+func newInvertedIndex(options SegmentOptions) *invertedIndex {
+	return &invertedIndex{
+		options:    options,
+		buffer:     newSegment(),
+		live:       make(map[string]*segment),
+		df:         make(map[string]int),
+		totals:     make(map[string]int),
+		dictionary: newTermDictionary(),
+	}
+}
+
+// tokenize lowercases text and splits it into runs of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func fieldText(doc *Document, field string) string {
+	if field == FieldTitle {
+		return doc.Title
+	}
+	return doc.Content
+}
+
+// analyzedText is what the index holds of one document
+type analyzedText struct {
+	terms    []string // Distinct, in order of first occurrence
+	postings map[string]*posting
+	lengths  map[string]int // Field to token count
+}
+
+// analyze reads a document's text fields with analyzer
+func analyze(doc *Document, analyzer *Analyzer) analyzedText {
+	text := analyzedText{postings: make(map[string]*posting), lengths: make(map[string]int, len(textFields))}
+	for _, field := range textFields {
+		tokens := analyzer.Analyze(fieldText(doc, field))
+		text.lengths[field] = len(tokens)
+		for position, term := range tokens {
+			p, ok := text.postings[term]
+			if !ok {
+				p = &posting{positions: make(map[string][]int)}
+				text.postings[term] = p
+				text.terms = append(text.terms, term)
+			}
+			p.positions[field] = append(p.positions[field], position)
+		}
+	}
+	return text
+}
+
+// add indexes the terms analyzer finds in a document's text fields
+func (idx *invertedIndex) add(doc *Document, analyzer *Analyzer) {
+	idx.insert(doc.ID, analyze(doc, analyzer))
+}
+
+// insert indexes a document's analyzed text, replacing any it had
+func (idx *invertedIndex) insert(id string, text analyzedText) {
+	idx.remove(id)
+	buffer := idx.buffer
+	for _, term := range text.terms {
+		docs, ok := buffer.postings[term]
+		if !ok {
+			docs = make(map[string]*posting)
+			buffer.postings[term] = docs
+		}
+		docs[id] = text.postings[term]
+	}
+	buffer.docTerms[id] = text.terms
+	buffer.lengths[id] = text.lengths
+	idx.live[id] = buffer
+	for _, term := range text.terms {
+		if idx.df[term]++; idx.df[term] == 1 {
+			idx.dictionary.insert(term)
+		}
+	}
+	for field, length := range text.lengths {
+		idx.totals[field] += length
+	}
+	if len(buffer.docTerms) >= idx.options.FlushDocs {
+		idx.flush()
+	}
+}
+
+func (idx *invertedIndex) remove(id string) {
+	seg, ok := idx.live[id]
+	if !ok {
+		return
+	}
+	for _, term := range seg.docTerms[id] {
+		if idx.df[term]--; idx.df[term] == 0 {
+			delete(idx.df, term)
+			idx.dictionary.delete(term)
+		}
+	}
+	for field, length := range seg.lengths[id] {
+		idx.totals[field] -= length
+	}
+	delete(idx.live, id)
+	if seg == idx.buffer {
+		seg.drop(id)
+	} else {
+		seg.deleted = append(seg.deleted, id)
+	}
+}
+
+// posting returns where term occurs in document id, or nil
+func (idx *invertedIndex) posting(term, id string) *posting {
+	if seg, ok := idx.live[id]; ok {
+		return seg.postings[term][id]
+	}
+	return nil
+}
+
+// eachPosting calls visit with every live document containing term, until
+// visit returns false
+func (idx *invertedIndex) eachPosting(term string, visit func(id string, p *posting) bool) {
+	if idx.df[term] == 0 {
+		return
+	}
+	for _, seg := range idx.searchable() {
+		for id, p := range seg.postings[term] {
+			if idx.live[id] == seg && !visit(id, p) {
+				return
+			}
+		}
+	}
+}
+
+// searchable returns the flushed segments and the buffer
+func (idx *invertedIndex) searchable() []*segment {
+	return append(idx.segments[:len(idx.segments):len(idx.segments)], idx.buffer)
+}
+
+// terms returns the distinct terms of document id
+func (idx *invertedIndex) terms(id string) []string {
+	if seg, ok := idx.live[id]; ok {
+		return seg.docTerms[id]
+	}
+	return nil
+}
+
+// length returns the token count of a document's field
+func (idx *invertedIndex) length(id, field string) int {
+	if seg, ok := idx.live[id]; ok {
+		return seg.lengths[id][field]
+	}
+	return 0
+}
+
+// matchAny returns the IDs of documents containing at least one term
+func (idx *invertedIndex) matchAny(terms []string) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, term := range terms {
+		idx.eachPosting(term, func(id string, _ *posting) bool {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+			return true
+		})
+	}
+	return ids
+}
+
+// matchAll returns the IDs of documents containing every term
+func (idx *invertedIndex) matchAll(terms []string) []string {
+	if len(terms) == 0 {
+		return nil
+	}
+	// Intersect starting from the rarest term to keep candidate sets small
+	sorted := append([]string(nil), terms...)
+	sort.Slice(sorted, func(i, j int) bool { return idx.df[sorted[i]] < idx.df[sorted[j]] })
+
+	var ids []string
+	idx.eachPosting(sorted[0], func(id string, _ *posting) bool {
+		for _, term := range sorted[1:] {
+			if idx.posting(term, id) == nil {
+				return true
+			}
+		}
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+// matchPhrase returns the IDs of documents containing the terms next to each
+// other, in order, within one field
+func (idx *invertedIndex) matchPhrase(terms []string) []string {
+	var ids []string
+	for _, id := range idx.matchAll(terms) {
+		if idx.hasPhrase(id, terms, textFields) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// hasPhrase reports whether document id holds the terms in sequence within
+// one of fields
+func (idx *invertedIndex) hasPhrase(id string, terms []string, fields []string) bool {
+	for _, field := range fields {
+		for _, start := range idx.posting(terms[0], id).positions[field] {
+			found := true
+			for offset, term := range terms[1:] {
+				if !containsPosition(idx.posting(term, id).positions[field], start+offset+1) {
+					found = false
+					break
+				}
+			}
+			if found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsPosition searches the ascending positions for position
+func containsPosition(positions []int, position int) bool {
+	i := sort.SearchInts(positions, position)
+	return i < len(positions) && positions[i] == position
+}
+
+// Search returns the documents whose title or content contains every word
+// of query, best scoring first. Matching ignores case and punctuation, and
+// whatever else the documents' analyzers do, such as stemming.
+func (db *DocumentDB) Search(query string) []*Document {
+	analysis := db.currentAnalysis()
+	return resultDocuments(db.searchShards(nil, func(s *shard) ([]string, []string) {
+		return analysis.matchEach(s, func(analyzer *Analyzer) ([]string, []string) {
+			terms := analyzer.Analyze(query)
+			return s.text.matchAll(terms), terms
+		})
+	}))
+}
+
+// SearchPhrase returns the documents whose title or content contains the
+// words of phrase next to each other, in order, best scoring first
+func (db *DocumentDB) SearchPhrase(phrase string) []*Document {
+	analysis := db.currentAnalysis()
+	return resultDocuments(db.searchShards(nil, func(s *shard) ([]string, []string) {
+		return analysis.matchEach(s, func(analyzer *Analyzer) ([]string, []string) {
+			terms := analyzer.Analyze(phrase)
+			if len(terms) == 0 {
+				return nil, nil
+			}
+			return s.text.matchPhrase(terms), terms
+		})
+	}))
+}
+
+// RankedSearch returns the documents containing any word of query with
+// their relevance scores, best first
+func (db *DocumentDB) RankedSearch(query string) []SearchResult {
+	analysis := db.currentAnalysis()
+	return db.searchShards(nil, func(s *shard) ([]string, []string) {
+		return analysis.matchEach(s, func(analyzer *Analyzer) ([]string, []string) {
+			terms := analyzer.Analyze(query)
+			return s.text.matchAny(terms), terms
+		})
+	})
+}
@@ -0,0 +1,164 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// FusionMethod is how HybridSearch combines text and vector rankings
+type FusionMethod string
+
+const (
+	// FusionRRF is reciprocal rank fusion: a document scores
+	// weight / (RankConstant + rank) for each list it is on, ranks counting
+	// from 1. It goes by rank alone, so the lists' scores needn't be
+	// comparable.
+	FusionRRF FusionMethod = "rrf"
+	// FusionWeighted blends scores: a document scores
+	// (1 - Weight) × relevance / best relevance + Weight × similarity
+	FusionWeighted FusionMethod = "weighted"
+)
+
+// FusionConfig tunes how HybridSearch combines text and vector rankings
+type FusionConfig struct {
+	Method FusionMethod `json:"method"` // Empty means FusionRRF
+	// Weight is the share of the vector ranking, from 0 for text alone to 1
+	// for vectors alone; the text ranking has the rest
+	Weight float64 `json:"weight"`
+	// RankConstant damps the lead of the top ranks under FusionRRF; 0
+	// means DefaultFusionConfig's
+	RankConstant int `json:"rank_constant,omitempty"`
+	// Candidates is how many documents each ranking contributes; 0 means
+	// DefaultFusionConfig's
+	Candidates int `json:"candidates,omitempty"`
+}
+
+// DefaultFusionConfig fuses the top 100 of each ranking by reciprocal rank,
+// weighing them equally, with the rank constant of the original RRF paper
+var DefaultFusionConfig = FusionConfig{Method: FusionRRF, Weight: 0.5, RankConstant: 60, Candidates: 100}
+
+// withDefaults fills in zero fields and checks the rest
+func (c FusionConfig) withDefaults() (FusionConfig, error) {
+	switch c.Method {
+	case "":
+		c.Method = FusionRRF
+	case FusionRRF, FusionWeighted:
+	default:
+		return c, fmt.Errorf("unknown fusion method %q", c.Method)
+	}
+	if !(c.Weight >= 0 && c.Weight <= 1) {
+		return c, errors.New("fusion weight must be between 0 and 1")
+	}
+	if c.RankConstant < 0 || c.Candidates < 0 {
+		return c, errors.New("rank constant and candidates must not be negative")
+	}
+	if c.RankConstant == 0 {
+		c.RankConstant = DefaultFusionConfig.RankConstant
+	}
+	if c.Candidates == 0 {
+		c.Candidates = DefaultFusionConfig.Candidates
+	}
+	return c, nil
+}
+
+// SetFusion changes how HybridSearch combines rankings when a search
+// doesn't say. Zero RankConstant and Candidates take their
+// DefaultFusionConfig values.
+func (db *DocumentDB) SetFusion(config FusionConfig) error {
+	config, err := config.withDefaults()
+	if err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	db.fusion = config
+	db.mutex.Unlock()
+	return nil
+}
+
+// Fusion returns how HybridSearch combines rankings by default
+func (db *DocumentDB) Fusion() FusionConfig {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.fusion
+}
+
+// HybridSearch ranks documents by text relevance to query and similarity
+// to vector together, returning the best k. The top documents of each
+// ranking, by TopK and SimilarSearch, are fused as fusion says, or as
+// SetFusion did if it is nil. Under FusionWeighted every candidate is
+// scored on both counts: with its similarity if it has a vector, and with
+// no relevance unless it ranked among the text candidates.
+func (db *DocumentDB) HybridSearch(query string, vector []float32, k int, fusion *FusionConfig) ([]SearchResult, error) {
+	config := db.Fusion()
+	if fusion != nil {
+		var err error
+		if config, err = fusion.withDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	unit, ok := unitVector(vector)
+	if !ok {
+		return nil, errors.New("query vector must not be all zeros")
+	}
+	if k <= 0 {
+		return nil, nil
+	}
+	limit := config.Candidates
+	if limit < k {
+		limit = k
+	}
+	nearest, err := db.SimilarSearch(vector, limit)
+	if err != nil {
+		return nil, err
+	}
+	matches := db.TopK(query, limit)
+
+	scores := make(map[string]float64)
+	docs := make(map[string]*Document)
+	switch config.Method {
+	case FusionRRF:
+		fuse := func(results []SearchResult, weight float64) {
+			for rank, result := range results {
+				docs[result.Document.ID] = result.Document
+				scores[result.Document.ID] += weight / float64(config.RankConstant+rank+1)
+			}
+		}
+		fuse(matches, 1-config.Weight)
+		fuse(nearest, config.Weight)
+	case FusionWeighted:
+		best := 0.0
+		if len(matches) > 0 {
+			best = matches[0].Score
+		}
+		for _, match := range matches {
+			relevance := 0.0
+			if best > 0 {
+				relevance = match.Score / best
+			}
+			docs[match.Document.ID] = match.Document
+			scores[match.Document.ID] = (1-config.Weight)*relevance + config.Weight*documentSimilarity(unit, match.Document)
+		}
+		for _, near := range nearest {
+			if _, scored := docs[near.Document.ID]; !scored {
+				docs[near.Document.ID] = near.Document
+				scores[near.Document.ID] = config.Weight * near.Score
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(docs))
+	for id, doc := range docs {
+		results = append(results, SearchResult{Document: doc, Score: scores[id]})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Document.ID < results[j].Document.ID
+	})
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
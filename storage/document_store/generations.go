@@ -0,0 +1,315 @@
+package documentstore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Index snapshots are gzip-compressed JSON lines: an indexSnapshotHeader,
+// then one indexSnapshotEntry per document in ID order
+const (
+	indexSnapshotFormat  = "documentdb-index"
+	indexSnapshotVersion = 1
+)
+
+type indexSnapshotHeader struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	CreatedAt  time.Time `json:"created_at"`
+	Generation uint64    `json:"generation"`
+	Documents  int       `json:"documents"`
+}
+
+// indexSnapshotEntry is the analyzed text of one document, and the version
+// of the document it was analyzed from
+type indexSnapshotEntry struct {
+	ID        string                      `json:"id"`
+	Version   uint64                      `json:"version"`
+	UpdatedAt time.Time                   `json:"updated_at"`
+	Lengths   map[string]int              `json:"lengths"`
+	Terms     map[string]map[string][]int `json:"terms"` // Term to field to positions
+}
+
+// IndexLoadReport tells how much of an index snapshot could be used
+type IndexLoadReport struct {
+	Generation uint64 `json:"generation"` // The generation now serving
+	Loaded     int    `json:"loaded"`     // Documents taken from the snapshot
+	// Reindexed counts documents missing from the snapshot or changed
+	// since it was written, which were analyzed afresh
+	Reindexed int `json:"reindexed"`
+	Stale     int `json:"stale"` // Snapshot entries for documents since changed or deleted
+}
+
+// indexBuild is a new generation of one shard's full-text index, built
+// from docs while the shard kept serving
+type indexBuild struct {
+	index *invertedIndex
+	docs  map[string]*Document
+}
+
+// IndexGeneration returns the generation of the full-text index serving
+// searches. It starts at zero and grows by one with every rebuild, change of
+// analysis or loaded snapshot.
+func (db *DocumentDB) IndexGeneration() uint64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.generation
+}
+
+// RebuildIndex analyzes every document afresh into a new generation of the
+// full-text index and swaps it in, returning its number. See SetAnalysis.
+func (db *DocumentDB) RebuildIndex() uint64 {
+	return db.rebuildIndex(db.currentAnalysis())
+}
+
+func (db *DocumentDB) rebuildIndex(analysis *Analysis) uint64 {
+	db.rebuilding.Lock()
+	defer db.rebuilding.Unlock()
+
+	options := db.currentSegmentOptions()
+	builds := make(map[*shard]*indexBuild, len(db.shards))
+	for _, s := range db.shards {
+		build := &indexBuild{index: newInvertedIndex(options), docs: s.documentsSnapshot()}
+		for _, doc := range build.docs {
+			build.index.add(doc, analysis.analyzerFor(doc))
+		}
+		builds[s] = build
+	}
+	generation, _ := db.swapIndex(analysis, builds)
+	return generation
+}
+
+// swapIndex puts a new generation of the index into service. It waits for
+// the searches running on the old one, then brings the new one up to date
+// with the writes made while it was built, so no search ever sees a mix of
+// both or misses a write. It returns the new generation and how many
+// documents had to be reindexed to catch up.
+func (db *DocumentDB) swapIndex(analysis *Analysis, builds map[*shard]*indexBuild) (uint64, int) {
+	db.lockAll()
+	defer db.unlockAll()
+
+	db.mutex.Lock()
+	db.analysis = analysis
+	db.generation++
+	generation := db.generation
+	db.mutex.Unlock()
+
+	reindexed := 0
+	for _, s := range db.shards {
+		build := builds[s]
+		for id, doc := range build.docs {
+			if s.documents[id] != doc {
+				build.index.remove(id)
+			}
+		}
+		for id, doc := range s.documents {
+			if build.docs[id] != doc {
+				build.index.add(doc, analysis.analyzerFor(doc))
+				reindexed++
+			}
+		}
+		s.text = build.index
+		db.mergeLocked(s)
+	}
+	db.spelling.reset() // Its terms are the old generation's
+	db.results.invalidate()
+	return generation, reindexed
+}
+
+// documentsSnapshot copies the shard's documents by ID
+func (s *shard) documentsSnapshot() map[string]*Document {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	docs := make(map[string]*Document, len(s.documents))
+	for id, doc := range s.documents {
+		docs[id] = doc
+	}
+	return docs
+}
+
+// WriteIndexSnapshot streams the analyzed text of every document, as the
+// full-text index holds it, to w. Each shard is locked only to flush its
+// buffer; the snapshot is then written from a point-in-time reader while
+// the shard keeps serving. It returns how many documents it wrote.
+func (db *DocumentDB) WriteIndexSnapshot(w io.Writer) (int, error) {
+	var entries []indexSnapshotEntry
+	for _, s := range db.shards {
+		s.mutex.Lock()
+		r := s.text.readerLocked()
+		docs := make(map[string]*Document, len(s.documents))
+		for id, doc := range s.documents {
+			docs[id] = doc
+		}
+		s.mutex.Unlock()
+
+		for _, view := range r.views {
+			for id, terms := range view.seg.docTerms {
+				if view.deleted[id] {
+					continue
+				}
+				doc, exists := docs[id]
+				if !exists {
+					continue
+				}
+				entry := indexSnapshotEntry{
+					ID:        id,
+					Version:   doc.Version,
+					UpdatedAt: doc.UpdatedAt,
+					Lengths:   view.seg.lengths[id],
+					Terms:     make(map[string]map[string][]int, len(terms)),
+				}
+				for _, term := range terms {
+					entry.Terms[term] = view.seg.postings[term][id].positions
+				}
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	header := indexSnapshotHeader{
+		Format:     indexSnapshotFormat,
+		Version:    indexSnapshotVersion,
+		CreatedAt:  time.Now(),
+		Generation: db.IndexGeneration(),
+		Documents:  len(entries),
+	}
+	if err := enc.Encode(header); err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), gz.Close()
+}
+
+// SnapshotIndex writes an index snapshot to a file, replacing it atomically
+func (db *DocumentDB) SnapshotIndex(filePath string) error {
+	var count int
+	err := replaceFile(filePath, func(w io.Writer) error {
+		var err error
+		count, err = db.WriteIndexSnapshot(w)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Index snapshot written", "path", filePath, "documents", count)
+	return nil
+}
+
+// ReadIndexSnapshot builds a new generation of the full-text index from a
+// snapshot and swaps it in without interrupting searches, as RebuildIndex
+// does. Documents changed since the snapshot was written, or missing from
+// it, are analyzed afresh. Snapshots hold terms, not analyzers, so load one
+// only into a database set up with the analysis it was written under.
+func (db *DocumentDB) ReadIndexSnapshot(r io.Reader) (IndexLoadReport, error) {
+	dec, closeReader, err := openIndexSnapshot(r)
+	if err != nil {
+		return IndexLoadReport{}, err
+	}
+	defer closeReader()
+
+	db.rebuilding.Lock()
+	defer db.rebuilding.Unlock()
+
+	var report IndexLoadReport
+	options := db.currentSegmentOptions()
+	builds := make(map[*shard]*indexBuild, len(db.shards))
+	for _, s := range db.shards {
+		builds[s] = &indexBuild{index: newInvertedIndex(options), docs: s.documentsSnapshot()}
+	}
+	loaded := make(map[string]bool)
+	for {
+		var entry indexSnapshotEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return IndexLoadReport{}, fmt.Errorf("malformed index entry %d: %w", len(loaded)+report.Stale+1, err)
+		}
+		build := builds[db.shardFor(entry.ID)]
+		doc, exists := build.docs[entry.ID]
+		if !exists || doc.Version != entry.Version || !doc.UpdatedAt.Equal(entry.UpdatedAt) || loaded[entry.ID] {
+			report.Stale++
+			continue
+		}
+		build.index.insert(entry.ID, entry.text())
+		loaded[entry.ID] = true
+	}
+	// Documents the snapshot lacks are left out of the builds, so the swap
+	// indexes them with the current analyzers
+	for _, build := range builds {
+		for id := range build.docs {
+			if !loaded[id] {
+				delete(build.docs, id)
+			}
+		}
+	}
+
+	analysis := db.currentAnalysis()
+	report.Loaded = len(loaded)
+	report.Generation, report.Reindexed = db.swapIndex(analysis, builds)
+	return report, nil
+}
+
+// LoadIndexSnapshot loads an index snapshot file as ReadIndexSnapshot does
+func (db *DocumentDB) LoadIndexSnapshot(filePath string) (IndexLoadReport, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return IndexLoadReport{}, err
+	}
+	defer file.Close()
+	report, err := db.ReadIndexSnapshot(file)
+	if err != nil {
+		return report, fmt.Errorf("failed to load index snapshot %s: %w", filePath, err)
+	}
+	logger.Info("Index generation loaded", "generation", report.Generation, "path", filePath,
+		"documents", report.Loaded, "reindexed", report.Reindexed)
+	return report, nil
+}
+
+// openIndexSnapshot checks a snapshot's header and returns a decoder for its
+// entries
+func openIndexSnapshot(r io.Reader) (*json.Decoder, func() error, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(gz)
+	var header indexSnapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		gz.Close()
+		return nil, nil, fmt.Errorf("malformed header: %w", err)
+	}
+	if header.Format != indexSnapshotFormat {
+		gz.Close()
+		return nil, nil, errors.New("not an index snapshot")
+	}
+	if header.Version < 1 || header.Version > indexSnapshotVersion {
+		gz.Close()
+		return nil, nil, fmt.Errorf("unsupported index snapshot version %d, expected at most %d", header.Version, indexSnapshotVersion)
+	}
+	return dec, gz.Close, nil
+}
+
+// text turns an entry back into what the index holds
+func (entry indexSnapshotEntry) text() analyzedText {
+	text := analyzedText{postings: make(map[string]*posting, len(entry.Terms)), lengths: entry.Lengths}
+	for term, positions := range entry.Terms {
+		text.terms = append(text.terms, term)
+		text.postings[term] = &posting{positions: positions}
+	}
+	sort.Strings(text.terms)
+	return text
+}
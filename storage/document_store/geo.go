@@ -0,0 +1,211 @@
+package documentstore
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// GeoPoint is a location in degrees
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// ParseGeoPoint reads a location written as a TypeGeo value, "52.37,4.89"
+func ParseGeoPoint(value string) (GeoPoint, error) {
+	lat, lon, err := parseGeo(value)
+	if err != nil {
+		return GeoPoint{}, err
+	}
+	return GeoPoint{Lat: lat, Lon: lon}, nil
+}
+
+func (p GeoPoint) String() string {
+	return strconv.FormatFloat(p.Lat, 'g', -1, 64) + "," + strconv.FormatFloat(p.Lon, 'g', -1, 64)
+}
+
+// earthRadius is the mean radius of the earth in meters
+const earthRadius = 6371008.8
+
+// Distance returns the great-circle distance between two points in meters
+func (p GeoPoint) Distance(q GeoPoint) float64 {
+	lat1, lat2 := p.Lat*math.Pi/180, q.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (q.Lon - p.Lon) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// documentLocation reads a document's location from a metadata key
+func documentLocation(doc *Document, key string) (GeoPoint, bool) {
+	value, ok := doc.Metadata[key]
+	if !ok {
+		return GeoPoint{}, false
+	}
+	p, err := ParseGeoPoint(value)
+	return p, err == nil
+}
+
+// geohashAlphabet is the base 32 alphabet of geohashes, in the order the
+// cells it names sort
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashPrecision is how many characters geohashes are indexed to, which
+// places a point to within a few centimeters
+const geohashPrecision = 12
+
+// geohash names the cell of the given precision holding a point. Cells
+// sharing a prefix lie within the cell the prefix names, so the points of a
+// cell are a range of indexed geohashes.
+func geohash(p GeoPoint, precision int) string {
+	latLow, latHigh := -90.0, 90.0
+	lonLow, lonHigh := -180.0, 180.0
+	hash := make([]byte, 0, precision)
+	bits, ch := 0, 0
+	for even := true; len(hash) < precision; even = !even {
+		// Bits alternate between longitude and latitude, longitude first
+		ch <<= 1
+		if even {
+			if mid := (lonLow + lonHigh) / 2; p.Lon >= mid {
+				ch |= 1
+				lonLow = mid
+			} else {
+				lonHigh = mid
+			}
+		} else {
+			if mid := (latLow + latHigh) / 2; p.Lat >= mid {
+				ch |= 1
+				latLow = mid
+			} else {
+				latHigh = mid
+			}
+		}
+		if bits++; bits == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// geohashCell returns the size in degrees of the cells of a precision
+func geohashCell(precision int) (height, width float64) {
+	lonBits := (5*precision + 1) / 2
+	latBits := 5 * precision / 2
+	return 180 / math.Pow(2, float64(latBits)), 360 / math.Pow(2, float64(lonBits))
+}
+
+// maxCoverCells bounds how many cells a circle is covered with; coarser
+// cells are taken until it fits
+const maxCoverCells = 64
+
+// geohashCover returns the geohash prefixes of cells that together cover
+// every point within radius meters of center. Cells are as fine as the
+// circle allows, so few points outside it fall in them.
+func geohashCover(center GeoPoint, radius float64) []string {
+	// The circle's bounding box, spanning every longitude if it holds a
+	// pole or is wider than a hemisphere
+	dLat := radius / earthRadius * 180 / math.Pi
+	minLat, maxLat := math.Max(center.Lat-dLat, -90), math.Min(center.Lat+dLat, 90)
+	minLon, maxLon := -180.0, 180.0
+	if minLat > -90 && maxLat < 90 {
+		if s := math.Sin(radius/earthRadius) / math.Cos(center.Lat*math.Pi/180); s < 1 {
+			dLon := math.Asin(s) * 180 / math.Pi
+			minLon, maxLon = center.Lon-dLon, center.Lon+dLon
+		}
+	}
+
+	for precision := geohashPrecision; precision > 1; precision-- {
+		if cells := coverCells(minLat, maxLat, minLon, maxLon, precision); cells != nil {
+			return cells
+		}
+	}
+	return coverCells(minLat, maxLat, minLon, maxLon, 1)
+}
+
+// coverCells returns the geohashes of the cells of a precision meeting a
+// bounding box, or nil if there are more than maxCoverCells of them and the
+// precision isn't 1, whose 32 cells span the globe. Longitudes past the
+// antimeridian wrap around.
+func coverCells(minLat, maxLat, minLon, maxLon float64, precision int) []string {
+	height, width := geohashCell(precision)
+	latCells, lonCells := int(math.Round(180/height)), int(math.Round(360/width))
+	firstLat, lastLat := cellIndex(minLat+90, height, latCells), cellIndex(maxLat+90, height, latCells)
+	firstLon, lastLon := int(math.Floor((minLon+180)/width)), int(math.Floor((maxLon+180)/width))
+	if lastLon-firstLon >= lonCells {
+		firstLon, lastLon = 0, lonCells-1
+	}
+	if precision > 1 && (lastLat-firstLat+1)*(lastLon-firstLon+1) > maxCoverCells {
+		return nil
+	}
+	var cells []string
+	for i := firstLat; i <= lastLat; i++ {
+		for j := firstLon; j <= lastLon; j++ {
+			lon := (j%lonCells + lonCells) % lonCells
+			center := GeoPoint{Lat: -90 + (float64(i)+0.5)*height, Lon: -180 + (float64(lon)+0.5)*width}
+			cells = append(cells, geohash(center, precision))
+		}
+	}
+	return cells
+}
+
+// cellRange is the range of indexed geohashes within a cell
+func cellRange(cell string) keyRange {
+	// Every geohash character sorts before ~
+	return keyRange{
+		low:  &keyBound{key: rangeKey{text: cell}, inclusive: true},
+		high: &keyBound{key: rangeKey{text: cell + "~"}},
+	}
+}
+
+// cellIndex returns which of n cells of a size an offset falls in, the
+// last cell holding the far edge
+func cellIndex(offset, size float64, n int) int {
+	if i := int(math.Floor(offset / size)); i < n {
+		return i
+	}
+	return n - 1
+}
+
+// geoDistance is a point and a radius in meters around it
+type geoDistance struct {
+	center GeoPoint
+	radius float64
+}
+
+// distanceUnits are the units a distance query's radius may be given in,
+// in meters
+var distanceUnits = map[string]float64{"m": 1, "km": 1000, "mi": 1609.344}
+
+// isGeoDistance reports whether a metadata clause's value is a point and a
+// radius around it
+func isGeoDistance(text string) bool {
+	return strings.Contains(text, "~")
+}
+
+// parseGeoDistance reads a distance clause's value: a point, then ~ and a
+// radius in m, km or mi, as in 52.37,4.89~10km
+func parseGeoDistance(text string) (geoDistance, error) {
+	point, radius, _ := strings.Cut(text, "~")
+	center, err := ParseGeoPoint(point)
+	if err != nil {
+		return geoDistance{}, fmt.Errorf("bad center %q: %v", point, err)
+	}
+	number := strings.TrimRight(radius, "abcdefghijklmnopqrstuvwxyz")
+	unit, ok := distanceUnits[radius[len(number):]]
+	n, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil || !(n >= 0) || math.IsInf(n, 0) {
+		return geoDistance{}, fmt.Errorf("bad radius %q, want a distance in m, km or mi", radius)
+	}
+	return geoDistance{center: center, radius: n * unit}, nil
+}
+
+func (d geoDistance) contains(p GeoPoint) bool {
+	return d.center.Distance(p) <= d.radius
+}
+
+func (d geoDistance) String() string {
+	return d.center.String() + "~" + strconv.FormatFloat(d.radius, 'g', -1, 64) + "m"
+}
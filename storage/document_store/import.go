@@ -0,0 +1,141 @@
+package documentstore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ImportOptions controls an import
+type ImportOptions struct {
+	Format ExportFormat
+	// Bulk is passed on to Bulk for each batch of documents read
+	Bulk BulkOptions
+}
+
+// Import reads documents in the given format from r and adds them through
+// Bulk, a batch at a time, so the schema and dedup policy apply and the
+// report says what became of each document. Creation and update times,
+// versions and content hashes are assigned afresh. CSV input starts with a
+// header row naming its columns, and line breaks within its values read
+// back as "\n". WARC input may be gzipped. A malformed document stops the
+// import; the report covers the batches stored before.
+func (db *DocumentDB) Import(r io.Reader, options ImportOptions) (BulkReport, error) {
+	next, err := documentReader(r, options.Format)
+	if err != nil {
+		return BulkReport{}, err
+	}
+	batchSize := options.Bulk.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBulkBatchSize
+	}
+
+	var report BulkReport
+	var batch []*Document
+	flush := func() {
+		part := db.Bulk(batch, options.Bulk)
+		offset := len(report.Items)
+		for _, item := range part.Items {
+			item.Index += offset
+			report.Items = append(report.Items, item)
+		}
+		report.Created += part.Created
+		report.Updated += part.Updated
+		report.Failed += part.Failed
+		report.Replaced = append(report.Replaced, part.Replaced...)
+		batch = batch[:0]
+	}
+	for {
+		doc, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			flush()
+			return report, fmt.Errorf("document %d: %w", len(report.Items)+1, err)
+		}
+		batch = append(batch, doc)
+		if len(batch) == batchSize {
+			flush()
+		}
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+	return report, nil
+}
+
+// ImportFile imports the documents in a file
+func (db *DocumentDB) ImportFile(filePath string, options ImportOptions) (BulkReport, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return BulkReport{}, err
+	}
+	defer file.Close()
+
+	report, err := db.Import(file, options)
+	if err != nil {
+		return report, fmt.Errorf("failed to import %s: %w", filePath, err)
+	}
+	logger.Info("Documents imported", "path", filePath, "created", report.Created, "updated", report.Updated, "failed", report.Failed)
+	return report, nil
+}
+
+// documentReader returns a function reading the documents of r one at a
+// time, then io.EOF
+func documentReader(r io.Reader, format ExportFormat) (func() (*Document, error), error) {
+	switch format {
+	case FormatJSONL:
+		dec := json.NewDecoder(r)
+		return func() (*Document, error) {
+			var doc Document
+			if err := dec.Decode(&doc); err != nil {
+				return nil, err
+			}
+			return &doc, nil
+		}, nil
+
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		columns, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("missing CSV header: %w", err)
+		}
+		for _, column := range columns {
+			if !validColumn(column) {
+				return nil, fmt.Errorf("unknown CSV column %q", column)
+			}
+		}
+		return func() (*Document, error) {
+			row, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			doc := &Document{}
+			for i, column := range columns {
+				if err := setColumn(doc, column, row[i]); err != nil {
+					return nil, err
+				}
+			}
+			return doc, nil
+		}, nil
+
+	case FormatWARC:
+		br := bufio.NewReader(r)
+		if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+			// Each record of a .warc.gz is its own gzip member
+			gz, err := gzip.NewReader(br)
+			if err != nil {
+				return nil, err
+			}
+			br = bufio.NewReader(gz)
+		}
+		wr := &warcReader{r: br}
+		return wr.next, nil
+	}
+	return nil, fmt.Errorf("unknown import format %q", format)
+}
@@ -0,0 +1,300 @@
+package documentstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metadataFieldPrefix names metadata keys in index field names
+const metadataFieldPrefix = "metadata."
+
+// fieldIndex maps the values of one metadata key to the documents holding them
+type fieldIndex struct {
+	key    string
+	kind   FieldType                  // How values order: TypeString, TypeInt, TypeDate or TypeGeo
+	values map[string]map[string]bool // Value to document IDs
+	// sorted holds the distinct values in order, for range queries; values
+	// that aren't of the index's kind are left out
+	sorted []indexedValue
+}
+
+// indexedValue is a value of a fieldIndex and its place in the order
+type indexedValue struct {
+	value string
+	key   rangeKey
+}
+
+func newFieldIndex(key string, kind FieldType) *fieldIndex {
+	return &fieldIndex{key: key, kind: rangeKind(kind), values: make(map[string]map[string]bool)}
+}
+
+func (idx *fieldIndex) add(doc *Document) {
+	value, ok := doc.Metadata[idx.key]
+	if !ok {
+		return
+	}
+	ids, ok := idx.values[value]
+	if !ok {
+		ids = make(map[string]bool)
+		idx.values[value] = ids
+		if key, ok := parseRangeKey(idx.kind, value); ok {
+			i := idx.search(key)
+			idx.sorted = append(idx.sorted, indexedValue{})
+			copy(idx.sorted[i+1:], idx.sorted[i:])
+			idx.sorted[i] = indexedValue{value: value, key: key}
+		}
+	}
+	ids[doc.ID] = true
+}
+
+func (idx *fieldIndex) remove(doc *Document) {
+	value, ok := doc.Metadata[idx.key]
+	if !ok {
+		return
+	}
+	ids := idx.values[value]
+	delete(ids, doc.ID)
+	if len(ids) == 0 {
+		delete(idx.values, value)
+		key, _ := parseRangeKey(idx.kind, value)
+		// Values such as "7" and "07" share a key, so look past the first
+		for i := idx.search(key); i < len(idx.sorted) && idx.sorted[i].key == key; i++ {
+			if idx.sorted[i].value == value {
+				idx.sorted = append(idx.sorted[:i], idx.sorted[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// search returns the position of the first sorted value not before key
+func (idx *fieldIndex) search(key rangeKey) int {
+	return sort.Search(len(idx.sorted), func(i int) bool { return !idx.sorted[i].key.less(key) })
+}
+
+// span returns the positions in sorted of the values in r, from start up
+// to but not including end
+func (idx *fieldIndex) span(r keyRange) (int, int) {
+	start := sort.Search(len(idx.sorted), func(i int) bool { return r.above(idx.sorted[i].key) })
+	end := sort.Search(len(idx.sorted), func(i int) bool { return !r.below(idx.sorted[i].key) })
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+// lookup returns the IDs of documents whose value is in r, ordered by value
+func (idx *fieldIndex) lookup(r keyRange) []string {
+	start, end := idx.span(r)
+	var ids []string
+	for _, v := range idx.sorted[start:end] {
+		ids = append(ids, sortedIDs(idx.values[v.value])...)
+	}
+	return ids
+}
+
+func sortedIDs(set map[string]bool) []string {
+	ids := make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// metadataKey returns the metadata key an index field names
+func metadataKey(field string) (string, error) {
+	key := strings.TrimPrefix(field, metadataFieldPrefix)
+	if key == field || key == "" {
+		return "", fmt.Errorf("cannot index field %q, only metadata.<key> fields are indexable", field)
+	}
+	return key, nil
+}
+
+// CreateIndex indexes a metadata field, e.g. "metadata.author", so lookups
+// and range queries on it don't scan every document. The index orders
+// values as the schema types the field when it is created: as numbers for
+// TypeInt, as times for TypeDate, by geohash for TypeGeo, so distance
+// queries only visit the cells near their center, and otherwise as
+// strings. Indexes live in memory and are rebuilt by calling CreateIndex
+// again after opening a database. Indexing a field twice fails with
+// ErrIndexExists, and indexing a field whose stored values don't read as
+// the type the schema gives it fails with ErrIncompatibleMapping, since
+// those documents would be left out. CreateIndex holds up writes while it
+// indexes every document; BuildIndex doesn't.
+func (db *DocumentDB) CreateIndex(field string) error {
+	key, err := metadataKey(field)
+	if err != nil {
+		return err
+	}
+	kind := db.currentSchema().fieldType(key)
+	db.lockAll()
+	defer db.unlockAll()
+
+	if _, exists := db.shards[0].allIndexes()[key]; exists {
+		return fmt.Errorf("%w: %s", ErrIndexExists, field)
+	}
+	if reason := db.mismatchesLocked(key, kind); reason != "" {
+		return mappingError([]FieldError{{key, reason + "; they would be left out of the index"}})
+	}
+	for _, s := range db.shards {
+		idx := newFieldIndex(key, kind)
+		for _, doc := range s.documents {
+			idx.add(doc)
+		}
+		s.indexes[key] = idx
+	}
+	return nil
+}
+
+// DropIndex removes the index on a metadata field, giving up its build if
+// BuildIndex is still backfilling it, and fails with ErrIndexNotFound if
+// it has none
+func (db *DocumentDB) DropIndex(field string) error {
+	key, err := metadataKey(field)
+	if err != nil {
+		return err
+	}
+	db.lockAll()
+	defer db.unlockAll()
+
+	if _, exists := db.shards[0].allIndexes()[key]; !exists {
+		return fmt.Errorf("%w: %s", ErrIndexNotFound, field)
+	}
+	for _, s := range db.shards {
+		delete(s.indexes, key)
+		delete(s.building, key)
+	}
+	return nil
+}
+
+// Indexes returns the indexed fields in order
+func (db *DocumentDB) Indexes() []string {
+	s := db.shards[0]
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	fields := make([]string, 0, len(s.indexes))
+	for key := range s.indexes {
+		fields = append(fields, metadataFieldPrefix+key)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// FindDocumentsInRange returns the documents whose value of an indexed
+// metadata field lies between low and high inclusive, ordered by value.
+// Values compare as the index orders them, see CreateIndex; values of
+// other kinds are never in range. An empty bound leaves that end of the
+// range open.
+func (db *DocumentDB) FindDocumentsInRange(field, low, high string) ([]*Document, error) {
+	key, err := metadataKey(field)
+	if err != nil {
+		return nil, err
+	}
+	db.rlockAll()
+	defer db.runlockAll()
+
+	idx, exists := db.shards[0].indexes[key]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrIndexNotFound, field)
+	}
+	var bounds valueRange
+	if low != "" {
+		bounds.low = &rangeBound{value: low, inclusive: true}
+	}
+	if high != "" {
+		bounds.high = &rangeBound{value: high, inclusive: true}
+	}
+	if idx.kind == TypeGeo {
+		return nil, fmt.Errorf("%s holds locations, which have no range order", field)
+	}
+	r, ok := bounds.keys(idx.kind)
+	if !ok {
+		return nil, fmt.Errorf("bounds of %s must be of type %s", field, idx.kind)
+	}
+	var docs []*Document
+	for _, s := range db.shards {
+		for _, id := range s.indexes[key].lookup(r) {
+			docs = append(docs, s.documents[id])
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		a, _ := parseRangeKey(idx.kind, docs[i].Metadata[key])
+		b, _ := parseRangeKey(idx.kind, docs[j].Metadata[key])
+		if a != b {
+			return a.less(b)
+		}
+		return docs[i].ID < docs[j].ID
+	})
+	return docs, nil
+}
+
+// putLocked stores doc in its shard and the shard's indexes, replacing any
+// previous version, and publishes the change; callers hold the shard's lock
+func (db *DocumentDB) putLocked(s *shard, doc *Document) {
+	kind := EventCreate
+	if old, exists := s.documents[doc.ID]; exists {
+		kind = EventUpdate
+		for _, idx := range s.indexes {
+			idx.remove(old)
+		}
+		for _, idx := range s.building {
+			idx.remove(old)
+		}
+		db.fingerprints.remove(documentFingerprint(old), old.ID)
+		db.links.remove(old)
+		s.accountLocked(old, true)
+	}
+	s.documents[doc.ID] = doc
+	s.accountLocked(doc, false)
+	delete(s.trash, doc.ID) // The stored document replaces any tombstone
+	db.fingerprints.add(documentFingerprint(doc), doc.ID)
+	db.links.add(doc)
+	db.vectors.put(doc)
+	for _, idx := range s.indexes {
+		idx.add(doc)
+	}
+	for _, idx := range s.building {
+		idx.add(doc)
+	}
+	analyzed := time.Now()
+	s.text.add(doc, db.currentAnalysis().analyzerFor(doc))
+	db.recordCosts(doc, time.Since(analyzed))
+	db.mergeLocked(s)
+	db.spellTermsLocked(s, doc.ID)
+	db.publish(kind, doc.ID, doc)
+}
+
+// removeLocked drops a document from its shard and the shard's indexes and
+// publishes the change; callers hold the shard's lock
+func (db *DocumentDB) removeLocked(s *shard, id string) {
+	if db.unindexLocked(s, id) {
+		db.publish(EventDelete, id, nil)
+	}
+}
+
+// unindexLocked drops a document from its shard and the shard's indexes
+// without publishing, reporting whether it was there
+func (db *DocumentDB) unindexLocked(s *shard, id string) bool {
+	doc, exists := s.documents[id]
+	if !exists {
+		return false
+	}
+	for _, idx := range s.indexes {
+		idx.remove(doc)
+	}
+	for _, idx := range s.building {
+		idx.remove(doc)
+	}
+	db.forgetTermsLocked(s, id)
+	s.text.remove(id)
+	db.fingerprints.remove(documentFingerprint(doc), id)
+	db.links.remove(doc)
+	db.vectors.remove(id)
+	s.accountLocked(doc, true)
+	delete(s.documents, id)
+	return true
+}
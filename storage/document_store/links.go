@@ -0,0 +1,298 @@
+package documentstore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Link is an edge of the link graph, from one document to another. The
+// target need not be stored: crawlers find links to pages they haven't
+// fetched yet.
+type Link struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// LinkDirection picks which edges Neighbors follows
+type LinkDirection int
+
+const (
+	LinksOut  LinkDirection = iota // From a document to those it links to
+	LinksIn                        // From a document to those linking to it
+	LinksBoth                      // Either way
+)
+
+// LinkReport says what became of a request to add links
+type LinkReport struct {
+	Added   int `json:"added"`   // New edges stored
+	Updated int `json:"updated"` // Documents given new outgoing links
+	// Missing lists the sources that aren't stored, whose links were dropped
+	Missing []string `json:"missing,omitempty"`
+}
+
+// linkIndex maps documents to the stored documents linking to them, across
+// shards. Outgoing links live on the documents themselves. Its lock is
+// taken after any shard's.
+type linkIndex struct {
+	mutex   sync.RWMutex
+	inlinks map[string]map[string]bool // Target to source IDs
+	edges   int
+}
+
+func newLinkIndex() *linkIndex {
+	return &linkIndex{inlinks: make(map[string]map[string]bool)}
+}
+
+func (l *linkIndex) add(doc *Document) {
+	if len(doc.Links) == 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, target := range doc.Links {
+		sources := l.inlinks[target]
+		if sources == nil {
+			sources = make(map[string]bool)
+			l.inlinks[target] = sources
+		}
+		if !sources[doc.ID] {
+			sources[doc.ID] = true
+			l.edges++
+		}
+	}
+}
+
+func (l *linkIndex) remove(doc *Document) {
+	if len(doc.Links) == 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, target := range doc.Links {
+		sources := l.inlinks[target]
+		if !sources[doc.ID] {
+			continue
+		}
+		delete(sources, doc.ID)
+		l.edges--
+		if len(sources) == 0 {
+			delete(l.inlinks, target)
+		}
+	}
+}
+
+// sources returns the IDs of the documents linking to id, sorted
+func (l *linkIndex) sources(id string) []string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	ids := make([]string, 0, len(l.inlinks[id]))
+	for source := range l.inlinks[id] {
+		ids = append(ids, source)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (l *linkIndex) count(id string) int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.inlinks[id])
+}
+
+// normalizeLinks drops empty and repeated targets, keeping the order they
+// were found in
+func normalizeLinks(targets []string) []string {
+	if len(targets) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool, len(targets))
+	links := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if target != "" && !seen[target] {
+			seen[target] = true
+			links = append(links, target)
+		}
+	}
+	if len(links) == 0 {
+		return nil
+	}
+	return links
+}
+
+// Outlinks returns the IDs a document links to, in the order they were
+// found; it fails with ErrNotFound if there is no such document
+func (db *DocumentDB) Outlinks(id string) ([]string, error) {
+	doc, err := db.GetDocument(id)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), doc.Links...), nil
+}
+
+// Inlinks returns the IDs of the stored documents linking to id, sorted.
+// The target itself need not be stored.
+func (db *DocumentDB) Inlinks(id string) []string {
+	return db.links.sources(id)
+}
+
+// InlinkCount returns how many stored documents link to id
+func (db *DocumentDB) InlinkCount(id string) int {
+	return db.links.count(id)
+}
+
+// LinkCount returns the number of edges in the link graph
+func (db *DocumentDB) LinkCount() int {
+	db.links.mutex.RLock()
+	defer db.links.mutex.RUnlock()
+	return db.links.edges
+}
+
+// Neighbors returns the IDs within depth links of a document, following
+// links in the given direction, nearest first and sorted within each
+// distance. The document itself is left out. Targets that aren't stored are
+// included but not followed further, since their links are unknown.
+func (db *DocumentDB) Neighbors(id string, depth int, direction LinkDirection) []string {
+	seen := map[string]bool{id: true}
+	var neighbors []string
+	frontier := []string{id}
+	for distance := 0; distance < depth && len(frontier) > 0; distance++ {
+		var next []string
+		for _, current := range frontier {
+			var adjacent []string
+			if direction != LinksIn {
+				if links, err := db.Outlinks(current); err == nil {
+					adjacent = append(adjacent, links...)
+				}
+			}
+			if direction != LinksOut {
+				adjacent = append(adjacent, db.Inlinks(current)...)
+			}
+			for _, other := range adjacent {
+				if !seen[other] {
+					seen[other] = true
+					next = append(next, other)
+				}
+			}
+		}
+		sort.Strings(next)
+		neighbors = append(neighbors, next...)
+		frontier = next
+	}
+	return neighbors
+}
+
+// SetLinks replaces the outgoing links of a document, storing a new version
+// unless they are unchanged; it fails with ErrNotFound if there is no such
+// document
+func (db *DocumentDB) SetLinks(id string, targets []string) error {
+	s := db.shardFor(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	doc, exists := s.documents[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	links := normalizeLinks(targets)
+	if equalLinks(doc.Links, links) {
+		return nil
+	}
+	updated := copyDocument(doc)
+	updated.Links = links
+	return db.commitUpdateLocked(s, doc, updated)
+}
+
+// AddLinks adds edges to the link graph in bulk, as a crawler reports the
+// links it extracts. Edges already present are skipped and each changed
+// source gets one new version. Shards are written one at a time, each as
+// one batch; links from sources that aren't stored are dropped and
+// reported. On an engine error the shards already written keep their new
+// links.
+func (db *DocumentDB) AddLinks(links []Link) (LinkReport, error) {
+	var report LinkReport
+	bySource := make(map[string][]string)
+	for _, link := range links {
+		if link.From == "" || link.To == "" {
+			continue
+		}
+		bySource[link.From] = append(bySource[link.From], link.To)
+	}
+	byShard := make(map[*shard][]string)
+	for source := range bySource {
+		s := db.shardFor(source)
+		byShard[s] = append(byShard[s], source)
+	}
+
+	for _, s := range db.shards {
+		sources := byShard[s]
+		if len(sources) == 0 {
+			continue
+		}
+		sort.Strings(sources)
+		added, updated, missing, err := db.addLinksToShard(s, sources, bySource)
+		report.Missing = append(report.Missing, missing...)
+		if err != nil {
+			return report, fmt.Errorf("failed to add links: %w", err)
+		}
+		report.Added += added
+		report.Updated += updated
+	}
+	sort.Strings(report.Missing)
+	return report, nil
+}
+
+func (db *DocumentDB) addLinksToShard(s *shard, sources []string, targets map[string][]string) (added, updated int, missing []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	schema := db.currentSchema()
+	var batch Batch
+	var replaced []*Document
+	now := time.Now()
+	for _, id := range sources {
+		doc, exists := s.documents[id]
+		if !exists {
+			missing = append(missing, id)
+			continue
+		}
+		links := normalizeLinks(append(append([]string(nil), doc.Links...), targets[id]...))
+		if len(links) == len(doc.Links) {
+			continue
+		}
+		next := copyDocument(doc)
+		next.Links = links
+		next.Version = doc.Version + 1
+		next.UpdatedAt = now
+		if err := schema.validate(next); err != nil {
+			return 0, 0, missing, fmt.Errorf("%s: %w", id, err)
+		}
+		batch.Puts = append(batch.Puts, next)
+		replaced = append(replaced, doc)
+		added += len(links) - len(doc.Links)
+	}
+	if len(batch.Puts) == 0 {
+		return 0, 0, missing, nil
+	}
+	if err := db.engine.Write(batch); err != nil {
+		return 0, 0, missing, err
+	}
+	for i, next := range batch.Puts {
+		db.keepVersionLocked(s, replaced[i])
+		db.putLocked(s, next)
+	}
+	return added, len(batch.Puts), missing, nil
+}
+
+func equalLinks(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,259 @@
+package documentstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// backfillBatchSize is how many documents BuildIndex indexes per lock of a
+// shard, so writes to the shard wait for one batch at most
+const backfillBatchSize = 1000
+
+// MappingError lists the ways a schema or index change conflicts with how
+// fields are indexed or with the values already stored, ordered by field.
+// Applying such a change would leave documents out of indexes or compare
+// values as the wrong type, so it is refused; reindexing into an index set
+// up the new way is the way through.
+type MappingError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+// Is makes every MappingError match ErrIncompatibleMapping
+func (e *MappingError) Is(target error) bool {
+	return target == ErrIncompatibleMapping
+}
+
+func (e *MappingError) Error() string {
+	reasons := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		reasons[i] = f.Error()
+	}
+	return fmt.Sprintf("incompatible mapping change: %s", strings.Join(reasons, "; "))
+}
+
+// mappingError returns problems as a *MappingError, or nil if there are
+// none
+func mappingError(problems []FieldError) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Field < problems[j].Field })
+	return &MappingError{Fields: problems}
+}
+
+// fieldType is the type a schema gives a metadata key; keys it doesn't
+// list, and every key without a schema, are strings
+func (s *compiledSchema) fieldType(key string) FieldType {
+	if s == nil {
+		return TypeString
+	}
+	if rule, ok := s.Fields[key]; ok {
+		return rule.Type
+	}
+	return TypeString
+}
+
+// checkMappingLocked returns a *MappingError if moving from schema old to
+// schema new retypes fields in a way the indexes or the stored values
+// don't allow: an indexed field can't change how its values order, and a
+// field can't take a type some stored values don't read as. Callers hold
+// every shard's lock.
+func (db *DocumentDB) checkMappingLocked(old, new *compiledSchema) error {
+	keys := make(map[string]bool)
+	for _, schema := range []*compiledSchema{old, new} {
+		if schema != nil {
+			for key := range schema.Fields {
+				keys[key] = true
+			}
+		}
+	}
+	indexed := db.shards[0].allIndexes()
+	var problems []FieldError
+	for key := range keys {
+		from, to := old.fieldType(key), new.fieldType(key)
+		if from == to {
+			continue
+		}
+		if idx, exists := indexed[key]; exists && idx.kind != rangeKind(to) {
+			problems = append(problems, FieldError{key, fmt.Sprintf("is indexed as %s, so it can't become %s; drop the index or reindex", idx.kind, to)})
+			continue
+		}
+		if reason := db.mismatchesLocked(key, to); reason != "" {
+			problems = append(problems, FieldError{key, reason + ", so it can't become " + string(to)})
+		}
+	}
+	return mappingError(problems)
+}
+
+// mismatchesLocked returns how the stored values of a metadata key fail
+// to read as kind, or "" if they all do. Callers hold every shard's lock.
+func (db *DocumentDB) mismatchesLocked(key string, kind FieldType) string {
+	if rangeKind(kind) == TypeString {
+		return ""
+	}
+	count, example := 0, ""
+	for _, s := range db.shards {
+		for _, doc := range s.documents {
+			value, ok := doc.Metadata[key]
+			if !ok {
+				continue
+			}
+			if _, ok := parseRangeKey(kind, value); !ok {
+				if count == 0 || value < example {
+					example = value
+				}
+				count++
+			}
+		}
+	}
+	if count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d stored values aren't %s, such as %q", count, kind, example)
+}
+
+// allIndexes returns the shard's indexes, those in use and those being
+// built, by metadata key; callers hold the shard's lock
+func (s *shard) allIndexes() map[string]*fieldIndex {
+	indexes := make(map[string]*fieldIndex, len(s.indexes)+len(s.building))
+	for key, idx := range s.indexes {
+		indexes[key] = idx
+	}
+	for key, idx := range s.building {
+		indexes[key] = idx
+	}
+	return indexes
+}
+
+// IndexBuild follows an index BuildIndex is filling in the background
+type IndexBuild struct {
+	Field string
+	total int
+	done  int64 // Documents indexed, accessed atomically
+	over  chan struct{}
+	err   error // Set before over closes
+}
+
+// Progress returns how many of the documents stored when the build began
+// have been indexed
+func (b *IndexBuild) Progress() (indexed, total int) {
+	return int(atomic.LoadInt64(&b.done)), b.total
+}
+
+// Wait waits until the index is in use, returning nil, or the build was
+// given up, returning why, or ctx is done
+func (b *IndexBuild) Wait(ctx context.Context) error {
+	select {
+	case <-b.over:
+		return b.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// BuildIndex indexes a metadata field as CreateIndex does, but without
+// holding up reads and writes while the existing documents are indexed.
+// The index starts empty and is kept current with every write from then
+// on, while the documents stored before are backfilled in the background
+// a batch at a time; searches go on scanning until the backfill is done
+// and the index is put to use. Dropping the index or closing the database
+// gives the build up. Like CreateIndex, it fails with ErrIndexExists if the
+// field is indexed or being indexed, and with ErrIncompatibleMapping if
+// stored values don't read as the type the schema gives the field.
+func (db *DocumentDB) BuildIndex(field string) (*IndexBuild, error) {
+	key, err := metadataKey(field)
+	if err != nil {
+		return nil, err
+	}
+	kind := db.currentSchema().fieldType(key)
+	db.lockAll()
+	if _, exists := db.shards[0].allIndexes()[key]; exists {
+		db.unlockAll()
+		return nil, fmt.Errorf("%w: %s", ErrIndexExists, field)
+	}
+	if reason := db.mismatchesLocked(key, kind); reason != "" {
+		db.unlockAll()
+		return nil, mappingError([]FieldError{{key, reason + "; they would be left out of the index"}})
+	}
+	// The documents to backfill are those stored now; later writes go
+	// into the index as they happen
+	build := &IndexBuild{Field: field, over: make(chan struct{})}
+	pending := make([][]string, len(db.shards))
+	indexes := make([]*fieldIndex, len(db.shards))
+	for i, s := range db.shards {
+		indexes[i] = newFieldIndex(key, kind)
+		s.building[key] = indexes[i]
+		pending[i] = make([]string, 0, len(s.documents))
+		for id := range s.documents {
+			pending[i] = append(pending[i], id)
+		}
+		build.total += len(pending[i])
+	}
+	db.unlockAll()
+
+	go func() {
+		build.err = db.backfill(key, indexes, pending, build)
+		close(build.over)
+	}()
+	return build, nil
+}
+
+// backfill adds the documents pending in each shard that are still
+// stored to the shard's index, then puts the indexes to use. An index
+// that is no longer being built, or was replaced by another build's, was
+// given up.
+func (db *DocumentDB) backfill(key string, indexes []*fieldIndex, pending [][]string, build *IndexBuild) error {
+	for i, s := range db.shards {
+		ids := pending[i]
+		for start := 0; start < len(ids); start += backfillBatchSize {
+			end := start + backfillBatchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+			s.mutex.Lock()
+			if s.building[key] != indexes[i] {
+				s.mutex.Unlock()
+				return fmt.Errorf("building the index on %s was given up: it was dropped or the database closed", build.Field)
+			}
+			// Adding a document written since the build began again is
+			// harmless
+			for _, id := range ids[start:end] {
+				if doc, exists := s.documents[id]; exists {
+					indexes[i].add(doc)
+				}
+			}
+			s.mutex.Unlock()
+			atomic.AddInt64(&build.done, int64(end-start))
+		}
+	}
+
+	db.lockAll()
+	defer db.unlockAll()
+	for i, s := range db.shards {
+		if s.building[key] != indexes[i] {
+			return fmt.Errorf("building the index on %s was given up: it was dropped or the database closed", build.Field)
+		}
+	}
+	for i, s := range db.shards {
+		s.indexes[key] = indexes[i]
+		delete(s.building, key)
+	}
+	return nil
+}
+
+// BuildingIndexes returns the fields BuildIndex is still backfilling, in
+// order
+func (db *DocumentDB) BuildingIndexes() []string {
+	s := db.shards[0]
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	fields := make([]string, 0, len(s.building))
+	for key := range s.building {
+		fields = append(fields, metadataFieldPrefix+key)
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,205 @@
+package documentstore
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MatchMode decides how FindDocumentsByContent compares text with document
+// content. Every mode ignores case by Unicode simple case folding, so
+// "ΣΟΦΙΑ" finds "σοφια" and "ſ" finds "S"; it doesn't expand letters, so
+// "STRASSE" doesn't find "straße".
+type MatchMode int
+
+const (
+	// MatchSubstring matches content containing the text anywhere
+	MatchSubstring MatchMode = iota
+	// MatchExact matches content containing the text's words as whole
+	// words, in order
+	MatchExact
+	// MatchPrefix is MatchExact but the text's last word may be the start
+	// of a longer word, as when completing what a user is typing
+	MatchPrefix
+	// MatchFuzzy is MatchExact but each word may be misspelt by up to
+	// MaxEdits insertions, deletions or substitutions
+	MatchFuzzy
+)
+
+// MatchOptions configures FindDocumentsByContent
+type MatchOptions struct {
+	Mode MatchMode
+	// MaxEdits bounds the misspellings per word in MatchFuzzy mode. Zero
+	// allows one edit in words of up to five letters and two in longer ones.
+	MaxEdits int
+}
+
+// FindDocumentsByContent returns the documents whose content matches text,
+// ordered by ID, scanning the shards in parallel. Empty text, or text
+// without words in a word-based mode, matches nothing.
+func (db *DocumentDB) FindDocumentsByContent(text string, options MatchOptions) []*Document {
+	match := newMatcher(text, options)
+	if match == nil {
+		return []*Document{}
+	}
+
+	var wg sync.WaitGroup
+	found := make([][]*Document, len(db.shards))
+	for i, s := range db.shards {
+		wg.Add(1)
+		go func(i int, s *shard) {
+			defer wg.Done()
+			s.mutex.RLock()
+			defer s.mutex.RUnlock()
+			for _, doc := range s.documents {
+				if match(doc.Content) {
+					found[i] = append(found[i], doc)
+				}
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	results := make([]*Document, 0)
+	for _, docs := range found {
+		results = append(results, docs...)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	return results
+}
+
+// newMatcher returns a function reporting whether content matches text in
+// the given mode, or nil if nothing can match
+func newMatcher(text string, options MatchOptions) func(content string) bool {
+	if options.Mode == MatchSubstring {
+		if text == "" {
+			return nil
+		}
+		folded := foldCase(text)
+		return func(content string) bool {
+			return strings.Contains(foldCase(content), folded)
+		}
+	}
+
+	words := foldTokens(text)
+	if len(words) == 0 {
+		return nil
+	}
+	return func(content string) bool {
+		return matchWords(foldTokens(content), words, options)
+	}
+}
+
+// foldCase maps every rune to a canonical member of its Unicode case
+// folding orbit, so strings equal under folding become identical. Unlike
+// strings.ToLower it also unites forms such as 'ſ' and 's' or 'K' (Kelvin)
+// and 'k', and each rune maps to exactly one rune, so substring positions
+// carry over.
+func foldCase(s string) string {
+	return strings.Map(foldRune, s)
+}
+
+func foldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
+
+// foldTokens splits text into words as tokenize does, folding their case.
+// Combining marks stay with the letter they follow, so a decomposed "café"
+// isn't the word "cafe".
+func foldTokens(text string) []string {
+	return strings.FieldsFunc(foldCase(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	})
+}
+
+// matchWords reports whether words occur as a run in tokens under the
+// options' mode
+func matchWords(tokens, words []string, options MatchOptions) bool {
+	for start := 0; start+len(words) <= len(tokens); start++ {
+		matched := true
+		for i, word := range words {
+			if !matchWord(tokens[start+i], word, i == len(words)-1, options) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func matchWord(token, word string, last bool, options MatchOptions) bool {
+	switch options.Mode {
+	case MatchPrefix:
+		if last {
+			return strings.HasPrefix(token, word)
+		}
+	case MatchFuzzy:
+		return withinEdits(token, word, maxEdits(word, options.MaxEdits))
+	}
+	return token == word
+}
+
+// maxEdits returns how many edits a fuzzy match of word may take
+func maxEdits(word string, configured int) int {
+	if configured > 0 {
+		return configured
+	}
+	if utf8.RuneCountInString(word) <= 5 {
+		return 1
+	}
+	return 2
+}
+
+// withinEdits reports whether the Levenshtein distance between a and b,
+// counted in runes, is at most max
+func withinEdits(a, b string, max int) bool {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra)-len(rb) > max || len(rb)-len(ra) > max {
+		return false
+	}
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		best := curr[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			if curr[j] < best {
+				best = curr[j]
+			}
+		}
+		if best > max {
+			return false
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)] <= max
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
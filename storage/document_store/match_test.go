@@ -0,0 +1,88 @@
+package documentstore_test
+
+import (
+	"reflect"
+	"testing"
+
+	documentstore "storage/document_store"
+)
+
+// Test every match mode against multi-byte text and the case folding
+// corners of Unicode
+func TestFindDocumentsByContent(t *testing.T) {
+	db := openMemoryDB(t)
+	contents := map[string]string{
+		"french":   "Un café naïve au coin de la rue",
+		"decomp":   "Un cafe\u0301 au lait",
+		"greek":    "ΛΟΓΟΣ και σοφια",
+		"sigma":    "ο λογος της ζωης",
+		"longs":    "Die ſtraſſe ist lang",
+		"german":   "Die Straße ist lang",
+		"kelvin":   "Absolute zero is 0 \u212Aelvin",
+		"japanese": "私は東京都に住んでいます",
+		"english":  "search engines rank pages",
+	}
+	for id, content := range contents {
+		if err := db.AddDocument(&documentstore.Document{ID: id, Content: content}); err != nil {
+			t.Fatalf("Failed to add %s: %v", id, err)
+		}
+	}
+
+	substring := documentstore.MatchOptions{Mode: documentstore.MatchSubstring}
+	exact := documentstore.MatchOptions{Mode: documentstore.MatchExact}
+	prefix := documentstore.MatchOptions{Mode: documentstore.MatchPrefix}
+	fuzzy := documentstore.MatchOptions{Mode: documentstore.MatchFuzzy}
+	oneEdit := documentstore.MatchOptions{Mode: documentstore.MatchFuzzy, MaxEdits: 1}
+	tests := []struct {
+		name    string
+		text    string
+		options documentstore.MatchOptions
+		want    []string
+	}{
+		{"substring across multi-byte runes", "ÏVE AU", substring, []string{"french"}},
+		{"substring of capital sigma", "λογοσ", substring, []string{"greek", "sigma"}},
+		{"substring of final sigma", "ΛΟΓΟς", substring, []string{"greek", "sigma"}},
+		{"substring of small sigma", "Σοφια", substring, []string{"greek"}},
+		{"substring of long s", "STRASSE", substring, []string{"longs"}},
+		{"substring without expanding sharp s", "strasse", substring, []string{"longs"}},
+		{"substring of sharp s", "STRAßE", substring, []string{"german"}},
+		{"substring of Kelvin sign", "kelvin", substring, []string{"kelvin"}},
+		{"substring of CJK", "東京", substring, []string{"japanese"}},
+		{"substring of combining mark", "E\u0301 AU", substring, []string{"decomp"}},
+		{"empty substring", "", substring, nil},
+
+		{"exact words in order", "café naïve", exact, []string{"french"}},
+		{"exact words out of order", "naïve café", exact, nil},
+		{"exact part of a word", "caf", exact, nil},
+		{"exact final sigma", "λογος", exact, []string{"greek", "sigma"}},
+		{"exact long s", "strasse", exact, []string{"longs"}},
+		{"exact Kelvin sign", "KELVIN", exact, []string{"kelvin"}},
+		{"exact unspaced CJK", "東京", exact, nil},
+		{"exact combining mark", "CAFE\u0301", exact, []string{"decomp"}},
+		{"exact letter without its mark", "cafe", exact, nil},
+		{"exact without words", "…", exact, nil},
+
+		{"prefix of the last word", "search eng", prefix, []string{"english"}},
+		{"prefix of an earlier word", "sea engines", prefix, nil},
+		{"prefix of CJK", "私は東京", prefix, []string{"japanese"}},
+		{"prefix of multi-byte word", "Un café NAÏ", prefix, []string{"french"}},
+		{"prefix of Kelvin sign", "0 k", prefix, []string{"kelvin"}},
+
+		{"fuzzy multi-byte edit counted once", "naive", oneEdit, []string{"french"}},
+		{"fuzzy CJK substitution", "私は東京都に住んでいまず", oneEdit, []string{"japanese"}},
+		{"fuzzy sharp s within two edits", "strasse", fuzzy, []string{"german", "longs"}},
+		{"fuzzy sharp s beyond one edit", "strasse", oneEdit, []string{"longs"}},
+		{"fuzzy final sigma", "λογοι", fuzzy, []string{"greek", "sigma"}},
+		{"fuzzy dropped combining mark", "cafe", oneEdit, []string{"decomp", "french"}},
+		{"fuzzy too far", "sorch", oneEdit, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, doc := range db.FindDocumentsByContent(tt.text, tt.options) {
+			got = append(got, doc.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %q found %v, expected %v", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
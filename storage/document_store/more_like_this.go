@@ -0,0 +1,88 @@
+package documentstore
+
+import "sort"
+
+// moreLikeThisTerms is how many of a document's terms MoreLikeThis searches
+// for when it has no vector
+const moreLikeThisTerms = 25
+
+// MoreLikeThis returns the k documents most like document id, best first,
+// for features such as related pages; it fails with ErrNotFound if there is
+// none. A document with a vector is compared by it, as SimilarSearch does.
+// Otherwise its most significant terms, those it would score best for, are
+// searched for as RankedSearch does, among documents analyzed as it was.
+// The document itself is never among the results.
+func (db *DocumentDB) MoreLikeThis(id string, k int) ([]SearchResult, error) {
+	doc, err := db.GetDocument(id)
+	if err != nil {
+		return nil, err
+	}
+	if k <= 0 {
+		return nil, nil
+	}
+	if _, ok := unitVector(doc.Vector); ok {
+		results, err := db.SimilarSearch(doc.Vector, k+1)
+		if err != nil {
+			return nil, err
+		}
+		return relatedResults(results, id, k), nil
+	}
+
+	config := db.scoringConfig()
+	analysis := db.currentAnalysis()
+	analyzer := analysis.analyzerFor(doc)
+	db.rlockAll()
+	defer db.runlockAll()
+
+	terms := db.significantTermsLocked(id, config)
+	var hits []hit
+	for _, s := range db.shards {
+		for _, match := range s.text.matchAny(terms) {
+			if analysis.analyzerFor(s.documents[match]) == analyzer {
+				hits = append(hits, hit{shard: s, id: match})
+			}
+		}
+	}
+	results := rankLocked(hits, terms, config, db.corpusStatsLocked(terms), nil)
+	return relatedResults(results, id, k), nil
+}
+
+// significantTermsLocked returns up to moreLikeThisTerms terms of document
+// id, those adding most to its own score for them. Terms no other document
+// holds can't find anything and are left out. Callers hold every shard's
+// read lock.
+func (db *DocumentDB) significantTermsLocked(id string, config ScoringConfig) []string {
+	text := db.shardFor(id).text
+	candidates := text.terms(id)
+	stats := db.corpusStatsLocked(candidates)
+	weights := make(map[string]float64, len(candidates))
+	terms := make([]string, 0, len(candidates))
+	for _, term := range candidates {
+		if stats.df[term] < 2 {
+			continue
+		}
+		weights[term] = text.score(id, []string{term}, config, stats)
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if weights[terms[i]] != weights[terms[j]] {
+			return weights[terms[i]] > weights[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+	if len(terms) > moreLikeThisTerms {
+		terms = terms[:moreLikeThisTerms]
+	}
+	return terms
+}
+
+// relatedResults drops document id from ranked results and keeps the best k
+func relatedResults(results []SearchResult, id string, k int) []SearchResult {
+	related := make([]SearchResult, 0, k)
+	for _, result := range results {
+		if result.Document.ID != id && len(related) < k {
+			related = append(related, result)
+		}
+	}
+	return related
+}
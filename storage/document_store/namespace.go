@@ -0,0 +1,487 @@
+package documentstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// NamespaceSeparator joins a namespace to the IDs documents have in it: the
+// document "a" of namespace "acme" is stored as "acme::a". Documents whose
+// IDs don't start with a namespace name and the separator are in no
+// namespace.
+const NamespaceSeparator = "::"
+
+// maxNamespaceLength bounds namespace names, which prefix every ID in them
+const maxNamespaceLength = 64
+
+// NamespaceQuota bounds what a namespace may hold; zero fields are
+// unlimited
+type NamespaceQuota struct {
+	MaxDocuments int   `json:"max_documents,omitempty"`
+	MaxBytes     int64 `json:"max_bytes,omitempty"` // Of titles, content and metadata
+}
+
+// NamespaceStats reports what a namespace holds
+type NamespaceStats struct {
+	Name      string         `json:"name"`
+	Documents int            `json:"documents"`
+	Bytes     int64          `json:"bytes"`
+	Quota     NamespaceQuota `json:"quota"`
+}
+
+// namespaceUsage is what a namespace holds in one shard
+type namespaceUsage struct {
+	ids   map[string]bool
+	bytes int64
+}
+
+// checkNamespace rejects names that could be confused with part of an ID
+func checkNamespace(name string) error {
+	if name == "" || len(name) > maxNamespaceLength {
+		return fmt.Errorf("namespace names must have 1 to %d characters", maxNamespaceLength)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("namespace %q may only hold lower case letters, digits, - and _", name)
+		}
+	}
+	return nil
+}
+
+// namespaceOf returns the namespace of a document ID, or "" if it is in
+// none
+func namespaceOf(id string) string {
+	name, _, ok := strings.Cut(id, NamespaceSeparator)
+	if !ok || checkNamespace(name) != nil {
+		return ""
+	}
+	return name
+}
+
+// sameNamespace reports whether two documents are in the same namespace,
+// or both in none
+func sameNamespace(a, b string) bool {
+	return namespaceOf(a) == namespaceOf(b)
+}
+
+// quotaSize is what a document counts towards its namespace's MaxBytes
+func quotaSize(doc *Document) int64 {
+	size := len(doc.Title) + len(doc.Content)
+	for key, value := range doc.Metadata {
+		size += len(key) + len(value)
+	}
+	return int64(size)
+}
+
+// accountLocked adds a document to, or with remove takes it from, the usage
+// of its namespace in s; callers hold the shard's lock
+func (s *shard) accountLocked(doc *Document, remove bool) {
+	name := namespaceOf(doc.ID)
+	if name == "" {
+		return
+	}
+	usage, exists := s.namespaces[name]
+	if !exists {
+		if remove {
+			return
+		}
+		usage = &namespaceUsage{ids: make(map[string]bool)}
+		s.namespaces[name] = usage
+	}
+	if remove {
+		delete(usage.ids, doc.ID)
+		usage.bytes -= quotaSize(doc)
+		if len(usage.ids) == 0 {
+			delete(s.namespaces, name)
+		}
+		return
+	}
+	usage.ids[doc.ID] = true
+	usage.bytes += quotaSize(doc)
+}
+
+// SetNamespaceQuota bounds what a namespace may hold from now on; a zero
+// quota removes the bound. Documents already stored stay, but writes
+// through the Namespace that would exceed it fail with ErrQuotaExceeded.
+func (db *DocumentDB) SetNamespaceQuota(name string, quota NamespaceQuota) error {
+	if err := checkNamespace(name); err != nil {
+		return err
+	}
+	if quota.MaxDocuments < 0 || quota.MaxBytes < 0 {
+		return errors.New("quotas must not be negative")
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if quota == (NamespaceQuota{}) {
+		delete(db.quotas, name)
+	} else {
+		db.quotas[name] = quota
+	}
+	return nil
+}
+
+func (db *DocumentDB) namespaceQuota(name string) NamespaceQuota {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.quotas[name]
+}
+
+// Namespaces reports every namespace holding documents or having a quota,
+// by name
+func (db *DocumentDB) Namespaces() []NamespaceStats {
+	stats := make(map[string]*NamespaceStats)
+	for _, s := range db.shards {
+		s.mutex.RLock()
+		for name, usage := range s.namespaces {
+			st, exists := stats[name]
+			if !exists {
+				st = &NamespaceStats{Name: name}
+				stats[name] = st
+			}
+			st.Documents += len(usage.ids)
+			st.Bytes += usage.bytes
+		}
+		s.mutex.RUnlock()
+	}
+	db.mutex.RLock()
+	for name, quota := range db.quotas {
+		if _, exists := stats[name]; !exists {
+			stats[name] = &NamespaceStats{Name: name}
+		}
+		stats[name].Quota = quota
+	}
+	db.mutex.RUnlock()
+	list := make([]NamespaceStats, 0, len(stats))
+	for _, st := range stats {
+		list = append(list, *st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Namespace is one tenant's view of the database. Its documents are stored
+// with IDs prefixed by the namespace name and NamespaceSeparator, which it
+// adds and strips, so tenants use their own IDs without clashing. Searches
+// and listings see only the namespace's documents, and its query results
+// are cached apart from other namespaces'. Dedup only compares documents
+// within a namespace.
+//
+// Relevance scores use term statistics across the whole database, and
+// searches don't suggest spelling corrections, since the dictionary spans
+// every namespace.
+type Namespace struct {
+	db     *DocumentDB
+	name   string
+	prefix string
+}
+
+// Namespace returns the view of one namespace, which exists as long as it
+// holds documents
+func (db *DocumentDB) Namespace(name string) (*Namespace, error) {
+	if err := checkNamespace(name); err != nil {
+		return nil, err
+	}
+	return &Namespace{db: db, name: name, prefix: name + NamespaceSeparator}, nil
+}
+
+// Name returns the namespace's name
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+// StoredID returns the ID a document of the namespace is stored under
+func (n *Namespace) StoredID(id string) string {
+	return n.prefix + id
+}
+
+// Stats reports what the namespace holds and its quota
+func (n *Namespace) Stats() NamespaceStats {
+	docs, bytes := n.usage()
+	return NamespaceStats{Name: n.name, Documents: docs, Bytes: bytes, Quota: n.db.namespaceQuota(n.name)}
+}
+
+func (n *Namespace) usage() (int, int64) {
+	docs, bytes := 0, int64(0)
+	for _, s := range n.db.shards {
+		s.mutex.RLock()
+		if usage, exists := s.namespaces[n.name]; exists {
+			docs += len(usage.ids)
+			bytes += usage.bytes
+		}
+		s.mutex.RUnlock()
+	}
+	return docs, bytes
+}
+
+// stored returns a copy of a tenant's document as it is stored, with its
+// ID and links prefixed
+func (n *Namespace) stored(doc *Document) *Document {
+	c := copyDocument(doc)
+	c.ID = n.prefix + doc.ID
+	for i, link := range c.Links {
+		c.Links[i] = n.prefix + link
+	}
+	return c
+}
+
+// local returns a copy of a stored document as the tenant sees it, without
+// the prefix. Links out of the namespace are dropped.
+func (n *Namespace) local(doc *Document) *Document {
+	c := *doc
+	c.ID = strings.TrimPrefix(doc.ID, n.prefix)
+	c.DuplicateOf = strings.TrimPrefix(doc.DuplicateOf, n.prefix)
+	c.Links = nil
+	for _, link := range doc.Links {
+		if id := strings.TrimPrefix(link, n.prefix); id != link {
+			c.Links = append(c.Links, id)
+		}
+	}
+	return &c
+}
+
+// admit holds the quota lock if the namespace has a quota, returning the
+// quota and the function releasing the lock
+func (n *Namespace) admit() (NamespaceQuota, func()) {
+	quota := n.db.namespaceQuota(n.name)
+	if quota == (NamespaceQuota{}) {
+		return quota, func() {}
+	}
+	n.db.metering.Lock()
+	return quota, n.db.metering.Unlock
+}
+
+// checkQuota fails if adding docs documents and bytes bytes to the
+// namespace's usage would exceed quota
+func (n *Namespace) checkQuota(quota NamespaceQuota, usedDocs int, usedBytes int64, docs int, bytes int64) error {
+	if quota.MaxDocuments > 0 && docs > 0 && usedDocs+docs > quota.MaxDocuments {
+		return fmt.Errorf("%w: %s holds %d of %d documents", ErrQuotaExceeded, n.name, usedDocs, quota.MaxDocuments)
+	}
+	if quota.MaxBytes > 0 && bytes > 0 && usedBytes+bytes > quota.MaxBytes {
+		return fmt.Errorf("%w: %s holds %d of %d bytes", ErrQuotaExceeded, n.name, usedBytes, quota.MaxBytes)
+	}
+	return nil
+}
+
+// AddDocument is DocumentDB.AddDocument within the namespace, failing with
+// ErrQuotaExceeded if the namespace is full. The document's ID is its ID
+// in the namespace; the times and version it is stored with are set on it.
+func (n *Namespace) AddDocument(doc *Document) error {
+	quota, release := n.admit()
+	defer release()
+	stored := n.stored(doc)
+	docs, bytes := n.usage()
+	if err := n.checkQuota(quota, docs, bytes, 1, quotaSize(stored)); err != nil {
+		return err
+	}
+	if err := n.db.AddDocument(stored); err != nil {
+		return err
+	}
+	doc.CreatedAt, doc.UpdatedAt, doc.Version = stored.CreatedAt, stored.UpdatedAt, stored.Version
+	return nil
+}
+
+// GetDocument retrieves a document of the namespace by its ID there
+func (n *Namespace) GetDocument(id string) (*Document, error) {
+	doc, err := n.db.GetDocument(n.prefix + id)
+	if err != nil {
+		return nil, err
+	}
+	return n.local(doc), nil
+}
+
+// UpdateDocument replaces the content of a document of the namespace,
+// failing with ErrQuotaExceeded if the namespace can't hold the new content
+func (n *Namespace) UpdateDocument(id string, newContent string) error {
+	quota, release := n.admit()
+	defer release()
+	if quota.MaxBytes > 0 {
+		doc, err := n.db.GetDocument(n.prefix + id)
+		if err != nil {
+			return err
+		}
+		_, bytes := n.usage()
+		if err := n.checkQuota(quota, 0, bytes, 0, int64(len(newContent)-len(doc.Content))); err != nil {
+			return err
+		}
+	}
+	return n.db.UpdateDocument(n.prefix+id, newContent)
+}
+
+// PatchDocument is DocumentDB.PatchDocument within the namespace. Patches
+// may grow documents past the namespace's MaxBytes, which then turns away
+// further growth.
+func (n *Namespace) PatchDocument(id string, patch []byte) error {
+	return n.db.PatchDocument(n.prefix+id, patch)
+}
+
+// DeleteDocument is DocumentDB.DeleteDocument within the namespace
+func (n *Namespace) DeleteDocument(id string) error {
+	return n.db.DeleteDocument(n.prefix + id)
+}
+
+// Bulk is DocumentDB.Bulk within the namespace. Documents that would take
+// the namespace past its quota fail with ErrQuotaExceeded without stopping
+// the rest; documents replacing others count only the bytes they add.
+func (n *Namespace) Bulk(docs []*Document, options BulkOptions) BulkReport {
+	quota, release := n.admit()
+	defer release()
+	usedDocs, usedBytes := n.usage()
+	report := BulkReport{Items: make([]BulkItem, len(docs))}
+	var admitted []*Document
+	var positions []int
+	counted := make(map[string]int64) // Sizes of the documents already admitted, by ID
+	for i, doc := range docs {
+		if doc == nil {
+			admitted, positions = append(admitted, nil), append(positions, i)
+			continue
+		}
+		stored := n.stored(doc)
+		size, exists := counted[stored.ID]
+		if !exists {
+			if old, err := n.db.GetDocument(stored.ID); err == nil {
+				size, exists = quotaSize(old), true
+			}
+		}
+		addDocs, addBytes := 1, quotaSize(stored)
+		switch {
+		case exists && options.Upsert:
+			addDocs, addBytes = 0, addBytes-size
+		case exists:
+			addDocs, addBytes = 0, 0 // It fails as already stored
+		}
+		if err := n.checkQuota(quota, usedDocs, usedBytes, addDocs, addBytes); err != nil {
+			report.Items[i] = BulkItem{Index: i, ID: doc.ID, Status: BulkFailed, Error: err.Error()}
+			continue
+		}
+		if !exists || options.Upsert {
+			counted[stored.ID] = quotaSize(stored)
+		}
+		usedDocs, usedBytes = usedDocs+addDocs, usedBytes+addBytes
+		admitted, positions = append(admitted, stored), append(positions, i)
+	}
+
+	written := n.db.Bulk(admitted, options)
+	for j, item := range written.Items {
+		i := positions[j]
+		item.Index = i
+		item.ID = strings.TrimPrefix(item.ID, n.prefix)
+		item.DuplicateOf = strings.TrimPrefix(item.DuplicateOf, n.prefix)
+		report.Items[i] = item
+		if item.Status != BulkFailed {
+			docs[i].CreatedAt, docs[i].UpdatedAt, docs[i].Version = admitted[j].CreatedAt, admitted[j].UpdatedAt, admitted[j].Version
+		}
+	}
+	for _, id := range written.Replaced {
+		report.Replaced = append(report.Replaced, strings.TrimPrefix(id, n.prefix))
+	}
+	for _, item := range report.Items {
+		switch item.Status {
+		case BulkCreated:
+			report.Created++
+		case BulkUpdated:
+			report.Updated++
+		default:
+			report.Failed++
+		}
+	}
+	return report
+}
+
+// ListDocumentsPage returns one page of the namespace's documents
+func (n *Namespace) ListDocumentsPage(options SearchOptions) (Page, error) {
+	if options.SortBy == "" {
+		options.SortBy = SortByCreatedAt
+	}
+	var results []SearchResult
+	for _, s := range n.db.shards {
+		s.mutex.RLock()
+		if usage, exists := s.namespaces[n.name]; exists {
+			for id := range usage.ids {
+				results = append(results, SearchResult{Document: s.documents[id]})
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	page, err := paginate(results, options)
+	n.localize(&page)
+	return page, err
+}
+
+// SearchPage runs a query in the query language over the namespace's
+// documents and returns one page of the matches
+func (n *Namespace) SearchPage(query string, options SearchOptions) (Page, error) {
+	return n.SearchPageContext(context.Background(), query, options)
+}
+
+// SearchPageContext is SearchPage, stopping early like
+// DocumentDB.SearchPageContext
+func (n *Namespace) SearchPageContext(ctx context.Context, query string, options SearchOptions) (Page, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return Page{}, err
+	}
+	page, err := n.db.searchPage(ctx, n.scope(q), options)
+	n.localize(&page)
+	return page, err
+}
+
+// scope limits a query to the namespace
+func (n *Namespace) scope(q *Query) *Query {
+	return &Query{root: &namespaceNode{name: n.name, child: q.root}}
+}
+
+// localize replaces the stored documents of a page with the tenant's view
+// of them
+func (n *Namespace) localize(page *Page) {
+	for i, result := range page.Results {
+		page.Results[i].Document = n.local(result.Document)
+	}
+}
+
+// namespaceNode limits its child's matches to the documents of one
+// namespace. Its name is part of the plan, so the query result cache keeps
+// namespaces apart.
+type namespaceNode struct {
+	name  string
+	child planNode
+}
+
+func (n *namespaceNode) execute(ex *execution) map[string]bool {
+	usage := ex.shard.namespaces[n.name]
+	if usage == nil {
+		return map[string]bool{}
+	}
+	ids := n.child.execute(ex)
+	for id := range ids {
+		if !usage.ids[id] {
+			delete(ids, id)
+		}
+	}
+	return ids
+}
+
+func (n *namespaceNode) cost(s *shard) int {
+	usage := s.namespaces[n.name]
+	if usage == nil {
+		return 0
+	}
+	if c := n.child.cost(s); c < len(usage.ids) {
+		return c
+	}
+	return len(usage.ids)
+}
+
+func (n *namespaceNode) bind(analyzer *Analyzer) planNode {
+	child := n.child.bind(analyzer)
+	if child == nil {
+		return nil
+	}
+	return &namespaceNode{name: n.name, child: child}
+}
+
+func (n *namespaceNode) String() string {
+	return "(namespace:" + n.name + " AND " + n.child.String() + ")"
+}
@@ -0,0 +1,255 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PageRankKey is the metadata key RunPageRank stores scores under unless
+// told otherwise
+const PageRankKey = "pagerank"
+
+// PageRankOptions tunes the link-analysis computation. A zero Damping,
+// MaxIterations or Tolerance takes its value from DefaultPageRankOptions.
+type PageRankOptions struct {
+	// Damping is the chance a random surfer follows a link rather than
+	// jumping elsewhere
+	Damping       float64
+	MaxIterations int
+	// Tolerance stops the iteration once scores move less than this in
+	// total, as a fraction of the whole
+	Tolerance float64
+	// Teleport weighs where the surfer jumps to, for personalized or
+	// trust-seeded rankings; documents left out are never jumped to. Empty
+	// means every document equally, which is plain PageRank.
+	Teleport map[string]float64
+	// MetadataKey is where RunPageRank stores scores; empty means
+	// PageRankKey
+	MetadataKey string
+}
+
+// DefaultPageRankOptions are the classic PageRank settings
+var DefaultPageRankOptions = PageRankOptions{
+	Damping:       0.85,
+	MaxIterations: 100,
+	Tolerance:     1e-6,
+	MetadataKey:   PageRankKey,
+}
+
+// PageRankResult is the outcome of a link-analysis run. Scores are scaled
+// so they average 1 over the stored documents: above 1 is better linked
+// than average.
+type PageRankResult struct {
+	Scores     map[string]float64 `json:"-"`
+	Documents  int                `json:"documents"`
+	Links      int                `json:"links"` // Links between stored documents, the only ones counted
+	Iterations int                `json:"iterations"`
+	Converged  bool               `json:"converged"`
+	Delta      float64            `json:"delta"`   // Change in the last iteration
+	Updated    int                `json:"updated"` // Documents whose stored score changed
+	Took       time.Duration      `json:"took"`
+}
+
+// ComputePageRank runs PageRank over the link graph of the stored
+// documents without storing anything. Links to documents that aren't
+// stored are ignored, and the rank of documents without links is spread
+// as the teleport vector says.
+func (db *DocumentDB) ComputePageRank(options PageRankOptions) (PageRankResult, error) {
+	start := time.Now()
+	options = pageRankDefaults(options)
+	if options.Damping < 0 || options.Damping >= 1 {
+		return PageRankResult{}, errors.New("damping must be between 0 and 1")
+	}
+
+	// Number the documents, so the iteration works on slices
+	docs := db.snapshot()
+	sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+	n := len(docs)
+	result := PageRankResult{Scores: make(map[string]float64, n), Documents: n}
+	if n == 0 {
+		result.Converged = true
+		result.Took = time.Since(start)
+		return result, nil
+	}
+	index := make(map[string]int, n)
+	for i, doc := range docs {
+		index[doc.ID] = i
+	}
+	outlinks := make([][]int, n)
+	for i, doc := range docs {
+		for _, target := range doc.Links {
+			if j, ok := index[target]; ok && j != i {
+				outlinks[i] = append(outlinks[i], j)
+			}
+		}
+		result.Links += len(outlinks[i])
+	}
+	teleport, err := teleportVector(options.Teleport, index)
+	if err != nil {
+		return PageRankResult{}, err
+	}
+
+	rank := make([]float64, n)
+	copy(rank, teleport)
+	next := make([]float64, n)
+	for result.Iterations < options.MaxIterations {
+		result.Iterations++
+		dangling := 0.0
+		for i := range next {
+			next[i] = 0
+		}
+		for i, targets := range outlinks {
+			if len(targets) == 0 {
+				dangling += rank[i]
+				continue
+			}
+			share := rank[i] / float64(len(targets))
+			for _, j := range targets {
+				next[j] += share
+			}
+		}
+		// Rank that can't follow a link jumps, as does the undamped part
+		jump := 1 - options.Damping + options.Damping*dangling
+		delta := 0.0
+		for i := range next {
+			next[i] = options.Damping*next[i] + jump*teleport[i]
+			delta += math.Abs(next[i] - rank[i])
+		}
+		rank, next = next, rank
+		result.Delta = delta
+		if delta < options.Tolerance {
+			result.Converged = true
+			break
+		}
+	}
+
+	for i, doc := range docs {
+		result.Scores[doc.ID] = rank[i] * float64(n)
+	}
+	result.Took = time.Since(start)
+	return result, nil
+}
+
+// RunPageRank computes PageRank and stores each document's score in its
+// metadata, where MetadataBoosts in ScoringConfig can weigh it into
+// relevance. Only documents whose score changed get a new version, one
+// batch per shard. Documents added during the run are scored by the next.
+func (db *DocumentDB) RunPageRank(options PageRankOptions) (PageRankResult, error) {
+	options = pageRankDefaults(options)
+	result, err := db.ComputePageRank(options)
+	if err != nil {
+		return result, err
+	}
+	start := time.Now()
+	for _, s := range db.shards {
+		updated, err := db.storeScores(s, options.MetadataKey, result.Scores)
+		result.Updated += updated
+		if err != nil {
+			return result, fmt.Errorf("failed to store link scores: %w", err)
+		}
+	}
+	result.Took += time.Since(start)
+	logger.Info("PageRank computed", "documents", result.Documents, "links", result.Links,
+		"iterations", result.Iterations, "converged", result.Converged, "took", result.Took)
+	return result, nil
+}
+
+// storeScores writes the changed scores of one shard's documents as one
+// batch
+func (db *DocumentDB) storeScores(s *shard, key string, scores map[string]float64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	schema := db.currentSchema()
+	var batch Batch
+	var replaced []*Document
+	now := time.Now()
+	for id, doc := range s.documents {
+		score, ok := scores[id]
+		if !ok {
+			continue
+		}
+		value := formatScore(score)
+		if current, ok := doc.Metadata[key]; ok && current == value {
+			continue
+		}
+		updated := copyDocument(doc)
+		if updated.Metadata == nil {
+			updated.Metadata = make(map[string]string)
+		}
+		updated.Metadata[key] = value
+		updated.Version = doc.Version + 1
+		updated.UpdatedAt = now
+		if err := schema.validate(updated); err != nil {
+			return 0, fmt.Errorf("%s: %w", id, err)
+		}
+		batch.Puts = append(batch.Puts, updated)
+		replaced = append(replaced, doc)
+	}
+	if len(batch.Puts) == 0 {
+		return 0, nil
+	}
+	if err := db.engine.Write(batch); err != nil {
+		return 0, err
+	}
+	for i, updated := range batch.Puts {
+		db.keepVersionLocked(s, replaced[i])
+		db.putLocked(s, updated)
+	}
+	return len(batch.Puts), nil
+}
+
+// formatScore rounds a score to 6 significant digits, so runs that barely
+// move it don't rewrite the document
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', 6, 64)
+}
+
+func pageRankDefaults(options PageRankOptions) PageRankOptions {
+	if options.Damping == 0 {
+		options.Damping = DefaultPageRankOptions.Damping
+	}
+	if options.MaxIterations <= 0 {
+		options.MaxIterations = DefaultPageRankOptions.MaxIterations
+	}
+	if options.Tolerance <= 0 {
+		options.Tolerance = DefaultPageRankOptions.Tolerance
+	}
+	if options.MetadataKey == "" {
+		options.MetadataKey = DefaultPageRankOptions.MetadataKey
+	}
+	return options
+}
+
+// teleportVector turns teleport weights into a distribution over the
+// numbered documents, uniform if there are none
+func teleportVector(weights map[string]float64, index map[string]int) ([]float64, error) {
+	vector := make([]float64, len(index))
+	if len(weights) == 0 {
+		for i := range vector {
+			vector[i] = 1 / float64(len(vector))
+		}
+		return vector, nil
+	}
+	total := 0.0
+	for id, weight := range weights {
+		if weight < 0 {
+			return nil, fmt.Errorf("negative teleport weight for %s", id)
+		}
+		if i, ok := index[id]; ok {
+			vector[i] = weight
+			total += weight
+		}
+	}
+	if total == 0 {
+		return nil, errors.New("no stored document has a teleport weight")
+	}
+	for i := range vector {
+		vector[i] /= total
+	}
+	return vector, nil
+}
@@ -0,0 +1,303 @@
+package documentstore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SortField orders pages of documents
+type SortField string
+
+const (
+	SortByCreatedAt SortField = "created_at" // Oldest first
+	SortByUpdatedAt SortField = "updated_at" // Least recently updated first
+	SortByRelevance SortField = "relevance"  // Best scoring first
+	// SortByDistance puts the locations nearest SearchOptions.Origin first,
+	// and documents without a location last
+	SortByDistance SortField = "distance"
+)
+
+// SearchOptions selects one page of a listing or search. Ties in the sort
+// order are broken by document ID, so the order is stable and pages neither
+// skip nor repeat documents.
+type SearchOptions struct {
+	Limit  int // Documents per page; 0 returns the rest
+	Offset int // Documents to skip; ignored when Cursor is set
+	// Cursor continues after the page that returned it, even if documents
+	// were added or removed meanwhile
+	Cursor  string
+	SortBy  SortField // Defaults to created_at for listings, relevance for searches
+	Reverse bool      // Newest or worst scoring first
+	// Origin is the point SortByDistance measures from, to the locations
+	// in GeoField, a metadata.<key> field of TypeGeo values
+	Origin   GeoPoint
+	GeoField string
+	// Fields, if set, limits the documents returned to these fields, named
+	// as export columns; see GetDocumentFields
+	Fields []string
+	// Facets aggregates every match alongside the page, for filter UIs
+	Facets []FacetRequest
+	// SuggestBelow makes searches matching fewer documents suggest a
+	// corrected query; 0 means DefaultSuggestBelow and negative never
+	SuggestBelow int
+	// Freshness, if set, lifts recently crawled matches of a search before
+	// they are sorted
+	Freshness *FreshnessBoost
+	// Timeout, if set, bounds how long a search looks for matches; see
+	// SearchPageContext
+	Timeout time.Duration
+	// RerankTopN, if set, re-ranks fewer of the best matches than the
+	// reranker's TopN, such as to shed load; a negative value re-ranks none
+	RerankTopN int
+	// CacheOnly answers a search from the query result cache alone; a
+	// search the cache doesn't hold gets an empty page with Uncached set
+	CacheOnly bool
+}
+
+// Page is one page of results
+type Page struct {
+	Results    []SearchResult `json:"results"`
+	Total      int            `json:"total"`                 // Matches across all pages
+	NextCursor string         `json:"next_cursor,omitempty"` // Empty on the last page
+	// Facets answers SearchOptions.Facets by name
+	Facets map[string]Facet `json:"facets,omitempty"`
+	// Suggestion is a corrected query matching more documents, for a
+	// search that matched few
+	Suggestion string `json:"suggestion,omitempty"`
+	// TimedOut is set when a search ran out of time, so the page holds
+	// only the matches found by then and Total counts only those
+	TimedOut bool `json:"timed_out,omitempty"`
+	// Uncached is set when a CacheOnly search wasn't in the query result
+	// cache, so the page holds no matches
+	Uncached bool `json:"uncached,omitempty"`
+}
+
+// pageCursor is the sort key of the last result on a page, encoded opaquely
+// for API consumers
+type pageCursor struct {
+	SortBy  SortField `json:"sort"`
+	Reverse bool      `json:"reverse,omitempty"`
+	Score   float64   `json:"score,omitempty"`
+	Time    time.Time `json:"time,omitempty"`
+	// Location is the last result's location when sorting by distance
+	Location string `json:"location,omitempty"`
+	ID       string `json:"id"`
+}
+
+// ListDocumentsPage returns one page of all documents
+func (db *DocumentDB) ListDocumentsPage(options SearchOptions) (Page, error) {
+	if options.SortBy == "" {
+		options.SortBy = SortByCreatedAt
+	}
+	docs := db.snapshot()
+	results := make([]SearchResult, 0, len(docs))
+	for _, doc := range docs {
+		results = append(results, SearchResult{Document: doc})
+	}
+	return paginate(results, options)
+}
+
+// SearchPage runs a query in the query language and returns one page of
+// the matches
+func (db *DocumentDB) SearchPage(query string, options SearchOptions) (Page, error) {
+	return db.SearchPageContext(context.Background(), query, options)
+}
+
+// searchPage runs a parsed query and returns one page of the matches
+func (db *DocumentDB) searchPage(ctx context.Context, q *Query, options SearchOptions) (Page, error) {
+	if options.SortBy == "" {
+		options.SortBy = SortByRelevance
+	}
+	if options.Timeout < 0 {
+		return Page{}, errors.New("timeout must not be negative")
+	}
+	if options.Freshness != nil {
+		if err := options.Freshness.check(); err != nil {
+			return Page{}, err
+		}
+	}
+	ctx, cancel := withTimeout(ctx, options.Timeout)
+	defer cancel()
+	var results []SearchResult
+	var timedOut, uncached bool
+	if options.CacheOnly {
+		var cached bool
+		results, cached = db.cachedResults(q)
+		uncached = !cached
+	} else {
+		results, timedOut = db.ExecuteContext(ctx, q)
+	}
+	if options.Freshness != nil {
+		options.Freshness.apply(results, time.Now())
+	}
+	if options.SortBy == SortByRelevance && !timedOut {
+		db.rerankResults(q, results, options.RerankTopN)
+	}
+	page, err := paginate(results, options)
+	page.TimedOut = timedOut
+	page.Uncached = uncached
+	return page, err
+}
+
+// paginate sorts results and cuts out the page options select
+func paginate(results []SearchResult, options SearchOptions) (Page, error) {
+	if options.Limit < 0 || options.Offset < 0 {
+		return Page{}, errors.New("limit and offset must not be negative")
+	}
+	less, err := options.less()
+	if err != nil {
+		return Page{}, err
+	}
+	p, err := compileProjection(options.Fields)
+	if err != nil {
+		return Page{}, err
+	}
+	facets, err := computeFacets(results, options.Facets)
+	if err != nil {
+		return Page{}, err
+	}
+	sort.Slice(results, func(i, j int) bool { return less(results[i], results[j]) })
+
+	start := options.Offset
+	if options.Cursor != "" {
+		last, err := decodeCursor(options.Cursor, options)
+		if err != nil {
+			return Page{}, err
+		}
+		start = sort.Search(len(results), func(i int) bool { return less(last, results[i]) })
+	}
+	if start > len(results) {
+		start = len(results)
+	}
+	end := len(results)
+	if options.Limit > 0 && start+options.Limit < end {
+		end = start + options.Limit
+	}
+
+	page := Page{Results: results[start:end], Total: len(results), Facets: facets}
+	if end < len(results) {
+		page.NextCursor = encodeCursor(results[end-1], options)
+	}
+	for i := range page.Results {
+		page.Results[i].Document = p.apply(page.Results[i].Document)
+	}
+	return page, nil
+}
+
+// less returns the order options sort results in
+func (o SearchOptions) less() (func(a, b SearchResult) bool, error) {
+	var compare func(a, b SearchResult) int
+	switch o.SortBy {
+	case SortByCreatedAt:
+		compare = func(a, b SearchResult) int { return compareTimes(a.Document.CreatedAt, b.Document.CreatedAt) }
+	case SortByUpdatedAt:
+		compare = func(a, b SearchResult) int { return compareTimes(a.Document.UpdatedAt, b.Document.UpdatedAt) }
+	case SortByRelevance:
+		compare = func(a, b SearchResult) int {
+			switch {
+			case a.Score > b.Score:
+				return -1
+			case a.Score < b.Score:
+				return 1
+			}
+			return 0
+		}
+	case SortByDistance:
+		key, err := o.geoKey()
+		if err != nil {
+			return nil, err
+		}
+		distance := func(doc *Document) float64 {
+			if p, ok := documentLocation(doc, key); ok {
+				return o.Origin.Distance(p)
+			}
+			return math.Inf(1)
+		}
+		compare = func(a, b SearchResult) int {
+			x, y := distance(a.Document), distance(b.Document)
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	default:
+		return nil, fmt.Errorf("cannot sort by %q", o.SortBy)
+	}
+	return func(a, b SearchResult) bool {
+		c := compare(a, b)
+		if c == 0 {
+			c = strings.Compare(a.Document.ID, b.Document.ID)
+		}
+		if o.Reverse {
+			return c > 0
+		}
+		return c < 0
+	}, nil
+}
+
+// geoKey returns the metadata key GeoField names
+func (o SearchOptions) geoKey() (string, error) {
+	key := strings.TrimPrefix(o.GeoField, metadataColumn)
+	if key == o.GeoField || key == "" {
+		return "", fmt.Errorf("sorting by distance needs a metadata.<key> location field, not %q", o.GeoField)
+	}
+	return key, nil
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func encodeCursor(last SearchResult, options SearchOptions) string {
+	cursor := pageCursor{SortBy: options.SortBy, Reverse: options.Reverse, ID: last.Document.ID}
+	switch options.SortBy {
+	case SortByCreatedAt:
+		cursor.Time = last.Document.CreatedAt
+	case SortByUpdatedAt:
+		cursor.Time = last.Document.UpdatedAt
+	case SortByRelevance:
+		cursor.Score = last.Score
+	case SortByDistance:
+		key, _ := options.geoKey()
+		cursor.Location = last.Document.Metadata[key]
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns a stand-in for the last result of the previous page,
+// carrying just its sort key
+func decodeCursor(encoded string, options SearchOptions) (SearchResult, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return SearchResult{}, errors.New("malformed cursor")
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return SearchResult{}, errors.New("malformed cursor")
+	}
+	if cursor.SortBy != options.SortBy || cursor.Reverse != options.Reverse {
+		return SearchResult{}, errors.New("cursor belongs to a different sort order")
+	}
+	doc := &Document{ID: cursor.ID, CreatedAt: cursor.Time, UpdatedAt: cursor.Time}
+	if key, err := options.geoKey(); err == nil && cursor.Location != "" {
+		doc.Metadata = map[string]string{key: cursor.Location}
+	}
+	return SearchResult{Document: doc, Score: cursor.Score}, nil
+}
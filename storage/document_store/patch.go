@@ -0,0 +1,154 @@
+package documentstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// PatchDocument applies a JSON merge patch (RFC 7386) to a document, so
+// callers can change some fields without sending the whole document. The
+// patch is an object that may set
+//
+//	"title", "content"  to a string, or to null to clear them
+//	"expires_at"        to an RFC 3339 time, or to null to never expire
+//	"metadata"          to an object whose keys are set to strings or
+//	                    removed with null, or to null to remove every key
+//	"links"             to an array of the IDs linked to, or to null to
+//	                    remove every link
+//	"vector"            to an array of numbers, or to null to remove it
+//
+// Fields the patch leaves out are untouched. A patch that changes nothing
+// doesn't bump the version or UpdatedAt.
+func (db *DocumentDB) PatchDocument(id string, patch []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return fmt.Errorf("patch must be a JSON object: %w", err)
+	}
+
+	s := db.shardFor(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	doc, exists := s.documents[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	updated := copyDocument(doc)
+	for field, value := range fields {
+		var err error
+		switch field {
+		case "title":
+			err = mergeString(field, &updated.Title, value)
+		case "content":
+			err = mergeString(field, &updated.Content, value)
+		case "metadata":
+			err = mergeMetadata(updated, value)
+		case "expires_at":
+			err = mergeTime(field, &updated.ExpiresAt, value)
+		case "links":
+			err = mergeLinks(updated, value)
+		case "vector":
+			err = mergeVector(updated, value)
+		case "id", "created_at", "updated_at", "version":
+			err = fmt.Errorf("%s cannot be patched", field)
+		default:
+			err = fmt.Errorf("unknown field %q", field)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !changed(doc, updated) {
+		return nil
+	}
+	return db.commitUpdateLocked(s, doc, updated)
+}
+
+func mergeString(name string, field *string, value json.RawMessage) error {
+	if isNull(value) {
+		*field = ""
+		return nil
+	}
+	if err := json.Unmarshal(value, field); err != nil {
+		return fmt.Errorf("%s must be a string or null", name)
+	}
+	return nil
+}
+
+func mergeTime(name string, field *time.Time, value json.RawMessage) error {
+	if isNull(value) {
+		*field = time.Time{}
+		return nil
+	}
+	if err := json.Unmarshal(value, field); err != nil {
+		return fmt.Errorf("%s must be an RFC 3339 time or null", name)
+	}
+	return nil
+}
+
+func mergeMetadata(doc *Document, value json.RawMessage) error {
+	if isNull(value) {
+		doc.Metadata = nil
+		return nil
+	}
+	var patch map[string]*string
+	if err := json.Unmarshal(value, &patch); err != nil {
+		return fmt.Errorf("metadata patch must map keys to strings or null: %w", err)
+	}
+	for key, v := range patch {
+		if v == nil {
+			delete(doc.Metadata, key)
+			continue
+		}
+		if doc.Metadata == nil {
+			doc.Metadata = make(map[string]string)
+		}
+		doc.Metadata[key] = *v
+	}
+	return nil
+}
+
+func mergeLinks(doc *Document, value json.RawMessage) error {
+	if isNull(value) {
+		doc.Links = nil
+		return nil
+	}
+	var links []string
+	if err := json.Unmarshal(value, &links); err != nil {
+		return fmt.Errorf("links must be an array of IDs or null: %w", err)
+	}
+	doc.Links = normalizeLinks(links)
+	return nil
+}
+
+func mergeVector(doc *Document, value json.RawMessage) error {
+	if isNull(value) {
+		doc.Vector = nil
+		return nil
+	}
+	if err := json.Unmarshal(value, &doc.Vector); err != nil {
+		return fmt.Errorf("vector must be an array of numbers or null: %w", err)
+	}
+	return nil
+}
+
+func isNull(value json.RawMessage) bool {
+	return string(value) == "null"
+}
+
+// changed reports whether a patch altered any field it can touch
+func changed(doc, updated *Document) bool {
+	if doc.Title != updated.Title || doc.Content != updated.Content || !doc.ExpiresAt.Equal(updated.ExpiresAt) ||
+		len(doc.Metadata) != len(updated.Metadata) || !equalLinks(doc.Links, updated.Links) ||
+		!equalVectors(doc.Vector, updated.Vector) {
+		return true
+	}
+	for key, value := range doc.Metadata {
+		if v, ok := updated.Metadata[key]; !ok || v != value {
+			return true
+		}
+	}
+	return false
+}
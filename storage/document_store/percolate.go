@@ -0,0 +1,46 @@
+package documentstore
+
+import (
+	"sort"
+)
+
+// Percolate matches documents against queries, the reverse of a search:
+// it returns, for each query by index, the IDs of the documents it
+// matches, in order. The documents are analyzed and indexed on their own,
+// as the database would index them, so a query matches them as a search
+// would once they are stored; they needn't be stored at all. Statistics
+// across the documents, such as how many hold a term, don't affect
+// matching, so percolating documents one batch at a time gives the same
+// answer as all at once.
+func (db *DocumentDB) Percolate(docs []*Document, queries []*Query) [][]string {
+	analysis := db.currentAnalysis()
+	s := newShard(db.currentSegmentOptions())
+	for _, doc := range docs {
+		if old, exists := s.documents[doc.ID]; exists {
+			// The later version wins, as it would in the store
+			s.accountLocked(old, true)
+			s.text.remove(doc.ID)
+		}
+		s.documents[doc.ID] = doc
+		s.accountLocked(doc, false)
+		s.text.add(doc, analysis.analyzerFor(doc))
+	}
+
+	matches := make([][]string, len(queries))
+	for i, q := range queries {
+		plans := make(map[*Analyzer]planNode)
+		for _, analyzer := range analysis.analyzers() {
+			plans[analyzer] = q.root.bind(analyzer)
+		}
+		ids, _ := analysis.matchEach(s, func(analyzer *Analyzer) ([]string, []string) {
+			root := plans[analyzer]
+			if root == nil {
+				return nil, nil
+			}
+			return sortedIDs(root.execute(&execution{shard: s})), nil
+		})
+		sort.Strings(ids)
+		matches[i] = ids
+	}
+	return matches
+}
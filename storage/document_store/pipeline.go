@@ -0,0 +1,399 @@
+package documentstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// pipelineTracer traces the batches a pipeline applies, an index span each
+// linked to the spans the batch's changes were submitted in
+var pipelineTracer = otel.Tracer("storage/document_store")
+
+// PipelineOptions tunes an IndexPipeline
+type PipelineOptions struct {
+	// BatchSize is how many changes are applied to the database at a time
+	BatchSize int
+	// FlushInterval is how long a change waits for its batch to fill before
+	// the batch is applied anyway, which bounds the indexing lag when
+	// changes trickle in
+	FlushInterval time.Duration
+	// QueueSize is how many changes may be waiting or being applied at
+	// once. Submit blocks while the queue is full, so a crawler can't run
+	// further ahead of the index than this.
+	QueueSize int
+	// Admission, if set, admits the pipeline's writes in the bulk lane, so
+	// they give way to interactive edits
+	Admission *Admission
+}
+
+// DefaultPipelineOptions applies changes in bulk batches at least every
+// second and lets 10000 wait
+var DefaultPipelineOptions = PipelineOptions{BatchSize: DefaultBulkBatchSize, FlushInterval: time.Second, QueueSize: 10000}
+
+// PipelineStats describes the work of an IndexPipeline, for monitoring
+type PipelineStats struct {
+	Queued  int    `json:"queued"` // Changes waiting or being applied
+	Batches uint64 `json:"batches"`
+	Indexed uint64 `json:"indexed"` // Documents added or updated
+	Deleted uint64 `json:"deleted"`
+	// Coalesced counts changes skipped because a later change to the same
+	// document came in the same batch
+	Coalesced uint64 `json:"coalesced"`
+	Failed    uint64 `json:"failed"` // Changes the database rejected
+	LastError string `json:"last_error,omitempty"`
+	// Lag is how long the oldest queued change has waited so far, zero when
+	// the queue is empty
+	Lag time.Duration `json:"lag"`
+	// LastLag is how long the oldest change of the last batch took from
+	// being submitted to being searchable; MaxLag is the longest so far
+	LastLag       time.Duration `json:"last_lag"`
+	MaxLag        time.Duration `json:"max_lag"`
+	LastBatch     time.Time     `json:"last_batch"`
+	LastBatchTook time.Duration `json:"last_batch_took"`
+}
+
+// pipelineChange is a document to store, or the ID of one to delete
+type pipelineChange struct {
+	id       string
+	doc      *Document // Nil for deletes
+	queuedAt time.Time
+	span     trace.SpanContext // Of the submitter, if traced
+}
+
+// IndexPipeline feeds a stream of changes, such as a crawler's output or
+// another database's change feed, into a DocumentDB, which indexes them as
+// it stores them. Changes are queued and applied in batches by a single
+// worker, in the order they were submitted, so a burst of crawled pages
+// costs a few bulk writes rather than one lock and engine write each.
+type IndexPipeline struct {
+	db      *DocumentDB
+	options PipelineOptions
+	slots   chan struct{} // Holds a token per queued change, for backpressure
+	wake    chan struct{} // Signals the worker that changes came in
+	stop    chan struct{} // Closed by Close
+	done    chan struct{} // Closed when the worker has applied everything
+
+	mutex    sync.Mutex // Guards the fields below
+	pending  []pipelineChange
+	inflight time.Time // When the oldest change being applied was queued
+	closed   bool
+	stats    PipelineStats
+}
+
+// NewIndexPipeline starts a pipeline applying changes to db. Zero fields of
+// options take their DefaultPipelineOptions value. Close the pipeline to
+// apply what is queued and stop it.
+func NewIndexPipeline(db *DocumentDB, options PipelineOptions) *IndexPipeline {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultPipelineOptions.BatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultPipelineOptions.FlushInterval
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultPipelineOptions.QueueSize
+	}
+	p := &IndexPipeline{
+		db:      db,
+		options: options,
+		slots:   make(chan struct{}, options.QueueSize),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Submit queues a document to be added, or to replace the stored one with
+// the same ID. It blocks while the queue is full, until ctx is done. The
+// pipeline owns doc from then on, as AddDocument does.
+func (p *IndexPipeline) Submit(ctx context.Context, doc *Document) error {
+	if doc == nil || doc.ID == "" {
+		return fmt.Errorf("%w: document has no ID", ErrInvalidDocument)
+	}
+	return p.enqueue(ctx, pipelineChange{id: doc.ID, doc: doc})
+}
+
+// SubmitDelete queues the deletion of a document. Deleting a document that
+// isn't stored is not an error, so deletes can be replayed.
+func (p *IndexPipeline) SubmitDelete(ctx context.Context, id string) error {
+	return p.enqueue(ctx, pipelineChange{id: id})
+}
+
+func (p *IndexPipeline) enqueue(ctx context.Context, change pipelineChange) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.stop:
+		return ErrPipelineClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		<-p.slots
+		return ErrPipelineClosed
+	}
+	change.queuedAt = time.Now()
+	change.span = trace.SpanContextFromContext(ctx)
+	p.pending = append(p.pending, change)
+	p.mutex.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Consume submits the documents a crawler sends on docs until the channel
+// closes or ctx is done. Documents without an ID are counted as failed and
+// skipped.
+func (p *IndexPipeline) Consume(ctx context.Context, docs <-chan *Document) error {
+	for {
+		select {
+		case doc, ok := <-docs:
+			if !ok {
+				return nil
+			}
+			err := p.Submit(ctx, doc)
+			if errors.Is(err, ErrInvalidDocument) {
+				// A bad page shouldn't stop the crawl
+				p.mutex.Lock()
+				p.stats.Failed++
+				p.stats.LastError = err.Error()
+				p.mutex.Unlock()
+			} else if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Follow submits the changes of source's change feed after sinceSeq, so
+// the pipeline's database keeps a searchable copy of source. It returns the
+// sequence number of the last change submitted when the feed ends: with a
+// nil error when source closes or Follow falls too far behind, in which
+// case call Follow again from there, and with ctx's error when ctx is done.
+func (p *IndexPipeline) Follow(ctx context.Context, source *DocumentDB, sinceSeq uint64) (uint64, error) {
+	events, err := source.Watch(ctx, sinceSeq)
+	if err != nil {
+		return sinceSeq, err
+	}
+	last := sinceSeq
+	for event := range events {
+		if event.Type == EventDelete {
+			err = p.SubmitDelete(ctx, event.ID)
+		} else {
+			// The source's documents are shared, and storing a copy stamps it
+			err = p.Submit(ctx, copyDocument(event.Document))
+		}
+		if err != nil {
+			return last, err
+		}
+		last = event.Seq
+	}
+	return last, ctx.Err()
+}
+
+// Stats returns the pipeline's progress and lag
+func (p *IndexPipeline) Stats() PipelineStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	stats := p.stats
+	stats.Queued = len(p.slots)
+	oldest := p.inflight
+	if oldest.IsZero() && len(p.pending) > 0 {
+		oldest = p.pending[0].queuedAt
+	}
+	if !oldest.IsZero() {
+		stats.Lag = time.Since(oldest)
+	}
+	return stats
+}
+
+// Close stops taking changes, waits for the queued ones to be applied and
+// stops the pipeline. It doesn't close the database.
+func (p *IndexPipeline) Close() {
+	p.mutex.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.stop)
+	}
+	p.mutex.Unlock()
+	<-p.done
+}
+
+// run applies batches of changes until the pipeline is closed and drained.
+// A batch is applied once it is full, once its oldest change has waited the
+// flush interval, or at once when closing.
+func (p *IndexPipeline) run() {
+	defer close(p.done)
+	timer := time.NewTimer(p.options.FlushInterval)
+	defer timer.Stop()
+	for {
+		p.mutex.Lock()
+		queued, closed := len(p.pending), p.closed
+		var wait time.Duration
+		if queued > 0 {
+			wait = p.options.FlushInterval - time.Since(p.pending[0].queuedAt)
+		}
+		if queued >= p.options.BatchSize || queued > 0 && (wait <= 0 || closed) {
+			n := queued
+			if n > p.options.BatchSize {
+				n = p.options.BatchSize
+			}
+			batch := append([]pipelineChange(nil), p.pending[:n]...)
+			p.pending = append(p.pending[:0], p.pending[n:]...)
+			p.inflight = batch[0].queuedAt
+			p.mutex.Unlock()
+			p.apply(batch)
+			continue
+		}
+		p.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		if queued == 0 {
+			select {
+			case <-p.wake:
+			case <-p.stop:
+			}
+			continue
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-p.wake:
+		case <-p.stop:
+		case <-timer.C:
+		}
+	}
+}
+
+// apply writes a batch to the database. Only the last change to each
+// document counts, so the batch comes down to one bulk upsert and the
+// deletes. A batch holds the changes of many traces, so its index span
+// starts a trace of its own, linked to each of them.
+func (p *IndexPipeline) apply(batch []pipelineChange) {
+	start := time.Now()
+	last := make(map[string]int, len(batch))
+	var links []trace.Link
+	linked := make(map[trace.SpanID]bool)
+	for i, change := range batch {
+		last[change.id] = i
+		if change.span.IsValid() && !linked[change.span.SpanID()] {
+			linked[change.span.SpanID()] = true
+			links = append(links, trace.Link{SpanContext: change.span})
+		}
+	}
+	_, span := pipelineTracer.Start(context.Background(), "index", trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("documents.changes", len(batch))))
+	defer span.End()
+	var docs []*Document
+	var deletes []string
+	for i, change := range batch {
+		if last[change.id] != i {
+			continue
+		}
+		if change.doc != nil {
+			docs = append(docs, change.doc)
+		} else {
+			deletes = append(deletes, change.id)
+		}
+	}
+
+	var indexed, deleted, failed uint64
+	var lastErr error
+	if len(docs) > 0 {
+		options := BulkOptions{BatchSize: len(docs), Upsert: true}
+		if admission := p.options.Admission; admission != nil {
+			options.BatchSize = admission.BulkBatchSize()
+			options.Admit = admission.Admitter(context.Background(), LaneBulk)
+		}
+		report := p.db.Bulk(docs, options)
+		indexed = uint64(report.Created + report.Updated)
+		failed = uint64(report.Failed)
+		lastErr = report.Err()
+	}
+	// Deletes are admitted a bulk batch at a time, like the documents
+	size := len(deletes)
+	if p.options.Admission != nil {
+		size = p.options.Admission.BulkBatchSize()
+	}
+	for from := 0; from < len(deletes); from += size {
+		end := from + size
+		if end > len(deletes) {
+			end = len(deletes)
+		}
+		release := func() {}
+		if p.options.Admission != nil {
+			var err error
+			if release, err = p.options.Admission.Admit(context.Background(), LaneBulk, end-from); err != nil {
+				failed += uint64(len(deletes) - from)
+				lastErr = err
+				break
+			}
+		}
+		for _, id := range deletes[from:end] {
+			err := p.db.DeleteDocument(id)
+			switch {
+			case err == nil:
+				deleted++
+			case !errors.Is(err, ErrNotFound):
+				failed++
+				lastErr = err
+			}
+		}
+		release()
+	}
+
+	now := time.Now()
+	lag := now.Sub(batch[0].queuedAt)
+	p.mutex.Lock()
+	p.inflight = time.Time{}
+	p.stats.Batches++
+	p.stats.Indexed += indexed
+	p.stats.Deleted += deleted
+	p.stats.Coalesced += uint64(len(batch) - len(docs) - len(deletes))
+	p.stats.Failed += failed
+	if lastErr != nil {
+		p.stats.LastError = lastErr.Error()
+	}
+	p.stats.LastLag = lag
+	if lag > p.stats.MaxLag {
+		p.stats.MaxLag = lag
+	}
+	p.stats.LastBatch = start
+	p.stats.LastBatchTook = now.Sub(start)
+	p.mutex.Unlock()
+
+	span.SetAttributes(attribute.Int64("documents.indexed", int64(indexed)),
+		attribute.Int64("documents.deleted", int64(deleted)), attribute.Int64("documents.failed", int64(failed)),
+		attribute.Int64("pipeline.lag_ms", lag.Milliseconds()))
+	if lastErr != nil {
+		span.RecordError(lastErr)
+		span.SetStatus(codes.Error, lastErr.Error())
+	}
+
+	for range batch {
+		<-p.slots
+	}
+}
@@ -0,0 +1,131 @@
+package documentstore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// projection is a compiled list of fields to return. Fields are named as
+// export columns: ColumnTitle, ColumnContent and so on, ColumnMetadata for
+// every metadata value and "metadata.<key>" for one. The ID is always
+// returned. A nil projection returns whole documents.
+type projection struct {
+	fields   map[string]bool
+	metadata map[string]bool // Keys picked one by one
+}
+
+// compileProjection checks fields; no fields means whole documents
+func compileProjection(fields []string) (*projection, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	p := &projection{fields: make(map[string]bool)}
+	for _, field := range fields {
+		if !validColumn(field) {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		if key := strings.TrimPrefix(field, metadataColumn); key != field {
+			if p.metadata == nil {
+				p.metadata = make(map[string]bool)
+			}
+			p.metadata[key] = true
+			continue
+		}
+		p.fields[field] = true
+	}
+	return p, nil
+}
+
+// needsContent reports whether the projection returns content, so engines
+// can skip reading it when it doesn't
+func (p *projection) needsContent() bool {
+	return p == nil || p.fields[ColumnContent]
+}
+
+// apply returns a new document holding the projected fields of doc, or doc
+// itself for a nil projection
+func (p *projection) apply(doc *Document) *Document {
+	if p == nil {
+		return doc
+	}
+	projected := &Document{ID: doc.ID}
+	if p.fields[ColumnTitle] {
+		projected.Title = doc.Title
+	}
+	if p.fields[ColumnContent] {
+		projected.Content = doc.Content
+		projected.ContentEncoding = doc.ContentEncoding
+		projected.CompressedContent = doc.CompressedContent
+	}
+	if p.fields[ColumnCreatedAt] {
+		projected.CreatedAt = doc.CreatedAt
+	}
+	if p.fields[ColumnUpdatedAt] {
+		projected.UpdatedAt = doc.UpdatedAt
+	}
+	if p.fields[ColumnExpiresAt] {
+		projected.ExpiresAt = doc.ExpiresAt
+	}
+	if p.fields[ColumnVersion] {
+		projected.Version = doc.Version
+	}
+	if p.fields[ColumnContentHash] {
+		projected.ContentHash = doc.ContentHash
+	}
+	if p.fields[ColumnDuplicateOf] {
+		projected.DuplicateOf = doc.DuplicateOf
+	}
+	if p.fields[ColumnLinks] {
+		projected.Links = doc.Links
+	}
+	if p.fields[ColumnVector] {
+		projected.Vector = doc.Vector
+	}
+	for key, value := range doc.Metadata {
+		if p.fields[ColumnMetadata] || p.metadata[key] {
+			if projected.Metadata == nil {
+				projected.Metadata = make(map[string]string)
+			}
+			projected.Metadata[key] = value
+		}
+	}
+	return projected
+}
+
+// GetDocumentFields retrieves only the given fields of a document, so
+// callers that need a title or a metadata value don't copy megabytes of
+// content around. It fails with ErrNotFound if there is no such document.
+func (db *DocumentDB) GetDocumentFields(id string, fields []string) (*Document, error) {
+	p, err := compileProjection(fields)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := db.GetDocument(id)
+	if err != nil {
+		return nil, err
+	}
+	return p.apply(doc), nil
+}
+
+// fieldGetter is implemented by engines that can read some fields of a
+// document without reading the rest
+type fieldGetter interface {
+	GetFields(id string, fields []string) (*Document, error)
+}
+
+// getDocumentFields reads the given fields of a document from engine,
+// reading the whole document if the engine can't do better
+func getDocumentFields(engine StorageEngine, id string, fields []string) (*Document, error) {
+	if g, ok := engine.(fieldGetter); ok {
+		return g.GetFields(id, fields)
+	}
+	p, err := compileProjection(fields)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := getDocument(engine, id)
+	if err != nil {
+		return nil, err
+	}
+	return p.apply(doc), nil
+}
@@ -0,0 +1,1027 @@
+package documentstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenPhrase
+	tokenLParen
+	tokenRParen
+	tokenAnd
+	tokenOr
+	tokenNot
+)
+
+type queryToken struct {
+	kind  tokenKind
+	field string // Set by a field: prefix
+	text  string
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case tokenLParen:
+		return `"("`
+	case tokenRParen:
+		return `")"`
+	case tokenPhrase:
+		return fmt.Sprintf("%q", t.text)
+	}
+	if t.field != "" {
+		return t.field + ":" + t.text
+	}
+	return t.text
+}
+
+// lexQuery splits a query into words, quoted phrases, parentheses and
+// operators
+func lexQuery(text string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		switch r := runes[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenLParen})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenRParen})
+			i++
+		case r == '"':
+			phrase, next, err := readQuoted(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, queryToken{kind: tokenPhrase, text: phrase})
+			i = next
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()"`, runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+			if field, value, ok := strings.Cut(word, ":"); ok {
+				if value == "" && i < len(runes) && runes[i] == '"' {
+					phrase, next, err := readQuoted(runes, i)
+					if err != nil {
+						return nil, err
+					}
+					tokens = append(tokens, queryToken{kind: tokenPhrase, field: field, text: phrase})
+					i = next
+					continue
+				}
+				tokens = append(tokens, queryToken{kind: tokenWord, field: field, text: value})
+				continue
+			}
+			switch word {
+			case "AND":
+				tokens = append(tokens, queryToken{kind: tokenAnd, text: word})
+			case "OR":
+				tokens = append(tokens, queryToken{kind: tokenOr, text: word})
+			case "NOT":
+				tokens = append(tokens, queryToken{kind: tokenNot, text: word})
+			default:
+				tokens = append(tokens, queryToken{kind: tokenWord, text: word})
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// readQuoted returns the text between the quote at runes[start] and the
+// next one, and the index after the closing quote
+func readQuoted(runes []rune, start int) (string, int, error) {
+	for i := start + 1; i < len(runes); i++ {
+		if runes[i] == '"' {
+			return string(runes[start+1 : i]), i + 1, nil
+		}
+	}
+	return "", 0, errors.New("unterminated quoted phrase")
+}
+
+// queryParser builds an execution plan from tokens by recursive descent
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek(kind tokenKind) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == kind
+}
+
+func (p *queryParser) parseOr() (planNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []planNode{node}
+	for p.peek(tokenOr) {
+		p.pos++
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &orNode{children: children}, nil
+}
+
+func (p *queryParser) parseAnd() (planNode, error) {
+	node, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	children := []planNode{node}
+	for {
+		if p.peek(tokenAnd) {
+			p.pos++
+		} else if !p.peek(tokenWord) && !p.peek(tokenPhrase) && !p.peek(tokenLParen) && !p.peek(tokenNot) {
+			break
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &andNode{children: children}, nil
+}
+
+func (p *queryParser) parseUnary() (planNode, error) {
+	if p.peek(tokenNot) {
+		p.pos++
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{child: child}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (planNode, error) {
+	if p.pos == len(p.tokens) {
+		return nil, errors.New("query ends unexpectedly")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch tok.kind {
+	case tokenLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(tokenRParen) {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return node, nil
+	case tokenWord, tokenPhrase:
+		return newClause(tok)
+	}
+	return nil, fmt.Errorf("unexpected %s", tok)
+}
+
+// newClause compiles one word or phrase, with its field, into a plan node
+func newClause(tok queryToken) (planNode, error) {
+	if strings.HasPrefix(tok.field, metadataFieldPrefix) {
+		key, err := metadataKey(tok.field)
+		if err != nil {
+			return nil, err
+		}
+		if tok.text == "" {
+			return nil, fmt.Errorf("%s needs a value", tok.field)
+		}
+		if tok.kind == tokenWord && isGeoDistance(tok.text) {
+			within, err := parseGeoDistance(tok.text)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", tok.field, err)
+			}
+			return &geoNode{key: key, within: within}, nil
+		}
+		if tok.kind == tokenWord && isRange(tok.text) {
+			r, err := parseRange(tok.text, time.Now())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", tok.field, err)
+			}
+			return &rangeNode{key: key, bounds: r}, nil
+		}
+		if err := checkPattern(tok.text); err != nil {
+			return nil, err
+		}
+		return &metadataNode{key: key, value: tok.text}, nil
+	}
+
+	if tok.field == "*" {
+		if tok.kind != tokenWord || tok.text != "*" {
+			return nil, fmt.Errorf("%s: only *:* may have the field *", tok)
+		}
+		return &allNode{}, nil
+	}
+
+	if tok.field == freshnessField {
+		age, ok := parseAge(tok.text)
+		if tok.kind != tokenWord || !ok {
+			return nil, fmt.Errorf("%s: want an age such as 7d, in s, m, h, d or w", tok)
+		}
+		return &freshnessNode{since: time.Now().Add(-age)}, nil
+	}
+
+	fields := textFields
+	switch tok.field {
+	case "":
+	case FieldTitle, FieldContent:
+		fields = []string{tok.field}
+	default:
+		return nil, fmt.Errorf("unknown field %q", tok.field)
+	}
+
+	if tok.kind == tokenWord && isFuzzy(tok.text) {
+		return newFuzzyNode(tok, fields)
+	}
+	if tok.kind == tokenWord && isPattern(tok.text) {
+		pattern := strings.ToLower(tok.text)
+		if err := checkPattern(pattern); err != nil {
+			return nil, err
+		}
+		return &wildcardNode{pattern: pattern, fields: fields}, nil
+	}
+	terms := tokenize(tok.text)
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("%s has no searchable words", tok)
+	}
+	return &textNode{text: tok.text, terms: terms, fields: fields}, nil
+}
+
+// newFuzzyNode compiles a word~ or word~edits clause
+func newFuzzyNode(tok queryToken, fields []string) (planNode, error) {
+	i := strings.LastIndex(tok.text, "~")
+	text, suffix := tok.text[:i], tok.text[i+1:]
+	if isPattern(text) {
+		return nil, fmt.Errorf("%s can't be both fuzzy and a wildcard pattern", tok)
+	}
+	edits := 0
+	if suffix != "" {
+		n, err := strconv.Atoi(suffix)
+		if err != nil || n < 1 || n > maxFuzzyEdits {
+			return nil, fmt.Errorf("%s: fuzzy words allow 1 to %d edits", tok, maxFuzzyEdits)
+		}
+		edits = n
+	}
+	terms := tokenize(text)
+	if len(terms) != 1 {
+		return nil, fmt.Errorf("%s must be a single word", tok)
+	}
+	return &fuzzyNode{text: text, term: terms[0], edits: edits, fields: fields}, nil
+}
+
+// maxFuzzyEdits bounds the edits of a fuzzy word, since the number of terms
+// in reach grows quickly with them
+const maxFuzzyEdits = 2
+
+func isFuzzy(text string) bool {
+	return strings.Contains(text, "~")
+}
+
+func isPattern(text string) bool {
+	return strings.ContainsAny(text, "*?")
+}
+
+func checkPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("bad wildcard pattern %q", pattern)
+	}
+	return nil
+}
+
+// Query is a parsed query, compiled into an execution plan that can be run
+// against any DocumentDB.
+//
+// A query combines clauses with NOT, AND and OR, from tightest binding to
+// loosest, and parentheses. Adjacent clauses are ANDed.
+// A clause is one of
+//
+//	engine            a word in the title or content
+//	"search engine"   the words next to each other, in order
+//	eng*  engin?      words matching a wildcard pattern
+//	engne~  engne~1   words within 1 or 2 edits; without a number, 1 for
+//	                  words of up to five letters and 2 for longer ones
+//	title:engine      any of the above scoped to title: or content:
+//	metadata.lang:en  documents whose metadata value matches exactly, or
+//	                  by wildcard pattern
+//	metadata.size:>100
+//	                  documents whose metadata value is above a bound, or
+//	                  at least (>=), below (<) or at most (<=) it
+//	metadata.size:10..99
+//	                  documents whose metadata value is between two bounds
+//	                  inclusive; either bound may be left out
+//	metadata.place:52.37,4.89~10km
+//	                  documents whose metadata location is within a
+//	                  distance of a point, in m, km or mi
+//	freshness:7d      documents crawled within an age, in seconds,
+//	                  minutes, hours, days or weeks; see CrawledAtKey
+//	*:*               every document
+//
+// Ranges compare values as the field's index orders them, see
+// CreateIndex. On fields without an index they go by the bounds, comparing
+// as integers if the bounds are all integers, as times if they are all
+// dates and as strings otherwise. Dates are RFC 3339 times or plain dates
+// such as 2024-05-01, or now with an optional offset in seconds, minutes,
+// hours, days or weeks, such as now-7d, which is fixed when the query is
+// parsed.
+//
+// Operators must be upper case; lower case "and", "or" and "not" are words.
+type Query struct {
+	root planNode
+}
+
+// ParseQuery parses and compiles a query
+func ParseQuery(text string) (*Query, error) {
+	tokens, err := lexQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty query")
+	}
+	p := &queryParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(tokens) {
+		return nil, fmt.Errorf("unexpected %s", tokens[p.pos])
+	}
+	return &Query{root: root}, nil
+}
+
+// String returns the execution plan, fully parenthesized
+func (q *Query) String() string {
+	return q.root.String()
+}
+
+// Query parses and runs a query, returning the matches with their
+// relevance scores, best first
+func (db *DocumentDB) Query(text string) ([]SearchResult, error) {
+	q, err := ParseQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	return db.Execute(q), nil
+}
+
+// Execute runs a parsed query, returning the matches with their relevance
+// scores, best first. Only words the matches were required or allowed to
+// contain count towards scores, not negated ones or metadata values.
+//
+// Words are analyzed the way the documents they are matched against were,
+// once per analyzer. Words an analyzer drops, such as stop words, are left
+// out of the query for that analyzer's documents.
+//
+// Results come from the query result cache when it is on and holds them;
+// see SetQueryCache.
+func (db *DocumentDB) Execute(q *Query) []SearchResult {
+	results, _ := db.ExecuteContext(context.Background(), q)
+	return results
+}
+
+// execute runs a query until it is done or d passes
+func (db *DocumentDB) execute(q *Query, d *deadline) []SearchResult {
+	return db.searchShards(d, db.matcher(q, d))
+}
+
+// matcher returns the function matching q on a shard, with q bound to
+// each analyzer once, for searchShards
+func (db *DocumentDB) matcher(q *Query, d *deadline) func(s *shard) ([]string, []string) {
+	analysis := db.currentAnalysis()
+	plans := make(map[*Analyzer]planNode)
+	for _, analyzer := range analysis.analyzers() {
+		plans[analyzer] = q.root.bind(analyzer)
+	}
+	return func(s *shard) ([]string, []string) {
+		ids, terms := analysis.matchEach(s, func(analyzer *Analyzer) ([]string, []string) {
+			root := plans[analyzer]
+			if root == nil {
+				return nil, nil
+			}
+			ex := &execution{shard: s, deadline: d}
+			return sortedIDs(root.execute(ex)), ex.terms
+		})
+		sort.Strings(ids)
+		return ids, terms
+	}
+}
+
+// execution is the state of one run of a plan over a shard; callers hold
+// the shard's lock
+type execution struct {
+	shard    *shard
+	terms    []string  // Index terms the matches are scored on
+	deadline *deadline // Nil for searches without a time limit
+}
+
+// sub returns a run over the same shard whose terms aren't scored on
+func (ex *execution) sub() *execution {
+	return &execution{shard: ex.shard, deadline: ex.deadline}
+}
+
+// expansion returns a function adding the documents with a term in one of
+// fields to ids, and the term to those the matches are scored on
+func (ex *execution) expansion(fields []string, ids map[string]bool) func(term string) {
+	return func(term string) {
+		if ex.deadline.step() {
+			return
+		}
+		ex.terms = append(ex.terms, term)
+		for id := range postingsIn(ex.shard.text, term, fields, ex.deadline) {
+			ids[id] = true
+		}
+	}
+}
+
+// planNode is a step of an execution plan yielding a set of document IDs
+type planNode interface {
+	execute(ex *execution) map[string]bool
+	// cost estimates how many documents the node yields, so intersections
+	// can start from the most selective node
+	cost(s *shard) int
+	// bind returns the node with its words analyzed by analyzer, or nil if
+	// the analyzer leaves nothing to search for
+	bind(analyzer *Analyzer) planNode
+	String() string
+}
+
+// textNode is a word or phrase as written in the query. Binding analyzes it
+// into a termNode or phraseNode.
+type textNode struct {
+	text   string
+	terms  []string // The standard analyzer's terms, for String
+	fields []string
+}
+
+func (n *textNode) execute(ex *execution) map[string]bool {
+	return n.bind(StandardAnalyzer).execute(ex)
+}
+
+func (n *textNode) cost(s *shard) int {
+	return n.bind(StandardAnalyzer).cost(s)
+}
+
+func (n *textNode) bind(analyzer *Analyzer) planNode {
+	terms := analyzer.Analyze(n.text)
+	switch len(terms) {
+	case 0:
+		return nil
+	case 1:
+		return &termNode{term: terms[0], fields: n.fields}
+	}
+	return &phraseNode{terms: terms, fields: n.fields}
+}
+
+func (n *textNode) String() string {
+	if len(n.terms) == 1 {
+		return fieldPrefix(n.fields) + n.terms[0]
+	}
+	return fmt.Sprintf("%s%q", fieldPrefix(n.fields), strings.Join(n.terms, " "))
+}
+
+type termNode struct {
+	term   string
+	fields []string
+}
+
+func (n *termNode) execute(ex *execution) map[string]bool {
+	ex.terms = append(ex.terms, n.term)
+	return postingsIn(ex.shard.text, n.term, n.fields, ex.deadline)
+}
+
+func (n *termNode) cost(s *shard) int {
+	return s.text.df[n.term]
+}
+
+func (n *termNode) bind(*Analyzer) planNode {
+	return n
+}
+
+func (n *termNode) String() string {
+	return fieldPrefix(n.fields) + n.term
+}
+
+type phraseNode struct {
+	terms  []string
+	fields []string
+}
+
+func (n *phraseNode) execute(ex *execution) map[string]bool {
+	ex.terms = append(ex.terms, n.terms...)
+	ids := make(map[string]bool)
+	for _, id := range ex.shard.text.matchAll(n.terms) {
+		if ex.deadline.step() {
+			break
+		}
+		if ex.shard.text.hasPhrase(id, n.terms, n.fields) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func (n *phraseNode) cost(s *shard) int {
+	least := len(s.documents)
+	for _, term := range n.terms {
+		if c := s.text.df[term]; c < least {
+			least = c
+		}
+	}
+	return least
+}
+
+func (n *phraseNode) bind(*Analyzer) planNode {
+	return n
+}
+
+func (n *phraseNode) String() string {
+	return fmt.Sprintf("%s%q", fieldPrefix(n.fields), strings.Join(n.terms, " "))
+}
+
+// wildcardNode expands a pattern over the index's terms when it runs
+type wildcardNode struct {
+	pattern string
+	fields  []string
+}
+
+func (n *wildcardNode) execute(ex *execution) map[string]bool {
+	ids := make(map[string]bool)
+	expand := ex.expansion(n.fields, ids)
+	// Only terms starting with the pattern's literal prefix can match, so a
+	// prefix query such as eng* never looks at the rest of the dictionary
+	ex.shard.text.dictionary.prefixed(literalPrefix(n.pattern), func(term string) {
+		if ex.deadline.step() {
+			return
+		}
+		if matched, _ := path.Match(n.pattern, term); matched {
+			expand(term)
+		}
+	})
+	return ids
+}
+
+func (n *wildcardNode) cost(s *shard) int {
+	return len(s.documents)
+}
+
+func (n *wildcardNode) bind(*Analyzer) planNode {
+	return n
+}
+
+func (n *wildcardNode) String() string {
+	return fieldPrefix(n.fields) + n.pattern
+}
+
+// fuzzyNode matches the terms within a few edits of a word, found by
+// running a Levenshtein automaton over the term dictionary when it runs
+type fuzzyNode struct {
+	text   string // As written, for analyzing
+	term   string
+	edits  int // Zero means by the term's length
+	fields []string
+}
+
+func (n *fuzzyNode) execute(ex *execution) map[string]bool {
+	ids := make(map[string]bool)
+	expand := ex.expansion(n.fields, ids)
+	ex.shard.text.dictionary.fuzzy(n.term, maxEdits(n.term, n.edits), func(term string, _ int) {
+		expand(term)
+	})
+	return ids
+}
+
+func (n *fuzzyNode) cost(s *shard) int {
+	return len(s.documents)
+}
+
+// bind analyzes the word, so a fuzzy word is compared with stems under a
+// stemming analyzer
+func (n *fuzzyNode) bind(analyzer *Analyzer) planNode {
+	terms := analyzer.Analyze(n.text)
+	nodes := make([]planNode, len(terms))
+	for i, term := range terms {
+		nodes[i] = &fuzzyNode{text: n.text, term: term, edits: n.edits, fields: n.fields}
+	}
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		return nodes[0]
+	}
+	return &andNode{children: nodes}
+}
+
+func (n *fuzzyNode) String() string {
+	if n.edits == 0 {
+		return fieldPrefix(n.fields) + n.term + "~"
+	}
+	return fmt.Sprintf("%s%s~%d", fieldPrefix(n.fields), n.term, n.edits)
+}
+
+// metadataNode filters on a metadata value, through the key's index when
+// there is one
+type metadataNode struct {
+	key   string
+	value string
+}
+
+func (n *metadataNode) execute(ex *execution) map[string]bool {
+	ids := make(map[string]bool)
+	if idx, exists := ex.shard.indexes[n.key]; exists && !isPattern(n.value) {
+		for id := range idx.values[n.value] {
+			ids[id] = true
+		}
+		return ids
+	}
+	for id, doc := range ex.shard.documents {
+		if ex.deadline.step() {
+			break
+		}
+		value, exists := doc.Metadata[n.key]
+		if !exists {
+			continue
+		}
+		if matched, _ := path.Match(n.value, value); matched {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func (n *metadataNode) cost(s *shard) int {
+	if idx, exists := s.indexes[n.key]; exists && !isPattern(n.value) {
+		return len(idx.values[n.value])
+	}
+	return len(s.documents)
+}
+
+func (n *metadataNode) bind(*Analyzer) planNode {
+	return n
+}
+
+func (n *metadataNode) String() string {
+	return fmt.Sprintf("%s%s:%q", metadataFieldPrefix, n.key, n.value)
+}
+
+// rangeNode filters on metadata values within a range, through the key's
+// index when there is one
+type rangeNode struct {
+	key    string
+	bounds valueRange
+}
+
+// keys returns the range as the shard's index for the key orders values,
+// or as the bounds suggest without one, reporting false if the bounds
+// aren't values of the index's kind
+func (n *rangeNode) keys(s *shard) (keyRange, FieldType, bool) {
+	kind := n.bounds.inferKind()
+	if idx, exists := s.indexes[n.key]; exists {
+		kind = idx.kind
+	}
+	r, ok := n.bounds.keys(kind)
+	return r, kind, ok
+}
+
+func (n *rangeNode) execute(ex *execution) map[string]bool {
+	ids := make(map[string]bool)
+	r, kind, ok := n.keys(ex.shard)
+	if !ok {
+		return ids
+	}
+	if idx, exists := ex.shard.indexes[n.key]; exists {
+		start, end := idx.span(r)
+		for _, v := range idx.sorted[start:end] {
+			for id := range idx.values[v.value] {
+				ids[id] = true
+			}
+		}
+		return ids
+	}
+	for id, doc := range ex.shard.documents {
+		if ex.deadline.step() {
+			break
+		}
+		value, exists := doc.Metadata[n.key]
+		if !exists {
+			continue
+		}
+		if key, ok := parseRangeKey(kind, value); ok && r.contains(key) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// cost counts the distinct values in range rather than the documents
+// holding them, a fair estimate for the fine-grained values ranges are
+// used on that doesn't walk them
+func (n *rangeNode) cost(s *shard) int {
+	r, _, ok := n.keys(s)
+	if !ok {
+		return 0
+	}
+	if idx, exists := s.indexes[n.key]; exists {
+		start, end := idx.span(r)
+		return end - start
+	}
+	return len(s.documents)
+}
+
+func (n *rangeNode) bind(*Analyzer) planNode {
+	return n
+}
+
+func (n *rangeNode) String() string {
+	return metadataFieldPrefix + n.key + ":" + n.bounds.String()
+}
+
+// geoNode filters on metadata locations within a distance of a point,
+// through the geohashes of the key's index when there is one
+type geoNode struct {
+	key    string
+	within geoDistance
+}
+
+func (n *geoNode) execute(ex *execution) map[string]bool {
+	ids := make(map[string]bool)
+	if idx, exists := ex.shard.indexes[n.key]; exists && idx.kind == TypeGeo {
+		// Only the cells covering the circle are visited, and of those
+		// only the points actually in it kept
+		for _, cell := range geohashCover(n.within.center, n.within.radius) {
+			start, end := idx.span(cellRange(cell))
+			for _, v := range idx.sorted[start:end] {
+				if p, err := ParseGeoPoint(v.value); err == nil && n.within.contains(p) {
+					for id := range idx.values[v.value] {
+						ids[id] = true
+					}
+				}
+			}
+		}
+		return ids
+	}
+	for id, doc := range ex.shard.documents {
+		if ex.deadline.step() {
+			break
+		}
+		if p, ok := documentLocation(doc, n.key); ok && n.within.contains(p) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// cost counts the distinct locations in the cells covering the circle
+func (n *geoNode) cost(s *shard) int {
+	idx, exists := s.indexes[n.key]
+	if !exists || idx.kind != TypeGeo {
+		return len(s.documents)
+	}
+	total := 0
+	for _, cell := range geohashCover(n.within.center, n.within.radius) {
+		start, end := idx.span(cellRange(cell))
+		total += end - start
+	}
+	return total
+}
+
+func (n *geoNode) bind(*Analyzer) planNode {
+	return n
+}
+
+func (n *geoNode) String() string {
+	return metadataFieldPrefix + n.key + ":" + n.within.String()
+}
+
+// andNode intersects its children, cheapest first, then subtracts the
+// negated ones
+type andNode struct {
+	children []planNode
+}
+
+func (n *andNode) execute(ex *execution) map[string]bool {
+	var include, exclude []planNode
+	for _, child := range n.children {
+		if not, ok := child.(*notNode); ok {
+			exclude = append(exclude, not.child)
+		} else {
+			include = append(include, child)
+		}
+	}
+	sort.SliceStable(include, func(i, j int) bool { return include[i].cost(ex.shard) < include[j].cost(ex.shard) })
+
+	var ids map[string]bool
+	if len(include) == 0 {
+		ids = allIDs(ex.shard)
+	} else {
+		ids = include[0].execute(ex)
+		for _, child := range include[1:] {
+			if len(ids) == 0 {
+				break
+			}
+			next := child.execute(ex)
+			for id := range ids {
+				if !next[id] {
+					delete(ids, id)
+				}
+			}
+		}
+	}
+	for _, child := range exclude {
+		if len(ids) == 0 {
+			break
+		}
+		for id := range child.execute(ex.sub()) {
+			delete(ids, id)
+		}
+	}
+	return ids
+}
+
+func (n *andNode) cost(s *shard) int {
+	least := len(s.documents)
+	for _, child := range n.children {
+		if _, ok := child.(*notNode); ok {
+			continue
+		}
+		if c := child.cost(s); c < least {
+			least = c
+		}
+	}
+	return least
+}
+
+func (n *andNode) bind(analyzer *Analyzer) planNode {
+	children := bindNodes(n.children, analyzer)
+	switch len(children) {
+	case 0:
+		return nil
+	case 1:
+		return children[0]
+	}
+	return &andNode{children: children}
+}
+
+func (n *andNode) String() string {
+	return joinNodes(n.children, " AND ")
+}
+
+type orNode struct {
+	children []planNode
+}
+
+func (n *orNode) execute(ex *execution) map[string]bool {
+	ids := make(map[string]bool)
+	for _, child := range n.children {
+		for id := range child.execute(ex) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func (n *orNode) cost(s *shard) int {
+	total := 0
+	for _, child := range n.children {
+		total += child.cost(s)
+	}
+	return total
+}
+
+func (n *orNode) bind(analyzer *Analyzer) planNode {
+	children := bindNodes(n.children, analyzer)
+	switch len(children) {
+	case 0:
+		return nil
+	case 1:
+		return children[0]
+	}
+	return &orNode{children: children}
+}
+
+func (n *orNode) String() string {
+	return joinNodes(n.children, " OR ")
+}
+
+// allNode matches every document, adding nothing to their scores
+type allNode struct{}
+
+func (n *allNode) execute(ex *execution) map[string]bool {
+	return allIDs(ex.shard)
+}
+
+func (n *allNode) cost(s *shard) int {
+	return len(s.documents)
+}
+
+func (n *allNode) bind(*Analyzer) planNode {
+	return n
+}
+
+func (n *allNode) String() string {
+	return "*:*"
+}
+
+// notNode on its own matches every document its child doesn't; inside an
+// AND it is subtracted instead
+type notNode struct {
+	child planNode
+}
+
+func (n *notNode) execute(ex *execution) map[string]bool {
+	ids := allIDs(ex.shard)
+	for id := range n.child.execute(ex.sub()) {
+		delete(ids, id)
+	}
+	return ids
+}
+
+func (n *notNode) cost(s *shard) int {
+	return len(s.documents)
+}
+
+func (n *notNode) bind(analyzer *Analyzer) planNode {
+	child := n.child.bind(analyzer)
+	if child == nil {
+		return nil
+	}
+	return &notNode{child: child}
+}
+
+func (n *notNode) String() string {
+	return "NOT " + n.child.String()
+}
+
+// postingsIn returns the IDs of the documents having term in one of fields
+func postingsIn(idx *invertedIndex, term string, fields []string, d *deadline) map[string]bool {
+	ids := make(map[string]bool, idx.df[term])
+	idx.eachPosting(term, func(id string, p *posting) bool {
+		for _, field := range fields {
+			if p.frequency(field) > 0 {
+				ids[id] = true
+				break
+			}
+		}
+		return !d.step()
+	})
+	return ids
+}
+
+func allIDs(s *shard) map[string]bool {
+	ids := make(map[string]bool, len(s.documents))
+	for id := range s.documents {
+		ids[id] = true
+	}
+	return ids
+}
+
+// fieldPrefix returns the field: prefix of a clause scoped to one field
+func fieldPrefix(fields []string) string {
+	if len(fields) == 1 {
+		return fields[0] + ":"
+	}
+	return ""
+}
+
+// bindNodes binds each node, leaving out those with nothing to search for
+func bindNodes(nodes []planNode, analyzer *Analyzer) []planNode {
+	var bound []planNode
+	for _, node := range nodes {
+		if b := node.bind(analyzer); b != nil {
+			bound = append(bound, b)
+		}
+	}
+	return bound
+}
+
+func joinNodes(nodes []planNode, op string) string {
+	parts := make([]string, len(nodes))
+	for i, node := range nodes {
+		parts[i] = node.String()
+	}
+	return "(" + strings.Join(parts, op) + ")"
+}
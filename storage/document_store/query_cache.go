@@ -0,0 +1,170 @@
+package documentstore
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// QueryCacheOptions configures the query result cache
+type QueryCacheOptions struct {
+	// MaxEntries bounds how many queries are cached; the least recently
+	// used are evicted first. Zero turns the cache off.
+	MaxEntries int
+	// MaxResults keeps queries matching more documents than this out of the
+	// cache, so a few broad queries can't take all of its memory
+	MaxResults int
+	// TTL is how long a result is served from the cache. Writes don't
+	// invalidate cached results, so they show in cached queries once it
+	// runs out; new generations of the index and scoring changes invalidate
+	// every entry at once.
+	TTL time.Duration
+}
+
+// DefaultQueryCacheOptions caches 1000 queries of up to 10000 matches for
+// ten seconds
+var DefaultQueryCacheOptions = QueryCacheOptions{MaxEntries: 1000, MaxResults: 10000, TTL: 10 * time.Second}
+
+// QueryCacheStats counts the work of the query result cache, for monitoring
+type QueryCacheStats struct {
+	Hits          uint64  `json:"hits"`
+	Misses        uint64  `json:"misses"`
+	HitRate       float64 `json:"hit_rate"` // Hits over lookups, 0 before the first
+	Evictions     uint64  `json:"evictions"`
+	Expirations   uint64  `json:"expirations"`   // Entries found past their TTL
+	Invalidations uint64  `json:"invalidations"` // Times every entry was dropped
+	TooLarge      uint64  `json:"too_large"`     // Results left out for exceeding MaxResults
+	Entries       int     `json:"entries"`
+}
+
+// queryCache holds the results of recent queries by their normalized plan,
+// in LRU order
+type queryCache struct {
+	mutex   sync.Mutex
+	options QueryCacheOptions
+	lru     *list.List // Of *queryCacheEntry, most recently used first
+	entries map[string]*list.Element
+	epoch   uint64 // Bumped by invalidate, so results computed before aren't stored
+	stats   QueryCacheStats
+}
+
+type queryCacheEntry struct {
+	key     string
+	results []SearchResult
+	expires time.Time
+}
+
+func newQueryCache() *queryCache {
+	return &queryCache{lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns a copy of the cached results for key, and the epoch to store
+// them at on a miss
+func (c *queryCache) get(key string) ([]SearchResult, uint64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.options.MaxEntries == 0 {
+		return nil, c.epoch, false
+	}
+	element, ok := c.entries[key]
+	if ok {
+		entry := element.Value.(*queryCacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.stats.Hits++
+			c.lru.MoveToFront(element)
+			// Callers sort and project the results they get in place
+			return append([]SearchResult(nil), entry.results...), c.epoch, true
+		}
+		c.stats.Expirations++
+		c.removeLocked(element)
+	}
+	c.stats.Misses++
+	return nil, c.epoch, false
+}
+
+// put caches a copy of the results of key, computed at epoch, unless the
+// cache was invalidated since
+func (c *queryCache) put(key string, results []SearchResult, epoch uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.options.MaxEntries == 0 || epoch != c.epoch {
+		return
+	}
+	if c.options.MaxResults > 0 && len(results) > c.options.MaxResults {
+		c.stats.TooLarge++
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		c.removeLocked(element)
+	}
+	entry := &queryCacheEntry{
+		key:     key,
+		results: append([]SearchResult(nil), results...),
+		expires: time.Now().Add(c.options.TTL),
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.options.MaxEntries {
+		c.removeLocked(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *queryCache) removeLocked(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*queryCacheEntry).key)
+}
+
+// invalidate drops every entry, and any result being computed meanwhile
+func (c *queryCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.epoch++
+	if len(c.entries) > 0 {
+		c.stats.Invalidations++
+	}
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// SetQueryCache turns on the query result cache, or off with a zero
+// MaxEntries, dropping whatever it held. Zero MaxResults and TTL take their
+// DefaultQueryCacheOptions values. Queries are cached by their execution
+// plan, so spacing and redundant parentheses don't matter.
+func (db *DocumentDB) SetQueryCache(options QueryCacheOptions) {
+	if options.MaxResults == 0 {
+		options.MaxResults = DefaultQueryCacheOptions.MaxResults
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultQueryCacheOptions.TTL
+	}
+	db.results.invalidate()
+	db.results.mutex.Lock()
+	defer db.results.mutex.Unlock()
+	db.results.options = options
+}
+
+// QueryCacheStats returns the query result cache's hit rate and size
+func (db *DocumentDB) QueryCacheStats() QueryCacheStats {
+	c := db.results
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(lookups)
+	}
+	return stats
+}
+
+// cachedResults returns the results the cache holds for q without running
+// it
+func (db *DocumentDB) cachedResults(q *Query) ([]SearchResult, bool) {
+	results, _, ok := db.results.get(q.String())
+	return results, ok
+}
+
+// InvalidateQueryCache drops every cached query result, e.g. after writes
+// that must show in searches at once
+func (db *DocumentDB) InvalidateQueryCache() {
+	db.results.invalidate()
+}
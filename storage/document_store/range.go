@@ -0,0 +1,227 @@
+package documentstore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rangeKey is a metadata value as indexes order it: by number for TypeInt,
+// by instant for TypeDate, by geohash for TypeGeo and by text otherwise
+type rangeKey struct {
+	number int64
+	text   string
+}
+
+func (a rangeKey) less(b rangeKey) bool {
+	if a.number != b.number {
+		return a.number < b.number
+	}
+	return a.text < b.text
+}
+
+// rangeKind is the order a field of type kind takes in an index; types
+// without an order of their own compare as strings
+func rangeKind(kind FieldType) FieldType {
+	if kind == TypeInt || kind == TypeDate || kind == TypeGeo {
+		return kind
+	}
+	return TypeString
+}
+
+// parseRangeKey reads value in the order of kind, reporting false if it
+// isn't a value of that kind
+func parseRangeKey(kind FieldType, value string) (rangeKey, bool) {
+	switch kind {
+	case TypeInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		return rangeKey{number: n}, err == nil
+	case TypeDate:
+		t, err := parseDate(value)
+		return rangeKey{number: t.UnixNano()}, err == nil
+	case TypeGeo:
+		p, err := ParseGeoPoint(value)
+		if err != nil {
+			return rangeKey{}, false
+		}
+		return rangeKey{text: geohash(p, geohashPrecision)}, true
+	}
+	return rangeKey{text: value}, true
+}
+
+// keyBound is one end of a keyRange
+type keyBound struct {
+	key       rangeKey
+	inclusive bool
+}
+
+// keyRange is the values between two bounds; a nil bound leaves that end
+// open
+type keyRange struct {
+	low, high *keyBound
+}
+
+// above reports whether key is past the low end of the range
+func (r keyRange) above(key rangeKey) bool {
+	if r.low == nil {
+		return true
+	}
+	if r.low.inclusive {
+		return !key.less(r.low.key)
+	}
+	return r.low.key.less(key)
+}
+
+// below reports whether key is short of the high end of the range
+func (r keyRange) below(key rangeKey) bool {
+	if r.high == nil {
+		return true
+	}
+	if r.high.inclusive {
+		return !r.high.key.less(key)
+	}
+	return key.less(r.high.key)
+}
+
+func (r keyRange) contains(key rangeKey) bool {
+	return r.above(key) && r.below(key)
+}
+
+// rangeBound is one end of a range as written in a query
+type rangeBound struct {
+	value     string
+	inclusive bool
+}
+
+// valueRange is a range of metadata values as written in a query, before
+// it is known how the values compare. A nil bound leaves that end open.
+type valueRange struct {
+	low, high *rangeBound
+}
+
+// parseRange reads a range clause's value: >, >=, < or <= followed by a
+// bound, or two bounds joined by .. of which either may be left out. Dates
+// relative to now are resolved against now.
+func parseRange(text string, now time.Time) (valueRange, error) {
+	var r valueRange
+	bound := func(value string, inclusive bool) (*rangeBound, error) {
+		if value == "" {
+			return nil, nil
+		}
+		resolved, err := resolveNow(value, now)
+		if err != nil {
+			return nil, err
+		}
+		return &rangeBound{value: resolved, inclusive: inclusive}, nil
+	}
+	var err error
+	switch {
+	case strings.HasPrefix(text, ">="):
+		r.low, err = bound(text[2:], true)
+	case strings.HasPrefix(text, ">"):
+		r.low, err = bound(text[1:], false)
+	case strings.HasPrefix(text, "<="):
+		r.high, err = bound(text[2:], true)
+	case strings.HasPrefix(text, "<"):
+		r.high, err = bound(text[1:], false)
+	default:
+		low, high, _ := strings.Cut(text, "..")
+		if r.low, err = bound(low, true); err == nil {
+			r.high, err = bound(high, true)
+		}
+	}
+	if err != nil {
+		return r, err
+	}
+	if r.low == nil && r.high == nil {
+		return r, fmt.Errorf("range %q has no bounds", text)
+	}
+	return r, nil
+}
+
+// isRange reports whether a metadata clause's value is a range rather than
+// a value or pattern to match
+func isRange(text string) bool {
+	return strings.HasPrefix(text, "<") || strings.HasPrefix(text, ">") || strings.Contains(text, "..")
+}
+
+// resolveNow turns now, or now with an offset such as now-7d, into an
+// RFC 3339 time, and leaves other values as they are. Offsets count
+// seconds, minutes, hours, days or weeks.
+func resolveNow(value string, now time.Time) (string, error) {
+	if value != "now" && !strings.HasPrefix(value, "now-") && !strings.HasPrefix(value, "now+") {
+		return value, nil
+	}
+	t := now.UTC()
+	if offset := value[len("now"):]; offset != "" {
+		age, ok := parseAge(offset[1:])
+		if !ok {
+			return "", fmt.Errorf("bad relative time %q, want now-<n><unit> with a unit of s, m, h, d or w", value)
+		}
+		if offset[0] == '-' {
+			age = -age
+		}
+		t = t.Add(age)
+	}
+	return t.Format(time.RFC3339Nano), nil
+}
+
+// inferKind is how the range compares values when no index says: as
+// integers if its bounds are all integers, as times if they are all dates,
+// and as strings otherwise
+func (r valueRange) inferKind() FieldType {
+	for _, kind := range []FieldType{TypeInt, TypeDate} {
+		if _, ok := r.keys(kind); ok {
+			return kind
+		}
+	}
+	return TypeString
+}
+
+// keys reads the range's bounds as values of kind, reporting false if one
+// isn't a value of that kind or kind has no order to take ranges in
+func (r valueRange) keys(kind FieldType) (keyRange, bool) {
+	var keys keyRange
+	if kind == TypeGeo {
+		return keys, false
+	}
+	var ok bool
+	if keys.low, ok = r.low.key(kind); !ok {
+		return keyRange{}, false
+	}
+	if keys.high, ok = r.high.key(kind); !ok {
+		return keyRange{}, false
+	}
+	return keys, true
+}
+
+// key reads the bound as a value of kind; a nil bound stays open
+func (b *rangeBound) key(kind FieldType) (*keyBound, bool) {
+	if b == nil {
+		return nil, true
+	}
+	key, ok := parseRangeKey(kind, b.value)
+	if !ok {
+		return nil, false
+	}
+	return &keyBound{key: key, inclusive: b.inclusive}, true
+}
+
+// String writes the range in interval notation, with * for open ends
+func (r valueRange) String() string {
+	low, high := "(*", "*)"
+	if r.low != nil {
+		low = "(" + r.low.value
+		if r.low.inclusive {
+			low = "[" + r.low.value
+		}
+	}
+	if r.high != nil {
+		high = r.high.value + ")"
+		if r.high.inclusive {
+			high = r.high.value + "]"
+		}
+	}
+	return low + ".." + high
+}
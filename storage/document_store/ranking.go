@@ -0,0 +1,175 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScoreContext is what a Scorer ranks a matching document by
+type ScoreContext struct {
+	Document *Document
+	// Relevance is the text score of the document for the query, as the
+	// scoring model and field boosts compute it
+	Relevance float64
+	Now       time.Time // The same for every document of a search
+}
+
+// Scorer computes the final ranking score of a matching document. Set one in
+// ScoringConfig to rank by more than text relevance.
+type Scorer interface {
+	Score(ctx ScoreContext) float64
+}
+
+// ScorerFunc lets an ordinary function be used as a Scorer
+type ScorerFunc func(ctx ScoreContext) float64
+
+// Score calls f(ctx)
+func (f ScorerFunc) Score(ctx ScoreContext) float64 {
+	return f(ctx)
+}
+
+// Kinds of ranking signals
+const (
+	SignalText      = "text"      // The text relevance score
+	SignalMetadata  = "metadata"  // A numeric metadata value, such as PageRank or clicks
+	SignalFreshness = "freshness" // Decay with the age of a date
+)
+
+// Transforms of metadata signals
+const (
+	TransformLog    = "log"    // ln(1 + value), so large counts don't swamp the rest
+	TransformLinear = "linear" // The value as it is
+)
+
+// Signal is one weighted input to a SignalScorer. Signals are plain data, so
+// rankings can be tuned from configuration rather than code.
+type Signal struct {
+	Kind   string  `json:"kind"`
+	Weight float64 `json:"weight"`
+	// Key is the metadata key of a metadata signal
+	Key string `json:"key,omitempty"`
+	// Transform applies to metadata signals; empty means TransformLog
+	Transform string `json:"transform,omitempty"`
+	// Field is the date a freshness signal decays with: ColumnCreatedAt,
+	// ColumnUpdatedAt (the default), CrawledAtKey for the crawl time,
+	// falling back to the update time, or "metadata.<key>" holding an
+	// RFC 3339 time
+	Field string `json:"field,omitempty"`
+	// HalfLife is how long a freshness signal takes to halve, such as
+	// "720h"
+	HalfLife string `json:"half_life,omitempty"`
+	// Decay is how a freshness signal falls off; empty means
+	// DecayExponential
+	Decay string `json:"decay,omitempty"`
+}
+
+// SignalScorer ranks documents by the weighted sum of its signals
+type SignalScorer struct {
+	signals []compiledSignal
+}
+
+type compiledSignal struct {
+	Signal
+	halfLife time.Duration
+}
+
+// NewSignalScorer checks signals and returns a scorer summing them. For
+// example, text relevance lifted by PageRank and recent updates:
+//
+//	[{"kind": "text", "weight": 1},
+//	 {"kind": "metadata", "key": "pagerank", "weight": 0.5},
+//	 {"kind": "freshness", "half_life": "720h", "weight": 2}]
+func NewSignalScorer(signals []Signal) (*SignalScorer, error) {
+	if len(signals) == 0 {
+		return nil, errors.New("a signal scorer needs at least one signal")
+	}
+	scorer := &SignalScorer{}
+	for i, signal := range signals {
+		compiled := compiledSignal{Signal: signal}
+		switch signal.Kind {
+		case SignalText:
+		case SignalMetadata:
+			if signal.Key == "" {
+				return nil, fmt.Errorf("signal %d: metadata signals need a key", i)
+			}
+			switch signal.Transform {
+			case "", TransformLog, TransformLinear:
+			default:
+				return nil, fmt.Errorf("signal %d: unknown transform %q", i, signal.Transform)
+			}
+		case SignalFreshness:
+			switch {
+			case signal.Field == "", signal.Field == ColumnCreatedAt, signal.Field == ColumnUpdatedAt, signal.Field == CrawledAtKey:
+			case strings.HasPrefix(signal.Field, metadataColumn) && len(signal.Field) > len(metadataColumn):
+			default:
+				return nil, fmt.Errorf("signal %d: freshness can't decay with %q", i, signal.Field)
+			}
+			halfLife, err := time.ParseDuration(signal.HalfLife)
+			if err != nil || halfLife <= 0 {
+				return nil, fmt.Errorf("signal %d: half_life must be a positive duration such as \"720h\"", i)
+			}
+			if err := checkDecay(signal.Decay); err != nil {
+				return nil, fmt.Errorf("signal %d: %w", i, err)
+			}
+			compiled.halfLife = halfLife
+		default:
+			return nil, fmt.Errorf("signal %d: unknown kind %q", i, signal.Kind)
+		}
+		scorer.signals = append(scorer.signals, compiled)
+	}
+	return scorer, nil
+}
+
+// Score sums the weighted signals; signals a document lacks count 0
+func (s *SignalScorer) Score(ctx ScoreContext) float64 {
+	score := 0.0
+	for _, signal := range s.signals {
+		score += signal.Weight * signal.value(ctx)
+	}
+	return score
+}
+
+func (signal compiledSignal) value(ctx ScoreContext) float64 {
+	doc := ctx.Document
+	switch signal.Kind {
+	case SignalText:
+		return ctx.Relevance
+	case SignalMetadata:
+		value, err := strconv.ParseFloat(doc.Metadata[signal.Key], 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return 0
+		}
+		if signal.Transform == TransformLinear {
+			return value
+		}
+		if value <= 0 {
+			return 0
+		}
+		return math.Log1p(value)
+	case SignalFreshness:
+		var date time.Time
+		switch signal.Field {
+		case ColumnCreatedAt:
+			date = doc.CreatedAt
+		case "", ColumnUpdatedAt:
+			date = doc.UpdatedAt
+		case CrawledAtKey:
+			date = crawlTime(doc)
+		default:
+			parsed, err := time.Parse(time.RFC3339Nano, doc.Metadata[strings.TrimPrefix(signal.Field, metadataColumn)])
+			if err != nil {
+				return 0
+			}
+			date = parsed
+		}
+		if date.IsZero() {
+			return 0
+		}
+		return decayFactor(signal.Decay, ctx.Now.Sub(date), signal.halfLife)
+	}
+	return 0
+}
@@ -0,0 +1,27 @@
+package documentstore
+
+// Replicate stores docs as they are, keeping the versions and times
+// another database gave them, for a copy of that database such as a
+// documentserver.Follower keeps. Unlike Bulk, it neither stamps nor
+// deduplicates them.
+func (db *DocumentDB) Replicate(docs []*Document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	copies := make([]*Document, len(docs))
+	for i, doc := range docs {
+		copies[i] = copyDocument(doc)
+	}
+
+	db.lockAll()
+	defer db.unlockAll()
+	if err := db.engine.Write(Batch{Puts: copies}); err != nil {
+		return err
+	}
+	for _, doc := range copies {
+		s := db.shardFor(doc.ID)
+		delete(s.history, doc.ID)
+		db.putLocked(s, doc)
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package documentstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRerankTopN is how many of the best matches a re-ranking model
+// re-scores unless told otherwise
+const DefaultRerankTopN = 100
+
+// Features of a re-ranking candidate, the columns of the rows a Model
+// scores. Numeric metadata named in RerankConfig.Metadata follows them as
+// "metadata.<key>".
+const (
+	FeatureScore         = "score"          // The relevance score, boosts included
+	FeatureRank          = "rank"           // The position by score, from 1
+	FeatureTitleMatch    = "title_match"    // Share of the query's words in the title
+	FeatureContentMatch  = "content_match"  // Share of the query's words in the content
+	FeatureContentLength = "content_length" // ln(1 + characters of content)
+	FeatureAgeDays       = "age_days"       // Days since the document was crawled
+)
+
+// FeatureNames are the features every candidate has, in column order
+var FeatureNames = []string{FeatureScore, FeatureRank, FeatureTitleMatch, FeatureContentMatch, FeatureContentLength, FeatureAgeDays}
+
+// Model scores re-ranking candidates, higher meaning better, from rows of
+// features named by names. Models are trained outside the store, such as
+// on the judgments click feedback yields; a runtime for ONNX or another
+// model format plugs in by implementing Predict. Predict with no rows
+// should fail if the model needs features names lacks.
+type Model interface {
+	Predict(names []string, rows [][]float64) ([]float64, error)
+}
+
+// LinearModel scores candidates by the weighted sum of their features, as
+// a logistic regression or linear ranking SVM learns them
+type LinearModel struct {
+	Weights map[string]float64 `json:"weights"` // By feature name
+	Bias    float64            `json:"bias"`
+}
+
+// LoadLinearModel reads a LinearModel's coefficients as JSON, such as
+// {"weights": {"score": 0.8, "title_match": 1.5}, "bias": 0}
+func LoadLinearModel(r io.Reader) (*LinearModel, error) {
+	var m LinearModel
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to read the model: %w", err)
+	}
+	for name, weight := range m.Weights {
+		if math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("weight of %s must be a number", name)
+		}
+	}
+	return &m, nil
+}
+
+// Predict sums each row's weighted features
+func (m *LinearModel) Predict(names []string, rows [][]float64) ([]float64, error) {
+	columns := make(map[string]int, len(names))
+	for i, name := range names {
+		columns[name] = i
+	}
+	for name := range m.Weights {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("the model weighs feature %s, which candidates lack", name)
+		}
+	}
+	scores := make([]float64, len(rows))
+	for i, row := range rows {
+		scores[i] = m.Bias
+		for name, weight := range m.Weights {
+			scores[i] += weight * row[columns[name]]
+		}
+	}
+	return scores, nil
+}
+
+// RerankConfig re-ranks the best matches of searches sorted by relevance
+// with a learned model, which may weigh more than the scoring model can
+type RerankConfig struct {
+	Model Model
+	// TopN is how many of the best matches are re-scored; 0 means
+	// DefaultRerankTopN. The rest keep their order below them.
+	TopN int
+	// Metadata are numeric metadata keys offered to the model as features,
+	// such as PageRankKey; missing and non-numeric values are 0
+	Metadata []string
+}
+
+// featureNames returns the columns of the rows c's model scores
+func (c *RerankConfig) featureNames() []string {
+	names := append([]string(nil), FeatureNames...)
+	for _, key := range c.Metadata {
+		names = append(names, metadataFieldPrefix+key)
+	}
+	return names
+}
+
+// SetReranker re-ranks searches sorted by relevance with config's model
+// from now on, after checking the model can score the features offered;
+// nil stops re-ranking
+func (db *DocumentDB) SetReranker(config *RerankConfig) error {
+	if config != nil {
+		if config.Model == nil {
+			return errors.New("a reranker needs a model")
+		}
+		if config.TopN < 0 {
+			return errors.New("rerank top N must not be negative")
+		}
+		c := *config
+		if c.TopN == 0 {
+			c.TopN = DefaultRerankTopN
+		}
+		c.Metadata = append([]string(nil), config.Metadata...)
+		if _, err := c.Model.Predict(c.featureNames(), nil); err != nil {
+			return err
+		}
+		config = &c
+	}
+	db.mutex.Lock()
+	db.rerank = config
+	db.mutex.Unlock()
+	return nil
+}
+
+// reranker returns the re-ranking settings, nil unless searches are
+// re-ranked
+func (db *DocumentDB) reranker() *RerankConfig {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.rerank
+}
+
+// rerankResults re-scores the best of results for q with the model, if
+// one is set: at most limit of them when limit is positive, none when it is
+// negative. The candidates take over the scores of the places they move
+// to, so they stay ahead of the rest and cursors see the same order. A
+// model that fails leaves the order as it was.
+func (db *DocumentDB) rerankResults(q *Query, results []SearchResult, limit int) {
+	config := db.reranker()
+	if config == nil || len(results) < 2 || limit < 0 {
+		return
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Document.ID < results[j].Document.ID
+	})
+	n := config.TopN
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	if n > len(results) {
+		n = len(results)
+	}
+	candidates := results[:n]
+	rows := db.rerankFeatures(q, candidates, config.Metadata, time.Now())
+	predicted, err := config.Model.Predict(config.featureNames(), rows)
+	if err == nil && len(predicted) != n {
+		err = fmt.Errorf("the model scored %d candidates", len(predicted))
+	}
+	if err != nil {
+		logger.Warn("Failed to re-rank results", "results", n, "error", err)
+		return
+	}
+	scores := make([]float64, n)
+	order := make([]int, n)
+	for i := range candidates {
+		scores[i] = candidates[i].Score
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return predicted[order[i]] > predicted[order[j]] })
+	reranked := make([]SearchResult, n)
+	for i, from := range order {
+		reranked[i] = SearchResult{Document: candidates[from].Document, Score: scores[i]}
+	}
+	copy(candidates, reranked)
+}
+
+// rerankFeatures returns the rows of features of candidates, in the order
+// of featureNames
+func (db *DocumentDB) rerankFeatures(q *Query, candidates []SearchResult, metadata []string, now time.Time) [][]float64 {
+	analysis := db.currentAnalysis()
+	terms := make(map[*Analyzer]map[string]bool)
+	rows := make([][]float64, len(candidates))
+	for i, result := range candidates {
+		doc := result.Document
+		analyzer := analysis.analyzerFor(doc)
+		words, ok := terms[analyzer]
+		if !ok {
+			words = make(map[string]bool)
+			if root := q.root.bind(analyzer); root != nil {
+				collectWords(root, words)
+			}
+			terms[analyzer] = words
+		}
+		row := []float64{
+			result.Score,
+			float64(i + 1),
+			wordShare(words, analyzer.Analyze(doc.Title)),
+			wordShare(words, analyzer.Analyze(doc.Content)),
+			math.Log1p(float64(len(doc.Content))),
+			math.Max(0, now.Sub(crawlTime(doc)).Hours()/24),
+		}
+		for _, key := range metadata {
+			value, err := strconv.ParseFloat(strings.TrimSpace(doc.Metadata[key]), 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				value = 0
+			}
+			row = append(row, value)
+		}
+		rows[i] = row
+	}
+	return rows
+}
+
+// collectWords gathers the terms and phrase words of a bound plan, leaving
+// out negated ones
+func collectWords(node planNode, words map[string]bool) {
+	switch n := node.(type) {
+	case *andNode:
+		for _, child := range n.children {
+			collectWords(child, words)
+		}
+	case *orNode:
+		for _, child := range n.children {
+			collectWords(child, words)
+		}
+	case *namespaceNode:
+		collectWords(n.child, words)
+	case *termNode:
+		words[n.term] = true
+	case *phraseNode:
+		for _, term := range n.terms {
+			words[term] = true
+		}
+	}
+}
+
+// wordShare is the share of words found among terms, 0 for no words
+func wordShare(words map[string]bool, terms []string) float64 {
+	if len(words) == 0 {
+		return 0
+	}
+	found := make(map[string]bool)
+	for _, term := range terms {
+		if words[term] {
+			found[term] = true
+		}
+	}
+	return float64(len(found)) / float64(len(words))
+}
@@ -0,0 +1,165 @@
+package documentstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// RestoreMode decides what happens to documents that are both in the
+// database and in the backup being restored
+type RestoreMode int
+
+const (
+	// RestoreReplace makes the database match the backup: a full backup
+	// replaces every document, deleting those it lacks, and an incremental
+	// one overwrites the documents it holds
+	RestoreReplace RestoreMode = iota
+	// RestoreSkipExisting only adds documents the database lacks
+	RestoreSkipExisting
+	// RestoreOverwriteOlder adds missing documents and overwrites those the
+	// backup holds a more recently updated copy of
+	RestoreOverwriteOlder
+	// RestoreFailOnConflict adds missing documents and restores nothing if
+	// any document in the backup differs from the database's copy
+	RestoreFailOnConflict
+)
+
+// RestoreOptions controls how a backup is restored into a live database
+type RestoreOptions struct {
+	Mode RestoreMode
+	// DryRun reports what the restore would change without changing anything
+	DryRun bool
+}
+
+// RestoreReport lists, by ID, what a restore changed or would change
+type RestoreReport struct {
+	Added     []string `json:"added,omitempty"`
+	Updated   []string `json:"updated,omitempty"`
+	Deleted   []string `json:"deleted,omitempty"`
+	Unchanged []string `json:"unchanged,omitempty"` // Skipped, or identical in both
+	Conflicts []string `json:"conflicts,omitempty"` // Only in RestoreFailOnConflict mode
+}
+
+// RestoreDatabase restores the database from a backup file. A full backup
+// replaces every document; an incremental one adds or overwrites the
+// documents it holds. Plain JSON backups from before the current format are
+// read as full backups.
+func (db *DocumentDB) RestoreDatabase(filePath string) error {
+	_, err := db.RestoreDatabaseWithOptions(filePath, RestoreOptions{})
+	return err
+}
+
+// RestoreDatabaseWithOptions validates a backup file and restores it as
+// options say, returning what changed. Nothing changes unless the whole
+// backup is valid and, in RestoreFailOnConflict mode, free of conflicts.
+func (db *DocumentDB) RestoreDatabaseWithOptions(filePath string, options RestoreOptions) (RestoreReport, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	defer file.Close()
+	return db.restore(file, filePath, options)
+}
+
+// restore restores the backup read from r, which name identifies in
+// messages
+func (db *DocumentDB) restore(r io.Reader, name string, options RestoreOptions) (RestoreReport, error) {
+	header, restoredDocs, err := readBackup(r)
+	if err != nil {
+		return RestoreReport{}, fmt.Errorf("failed to read backup %s: %w", name, err)
+	}
+
+	db.lockAll()
+	defer db.unlockAll()
+
+	report, batch, err := db.planRestoreLocked(restoredDocs, !header.Since.IsZero(), options.Mode)
+	if err != nil {
+		return report, err
+	}
+	if options.DryRun {
+		logger.Info("Restore dry run", "backup", name,
+			"added", len(report.Added), "updated", len(report.Updated), "deleted", len(report.Deleted))
+		return report, nil
+	}
+	if err := db.engine.Write(batch); err != nil {
+		return report, err
+	}
+
+	for _, id := range batch.Deletes {
+		s := db.shardFor(id)
+		db.removeLocked(s, id)
+		delete(s.history, id)
+	}
+	for _, doc := range batch.Puts {
+		s := db.shardFor(doc.ID)
+		delete(s.history, doc.ID)
+		db.putLocked(s, doc)
+	}
+	logger.Info("Database restored", "backup", name)
+	return report, nil
+}
+
+// planRestoreLocked works out the writes restoring docs takes; callers hold
+// every shard's lock
+func (db *DocumentDB) planRestoreLocked(docs map[string]*Document, incremental bool, mode RestoreMode) (RestoreReport, Batch, error) {
+	var report RestoreReport
+	var batch Batch
+	for _, id := range sortedKeys(docs) {
+		doc := docs[id]
+		existing, exists := db.lookupLocked(id)
+		switch {
+		case !exists:
+			report.Added = append(report.Added, id)
+		case sameDocument(existing, doc):
+			report.Unchanged = append(report.Unchanged, id)
+			continue
+		case mode == RestoreReplace,
+			mode == RestoreOverwriteOlder && doc.UpdatedAt.After(existing.UpdatedAt):
+			report.Updated = append(report.Updated, id)
+		case mode == RestoreFailOnConflict:
+			report.Conflicts = append(report.Conflicts, id)
+			continue
+		default:
+			report.Unchanged = append(report.Unchanged, id)
+			continue
+		}
+		batch.Puts = append(batch.Puts, doc)
+	}
+
+	if mode == RestoreReplace && !incremental {
+		var deleted []string
+		for _, s := range db.shards {
+			for id := range s.documents {
+				if _, kept := docs[id]; !kept {
+					deleted = append(deleted, id)
+				}
+			}
+		}
+		sort.Strings(deleted)
+		report.Deleted = deleted
+		batch.Deletes = deleted
+	}
+	if len(report.Conflicts) > 0 {
+		return report, Batch{}, fmt.Errorf("backup conflicts with %d documents: %s",
+			len(report.Conflicts), strings.Join(report.Conflicts, ", "))
+	}
+	return report, batch, nil
+}
+
+// sameDocument reports whether two copies of a document hold the same
+// version and fields
+func sameDocument(a, b *Document) bool {
+	return a.Version == b.Version && a.UpdatedAt.Equal(b.UpdatedAt) && !changed(a, b)
+}
+
+func sortedKeys(docs map[string]*Document) []string {
+	ids := make([]string, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,266 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FieldType is the kind of value a metadata field holds. Metadata values
+// are strings, so a type constrains how the string must read.
+type FieldType string
+
+// Metadata field types
+const (
+	TypeString FieldType = "string"
+	TypeInt    FieldType = "int"  // A base 10 integer such as "-42"
+	TypeDate   FieldType = "date" // RFC 3339, or a plain date such as "2024-05-01"
+	TypeGeo    FieldType = "geo"  // Latitude and longitude in degrees, as "52.37,4.89"
+)
+
+// FieldRule constrains one metadata field
+type FieldRule struct {
+	Type     FieldType // Empty means TypeString
+	Required bool
+	// Values, if set, lists the only values allowed
+	Values []string
+	// Pattern, if set, is a regular expression the whole value must match
+	Pattern string
+	// MaxLength, if positive, bounds the value's length in characters
+	MaxLength int
+	// Min and Max, if set, bound TypeInt values
+	Min, Max *int64
+}
+
+// Schema describes the documents a database accepts. AddDocument, the
+// update methods and Bulk reject documents that break it with a
+// *ValidationError; documents already stored, and those restored from a
+// backup, aren't checked.
+type Schema struct {
+	Fields         map[string]FieldRule // Rules by metadata key
+	RequireTitle   bool
+	RequireContent bool
+	// Strict rejects metadata keys that Fields doesn't list
+	Strict bool
+}
+
+// FieldError is one way a document breaks its schema
+type FieldError struct {
+	Field  string `json:"field"` // A metadata key, or "title" or "content"
+	Reason string `json:"reason"`
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// ValidationError lists every way a document breaks the schema, ordered by
+// field
+type ValidationError struct {
+	ID     string       `json:"id"`
+	Fields []FieldError `json:"fields"`
+}
+
+// Is makes every ValidationError match ErrInvalidDocument
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidDocument
+}
+
+func (e *ValidationError) Error() string {
+	reasons := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		reasons[i] = f.Error()
+	}
+	return fmt.Sprintf("document %s is invalid: %s", e.ID, strings.Join(reasons, "; "))
+}
+
+// compiledSchema is a Schema with its patterns compiled
+type compiledSchema struct {
+	Schema
+	patterns map[string]*regexp.Regexp
+}
+
+// SetSchema makes the database validate documents against schema from now
+// on; nil turns validation off. It fails if a rule is malformed, and with
+// a *MappingError if it retypes a field in a way its index or its stored
+// values don't allow. Fields added to the schema, or whose rules change
+// but not their type, take effect without touching stored documents; to
+// index an added field, use BuildIndex.
+func (db *DocumentDB) SetSchema(schema *Schema) error {
+	var compiled *compiledSchema
+	if schema != nil {
+		var err error
+		if compiled, err = compileSchema(*schema); err != nil {
+			return err
+		}
+	}
+	// The shards stay locked until the schema is swapped, so no write
+	// lands in between the check and the swap
+	db.rlockAll()
+	defer db.runlockAll()
+	if err := db.checkMappingLocked(db.currentSchema(), compiled); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.schema = compiled
+	return nil
+}
+
+// Schema returns the schema documents are validated against, or nil
+func (db *DocumentDB) Schema() *Schema {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.schema == nil {
+		return nil
+	}
+	schema := db.schema.Schema
+	return &schema
+}
+
+// currentSchema returns the compiled schema, or nil
+func (db *DocumentDB) currentSchema() *compiledSchema {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.schema
+}
+
+func compileSchema(schema Schema) (*compiledSchema, error) {
+	fields := make(map[string]FieldRule, len(schema.Fields))
+	patterns := make(map[string]*regexp.Regexp)
+	for key, rule := range schema.Fields {
+		switch rule.Type {
+		case "":
+			rule.Type = TypeString
+		case TypeString, TypeInt, TypeDate, TypeGeo:
+		default:
+			return nil, fmt.Errorf("field %s has unknown type %q", key, rule.Type)
+		}
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return nil, fmt.Errorf("field %s has a minimum above its maximum", key)
+		}
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("field %s has an invalid pattern: %w", key, err)
+			}
+			patterns[key] = pattern
+		}
+		fields[key] = rule
+	}
+	schema.Fields = fields
+	return &compiledSchema{Schema: schema, patterns: patterns}, nil
+}
+
+// validate returns a *ValidationError if doc breaks the schema. A nil
+// schema accepts everything.
+func (s *compiledSchema) validate(doc *Document) error {
+	if s == nil {
+		return nil
+	}
+	var problems []FieldError
+	if s.RequireTitle && strings.TrimSpace(doc.Title) == "" {
+		problems = append(problems, FieldError{FieldTitle, "is required"})
+	}
+	if s.RequireContent && strings.TrimSpace(doc.Content) == "" {
+		problems = append(problems, FieldError{FieldContent, "is required"})
+	}
+	for key, rule := range s.Fields {
+		value, ok := doc.Metadata[key]
+		if !ok {
+			if rule.Required {
+				problems = append(problems, FieldError{key, "is required"})
+			}
+			continue
+		}
+		if reason := s.check(key, rule, value); reason != "" {
+			problems = append(problems, FieldError{key, reason})
+		}
+	}
+	if s.Strict {
+		for key := range doc.Metadata {
+			if _, known := s.Fields[key]; !known {
+				problems = append(problems, FieldError{key, "is not in the schema"})
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Field < problems[j].Field })
+	return &ValidationError{ID: doc.ID, Fields: problems}
+}
+
+// check returns why value breaks rule, or "" if it doesn't
+func (s *compiledSchema) check(key string, rule FieldRule, value string) string {
+	switch rule.Type {
+	case TypeInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Sprintf("%q is not an integer", value)
+		}
+		if rule.Min != nil && n < *rule.Min {
+			return fmt.Sprintf("%d is below the minimum %d", n, *rule.Min)
+		}
+		if rule.Max != nil && n > *rule.Max {
+			return fmt.Sprintf("%d is above the maximum %d", n, *rule.Max)
+		}
+	case TypeDate:
+		if _, err := parseDate(value); err != nil {
+			return fmt.Sprintf("%q is not a date", value)
+		}
+	case TypeGeo:
+		if _, _, err := parseGeo(value); err != nil {
+			return fmt.Sprintf("%q is not a location: %v", value, err)
+		}
+	}
+	if rule.MaxLength > 0 && utf8.RuneCountInString(value) > rule.MaxLength {
+		return fmt.Sprintf("is longer than %d characters", rule.MaxLength)
+	}
+	if len(rule.Values) > 0 && !containsString(rule.Values, value) {
+		return fmt.Sprintf("%q is not one of %s", value, strings.Join(rule.Values, ", "))
+	}
+	if pattern := s.patterns[key]; pattern != nil && !pattern.MatchString(value) {
+		return fmt.Sprintf("%q does not match %s", value, rule.Pattern)
+	}
+	return ""
+}
+
+// parseDate reads a TypeDate value
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// parseGeo reads a TypeGeo value as latitude and longitude
+func parseGeo(value string) (float64, float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("want latitude,longitude")
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || !(lat >= -90 && lat <= 90) {
+		return 0, 0, errors.New("latitude must be between -90 and 90")
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || !(lon >= -180 && lon <= 180) {
+		return 0, 0, errors.New("longitude must be between -180 and 180")
+	}
+	return lat, lon, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package documentstore
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ScoringModel is the relevance function ranking search results
+type ScoringModel int
+
+const (
+	// BM25 saturates term frequency and normalizes for field length
+	BM25 ScoringModel = iota
+	// TFIDF weighs log-scaled term frequency by inverse document frequency
+	TFIDF
+)
+
+// ScoringConfig tunes how search results are ranked
+type ScoringConfig struct {
+	Model ScoringModel
+	K1    float64 // BM25 term frequency saturation; higher lets repeats count longer
+	B     float64 // BM25 length normalization, from 0 (none) to 1 (full)
+	// FieldBoosts weighs matches by the field they occur in; fields without
+	// a boost count once
+	FieldBoosts map[string]float64
+	// MetadataBoosts weighs numeric metadata, such as the scores RunPageRank
+	// stores under PageRankKey, into relevance: a score is multiplied by
+	// 1 + weight × ln(1 + value). Missing, negative and non-numeric values
+	// leave it as it is.
+	MetadataBoosts map[string]float64
+	// Scorer, if set, computes the final score from the text relevance and
+	// the document, in place of MetadataBoosts
+	Scorer Scorer
+}
+
+// DefaultScoringConfig ranks with BM25 and counts title matches twice
+var DefaultScoringConfig = ScoringConfig{
+	Model:       BM25,
+	K1:          1.2,
+	B:           0.75,
+	FieldBoosts: map[string]float64{FieldTitle: 2, FieldContent: 1},
+}
+
+// SearchResult is a matching document with its relevance score
+type SearchResult struct {
+	Document *Document `json:"document"`
+	Score    float64   `json:"score"`
+}
+
+// SetScoring changes how search results are ranked
+func (db *DocumentDB) SetScoring(config ScoringConfig) {
+	db.mutex.Lock()
+	db.scoring = config
+	db.mutex.Unlock()
+	db.results.invalidate()
+}
+
+// scoringConfig returns the current scoring settings
+func (db *DocumentDB) scoringConfig() ScoringConfig {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.scoring
+}
+
+// hit is a matching document and the shard holding it
+type hit struct {
+	shard *shard
+	id    string
+}
+
+// corpusStats are the collection-wide counts relevance depends on, summed
+// over the shards so scores don't depend on where a document lands
+type corpusStats struct {
+	docs   float64
+	df     map[string]float64 // Term to documents containing it
+	totals map[string]float64 // Field to tokens across documents
+}
+
+// searchShards runs match on every shard under a consistent read lock and
+// ranks the matches for the index terms match reports. Once d passes the
+// remaining shards are skipped, and the matches found are ranked as far as
+// time allows.
+func (db *DocumentDB) searchShards(d *deadline, match func(s *shard) (ids, terms []string)) []SearchResult {
+	config := db.scoringConfig()
+	db.rlockAll()
+	defer db.runlockAll()
+
+	var hits []hit
+	var terms []string
+	seen := make(map[string]bool)
+	for _, s := range db.shards {
+		if d.expired() {
+			break
+		}
+		ids, shardTerms := match(s)
+		for _, id := range ids {
+			hits = append(hits, hit{shard: s, id: id})
+		}
+		for _, term := range shardTerms {
+			if !seen[term] {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+	return rankLocked(hits, terms, config, db.corpusStatsLocked(terms), d)
+}
+
+// corpusStatsLocked sums the counts for terms over the shards; callers hold
+// every shard's read lock
+func (db *DocumentDB) corpusStatsLocked(terms []string) corpusStats {
+	stats := corpusStats{df: make(map[string]float64), totals: make(map[string]float64)}
+	for _, s := range db.shards {
+		stats.docs += float64(len(s.text.live))
+		for _, term := range terms {
+			stats.df[term] += float64(s.text.df[term])
+		}
+		for field, total := range s.text.totals {
+			stats.totals[field] += float64(total)
+		}
+	}
+	return stats
+}
+
+// rankLocked scores the matching documents for terms and orders them best
+// first, breaking ties by ID; callers hold the matches' shard locks. Once d
+// passes, the hits not yet scored are kept with a score of 0.
+func rankLocked(hits []hit, terms []string, config ScoringConfig, stats corpusStats, d *deadline) []SearchResult {
+	now := time.Now()
+	results := make([]SearchResult, 0, len(hits))
+	for _, h := range hits {
+		doc := h.shard.documents[h.id]
+		if d.step() {
+			results = append(results, SearchResult{Document: doc})
+			continue
+		}
+		relevance := h.shard.text.score(h.id, terms, config, stats)
+		score := relevance * metadataBoost(doc, config.MetadataBoosts)
+		if config.Scorer != nil {
+			score = config.Scorer.Score(ScoreContext{Document: doc, Relevance: relevance, Now: now})
+		}
+		results = append(results, SearchResult{Document: doc, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Document.ID < results[j].Document.ID
+	})
+	return results
+}
+
+// score sums the relevance of each term to a document across its fields
+func (idx *invertedIndex) score(id string, terms []string, config ScoringConfig, stats corpusStats) float64 {
+	score := 0.0
+	for _, term := range terms {
+		p := idx.posting(term, id)
+		if p == nil {
+			continue
+		}
+		for _, field := range textFields {
+			if tf := p.frequency(field); tf > 0 {
+				score += fieldScore(config, stats, stats.df[term], field, tf, idx.length(id, field))
+			}
+		}
+	}
+	return score
+}
+
+// fieldScore is the relevance of a term occurring tf times in a field of
+// the given length, where df documents hold the term. It grows with tf and
+// shrinks with length, which lets top-k searches bound it.
+func fieldScore(config ScoringConfig, stats corpusStats, df float64, field string, tf, length int) float64 {
+	docs := stats.docs
+	boost, ok := config.FieldBoosts[field]
+	if !ok {
+		boost = 1
+	}
+	frequency := float64(tf)
+	switch config.Model {
+	case TFIDF:
+		return boost * (1 + math.Log(frequency)) * math.Log(1+docs/df)
+	default:
+		idf := math.Log(1 + (docs-df+0.5)/(df+0.5))
+		norm := 1.0
+		if average := stats.totals[field] / docs; average > 0 {
+			norm = 1 - config.B + config.B*float64(length)/average
+		}
+		return boost * idf * frequency * (config.K1 + 1) / (frequency + config.K1*norm)
+	}
+}
+
+// metadataBoost is the factor MetadataBoosts applies to a document's score
+func metadataBoost(doc *Document, boosts map[string]float64) float64 {
+	factor := 1.0
+	for key, weight := range boosts {
+		value, err := strconv.ParseFloat(doc.Metadata[key], 64)
+		if err != nil || value <= 0 || math.IsInf(value, 0) {
+			continue
+		}
+		factor *= 1 + weight*math.Log1p(value)
+	}
+	return factor
+}
+
+// resultDocuments strips the scores from ranked results
+func resultDocuments(results []SearchResult) []*Document {
+	docs := make([]*Document, len(results))
+	for i, result := range results {
+		docs[i] = result.Document
+	}
+	return docs
+}
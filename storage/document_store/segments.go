@@ -0,0 +1,295 @@
+package documentstore
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SegmentOptions tunes how the full-text index is split into segments
+type SegmentOptions struct {
+	// FlushDocs is how many documents the in-memory buffer takes before it
+	// is flushed into a segment
+	FlushDocs int
+	// MergeFactor is how many segments of about the same size are merged
+	// into one in the background. Segments grow by this factor from one
+	// merge to the next, so a shard holds about MergeFactor segments per
+	// order of magnitude of its size.
+	MergeFactor int
+}
+
+// DefaultSegmentOptions flushes every 1000 documents and merges ten
+// segments at a time
+var DefaultSegmentOptions = SegmentOptions{FlushDocs: 1000, MergeFactor: 10}
+
+// SegmentStats describes the segments of the full-text index across shards
+type SegmentStats struct {
+	Segments int    `json:"segments"` // Flushed segments
+	Buffered int    `json:"buffered"` // Documents in the in-memory buffers
+	Deleted  int    `json:"deleted"`  // Tombstones the next merges will drop
+	Merges   uint64 `json:"merges"`   // Merges completed since the database opened
+}
+
+// segment is a part of the full-text index. Once flushed from the buffer
+// it never changes but for tombstones, which are only ever appended, so it
+// can be read without the shard's lock.
+type segment struct {
+	postings map[string]map[string]*posting // Term to document ID to posting
+	docTerms map[string][]string            // Document ID to its distinct terms
+	lengths  map[string]map[string]int      // Document ID to field to token count
+	deleted  []string                       // Documents removed since the segment was flushed
+
+	listMutex sync.Mutex              // Guards lists, which searches build under a read lock
+	lists     map[string]*postingList // Term to its postings in ID order, built on demand
+}
+
+func newSegment() *segment {
+	return &segment{
+		postings: make(map[string]map[string]*posting),
+		docTerms: make(map[string][]string),
+		lengths:  make(map[string]map[string]int),
+	}
+}
+
+// drop removes a document outright, which only the buffer allows
+func (seg *segment) drop(id string) {
+	for _, term := range seg.docTerms[id] {
+		delete(seg.postings[term], id)
+		if len(seg.postings[term]) == 0 {
+			delete(seg.postings, term)
+		}
+	}
+	delete(seg.docTerms, id)
+	delete(seg.lengths, id)
+}
+
+// size counts the segment's documents that haven't been deleted
+func (seg *segment) size() int {
+	return len(seg.docTerms) - len(seg.deleted)
+}
+
+// flush freezes the buffer into a segment and starts a new one
+func (idx *invertedIndex) flush() {
+	if len(idx.buffer.docTerms) == 0 {
+		return
+	}
+	idx.segments = append(idx.segments, idx.buffer)
+	idx.buffer = newSegment()
+}
+
+// segmentView is a segment as it was at some point: its tombstones then
+type segmentView struct {
+	seg     *segment
+	deleted map[string]bool
+}
+
+// indexReader is a point-in-time view of flushed segments. It can be read
+// without the shard's lock and doesn't see later changes, since segments
+// are immutable and their tombstones only grow.
+type indexReader struct {
+	views []segmentView
+}
+
+// newIndexReader returns a point-in-time view of segs; callers hold the
+// shard's lock
+func newIndexReader(segs []*segment) *indexReader {
+	r := &indexReader{views: make([]segmentView, len(segs))}
+	for i, seg := range segs {
+		deleted := make(map[string]bool, len(seg.deleted))
+		for _, id := range seg.deleted {
+			deleted[id] = true
+		}
+		r.views[i] = segmentView{seg: seg, deleted: deleted}
+	}
+	return r
+}
+
+// readerLocked flushes the buffer and returns a point-in-time view of the
+// whole index; callers hold the shard's write lock
+func (idx *invertedIndex) readerLocked() *indexReader {
+	idx.flush()
+	return newIndexReader(idx.segments)
+}
+
+// merge writes the live documents of every segment in the reader into one
+// new segment. Postings are shared, not copied, as neither side changes
+// them.
+func (r *indexReader) merge() *segment {
+	merged := newSegment()
+	for _, view := range r.views {
+		for id, terms := range view.seg.docTerms {
+			if view.deleted[id] {
+				continue
+			}
+			merged.docTerms[id] = terms
+			merged.lengths[id] = view.seg.lengths[id]
+			for _, term := range terms {
+				docs, ok := merged.postings[term]
+				if !ok {
+					docs = make(map[string]*posting)
+					merged.postings[term] = docs
+				}
+				docs[id] = view.seg.postings[term][id]
+			}
+		}
+	}
+	return merged
+}
+
+// mergeCandidates picks segments to merge, or nil if none need it: the
+// smallest tier holding MergeFactor segments, or else the first segment
+// that is mostly tombstones. Tiers group segments within a factor of
+// MergeFactor of each other's size.
+func (idx *invertedIndex) mergeCandidates() []*segment {
+	tiers := make(map[int][]*segment)
+	lowest := -1
+	for _, seg := range idx.segments {
+		tier := 0
+		for limit := idx.options.FlushDocs * idx.options.MergeFactor; seg.size() >= limit; limit *= idx.options.MergeFactor {
+			tier++
+		}
+		tiers[tier] = append(tiers[tier], seg)
+		if len(tiers[tier]) >= idx.options.MergeFactor && (lowest < 0 || tier < lowest) {
+			lowest = tier
+		}
+	}
+	if lowest >= 0 {
+		return tiers[lowest]
+	}
+	for _, seg := range idx.segments {
+		if len(seg.deleted) > len(seg.docTerms)/2 {
+			return []*segment{seg}
+		}
+	}
+	return nil
+}
+
+// commitMerge replaces the segments read by r with merged, reporting false
+// if any of them is gone. Documents deleted since r was taken are
+// tombstoned in merged; callers hold the shard's write lock.
+func (idx *invertedIndex) commitMerge(r *indexReader, merged *segment) bool {
+	sources := make(map[*segment]bool, len(r.views))
+	for _, view := range r.views {
+		sources[view.seg] = true
+	}
+	kept := make([]*segment, 0, len(idx.segments))
+	for _, seg := range idx.segments {
+		if !sources[seg] {
+			kept = append(kept, seg)
+		}
+	}
+	if len(kept)+len(r.views) != len(idx.segments) {
+		return false
+	}
+	for _, view := range r.views {
+		for _, id := range view.seg.deleted[len(view.deleted):] {
+			merged.deleted = append(merged.deleted, id)
+		}
+	}
+	for id := range merged.docTerms {
+		if sources[idx.live[id]] {
+			idx.live[id] = merged
+		}
+	}
+	if len(merged.docTerms) > 0 {
+		kept = append(kept, merged)
+	}
+	idx.segments = kept
+	return true
+}
+
+// mergeLocked starts merging a shard's segments in the background if its
+// index asks for it and isn't merging already. The merge reads a
+// point-in-time view, so writes and searches carry on meanwhile; only
+// swapping the result in takes the shard's lock. Callers hold the shard's
+// write lock.
+func (db *DocumentDB) mergeLocked(s *shard) {
+	idx := s.text
+	if idx.merging {
+		return
+	}
+	candidates := idx.mergeCandidates()
+	if candidates == nil {
+		return
+	}
+	idx.merging = true
+	r := newIndexReader(candidates)
+	db.merges.Add(1)
+	go func() {
+		defer db.merges.Done()
+		merged := r.merge()
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		idx.merging = false
+		// The index is replaced wholesale when the analysis changes
+		if s.text != idx {
+			return
+		}
+		if idx.commitMerge(r, merged) {
+			atomic.AddUint64(&db.merged, 1)
+		}
+		db.mergeLocked(s)
+	}()
+}
+
+// SetSegmentOptions changes how the full-text index is split into
+// segments. Zero fields take their DefaultSegmentOptions value. It applies
+// to the buffers and merges from now on; existing segments stay as they
+// are until merged.
+func (db *DocumentDB) SetSegmentOptions(options SegmentOptions) {
+	if options.FlushDocs <= 0 {
+		options.FlushDocs = DefaultSegmentOptions.FlushDocs
+	}
+	if options.MergeFactor < 2 {
+		options.MergeFactor = DefaultSegmentOptions.MergeFactor
+	}
+	db.lockAll()
+	defer db.unlockAll()
+
+	db.mutex.Lock()
+	db.segmentOptions = options
+	db.mutex.Unlock()
+
+	for _, s := range db.shards {
+		s.text.options = options
+		db.mergeLocked(s)
+	}
+}
+
+// currentSegmentOptions returns the segment settings
+func (db *DocumentDB) currentSegmentOptions() SegmentOptions {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.segmentOptions
+}
+
+// ForceMerge flushes every shard's buffer and merges its segments into one,
+// dropping every tombstone. Writes to a shard wait while it is merged.
+func (db *DocumentDB) ForceMerge() {
+	for _, s := range db.shards {
+		s.mutex.Lock()
+		idx := s.text
+		r := idx.readerLocked()
+		if len(r.views) > 1 || len(r.views) == 1 && len(r.views[0].deleted) > 0 {
+			if idx.commitMerge(r, r.merge()) {
+				atomic.AddUint64(&db.merged, 1)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// SegmentStats returns the state of the full-text index's segments
+func (db *DocumentDB) SegmentStats() SegmentStats {
+	db.rlockAll()
+	defer db.runlockAll()
+	stats := SegmentStats{Merges: atomic.LoadUint64(&db.merged)}
+	for _, s := range db.shards {
+		stats.Segments += len(s.text.segments)
+		stats.Buffered += len(s.text.buffer.docTerms)
+		for _, seg := range s.text.segments {
+			stats.Deleted += len(seg.deleted)
+		}
+	}
+	return stats
+}
@@ -0,0 +1,95 @@
+package documentstore
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// DefaultShards is how many shards NewDocumentDB and OpenDocumentDB split
+// the documents into
+const DefaultShards = 16
+
+// shard holds the documents whose IDs hash to it, with their indexes and
+// history, under its own lock. Writes to different shards don't wait for
+// each other; operations spanning documents lock the shards in order.
+type shard struct {
+	documents map[string]*Document
+	indexes   map[string]*fieldIndex // Secondary indexes by metadata key
+	// Indexes BuildIndex is backfilling, kept current with writes but not
+	// yet searched
+	building map[string]*fieldIndex
+	text     *invertedIndex
+	history  map[string][]*Document // Previous versions by ID, oldest first
+	trash    map[string]*Document   // Tombstones of soft-deleted documents by ID
+	// What each namespace holds in the shard, for scoping and quotas
+	namespaces map[string]*namespaceUsage
+	mutex      sync.RWMutex
+}
+
+func newShard(options SegmentOptions) *shard {
+	return &shard{
+		documents:  make(map[string]*Document),
+		indexes:    make(map[string]*fieldIndex),
+		building:   make(map[string]*fieldIndex),
+		text:       newInvertedIndex(options),
+		history:    make(map[string][]*Document),
+		trash:      make(map[string]*Document),
+		namespaces: make(map[string]*namespaceUsage),
+	}
+}
+
+// shardFor returns the shard a document ID belongs to
+func (db *DocumentDB) shardFor(id string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return db.shards[h.Sum32()%uint32(len(db.shards))]
+}
+
+// rlockAll read-locks every shard, in order, for a consistent view across
+// them
+func (db *DocumentDB) rlockAll() {
+	for _, s := range db.shards {
+		s.mutex.RLock()
+	}
+}
+
+func (db *DocumentDB) runlockAll() {
+	for _, s := range db.shards {
+		s.mutex.RUnlock()
+	}
+}
+
+// lockAll write-locks every shard, in order
+func (db *DocumentDB) lockAll() {
+	for _, s := range db.shards {
+		s.mutex.Lock()
+	}
+}
+
+func (db *DocumentDB) unlockAll() {
+	for _, s := range db.shards {
+		s.mutex.Unlock()
+	}
+}
+
+// snapshot returns every document. Shards are locked one at a time, so
+// the result may miss changes made while it was taken, but the documents
+// themselves can be read without locking since they are never modified.
+func (db *DocumentDB) snapshot() []*Document {
+	var docs []*Document
+	for _, s := range db.shards {
+		s.mutex.RLock()
+		for _, doc := range s.documents {
+			docs = append(docs, doc)
+		}
+		s.mutex.RUnlock()
+	}
+	return docs
+}
+
+// lookupLocked returns a document from any shard; callers hold every
+// shard's lock
+func (db *DocumentDB) lookupLocked(id string) (*Document, bool) {
+	doc, exists := db.shardFor(id).documents[id]
+	return doc, exists
+}
@@ -0,0 +1,41 @@
+package documentstore_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	documentstore "storage/document_store"
+)
+
+// Benchmark concurrent writers adding and then updating documents, all in
+// one shard against spread over the default number of shards
+func BenchmarkShardedWrites(b *testing.B) {
+	for _, shards := range []int{1, documentstore.DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			db, err := documentstore.OpenShardedDocumentDB(documentstore.NewMemoryEngine(), shards)
+			if err != nil {
+				b.Fatalf("Failed to open database: %v", err)
+			}
+			defer db.Close()
+
+			var next atomic.Uint64
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id := fmt.Sprintf("doc%d", next.Add(1))
+					doc := &documentstore.Document{ID: id, Title: "Document " + id, Content: "the quick brown fox jumps over the lazy dog"}
+					if err := db.AddDocument(doc); err != nil {
+						b.Errorf("Failed to add document: %v", err)
+						return
+					}
+					if err := db.UpdateDocument(id, "the lazy dog sleeps through the quick brown fox"); err != nil {
+						b.Errorf("Failed to update document: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package documentstore
+
+import (
+	"html"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// DefaultSnippetLength is how many characters of content a snippet shows
+// unless told otherwise
+const DefaultSnippetLength = 160
+
+// Snippet returns a passage of about length characters of a document's
+// content holding as many words matching query as fit, for showing under a
+// search result; 0 means DefaultSnippetLength. It is HTML: the text is
+// escaped and matching words are wrapped in <em>, with an ellipsis where
+// the passage cuts the content short. Words match as the query matches
+// them in content, analyzed as the document was; negated words and
+// metadata clauses aren't highlighted. A query that doesn't parse
+// highlights nothing.
+func (db *DocumentDB) Snippet(doc *Document, query string, length int) string {
+	if length <= 0 {
+		length = DefaultSnippetLength
+	}
+	analyzer := db.currentAnalysis().analyzerFor(doc)
+	var m snippetMatcher
+	if q, err := ParseQuery(query); err == nil {
+		if root := q.root.bind(analyzer); root != nil {
+			m.collect(root)
+		}
+	}
+
+	text := []rune(doc.Content)
+	words := snippetWords(text)
+	for i := range words {
+		words[i].match = m.matches(analyzer.Analyze(string(text[words[i].start:words[i].end])))
+	}
+	start, end := snippetWindow(words, len(text), length)
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("… ")
+	}
+	at := start
+	for _, w := range words {
+		if w.start < start || w.end > end || !w.match {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(text[at:w.start])))
+		b.WriteString("<em>" + html.EscapeString(string(text[w.start:w.end])) + "</em>")
+		at = w.end
+	}
+	b.WriteString(html.EscapeString(string(text[at:end])))
+	if end < len(text) {
+		b.WriteString(" …")
+	}
+	return b.String()
+}
+
+// snippetMatcher holds the query words to highlight, as bound to the
+// document's analyzer
+type snippetMatcher struct {
+	terms    map[string]bool
+	patterns []string
+	fuzzy    []*fuzzyNode
+}
+
+// collect gathers the words of a bound plan that match in content, leaving
+// out negated ones
+func (m *snippetMatcher) collect(node planNode) {
+	switch n := node.(type) {
+	case *andNode:
+		for _, child := range n.children {
+			m.collect(child)
+		}
+	case *orNode:
+		for _, child := range n.children {
+			m.collect(child)
+		}
+	case *termNode:
+		if inContent(n.fields) {
+			m.addTerms(n.term)
+		}
+	case *phraseNode:
+		if inContent(n.fields) {
+			m.addTerms(n.terms...)
+		}
+	case *wildcardNode:
+		if inContent(n.fields) {
+			m.patterns = append(m.patterns, n.pattern)
+		}
+	case *fuzzyNode:
+		if inContent(n.fields) {
+			m.fuzzy = append(m.fuzzy, n)
+		}
+	}
+}
+
+func (m *snippetMatcher) addTerms(terms ...string) {
+	if m.terms == nil {
+		m.terms = make(map[string]bool)
+	}
+	for _, term := range terms {
+		m.terms[term] = true
+	}
+}
+
+// matches reports whether any of a word's terms is one to highlight
+func (m *snippetMatcher) matches(terms []string) bool {
+	for _, term := range terms {
+		if m.terms[term] {
+			return true
+		}
+		for _, pattern := range m.patterns {
+			if matched, _ := path.Match(pattern, term); matched {
+				return true
+			}
+		}
+		for _, n := range m.fuzzy {
+			if withinEdits(n.term, term, maxEdits(n.term, n.edits)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func inContent(fields []string) bool {
+	for _, field := range fields {
+		if field == FieldContent {
+			return true
+		}
+	}
+	return false
+}
+
+// snippetWord is a run of letters and digits in content, by rune offset
+type snippetWord struct {
+	start, end int
+	match      bool
+}
+
+// snippetWords splits text into words the way tokenize does, keeping
+// where they are
+func snippetWords(text []rune) []snippetWord {
+	var words []snippetWord
+	start := -1
+	for i, r := range text {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			words = append(words, snippetWord{start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, snippetWord{start: start, end: len(text)})
+	}
+	return words
+}
+
+// snippetWindow picks the stretch of about length runes of a text of size
+// runes holding the most matching words, starting a little before the
+// first of them and cut at word boundaries
+func snippetWindow(words []snippetWord, size, length int) (start, end int) {
+	if size <= length {
+		return 0, size
+	}
+	// The window leads in to its first match with a few words of context
+	lead := length / 4
+	best, bestCount := -1, 0
+	for i, w := range words {
+		if !w.match {
+			continue
+		}
+		count := 0
+		for _, other := range words[i:] {
+			if other.end > w.start+length-lead {
+				break
+			}
+			if other.match {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = i, count
+		}
+	}
+	if best > 0 {
+		start = words[best].start
+		for i := best - 1; i >= 0 && words[best].start-words[i].start <= lead; i-- {
+			start = words[i].start
+		}
+	}
+	end = start + length
+	if end >= size {
+		return start, size
+	}
+	for i := len(words) - 1; i >= 0; i-- {
+		if words[i].end <= end && words[i].start >= start {
+			return start, words[i].end
+		}
+	}
+	return start, end
+}
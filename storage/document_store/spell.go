@@ -0,0 +1,314 @@
+package documentstore
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// DefaultSuggestBelow is how few matches make SearchPage suggest a
+// corrected query unless told otherwise
+const DefaultSuggestBelow = 3
+
+// correctionGain is how many times more documents a correction must match
+// than the word it replaces, so rare but real words aren't "corrected"
+const correctionGain = 10
+
+// bkNode is a node of a BK-tree: every child's term is the key's distance
+// away from the node's term, so a search only visits children whose
+// distance can be within reach
+type bkNode struct {
+	term     string
+	children map[int]*bkNode
+}
+
+// spellIndex is a BK-tree over the indexed vocabulary across shards. It is
+// built on first use and then grows as documents bring new terms. Terms
+// that leave the index stay in the tree until it is rebuilt, so matches are
+// checked against the shards. Its lock is taken after any shard's.
+type spellIndex struct {
+	mutex sync.Mutex
+	root  *bkNode // Nil until built
+	size  int
+	stale int // Terms that may have left the index since it was built
+}
+
+// add inserts a term new to a shard, once the tree is built
+func (si *spellIndex) add(term string) {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+	if si.root != nil {
+		si.insertLocked(term)
+	}
+}
+
+// forget notes that a term left a shard, and may have left the index
+func (si *spellIndex) forget() {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+	if si.root != nil {
+		si.stale++
+	}
+}
+
+// reset drops the tree, to be rebuilt on next use
+func (si *spellIndex) reset() {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+	si.root, si.size, si.stale = nil, 0, 0
+}
+
+func (si *spellIndex) insertLocked(term string) {
+	if si.root == nil {
+		si.root = &bkNode{term: term}
+		si.size = 1
+		return
+	}
+	node := si.root
+	for {
+		d := editDistance(term, node.term)
+		if d == 0 {
+			return
+		}
+		child, ok := node.children[d]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[int]*bkNode)
+			}
+			node.children[d] = &bkNode{term: term}
+			si.size++
+			return
+		}
+		node = child
+	}
+}
+
+// search returns the terms within max edits of word, with their distances
+func (si *spellIndex) search(word string, max int) map[string]int {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+	found := make(map[string]int)
+	if si.root == nil {
+		return found
+	}
+	stack := []*bkNode{si.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := editDistance(word, node.term)
+		if d <= max {
+			found[node.term] = d
+		}
+		for distance, child := range node.children {
+			if distance >= d-max && distance <= d+max {
+				stack = append(stack, child)
+			}
+		}
+	}
+	return found
+}
+
+// spellTermsLocked adds the terms a document brought to its shard to the
+// spell index; callers hold the shard's lock
+func (db *DocumentDB) spellTermsLocked(s *shard, id string) {
+	for _, term := range s.text.terms(id) {
+		if s.text.df[term] == 1 {
+			db.spelling.add(term)
+		}
+	}
+}
+
+// forgetTermsLocked notes the terms that leave a shard with a document,
+// before it is removed from the full-text index; callers hold the shard's
+// lock
+func (db *DocumentDB) forgetTermsLocked(s *shard, id string) {
+	for _, term := range s.text.terms(id) {
+		if s.text.df[term] == 1 {
+			db.spelling.forget()
+		}
+	}
+}
+
+// spellIndexLocked returns the spell index, building it from the shards'
+// vocabulary if it hasn't been yet or has grown too stale; callers hold
+// every shard's read lock
+func (db *DocumentDB) spellIndexLocked() *spellIndex {
+	si := db.spelling
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+	if si.root != nil && si.stale <= si.size/2 {
+		return si
+	}
+	si.root, si.size, si.stale = nil, 0, 0
+	for _, s := range db.shards {
+		for term := range s.text.df {
+			si.insertLocked(term)
+		}
+	}
+	return si
+}
+
+// documentFrequencyLocked counts the documents containing term across
+// shards; callers hold every shard's read lock
+func (db *DocumentDB) documentFrequencyLocked(term string) int {
+	df := 0
+	for _, s := range db.shards {
+		df += s.text.df[term]
+	}
+	return df
+}
+
+// analyzedFrequencyLocked counts the documents containing a query word as
+// the analyzer that finds it in the most documents reads it. It reports
+// false if every analyzer drops the word, as a stop word. Callers hold every
+// shard's read lock.
+func (db *DocumentDB) analyzedFrequencyLocked(analysis *Analysis, word string) (int, bool) {
+	most, searchable := 0, false
+	for _, analyzer := range analysis.analyzers() {
+		for _, term := range analyzer.Analyze(word) {
+			searchable = true
+			if df := db.documentFrequencyLocked(term); df > most {
+				most = df
+			}
+		}
+	}
+	return most, searchable
+}
+
+// correctLocked returns the best correction of a term found in df
+// documents: the indexed term fewest edits away, then in the most
+// documents, if it is in many more documents than term itself; callers hold
+// every shard's read lock
+func (db *DocumentDB) correctLocked(si *spellIndex, term string, df int) (string, bool) {
+	if utf8.RuneCountInString(term) < 3 {
+		return "", false
+	}
+	best, bestDistance, bestDF := "", 0, 0
+	for candidate, distance := range si.search(term, maxEdits(term, 0)) {
+		if distance == 0 {
+			continue
+		}
+		candidateDF := db.documentFrequencyLocked(candidate)
+		if candidateDF == 0 || candidateDF < correctionGain*df {
+			continue
+		}
+		if best == "" || distance < bestDistance ||
+			distance == bestDistance && (candidateDF > bestDF || candidateDF == bestDF && candidate < best) {
+			best, bestDistance, bestDF = candidate, distance, candidateDF
+		}
+	}
+	return best, best != ""
+}
+
+// SuggestQuery returns the query with misspelled words corrected to
+// indexed words a few edits away, as a "did you mean" suggestion. Only
+// words searched in text are corrected, not metadata values, wildcard
+// patterns or operators. Corrections are index terms, so under a stemming
+// analyzer they are stems, which search the same as the full words. It
+// reports false if it would change nothing.
+func (db *DocumentDB) SuggestQuery(query string) (string, bool) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return "", false
+	}
+	analysis := db.currentAnalysis()
+	db.rlockAll()
+	defer db.runlockAll()
+	si := db.spellIndexLocked()
+
+	changed := false
+	parts := make([]string, len(tokens))
+	for i, tok := range tokens {
+		if (tok.kind == tokenWord || tok.kind == tokenPhrase) && !strings.HasPrefix(tok.field, metadataFieldPrefix) &&
+			!(tok.kind == tokenWord && (isPattern(tok.text) || isFuzzy(tok.text))) {
+			terms := tokenize(tok.text)
+			corrected := false
+			for j, term := range terms {
+				df, searchable := db.analyzedFrequencyLocked(analysis, term)
+				if !searchable {
+					continue
+				}
+				if correction, ok := db.correctLocked(si, term, df); ok {
+					terms[j] = correction
+					corrected = true
+				}
+			}
+			if corrected {
+				tok.text = strings.Join(terms, " ")
+				if tok.kind == tokenWord && len(terms) > 1 {
+					tok.kind = tokenPhrase
+				}
+				changed = true
+			}
+		}
+		parts[i] = formatToken(tok)
+	}
+	if !changed {
+		return "", false
+	}
+	return strings.Join(parts, " "), true
+}
+
+// formatToken writes a token back as query text
+func formatToken(tok queryToken) string {
+	var prefix string
+	if tok.field != "" {
+		prefix = tok.field + ":"
+	}
+	switch tok.kind {
+	case tokenLParen:
+		return "("
+	case tokenRParen:
+		return ")"
+	case tokenPhrase:
+		return prefix + `"` + tok.text + `"`
+	case tokenWord:
+		return prefix + tok.text
+	}
+	return tok.text
+}
+
+// suggestFor fills in a page's suggestion if the query matched fewer than
+// below documents and a corrected query matches more
+func (db *DocumentDB) suggestFor(page *Page, query string, below int) {
+	if below == 0 {
+		below = DefaultSuggestBelow
+	}
+	if page.Total >= below {
+		return
+	}
+	suggestion, ok := db.SuggestQuery(query)
+	if !ok {
+		return
+	}
+	q, err := ParseQuery(suggestion)
+	if err != nil {
+		return
+	}
+	if len(db.Execute(q)) > page.Total {
+		page.Suggestion = suggestion
+	}
+}
+
+// editDistance returns the Levenshtein distance between a and b, counted
+// in runes
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,144 @@
+package documentstore
+
+import (
+	"sort"
+)
+
+// IndexStats describes what the database holds and how it is indexed, for
+// debugging relevance: IDF follows from document counts and document
+// frequencies, length normalization from average field lengths
+type IndexStats struct {
+	Documents  int    `json:"documents"` // Live, not counting the trash
+	Trashed    int    `json:"trashed"`
+	Shards     int    `json:"shards"`
+	Generation uint64 `json:"generation"` // Of the full-text index
+	// Terms is how many distinct terms the full-text index holds
+	Terms    int                   `json:"terms"`
+	Fields   map[string]FieldStats `json:"fields"`   // By text field
+	Metadata []MetadataStats       `json:"metadata"` // By key
+	// TopTerms are the terms held by the most documents, if asked for
+	TopTerms []TermStats  `json:"top_terms,omitempty"`
+	Segments SegmentStats `json:"segments"`
+}
+
+// FieldStats describes a text field across documents
+type FieldStats struct {
+	Tokens        int     `json:"tokens"`
+	AverageLength float64 `json:"average_length"` // Tokens per document
+}
+
+// MetadataStats describes a metadata key across documents
+type MetadataStats struct {
+	Key       string `json:"key"`
+	Documents int    `json:"documents"` // Holding the key
+	Values    int    `json:"values"`    // Distinct values
+	Indexed   bool   `json:"indexed"`   // Whether CreateIndex indexed it
+}
+
+// TermStats describes an index term across documents
+type TermStats struct {
+	Term              string `json:"term"`
+	DocumentFrequency int    `json:"document_frequency"` // Documents holding it
+	// Frequency is how often it occurs across documents and fields; only
+	// TermStats counts it
+	Frequency int `json:"frequency,omitempty"`
+}
+
+// IndexStats returns statistics of the database and its indexes, with the
+// topTerms terms held by the most documents. It looks at every document
+// and term, so it is for occasional debugging rather than monitoring.
+func (db *DocumentDB) IndexStats(topTerms int) IndexStats {
+	stats := IndexStats{
+		Shards:     len(db.shards),
+		Generation: db.IndexGeneration(),
+		Fields:     make(map[string]FieldStats),
+		Segments:   db.SegmentStats(),
+	}
+	indexed := make(map[string]bool)
+	for _, field := range db.Indexes() {
+		indexed[field[len(metadataFieldPrefix):]] = true
+	}
+
+	db.rlockAll()
+	indexedDocs := 0
+	df := make(map[string]int)
+	keys := make(map[string]*MetadataStats)
+	values := make(map[string]map[string]bool)
+	for _, s := range db.shards {
+		stats.Documents += len(s.documents)
+		indexedDocs += len(s.text.live)
+		stats.Trashed += len(s.trash)
+		for term, n := range s.text.df {
+			df[term] += n
+		}
+		for _, field := range textFields {
+			fs := stats.Fields[field]
+			fs.Tokens += s.text.totals[field]
+			stats.Fields[field] = fs
+		}
+		for _, doc := range s.documents {
+			for key, value := range doc.Metadata {
+				ks, exists := keys[key]
+				if !exists {
+					ks = &MetadataStats{Key: key, Indexed: indexed[key]}
+					keys[key] = ks
+					values[key] = make(map[string]bool)
+				}
+				ks.Documents++
+				values[key][value] = true
+			}
+		}
+	}
+	db.runlockAll()
+
+	stats.Terms = len(df)
+	for field, fs := range stats.Fields {
+		if indexedDocs > 0 {
+			fs.AverageLength = float64(fs.Tokens) / float64(indexedDocs)
+		}
+		stats.Fields[field] = fs
+	}
+	stats.Metadata = make([]MetadataStats, 0, len(keys))
+	for key, ks := range keys {
+		ks.Values = len(values[key])
+		stats.Metadata = append(stats.Metadata, *ks)
+	}
+	sort.Slice(stats.Metadata, func(i, j int) bool { return stats.Metadata[i].Key < stats.Metadata[j].Key })
+
+	if topTerms > 0 {
+		top := make([]TermStats, 0, len(df))
+		for term, n := range df {
+			top = append(top, TermStats{Term: term, DocumentFrequency: n})
+		}
+		sort.Slice(top, func(i, j int) bool {
+			if top[i].DocumentFrequency != top[j].DocumentFrequency {
+				return top[i].DocumentFrequency > top[j].DocumentFrequency
+			}
+			return top[i].Term < top[j].Term
+		})
+		if len(top) > topTerms {
+			top = top[:topTerms]
+		}
+		stats.TopTerms = top
+	}
+	return stats
+}
+
+// TermStats returns how many documents hold an index term and how often
+// it occurs. The term is looked up as indexed, not analyzed; Explain shows
+// the terms a query becomes.
+func (db *DocumentDB) TermStats(term string) TermStats {
+	stats := TermStats{Term: term}
+	db.rlockAll()
+	defer db.runlockAll()
+	for _, s := range db.shards {
+		stats.DocumentFrequency += s.text.df[term]
+		s.text.eachPosting(term, func(_ string, p *posting) bool {
+			for _, field := range textFields {
+				stats.Frequency += p.frequency(field)
+			}
+			return true
+		})
+	}
+	return stats
+}
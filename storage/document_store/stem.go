@@ -0,0 +1,215 @@
+package documentstore
+
+import "strings"
+
+// porterStem returns the stem of a lowercase English word by the Porter
+// algorithm (M.F. Porter, "An algorithm for suffix stripping", 1980).
+// Words of two letters or fewer, and words with anything but the letters
+// a to z, are returned as they are.
+func porterStem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+	s := &stemmer{b: []byte(word)}
+	s.step1a()
+	s.step1b()
+	s.step1c()
+	s.replaceSuffix(step2Suffixes, 0)
+	s.replaceSuffix(step3Suffixes, 0)
+	s.step4()
+	s.step5()
+	return string(s.b)
+}
+
+type stemmer struct {
+	b []byte
+}
+
+// consonant reports whether b[i] is a consonant: a letter other than a, e,
+// i, o and u, and y only after a vowel
+func (s *stemmer) consonant(i int) bool {
+	switch s.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !s.consonant(i-1)
+	}
+	return true
+}
+
+// measure counts the vowel-consonant sequences of b[:n]
+func (s *stemmer) measure(n int) int {
+	m, i := 0, 0
+	for i < n && s.consonant(i) {
+		i++
+	}
+	for i < n {
+		for i < n && !s.consonant(i) {
+			i++
+		}
+		if i >= n {
+			break
+		}
+		for i < n && s.consonant(i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+// hasVowel reports whether b[:n] contains a vowel
+func (s *stemmer) hasVowel(n int) bool {
+	for i := 0; i < n; i++ {
+		if !s.consonant(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doubleConsonant reports whether b[:n] ends with a double consonant
+func (s *stemmer) doubleConsonant(n int) bool {
+	return n >= 2 && s.b[n-1] == s.b[n-2] && s.consonant(n-1)
+}
+
+// cvc reports whether b[:n] ends consonant-vowel-consonant, the last not
+// w, x or y, as in "hop" but not "snow"
+func (s *stemmer) cvc(n int) bool {
+	if n < 3 || !s.consonant(n-1) || s.consonant(n-2) || !s.consonant(n-3) {
+		return false
+	}
+	last := s.b[n-1]
+	return last != 'w' && last != 'x' && last != 'y'
+}
+
+func (s *stemmer) endsWith(suffix string) bool {
+	return strings.HasSuffix(string(s.b), suffix)
+}
+
+// step1a handles plurals: caresses to caress, ponies to poni, cats to cat
+func (s *stemmer) step1a() {
+	switch {
+	case s.endsWith("sses"), s.endsWith("ies"):
+		s.b = s.b[:len(s.b)-2]
+	case s.endsWith("ss"):
+	case s.endsWith("s"):
+		s.b = s.b[:len(s.b)-1]
+	}
+}
+
+// step1b handles -ed and -ing: agreed to agree, hopping to hop, hoping to
+// hope
+func (s *stemmer) step1b() {
+	n := len(s.b)
+	if s.endsWith("eed") {
+		if s.measure(n-3) > 0 {
+			s.b = s.b[:n-1]
+		}
+		return
+	}
+	switch {
+	case s.endsWith("ed") && s.hasVowel(n-2):
+		s.b = s.b[:n-2]
+	case s.endsWith("ing") && s.hasVowel(n-3):
+		s.b = s.b[:n-3]
+	default:
+		return
+	}
+	n = len(s.b)
+	switch {
+	case s.endsWith("at"), s.endsWith("bl"), s.endsWith("iz"):
+		s.b = append(s.b, 'e')
+	case s.doubleConsonant(n) && !strings.ContainsRune("lsz", rune(s.b[n-1])):
+		s.b = s.b[:n-1]
+	case s.measure(n) == 1 && s.cvc(n):
+		s.b = append(s.b, 'e')
+	}
+}
+
+// step1c turns a final y into i after a vowel: happy to happi
+func (s *stemmer) step1c() {
+	n := len(s.b)
+	if s.endsWith("y") && s.hasVowel(n-1) {
+		s.b[n-1] = 'i'
+	}
+}
+
+// Suffix replacements of steps 2 and 3, longest first where one ends
+// another
+var (
+	step2Suffixes = [][2]string{
+		{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"}, {"izer", "ize"},
+		{"bli", "ble"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"},
+		{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"},
+		{"fulness", "ful"}, {"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+		{"logi", "log"},
+	}
+	step3Suffixes = [][2]string{
+		{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"}, {"ical", "ic"},
+		{"ful", ""}, {"ness", ""},
+	}
+	step4Suffixes = []string{
+		"ement", "ment", "able", "ible", "ance", "ence", "ant", "ent", "ism", "ate", "iti", "ous",
+		"ive", "ize", "ion", "al", "er", "ic", "ou",
+	}
+)
+
+// replaceSuffix replaces the longest of suffixes the word ends with, if
+// the stem before it measures more than min
+func (s *stemmer) replaceSuffix(suffixes [][2]string, min int) {
+	match := -1
+	for i, rule := range suffixes {
+		if s.endsWith(rule[0]) && (match < 0 || len(rule[0]) > len(suffixes[match][0])) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return
+	}
+	stem := len(s.b) - len(suffixes[match][0])
+	if s.measure(stem) > min {
+		s.b = append(s.b[:stem], suffixes[match][1]...)
+	}
+}
+
+// step4 drops suffixes from stems measuring more than 1: revival to reviv,
+// adoption to adopt
+func (s *stemmer) step4() {
+	match := ""
+	for _, suffix := range step4Suffixes {
+		if s.endsWith(suffix) && len(suffix) > len(match) {
+			match = suffix
+		}
+	}
+	if match == "" {
+		return
+	}
+	stem := len(s.b) - len(match)
+	if match == "ion" && (stem == 0 || (s.b[stem-1] != 's' && s.b[stem-1] != 't')) {
+		return
+	}
+	if s.measure(stem) > 1 {
+		s.b = s.b[:stem]
+	}
+}
+
+// step5 tidies up a final e and ll: probate to probat, controll to control
+func (s *stemmer) step5() {
+	n := len(s.b)
+	if s.endsWith("e") {
+		m := s.measure(n - 1)
+		if m > 1 || m == 1 && !s.cvc(n-1) {
+			s.b = s.b[:n-1]
+		}
+	}
+	n = len(s.b)
+	if s.measure(n) > 1 && s.doubleConsonant(n) && s.b[n-1] == 'l' {
+		s.b = s.b[:n-1]
+	}
+}
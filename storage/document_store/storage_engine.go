@@ -0,0 +1,280 @@
+package documentstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt buckets: documents without their content, keyed by ID, and the
+// content of each document under the same key. Keeping content apart lets
+// reads that don't need it leave it on disk.
+var (
+	documentsBucket = []byte("documents")
+	contentsBucket  = []byte("contents")
+)
+
+// documentBody is the part of a document kept in the contents bucket
+type documentBody struct {
+	Content           string `json:"content,omitempty"`
+	ContentEncoding   string `json:"content_encoding,omitempty"`
+	CompressedContent []byte `json:"compressed_content,omitempty"`
+}
+
+// Batch is a set of writes a storage engine applies atomically
+type Batch struct {
+	Puts    []*Document
+	Deletes []string
+}
+
+// StorageEngine persists the documents of a DocumentDB. The database keeps
+// every document in memory and writes each change through to its engine
+// before applying it, so an engine only needs to load and store documents.
+type StorageEngine interface {
+	// Load returns all stored documents, keyed by ID
+	Load() (map[string]*Document, error)
+	// Write applies a batch entirely or not at all
+	Write(batch Batch) error
+	Close() error
+}
+
+// getter is implemented by engines that can read a single document without
+// loading them all
+type getter interface {
+	Get(id string) (*Document, error)
+}
+
+// getDocument reads one document from engine, failing with ErrNotFound if
+// it isn't stored
+func getDocument(engine StorageEngine, id string) (*Document, error) {
+	g, ok := engine.(getter)
+	if !ok {
+		return nil, fmt.Errorf("%T can't read single documents", engine)
+	}
+	return g.Get(id)
+}
+
+// MemoryEngine keeps documents in memory only, for tests and throwaway databases
+type MemoryEngine struct {
+	documents map[string]*Document
+	mutex     sync.Mutex
+}
+
+// NewMemoryEngine creates an empty in-memory engine
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{documents: make(map[string]*Document)}
+}
+
+// Load returns copies of the stored documents
+func (e *MemoryEngine) Load() (map[string]*Document, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	docs := make(map[string]*Document, len(e.documents))
+	for id, doc := range e.documents {
+		docs[id] = copyDocument(doc)
+	}
+	return docs, nil
+}
+
+// Write stores copies of the batch's documents, so later changes to them
+// aren't persisted until written again
+func (e *MemoryEngine) Write(batch Batch) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, id := range batch.Deletes {
+		delete(e.documents, id)
+	}
+	for _, doc := range batch.Puts {
+		e.documents[doc.ID] = copyDocument(doc)
+	}
+	return nil
+}
+
+// Get returns a copy of the stored document
+func (e *MemoryEngine) Get(id string) (*Document, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	doc, ok := e.documents[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return copyDocument(doc), nil
+}
+
+// Close does nothing; the documents stay available to a later Load
+func (e *MemoryEngine) Close() error {
+	return nil
+}
+
+// BoltEngine stores documents as JSON in a Bolt database file, with their
+// content in a bucket of its own. Files written before content was split
+// out still load; their documents move over as they are rewritten. Every
+// write is a transaction synced to disk before it returns.
+type BoltEngine struct {
+	db *bolt.DB
+}
+
+// OpenBoltEngine opens the Bolt database at path, creating it if needed
+func OpenBoltEngine(path string) (*BoltEngine, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open document database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{documentsBucket, contentsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltEngine{db: db}, nil
+}
+
+// Load reads every document in the database
+func (e *BoltEngine) Load() (map[string]*Document, error) {
+	docs := make(map[string]*Document)
+	err := e.db.View(func(tx *bolt.Tx) error {
+		contents := tx.Bucket(contentsBucket)
+		return tx.Bucket(documentsBucket).ForEach(func(key, value []byte) error {
+			doc, err := readBoltDocument(key, value, contents)
+			if err != nil {
+				return err
+			}
+			docs[doc.ID] = doc
+			return nil
+		})
+	})
+	return docs, err
+}
+
+// Write applies the batch in a single transaction
+func (e *BoltEngine) Write(batch Batch) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		documents, contents := tx.Bucket(documentsBucket), tx.Bucket(contentsBucket)
+		for _, id := range batch.Deletes {
+			if err := documents.Delete([]byte(id)); err != nil {
+				return err
+			}
+			if err := contents.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		for _, doc := range batch.Puts {
+			head := *doc
+			head.Content, head.ContentEncoding, head.CompressedContent = "", "", nil
+			data, err := json.Marshal(&head)
+			if err != nil {
+				return err
+			}
+			if err := documents.Put([]byte(doc.ID), data); err != nil {
+				return err
+			}
+			body, err := json.Marshal(documentBody{doc.Content, doc.ContentEncoding, doc.CompressedContent})
+			if err != nil {
+				return err
+			}
+			if err := contents.Put([]byte(doc.ID), body); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get reads one document in its own read transaction
+func (e *BoltEngine) Get(id string) (*Document, error) {
+	return e.GetFields(id, nil)
+}
+
+// GetFields reads the given fields of a document, leaving its content on
+// disk unless it is asked for
+func (e *BoltEngine) GetFields(id string, fields []string) (*Document, error) {
+	p, err := compileProjection(fields)
+	if err != nil {
+		return nil, err
+	}
+	var doc *Document
+	err = e.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(documentsBucket).Get([]byte(id))
+		if value == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		var contents *bolt.Bucket
+		if p.needsContent() {
+			contents = tx.Bucket(contentsBucket)
+		}
+		doc, err = readBoltDocument([]byte(id), value, contents)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.apply(doc), nil
+}
+
+// readBoltDocument decodes a stored document, adding its content from the
+// contents bucket unless that is nil
+func readBoltDocument(key, value []byte, contents *bolt.Bucket) (*Document, error) {
+	var doc Document
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return nil, fmt.Errorf("malformed document %s: %w", key, err)
+	}
+	if contents == nil {
+		return &doc, nil
+	}
+	// Documents written before content was split out keep it inline
+	if data := contents.Get(key); data != nil {
+		var body documentBody
+		if err := json.Unmarshal(data, &body); err != nil {
+			return nil, fmt.Errorf("malformed content of document %s: %w", key, err)
+		}
+		doc.Content, doc.ContentEncoding, doc.CompressedContent = body.Content, body.ContentEncoding, body.CompressedContent
+	}
+	return &doc, nil
+}
+
+// Sync flushes the database file to disk. Writes are synced as they commit,
+// so this only matters when the file was opened with NoSync.
+func (e *BoltEngine) Sync() error {
+	return e.db.Sync()
+}
+
+// Close closes the database file
+func (e *BoltEngine) Close() error {
+	return e.db.Close()
+}
+
+// Clone returns a copy of doc that shares nothing with it, for changing a
+// document read from a database without changing the stored one
+func (doc *Document) Clone() *Document {
+	return copyDocument(doc)
+}
+
+// copyDocument returns a copy of doc that shares nothing with it
+func copyDocument(doc *Document) *Document {
+	c := *doc
+	if doc.Metadata != nil {
+		c.Metadata = make(map[string]string, len(doc.Metadata))
+		for key, value := range doc.Metadata {
+			c.Metadata[key] = value
+		}
+	}
+	if doc.Links != nil {
+		c.Links = append([]string(nil), doc.Links...)
+	}
+	if doc.Vector != nil {
+		c.Vector = append([]float32(nil), doc.Vector...)
+	}
+	return &c
+}
@@ -0,0 +1,97 @@
+package documentstore
+
+import (
+	"context"
+	"time"
+)
+
+// deadlineCheckInterval is how many steps of a search pass between looks
+// at its context, which take a lock
+const deadlineCheckInterval = 256
+
+// deadline stops a search once its context is done. Searches consult it in
+// their innermost loops, over postings, dictionary terms and documents, so
+// even a pathological query stops soon after its time runs out. A nil
+// deadline never passes.
+type deadline struct {
+	ctx    context.Context
+	steps  int
+	passed bool
+}
+
+// newDeadline returns the deadline of ctx, or nil if it can't end
+func newDeadline(ctx context.Context) *deadline {
+	if ctx.Done() == nil {
+		return nil
+	}
+	return &deadline{ctx: ctx}
+}
+
+// step counts a step of the search and reports whether it is out of time,
+// looking at the context every deadlineCheckInterval steps
+func (d *deadline) step() bool {
+	if d == nil {
+		return false
+	}
+	if !d.passed {
+		d.steps++
+		if d.steps%deadlineCheckInterval == 0 {
+			d.passed = d.ctx.Err() != nil
+		}
+	}
+	return d.passed
+}
+
+// expired reports whether the search is out of time, looking at the
+// context now
+func (d *deadline) expired() bool {
+	if d == nil {
+		return false
+	}
+	if !d.passed {
+		d.passed = d.ctx.Err() != nil
+	}
+	return d.passed
+}
+
+// ExecuteContext is Execute, stopping early once ctx is done. It then
+// returns the matches found so far, ranked, and reports that it timed out;
+// those partial results aren't cached.
+func (db *DocumentDB) ExecuteContext(ctx context.Context, q *Query) ([]SearchResult, bool) {
+	key := q.String()
+	results, epoch, ok := db.results.get(key)
+	if ok {
+		return results, false
+	}
+	d := newDeadline(ctx)
+	results = db.execute(q, d)
+	if d.expired() {
+		return results, true
+	}
+	db.results.put(key, results, epoch)
+	return results, false
+}
+
+// SearchPageContext is SearchPage, stopping early once ctx is done or
+// options.Timeout runs out. A search stopped early returns a page of the
+// matches found so far with TimedOut set, rather than an error.
+func (db *DocumentDB) SearchPageContext(ctx context.Context, query string, options SearchOptions) (Page, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return Page{}, err
+	}
+	page, err := db.searchPage(ctx, q, options)
+	if err != nil || page.TimedOut || page.Uncached {
+		return page, err
+	}
+	db.suggestFor(&page, query, options.SuggestBelow)
+	return page, nil
+}
+
+// withTimeout bounds ctx by a search's timeout, if it has one
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
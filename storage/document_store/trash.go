@@ -0,0 +1,163 @@
+package documentstore
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultTrashRetention is how long deleted documents stay recoverable
+// unless SetTrashRetention says otherwise
+const DefaultTrashRetention = 7 * 24 * time.Hour
+
+// SetTrashRetention sets how long deleted documents stay in the trash before
+// PurgeTrash or the sweeper removes them for good. Zero turns the trash off:
+// deletes are permanent and the next purge empties the trash.
+func (db *DocumentDB) SetTrashRetention(retention time.Duration) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.retention = retention
+}
+
+func (db *DocumentDB) trashRetention() time.Duration {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.retention
+}
+
+// trashLocked replaces a document with its tombstone, a new version marked
+// deleted, which leaves every query and index but stays stored so the
+// delete replicates like any other write; callers hold the shard's lock
+func (db *DocumentDB) trashLocked(s *shard, doc *Document) error {
+	tombstone := copyDocument(doc)
+	tombstone.Version = doc.Version + 1
+	tombstone.UpdatedAt = time.Now()
+	tombstone.DeletedAt = tombstone.UpdatedAt
+	if err := db.engine.Write(Batch{Puts: []*Document{tombstone}}); err != nil {
+		return err
+	}
+	db.keepVersionLocked(s, doc)
+	db.unindexLocked(s, doc.ID)
+	s.trash[doc.ID] = tombstone
+	db.publish(EventDelete, doc.ID, tombstone)
+	return nil
+}
+
+// firstVersionLocked returns the version a document added as id starts at:
+// 1, or past its tombstone's if a deleted document of that ID is in the
+// trash, so its versions never go back; callers hold the shard's lock
+func (s *shard) firstVersionLocked(id string) uint64 {
+	if tombstone, trashed := s.trash[id]; trashed {
+		return tombstone.Version + 1
+	}
+	return 1
+}
+
+// Trash returns the tombstones of the deleted documents that can still be
+// recovered, most recently deleted first
+func (db *DocumentDB) Trash() []*Document {
+	var docs []*Document
+	for _, s := range db.shards {
+		s.mutex.RLock()
+		for _, doc := range s.trash {
+			docs = append(docs, doc)
+		}
+		s.mutex.RUnlock()
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if !docs[i].DeletedAt.Equal(docs[j].DeletedAt) {
+			return docs[i].DeletedAt.After(docs[j].DeletedAt)
+		}
+		return docs[i].ID < docs[j].ID
+	})
+	return docs
+}
+
+// RecoverDocument brings a document back from the trash as a new version
+// and returns it. It fails with ErrNotFound if the document isn't in the
+// trash.
+func (db *DocumentDB) RecoverDocument(id string) (*Document, error) {
+	s := db.shardFor(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tombstone, exists := s.trash[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s is not in the trash", ErrNotFound, id)
+	}
+	recovered := copyDocument(tombstone)
+	recovered.DeletedAt = time.Time{}
+	recovered.Version = tombstone.Version + 1
+	recovered.UpdatedAt = time.Now()
+	if err := db.engine.Write(Batch{Puts: []*Document{recovered}}); err != nil {
+		return nil, err
+	}
+	db.putLocked(s, recovered)
+	return recovered, nil
+}
+
+// PurgeDocument removes a document for good, whether it is in the trash or
+// not. It fails with ErrNotFound if there is no such document.
+func (db *DocumentDB) PurgeDocument(id string) error {
+	s := db.shardFor(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, live := s.documents[id]
+	_, trashed := s.trash[id]
+	if !live && !trashed {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err := db.engine.Write(Batch{Deletes: []string{id}}); err != nil {
+		return err
+	}
+	// A trashed document's delete was published when it was trashed
+	db.removeLocked(s, id)
+	delete(s.trash, id)
+	delete(s.history, id)
+	return nil
+}
+
+// PurgeTrash removes for good the documents deleted longer ago than the
+// trash retention and returns how many it removed. Like ExpireDocuments, it
+// goes one shard at a time and a failing shard doesn't stop the others.
+func (db *DocumentDB) PurgeTrash() (int, error) {
+	cutoff := time.Now().Add(-db.trashRetention())
+	purged := 0
+	var firstErr error
+	for _, s := range db.shards {
+		n, err := db.purgeShard(s, cutoff)
+		purged += n
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to purge the trash: %w", err)
+		}
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.expiry.Purged += uint64(purged)
+	return purged, firstErr
+}
+
+func (db *DocumentDB) purgeShard(s *shard, cutoff time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var purged []string
+	for id, doc := range s.trash {
+		if !doc.DeletedAt.After(cutoff) {
+			purged = append(purged, id)
+		}
+	}
+	if len(purged) == 0 {
+		return 0, nil
+	}
+	if err := db.engine.Write(Batch{Deletes: purged}); err != nil {
+		return 0, err
+	}
+	for _, id := range purged {
+		delete(s.trash, id)
+		delete(s.history, id)
+	}
+	return len(purged), nil
+}
@@ -0,0 +1,148 @@
+package documentstore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// ExpirationStats counts the work of expiring documents and emptying the
+// trash, for monitoring
+type ExpirationStats struct {
+	Expired       uint64        `json:"expired"` // Documents removed since the database opened
+	Purged        uint64        `json:"purged"`  // Deleted documents removed from the trash
+	Sweeps        uint64        `json:"sweeps"`
+	Failures      uint64        `json:"failures"` // Sweeps whose delete the engine rejected
+	LastSweep     time.Time     `json:"last_sweep"`
+	LastSweepTook time.Duration `json:"last_sweep_took"`
+}
+
+// expired reports whether a document's time to live has run out
+func (doc *Document) expired(now time.Time) bool {
+	return !doc.ExpiresAt.IsZero() && !now.Before(doc.ExpiresAt)
+}
+
+// SetExpiry sets when a document expires; the zero time keeps it forever.
+// Expired documents stay readable until ExpireDocuments or the sweeper
+// removes them.
+func (db *DocumentDB) SetExpiry(id string, expiresAt time.Time) error {
+	s := db.shardFor(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	doc, exists := s.documents[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	updated := copyDocument(doc)
+	updated.ExpiresAt = expiresAt
+	return db.commitUpdateLocked(s, doc, updated)
+}
+
+// ExpireDocuments removes the documents whose time to live has run out and
+// returns how many it removed. Shards are swept one at a time, and a shard
+// whose delete fails doesn't stop the others.
+func (db *DocumentDB) ExpireDocuments() (int, error) {
+	start := time.Now()
+	removed := 0
+	var firstErr error
+	for _, s := range db.shards {
+		n, err := db.expireShard(s, start)
+		removed += n
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to delete expired documents: %w", err)
+		}
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.expiry.Sweeps++
+	db.expiry.Expired += uint64(removed)
+	if firstErr != nil {
+		db.expiry.Failures++
+	}
+	db.expiry.LastSweep = start
+	db.expiry.LastSweepTook = time.Since(start)
+	return removed, firstErr
+}
+
+func (db *DocumentDB) expireShard(s *shard, now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var expired []string
+	for id, doc := range s.documents {
+		if doc.expired(now) {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	if err := db.engine.Write(Batch{Deletes: expired}); err != nil {
+		return 0, err
+	}
+	for _, id := range expired {
+		db.removeLocked(s, id)
+		delete(s.history, id)
+	}
+	return len(expired), nil
+}
+
+// ExpirationStats returns the expiration counters
+func (db *DocumentDB) ExpirationStats() ExpirationStats {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.expiry
+}
+
+// StartExpirySweeper calls ExpireDocuments and PurgeTrash in the background
+// about every interval until Close. Each wait is stretched by up to a tenth of interval
+// at random, so databases opened together don't sweep in lockstep.
+func (db *DocumentDB) StartExpirySweeper(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("sweep interval must be positive")
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.sweepStop != nil {
+		return errors.New("expiry sweeper already running")
+	}
+	db.sweepStop, db.sweepDone = make(chan struct{}), make(chan struct{})
+	go db.sweepLoop(interval, db.sweepStop, db.sweepDone)
+	return nil
+}
+
+func (db *DocumentDB) sweepLoop(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		wait := interval + time.Duration(rand.Int63n(int64(interval)/10+1))
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			if _, err := db.ExpireDocuments(); err != nil {
+				logger.Error("Failed to expire documents", "error", err)
+			}
+			if _, err := db.PurgeTrash(); err != nil {
+				logger.Error("Failed to purge deleted documents", "error", err)
+			}
+		}
+	}
+}
+
+// stopSweeper stops the expiry sweeper, if running, and waits for it
+func (db *DocumentDB) stopSweeper() {
+	db.mutex.Lock()
+	stop, done := db.sweepStop, db.sweepDone
+	db.sweepStop, db.sweepDone = nil, nil
+	db.mutex.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
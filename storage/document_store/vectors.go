@@ -0,0 +1,422 @@
+package documentstore
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// HNSW parameters: how many neighbors a node keeps per layer, twice that on
+// the bottom layer, and how many candidates inserts and searches track.
+// More of each finds closer neighbors at the cost of speed and memory.
+const (
+	hnswM              = 16
+	hnswEfConstruction = 100
+	hnswEfSearch       = 64
+)
+
+// vectorIndex is a hierarchical navigable small world graph over the
+// documents' vectors, across shards, for approximate nearest neighbor
+// search by cosine similarity. Each layer is a proximity graph over a
+// sparser sample of the nodes than the one below; searches descend
+// greedily from the sparse top to the full bottom layer. Its lock is taken
+// after any shard's.
+type vectorIndex struct {
+	mutex    sync.RWMutex
+	dims     int // Of every vector indexed, or 0 while none are
+	nodes    map[string]*hnswNode
+	entry    *hnswNode // A node on the top layer
+	maxLevel int
+	rng      *rand.Rand
+}
+
+type hnswNode struct {
+	id      string
+	vector  []float32     // Scaled to unit length
+	friends [][]*hnswNode // Neighbors by layer, from 0 up to the node's level
+	// removed marks a node taken out of the index. Nodes that linked to it
+	// without being linked back may still do so; searches pass through it
+	// but never return it, and it is dropped from their lists when they are
+	// next pruned.
+	removed bool
+}
+
+func newVectorIndex() *vectorIndex {
+	return &vectorIndex{nodes: make(map[string]*hnswNode), rng: rand.New(rand.NewSource(1))}
+}
+
+// check returns a *ValidationError if doc's vector can't be indexed: it
+// must have as many dimensions as those indexed and not be all zeros
+func (v *vectorIndex) check(doc *Document) error {
+	if len(doc.Vector) == 0 {
+		return nil
+	}
+	v.mutex.RLock()
+	dims := v.dims
+	v.mutex.RUnlock()
+
+	reason := ""
+	if dims > 0 && len(doc.Vector) != dims {
+		reason = fmt.Sprintf("has %d dimensions, not %d like the vectors stored", len(doc.Vector), dims)
+	} else if _, ok := unitVector(doc.Vector); !ok {
+		reason = "must not be all zeros"
+	}
+	if reason == "" {
+		return nil
+	}
+	return &ValidationError{ID: doc.ID, Fields: []FieldError{{ColumnVector, reason}}}
+}
+
+// unitVector returns vector scaled to unit length, reporting false for a
+// zero vector or one holding NaN or infinities
+func unitVector(vector []float32) ([]float32, bool) {
+	norm := 0.0
+	for _, x := range vector {
+		norm += float64(x) * float64(x)
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 || math.IsNaN(norm) || math.IsInf(norm, 0) {
+		return nil, false
+	}
+	unit := make([]float32, len(vector))
+	for i, x := range vector {
+		unit[i] = float32(float64(x) / norm)
+	}
+	return unit, true
+}
+
+// similarity is the cosine similarity of two unit vectors
+func similarity(a, b []float32) float64 {
+	dot := 0.0
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return dot
+}
+
+// put indexes a document's vector, replacing any it had indexed before.
+// Documents without a vector, or with one check would reject, are left out.
+func (v *vectorIndex) put(doc *Document) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if old, exists := v.nodes[doc.ID]; exists {
+		if unit, ok := unitVector(doc.Vector); ok && equalVectors(old.vector, unit) {
+			return
+		}
+		v.removeLocked(old)
+	}
+	unit, ok := unitVector(doc.Vector)
+	if !ok || v.dims > 0 && len(unit) != v.dims {
+		return
+	}
+	v.dims = len(unit)
+	v.insertLocked(&hnswNode{id: doc.ID, vector: unit})
+}
+
+// remove drops a document's vector from the index
+func (v *vectorIndex) remove(id string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if node, exists := v.nodes[id]; exists {
+		v.removeLocked(node)
+	}
+}
+
+func equalVectors(a, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// randomLevel draws a node's top layer, each layer holding about 1/hnswM
+// of the nodes of the one below
+func (v *vectorIndex) randomLevel() int {
+	return int(-math.Log(1-v.rng.Float64()) / math.Log(hnswM))
+}
+
+// maxFriends is how many neighbors a node keeps on a layer
+func maxFriends(layer int) int {
+	if layer == 0 {
+		return 2 * hnswM
+	}
+	return hnswM
+}
+
+func (v *vectorIndex) insertLocked(node *hnswNode) {
+	level := v.randomLevel()
+	node.friends = make([][]*hnswNode, level+1)
+	v.nodes[node.id] = node
+	if v.entry == nil {
+		v.entry, v.maxLevel = node, level
+		return
+	}
+
+	entry := v.entry
+	for layer := v.maxLevel; layer > level; layer-- {
+		entry = greedyClosest(node.vector, entry, layer)
+	}
+	entries := []*hnswNode{entry}
+	top := level
+	if top > v.maxLevel {
+		top = v.maxLevel
+	}
+	for layer := top; layer >= 0; layer-- {
+		candidates := searchLayer(node.vector, entries, hnswEfConstruction, layer)
+		node.friends[layer] = closest(candidates, hnswM)
+		for _, friend := range node.friends[layer] {
+			friend.friends[layer] = append(friend.friends[layer], node)
+			if len(friend.friends[layer]) > maxFriends(layer) {
+				friend.friends[layer] = pruneFriends(friend, friend.friends[layer], maxFriends(layer))
+			}
+		}
+		entries = make([]*hnswNode, len(candidates))
+		for i, c := range candidates {
+			entries[i] = c.node
+		}
+	}
+	if level > v.maxLevel {
+		v.entry, v.maxLevel = node, level
+	}
+}
+
+// removeLocked unlinks a node and reconnects its neighbors to each other,
+// so the graph stays navigable without it
+func (v *vectorIndex) removeLocked(node *hnswNode) {
+	delete(v.nodes, node.id)
+	node.removed = true
+	for layer, friends := range node.friends {
+		for _, friend := range friends {
+			kept := friend.friends[layer][:0]
+			for _, f := range friend.friends[layer] {
+				if !f.removed {
+					kept = append(kept, f)
+				}
+			}
+			// The removed node's other neighbors are the likeliest
+			// replacements for the link the friend lost
+			for _, f := range friends {
+				if f != friend && !f.removed && !containsNode(kept, f) {
+					kept = append(kept, f)
+				}
+			}
+			friend.friends[layer] = pruneFriends(friend, kept, maxFriends(layer))
+		}
+	}
+
+	if v.entry != node {
+		return
+	}
+	v.entry, v.maxLevel = nil, 0
+	for _, n := range v.nodes {
+		if v.entry == nil || len(n.friends)-1 > v.maxLevel {
+			v.entry, v.maxLevel = n, len(n.friends)-1
+		}
+	}
+	if v.entry == nil {
+		v.dims = 0
+	}
+}
+
+func containsNode(nodes []*hnswNode, node *hnswNode) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneFriends keeps the limit nodes closest to node, dropping removed ones
+func pruneFriends(node *hnswNode, friends []*hnswNode, limit int) []*hnswNode {
+	scored := make([]scoredNode, 0, len(friends))
+	for _, f := range friends {
+		if !f.removed {
+			scored = append(scored, scoredNode{node: f, score: similarity(node.vector, f.vector)})
+		}
+	}
+	if len(scored) == len(friends) && len(friends) <= limit {
+		return friends
+	}
+	return closest(scored, limit)
+}
+
+// greedyClosest walks a layer from entry to the node nearest query it can
+// reach by always moving closer
+func greedyClosest(query []float32, entry *hnswNode, layer int) *hnswNode {
+	best, bestScore := entry, similarity(query, entry.vector)
+	for improved := true; improved; {
+		improved = false
+		for _, friend := range best.friends[layer] {
+			if score := similarity(query, friend.vector); score > bestScore && !friend.removed {
+				best, bestScore, improved = friend, score, true
+			}
+		}
+	}
+	return best
+}
+
+// scoredNode is a node and its similarity to a query
+type scoredNode struct {
+	node  *hnswNode
+	score float64
+}
+
+// nodeHeap is a heap of scored nodes, the least similar on top unless
+// nearest is set
+type nodeHeap struct {
+	nodes   []scoredNode
+	nearest bool
+}
+
+func (h *nodeHeap) Len() int { return len(h.nodes) }
+func (h *nodeHeap) Less(i, j int) bool {
+	if h.nearest {
+		return h.nodes[i].score > h.nodes[j].score
+	}
+	return h.nodes[i].score < h.nodes[j].score
+}
+func (h *nodeHeap) Swap(i, j int)      { h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i] }
+func (h *nodeHeap) Push(x interface{}) { h.nodes = append(h.nodes, x.(scoredNode)) }
+func (h *nodeHeap) Pop() interface{} {
+	last := h.nodes[len(h.nodes)-1]
+	h.nodes = h.nodes[:len(h.nodes)-1]
+	return last
+}
+
+// searchLayer finds about the ef nodes of a layer nearest query, best
+// first, by expanding the nearest unexpanded candidate until none is
+// nearer than the furthest of the ef found
+func searchLayer(query []float32, entries []*hnswNode, ef, layer int) []scoredNode {
+	visited := make(map[*hnswNode]bool)
+	candidates := &nodeHeap{nearest: true}
+	found := &nodeHeap{}
+	consider := func(node *hnswNode) {
+		visited[node] = true
+		scored := scoredNode{node: node, score: similarity(query, node.vector)}
+		if found.Len() >= ef && scored.score <= found.nodes[0].score {
+			return
+		}
+		heap.Push(candidates, scored)
+		if node.removed {
+			return
+		}
+		heap.Push(found, scored)
+		if found.Len() > ef {
+			heap.Pop(found)
+		}
+	}
+	for _, entry := range entries {
+		consider(entry)
+	}
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(scoredNode)
+		if found.Len() >= ef && c.score < found.nodes[0].score {
+			break
+		}
+		for _, friend := range c.node.friends[layer] {
+			if !visited[friend] {
+				consider(friend)
+			}
+		}
+	}
+	return sortScored(found.nodes)
+}
+
+// sortScored orders scored nodes best first, breaking ties by ID
+func sortScored(scored []scoredNode) []scoredNode {
+	sort.Slice(scored, func(i, j int) bool {
+		if scored[i].score != scored[j].score {
+			return scored[i].score > scored[j].score
+		}
+		return scored[i].node.id < scored[j].node.id
+	})
+	return scored
+}
+
+// closest returns the nodes of the limit best scores, best first
+func closest(scored []scoredNode, limit int) []*hnswNode {
+	sorted := sortScored(append([]scoredNode(nil), scored...))
+	if len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+	nodes := make([]*hnswNode, len(sorted))
+	for i, s := range sorted {
+		nodes[i] = s.node
+	}
+	return nodes
+}
+
+// search returns about the k documents whose vectors are most similar to
+// query, a unit vector, best first, with their cosine similarity
+func (v *vectorIndex) search(query []float32, k, ef int) ([]scoredNode, error) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	if v.entry == nil {
+		return nil, nil
+	}
+	if len(query) != v.dims {
+		return nil, fmt.Errorf("query vector has %d dimensions, not %d like the vectors stored", len(query), v.dims)
+	}
+	entry := v.entry
+	for layer := v.maxLevel; layer > 0; layer-- {
+		entry = greedyClosest(query, entry, layer)
+	}
+	if ef < k {
+		ef = k
+	}
+	found := searchLayer(query, []*hnswNode{entry}, ef, 0)
+	if len(found) > k {
+		found = found[:k]
+	}
+	return found, nil
+}
+
+// SimilarSearch returns the k documents whose vectors are most similar to
+// vector, best first, scored by cosine similarity. The search is
+// approximate: it walks a graph of the vectors rather than comparing every
+// one, so it may now and then miss a close match. It fails if vector is all
+// zeros or its length differs from the stored vectors'.
+func (db *DocumentDB) SimilarSearch(vector []float32, k int) ([]SearchResult, error) {
+	query, ok := unitVector(vector)
+	if !ok {
+		return nil, errors.New("query vector must not be all zeros")
+	}
+	if k <= 0 {
+		return nil, nil
+	}
+	db.rlockAll()
+	defer db.runlockAll()
+
+	found, err := db.vectors.search(query, k, hnswEfSearch)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]SearchResult, 0, len(found))
+	for _, f := range found {
+		if doc, exists := db.lookupLocked(f.node.id); exists {
+			results = append(results, SearchResult{Document: doc, Score: f.score})
+		}
+	}
+	return results, nil
+}
+
+// documentSimilarity is the cosine similarity of a unit vector to a
+// document's vector, or 0 if the document has none of the same length
+func documentSimilarity(unit []float32, doc *Document) float64 {
+	other, ok := unitVector(doc.Vector)
+	if !ok || len(other) != len(unit) {
+		return 0
+	}
+	return similarity(unit, other)
+}
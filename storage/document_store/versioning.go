@@ -0,0 +1,107 @@
+package documentstore
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// UpdateDocumentIf updates the content of a document only if it is still
+// at expectedVersion, so a writer working from a stale read fails instead of
+// overwriting a concurrent update. A conflict fails with an error matching
+// ErrVersionConflict; re-read the document and retry.
+func (db *DocumentDB) UpdateDocumentIf(id string, expectedVersion uint64, newContent string) error {
+	s := db.shardFor(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	doc, exists := s.documents[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if doc.Version != expectedVersion {
+		return fmt.Errorf("%w: document %s is at version %d, not %d", ErrVersionConflict, id, doc.Version, expectedVersion)
+	}
+	updated := copyDocument(doc)
+	updated.Content = newContent
+	return db.commitUpdateLocked(s, doc, updated)
+}
+
+// SetHistoryLimit keeps up to n previous versions of each document for
+// History. History lives in memory only and is off, n = 0, by default.
+// Lowering the limit trims versions already kept.
+func (db *DocumentDB) SetHistoryLimit(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&db.keep, int64(n))
+	for _, s := range db.shards {
+		s.mutex.Lock()
+		for id, versions := range s.history {
+			if len(versions) > n {
+				versions = versions[len(versions)-n:]
+			}
+			if len(versions) == 0 {
+				delete(s.history, id)
+			} else {
+				s.history[id] = versions
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// History returns the retained previous versions of a document, oldest
+// first, followed by the current one
+func (db *DocumentDB) History(id string) ([]*Document, error) {
+	s := db.shardFor(id)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	doc, exists := s.documents[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	versions := make([]*Document, 0, len(s.history[id])+1)
+	for _, version := range s.history[id] {
+		versions = append(versions, copyDocument(version))
+	}
+	return append(versions, copyDocument(doc)), nil
+}
+
+// commitUpdateLocked persists updated as the next version of doc, then
+// stores it in doc's place and keeps the old version if history is on;
+// callers hold the shard's lock
+func (db *DocumentDB) commitUpdateLocked(s *shard, doc, updated *Document) error {
+	if err := db.currentSchema().validate(updated); err != nil {
+		return err
+	}
+	if err := db.vectors.check(updated); err != nil {
+		return err
+	}
+	if updated.Content != doc.Content {
+		updated.ContentHash, updated.DuplicateOf = fingerprint(updated.Content), ""
+	}
+	updated.Version = doc.Version + 1
+	updated.UpdatedAt = time.Now()
+	if err := db.engine.Write(Batch{Puts: []*Document{updated}}); err != nil {
+		return err
+	}
+	db.keepVersionLocked(s, doc)
+	db.putLocked(s, updated)
+	return nil
+}
+
+// keepVersionLocked adds a replaced document to its history if history is
+// on; callers hold the shard's lock
+func (db *DocumentDB) keepVersionLocked(s *shard, doc *Document) {
+	keep := int(atomic.LoadInt64(&db.keep))
+	if keep == 0 {
+		return
+	}
+	versions := append(s.history[doc.ID], doc)
+	if len(versions) > keep {
+		versions = versions[len(versions)-keep:]
+	}
+	s.history[doc.ID] = versions
+}
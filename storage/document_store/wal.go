@@ -0,0 +1,426 @@
+package documentstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walSegmentPrefix = "wal-"
+	walSegmentSuffix = ".log"
+	walCheckpoint    = "checkpoint"
+	// walHeaderSize is the length and CRC preceding each record
+	walHeaderSize = 8
+	// maxWALRecord bounds the length read from a header, which may be garbage
+	maxWALRecord = 1 << 30
+)
+
+// SyncPolicy decides when the write-ahead log is flushed to disk
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs every write before it is applied, losing nothing on a crash
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background every SyncEvery, trading the
+	// writes of the last interval for much cheaper writes
+	SyncInterval
+)
+
+// WALOptions tunes a write-ahead log
+type WALOptions struct {
+	Sync            SyncPolicy
+	SyncEvery       time.Duration // Flush interval under SyncInterval
+	MaxSegmentBytes int64         // Size at which the log rotates to a new segment
+}
+
+// DefaultWALOptions fsyncs every write and rotates segments at 64MB
+var DefaultWALOptions = WALOptions{
+	Sync:            SyncAlways,
+	SyncEvery:       100 * time.Millisecond,
+	MaxSegmentBytes: 64 << 20,
+}
+
+// walRecord is a logged batch
+type walRecord struct {
+	Seq     uint64      `json:"seq"`
+	Puts    []*Document `json:"puts,omitempty"`
+	Deletes []string    `json:"deletes,omitempty"`
+}
+
+// syncer is implemented by engines that can flush their writes to disk, so
+// the log can drop the segments they have made durable
+type syncer interface {
+	Sync() error
+}
+
+// canSync reports whether engine can make its writes durable. Wrappers that
+// always have Sync, like CachingEngine, say whether the engine they wrap can.
+func canSync(engine StorageEngine) bool {
+	if _, ok := engine.(syncer); !ok {
+		return false
+	}
+	if wrapper, ok := engine.(interface{ canSync() bool }); ok {
+		return wrapper.canSync()
+	}
+	return true
+}
+
+// WALEngine records every batch in a write-ahead log before handing it to
+// the engine it wraps. On open it replays the batches the wrapped engine may
+// not have stored before a crash. Segments are dropped once the wrapped
+// engine has synced past them; engines that can't sync, like MemoryEngine,
+// keep the whole log, which then holds the durable copy of the database.
+type WALEngine struct {
+	dir     string
+	inner   StorageEngine
+	options WALOptions
+
+	mutex   sync.Mutex
+	segment *os.File
+	writer  *bufio.Writer
+	size    int64
+	seq     uint64 // Sequence number of the last logged batch
+	dirty   bool   // Written since the last fsync
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// OpenWALEngine opens the log in dir, replays it into inner and returns an
+// engine logging every write to it
+func OpenWALEngine(dir string, inner StorageEngine, options WALOptions) (*WALEngine, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	e := &WALEngine{dir: dir, inner: inner, options: options}
+	if err := e.recover(); err != nil {
+		return nil, err
+	}
+	if err := e.openSegment(); err != nil {
+		return nil, err
+	}
+	if options.Sync == SyncInterval && options.SyncEvery > 0 {
+		e.stop, e.done = make(chan struct{}), make(chan struct{})
+		go e.syncLoop()
+	}
+	return e, nil
+}
+
+// Load returns the documents of the wrapped engine, which recovery has
+// brought up to date with the log
+func (e *WALEngine) Load() (map[string]*Document, error) {
+	return e.inner.Load()
+}
+
+// Write logs the batch, flushing it as the sync policy says, and then
+// applies it to the wrapped engine
+func (e *WALEngine) Write(batch Batch) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	record := walRecord{Seq: e.seq + 1, Puts: batch.Puts, Deletes: batch.Deletes}
+	if err := e.appendLocked(record); err != nil {
+		return fmt.Errorf("failed to log write: %w", err)
+	}
+	e.seq = record.Seq
+	if err := e.inner.Write(batch); err != nil {
+		// The logged batch would be replayed on the next open, so the log
+		// and the engine can't be reconciled without a restart
+		return fmt.Errorf("failed to apply logged write %d: %w", record.Seq, err)
+	}
+	if e.size >= e.options.MaxSegmentBytes && e.options.MaxSegmentBytes > 0 {
+		if err := e.rotateLocked(); err != nil {
+			return fmt.Errorf("failed to rotate write-ahead log: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close flushes the log and closes it and the wrapped engine
+func (e *WALEngine) Close() error {
+	if e.stop != nil {
+		close(e.stop)
+		<-e.done
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	err := e.syncLocked()
+	if closeErr := e.segment.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := e.inner.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Sync flushes the log to disk
+func (e *WALEngine) Sync() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.syncLocked()
+}
+
+func (e *WALEngine) syncLoop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.options.SyncEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			if err := e.Sync(); err != nil {
+				logger.Error("Failed to sync write-ahead log", "error", err)
+			}
+		}
+	}
+}
+
+// appendLocked writes a record as its length, CRC and JSON body
+func (e *WALEngine) appendLocked(record walRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	var header [walHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	if _, err := e.writer.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := e.writer.Write(payload); err != nil {
+		return err
+	}
+	e.size += int64(walHeaderSize + len(payload))
+	e.dirty = true
+	if e.options.Sync == SyncAlways {
+		return e.syncLocked()
+	}
+	// Interval syncing still hands each write to the OS, so only a machine
+	// crash, not a process crash, can lose it
+	return e.writer.Flush()
+}
+
+func (e *WALEngine) syncLocked() error {
+	if !e.dirty {
+		return nil
+	}
+	if err := e.writer.Flush(); err != nil {
+		return err
+	}
+	if err := e.segment.Sync(); err != nil {
+		return err
+	}
+	e.dirty = false
+	return nil
+}
+
+// openSegment starts a new segment named after the next sequence number
+func (e *WALEngine) openSegment() error {
+	path := filepath.Join(e.dir, fmt.Sprintf("%s%020d%s", walSegmentPrefix, e.seq+1, walSegmentSuffix))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	e.segment, e.writer, e.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+// rotateLocked closes the full segment, starts the next one and drops the
+// segments the wrapped engine has made durable
+func (e *WALEngine) rotateLocked() error {
+	if err := e.syncLocked(); err != nil {
+		return err
+	}
+	if err := e.segment.Close(); err != nil {
+		return err
+	}
+	if err := e.openSegment(); err != nil {
+		return err
+	}
+	return e.checkpointLocked()
+}
+
+// checkpointLocked records that every logged batch is durable in the wrapped
+// engine and removes the segments holding only those batches
+func (e *WALEngine) checkpointLocked() error {
+	if !canSync(e.inner) {
+		return nil
+	}
+	if err := e.inner.(syncer).Sync(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(e.dir, walCheckpoint), []byte(strconv.FormatUint(e.seq, 10))); err != nil {
+		return err
+	}
+	segments, err := e.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		// Segments other than the current one end at or before e.seq
+		if segment.first <= e.seq {
+			if err := os.Remove(segment.path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type walSegment struct {
+	path  string
+	first uint64 // Sequence number of the segment's first record
+}
+
+// segments lists the log's segments in order
+func (e *WALEngine) segments() ([]walSegment, error) {
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []walSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, walSegmentPrefix), walSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, walSegment{path: filepath.Join(e.dir, name), first: first})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+// recover replays the batches logged after the last checkpoint into the
+// wrapped engine. Replaying a batch the engine already holds is harmless,
+// since batches only put and delete whole documents. A torn record at the
+// end of the log, left by a crash mid-write, is cut off.
+func (e *WALEngine) recover() error {
+	var checkpoint uint64
+	if data, err := os.ReadFile(filepath.Join(e.dir, walCheckpoint)); err == nil {
+		if checkpoint, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return fmt.Errorf("malformed write-ahead log checkpoint: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	e.seq = checkpoint
+
+	segments, err := e.segments()
+	if err != nil {
+		return err
+	}
+	replayed := 0
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		err := e.replaySegment(segment.path, last, func(record walRecord) error {
+			if record.Seq <= e.seq {
+				return nil
+			}
+			if record.Seq != e.seq+1 {
+				return fmt.Errorf("write-ahead log skips from %d to %d", e.seq, record.Seq)
+			}
+			if err := e.inner.Write(Batch{Puts: record.Puts, Deletes: record.Deletes}); err != nil {
+				return err
+			}
+			e.seq = record.Seq
+			replayed++
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to recover %s: %w", segment.path, err)
+		}
+	}
+	if replayed > 0 {
+		logger.Info("Recovered writes from the write-ahead log", "writes", replayed)
+	}
+	return nil
+}
+
+// replaySegment reads the records of a segment in order. A corrupt record
+// in the last segment is where a crash interrupted the log, so the segment
+// is truncated there; anywhere else it is an error.
+func (e *WALEngine) replaySegment(path string, last bool, apply func(walRecord) error) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		record, size, err := readWALRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if !last {
+				return err
+			}
+			logger.Warn("Truncating write-ahead log", "path", path, "offset", offset, "error", err)
+			return file.Truncate(offset)
+		}
+		if err := apply(record); err != nil {
+			return err
+		}
+		offset += size
+	}
+}
+
+// readWALRecord reads one record, returning io.EOF at a clean end of segment
+func readWALRecord(reader *bufio.Reader) (walRecord, int64, error) {
+	var record walRecord
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return record, 0, errors.New("torn record header")
+		}
+		return record, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > maxWALRecord {
+		return record, 0, fmt.Errorf("record length %d out of range", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return record, 0, errors.New("torn record")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return record, 0, errors.New("record checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, 0, err
+	}
+	return record, int64(walHeaderSize + len(payload)), nil
+}
+
+// writeFileAtomic replaces path with data so readers see the old or the new
+// contents, never a mix
+func writeFileAtomic(path string, data []byte) error {
+	return replaceFile(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,223 @@
+package documentstore_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	documentstore "storage/document_store"
+)
+
+// recordingEngine is a memory engine noting every batch written to it
+type recordingEngine struct {
+	*documentstore.MemoryEngine
+	operations []string
+}
+
+func newRecordingEngine() *recordingEngine {
+	return &recordingEngine{MemoryEngine: documentstore.NewMemoryEngine()}
+}
+
+func (e *recordingEngine) Write(batch documentstore.Batch) error {
+	for _, doc := range batch.Puts {
+		e.operations = append(e.operations, "put "+doc.ID+" "+doc.Content)
+	}
+	for _, id := range batch.Deletes {
+		e.operations = append(e.operations, "delete "+id)
+	}
+	return e.MemoryEngine.Write(batch)
+}
+
+// syncingEngine is a recording engine that can make its writes durable, so
+// the log checkpoints it
+type syncingEngine struct {
+	*recordingEngine
+}
+
+func (e syncingEngine) Sync() error {
+	return nil
+}
+
+func openWAL(t *testing.T, dir string, inner documentstore.StorageEngine, options documentstore.WALOptions) *documentstore.WALEngine {
+	t.Helper()
+	engine, err := documentstore.OpenWALEngine(dir, inner, options)
+	if err != nil {
+		t.Fatalf("Failed to open write-ahead log: %v", err)
+	}
+	return engine
+}
+
+// writeBatches writes each batch through the log in turn
+func writeBatches(t *testing.T, engine *documentstore.WALEngine, batches ...documentstore.Batch) {
+	t.Helper()
+	for _, batch := range batches {
+		if err := engine.Write(batch); err != nil {
+			t.Fatalf("Failed to write batch: %v", err)
+		}
+	}
+}
+
+// walSegments lists the log's segment files in order
+func walSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		t.Fatalf("Failed to list segments: %v", err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// replay reopens the log over a fresh engine and returns what it replayed
+func replay(t *testing.T, dir string) []string {
+	t.Helper()
+	inner := newRecordingEngine()
+	engine := openWAL(t, dir, inner, documentstore.DefaultWALOptions)
+	if err := engine.Close(); err != nil {
+		t.Fatalf("Failed to close write-ahead log: %v", err)
+	}
+	return inner.operations
+}
+
+func put(id, content string) documentstore.Batch {
+	return documentstore.Batch{Puts: []*documentstore.Document{{ID: id, Content: content}}}
+}
+
+func del(id string) documentstore.Batch {
+	return documentstore.Batch{Deletes: []string{id}}
+}
+
+// Test that reopening the log replays every logged batch in order
+func TestWALReplaysLoggedWrites(t *testing.T) {
+	dir := t.TempDir()
+	engine := openWAL(t, dir, documentstore.NewMemoryEngine(), documentstore.DefaultWALOptions)
+	writeBatches(t, engine, put("a", "first"), put("b", "second"), put("a", "third"), del("b"))
+	if err := engine.Close(); err != nil {
+		t.Fatalf("Failed to close write-ahead log: %v", err)
+	}
+
+	want := []string{"put a first", "put b second", "put a third", "delete b"}
+	if got := replay(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Replayed %q, expected %q", got, want)
+	}
+}
+
+// Test that a torn or corrupt record at the end of the log is cut off on
+// reopen, replaying exactly the records before it, and that writes after
+// the cut are kept
+func TestWALTruncatesDamagedTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(data []byte) []byte
+		want   []string
+	}{
+		{"torn header", func(data []byte) []byte {
+			return append(data, 0, 0, 1)
+		}, []string{"put a first", "put b second", "delete a"}},
+		{"torn record", func(data []byte) []byte {
+			header := make([]byte, 8)
+			binary.BigEndian.PutUint32(header, 100)
+			return append(append(data, header...), `{"seq":4,"puts":[`...)
+		}, []string{"put a first", "put b second", "delete a"}},
+		{"garbage length", func(data []byte) []byte {
+			return append(data, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0)
+		}, []string{"put a first", "put b second", "delete a"}},
+		{"corrupt last record", func(data []byte) []byte {
+			data[len(data)-3] ^= 0xff
+			return data
+		}, []string{"put a first", "put b second"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			engine := openWAL(t, dir, documentstore.NewMemoryEngine(), documentstore.DefaultWALOptions)
+			writeBatches(t, engine, put("a", "first"), put("b", "second"), del("a"))
+			engine.Close()
+
+			segments := walSegments(t, dir)
+			path := segments[len(segments)-1]
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read segment: %v", err)
+			}
+			if err := os.WriteFile(path, tt.damage(data), 0o644); err != nil {
+				t.Fatalf("Failed to write segment: %v", err)
+			}
+
+			if got := replay(t, dir); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Replayed %q, expected %q", got, tt.want)
+			}
+			// The damage is gone: the log continues after the last good
+			// record and replays the same again with the new write
+			engine = openWAL(t, dir, documentstore.NewMemoryEngine(), documentstore.DefaultWALOptions)
+			writeBatches(t, engine, put("c", "fourth"))
+			engine.Close()
+			want := append(tt.want, "put c fourth")
+			if got := replay(t, dir); !reflect.DeepEqual(got, want) {
+				t.Fatalf("Replayed %q after another write, expected %q", got, want)
+			}
+		})
+	}
+}
+
+// Test that damage before the last segment fails the open rather than
+// silently dropping the writes logged after it
+func TestWALRejectsDamageBeforeLastSegment(t *testing.T) {
+	dir := t.TempDir()
+	// Rotating after every write, over an engine that can't sync, keeps a
+	// segment a write
+	options := documentstore.DefaultWALOptions
+	options.MaxSegmentBytes = 1
+	engine := openWAL(t, dir, documentstore.NewMemoryEngine(), options)
+	writeBatches(t, engine, put("a", "first"), put("b", "second"), put("c", "third"))
+	engine.Close()
+
+	segments := walSegments(t, dir)
+	if len(segments) < 3 {
+		t.Fatalf("Log has %d segments, expected one a write", len(segments))
+	}
+	data, err := os.ReadFile(segments[0])
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	data[len(data)-3] ^= 0xff
+	if err := os.WriteFile(segments[0], data, 0o644); err != nil {
+		t.Fatalf("Failed to write segment: %v", err)
+	}
+	if _, err := documentstore.OpenWALEngine(dir, documentstore.NewMemoryEngine(), documentstore.DefaultWALOptions); err == nil {
+		t.Fatalf("Opened a log with a corrupt record before its last segment")
+	}
+}
+
+// Test that once an engine that syncs has made writes durable, only the
+// writes logged after the checkpoint are replayed
+func TestWALReplaysOnlyAfterCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	options := documentstore.DefaultWALOptions
+	options.MaxSegmentBytes = 1
+	engine := openWAL(t, dir, syncingEngine{newRecordingEngine()}, options)
+	writeBatches(t, engine, put("a", "first"), put("b", "second"))
+	engine.Close()
+
+	options.MaxSegmentBytes = 0
+	engine = openWAL(t, dir, syncingEngine{newRecordingEngine()}, options)
+	writeBatches(t, engine, del("a"), put("c", "third"))
+	engine.Close()
+
+	inner := syncingEngine{newRecordingEngine()}
+	engine = openWAL(t, dir, inner, documentstore.DefaultWALOptions)
+	want := []string{"delete a", "put c third"}
+	if !reflect.DeepEqual(inner.operations, want) {
+		t.Fatalf("Replayed %q, expected %q", inner.operations, want)
+	}
+	// The next write follows the replayed ones
+	writeBatches(t, engine, put("d", "fourth"))
+	engine.Close()
+	want = append(want, "put d fourth")
+	if got := replay(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Replayed %q, expected %q", got, want)
+	}
+}
@@ -0,0 +1,342 @@
+package documentstore
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// wandBlockSize is how many postings share a score bound in block-max WAND
+const wandBlockSize = 64
+
+// postingList is a term's postings in one segment ordered by document ID,
+// which is the order top-k searches walk them in
+type postingList struct {
+	ids    []string
+	blocks []postingBlock // Of wandBlockSize postings each
+	whole  postingBlock   // Over the entire list
+}
+
+// postingBlock bounds the scores of a run of postings: no posting in it
+// occurs more often, or in a shorter field, than these
+type postingBlock struct {
+	last   string // ID of the last posting
+	maxTF  []int  // By position in textFields
+	minLen []int
+}
+
+func newPostingBlock() postingBlock {
+	return postingBlock{maxTF: make([]int, len(textFields)), minLen: make([]int, len(textFields))}
+}
+
+// include widens the block to cover a posting
+func (b *postingBlock) include(p *posting, lengths map[string]int) {
+	for i, field := range textFields {
+		tf := p.frequency(field)
+		if tf == 0 {
+			continue
+		}
+		if tf > b.maxTF[i] {
+			b.maxTF[i] = tf
+		}
+		if length := lengths[field]; b.minLen[i] == 0 || length < b.minLen[i] {
+			b.minLen[i] = length
+		}
+	}
+}
+
+// bound is the highest score a posting of the block can have for a term
+// held by df documents
+func (b *postingBlock) bound(config ScoringConfig, stats corpusStats, df float64) float64 {
+	bound := 0.0
+	for i, field := range textFields {
+		if b.maxTF[i] > 0 {
+			bound += fieldScore(config, stats, df, field, b.maxTF[i], b.minLen[i])
+		}
+	}
+	return bound
+}
+
+// buildPostingList sorts a segment's postings of term into a posting list
+func buildPostingList(seg *segment, term string) *postingList {
+	docs := seg.postings[term]
+	list := &postingList{ids: make([]string, 0, len(docs)), whole: newPostingBlock()}
+	for id := range docs {
+		list.ids = append(list.ids, id)
+	}
+	sort.Strings(list.ids)
+	for i, id := range list.ids {
+		p := docs[id]
+		if i%wandBlockSize == 0 {
+			list.blocks = append(list.blocks, newPostingBlock())
+		}
+		block := &list.blocks[len(list.blocks)-1]
+		block.include(p, seg.lengths[id])
+		block.last = id
+		list.whole.include(p, seg.lengths[id])
+	}
+	if len(list.ids) > 0 {
+		list.whole.last = list.ids[len(list.ids)-1]
+	}
+	return list
+}
+
+// postingList returns a segment's postings of term in ID order. Lists of
+// flushed segments are built once and kept, since the postings never
+// change; the buffer's are built afresh for each search.
+func (idx *invertedIndex) postingList(seg *segment, term string) *postingList {
+	if seg == idx.buffer {
+		return buildPostingList(seg, term)
+	}
+	seg.listMutex.Lock()
+	defer seg.listMutex.Unlock()
+	list, ok := seg.lists[term]
+	if !ok {
+		if seg.lists == nil {
+			seg.lists = make(map[string]*postingList)
+		}
+		list = buildPostingList(seg, term)
+		seg.lists[term] = list
+	}
+	return list
+}
+
+// wandCursor walks one term's posting list
+type wandCursor struct {
+	list  *postingList
+	pos   int
+	df    float64
+	bound float64 // Of the whole list
+}
+
+func (c *wandCursor) exhausted() bool {
+	return c.pos >= len(c.list.ids)
+}
+
+func (c *wandCursor) doc() string {
+	return c.list.ids[c.pos]
+}
+
+// seek moves to the first posting at or after id
+func (c *wandCursor) seek(id string) {
+	c.pos += sort.SearchStrings(c.list.ids[c.pos:], id)
+}
+
+// seekPast moves to the first posting after id
+func (c *wandCursor) seekPast(id string) {
+	rest := c.list.ids[c.pos:]
+	c.pos += sort.Search(len(rest), func(i int) bool { return rest[i] > id })
+}
+
+// blockBound returns the score bound of the block holding the first
+// posting at or after id, and the last ID of that block
+func (c *wandCursor) blockBound(id string, config ScoringConfig, stats corpusStats) (float64, string) {
+	blocks := c.list.blocks[c.pos/wandBlockSize:]
+	b := sort.Search(len(blocks), func(i int) bool { return blocks[i].last >= id })
+	if b == len(blocks) {
+		return 0, c.list.whole.last
+	}
+	return blocks[b].bound(config, stats, c.df), blocks[b].last
+}
+
+// topResults keeps the k best results seen, the worst on top
+type topResults []SearchResult
+
+func (t topResults) Len() int            { return len(t) }
+func (t topResults) Less(i, j int) bool  { return worse(t[i], t[j]) }
+func (t topResults) Swap(i, j int)       { t[i], t[j] = t[j], t[i] }
+func (t *topResults) Push(x interface{}) { *t = append(*t, x.(SearchResult)) }
+func (t *topResults) Pop() interface{} {
+	old := *t
+	last := old[len(old)-1]
+	*t = old[:len(old)-1]
+	return last
+}
+
+// worse orders results as rankLocked does, reversed
+func worse(a, b SearchResult) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return a.Document.ID > b.Document.ID
+}
+
+// wandSearch is the state of one top-k search across shards. The k-th best
+// score so far is the threshold a document's bound must reach for it to be
+// scored at all, and it rises as better documents turn up.
+type wandSearch struct {
+	k      int
+	terms  []string
+	config ScoringConfig
+	stats  corpusStats
+	top    topResults
+}
+
+// reaches reports whether a score bound could beat the k-th best result.
+// The slack covers rounding, since bounds and scores are summed in
+// different orders.
+func (w *wandSearch) reaches(bound float64) bool {
+	if len(w.top) < w.k {
+		return true
+	}
+	threshold := w.top[0].Score
+	return bound >= threshold-1e-9*threshold
+}
+
+// consider scores a live document and keeps it if it is among the k best
+func (w *wandSearch) consider(s *shard, id string) {
+	result := SearchResult{Document: s.documents[id], Score: s.text.score(id, w.terms, w.config, w.stats)}
+	if len(w.top) < w.k {
+		heap.Push(&w.top, result)
+	} else if worse(w.top[0], result) {
+		w.top[0] = result
+		heap.Fix(&w.top, 0)
+	}
+}
+
+// segment runs block-max WAND over one segment of a shard's index: cursors
+// are kept in document order, and only where the bounds of the terms seen
+// so far reach the threshold is a document scored; whole blocks whose
+// bounds fall short are skipped. Callers hold the shard's lock.
+func (w *wandSearch) segment(s *shard, seg *segment) {
+	var cursors []*wandCursor
+	for _, term := range w.terms {
+		list := s.text.postingList(seg, term)
+		if len(list.ids) == 0 {
+			continue
+		}
+		df := w.stats.df[term]
+		cursors = append(cursors, &wandCursor{list: list, df: df, bound: list.whole.bound(w.config, w.stats, df)})
+	}
+	for {
+		live := cursors[:0]
+		for _, c := range cursors {
+			if !c.exhausted() {
+				live = append(live, c)
+			}
+		}
+		cursors = live
+		if len(cursors) == 0 {
+			return
+		}
+		sort.Slice(cursors, func(i, j int) bool { return cursors[i].doc() < cursors[j].doc() })
+
+		// The pivot is the first document whose terms could together
+		// reach the threshold; every document before it falls short
+		p, sum := -1, 0.0
+		for i, c := range cursors {
+			sum += c.bound
+			if w.reaches(sum) {
+				p = i
+				break
+			}
+		}
+		if p < 0 {
+			return
+		}
+		pivot := cursors[p].doc()
+		for p+1 < len(cursors) && cursors[p+1].doc() == pivot {
+			p++
+		}
+
+		blockSum, limit := 0.0, ""
+		for i, c := range cursors[:p+1] {
+			bound, last := c.blockBound(pivot, w.config, w.stats)
+			blockSum += bound
+			if i == 0 || last < limit {
+				limit = last
+			}
+		}
+		if !w.reaches(blockSum) {
+			// Up to the end of the nearest block, only these cursors hold
+			// documents, and their blocks fall short
+			if p+1 < len(cursors) && cursors[p+1].doc() <= limit {
+				next := cursors[p+1].doc()
+				for _, c := range cursors[:p+1] {
+					c.seek(next)
+				}
+			} else {
+				for _, c := range cursors[:p+1] {
+					c.seekPast(limit)
+				}
+			}
+			continue
+		}
+
+		if cursors[0].doc() != pivot {
+			for _, c := range cursors[:p] {
+				c.seek(pivot)
+			}
+			continue
+		}
+		if s.text.live[pivot] == seg {
+			w.consider(s, pivot)
+		}
+		for _, c := range cursors[:p+1] {
+			c.pos++
+		}
+	}
+}
+
+// SetTopKPruning makes TopK ask enabled, before each search, whether to
+// skip postings that can't make the top k or rank every match, so the
+// pruning can be rolled out and back at runtime. Nil, the default, always
+// prunes.
+func (db *DocumentDB) SetTopKPruning(enabled func() bool) {
+	db.mutex.Lock()
+	db.pruning = enabled
+	db.mutex.Unlock()
+}
+
+// topKPruning reports whether TopK prunes
+func (db *DocumentDB) topKPruning() bool {
+	db.mutex.RLock()
+	enabled := db.pruning
+	db.mutex.RUnlock()
+	return enabled == nil || enabled()
+}
+
+// TopK returns the k documents best matching any word of query, best
+// first, as the first k of RankedSearch would be. Rather than score every
+// match, it skips the documents and blocks of postings whose score bounds
+// can't make the top k, so small k over long posting lists costs a fraction
+// of a full ranking. Custom scorers, metadata boosts and analysis with
+// several analyzers rank the full result instead, since their scores can't
+// be bounded by the index, as do searches while SetTopKPruning turns
+// pruning off.
+func (db *DocumentDB) TopK(query string, k int) []SearchResult {
+	if k <= 0 {
+		return nil
+	}
+	config := db.scoringConfig()
+	analyzers := db.currentAnalysis().analyzers()
+	if config.Scorer != nil || len(config.MetadataBoosts) > 0 || len(analyzers) > 1 || !db.topKPruning() {
+		results := db.RankedSearch(query)
+		if len(results) > k {
+			results = results[:k]
+		}
+		return results
+	}
+
+	var terms []string
+	seen := make(map[string]bool)
+	for _, term := range analyzers[0].Analyze(query) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	db.rlockAll()
+	defer db.runlockAll()
+
+	w := &wandSearch{k: k, terms: terms, config: config, stats: db.corpusStatsLocked(terms)}
+	for _, s := range db.shards {
+		for _, seg := range s.text.searchable() {
+			w.segment(s, seg)
+		}
+	}
+	results := make([]SearchResult, len(w.top))
+	for i := len(results) - 1; i >= 0; i-- {
+		results[i] = heap.Pop(&w.top).(SearchResult)
+	}
+	return results
+}
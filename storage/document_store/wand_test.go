@@ -0,0 +1,141 @@
+package documentstore_test
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	documentstore "storage/document_store"
+)
+
+// randomText joins n words drawn from the first vocabulary words, common
+// words more often than rare ones
+func randomText(rng *rand.Rand, vocabulary, n int) string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", rng.Intn(rng.Intn(vocabulary)+1))
+	}
+	return strings.Join(words, " ")
+}
+
+// Test that TopK returns the first k results of a full ranking, on random
+// corpora spread over several segments, with tied scores and with k beyond
+// the number of matches
+func TestTopKMatchesFullRanking(t *testing.T) {
+	ties := 0
+	for seed := int64(1); seed <= 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		db := openMemoryDB(t)
+		db.SetSegmentOptions(documentstore.SegmentOptions{FlushDocs: 1 + rng.Intn(50), MergeFactor: 2 + rng.Intn(4)})
+		vocabulary := 5 + rng.Intn(40)
+		docs := 50 + rng.Intn(400)
+
+		var contents []*documentstore.Document
+		for i := 0; i < docs; i++ {
+			doc := &documentstore.Document{
+				ID:      fmt.Sprintf("doc%04d", i),
+				Title:   randomText(rng, vocabulary, 1+rng.Intn(3)),
+				Content: randomText(rng, vocabulary, 1+rng.Intn(80)),
+			}
+			// Copies of earlier documents score the same, leaving the ID
+			// to break the tie
+			if i > 0 && rng.Intn(4) == 0 {
+				earlier := contents[rng.Intn(len(contents))]
+				doc.Title, doc.Content = earlier.Title, earlier.Content
+			}
+			if err := db.AddDocument(doc); err != nil {
+				t.Fatalf("Failed to add document: %v", err)
+			}
+			contents = append(contents, doc)
+		}
+		// Updates and deletes leave stale postings behind in older segments
+		for i := 0; i < docs/10; i++ {
+			err := db.UpdateDocument(contents[rng.Intn(docs)].ID, randomText(rng, vocabulary, 1+rng.Intn(80)))
+			if err != nil && !errors.Is(err, documentstore.ErrNotFound) {
+				t.Fatalf("Failed to update document: %v", err)
+			}
+			db.DeleteDocument(contents[rng.Intn(docs)].ID)
+		}
+
+		for q := 0; q < 30; q++ {
+			query := randomText(rng, vocabulary+5, 1+rng.Intn(5))
+			full := db.RankedSearch(query)
+			for i := 1; i < len(full); i++ {
+				if full[i].Score == full[i-1].Score {
+					ties++
+				}
+			}
+			for _, k := range []int{1, 3, 10, len(full), len(full) + 5} {
+				if k == 0 {
+					continue
+				}
+				want := full
+				if len(want) > k {
+					want = want[:k]
+				}
+				got := db.TopK(query, k)
+				if len(got) != len(want) {
+					t.Fatalf("Seed %d: top %d of %q has %d results, expected %d", seed, k, query, len(got), len(want))
+				}
+				for i := range want {
+					if got[i].Document.ID != want[i].Document.ID || math.Abs(got[i].Score-want[i].Score) > 1e-9*want[i].Score {
+						t.Fatalf("Seed %d: result %d of the top %d of %q is %s scoring %v, expected %s scoring %v",
+							seed, i, k, query, got[i].Document.ID, got[i].Score, want[i].Document.ID, want[i].Score)
+					}
+				}
+			}
+		}
+	}
+	if ties == 0 {
+		t.Fatalf("No query ranked tied scores")
+	}
+}
+
+// Benchmark top-k searches of increasing length over common words, ranking
+// every match against pruning with TopK
+func BenchmarkTopK(b *testing.B) {
+	const k = 10
+	db := documentstore.NewDocumentDB()
+	defer db.Close()
+	rng := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(rng, 1.1, 1, 4999)
+	var docs []*documentstore.Document
+	for i := 0; i < 20000; i++ {
+		words := make([]string, 50+rng.Intn(250))
+		for j := range words {
+			words[j] = fmt.Sprintf("w%d", zipf.Uint64())
+		}
+		docs = append(docs, &documentstore.Document{ID: fmt.Sprintf("doc%07d", i), Content: strings.Join(words, " ")})
+	}
+	if err := db.Bulk(docs, documentstore.BulkOptions{}).Err(); err != nil {
+		b.Fatalf("Failed to add documents: %v", err)
+	}
+	db.ForceMerge()
+
+	for _, words := range []int{1, 2, 4, 8} {
+		var queries []string
+		for q := 0; q < 20; q++ {
+			terms := make([]string, words)
+			for i := range terms {
+				terms[i] = fmt.Sprintf("w%d", rng.Intn(50))
+			}
+			queries = append(queries, strings.Join(terms, " "))
+		}
+		b.Run(fmt.Sprintf("words=%d/full", words), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				results := db.RankedSearch(queries[i%len(queries)])
+				if len(results) > k {
+					results = results[:k]
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("words=%d/pruned", words), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				db.TopK(queries[i%len(queries)], k)
+			}
+		})
+	}
+}
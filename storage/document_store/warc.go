@@ -0,0 +1,206 @@
+package documentstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const warcVersion = "WARC/1.0"
+
+// Extension fields carrying what WARC has no field for. Values are JSON so
+// titles and metadata can hold any text.
+const (
+	warcDocumentID       = "X-Document-ID"
+	warcDocumentTitle    = "X-Document-Title"
+	warcDocumentMetadata = "X-Document-Metadata"
+)
+
+// Metadata keys a WARC record's target URI and content type map to
+const (
+	metadataURL         = "url"
+	metadataContentType = "content_type"
+)
+
+// writeWARC writes a warcinfo record, then a resource record per document.
+// The target URI is the document's "url" metadata, or a URN naming the
+// document if it has none.
+func writeWARC(w io.Writer, docs []*Document) error {
+	bw := bufio.NewWriter(w)
+	now := time.Now().UTC()
+	info := "software: documentstore\r\nformat: WARC File Format 1.0\r\n"
+	err := writeWARCRecord(bw, []string{
+		"WARC-Type", "warcinfo",
+		"WARC-Record-ID", warcRecordID("warcinfo", now.String()),
+		"WARC-Date", now.Format(time.RFC3339),
+		"Content-Type", "application/warc-fields",
+	}, []byte(info))
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		target := doc.Metadata[metadataURL]
+		if !validHeaderValue(target) {
+			target = "urn:x-document:" + url.PathEscape(doc.ID)
+		}
+		contentType := doc.Metadata[metadataContentType]
+		if !validHeaderValue(contentType) {
+			contentType = "text/plain; charset=utf-8"
+		}
+		id, _ := json.Marshal(doc.ID)
+		title, _ := json.Marshal(doc.Title)
+		headers := []string{
+			"WARC-Type", "resource",
+			"WARC-Record-ID", warcRecordID(doc.ID, strconv.FormatUint(doc.Version, 10)),
+			"WARC-Date", doc.UpdatedAt.UTC().Format(time.RFC3339),
+			"WARC-Target-URI", target,
+			"Content-Type", contentType,
+			warcDocumentID, string(id),
+			warcDocumentTitle, string(title),
+		}
+		if len(doc.Metadata) > 0 {
+			metadata, err := json.Marshal(doc.Metadata)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, warcDocumentMetadata, string(metadata))
+		}
+		if err := writeWARCRecord(bw, headers, []byte(doc.Content)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeWARCRecord writes one record from header name and value pairs
+func writeWARCRecord(w *bufio.Writer, headers []string, block []byte) error {
+	w.WriteString(warcVersion + "\r\n")
+	for i := 0; i < len(headers); i += 2 {
+		fmt.Fprintf(w, "%s: %s\r\n", headers[i], headers[i+1])
+	}
+	fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(block))
+	w.Write(block)
+	_, err := w.WriteString("\r\n\r\n")
+	return err
+}
+
+// validHeaderValue reports whether value can go in a header as is
+func validHeaderValue(value string) bool {
+	return value != "" && !strings.ContainsAny(value, "\r\n")
+}
+
+// warcRecordID derives a stable record ID, so exporting the same documents
+// twice gives the same records
+func warcRecordID(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	sum[6] = sum[6]&0x0f | 0x50 // UUID version 5 layout
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// warcReader reads documents from the resource and response records of a
+// WARC file, skipping other records
+type warcReader struct {
+	r *bufio.Reader
+}
+
+// next returns the next document, or io.EOF after the last
+func (wr *warcReader) next() (*Document, error) {
+	for {
+		version, err := wr.r.ReadString('\n')
+		if err == io.EOF && strings.TrimSpace(version) == "" {
+			return nil, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		version = strings.TrimSpace(version)
+		if version == "" {
+			continue // Blank lines end each record
+		}
+		if !strings.HasPrefix(version, "WARC/") {
+			return nil, fmt.Errorf("expected a WARC record, found %q", version)
+		}
+
+		headers, err := textproto.NewReader(wr.r).ReadMIMEHeader()
+		if err != nil {
+			return nil, fmt.Errorf("malformed WARC headers: %w", err)
+		}
+		length, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+		if err != nil || length < 0 {
+			return nil, errors.New("WARC record has no valid Content-Length")
+		}
+		block := make([]byte, length)
+		if _, err := io.ReadFull(wr.r, block); err != nil {
+			return nil, fmt.Errorf("truncated WARC record: %w", err)
+		}
+
+		switch headers.Get("WARC-Type") {
+		case "resource":
+			return warcDocument(headers, block, headers.Get("Content-Type"))
+		case "response":
+			if !strings.HasPrefix(headers.Get("Content-Type"), "application/http") {
+				continue
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), nil)
+			if err != nil {
+				return nil, fmt.Errorf("malformed HTTP response in WARC record: %w", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("malformed HTTP response in WARC record: %w", err)
+			}
+			return warcDocument(headers, body, resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+// warcDocument builds a document from a record. Records from other tools
+// lack the extension fields, so their target URI serves as ID and, with
+// their content type, as metadata, and their WARC-Date as crawl time.
+func warcDocument(headers textproto.MIMEHeader, content []byte, contentType string) (*Document, error) {
+	doc := &Document{Content: string(content)}
+	value := headers.Get(warcDocumentID)
+	if value == "" {
+		doc.ID = headers.Get("WARC-Target-URI")
+		setMetadata(doc, metadataURL, doc.ID)
+		if contentType != "" {
+			setMetadata(doc, metadataContentType, contentType)
+		}
+		setCrawlTime(doc, headers)
+		return doc, nil
+	}
+	if err := json.Unmarshal([]byte(value), &doc.ID); err != nil {
+		return nil, fmt.Errorf("malformed %s: %w", warcDocumentID, err)
+	}
+	if value := headers.Get(warcDocumentTitle); value != "" {
+		if err := json.Unmarshal([]byte(value), &doc.Title); err != nil {
+			return nil, fmt.Errorf("malformed %s: %w", warcDocumentTitle, err)
+		}
+	}
+	if value := headers.Get(warcDocumentMetadata); value != "" {
+		if err := json.Unmarshal([]byte(value), &doc.Metadata); err != nil {
+			return nil, fmt.Errorf("malformed %s: %w", warcDocumentMetadata, err)
+		}
+	}
+	return doc, nil
+}
+
+// setCrawlTime records a record's WARC-Date as the document's crawl time
+func setCrawlTime(doc *Document, headers textproto.MIMEHeader) {
+	if t, err := time.Parse(time.RFC3339Nano, headers.Get("WARC-Date")); err == nil {
+		setMetadata(doc, CrawledAtKey, t.UTC().Format(time.RFC3339Nano))
+	}
+}
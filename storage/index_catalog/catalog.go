@@ -0,0 +1,441 @@
+package indexcatalog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"monitoring/logging"
+	documentstore "storage/document_store"
+)
+
+// logger reports what goes wrong without failing a call
+var logger = logging.Component("storage/index_catalog")
+
+// DeleteTokenTTL is how long the confirmation token for deleting an index
+// stays good
+const DeleteTokenTTL = 5 * time.Minute
+
+// Errors of catalog operations
+var (
+	ErrNotFound  = errors.New("index not found")
+	ErrExists    = errors.New("name already taken")
+	ErrInUse     = errors.New("index is in use by an alias")
+	ErrBadToken  = errors.New("confirmation token is wrong or expired")
+	ErrBadName   = errors.New("names are 1 to 64 lowercase letters, digits, '-' and '_', starting with a letter or digit")
+	ErrSameIndex = errors.New("cannot reindex an index into itself")
+)
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// IndexInfo describes an index in the catalog
+type IndexInfo struct {
+	Name      string    `json:"name"`
+	Documents int       `json:"documents"`
+	Aliases   []string  `json:"aliases"` // Pointing at the index
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeleteToken confirms the deletion of an index
+type DeleteToken struct {
+	Index     string    `json:"index"`
+	Token     string    `json:"confirm"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// index is an open index of the catalog
+type index struct {
+	db        *documentstore.DocumentDB
+	createdAt time.Time
+}
+
+// catalogFile is what the catalog keeps in catalog.json
+type catalogFile struct {
+	Indices map[string]time.Time `json:"indices"` // Name to creation time
+	Aliases map[string]string    `json:"aliases"` // Alias to index name
+}
+
+// Catalog manages named indices, each a DocumentDB, and the aliases
+// clients address them by. Pointing an alias at another index takes
+// effect at once for every lookup after it, so a rebuilt index can be put
+// into service by moving its alias once the rebuild is done.
+type Catalog struct {
+	dir       string
+	configure func(name string, db *documentstore.DocumentDB)
+
+	mutex      sync.RWMutex
+	indices    map[string]*index
+	aliases    map[string]string
+	deletes    map[string]DeleteToken // Pending confirmations by index name
+	transforms map[string]Transform   // Registered for reindexing by name
+}
+
+// OpenCatalog opens the catalog in dir, creating it if need be, along with
+// every index it holds; each index is a Bolt file named after it. An empty
+// dir keeps indices in memory only. configure, if not nil, is called with
+// each index as it is opened or created, to set its scoring, analysis and
+// the like.
+func OpenCatalog(dir string, configure func(name string, db *documentstore.DocumentDB)) (*Catalog, error) {
+	c := &Catalog{
+		dir:        dir,
+		configure:  configure,
+		indices:    make(map[string]*index),
+		aliases:    make(map[string]string),
+		deletes:    make(map[string]DeleteToken),
+		transforms: make(map[string]Transform),
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(c.catalogPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file catalogFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse index catalog %s: %w", c.catalogPath(), err)
+	}
+	for name, createdAt := range file.Indices {
+		db, err := c.open(name)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.indices[name] = &index{db: db, createdAt: createdAt}
+	}
+	for alias, name := range file.Aliases {
+		c.aliases[alias] = name
+	}
+	return c, nil
+}
+
+func (c *Catalog) catalogPath() string {
+	return filepath.Join(c.dir, "catalog.json")
+}
+
+func (c *Catalog) indexPath(name string) string {
+	return filepath.Join(c.dir, name+".db")
+}
+
+// open opens the database of an index, configured before its documents are
+// loaded
+func (c *Catalog) open(name string) (*documentstore.DocumentDB, error) {
+	var engine documentstore.StorageEngine = documentstore.NewMemoryEngine()
+	if c.dir != "" {
+		bolt, err := documentstore.OpenBoltEngine(c.indexPath(name))
+		if err != nil {
+			return nil, err
+		}
+		engine = bolt
+	}
+	var settings []func(*documentstore.DocumentDB)
+	if c.configure != nil {
+		settings = append(settings, func(db *documentstore.DocumentDB) { c.configure(name, db) })
+	}
+	db, err := documentstore.OpenDocumentDB(engine, settings...)
+	if err != nil {
+		engine.Close()
+		return nil, fmt.Errorf("failed to open index %s: %w", name, err)
+	}
+	return db, nil
+}
+
+// saveLocked writes the catalog to a temporary file and renames it over
+// catalog.json, so a crash never leaves a partial one
+func (c *Catalog) saveLocked() error {
+	if c.dir == "" {
+		return nil
+	}
+	file := catalogFile{Indices: make(map[string]time.Time, len(c.indices)), Aliases: c.aliases}
+	for name, idx := range c.indices {
+		file.Indices[name] = idx.createdAt
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, "catalog.json.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.catalogPath())
+}
+
+// Create creates an empty index. Its name may not be taken by another
+// index or an alias.
+func (c *Catalog) Create(name string) (IndexInfo, error) {
+	if !validName.MatchString(name) {
+		return IndexInfo{}, fmt.Errorf("%w: %q", ErrBadName, name)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.checkFreeLocked(name); err != nil {
+		return IndexInfo{}, err
+	}
+	db, err := c.open(name)
+	if err != nil {
+		return IndexInfo{}, err
+	}
+	idx := &index{db: db, createdAt: time.Now().UTC()}
+	c.indices[name] = idx
+	if err := c.saveLocked(); err != nil {
+		delete(c.indices, name)
+		db.Close()
+		if c.dir != "" {
+			os.Remove(c.indexPath(name))
+		}
+		return IndexInfo{}, err
+	}
+	return c.infoLocked(name, idx), nil
+}
+
+// checkFreeLocked fails if an index or alias already goes by name
+func (c *Catalog) checkFreeLocked(name string) error {
+	if _, exists := c.indices[name]; exists {
+		return fmt.Errorf("%w: %s is an index", ErrExists, name)
+	}
+	if _, exists := c.aliases[name]; exists {
+		return fmt.Errorf("%w: %s is an alias", ErrExists, name)
+	}
+	return nil
+}
+
+// Get returns the database of an index, by its name or an alias of it
+func (c *Catalog) Get(name string) (*documentstore.DocumentDB, error) {
+	_, db, err := c.lookup(name)
+	return db, err
+}
+
+// Resolve returns the name of the index an alias points at, or name
+// itself if it is an index
+func (c *Catalog) Resolve(name string) (string, error) {
+	resolved, _, err := c.lookup(name)
+	return resolved, err
+}
+
+// lookup returns the name and database of an index, by its name or an
+// alias of it, both as of the same moment
+func (c *Catalog) lookup(name string) (string, *documentstore.DocumentDB, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	resolved, idx, err := c.resolveLocked(name)
+	if err != nil {
+		return "", nil, err
+	}
+	return resolved, idx.db, nil
+}
+
+func (c *Catalog) resolveLocked(name string) (string, *index, error) {
+	if target, exists := c.aliases[name]; exists {
+		name = target
+	}
+	idx, exists := c.indices[name]
+	if !exists {
+		return "", nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return name, idx, nil
+}
+
+// Info describes an index, by its name or an alias of it
+func (c *Catalog) Info(name string) (IndexInfo, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	resolved, idx, err := c.resolveLocked(name)
+	if err != nil {
+		return IndexInfo{}, err
+	}
+	return c.infoLocked(resolved, idx), nil
+}
+
+// List describes every index, by name
+func (c *Catalog) List() []IndexInfo {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	infos := make([]IndexInfo, 0, len(c.indices))
+	for name, idx := range c.indices {
+		infos = append(infos, c.infoLocked(name, idx))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (c *Catalog) infoLocked(name string, idx *index) IndexInfo {
+	info := IndexInfo{Name: name, Documents: len(idx.db.ListDocuments()), Aliases: []string{}, CreatedAt: idx.createdAt}
+	for alias, target := range c.aliases {
+		if target == name {
+			info.Aliases = append(info.Aliases, alias)
+		}
+	}
+	sort.Strings(info.Aliases)
+	return info
+}
+
+// Aliases returns every alias and the index it points at
+func (c *Catalog) Aliases() map[string]string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	aliases := make(map[string]string, len(c.aliases))
+	for alias, name := range c.aliases {
+		aliases[alias] = name
+	}
+	return aliases
+}
+
+// SetAlias points an alias at an index, creating the alias or moving it
+// from the index it pointed at. Lookups switch over all at once: each
+// finds either the old index or the new one.
+func (c *Catalog) SetAlias(alias, name string) error {
+	if !validName.MatchString(alias) {
+		return fmt.Errorf("%w: %q", ErrBadName, alias)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, exists := c.indices[alias]; exists {
+		return fmt.Errorf("%w: %s is an index", ErrExists, alias)
+	}
+	if _, exists := c.indices[name]; !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	previous, existed := c.aliases[alias]
+	c.aliases[alias] = name
+	if err := c.saveLocked(); err != nil {
+		if existed {
+			c.aliases[alias] = previous
+		} else {
+			delete(c.aliases, alias)
+		}
+		return err
+	}
+	return nil
+}
+
+// RemoveAlias removes an alias; the index it pointed at stays
+func (c *Catalog) RemoveAlias(alias string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	name, exists := c.aliases[alias]
+	if !exists {
+		return fmt.Errorf("%w: no alias %s", ErrNotFound, alias)
+	}
+	delete(c.aliases, alias)
+	if err := c.saveLocked(); err != nil {
+		c.aliases[alias] = name
+		return err
+	}
+	return nil
+}
+
+// RequestDelete returns the token that confirms deleting an index, good
+// for DeleteTokenTTL. Deletion takes the index's own name, not an alias,
+// and asking again replaces the token.
+func (c *Catalog) RequestDelete(name string) (DeleteToken, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, exists := c.indices[name]; !exists {
+		return DeleteToken{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err := c.checkUnaliasedLocked(name); err != nil {
+		return DeleteToken{}, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return DeleteToken{}, err
+	}
+	token := DeleteToken{Index: name, Token: hex.EncodeToString(b), ExpiresAt: time.Now().Add(DeleteTokenTTL).UTC()}
+	c.deletes[name] = token
+	return token, nil
+}
+
+// Delete deletes an index and its documents for good, given the token
+// RequestDelete returned for it. Indices an alias points at are not
+// deleted; move or remove the alias first.
+func (c *Catalog) Delete(name, token string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	idx, exists := c.indices[name]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err := c.checkUnaliasedLocked(name); err != nil {
+		return err
+	}
+	pending, exists := c.deletes[name]
+	if !exists || token == "" || pending.Token != token || time.Now().After(pending.ExpiresAt) {
+		return fmt.Errorf("%w: deleting %s", ErrBadToken, name)
+	}
+	delete(c.deletes, name)
+	delete(c.indices, name)
+	if err := c.saveLocked(); err != nil {
+		c.indices[name] = idx
+		return err
+	}
+	if err := idx.db.Close(); err != nil {
+		logger.Error("Failed to close index", "index", name, "error", err)
+	}
+	if c.dir != "" {
+		if err := os.Remove(c.indexPath(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("index %s is deleted but its file isn't: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Catalog) checkUnaliasedLocked(name string) error {
+	for alias, target := range c.aliases {
+		if target == name {
+			return fmt.Errorf("%w: %s points at %s", ErrInUse, alias, name)
+		}
+	}
+	return nil
+}
+
+// RegisterTransform makes a Transform available to reindexing over HTTP
+// under a name, replacing any registered under it before
+func (c *Catalog) RegisterTransform(name string, transform Transform) {
+	c.mutex.Lock()
+	c.transforms[name] = transform
+	c.mutex.Unlock()
+}
+
+// registeredTransform returns the Transform registered under name
+func (c *Catalog) registeredTransform(name string) (Transform, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	transform, exists := c.transforms[name]
+	return transform, exists
+}
+
+// Close closes every index
+func (c *Catalog) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var first error
+	for name, idx := range c.indices {
+		if err := idx.db.Close(); err != nil && first == nil {
+			first = fmt.Errorf("failed to close index %s: %w", name, err)
+		}
+	}
+	return first
+}
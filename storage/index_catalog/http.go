@@ -0,0 +1,199 @@
+package indexcatalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"pkg/httpjson"
+	documentstore "storage/document_store"
+)
+
+// Handler manages the catalog over HTTP and, if serve isn't nil, serves
+// each index at /indices/{name}/ with the handler serve returns for it,
+// looking the index up on every request so that moving an alias takes
+// effect at once. It checks no credentials itself, so it belongs behind
+// authentication.
+//
+//	GET    /indices                     every index
+//	PUT    /indices/{name}              create an empty index
+//	GET    /indices/{name}              an index, by name or alias
+//	DELETE /indices/{name}              answer 428 with a token confirming
+//	                                    the deletion, see RequestDelete
+//	DELETE /indices/{name}?confirm=tok  delete an index and its documents
+//	*      /indices/{name}/...          the index, by name or alias, as
+//	                                    serve serves it
+//	GET    /aliases                     every alias and its index
+//	PUT    /aliases/{alias}             point an alias at {"index"}
+//	DELETE /aliases/{alias}             remove an alias
+//	POST   /reindex                     copy {"source"} into {"dest"}
+//	                                    through the registered {"transform"}
+//	                                    and then {"metadata"}, a
+//	                                    MetadataTransform
+func (c *Catalog) Handler(serve func(name string, db *documentstore.DocumentDB) http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/indices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, c.List())
+	})
+	mux.HandleFunc("/indices/", func(w http.ResponseWriter, r *http.Request) {
+		name, rest, nested := strings.Cut(strings.TrimPrefix(r.URL.Path, "/indices/"), "/")
+		if name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if nested {
+			c.serveIndex(w, r, name, rest, serve)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			info, err := c.Info(name)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, info)
+		case http.MethodPut, http.MethodPost:
+			info, err := c.Create(name)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			httpjson.Write(w, http.StatusCreated, info)
+		case http.MethodDelete:
+			token := r.URL.Query().Get("confirm")
+			if token == "" {
+				pending, err := c.RequestDelete(name)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				httpjson.Write(w, http.StatusPreconditionRequired, pending)
+				return
+			}
+			if err := c.Delete(name, token); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/aliases", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, c.Aliases())
+	})
+	mux.HandleFunc("/aliases/", func(w http.ResponseWriter, r *http.Request) {
+		alias := strings.TrimPrefix(r.URL.Path, "/aliases/")
+		if alias == "" || strings.Contains(alias, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			var spec struct {
+				Index string `json:"index"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&spec); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := c.SetAlias(alias, spec.Index); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			if err := c.RemoveAlias(alias); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/reindex", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var spec struct {
+			Source    string             `json:"source"`
+			Dest      string             `json:"dest"`
+			Transform string             `json:"transform"`
+			Metadata  *MetadataTransform `json:"metadata"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&spec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var transforms []Transform
+		if spec.Transform != "" {
+			transform, exists := c.registeredTransform(spec.Transform)
+			if !exists {
+				http.Error(w, fmt.Sprintf("no transform %q is registered", spec.Transform), http.StatusBadRequest)
+				return
+			}
+			transforms = append(transforms, transform)
+		}
+		if spec.Metadata != nil {
+			transforms = append(transforms, spec.Metadata.Transform())
+		}
+		var transform Transform
+		if len(transforms) > 0 {
+			transform = Chain(transforms...)
+		}
+		report, err := c.Reindex(r.Context(), spec.Source, spec.Dest, transform)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, report)
+	})
+	return mux
+}
+
+// serveIndex passes a request for /indices/{name}/{rest} to the handler
+// serve returns for the index, as a request for /{rest}
+func (c *Catalog) serveIndex(w http.ResponseWriter, r *http.Request, name, rest string, serve func(string, *documentstore.DocumentDB) http.Handler) {
+	if serve == nil {
+		http.NotFound(w, r)
+		return
+	}
+	resolved, db, err := c.lookup(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/" + rest
+	r2.URL.RawPath = strings.TrimPrefix(r.URL.EscapedPath(), "/indices/"+name)
+	serve(resolved, db).ServeHTTP(w, r2)
+}
+
+// writeError answers with the status matching err
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrExists), errors.Is(err, ErrInUse):
+		status = http.StatusConflict
+	case errors.Is(err, ErrBadToken):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ErrBadName), errors.Is(err, ErrSameIndex):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
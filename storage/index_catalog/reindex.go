@@ -0,0 +1,211 @@
+package indexcatalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	documentstore "storage/document_store"
+)
+
+// Transform rewrites a document on its way from one index to another. It
+// gets a copy it may change and return, or it returns nil to leave the
+// document out of the new index. An error fails that document only.
+type Transform func(doc *documentstore.Document) (*documentstore.Document, error)
+
+// MetadataTransform is a Transform declared rather than coded, for
+// reindexing over HTTP: it renames metadata keys, then removes keys, then
+// sets values
+type MetadataTransform struct {
+	Rename map[string]string `json:"rename,omitempty"` // Old key to new key
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+}
+
+// Transform returns t as a Transform
+func (t MetadataTransform) Transform() Transform {
+	return func(doc *documentstore.Document) (*documentstore.Document, error) {
+		if doc.Metadata == nil {
+			doc.Metadata = make(map[string]string)
+		}
+		for from, to := range t.Rename {
+			if value, exists := doc.Metadata[from]; exists {
+				delete(doc.Metadata, from)
+				doc.Metadata[to] = value
+			}
+		}
+		for _, key := range t.Remove {
+			delete(doc.Metadata, key)
+		}
+		for key, value := range t.Set {
+			doc.Metadata[key] = value
+		}
+		return doc, nil
+	}
+}
+
+// Chain returns a Transform applying each of transforms in turn; a
+// document any of them drops is dropped
+func Chain(transforms ...Transform) Transform {
+	return func(doc *documentstore.Document) (*documentstore.Document, error) {
+		var err error
+		for _, transform := range transforms {
+			if doc, err = transform(doc); doc == nil || err != nil {
+				return nil, err
+			}
+		}
+		return doc, nil
+	}
+}
+
+// reindexBatchSize is how many documents Reindex writes at a time
+const reindexBatchSize = 500
+
+// ReindexReport tells how a reindex went
+type ReindexReport struct {
+	Source  string `json:"source"` // Index names, with aliases resolved
+	Dest    string `json:"dest"`
+	Copied  int    `json:"copied"`  // Documents written to dest
+	Dropped int    `json:"dropped"` // Left out by the transform
+	Failed  int    `json:"failed"`  // Failing the transform or the write
+	// Replayed counts the changes made to source while copying that were
+	// applied to dest afterwards
+	Replayed int `json:"replayed"`
+	// Seq is the sequence number of source's change feed dest is current
+	// with; changes to source after it are not in dest
+	Seq    uint64        `json:"seq"`
+	Errors []string      `json:"errors,omitempty"` // The first few
+	Took   time.Duration `json:"took"`
+}
+
+// maxReportErrors caps ReindexReport.Errors
+const maxReportErrors = 10
+
+func (r *ReindexReport) fail(id string, err error) {
+	r.Failed++
+	if len(r.Errors) < maxReportErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf("%s: %v", id, err))
+	}
+}
+
+// Reindex copies every document of the source index into dest, passing
+// each through transform if it isn't nil; documents dest already holds
+// are replaced. Both are named by index or alias, and dest has to exist,
+// so it is created with the settings wanted first. Changes made to source
+// while copying are replayed onto dest before Reindex returns, so dest is
+// current as of the report's Seq; stop writing to source first, or move
+// writers over, if no later change may be missed. Reindex stops with ctx's
+// error when ctx is done, leaving dest partly filled.
+func (c *Catalog) Reindex(ctx context.Context, source, dest string, transform Transform) (ReindexReport, error) {
+	started := time.Now()
+	report := ReindexReport{}
+	source, from, err := c.lookup(source)
+	if err != nil {
+		return report, err
+	}
+	dest, to, err := c.lookup(dest)
+	if err != nil {
+		return report, err
+	}
+	report.Source, report.Dest = source, dest
+	if source == dest {
+		return report, fmt.Errorf("%w: %s", ErrSameIndex, source)
+	}
+
+	// Changes after seq may or may not be in the snapshot, so they are all
+	// replayed; replaying a change dest already has is harmless
+	seq := from.ChangeSeq()
+	docs := from.ListDocuments()
+	sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+	batch := make([]*documentstore.Document, 0, reindexBatchSize)
+	for _, doc := range docs {
+		if err := ctx.Err(); err != nil {
+			report.Took = time.Since(started)
+			return report, err
+		}
+		if doc, ok := report.transform(doc, transform); ok {
+			batch = append(batch, doc)
+		}
+		if len(batch) == reindexBatchSize {
+			report.write(to, batch)
+			batch = batch[:0]
+		}
+	}
+	report.write(to, batch)
+
+	report.Seq, err = report.replay(ctx, from, to, seq, transform)
+	report.Took = time.Since(started)
+	return report, err
+}
+
+// transform passes a copy of doc through transform, counting it as dropped
+// or failed if it doesn't come out
+func (r *ReindexReport) transform(doc *documentstore.Document, transform Transform) (*documentstore.Document, bool) {
+	doc = doc.Clone()
+	if transform == nil {
+		return doc, true
+	}
+	id := doc.ID
+	doc, err := transform(doc)
+	switch {
+	case err != nil:
+		r.fail(id, err)
+		return nil, false
+	case doc == nil:
+		r.Dropped++
+		return nil, false
+	}
+	return doc, true
+}
+
+// write upserts a batch of documents into db
+func (r *ReindexReport) write(db *documentstore.DocumentDB, batch []*documentstore.Document) {
+	if len(batch) == 0 {
+		return
+	}
+	bulk := db.Bulk(batch, documentstore.BulkOptions{Upsert: true})
+	r.Copied += bulk.Created + bulk.Updated
+	for _, item := range bulk.Items {
+		if item.Error != "" {
+			r.fail(item.ID, errors.New(item.Error))
+		}
+	}
+}
+
+// replay applies the changes to from after seq, up to the latest when it
+// is called, onto to, and returns the sequence number it got to
+func (r *ReindexReport) replay(ctx context.Context, from, to *documentstore.DocumentDB, seq uint64, transform Transform) (uint64, error) {
+	end := from.ChangeSeq()
+	if end == seq {
+		return seq, nil
+	}
+	watchCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	events, err := from.Watch(watchCtx, seq)
+	if err != nil {
+		return seq, fmt.Errorf("failed to replay the changes made while copying: %w", err)
+	}
+	for event := range events {
+		if event.Type == documentstore.EventDelete {
+			if err := to.DeleteDocument(event.ID); err != nil && !errors.Is(err, documentstore.ErrNotFound) {
+				r.fail(event.ID, err)
+			}
+		} else if doc, ok := r.transform(event.Document, transform); ok {
+			r.write(to, []*documentstore.Document{doc})
+		} else if _, err := to.GetDocument(event.ID); err == nil {
+			// Dropped now, so an earlier version copied has to go
+			to.DeleteDocument(event.ID)
+		}
+		r.Replayed++
+		seq = event.Seq
+		if seq >= end {
+			return seq, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return seq, err
+	}
+	return seq, fmt.Errorf("the change feed ended at %d while replaying up to %d", seq, end)
+}
@@ -0,0 +1,265 @@
+package queryanalytics
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"monitoring/logging"
+)
+
+// logger reports the query log and judgments that can't be written, which
+// may happen for every search, so it is sampled
+var logger = logging.Sampled(logging.Component("storage/query_analytics"), logging.DefaultSampling)
+
+// Defaults for the Options left zero
+const (
+	DefaultInterval   = 10 * time.Minute
+	DefaultTopQueries = 20
+	DefaultReports    = 144 // A day of ten minute windows
+	DefaultMaxQueries = 10000
+	DefaultMaxSamples = 10000
+)
+
+// ErrUnknownQuery is returned for clicks on searches that weren't recorded
+// or whose window has been reported and forgotten
+var ErrUnknownQuery = errors.New("unknown or expired query ID")
+
+// Options configures an Analytics
+type Options struct {
+	// Log, if set, receives a JSON line for every search, click and skip,
+	// for offline analysis
+	Log io.Writer
+	// Judgments, if set, stores every click and skip joined to its search,
+	// for training ranking models
+	Judgments JudgmentStore
+	// Interval is how often the searches since the last report are
+	// aggregated into a new one, once Start is called
+	Interval time.Duration
+	// TopQueries is how many queries each list of a report holds
+	TopQueries int
+	// Reports is how many reports are kept, the oldest dropped first
+	Reports int
+	// MaxQueries bounds the distinct queries counted in a window; searches
+	// for more are counted as untracked, so a flood of unique queries
+	// can't exhaust memory
+	MaxQueries int
+	// MaxSamples bounds the latencies kept per window; percentiles come
+	// from a uniform sample of this many
+	MaxSamples int
+}
+
+// Search is a search as it is recorded
+type Search struct {
+	Query    string
+	Time     time.Time // When it was answered; zero means now
+	Latency  time.Duration
+	Results  int // Matches across all pages
+	TimedOut bool
+	// Hits are the IDs of the results shown, in order, so clicks can be
+	// checked against them and the results skipped above a click inferred
+	Hits []string
+}
+
+// Click is a user opening a result of a search or, with EventSkip, passing
+// it over
+type Click struct {
+	QueryID string // Record's ID for the search
+	ID      string // Of the document
+	// Position is of the result among the search's hits, from 1; 0 means
+	// unknown, which the hits recorded with the search may tell
+	Position int
+	Event    Event     // Empty means EventClick
+	Time     time.Time // Zero means now
+}
+
+// logLine is a line of the log, for either a search or a click
+type logLine struct {
+	Type       string    `json:"type"` // "search", "click" or "skip"
+	Time       time.Time `json:"time"`
+	QueryID    string    `json:"query_id"`
+	Query      string    `json:"query,omitempty"`
+	LatencyMs  float64   `json:"latency_ms,omitempty"`
+	Results    int       `json:"results,omitempty"`
+	TimedOut   bool      `json:"timed_out,omitempty"`
+	DocumentID string    `json:"document_id,omitempty"`
+	Position   int       `json:"position,omitempty"`
+}
+
+// Analytics records searches and the results clicked on them, and
+// aggregates them window by window into reports of the top queries, the
+// queries finding nothing and latency percentiles, for tuning relevance.
+// Clicks are attributed to the query of the search they follow, and count
+// in the window they arrive in.
+type Analytics struct {
+	options Options
+	logging sync.Mutex // Serializes log lines
+
+	mutex    sync.Mutex
+	current  *window
+	previous *window  // Clicks on its searches still count
+	reports  []Report // Oldest first
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// New returns an Analytics; zero options take their defaults. Call Start
+// to aggregate reports periodically.
+func New(options Options) *Analytics {
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.TopQueries <= 0 {
+		options.TopQueries = DefaultTopQueries
+	}
+	if options.Reports <= 0 {
+		options.Reports = DefaultReports
+	}
+	if options.MaxQueries <= 0 {
+		options.MaxQueries = DefaultMaxQueries
+	}
+	if options.MaxSamples <= 0 {
+		options.MaxSamples = DefaultMaxSamples
+	}
+	return &Analytics{options: options, current: newWindow(time.Now())}
+}
+
+// Start aggregates a report every Options.Interval until Close
+func (a *Analytics) Start() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.stop != nil {
+		return
+	}
+	a.stop, a.done = make(chan struct{}), make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(a.options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.Rotate()
+			case <-stop:
+				return
+			}
+		}
+	}(a.stop, a.done)
+}
+
+// Close stops periodic aggregation and reports the searches since the
+// last report
+func (a *Analytics) Close() error {
+	a.mutex.Lock()
+	stop, done := a.stop, a.done
+	a.stop, a.done = nil, nil
+	a.mutex.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	a.Rotate()
+	return nil
+}
+
+// Record adds a search and returns the ID clicks on its results refer to
+func (a *Analytics) Record(s Search) string {
+	if s.Time.IsZero() {
+		s.Time = time.Now()
+	}
+	id := newQueryID()
+	a.mutex.Lock()
+	a.current.addSearch(id, s, a.options)
+	a.mutex.Unlock()
+	a.log(logLine{Type: "search", Time: s.Time, QueryID: id, Query: s.Query,
+		LatencyMs: float64(s.Latency) / float64(time.Millisecond), Results: s.Results, TimedOut: s.TimedOut})
+	return id
+}
+
+// RecordClick adds a click or skip on a result of a search recorded in the
+// current or the previous window, failing with ErrUnknownQuery otherwise.
+// If the search's hits were recorded, the document must be among them, at
+// the position given if there is one. The event and, for a click, the
+// results skipped above it go to Options.Judgments.
+func (a *Analytics) RecordClick(c Click) error {
+	if c.Time.IsZero() {
+		c.Time = time.Now()
+	}
+	if c.Event == "" {
+		c.Event = EventClick
+	}
+	if c.Event != EventClick && c.Event != EventSkip {
+		return fmt.Errorf("unknown event %q, want %s or %s", c.Event, EventClick, EventSkip)
+	}
+	if c.ID == "" {
+		return fmt.Errorf("a %s needs the ID of the document", c.Event)
+	}
+	if c.Position < 0 {
+		return errors.New("positions must not be negative")
+	}
+	a.mutex.Lock()
+	s, exists := a.current.searches[c.QueryID]
+	if !exists && a.previous != nil {
+		s, exists = a.previous.searches[c.QueryID]
+	}
+	if !exists {
+		a.mutex.Unlock()
+		return fmt.Errorf("%w: %q", ErrUnknownQuery, c.QueryID)
+	}
+	position, err := s.position(c.ID, c.Position)
+	if err != nil {
+		a.mutex.Unlock()
+		return err
+	}
+	c.Position = position
+	a.current.addClick(s, c.Event, a.options)
+	var judgments []Judgment
+	if a.options.Judgments != nil {
+		judgments = s.judgments(c.QueryID, c)
+	}
+	a.mutex.Unlock()
+	a.log(logLine{Type: string(c.Event), Time: c.Time, QueryID: c.QueryID, DocumentID: c.ID, Position: c.Position})
+	for _, j := range judgments {
+		if err := a.options.Judgments.Store(j); err != nil {
+			logger.Error("Failed to store a judgment", "event", j.Event, "error", err)
+		}
+	}
+	return nil
+}
+
+// log writes a line to the log, if there is one
+func (a *Analytics) log(line logLine) {
+	if a.options.Log == nil {
+		return
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	a.logging.Lock()
+	defer a.logging.Unlock()
+	if _, err := a.options.Log.Write(append(data, '\n')); err != nil {
+		logger.Error("Failed to write to the query log", "type", line.Type, "error", err)
+	}
+}
+
+// Normalize is how queries are grouped in reports: in lower case, with
+// runs of spaces collapsed
+func Normalize(query string) string {
+	return strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
+
+func newQueryID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Without randomness IDs only need to be unique
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
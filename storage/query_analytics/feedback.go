@@ -0,0 +1,108 @@
+package queryanalytics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event is what a user did with a result
+type Event string
+
+const (
+	EventClick Event = "click" // Opened it
+	EventSkip  Event = "skip"  // Passed it over
+)
+
+// Judgment is a click or skip joined to the search it happened on, a
+// labelled example for training a ranking model
+type Judgment struct {
+	Time       time.Time `json:"time"`
+	Event      Event     `json:"event"`
+	QueryID    string    `json:"query_id"`
+	Query      string    `json:"query"` // As searched, not normalized
+	SearchedAt time.Time `json:"searched_at"`
+	Results    int       `json:"results"` // Matches the search found
+	ID         string    `json:"id"`      // Of the document
+	Position   int       `json:"position"`
+	// Implicit marks a skip inferred from a click below the result rather
+	// than reported
+	Implicit bool `json:"implicit,omitempty"`
+}
+
+// JudgmentStore keeps judgments for training
+type JudgmentStore interface {
+	Store(j Judgment) error
+}
+
+// JudgmentLog stores judgments as JSON lines, which ReadJudgments reads
+// back
+type JudgmentLog struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewJudgmentLog returns a JudgmentLog writing to w, such as a file opened
+// for appending
+func NewJudgmentLog(w io.Writer) *JudgmentLog {
+	return &JudgmentLog{w: w}
+}
+
+// Store writes a judgment as a line
+func (l *JudgmentLog) Store(j Judgment) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.w.Write(append(data, '\n'))
+	return err
+}
+
+// ReadJudgments calls fn with each judgment of a JudgmentLog, stopping at
+// the first error
+func ReadJudgments(r io.Reader, fn func(Judgment) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var j Judgment
+		if err := json.Unmarshal(scanner.Bytes(), &j); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(j); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// judgments returns the judgments a feedback event on s yields: the event
+// itself and, for a click, a skip of every result above it neither clicked
+// nor skipped before. Callers hold the analytics' mutex.
+func (s *search) judgments(id string, c Click) []Judgment {
+	judgment := func(event Event, doc string, position int, implicit bool) Judgment {
+		return Judgment{Time: c.Time, Event: event, QueryID: id, Query: s.raw, SearchedAt: s.time,
+			Results: s.results, ID: doc, Position: position, Implicit: implicit}
+	}
+	js := []Judgment{judgment(c.Event, c.ID, c.Position, false)}
+	if c.Position > 0 {
+		s.judged[c.Position] = true
+	}
+	if c.Event != EventClick {
+		return js
+	}
+	for position := 1; position < c.Position && position <= len(s.hits); position++ {
+		if !s.judged[position] {
+			s.judged[position] = true
+			js = append(js, judgment(EventSkip, s.hits[position-1], position, true))
+		}
+	}
+	return js
+}
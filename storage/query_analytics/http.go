@@ -0,0 +1,47 @@
+package queryanalytics
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// reportsResponse is the answer to GET /analytics
+type reportsResponse struct {
+	Current Report   `json:"current"` // The window still open
+	Reports []Report `json:"reports"` // Newest first
+}
+
+// Handler serves the reports as JSON. They show what users search for, so
+// it belongs behind authentication.
+//
+//	GET /analytics            the open window and every report kept
+//	GET /analytics?reports=n  the open window and the last n reports
+func (a *Analytics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reports := a.Reports()
+		if value := r.URL.Query().Get("reports"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				http.Error(w, "reports must be a count", http.StatusBadRequest)
+				return
+			}
+			if n < len(reports) {
+				reports = reports[len(reports)-n:]
+			}
+		}
+		for i, j := 0, len(reports)-1; i < j; i, j = i+1, j-1 {
+			reports[i], reports[j] = reports[j], reports[i]
+		}
+		if reports == nil {
+			reports = []Report{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reportsResponse{Current: a.Current(), Reports: reports})
+	})
+}
@@ -0,0 +1,264 @@
+package queryanalytics
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Report aggregates the searches of one window
+type Report struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Searches    int       `json:"searches"`
+	ZeroResults int       `json:"zero_results"`
+	TimedOut    int       `json:"timed_out"`
+	Clicks      int       `json:"clicks"`
+	Skips       int       `json:"skips"`
+	// ClickThroughRate is the share of searches followed by a click
+	ClickThroughRate float64 `json:"click_through_rate"`
+	Latency          Latency `json:"latency"`
+	// TopQueries are the most searched queries, and ZeroResultQueries the
+	// most searched of those that found nothing, the likeliest to need
+	// synonyms, spelling fixes or content
+	TopQueries        []QueryStats `json:"top_queries"`
+	ZeroResultQueries []QueryStats `json:"zero_result_queries"`
+	// Untracked counts the searches for queries past Options.MaxQueries
+	// distinct ones, which the lists leave out
+	Untracked int `json:"untracked,omitempty"`
+}
+
+// Latency holds percentiles of search latency, in milliseconds
+type Latency struct {
+	P50 float64 `json:"p50_ms"`
+	P90 float64 `json:"p90_ms"`
+	P95 float64 `json:"p95_ms"`
+	P99 float64 `json:"p99_ms"`
+	Max float64 `json:"max_ms"`
+}
+
+// QueryStats counts the searches for one query, as Normalize groups them
+type QueryStats struct {
+	Query            string  `json:"query"`
+	Searches         int     `json:"searches"`
+	ZeroResults      int     `json:"zero_results"`
+	Clicks           int     `json:"clicks"`
+	ClickThroughRate float64 `json:"click_through_rate"`
+	MeanResults      float64 `json:"mean_results"`
+}
+
+// window gathers the searches and clicks since the last report
+type window struct {
+	start    time.Time
+	queries  map[string]*queryCounts // By normalized query
+	searches map[string]*search      // By query ID, for attributing clicks
+
+	total, zero, timedOut int
+	clicks, clicked       int // Clicks, and searches with at least one
+	skips, untracked      int
+
+	latencies []time.Duration // A uniform sample of those offered
+	offered   int
+}
+
+// queryCounts are the counts of one query in a window
+type queryCounts struct {
+	searches, zero, clicks, clicked, results int
+}
+
+// search is a recorded search clicks can refer to
+type search struct {
+	query   string // Normalized
+	raw     string // As searched
+	time    time.Time
+	results int
+	hits    []string     // IDs shown, in order, if known
+	judged  map[int]bool // Positions clicked or skipped, for inferring skips
+	clicked bool
+}
+
+// position checks a feedback event on document id against the hits
+// shown, if known, and returns its position, looked up when 0
+func (s *search) position(id string, position int) (int, error) {
+	if len(s.hits) == 0 {
+		return position, nil
+	}
+	if position == 0 {
+		for i, hit := range s.hits {
+			if hit == id {
+				return i + 1, nil
+			}
+		}
+		return 0, fmt.Errorf("document %q wasn't among the search's hits", id)
+	}
+	if position > len(s.hits) || s.hits[position-1] != id {
+		return 0, fmt.Errorf("document %q wasn't at position %d of the search's hits", id, position)
+	}
+	return position, nil
+}
+
+func newWindow(start time.Time) *window {
+	return &window{start: start, queries: make(map[string]*queryCounts), searches: make(map[string]*search)}
+}
+
+// counts returns the counts of a query, or nil if the window tracks as
+// many queries as it may
+func (w *window) counts(query string, options Options) *queryCounts {
+	c, exists := w.queries[query]
+	if !exists && len(w.queries) < options.MaxQueries {
+		c = &queryCounts{}
+		w.queries[query] = c
+	}
+	return c
+}
+
+func (w *window) addSearch(id string, s Search, options Options) {
+	query := Normalize(s.Query)
+	w.searches[id] = &search{query: query, raw: s.Query, time: s.Time, results: s.Results,
+		hits: append([]string(nil), s.Hits...), judged: make(map[int]bool)}
+	w.total++
+	if s.Results == 0 {
+		w.zero++
+	}
+	if s.TimedOut {
+		w.timedOut++
+	}
+	// Reservoir sampling keeps every latency equally likely to be kept
+	w.offered++
+	if len(w.latencies) < options.MaxSamples {
+		w.latencies = append(w.latencies, s.Latency)
+	} else if i := rand.Intn(w.offered); i < options.MaxSamples {
+		w.latencies[i] = s.Latency
+	}
+
+	c := w.counts(query, options)
+	if c == nil {
+		w.untracked++
+		return
+	}
+	c.searches++
+	c.results += s.Results
+	if s.Results == 0 {
+		c.zero++
+	}
+}
+
+func (w *window) addClick(s *search, event Event, options Options) {
+	if event == EventSkip {
+		w.skips++
+		return
+	}
+	w.clicks++
+	c := w.counts(s.query, options)
+	if c != nil {
+		c.clicks++
+	}
+	if s.clicked {
+		return
+	}
+	s.clicked = true
+	w.clicked++
+	if c != nil {
+		c.clicked++
+	}
+}
+
+// report aggregates the window, closed at end
+func (w *window) report(end time.Time, top int) Report {
+	r := Report{
+		Start:       w.start,
+		End:         end,
+		Searches:    w.total,
+		ZeroResults: w.zero,
+		TimedOut:    w.timedOut,
+		Clicks:      w.clicks,
+		Skips:       w.skips,
+		Untracked:   w.untracked,
+		Latency:     percentiles(w.latencies),
+	}
+	if w.total > 0 {
+		r.ClickThroughRate = math.Min(1, float64(w.clicked)/float64(w.total))
+	}
+	var all, zero []QueryStats
+	for query, c := range w.queries {
+		stats := QueryStats{Query: query, Searches: c.searches, ZeroResults: c.zero, Clicks: c.clicks}
+		if c.searches > 0 {
+			stats.ClickThroughRate = math.Min(1, float64(c.clicked)/float64(c.searches))
+			stats.MeanResults = float64(c.results) / float64(c.searches)
+		}
+		all = append(all, stats)
+		if c.zero > 0 {
+			zero = append(zero, stats)
+		}
+	}
+	r.TopQueries = topQueries(all, top, func(s QueryStats) int { return s.Searches })
+	r.ZeroResultQueries = topQueries(zero, top, func(s QueryStats) int { return s.ZeroResults })
+	return r
+}
+
+// topQueries returns the n queries counting most by count, ties broken
+// by query
+func topQueries(stats []QueryStats, n int, count func(QueryStats) int) []QueryStats {
+	sort.Slice(stats, func(i, j int) bool {
+		if a, b := count(stats[i]), count(stats[j]); a != b {
+			return a > b
+		}
+		return stats[i].Query < stats[j].Query
+	})
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	if stats == nil {
+		stats = []QueryStats{}
+	}
+	return stats
+}
+
+// percentiles returns the nearest-rank percentiles of a latency sample
+func percentiles(sample []time.Duration) Latency {
+	if len(sample) == 0 {
+		return Latency{}
+	}
+	sorted := append([]time.Duration(nil), sample...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) float64 {
+		rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		return float64(sorted[rank]) / float64(time.Millisecond)
+	}
+	return Latency{P50: at(0.5), P90: at(0.9), P95: at(0.95), P99: at(0.99), Max: at(1)}
+}
+
+// Rotate closes the current window into a report, which it returns, and
+// starts a new one. Start calls it every Options.Interval.
+func (a *Analytics) Rotate() Report {
+	now := time.Now()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	r := a.current.report(now, a.options.TopQueries)
+	a.previous, a.current = a.current, newWindow(now)
+	a.reports = append(a.reports, r)
+	if len(a.reports) > a.options.Reports {
+		a.reports = append([]Report(nil), a.reports[len(a.reports)-a.options.Reports:]...)
+	}
+	return r
+}
+
+// Current aggregates the searches since the last report, without closing
+// the window
+func (a *Analytics) Current() Report {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.current.report(time.Now(), a.options.TopQueries)
+}
+
+// Reports returns the reports kept, oldest first
+func (a *Analytics) Reports() []Report {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]Report(nil), a.reports...)
+}
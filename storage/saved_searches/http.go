@@ -0,0 +1,83 @@
+package savedsearches
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"pkg/httpjson"
+)
+
+// Handler manages saved searches over HTTP. It checks no credentials
+// itself, so it belongs behind authentication.
+//
+//	GET    /saved-searches        every saved search, oldest first
+//	POST   /saved-searches        save a search from {"name", "query",
+//	                              "webhook", "updates"}
+//	GET    /saved-searches/{id}   a saved search
+//	DELETE /saved-searches/{id}   stop alerting on a saved search
+func (s *Store) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/saved-searches", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpjson.Write(w, http.StatusOK, s.List())
+		case http.MethodPost:
+			var spec struct {
+				Name    string `json:"name"`
+				Query   string `json:"query"`
+				Webhook string `json:"webhook"`
+				Updates bool   `json:"updates"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&spec); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			search, err := s.Create(SavedSearch{Name: spec.Name, Query: spec.Query, Webhook: spec.Webhook, Updates: spec.Updates})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			httpjson.Write(w, http.StatusCreated, search)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/saved-searches/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/saved-searches/"))
+		if err != nil || id == "" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			search, err := s.Get(id)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, search)
+		case http.MethodDelete:
+			if err := s.Delete(id); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// writeError answers with 404 for saved searches that don't exist and 500
+// otherwise
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrNotFound) {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
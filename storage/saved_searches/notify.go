@@ -0,0 +1,84 @@
+package savedsearches
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Notification tells of documents newly matching a saved search
+type Notification struct {
+	SearchID string    `json:"search_id"`
+	Name     string    `json:"name,omitempty"`
+	Query    string    `json:"query"`
+	Matches  []Match   `json:"matches"`
+	Time     time.Time `json:"time"`
+}
+
+// Match is a document a notification tells of
+type Match struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Event string `json:"event"` // documentstore.EventCreate or EventUpdate
+	// URL is the document's metadata.url, if it has one
+	URL string `json:"url,omitempty"`
+}
+
+// Webhook posts notifications to saved searches' webhook URLs
+type Webhook struct {
+	Client *http.Client
+	// Retries is how many more times a failed post is tried, waiting
+	// Backoff, then twice as long, and so on
+	Retries int
+	Backoff time.Duration
+}
+
+// DefaultWebhook gives up on a hook after 10 seconds and tries three more
+// times, waiting a second more each time
+var DefaultWebhook = Webhook{Client: &http.Client{Timeout: 10 * time.Second}, Retries: 3, Backoff: time.Second}
+
+// Post posts n as JSON to url, retrying failures, until a 2xx answer or
+// ctx is done
+func (h Webhook) Post(ctx context.Context, url string, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	backoff := h.Backoff
+	for attempt := 0; ; attempt++ {
+		err = post(ctx, client, url, body)
+		if err == nil || attempt >= h.Retries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func post(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
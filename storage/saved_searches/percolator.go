@@ -0,0 +1,262 @@
+package savedsearches
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"monitoring/logging"
+	documentstore "storage/document_store"
+)
+
+// logger reports the changes and notifications percolators fail on
+var logger = logging.Component("storage/saved_searches")
+
+// Defaults for the Options left zero
+const (
+	DefaultBatchSize  = 100
+	DefaultBatchDelay = time.Second
+)
+
+// Options configures a Percolator
+type Options struct {
+	// BatchSize is how many changed documents are percolated at once
+	BatchSize int
+	// BatchDelay is the longest a changed document waits for its batch to
+	// fill, and so about the longest before its alerts go out
+	BatchDelay time.Duration
+	// Webhook posts the notifications of saved searches with a webhook;
+	// nil means DefaultWebhook
+	Webhook *Webhook
+}
+
+// parsedSearch is a saved search with its query parsed
+type parsedSearch struct {
+	SavedSearch
+	query *documentstore.Query
+}
+
+// Percolator alerts on documents newly matching saved searches: it
+// follows the database's change feed and matches each batch of added, and
+// for saved searches asking for them changed, documents against every
+// saved search, posting a Notification to each matching search's webhook
+// and to every subscriber.
+type Percolator struct {
+	db      *documentstore.DocumentDB
+	store   *Store
+	options Options
+
+	mutex       sync.Mutex
+	parsed      map[string]parsedSearch // By saved search ID
+	subscribers map[chan Notification]bool
+	deliveries  sync.WaitGroup // Webhook posts in flight
+}
+
+// NewPercolator returns a Percolator for the saved searches in store;
+// zero options take their defaults. Call Run to start alerting.
+func NewPercolator(db *documentstore.DocumentDB, store *Store, options Options) *Percolator {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.BatchDelay <= 0 {
+		options.BatchDelay = DefaultBatchDelay
+	}
+	if options.Webhook == nil {
+		options.Webhook = &DefaultWebhook
+	}
+	return &Percolator{
+		db:          db,
+		store:       store,
+		options:     options,
+		parsed:      make(map[string]parsedSearch),
+		subscribers: make(map[chan Notification]bool),
+	}
+}
+
+// Subscribe returns a channel receiving every notification, buffering up
+// to buffer of them; notifications for a subscriber whose buffer is full
+// are dropped rather than holding up the rest. Call the returned function
+// to unsubscribe, which closes the channel.
+func (p *Percolator) Subscribe(buffer int) (<-chan Notification, func()) {
+	ch := make(chan Notification, buffer)
+	p.mutex.Lock()
+	p.subscribers[ch] = true
+	p.mutex.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			p.mutex.Lock()
+			delete(p.subscribers, ch)
+			p.mutex.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Run alerts on the documents changed from now on until ctx is done, then
+// waits for the webhook posts in flight, which ctx cuts short. Documents
+// changed just before may go unalerted. If the percolator falls so far
+// behind that the change feed no longer holds the changes it hasn't seen,
+// it carries on from the latest, and those changes go unalerted too.
+func (p *Percolator) Run(ctx context.Context) error {
+	defer p.deliveries.Wait()
+	seq := p.db.ChangeSeq()
+	for ctx.Err() == nil {
+		events, err := p.db.Watch(ctx, seq)
+		if err != nil {
+			logger.Warn("Failed to follow changes, skipping to the latest", "after", seq, "error", err)
+			seq = p.db.ChangeSeq()
+			continue
+		}
+		seq = p.follow(ctx, events, seq)
+	}
+	return nil
+}
+
+// follow percolates the changes on events in batches until the channel
+// closes, and returns the sequence number of the last change seen
+func (p *Percolator) follow(ctx context.Context, events <-chan documentstore.Event, seq uint64) uint64 {
+	var batch []documentstore.Event
+	timer := time.NewTimer(p.options.BatchDelay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				if ctx.Err() == nil {
+					p.percolate(ctx, batch)
+				}
+				return seq
+			}
+			seq = event.Seq
+			if event.Type != documentstore.EventDelete && event.Document == nil {
+				continue
+			}
+			if len(batch) == 0 {
+				timer.Reset(p.options.BatchDelay)
+			}
+			batch = append(batch, event)
+			if len(batch) >= p.options.BatchSize {
+				timer.Stop()
+				p.percolate(ctx, batch)
+				batch = nil
+			}
+		case <-timer.C:
+			p.percolate(ctx, batch)
+			batch = nil
+		}
+	}
+}
+
+// percolate matches a batch of changes against every saved search and
+// sends out the notifications
+func (p *Percolator) percolate(ctx context.Context, batch []documentstore.Event) {
+	if len(batch) == 0 {
+		return
+	}
+	searches := p.searches()
+	if len(searches) == 0 {
+		return
+	}
+
+	// A document changed more than once in a batch is percolated as it is
+	// last, counts as new if any change added it, and is left out if the
+	// last deleted it
+	latest := make(map[string]documentstore.Event)
+	var order []string
+	for _, event := range batch {
+		if previous, seen := latest[event.ID]; !seen {
+			order = append(order, event.ID)
+		} else if previous.Type == documentstore.EventCreate && event.Type == documentstore.EventUpdate {
+			event.Type = documentstore.EventCreate
+		}
+		latest[event.ID] = event
+	}
+	var docs []*documentstore.Document
+	for _, id := range order {
+		if event := latest[id]; event.Type != documentstore.EventDelete {
+			docs = append(docs, event.Document)
+		}
+	}
+	if len(docs) == 0 {
+		return
+	}
+
+	queries := make([]*documentstore.Query, len(searches))
+	for i, search := range searches {
+		queries[i] = search.query
+	}
+	now := time.Now()
+	for i, ids := range p.db.Percolate(docs, queries) {
+		search := searches[i]
+		var matches []Match
+		for _, id := range ids {
+			event := latest[id]
+			if event.Type == documentstore.EventUpdate && !search.Updates {
+				continue
+			}
+			doc := event.Document
+			matches = append(matches, Match{ID: doc.ID, Title: doc.Title, Event: event.Type, URL: doc.Metadata["url"]})
+		}
+		if len(matches) > 0 {
+			p.notify(ctx, search.SavedSearch, Notification{
+				SearchID: search.ID,
+				Name:     search.Name,
+				Query:    search.Query,
+				Matches:  matches,
+				Time:     now,
+			})
+		}
+	}
+}
+
+// searches returns the saved searches with their queries parsed, parsing
+// only those new or changed since the last batch
+func (p *Percolator) searches() []parsedSearch {
+	saved := p.store.List()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	parsed := make(map[string]parsedSearch, len(saved))
+	searches := make([]parsedSearch, 0, len(saved))
+	for _, search := range saved {
+		ps, exists := p.parsed[search.ID]
+		if !exists || ps.Query != search.Query {
+			q, err := documentstore.ParseQuery(search.Query)
+			if err != nil {
+				logger.Warn("Failed to parse saved search", "search", search.ID, "error", err)
+				continue
+			}
+			ps = parsedSearch{query: q}
+		}
+		ps.SavedSearch = search
+		parsed[search.ID] = ps
+		searches = append(searches, ps)
+	}
+	p.parsed = parsed
+	return searches
+}
+
+// notify sends n to every subscriber and, in the background, to the saved
+// search's webhook
+func (p *Percolator) notify(ctx context.Context, search SavedSearch, n Notification) {
+	p.mutex.Lock()
+	for ch := range p.subscribers {
+		select {
+		case ch <- n:
+		default:
+			logger.Warn("Failed to notify a subscriber of saved search: its buffer is full", "search", search.ID)
+		}
+	}
+	p.mutex.Unlock()
+	if search.Webhook == "" {
+		return
+	}
+	p.deliveries.Add(1)
+	go func() {
+		defer p.deliveries.Done()
+		if err := p.options.Webhook.Post(ctx, search.Webhook, n); err != nil {
+			logger.Error("Failed to post saved search to its webhook", "search", search.ID, "error", err)
+		}
+	}()
+}
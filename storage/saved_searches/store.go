@@ -0,0 +1,193 @@
+package savedsearches
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	documentstore "storage/document_store"
+)
+
+// ErrNotFound is returned for saved searches that don't exist
+var ErrNotFound = errors.New("saved search not found")
+
+// SavedSearch is a standing query whose new matches are alerted on
+type SavedSearch struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Query string `json:"query"` // In the query language
+	// Webhook, if set, is the URL notifications are posted to as JSON;
+	// subscribers to the Percolator receive them either way
+	Webhook string `json:"webhook,omitempty"`
+	// Updates also alerts on changed documents that match, not only new
+	// ones
+	Updates   bool      `json:"updates,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// check rejects saved searches without a query that parses or with a
+// webhook that isn't an HTTP URL
+func (s *SavedSearch) check() error {
+	if s.Query == "" {
+		return errors.New("a saved search needs a query")
+	}
+	if _, err := documentstore.ParseQuery(s.Query); err != nil {
+		return fmt.Errorf("invalid query: %w", err)
+	}
+	if s.Webhook != "" {
+		u, err := url.Parse(s.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %q isn't an http or https URL", s.Webhook)
+		}
+	}
+	return nil
+}
+
+// Store keeps saved searches in a JSON file
+type Store struct {
+	path string
+
+	mutex    sync.Mutex
+	searches map[string]*SavedSearch
+}
+
+// OpenStore loads the saved searches in the file at path, which need not
+// exist yet. An empty path keeps them in memory only.
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path, searches: make(map[string]*SavedSearch)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var searches []*SavedSearch
+	if err := json.Unmarshal(data, &searches); err != nil {
+		return nil, fmt.Errorf("parse saved searches %s: %w", path, err)
+	}
+	for _, search := range searches {
+		s.searches[search.ID] = search
+	}
+	return s, nil
+}
+
+// saveLocked writes the saved searches to a temporary file and renames it
+// over the file, so a crash never leaves a partial one
+func (s *Store) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Create saves a search with the name, query, webhook and updates of spec
+// and returns it as saved
+func (s *Store) Create(spec SavedSearch) (SavedSearch, error) {
+	if err := spec.check(); err != nil {
+		return SavedSearch{}, err
+	}
+	id, err := newID()
+	if err != nil {
+		return SavedSearch{}, err
+	}
+	search := &SavedSearch{
+		ID:        id,
+		Name:      spec.Name,
+		Query:     spec.Query,
+		Webhook:   spec.Webhook,
+		Updates:   spec.Updates,
+		CreatedAt: time.Now().UTC(),
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.searches[id] = search
+	if err := s.saveLocked(); err != nil {
+		delete(s.searches, id)
+		return SavedSearch{}, err
+	}
+	return *search, nil
+}
+
+// Get returns a saved search
+func (s *Store) Get(id string) (SavedSearch, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	search, exists := s.searches[id]
+	if !exists {
+		return SavedSearch{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return *search, nil
+}
+
+// Delete removes a saved search; it is alerted on no more
+func (s *Store) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	search, exists := s.searches[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	delete(s.searches, id)
+	if err := s.saveLocked(); err != nil {
+		s.searches[id] = search
+		return err
+	}
+	return nil
+}
+
+// List returns every saved search, oldest first
+func (s *Store) List() []SavedSearch {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listLocked()
+}
+
+func (s *Store) listLocked() []SavedSearch {
+	searches := make([]SavedSearch, 0, len(s.searches))
+	for _, search := range s.searches {
+		searches = append(searches, *search)
+	}
+	sort.Slice(searches, func(i, j int) bool {
+		if !searches[i].CreatedAt.Equal(searches[j].CreatedAt) {
+			return searches[i].CreatedAt.Before(searches[j].CreatedAt)
+		}
+		return searches[i].ID < searches[j].ID
+	})
+	return searches
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,317 @@
+package searchserver
+
+//go:generate protoc --go_out=. --go_opt=module=storage/search_server --go-grpc_out=. --go-grpc_opt=module=storage/search_server search.proto
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	documentstore "storage/document_store"
+	"storage/search_server/searchpb"
+)
+
+// GRPCServer returns a gRPC server with the Search service of search.proto
+// registered, ready to Serve. Interceptors, TLS and other options are
+// passed through to grpc.NewServer.
+func (s *Server) GRPCServer(options ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(options...)
+	searchpb.RegisterSearchServer(server, &grpcServer{s: s})
+	return server
+}
+
+// grpcServer serves the Search service of search.proto with a Server
+type grpcServer struct {
+	searchpb.UnimplementedSearchServer
+	s *Server
+}
+
+func (g *grpcServer) Search(ctx context.Context, req *searchpb.SearchRequest) (*searchpb.SearchResponse, error) {
+	var resp SearchResponse
+	err := g.s.observeCall(ctx, searchpb.Search_Search_FullMethodName, func(ctx context.Context) (err error) {
+		resp, err = g.s.search(ctx, searchRequestFromProto(req))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return searchResponseToProto(&resp), nil
+}
+
+func (g *grpcServer) Suggest(ctx context.Context, req *searchpb.SuggestRequest) (*searchpb.SuggestResponse, error) {
+	var resp SuggestResponse
+	err := g.s.observeCall(ctx, searchpb.Search_Suggest_FullMethodName, func(context.Context) (err error) {
+		resp, err = g.s.suggest(req.GetQuery(), int(req.GetLimit()))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &searchpb.SuggestResponse{Query: resp.Query, Completions: resp.Completions, Correction: resp.Correction}, nil
+}
+
+func (g *grpcServer) Related(ctx context.Context, req *searchpb.RelatedRequest) (*searchpb.RelatedResponse, error) {
+	var hits []Hit
+	err := g.s.observeCall(ctx, searchpb.Search_Related_FullMethodName, func(context.Context) (err error) {
+		hits, err = g.s.related(req.GetId(), int(req.GetLimit()))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &searchpb.RelatedResponse{Id: req.GetId(), Hits: hitsToProto(hits)}, nil
+}
+
+// StreamSearch streams the hits of a search until they run out, reach the
+// request's limit or the client cancels
+func (g *grpcServer) StreamSearch(req *searchpb.SearchRequest, stream searchpb.Search_StreamSearchServer) error {
+	started := time.Now()
+	ctx, seen := observing(stream.Context())
+	err := streamHits(ctx, g.s, searchRequestFromProto(req), stream)
+	g.s.observe(searchpb.Search_StreamSearch_FullMethodName, status.Code(err).String(), started, seen)
+	return err
+}
+
+// observeCall runs a unary call, turning its error into a status and
+// recording it in the server's metrics
+func (s *Server) observeCall(ctx context.Context, fullMethod string, call func(ctx context.Context) error) error {
+	started := time.Now()
+	ctx, seen := observing(ctx)
+	err := call(ctx)
+	if err != nil {
+		err = grpcError(err)
+	}
+	s.observe(fullMethod, status.Code(err).String(), started, seen)
+	return err
+}
+
+// streamHits sends the hits of a stream's search, returning the status
+// the stream ends with
+func streamHits(ctx context.Context, s *Server, req SearchRequest, stream searchpb.Search_StreamSearchServer) error {
+	err := s.streamSearch(ctx, req, func(hit Hit) error {
+		return stream.Send(hitToProto(&hit))
+	})
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() != nil:
+		return status.FromContextError(ctx.Err()).Err()
+	case errors.Is(err, errBadRequest), errors.Is(err, errTimedOut):
+		return grpcError(err)
+	default:
+		// A failed send already carries its status
+		return err
+	}
+}
+
+// grpcError turns an error into a status with the code that fits it
+func grpcError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, documentstore.ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, errBadRequest):
+		code = codes.InvalidArgument
+	case errors.Is(err, errTimedOut):
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
+
+// Client calls the Search service of a server returned by GRPCServer. The
+// connection is the caller's to dial and close.
+type Client struct {
+	client searchpb.SearchClient
+}
+
+// NewClient returns a client calling the Search service over conn
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{client: searchpb.NewSearchClient(conn)}
+}
+
+// Search returns a page of hits; errors are gRPC statuses, with
+// InvalidArgument for a bad request
+func (c *Client) Search(ctx context.Context, req SearchRequest, options ...grpc.CallOption) (*SearchResponse, error) {
+	resp, err := c.client.Search(ctx, searchRequestToProto(&req), options...)
+	if err != nil {
+		return nil, err
+	}
+	return searchResponseFromProto(resp), nil
+}
+
+// Suggest completes and corrects a query being typed; a limit of 0 asks for
+// the server's maximum
+func (c *Client) Suggest(ctx context.Context, query string, limit int, options ...grpc.CallOption) (*SuggestResponse, error) {
+	resp, err := c.client.Suggest(ctx, &searchpb.SuggestRequest{Query: query, Limit: int32(limit)}, options...)
+	if err != nil {
+		return nil, err
+	}
+	completions := resp.GetCompletions()
+	if completions == nil {
+		completions = []string{}
+	}
+	return &SuggestResponse{Query: resp.GetQuery(), Completions: completions, Correction: resp.GetCorrection()}, nil
+}
+
+// Related returns hits for the documents most like document id; errors
+// with NotFound if it doesn't exist
+func (c *Client) Related(ctx context.Context, id string, limit int, options ...grpc.CallOption) (*RelatedResponse, error) {
+	resp, err := c.client.Related(ctx, &searchpb.RelatedRequest{Id: id, Limit: int32(limit)}, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &RelatedResponse{ID: resp.GetId(), Hits: hitsFromProto(resp.GetHits())}, nil
+}
+
+// StreamSearch starts streaming the hits of a search, best first. Facets
+// aren't computed and req.Limit caps the hits rather than sizing a page; 0
+// streams every match. Cancel ctx to stop the stream early.
+func (c *Client) StreamSearch(ctx context.Context, req SearchRequest, options ...grpc.CallOption) (*HitStream, error) {
+	stream, err := c.client.StreamSearch(ctx, searchRequestToProto(&req), options...)
+	if err != nil {
+		return nil, err
+	}
+	return &HitStream{stream: stream}, nil
+}
+
+// HitStream receives the hits of Client.StreamSearch
+type HitStream struct {
+	stream searchpb.Search_StreamSearchClient
+}
+
+// Recv returns the next hit, io.EOF once the stream has ended normally or
+// the status it failed with
+func (h *HitStream) Recv() (Hit, error) {
+	hit, err := h.stream.Recv()
+	if err != nil {
+		return Hit{}, err
+	}
+	return hitFromProto(hit), nil
+}
+
+func searchRequestToProto(req *SearchRequest) *searchpb.SearchRequest {
+	return &searchpb.SearchRequest{
+		Query:     req.Query,
+		Limit:     int32(req.Limit),
+		Cursor:    req.Cursor,
+		Sort:      req.Sort,
+		Reverse:   req.Reverse,
+		Facets:    req.Facets,
+		Origin:    req.Origin,
+		GeoField:  req.GeoField,
+		TimeoutMs: int32(req.Timeout.Milliseconds()),
+	}
+}
+
+func searchRequestFromProto(req *searchpb.SearchRequest) SearchRequest {
+	return SearchRequest{
+		Query:    req.GetQuery(),
+		Limit:    int(req.GetLimit()),
+		Cursor:   req.GetCursor(),
+		Sort:     req.GetSort(),
+		Reverse:  req.GetReverse(),
+		Facets:   req.GetFacets(),
+		Origin:   req.GetOrigin(),
+		GeoField: req.GetGeoField(),
+		Timeout:  time.Duration(req.GetTimeoutMs()) * time.Millisecond,
+	}
+}
+
+func searchResponseToProto(resp *SearchResponse) *searchpb.SearchResponse {
+	m := &searchpb.SearchResponse{
+		Query:      resp.Query,
+		Total:      int32(resp.Total),
+		Hits:       hitsToProto(resp.Hits),
+		NextCursor: resp.NextCursor,
+		Suggestion: resp.Suggestion,
+		TimedOut:   resp.TimedOut,
+		QueryId:    resp.QueryID,
+		Degraded:   resp.Degraded,
+	}
+	// Facets are sent by name, so responses encode the same every time
+	names := make([]string, 0, len(resp.Facets))
+	for name := range resp.Facets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		facet := resp.Facets[name]
+		encoded := &searchpb.Facet{Name: name, Other: int32(facet.Other), Missing: int32(facet.Missing)}
+		for _, bucket := range facet.Buckets {
+			encoded.Buckets = append(encoded.Buckets, &searchpb.FacetBucket{Key: bucket.Key, Count: int32(bucket.Count)})
+		}
+		m.Facets = append(m.Facets, encoded)
+	}
+	return m
+}
+
+func searchResponseFromProto(m *searchpb.SearchResponse) *SearchResponse {
+	resp := &SearchResponse{
+		Query:      m.GetQuery(),
+		Total:      int(m.GetTotal()),
+		Hits:       hitsFromProto(m.GetHits()),
+		NextCursor: m.GetNextCursor(),
+		Suggestion: m.GetSuggestion(),
+		TimedOut:   m.GetTimedOut(),
+		QueryID:    m.GetQueryId(),
+		Degraded:   m.GetDegraded(),
+	}
+	for _, encoded := range m.GetFacets() {
+		facet := documentstore.Facet{
+			Buckets: []documentstore.FacetBucket{},
+			Other:   int(encoded.GetOther()),
+			Missing: int(encoded.GetMissing()),
+		}
+		for _, bucket := range encoded.GetBuckets() {
+			facet.Buckets = append(facet.Buckets, documentstore.FacetBucket{Key: bucket.GetKey(), Count: int(bucket.GetCount())})
+		}
+		if resp.Facets == nil {
+			resp.Facets = make(map[string]documentstore.Facet)
+		}
+		resp.Facets[encoded.GetName()] = facet
+	}
+	return resp
+}
+
+func hitToProto(hit *Hit) *searchpb.Hit {
+	return &searchpb.Hit{
+		Id:       hit.ID,
+		Score:    hit.Score,
+		Title:    hit.Title,
+		Url:      hit.URL,
+		Snippet:  hit.Snippet,
+		Metadata: hit.Metadata,
+	}
+}
+
+func hitFromProto(hit *searchpb.Hit) Hit {
+	return Hit{
+		ID:       hit.GetId(),
+		Score:    hit.GetScore(),
+		Title:    hit.GetTitle(),
+		URL:      hit.GetUrl(),
+		Snippet:  hit.GetSnippet(),
+		Metadata: hit.GetMetadata(),
+	}
+}
+
+func hitsToProto(hits []Hit) []*searchpb.Hit {
+	encoded := make([]*searchpb.Hit, len(hits))
+	for i := range hits {
+		encoded[i] = hitToProto(&hits[i])
+	}
+	return encoded
+}
+
+func hitsFromProto(encoded []*searchpb.Hit) []Hit {
+	hits := make([]Hit, len(encoded))
+	for i, hit := range encoded {
+		hits[i] = hitFromProto(hit)
+	}
+	return hits
+}
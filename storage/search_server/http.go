@@ -0,0 +1,250 @@
+package searchserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg/httpjson"
+	documentstore "storage/document_store"
+	queryanalytics "storage/query_analytics"
+)
+
+// Handler serves searches as JSON over HTTP
+//
+//	GET /search?q={query}      a page of hits for a query in the query language
+//	GET /suggest?q={prefix}    completions of a query being typed, and a
+//	                           spelling correction
+//	GET /related/{id}          hits for the documents most like one
+//	GET /document/{id}         a document, such as the one a hit points to
+//	GET /explain?q={query}&id={id}
+//	                           how a document scores for a query, to debug
+//	                           why it ranks where it does
+//	POST /feedback             a click on a hit, or with "event": "skip" a
+//	                           hit passed over, as {"query_id", "id",
+//	                           "position"} with the search's query_id
+//	GET|POST /_search          a search in the Elasticsearch query DSL, see
+//	GET|POST /{index}/_search  opensearch.go; the index only names the
+//	                           store in hits
+//
+// Searches take limit (1 to Options.MaxLimit), cursor, sort
+// (relevance, created_at, updated_at or distance) and reverse parameters,
+// and for sort=distance origin and geo_field, as SearchOptions, and facet
+// parameters in the short form ParseFacet reads, such as
+// facet=terms:metadata.language. A page's next_cursor continues it. A
+// timeout parameter such as 500ms gives up sooner than
+// Options.SearchTimeout; a search out of time answers with the hits found
+// so far and timed_out set. A search shedding work under resource
+// pressure lists the resources in degraded; see SetDegradation.
+// Suggestions and related documents take limit, documents a fields
+// parameter such as fields=title,metadata.url. Every response is JSON,
+// failures included, as {"error": "..."} or, from _search, as
+// Elasticsearch reports them. IDs containing slashes must be
+// escaped as %2F.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		req, err := searchRequest(r.URL.Query())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp, err := s.search(r.Context(), req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, resp)
+	})
+	mux.HandleFunc("/suggest", func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		params := r.URL.Query()
+		limit, err := intParam(params, "limit")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp, err := s.suggest(params.Get("q"), limit)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, resp)
+	})
+	mux.HandleFunc("/feedback", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httpjson.Write(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+			return
+		}
+		var req struct {
+			QueryID  string `json:"query_id"`
+			ID       string `json:"id"`
+			Position int    `json:"position"`
+			Event    string `json:"event"`
+		}
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		click := queryanalytics.Click{QueryID: req.QueryID, ID: req.ID, Position: req.Position, Event: queryanalytics.Event(req.Event)}
+		if err := s.feedback(click); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/document/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		id, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/document/"))
+		if err != nil || id == "" {
+			httpjson.Write(w, http.StatusNotFound, errorResponse{Error: "not found"})
+			return
+		}
+		doc, err := s.getDocument(id, fieldsParam(r.URL.Query()))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, doc)
+	})
+	mux.HandleFunc("/related/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		id, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/related/"))
+		if err != nil || id == "" {
+			httpjson.Write(w, http.StatusNotFound, errorResponse{Error: "not found"})
+			return
+		}
+		limit, err := intParam(r.URL.Query(), "limit")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		hits, err := s.related(id, limit)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, RelatedResponse{ID: id, Hits: hits})
+	})
+	mux.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		params := r.URL.Query()
+		if params.Get("q") == "" || params.Get("id") == "" {
+			writeError(w, fmt.Errorf("%w: missing query or id", errBadRequest))
+			return
+		}
+		explanation, err := s.db.Explain(params.Get("q"), params.Get("id"))
+		if err != nil {
+			if !errors.Is(err, documentstore.ErrNotFound) {
+				err = fmt.Errorf("%w: %v", errBadRequest, err)
+			}
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, explanation)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		switch {
+		case path == "/":
+			s.serveOpenSearchInfo(w, r)
+		case strings.HasSuffix(path, "/_search") && strings.Count(path, "/") <= 2:
+			s.serveOpenSearch(w, r, strings.Trim(strings.TrimSuffix(path, "_search"), "/"))
+		default:
+			httpjson.Write(w, http.StatusNotFound, errorResponse{Error: "not found"})
+		}
+	})
+	return s.instrument(mux)
+}
+
+// searchRequest reads a search from its parameters
+func searchRequest(params url.Values) (SearchRequest, error) {
+	req := SearchRequest{
+		Query:    params.Get("q"),
+		Cursor:   params.Get("cursor"),
+		Sort:     params.Get("sort"),
+		Facets:   params["facet"],
+		Origin:   params.Get("origin"),
+		GeoField: params.Get("geo_field"),
+	}
+	var err error
+	if req.Limit, err = intParam(params, "limit"); err != nil {
+		return req, err
+	}
+	if value := params.Get("reverse"); value != "" {
+		if req.Reverse, err = strconv.ParseBool(value); err != nil {
+			return req, fmt.Errorf("%w: reverse must be true or false", errBadRequest)
+		}
+	}
+	if value := params.Get("timeout"); value != "" {
+		if req.Timeout, err = time.ParseDuration(value); err != nil {
+			return req, fmt.Errorf("%w: timeout must be a duration such as 500ms", errBadRequest)
+		}
+	}
+	return req, nil
+}
+
+// intParam reads an integer parameter, 0 if it is missing
+func intParam(params url.Values, name string) (int, error) {
+	value := params.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be an integer", errBadRequest, name)
+	}
+	return n, nil
+}
+
+func fieldsParam(params url.Values) []string {
+	var fields []string
+	for _, field := range strings.Split(params.Get("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// allowGet turns away requests that would change something
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		httpjson.Write(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return false
+	}
+	return true
+}
+
+// writeError answers with the status that fits an error
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, documentstore.ErrNotFound), errors.Is(err, queryanalytics.ErrUnknownQuery),
+		errors.Is(err, errFeedbackOff):
+		status = http.StatusNotFound
+	case errors.Is(err, errBadRequest):
+		status = http.StatusBadRequest
+	}
+	httpjson.Write(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,203 @@
+package searchserver
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"monitoring/metrics"
+	"monitoring/tracing"
+	documentstore "storage/document_store"
+)
+
+// Metrics receives the server's instrumentation events. Inject an
+// implementation with SetMetrics; servers default to discarding them.
+type Metrics interface {
+	// ObserveRequest records a request to an endpoint answered with code,
+	// an HTTP status or gRPC code, after latency. The exemplar labels, such
+	// as the query ID of the search it made and the ID of its trace, may be
+	// nil.
+	ObserveRequest(endpoint, code string, latency time.Duration, exemplar map[string]string)
+	// ObserveResults records how many documents a search matched
+	ObserveResults(endpoint string, total int)
+	// ObserveTimeout records a search that ran out of time
+	ObserveTimeout(endpoint string)
+}
+
+// noopMetrics discards all events
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveRequest(string, string, time.Duration, map[string]string) {}
+func (noopMetrics) ObserveResults(string, int)                                      {}
+func (noopMetrics) ObserveTimeout(string)                                           {}
+
+// PrometheusMetrics exports the server's events as Prometheus metrics, along
+// with the counters of the database's query cache. Latency buckets run from
+// a millisecond to ten seconds, fine enough to define SLOs on p99 latency.
+type PrometheusMetrics struct {
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	results  *prometheus.HistogramVec
+	timeouts *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics creates the search metrics for a server over db and
+// registers them with reg. A nil reg uses metrics.Default.
+func NewPrometheusMetrics(reg prometheus.Registerer, db *documentstore.DocumentDB) *PrometheusMetrics {
+	if reg == nil {
+		reg = metrics.Default
+	}
+	m := &PrometheusMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "search_requests_total",
+			Help: "Requests to each search endpoint, by status or gRPC code",
+		}, []string{"endpoint", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "search_request_duration_seconds",
+			Help:    "Time taken to answer requests to each search endpoint",
+			Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}, []string{"endpoint"}),
+		results: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "search_results",
+			Help:    "Documents matched by each search",
+			Buckets: []float64{0, 1, 10, 100, 1000, 10000, 100000},
+		}, []string{"endpoint"}),
+		timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "search_timeouts_total",
+			Help: "Searches that ran out of time and answered with the matches found so far",
+		}, []string{"endpoint"}),
+	}
+	reg.MustRegister(m.requests, m.latency, m.results, m.timeouts, queryCacheCollector{db})
+	return m
+}
+
+func (m *PrometheusMetrics) ObserveRequest(endpoint, code string, latency time.Duration, exemplar map[string]string) {
+	m.requests.WithLabelValues(endpoint, code).Inc()
+	observer := m.latency.WithLabelValues(endpoint)
+	if len(exemplar) > 0 {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(latency.Seconds(), exemplar)
+		return
+	}
+	observer.Observe(latency.Seconds())
+}
+
+func (m *PrometheusMetrics) ObserveResults(endpoint string, total int) {
+	m.results.WithLabelValues(endpoint).Observe(float64(total))
+}
+
+func (m *PrometheusMetrics) ObserveTimeout(endpoint string) {
+	m.timeouts.WithLabelValues(endpoint).Inc()
+}
+
+// queryCacheCollector exports the counters of a database's query cache,
+// so hit rates are worked out over any window from the hits and misses
+type queryCacheCollector struct {
+	db *documentstore.DocumentDB
+}
+
+var (
+	queryCacheHits      = prometheus.NewDesc("search_query_cache_hits_total", "Searches answered from the query cache", nil, nil)
+	queryCacheMisses    = prometheus.NewDesc("search_query_cache_misses_total", "Searches the query cache couldn't answer", nil, nil)
+	queryCacheEvictions = prometheus.NewDesc("search_query_cache_evictions_total", "Results evicted from the query cache to make room", nil, nil)
+	queryCacheEntries   = prometheus.NewDesc("search_query_cache_entries", "Results held in the query cache", nil, nil)
+)
+
+func (c queryCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queryCacheHits
+	ch <- queryCacheMisses
+	ch <- queryCacheEvictions
+	ch <- queryCacheEntries
+}
+
+func (c queryCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.db.QueryCacheStats()
+	ch <- prometheus.MustNewConstMetric(queryCacheHits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(queryCacheMisses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(queryCacheEvictions, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(queryCacheEntries, prometheus.GaugeValue, float64(stats.Entries))
+}
+
+// SetMetrics injects the metrics sink of the server; call it before serving
+func (s *Server) SetMetrics(m Metrics) {
+	s.metrics = m
+}
+
+// observation is what a request's search found, noted by record and
+// reported with the request once it is answered
+type observation struct {
+	searched bool
+	results  int
+	timedOut bool
+	queryID  string
+	traceID  string // Of the request's trace, if recorded
+}
+
+type observationKey struct{}
+
+// observing returns ctx carrying a new observation for record to fill in
+func observing(ctx context.Context) (context.Context, *observation) {
+	seen := &observation{traceID: tracing.TraceID(ctx)}
+	return context.WithValue(ctx, observationKey{}, seen), seen
+}
+
+// observe reports a request to endpoint, started at started and answered
+// with code, and the search it made if any
+func (s *Server) observe(endpoint, code string, started time.Time, seen *observation) {
+	exemplar := make(map[string]string, 2)
+	if seen.queryID != "" {
+		exemplar["query_id"] = seen.queryID
+	}
+	if seen.traceID != "" {
+		exemplar["trace_id"] = seen.traceID
+	}
+	s.metrics.ObserveRequest(endpoint, code, time.Since(started), exemplar)
+	if !seen.searched {
+		return
+	}
+	s.metrics.ObserveResults(endpoint, seen.results)
+	if seen.timedOut {
+		s.metrics.ObserveTimeout(endpoint)
+	}
+}
+
+// instrument reports every request next answers to the metrics
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		ctx, seen := observing(r.Context())
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		s.observe(httpEndpoint(r.URL.Path), strconv.Itoa(recorder.status), started, seen)
+	})
+}
+
+// httpEndpoint names the endpoint serving path, with IDs and index names
+// left out so the metrics have few labels
+func httpEndpoint(path string) string {
+	switch {
+	case path == "/", path == "/search", path == "/suggest", path == "/explain", path == "/feedback":
+		return path
+	case strings.HasPrefix(path, "/document/"):
+		return "/document"
+	case strings.HasPrefix(path, "/related/"):
+		return "/related"
+	case strings.HasSuffix(path, "/_search"):
+		return "/_search"
+	}
+	return "other"
+}
+
+// statusRecorder remembers the status a handler answers with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,1017 @@
+package searchserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"pkg/httpjson"
+	documentstore "storage/document_store"
+)
+
+// The adapter speaks a subset of the Elasticsearch search API, so
+// dashboards and client libraries written for Elasticsearch or OpenSearch
+// can search the store. Queries in the query DSL are translated into the
+// query language and run like any other search:
+//
+//	match_all, match_none
+//	match            words in text fields, any of them unless "operator"
+//	                 is "and", optionally "fuzziness" AUTO, 1 or 2
+//	match_phrase     the words next to each other, in order
+//	term, terms      exact metadata values, or words in text fields
+//	range            metadata values by gt, gte, lt and lte; dates take
+//	                 now-7d style offsets but not rounding such as /d
+//	exists           documents having a metadata key
+//	bool             must, filter, should, must_not and an integer
+//	                 minimum_should_match
+//
+// Fields title and content are text, _all and * both of them; any other
+// field is a metadata key, with or without its "metadata." prefix.
+// Aggregations may be terms, date_histogram or range, without
+// sub-aggregations. Results sort by _score, created_at or updated_at.
+
+// compatibleVersion is the Elasticsearch version the adapter reports to
+// clients that check it, the last one both Elasticsearch and OpenSearch
+// clients accept
+const compatibleVersion = "7.10.2"
+
+// defaultIndex names the store in hits when a search names no index
+const defaultIndex = "documents"
+
+// maxResultWindow bounds from+size, as Elasticsearch's
+// index.max_result_window does by default. Clients page through it with
+// from rather than cursors, so it is not bounded by Options.MaxLimit.
+const maxResultWindow = 10000
+
+// maxSearchBodyBytes bounds the JSON body of a search
+const maxSearchBodyBytes = 1 << 20
+
+// openSearchRequest is the body of a _search request
+type openSearchRequest struct {
+	Query        json.RawMessage            `json:"query"`
+	From         *int                       `json:"from"`
+	Size         *int                       `json:"size"`
+	Sort         json.RawMessage            `json:"sort"`
+	Source       json.RawMessage            `json:"_source"`
+	Aggs         map[string]json.RawMessage `json:"aggs"`
+	Aggregations map[string]json.RawMessage `json:"aggregations"`
+	// Totals are always exact, so this is accepted and ignored
+	TrackTotalHits json.RawMessage `json:"track_total_hits"`
+	// Timeout is a time value such as "500ms", capped by
+	// Options.SearchTimeout
+	Timeout string `json:"timeout"`
+}
+
+// openSearchResponse is the answer to a _search request
+type openSearchResponse struct {
+	Took         int64                  `json:"took"`
+	TimedOut     bool                   `json:"timed_out"`
+	Shards       openSearchShards       `json:"_shards"`
+	Hits         openSearchHits         `json:"hits"`
+	Aggregations map[string]interface{} `json:"aggregations,omitempty"`
+}
+
+type openSearchShards struct {
+	Total      int `json:"total"`
+	Successful int `json:"successful"`
+	Skipped    int `json:"skipped"`
+	Failed     int `json:"failed"`
+}
+
+type openSearchHits struct {
+	Total    openSearchTotal `json:"total"`
+	MaxScore *float64        `json:"max_score"`
+	Hits     []openSearchHit `json:"hits"`
+}
+
+type openSearchTotal struct {
+	Value    int    `json:"value"`
+	Relation string `json:"relation"`
+}
+
+type openSearchHit struct {
+	Index  string                 `json:"_index"`
+	ID     string                 `json:"_id"`
+	Score  *float64               `json:"_score"`
+	Source map[string]interface{} `json:"_source,omitempty"`
+	Sort   []interface{}          `json:"sort,omitempty"`
+}
+
+// openSearchError is Elasticsearch's error body
+type openSearchError struct {
+	Error struct {
+		RootCause []openSearchCause `json:"root_cause"`
+		openSearchCause
+	} `json:"error"`
+	Status int `json:"status"`
+}
+
+type openSearchCause struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// errParsing marks query DSL the adapter can't read or translate
+var errParsing = errors.New("bad query DSL")
+
+// serveOpenSearchInfo answers the root request clients make to learn the
+// version they are talking to
+func (s *Server) serveOpenSearchInfo(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	httpjson.Write(w, http.StatusOK, map[string]interface{}{
+		"name":         "searchd",
+		"cluster_name": "searchengine",
+		"version": map[string]string{
+			"number":         compatibleVersion,
+			"build_flavor":   "default",
+			"lucene_version": "8.7.0",
+		},
+		"tagline": "You Know, for Search",
+	})
+}
+
+// serveOpenSearch answers a _search request on index, which only names the
+// store in hits
+func (s *Server) serveOpenSearch(w http.ResponseWriter, r *http.Request, index string) {
+	started := time.Now()
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeOpenSearchError(w, http.StatusMethodNotAllowed, "method_not_allowed", "_search takes GET or POST")
+		return
+	}
+	var req openSearchRequest
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSearchBodyBytes))
+	if err != nil {
+		writeOpenSearchError(w, http.StatusRequestEntityTooLarge, "content_too_long_exception", err.Error())
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			writeOpenSearchError(w, http.StatusBadRequest, "parsing_exception", err.Error())
+			return
+		}
+	}
+	resp, err := s.openSearch(r.Context(), req, r.URL.Query(), index)
+	if err != nil {
+		kind, sentinel := "illegal_argument_exception", errBadRequest
+		if errors.Is(err, errParsing) {
+			kind, sentinel = "parsing_exception", errParsing
+		}
+		writeOpenSearchError(w, http.StatusBadRequest, kind, strings.TrimPrefix(err.Error(), sentinel.Error()+": "))
+		return
+	}
+	resp.Took = time.Since(started).Milliseconds()
+	httpjson.Write(w, http.StatusOK, resp)
+}
+
+// openSearch runs a _search request, with its URL parameters q, from,
+// size, sort, _source and timeout taking precedence over the body
+func (s *Server) openSearch(ctx context.Context, req openSearchRequest, params map[string][]string, index string) (*openSearchResponse, error) {
+	query := "*:*"
+	if len(req.Query) > 0 {
+		var err error
+		if query, err = translateQuery(req.Query); err != nil {
+			return nil, err
+		}
+	}
+	if q := first(params["q"]); q != "" {
+		if err := s.checkQuery(q); err != nil {
+			return nil, err
+		}
+		query = q
+	}
+
+	from, size := 0, 10
+	if req.From != nil {
+		from = *req.From
+	}
+	if req.Size != nil {
+		size = *req.Size
+	}
+	for name, value := range map[string]*int{"from": &from, "size": &size} {
+		if text := first(params[name]); text != "" {
+			n, err := strconv.Atoi(text)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s must be an integer", errBadRequest, name)
+			}
+			*value = n
+		}
+	}
+	if from < 0 || size < 0 {
+		return nil, fmt.Errorf("%w: from and size must not be negative", errBadRequest)
+	}
+	if from+size > maxResultWindow {
+		return nil, fmt.Errorf("%w: result window is too large, from + size must be at most %d", errBadRequest, maxResultWindow)
+	}
+	options := documentstore.SearchOptions{Offset: from, Limit: size, SortBy: documentstore.SortByRelevance, SuggestBelow: -1}
+	if size == 0 {
+		// A limit of 0 means every match; the one asked for is dropped
+		options.Limit = 1
+	}
+
+	var err error
+	sortBy := req.Sort
+	if text := first(params["sort"]); text != "" {
+		sortBy = sortParam(text)
+	}
+	if len(sortBy) > 0 {
+		if options.SortBy, options.Reverse, err = translateSort(sortBy); err != nil {
+			return nil, err
+		}
+	}
+	source := req.Source
+	if text := first(params["_source"]); text != "" {
+		source = sourceParam(text)
+	}
+	includes, whole, err := translateSource(source)
+	if err != nil {
+		return nil, err
+	}
+	aggs := req.Aggs
+	if aggs == nil {
+		aggs = req.Aggregations
+	}
+	var ranges map[string][]documentstore.NumericBucket
+	if options.Facets, ranges, err = translateAggregations(aggs); err != nil {
+		return nil, err
+	}
+	timeout := req.Timeout
+	if text := first(params["timeout"]); text != "" {
+		timeout = text
+	}
+	var limit time.Duration
+	if timeout != "" {
+		if limit, err = parseTimeValue(timeout); err != nil {
+			return nil, err
+		}
+	}
+	if options.Timeout, err = s.searchTimeout(limit); err != nil {
+		return nil, err
+	}
+
+	s.degrade(&options)
+	s.gate(ctx, query, &options)
+	started := time.Now()
+	page, err := s.db.SearchPageContext(ctx, query, options)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	s.record(ctx, query, started, page)
+	if size == 0 {
+		page.Results = nil
+	}
+
+	if index == "" {
+		index = defaultIndex
+	}
+	resp := &openSearchResponse{
+		TimedOut: page.TimedOut,
+		Shards:   openSearchShards{Total: 1, Successful: 1},
+		Hits: openSearchHits{
+			Total: openSearchTotal{Value: page.Total, Relation: "eq"},
+			Hits:  make([]openSearchHit, len(page.Results)),
+		},
+	}
+	relevance := options.SortBy == documentstore.SortByRelevance
+	for i, result := range page.Results {
+		hit := openSearchHit{Index: index, ID: result.Document.ID}
+		s.recordHit(result.Document)
+		if relevance {
+			score := result.Score
+			hit.Score = &score
+			if resp.Hits.MaxScore == nil || score > *resp.Hits.MaxScore {
+				resp.Hits.MaxScore = &score
+			}
+		} else {
+			date := result.Document.CreatedAt
+			if options.SortBy == documentstore.SortByUpdatedAt {
+				date = result.Document.UpdatedAt
+			}
+			hit.Sort = []interface{}{date.UnixMilli()}
+		}
+		if whole || len(includes) > 0 {
+			hit.Source = sourceOf(result.Document, includes)
+		}
+		resp.Hits.Hits[i] = hit
+	}
+	if len(options.Facets) > 0 {
+		resp.Aggregations = make(map[string]interface{}, len(options.Facets))
+		for _, request := range options.Facets {
+			resp.Aggregations[request.Name] = aggregationOf(request, page.Facets[request.Name], ranges[request.Name])
+		}
+	}
+	return resp, nil
+}
+
+// timeUnits are the units of Elasticsearch time values
+var timeUnits = map[string]time.Duration{
+	"d":      24 * time.Hour,
+	"h":      time.Hour,
+	"m":      time.Minute,
+	"s":      time.Second,
+	"ms":     time.Millisecond,
+	"micros": time.Microsecond,
+	"nanos":  time.Nanosecond,
+}
+
+// parseTimeValue reads an Elasticsearch time value such as 500ms or 2s
+func parseTimeValue(text string) (time.Duration, error) {
+	digits := strings.TrimRightFunc(text, unicode.IsLetter)
+	unit, ok := timeUnits[text[len(digits):]]
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: failed to parse time value [%s], want a number and a unit such as 500ms", errBadRequest, text)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// translateQuery turns a query of the query DSL into the query language
+func translateQuery(raw json.RawMessage) (string, error) {
+	kind, body, err := singleKey(raw, "query")
+	if err != nil {
+		return "", err
+	}
+	switch kind {
+	case "match_all":
+		return "*:*", nil
+	case "match_none":
+		return matchNone, nil
+	case "match":
+		return translateMatch(body)
+	case "match_phrase":
+		field, value, err := fieldQuery(body, "query")
+		if err != nil {
+			return "", err
+		}
+		name, text, err := dslField(field)
+		if err != nil {
+			return "", err
+		}
+		if !text {
+			return metadataClause(name, value)
+		}
+		if len(words(value)) == 0 {
+			return matchNone, nil
+		}
+		return name + `"` + strings.ReplaceAll(value, `"`, " ") + `"`, nil
+	case "term":
+		field, value, err := fieldQuery(body, "value")
+		if err != nil {
+			return "", err
+		}
+		return termClause(field, value)
+	case "terms":
+		return translateTerms(body)
+	case "range":
+		return translateRange(body)
+	case "exists":
+		var exists struct {
+			Field string `json:"field"`
+		}
+		if err := strictDecode(body, &exists); err != nil {
+			return "", fmt.Errorf("%w: [exists] %v", errParsing, err)
+		}
+		name, _, err := dslField(exists.Field)
+		if err != nil {
+			return "", err
+		}
+		return name + "*", nil
+	case "bool":
+		return translateBool(body)
+	}
+	return "", fmt.Errorf("%w: unknown or unsupported query [%s]", errParsing, kind)
+}
+
+// matchNone is a clause matching no document
+const matchNone = "NOT *:*"
+
+func translateMatch(body json.RawMessage) (string, error) {
+	field, options, err := singleKey(body, "match")
+	if err != nil {
+		return "", err
+	}
+	match := struct {
+		Query     json.RawMessage `json:"query"`
+		Operator  string          `json:"operator"`
+		Fuzziness json.RawMessage `json:"fuzziness"`
+	}{Query: options}
+	if bytes.HasPrefix(bytes.TrimSpace(options), []byte("{")) {
+		match.Query = nil
+		if err := strictDecode(options, &match); err != nil {
+			return "", fmt.Errorf("%w: [match] %v", errParsing, err)
+		}
+	}
+	value, err := scalar(match.Query)
+	if err != nil {
+		return "", fmt.Errorf("%w: [match] %v", errParsing, err)
+	}
+	name, text, err := dslField(field)
+	if err != nil {
+		return "", err
+	}
+	if !text {
+		return metadataClause(name, value)
+	}
+	var suffix string
+	if len(match.Fuzziness) > 0 {
+		fuzziness, err := scalar(match.Fuzziness)
+		if err != nil {
+			return "", fmt.Errorf("%w: [match] %v", errParsing, err)
+		}
+		switch strings.ToUpper(fuzziness) {
+		case "0":
+		case "AUTO":
+			suffix = "~"
+		case "1", "2":
+			suffix = "~" + fuzziness
+		default:
+			return "", fmt.Errorf("%w: [match] fuzziness must be AUTO, 0, 1 or 2", errParsing)
+		}
+	}
+	separator := " OR "
+	switch strings.ToLower(match.Operator) {
+	case "", "or":
+	case "and":
+		separator = " "
+	default:
+		return "", fmt.Errorf("%w: [match] operator must be and or or", errParsing)
+	}
+	clauses := words(value)
+	if len(clauses) == 0 {
+		return matchNone, nil
+	}
+	for i, word := range clauses {
+		clauses[i] = name + word + suffix
+	}
+	return group(clauses, separator), nil
+}
+
+func translateTerms(body json.RawMessage) (string, error) {
+	field, raw, err := singleKey(body, "terms")
+	if err != nil {
+		return "", err
+	}
+	var values []json.RawMessage
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return "", fmt.Errorf("%w: [terms] %s must be an array of values", errParsing, field)
+	}
+	if len(values) == 0 {
+		return matchNone, nil
+	}
+	clauses := make([]string, len(values))
+	for i, raw := range values {
+		value, err := scalar(raw)
+		if err != nil {
+			return "", fmt.Errorf("%w: [terms] %v", errParsing, err)
+		}
+		if clauses[i], err = termClause(field, value); err != nil {
+			return "", err
+		}
+	}
+	return group(clauses, " OR "), nil
+}
+
+// termClause matches a metadata value exactly, or a text field holding the
+// value's words
+func termClause(field, value string) (string, error) {
+	name, text, err := dslField(field)
+	if err != nil {
+		return "", err
+	}
+	if !text {
+		return metadataClause(name, value)
+	}
+	if len(words(value)) == 0 {
+		return matchNone, nil
+	}
+	return name + `"` + strings.ReplaceAll(value, `"`, " ") + `"`, nil
+}
+
+func translateRange(body json.RawMessage) (string, error) {
+	field, raw, err := singleKey(body, "range")
+	if err != nil {
+		return "", err
+	}
+	var bounds map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &bounds); err != nil {
+		return "", fmt.Errorf("%w: [range] %s must be an object of bounds", errParsing, field)
+	}
+	name, text, err := dslField(field)
+	if err != nil {
+		return "", err
+	}
+	if text {
+		return "", fmt.Errorf("%w: [range] only metadata fields have ranges, not %s", errBadRequest, field)
+	}
+	operators := map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+	var clauses []string
+	for _, bound := range []string{"gt", "gte", "lt", "lte"} {
+		raw, ok := bounds[bound]
+		if !ok {
+			continue
+		}
+		delete(bounds, bound)
+		value, err := scalar(raw)
+		if err != nil {
+			return "", fmt.Errorf("%w: [range] %v", errParsing, err)
+		}
+		if value == "" || strings.IndexFunc(value, unsafeRune) >= 0 {
+			return "", fmt.Errorf("%w: [range] bound %q can't be searched", errBadRequest, value)
+		}
+		clauses = append(clauses, name+operators[bound]+value)
+	}
+	delete(bounds, "boost")
+	for key := range bounds {
+		return "", fmt.Errorf("%w: [range] unsupported parameter [%s]", errParsing, key)
+	}
+	if len(clauses) == 0 {
+		return name + "*", nil
+	}
+	return group(clauses, " "), nil
+}
+
+func translateBool(body json.RawMessage) (string, error) {
+	var b struct {
+		Must               json.RawMessage `json:"must"`
+		Filter             json.RawMessage `json:"filter"`
+		Should             json.RawMessage `json:"should"`
+		MustNot            json.RawMessage `json:"must_not"`
+		MinimumShouldMatch json.RawMessage `json:"minimum_should_match"`
+		Boost              json.RawMessage `json:"boost"`
+	}
+	if err := strictDecode(body, &b); err != nil {
+		return "", fmt.Errorf("%w: [bool] %v", errParsing, err)
+	}
+	var clauses []string
+	for _, occur := range []json.RawMessage{b.Must, b.Filter} {
+		queries, err := translateQueries(occur)
+		if err != nil {
+			return "", err
+		}
+		clauses = append(clauses, queries...)
+	}
+	should, err := translateQueries(b.Should)
+	if err != nil {
+		return "", err
+	}
+	mustNot, err := translateQueries(b.MustNot)
+	if err != nil {
+		return "", err
+	}
+
+	// Should clauses are required when nothing else is, and otherwise only
+	// lift the scores of the documents they match
+	required := len(clauses) == 0
+	if len(b.MinimumShouldMatch) > 0 {
+		text, err := scalar(b.MinimumShouldMatch)
+		if err != nil {
+			return "", fmt.Errorf("%w: [bool] %v", errParsing, err)
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 || n > 1 {
+			return "", fmt.Errorf("%w: [bool] minimum_should_match may only be 0 or 1", errBadRequest)
+		}
+		required = n == 1
+	}
+	if len(should) > 0 {
+		if required {
+			clauses = append(clauses, group(should, " OR "))
+		} else {
+			clauses = append(clauses, group(append(should, "*:*"), " OR "))
+		}
+	}
+	for _, clause := range mustNot {
+		clauses = append(clauses, "NOT "+clause)
+	}
+	if len(clauses) == 0 {
+		return "*:*", nil
+	}
+	return group(clauses, " "), nil
+}
+
+// translateQueries translates a query or array of queries, each
+// parenthesized
+func translateQueries(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	items := []json.RawMessage{raw}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		items = nil
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, fmt.Errorf("%w: [bool] %v", errParsing, err)
+		}
+	}
+	clauses := make([]string, len(items))
+	for i, item := range items {
+		clause, err := translateQuery(item)
+		if err != nil {
+			return nil, err
+		}
+		clauses[i] = "(" + clause + ")"
+	}
+	return clauses, nil
+}
+
+// dslField maps a field of the query DSL to the query language's field
+// prefix, with the colon, reporting whether it searches text
+func dslField(field string) (string, bool, error) {
+	switch field {
+	case "":
+		return "", false, fmt.Errorf("%w: missing field", errParsing)
+	case "_all", "*":
+		return "", true, nil
+	case documentstore.FieldTitle, documentstore.FieldContent:
+		return field + ":", true, nil
+	}
+	key := strings.TrimPrefix(field, documentstore.ColumnMetadata+".")
+	if key == "" || strings.IndexFunc(key, unsafeRune) >= 0 || strings.ContainsRune(key, ':') {
+		return "", false, fmt.Errorf("%w: field %q can't be searched", errBadRequest, field)
+	}
+	return documentstore.ColumnMetadata + "." + key + ":", false, nil
+}
+
+// metadataClause matches a metadata value exactly, escaping the wildcards
+// metadata clauses otherwise match by
+func metadataClause(name, value string) (string, error) {
+	if strings.ContainsRune(value, '"') {
+		return "", fmt.Errorf("%w: values with double quotes can't be searched", errBadRequest)
+	}
+	if strings.ContainsAny(value, "*?") {
+		var escaped strings.Builder
+		for _, r := range value {
+			if strings.ContainsRune(`*?[\`, r) {
+				escaped.WriteByte('\\')
+			}
+			escaped.WriteRune(r)
+		}
+		value = escaped.String()
+	}
+	return name + `"` + value + `"`, nil
+}
+
+// unsafeRune reports whether r would end a word of the query language
+func unsafeRune(r rune) bool {
+	return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"'
+}
+
+// words splits text into the letters and digits the query language
+// searches for, leaving out punctuation it would read as syntax
+func words(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// group joins clauses, parenthesizing more than one
+func group(clauses []string, separator string) string {
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	return "(" + strings.Join(clauses, separator) + ")"
+}
+
+// fieldQuery reads a {"field": value} or {"field": {"<key>": value}}
+// query
+func fieldQuery(body json.RawMessage, key string) (string, string, error) {
+	field, raw, err := singleKey(body, "query")
+	if err != nil {
+		return "", "", err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		var options map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &options); err != nil {
+			return "", "", fmt.Errorf("%w: %v", errParsing, err)
+		}
+		var ok bool
+		if raw, ok = options[key]; !ok {
+			return "", "", fmt.Errorf("%w: [%s] missing [%s]", errParsing, field, key)
+		}
+		delete(options, key)
+		delete(options, "boost")
+		for option := range options {
+			return "", "", fmt.Errorf("%w: [%s] unsupported parameter [%s]", errParsing, field, option)
+		}
+	}
+	value, err := scalar(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: [%s] %v", errParsing, field, err)
+	}
+	return field, value, nil
+}
+
+// singleKey reads an object holding one key, such as a query
+func singleKey(raw json.RawMessage, what string) (string, json.RawMessage, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return "", nil, fmt.Errorf("%w: [%s] must be an object", errParsing, what)
+	}
+	if len(object) != 1 {
+		return "", nil, fmt.Errorf("%w: [%s] must hold exactly one key, not %d", errParsing, what, len(object))
+	}
+	for key, value := range object {
+		return key, value, nil
+	}
+	return "", nil, nil
+}
+
+// scalar reads a string, number or bool as text
+func scalar(raw json.RawMessage) (string, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("missing value")
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("%s is not a string, number or bool", raw)
+}
+
+func strictDecode(raw json.RawMessage, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// translateSort reads a sort: "_score", a field name, {"field": "asc"},
+// {"field": {"order": "asc"}} or an array of them. Only one sort key is
+// supported, though _doc may follow it as a tie breaker.
+func translateSort(raw json.RawMessage) (documentstore.SortField, bool, error) {
+	items := []json.RawMessage{raw}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		items = nil
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return "", false, fmt.Errorf("%w: [sort] %v", errParsing, err)
+		}
+	}
+	var keys []string
+	orders := make(map[string]string)
+	for _, item := range items {
+		field, order := "", ""
+		if err := json.Unmarshal(item, &field); err != nil {
+			var spec json.RawMessage
+			if field, spec, err = singleKey(item, "sort"); err != nil {
+				return "", false, err
+			}
+			if err := json.Unmarshal(spec, &order); err != nil {
+				var options struct {
+					Order string `json:"order"`
+				}
+				if err := json.Unmarshal(spec, &options); err != nil {
+					return "", false, fmt.Errorf("%w: [sort] %v", errParsing, err)
+				}
+				order = options.Order
+			}
+		}
+		if field == "_doc" {
+			continue
+		}
+		keys = append(keys, field)
+		orders[field] = strings.ToLower(order)
+	}
+	switch len(keys) {
+	case 0:
+		return documentstore.SortByRelevance, false, nil
+	case 1:
+	default:
+		return "", false, fmt.Errorf("%w: only one sort key is supported", errBadRequest)
+	}
+	field, order := keys[0], orders[keys[0]]
+	if order != "" && order != "asc" && order != "desc" {
+		return "", false, fmt.Errorf("%w: [sort] order must be asc or desc", errParsing)
+	}
+	switch field {
+	case "_score":
+		return documentstore.SortByRelevance, order == "asc", nil
+	case documentstore.ColumnCreatedAt:
+		return documentstore.SortByCreatedAt, order == "desc", nil
+	case documentstore.ColumnUpdatedAt:
+		return documentstore.SortByUpdatedAt, order == "desc", nil
+	}
+	return "", false, fmt.Errorf("%w: can only sort by _score, created_at or updated_at, not %s", errBadRequest, field)
+}
+
+// sortParam turns a sort URL parameter such as created_at:desc into the
+// body's form
+func sortParam(text string) json.RawMessage {
+	var items []map[string]string
+	for _, item := range strings.Split(text, ",") {
+		field, order, _ := strings.Cut(item, ":")
+		items = append(items, map[string]string{field: order})
+	}
+	raw, _ := json.Marshal(items)
+	return raw
+}
+
+// translateSource reads _source: true or false, a field or fields, or
+// {"includes": [...]}. It returns the fields to include, or whether whole
+// documents are.
+func translateSource(raw json.RawMessage) ([]string, bool, error) {
+	if len(raw) == 0 {
+		return nil, true, nil
+	}
+	var whole bool
+	if err := json.Unmarshal(raw, &whole); err == nil {
+		return nil, whole, nil
+	}
+	var field string
+	if err := json.Unmarshal(raw, &field); err == nil {
+		return []string{field}, false, nil
+	}
+	var fields []string
+	if err := json.Unmarshal(raw, &fields); err == nil {
+		return fields, len(fields) == 0, nil
+	}
+	var filter struct {
+		Includes []string `json:"includes"`
+	}
+	if err := strictDecode(raw, &filter); err != nil {
+		return nil, false, fmt.Errorf("%w: [_source] %v", errParsing, err)
+	}
+	return filter.Includes, len(filter.Includes) == 0, nil
+}
+
+// sourceParam turns a _source URL parameter into the body's form
+func sourceParam(text string) json.RawMessage {
+	if text == "true" || text == "false" {
+		return json.RawMessage(text)
+	}
+	raw, _ := json.Marshal(strings.Split(text, ","))
+	return raw
+}
+
+// sourceOf shows a document as _source, whole or only the included
+// fields. Fields other than title, content, created_at, updated_at and
+// metadata are metadata keys.
+func sourceOf(doc *documentstore.Document, includes []string) map[string]interface{} {
+	source := make(map[string]interface{})
+	if len(includes) == 0 {
+		includes = []string{documentstore.ColumnTitle, documentstore.ColumnContent, documentstore.ColumnMetadata,
+			documentstore.ColumnCreatedAt, documentstore.ColumnUpdatedAt}
+	}
+	for _, field := range includes {
+		switch field {
+		case documentstore.ColumnTitle:
+			source[field] = doc.Title
+		case documentstore.ColumnContent:
+			source[field] = doc.Content
+		case documentstore.ColumnCreatedAt:
+			source[field] = doc.CreatedAt
+		case documentstore.ColumnUpdatedAt:
+			source[field] = doc.UpdatedAt
+		case documentstore.ColumnMetadata:
+			source[field] = doc.Metadata
+		default:
+			key := strings.TrimPrefix(field, documentstore.ColumnMetadata+".")
+			value, ok := doc.Metadata[key]
+			if !ok {
+				continue
+			}
+			metadata, _ := source[documentstore.ColumnMetadata].(map[string]string)
+			if metadata == nil {
+				metadata = make(map[string]string)
+				source[documentstore.ColumnMetadata] = metadata
+			}
+			metadata[key] = value
+		}
+	}
+	return source
+}
+
+// calendarIntervals map date_histogram intervals to facet intervals
+var calendarIntervals = map[string]string{
+	"hour": documentstore.IntervalHour, "1h": documentstore.IntervalHour,
+	"day": documentstore.IntervalDay, "1d": documentstore.IntervalDay,
+	"week": documentstore.IntervalWeek, "1w": documentstore.IntervalWeek,
+	"month": documentstore.IntervalMonth, "1M": documentstore.IntervalMonth,
+	"year": documentstore.IntervalYear, "1y": documentstore.IntervalYear,
+}
+
+// translateAggregations turns aggregations into facet requests named
+// after them, returning the ranges of range aggregations as asked for
+func translateAggregations(aggs map[string]json.RawMessage) ([]documentstore.FacetRequest, map[string][]documentstore.NumericBucket, error) {
+	var requests []documentstore.FacetRequest
+	ranges := make(map[string][]documentstore.NumericBucket)
+	for name, raw := range aggs {
+		kind, body, err := singleKey(raw, "aggs")
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: aggregation [%s] must have one type and no sub-aggregations", errParsing, name)
+		}
+		var agg struct {
+			Field            string `json:"field"`
+			Size             int    `json:"size"`
+			CalendarInterval string `json:"calendar_interval"`
+			Interval         string `json:"interval"`
+			Ranges           []struct {
+				Key  string   `json:"key"`
+				From *float64 `json:"from"`
+				To   *float64 `json:"to"`
+			} `json:"ranges"`
+		}
+		if err := strictDecode(body, &agg); err != nil {
+			return nil, nil, fmt.Errorf("%w: aggregation [%s] %v", errParsing, name, err)
+		}
+		request := documentstore.FacetRequest{Name: name, Field: aggregationField(agg.Field)}
+		switch kind {
+		case "terms":
+			request.Kind = documentstore.FacetTerms
+			request.Size = agg.Size
+		case "date_histogram":
+			request.Kind = documentstore.FacetDateHistogram
+			interval := agg.CalendarInterval
+			if interval == "" {
+				interval = agg.Interval
+			}
+			var ok bool
+			if request.Interval, ok = calendarIntervals[interval]; !ok {
+				return nil, nil, fmt.Errorf("%w: aggregation [%s] has unsupported interval %q", errBadRequest, name, interval)
+			}
+		case "range":
+			request.Kind = documentstore.FacetRange
+			for _, r := range agg.Ranges {
+				request.Ranges = append(request.Ranges, documentstore.NumericBucket{Key: r.Key, From: r.From, To: r.To})
+			}
+			ranges[name] = request.Ranges
+		default:
+			return nil, nil, fmt.Errorf("%w: unsupported aggregation type [%s]", errParsing, kind)
+		}
+		requests = append(requests, request)
+	}
+	return requests, ranges, nil
+}
+
+// aggregationField maps an aggregation's field to a facet field: dates of
+// documents stay as they are and anything else is a metadata key
+func aggregationField(field string) string {
+	switch field {
+	case documentstore.ColumnCreatedAt, documentstore.ColumnUpdatedAt, documentstore.ColumnExpiresAt:
+		return field
+	}
+	return documentstore.ColumnMetadata + "." + strings.TrimPrefix(field, documentstore.ColumnMetadata+".")
+}
+
+// aggregationOf shows a facet as the aggregation it answers
+func aggregationOf(request documentstore.FacetRequest, facet documentstore.Facet, ranges []documentstore.NumericBucket) map[string]interface{} {
+	buckets := make([]map[string]interface{}, len(facet.Buckets))
+	for i, bucket := range facet.Buckets {
+		b := map[string]interface{}{"key": bucket.Key, "doc_count": bucket.Count}
+		switch request.Kind {
+		case documentstore.FacetDateHistogram:
+			if start, err := time.Parse(time.RFC3339, bucket.Key); err == nil {
+				b["key"] = start.UnixMilli()
+				b["key_as_string"] = bucket.Key
+			}
+		case documentstore.FacetRange:
+			if i < len(ranges) {
+				if ranges[i].From != nil {
+					b["from"] = *ranges[i].From
+				}
+				if ranges[i].To != nil {
+					b["to"] = *ranges[i].To
+				}
+			}
+		}
+		buckets[i] = b
+	}
+	agg := map[string]interface{}{"buckets": buckets}
+	if request.Kind == documentstore.FacetTerms {
+		agg["doc_count_error_upper_bound"] = 0
+		agg["sum_other_doc_count"] = facet.Other
+	}
+	return agg
+}
+
+// writeOpenSearchError answers with Elasticsearch's error body
+func writeOpenSearchError(w http.ResponseWriter, status int, kind, reason string) {
+	var body openSearchError
+	body.Error.openSearchCause = openSearchCause{Type: kind, Reason: reason}
+	body.Error.RootCause = []openSearchCause{body.Error.openSearchCause}
+	body.Status = status
+	httpjson.Write(w, status, body)
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,474 @@
+package searchserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"pkg/degradation"
+	"pkg/feature_flags"
+	apikeys "storage/api_keys"
+	documentstore "storage/document_store"
+	queryanalytics "storage/query_analytics"
+)
+
+// Options bounds what clients may ask of a Server
+type Options struct {
+	MaxQueryBytes int // Longest query accepted
+	DefaultLimit  int // Hits per page when a search doesn't say
+	MaxLimit      int // Most hits a page may ask for
+	SnippetLength int // Characters of content shown under each hit
+	// MaxCompletions is the most completions a suggestion may ask for,
+	// and how many it gets when it doesn't say
+	MaxCompletions int
+	// SearchTimeout is the longest a search looks for matches before
+	// answering with those found so far, marked timed out. Requests may
+	// ask for less.
+	SearchTimeout time.Duration
+}
+
+// DefaultOptions suit a search box: ten hits a page, at most a hundred
+var DefaultOptions = Options{
+	MaxQueryBytes:  1024,
+	DefaultLimit:   10,
+	MaxLimit:       100,
+	SnippetLength:  documentstore.DefaultSnippetLength,
+	MaxCompletions: 10,
+	SearchTimeout:  5 * time.Second,
+}
+
+// Server answers end users' searches over a DocumentDB: ranked hits with
+// snippets and facets, completions of queries being typed, related
+// documents and the documents hits point to. Unlike a documentserver.Server it only reads.
+type Server struct {
+	db        *documentstore.DocumentDB
+	options   Options
+	analytics *queryanalytics.Analytics // Nil unless searches are recorded
+	metrics   Metrics
+	governor  *degradation.Governor   // Nil unless searches degrade under resource pressure
+	flags     *feature_flags.Registry // Nil unless features are rolled out by flag
+	hits      HitRecorder             // Nil unless hits are charged to their domains
+}
+
+// HitRecorder is told the URL of every crawled page a search returns, such
+// as a domain_costs.Reporter charging the hit to its domain
+type HitRecorder interface {
+	RecordQueryHit(rawURL string)
+}
+
+// NewServer returns a search server for db; zero options take their
+// DefaultOptions values
+func NewServer(db *documentstore.DocumentDB, options Options) *Server {
+	if options.MaxQueryBytes <= 0 {
+		options.MaxQueryBytes = DefaultOptions.MaxQueryBytes
+	}
+	if options.DefaultLimit <= 0 {
+		options.DefaultLimit = DefaultOptions.DefaultLimit
+	}
+	if options.MaxLimit <= 0 {
+		options.MaxLimit = DefaultOptions.MaxLimit
+	}
+	if options.SnippetLength <= 0 {
+		options.SnippetLength = DefaultOptions.SnippetLength
+	}
+	if options.MaxCompletions <= 0 {
+		options.MaxCompletions = DefaultOptions.MaxCompletions
+	}
+	if options.SearchTimeout <= 0 {
+		options.SearchTimeout = DefaultOptions.SearchTimeout
+	}
+	return &Server{db: db, options: options, metrics: noopMetrics{}}
+}
+
+// SetAnalytics records every search and the clicks reported on /feedback
+// in a; call it before serving
+func (s *Server) SetAnalytics(a *queryanalytics.Analytics) {
+	s.analytics = a
+}
+
+// SetDegradation sheds the expensive parts of searches while g reports
+// resource pressure: facets, re-ranking beyond its window and, under
+// critical pressure, searches the query cache doesn't hold. Call it before
+// serving.
+func (s *Server) SetDegradation(g *degradation.Governor) {
+	s.governor = g
+}
+
+// SetHitRecorder tells r the URL of every crawled page searches return.
+// Call it before serving.
+func (s *Server) SetHitRecorder(r HitRecorder) {
+	s.hits = r
+}
+
+// SetFeatureFlags gates features of searches behind flags in r: the
+// re-ranking model runs only for the searches FlagNewRanker is enabled
+// for, by the API key's ID as the tenant and the query as the rollout key.
+// Call it before serving.
+func (s *Server) SetFeatureFlags(r *feature_flags.Registry) {
+	s.flags = r
+}
+
+// SearchRequest is a search as clients send it, over HTTP as parameters
+// and over gRPC as the SearchRequest message
+type SearchRequest struct {
+	Query   string
+	Limit   int    // Hits per page; 0 means Options.DefaultLimit
+	Cursor  string // A previous page's NextCursor, to continue after it
+	Sort    string // relevance (the default), created_at, updated_at or distance
+	Reverse bool
+	// Facets aggregate every match, in the short form ParseFacet reads,
+	// such as "terms:metadata.language"
+	Facets []string
+	// For sorting by distance, the point to measure from as "lat,lon" and
+	// the location field, such as "metadata.place"
+	Origin   string
+	GeoField string
+	// Timeout gives up on the search sooner than Options.SearchTimeout; 0
+	// means that
+	Timeout time.Duration
+}
+
+// Hit is a matching document as a results page shows it
+type Hit struct {
+	ID       string            `json:"id"`
+	Score    float64           `json:"score"`
+	Title    string            `json:"title"`
+	URL      string            `json:"url,omitempty"`
+	Snippet  string            `json:"snippet"` // HTML, see DocumentDB.Snippet
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// SearchResponse is a page of hits
+type SearchResponse struct {
+	Query      string                         `json:"query"`
+	Total      int                            `json:"total"`
+	Hits       []Hit                          `json:"hits"`
+	Facets     map[string]documentstore.Facet `json:"facets,omitempty"`
+	NextCursor string                         `json:"next_cursor,omitempty"`
+	Suggestion string                         `json:"suggestion,omitempty"` // A corrected query matching more
+	// TimedOut is set when the search ran out of time; the hits, facets
+	// and total then cover only the matches found by then
+	TimedOut bool `json:"timed_out"`
+	// QueryID identifies the search when clicks on its hits are reported;
+	// empty unless searches are recorded
+	QueryID string `json:"query_id,omitempty"`
+	// Degraded lists the resources under pressure when the search was
+	// answered in degraded mode: without facets, with fewer matches
+	// re-ranked or, under critical pressure, from the query cache alone,
+	// with no hits if it didn't hold the query
+	Degraded []string `json:"degraded,omitempty"`
+}
+
+// RelatedResponse lists the documents most like one, as MoreLikeThis finds
+// them
+type RelatedResponse struct {
+	ID   string `json:"id"`
+	Hits []Hit  `json:"hits"`
+}
+
+// SuggestResponse completes and corrects a query being typed
+type SuggestResponse struct {
+	Query       string   `json:"query"`
+	Completions []string `json:"completions"`
+	Correction  string   `json:"correction,omitempty"`
+}
+
+// errorResponse is the body of every failed HTTP request
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// metadataURL is the metadata key crawled documents keep their URL under
+const metadataURL = "url"
+
+// sortFields are the orders a search may ask for
+var sortFields = map[string]documentstore.SortField{
+	"":           documentstore.SortByRelevance,
+	"relevance":  documentstore.SortByRelevance,
+	"created_at": documentstore.SortByCreatedAt,
+	"updated_at": documentstore.SortByUpdatedAt,
+	"distance":   documentstore.SortByDistance,
+}
+
+// checkQuery rejects queries clients shouldn't send
+func (s *Server) checkQuery(query string) error {
+	if strings.TrimSpace(query) == "" {
+		return fmt.Errorf("%w: missing query", errBadRequest)
+	}
+	if len(query) > s.options.MaxQueryBytes {
+		return fmt.Errorf("%w: query longer than %d bytes", errBadRequest, s.options.MaxQueryBytes)
+	}
+	return nil
+}
+
+// searchOptions checks a search request and turns it into the options
+// selecting its page
+func (s *Server) searchOptions(req SearchRequest) (documentstore.SearchOptions, error) {
+	options := documentstore.SearchOptions{Limit: req.Limit, Cursor: req.Cursor, Reverse: req.Reverse, GeoField: req.GeoField}
+	if err := s.checkQuery(req.Query); err != nil {
+		return options, err
+	}
+	if options.Limit == 0 {
+		options.Limit = s.options.DefaultLimit
+	}
+	if options.Limit < 1 || options.Limit > s.options.MaxLimit {
+		return options, fmt.Errorf("%w: limit must be from 1 to %d", errBadRequest, s.options.MaxLimit)
+	}
+	var ok bool
+	if options.SortBy, ok = sortFields[req.Sort]; !ok {
+		return options, fmt.Errorf("%w: sort must be relevance, created_at, updated_at or distance", errBadRequest)
+	}
+	if req.Origin != "" {
+		var err error
+		if options.Origin, err = documentstore.ParseGeoPoint(req.Origin); err != nil {
+			return options, fmt.Errorf("%w: bad origin %q: %v", errBadRequest, req.Origin, err)
+		}
+	}
+	for _, spec := range req.Facets {
+		facet, err := documentstore.ParseFacet(spec)
+		if err != nil {
+			return options, fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		options.Facets = append(options.Facets, facet)
+	}
+	var err error
+	if options.Timeout, err = s.searchTimeout(req.Timeout); err != nil {
+		return options, err
+	}
+	return options, nil
+}
+
+// degrade sheds the expensive parts of a search while the governor reports
+// resource pressure, returning the resources under it
+func (s *Server) degrade(options *documentstore.SearchOptions) []string {
+	if s.governor == nil {
+		return nil
+	}
+	policy := s.governor.Policy()
+	if !policy.Degraded {
+		return nil
+	}
+	if policy.DisableAggregations {
+		options.Facets = nil
+	}
+	options.RerankTopN = policy.RerankWindow
+	options.CacheOnly = policy.CacheOnly
+	return policy.Reasons
+}
+
+// gate turns off the features of a search that their flags don't enable
+// for it
+func (s *Server) gate(ctx context.Context, query string, options *documentstore.SearchOptions) {
+	if s.flags == nil {
+		return
+	}
+	target := feature_flags.Target{Key: query}
+	if key, ok := apikeys.KeyFromContext(ctx); ok {
+		target.Tenant = key.ID
+	}
+	if !s.flags.Enabled(feature_flags.FlagNewRanker, target) {
+		options.RerankTopN = -1
+	}
+}
+
+// searchTimeout returns how long a search asking for timeout may run
+func (s *Server) searchTimeout(timeout time.Duration) (time.Duration, error) {
+	if timeout < 0 {
+		return 0, fmt.Errorf("%w: timeout must not be negative", errBadRequest)
+	}
+	if timeout == 0 || timeout > s.options.SearchTimeout {
+		return s.options.SearchTimeout, nil
+	}
+	return timeout, nil
+}
+
+// search runs a query and shapes the page it selects into hits. It stops
+// early when ctx ends, such as when the client goes away.
+func (s *Server) search(ctx context.Context, req SearchRequest) (SearchResponse, error) {
+	started := time.Now()
+	options, err := s.searchOptions(req)
+	if err != nil {
+		return SearchResponse{}, err
+	}
+	degraded := s.degrade(&options)
+	s.gate(ctx, req.Query, &options)
+	page, err := s.db.SearchPageContext(ctx, req.Query, options)
+	if err != nil {
+		// Only a bad query, cursor or sort order fails a page
+		return SearchResponse{}, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	resp := SearchResponse{
+		Query:      req.Query,
+		Total:      page.Total,
+		Hits:       make([]Hit, len(page.Results)),
+		Facets:     page.Facets,
+		NextCursor: page.NextCursor,
+		Suggestion: page.Suggestion,
+		TimedOut:   page.TimedOut,
+		Degraded:   degraded,
+	}
+	for i, result := range page.Results {
+		resp.Hits[i] = s.hit(result, req.Query)
+	}
+	resp.QueryID = s.record(ctx, req.Query, started, page)
+	return resp, nil
+}
+
+// record adds a search answered with page to the analytics, if searches
+// are recorded, and returns its query ID. The search is noted for the
+// metrics of the request in ctx too.
+func (s *Server) record(ctx context.Context, query string, started time.Time, page documentstore.Page) string {
+	var queryID string
+	if s.analytics != nil {
+		hits := make([]string, len(page.Results))
+		for i, result := range page.Results {
+			hits[i] = result.Document.ID
+		}
+		queryID = s.analytics.Record(queryanalytics.Search{
+			Query:    query,
+			Latency:  time.Since(started),
+			Results:  page.Total,
+			TimedOut: page.TimedOut,
+			Hits:     hits,
+		})
+	}
+	if seen, ok := ctx.Value(observationKey{}).(*observation); ok {
+		*seen = observation{searched: true, results: page.Total, timedOut: page.TimedOut, queryID: queryID}
+	}
+	return queryID
+}
+
+// feedback records a click or skip on a hit of a recorded search
+func (s *Server) feedback(click queryanalytics.Click) error {
+	if s.analytics == nil {
+		return fmt.Errorf("%w: searches aren't recorded", errFeedbackOff)
+	}
+	if err := s.analytics.RecordClick(click); err != nil {
+		if errors.Is(err, queryanalytics.ErrUnknownQuery) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return nil
+}
+
+// hit shows a result of query, recording it as a hit of the page's domain
+// unless it isn't the result of a query
+func (s *Server) hit(result documentstore.SearchResult, query string) Hit {
+	doc := result.Document
+	if query != "" {
+		s.recordHit(doc)
+	}
+	return Hit{
+		ID:       doc.ID,
+		Score:    result.Score,
+		Title:    doc.Title,
+		URL:      doc.Metadata[metadataURL],
+		Snippet:  s.db.Snippet(doc, query, s.options.SnippetLength),
+		Metadata: doc.Metadata,
+	}
+}
+
+// recordHit tells the hit recorder, if one is set, that doc was returned
+func (s *Server) recordHit(doc *documentstore.Document) {
+	if url := doc.Metadata[metadataURL]; s.hits != nil && url != "" {
+		s.hits.RecordQueryHit(url)
+	}
+}
+
+// streamSearch sends every hit of a search in turn, best first, up to
+// req.Limit if it is set, stopping early if ctx ends or send fails. Facets
+// aren't computed for streams. A search that runs out of time streams the
+// hits it found and fails with DeadlineExceeded.
+func (s *Server) streamSearch(ctx context.Context, req SearchRequest, send func(Hit) error) error {
+	if req.Limit < 0 {
+		return fmt.Errorf("%w: limit must not be negative", errBadRequest)
+	}
+	started := time.Now()
+	options, err := s.searchOptions(SearchRequest{Query: req.Query, Cursor: req.Cursor, Sort: req.Sort, Reverse: req.Reverse,
+		Origin: req.Origin, GeoField: req.GeoField, Timeout: req.Timeout})
+	if err != nil {
+		return err
+	}
+	options.Limit = req.Limit
+	options.SuggestBelow = -1
+	s.degrade(&options)
+	s.gate(ctx, req.Query, &options)
+	page, err := s.db.SearchPageContext(ctx, req.Query, options)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	s.record(ctx, req.Query, started, page)
+	for _, result := range page.Results {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := send(s.hit(result, req.Query)); err != nil {
+			return err
+		}
+	}
+	if page.TimedOut {
+		return errTimedOut
+	}
+	return nil
+}
+
+// related returns hits for the limit documents most like document id
+func (s *Server) related(id string, limit int) ([]Hit, error) {
+	if limit == 0 {
+		limit = s.options.DefaultLimit
+	}
+	if limit < 1 || limit > s.options.MaxLimit {
+		return nil, fmt.Errorf("%w: limit must be from 1 to %d", errBadRequest, s.options.MaxLimit)
+	}
+	results, err := s.db.MoreLikeThis(id, limit)
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]Hit, len(results))
+	for i, result := range results {
+		hits[i] = s.hit(result, "")
+	}
+	return hits, nil
+}
+
+// suggest completes a query being typed, and corrects its spelling
+func (s *Server) suggest(query string, limit int) (SuggestResponse, error) {
+	if err := s.checkQuery(query); err != nil {
+		return SuggestResponse{}, err
+	}
+	if limit == 0 {
+		limit = s.options.MaxCompletions
+	}
+	if limit < 1 || limit > s.options.MaxCompletions {
+		return SuggestResponse{}, fmt.Errorf("%w: limit must be from 1 to %d", errBadRequest, s.options.MaxCompletions)
+	}
+	resp := SuggestResponse{Query: query, Completions: s.db.CompleteQuery(query, limit)}
+	if resp.Completions == nil {
+		resp.Completions = []string{}
+	}
+	resp.Correction, _ = s.db.SuggestQuery(query)
+	return resp, nil
+}
+
+// getDocument returns the given fields of a document, or all of them if
+// fields is empty
+func (s *Server) getDocument(id string, fields []string) (*documentstore.Document, error) {
+	doc, err := s.db.GetDocumentFields(id, fields)
+	if err != nil && !errors.Is(err, documentstore.ErrNotFound) {
+		// Only an unknown field fails otherwise
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return doc, err
+}
+
+// errBadRequest marks failures caused by the request rather than the store
+var errBadRequest = errors.New("bad request")
+
+// errFeedbackOff turns clicks away from a server not recording searches
+var errFeedbackOff = errors.New("feedback is off")
+
+// errTimedOut ends a stream of hits whose search ran out of time
+var errTimedOut = errors.New("search timed out; the hits sent are those found in time")